@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// Most parts an appended or composed file may be made of.
+const maxFileParts = 10000
+
+// Attempts at appending before giving up on concurrent appends.
+const appendAttempts = 10
+
+var errTooManyParts = fmt.Errorf("more than %v parts", maxFileParts)
+
+// The blobs making up a file, whether or not it's stored in parts.
+func fileParts(fm fileMeta) []blobPart {
+	if len(fm.Parts) > 0 {
+		return fm.Parts
+	}
+	if fm.Length == 0 {
+		return nil
+	}
+	return []blobPart{{fm.OID, fm.Length}}
+}
+
+// Store a request body as a blob on its own.
+func storeBodyBlob(fn string, req *http.Request) (blobPart, error) {
+	f, err := NewUploadRecord(pickVolume(), req.Header.Get("X-CBFS-Hash"))
+	if err != nil {
+		return blobPart{}, err
+	}
+	defer f.Close()
+
+	h, length, err := f.Process(req.Body)
+	if err != nil {
+		return blobPart{}, err
+	}
+	if err := recordBlobOwnership(h, length, true); err != nil {
+		return blobPart{}, err
+	}
+	if want := replicaTarget(fn); want > 1 {
+		go increaseReplicaCount(h, length, want-1)
+	}
+	return blobPart{h, length}, nil
+}
+
+// Store fm at fn made of the given parts.
+func storeComposed(fn string, fm fileMeta, parts []blobPart,
+	exp, revs int, header http.Header) (string, error) {
+
+	if len(parts) > maxFileParts {
+		return "", errTooManyParts
+	}
+	h, err := storePartsManifest(fn, parts)
+	if err != nil {
+		return "", err
+	}
+	fm.OID = h
+	fm.Parts = parts
+	fm.Length = partsLength(parts)
+	fm.Modified = time.Now().UTC()
+	return h, storeMeta(fn, exp, fm, revs, header)
+}
+
+func sendComposeError(w http.ResponseWriter, fn string, err error) {
+	if httpQuotaError(w, fn, err) || httpRetentionError(w, fn, err) {
+		return
+	}
+	switch err {
+	case errUploadPrecondition:
+		http.Error(w, "precondition failed", 412)
+	case errTooManyParts:
+		http.Error(w, err.Error(), 413)
+	default:
+		log.Printf("Error storing file meta of %v: %v", fn, err)
+		http.Error(w, fmt.Sprintf("Error recording file meta: %v", err), 500)
+	}
+}
+
+// How many old revisions to keep, defaulting to none since every
+// append would otherwise make one.
+func appendRevs(header http.Header) int {
+	if i, err := strconv.Atoi(header.Get("X-CBFS-KeepRevs")); err == nil {
+		return i
+	}
+	return 0
+}
+
+// POST /path?append=true adds the body to the end of the file as a
+// new part, creating the file if there isn't one.  Existing content
+// is referenced, not copied.
+func doAppendFile(w http.ResponseWriter, req *http.Request) {
+	fn, k := resolvePath(req)
+	if fn == "" || strings.Contains(fn, "//") {
+		http.Error(w, fmt.Sprintf("Invalid path name: %v", fn), 400)
+		return
+	}
+	if req.ContentLength == 0 {
+		http.Error(w, "Nothing to append", 400)
+		return
+	}
+	if code, err := decodeRequestBody(req); err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	part, err := storeBodyBlob(fn, req)
+	if err != nil {
+		log.Printf("Error storing append to %v: %v", fn, err)
+		http.Error(w, fmt.Sprintf("Error storing blob: %v", err), 500)
+		return
+	}
+
+	// Unless the client gave its own conditions, make sure nothing
+	// else changed the file between reading and writing it, and try
+	// again if something did.
+	conditional := req.Header.Get("If-Match") != "" ||
+		req.Header.Get("If-None-Match") != ""
+	var h string
+	for i := 0; i < appendAttempts; i++ {
+		existing := fileMeta{}
+		err = couchbase.Get(k, &existing)
+		exists := err == nil
+		if err != nil && !gomemcached.IsNotFound(err) {
+			break
+		}
+		if exists && existing.Type != "file" {
+			err = errors.New("not a file")
+			break
+		}
+
+		hdr := http.Header{}
+		for _, h := range []string{"If-Match", "If-None-Match"} {
+			if v := req.Header.Get(h); v != "" {
+				hdr.Set(h, v)
+			}
+		}
+		fm := fileMeta{Headers: storedHeaders(req.Header)}
+		if exists {
+			fm.Headers = existing.Headers
+			fm.Userdata = existing.Userdata
+			fm.Expires = existing.Expires
+			if !conditional {
+				hdr.Set("If-Match", fileETag(existing.OID))
+			}
+		} else if !conditional {
+			hdr.Set("If-None-Match", "*")
+		}
+
+		parts := append(fileParts(existing), part)
+		h, err = storeComposed(fn, fm, parts, getExpiration(req.Header),
+			appendRevs(req.Header), hdr)
+		if err != errUploadPrecondition || conditional {
+			break
+		}
+	}
+	if err != nil {
+		sendComposeError(w, fn, err)
+		return
+	}
+
+	log.Printf("Appended %v to %v -> %v", part.OID, fn, h)
+	w.Header().Set("Etag", fileETag(h))
+	w.WriteHeader(201)
+}
+
+// POST /.cbfs/compose/<dest>?source=a&source=b... makes dest the
+// concatenation of the sources, by reference.
+func doCompose(w http.ResponseWriter, req *http.Request, dest string) {
+	dest = strings.Trim(dest, "/")
+	sources := req.URL.Query()["source"]
+	switch {
+	case dest == "" || strings.Contains(dest, "//"):
+		http.Error(w, fmt.Sprintf("Invalid path name: %v", dest), 400)
+		return
+	case len(sources) == 0:
+		http.Error(w, "No sources given", 400)
+		return
+	}
+
+	fm := fileMeta{}
+	parts := []blobPart{}
+	for _, src := range sources {
+		src = strings.TrimLeft(src, "/")
+		got := fileMeta{}
+		err := couchbase.Get(shortName(src), &got)
+		switch {
+		case err == nil && got.Type == "file":
+		case err == nil || gomemcached.IsNotFound(err):
+			http.Error(w, "not found: "+src, 404)
+			return
+		default:
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if fm.Headers == nil {
+			fm.Headers = got.Headers
+		}
+		parts = append(parts, fileParts(got)...)
+	}
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		fm.Headers = http.Header{"Content-Type": {ct}}
+	}
+
+	// Preconditions given on the request apply to the destination.
+	hdr := http.Header{}
+	for _, h := range []string{"If-Match", "If-None-Match"} {
+		if v := req.Header.Get(h); v != "" {
+			hdr.Set(h, v)
+		}
+	}
+
+	revs := globalConfig.DefaultVersionCount
+	if i, err := strconv.Atoi(req.Header.Get("X-CBFS-KeepRevs")); err == nil {
+		revs = i
+	}
+
+	h, err := storeComposed(dest, fm, parts, getExpiration(req.Header),
+		revs, hdr)
+	if err != nil {
+		sendComposeError(w, dest, err)
+		return
+	}
+
+	log.Printf("Composed %v from %v -> %v (%v parts)",
+		dest, sources, h, len(parts))
+	w.Header().Set("Etag", fileETag(h))
+	w.WriteHeader(201)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFileParts(t *testing.T) {
+	tests := []struct {
+		fm  fileMeta
+		exp []blobPart
+	}{
+		{fileMeta{OID: "a", Length: 5}, []blobPart{{"a", 5}}},
+		{fileMeta{OID: "empty"}, nil},
+		{fileMeta{OID: "m", Length: 7, Parts: []blobPart{{"b", 3}, {"c", 4}}},
+			[]blobPart{{"b", 3}, {"c", 4}}},
+	}
+
+	for _, test := range tests {
+		if got := fileParts(test.fm); !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("Expected %v for %+v, got %v", test.exp, test.fm, got)
+		}
+	}
+}
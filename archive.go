@@ -0,0 +1,47 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Archive formats a subtree can be downloaded as.
+var archiveFormats = map[string]struct {
+	contentType string
+	write       func(w io.Writer, path string)
+}{
+	"tar":    {"application/x-tar", writeTar},
+	"tar.gz": {"application/gzip", writeTarGz},
+	"tgz":    {"application/gzip", writeTarGz},
+	"zip":    {"application/zip", writeZip},
+}
+
+func writeTarGz(w io.Writer, path string) {
+	gz := gzip.NewWriter(w)
+	defer gz.Close()
+	writeTar(gz, path)
+}
+
+// Stream an archive of everything under path in the format asked for
+// (tar.gz by default).
+func doArchiveDocs(w http.ResponseWriter, req *http.Request,
+	path string) {
+
+	format := req.FormValue("format")
+	if format == "" {
+		format = "tar.gz"
+	}
+	af, ok := archiveFormats[format]
+	if !ok {
+		http.Error(w, "Unsupported archive format: "+format, 400)
+		return
+	}
+
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=%q", archiveFilename(path, format)))
+	w.Header().Set("Content-Type", af.contentType)
+	w.WriteHeader(200)
+	af.write(w, path)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestArchiveBadFormat(t *testing.T) {
+	req := httptest.NewRequest("GET", archivePrefix+"some/dir?format=rar", nil)
+	w := httptest.NewRecorder()
+	doArchiveDocs(w, req, "some/dir")
+	if w.Code != 400 {
+		t.Errorf("Expected 400 for an unknown format, got %v", w.Code)
+	}
+}
+
+func TestArchiveFilenameFormats(t *testing.T) {
+	for format := range archiveFormats {
+		exp := "dir." + format
+		if got := archiveFilename("some/dir/", format); got != exp {
+			t.Errorf("Expected %q for %v, got %q", exp, format, got)
+		}
+	}
+}
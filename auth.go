@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/hmac"
+	"net/http"
+	"strings"
+
+	"github.com/couchbaselabs/cbfs/config"
+)
+
+// Carries the cluster's node secret on requests between nodes.
+const nodeAuthHeader = "X-CBFS-Node-Auth"
+
+// A permission needed on a path to serve a request.
+type access struct {
+	path string
+	perm byte
+}
+
+func methodPerm(method string) byte {
+	switch method {
+	case "GET", "HEAD":
+		return cbfsconfig.PermRead
+	case "DELETE":
+		return cbfsconfig.PermDelete
+	}
+	return cbfsconfig.PermWrite
+}
+
+// Paths under these prefixes act on the user file named by the rest.
+// Locks are named, and so permitted, like the files they guard.
+var userPathPrefixes = []string{listPrefix, fileInfoPrefix, chunksPrefix,
+	zipPrefix, tarPrefix, archivePrefix, extractPrefix, revisionsPrefix,
+	metaPrefix, formUploadPrefix, findPrefix, duPrefix, retentionPrefix,
+	locksPrefix}
+
+// Cluster information any authenticated user may read, since clients
+// need it for ordinary operations.
+var publicPaths = []string{nodePrefix, blobInfoPath, pingPrefix}
+
+// What a request needs to be allowed.  If open is true, any
+// authenticated user may make it.
+func requiredAccess(req *http.Request) (needs []access, open bool) {
+	p := req.URL.Path
+	perm := methodPerm(req.Method)
+
+	if !strings.HasPrefix(p, "/.cbfs/") {
+		path := strings.TrimLeft(p, "/")
+		switch req.Method {
+		case "COPY", "MOVE":
+			dest, _ := copyDestination(req)
+			needs = []access{{path, cbfsconfig.PermRead},
+				{dest, cbfsconfig.PermWrite}}
+			if req.Method == "MOVE" {
+				needs = append(needs, access{path, cbfsconfig.PermDelete})
+			}
+			return needs, false
+		}
+		return []access{{path, perm}}, false
+	}
+
+	if strings.HasPrefix(p, composePrefix) {
+		needs = []access{{minusPrefix(p, composePrefix), perm}}
+		for _, src := range req.URL.Query()["source"] {
+			needs = append(needs,
+				access{strings.TrimLeft(src, "/"), cbfsconfig.PermRead})
+		}
+		return needs, false
+	}
+	if strings.HasPrefix(p, trashPrefix) {
+		needs = []access{{minusPrefix(p, trashPrefix), perm}}
+		if to := req.URL.Query().Get("to"); to != "" {
+			needs = append(needs,
+				access{strings.TrimLeft(to, "/"), cbfsconfig.PermWrite})
+		}
+		return needs, false
+	}
+	for _, prefix := range userPathPrefixes {
+		if strings.HasPrefix(p, prefix) {
+			return []access{{minusPrefix(p, prefix), perm}}, false
+		}
+	}
+	for _, pp := range publicPaths {
+		if p == pp && perm != cbfsconfig.PermDelete {
+			return nil, true
+		}
+	}
+	switch {
+	case p == multipartPrefix && req.Method == "POST":
+		return []access{{strings.TrimLeft(req.FormValue("path"), "/"),
+			cbfsconfig.PermWrite}}, false
+	case strings.HasPrefix(p, multipartPrefix):
+		// Upload IDs are unguessable, so whoever started the
+		// upload is whoever knows the ID.
+		return nil, true
+	case p == batchPrefix && req.Method == "POST":
+		// Each operation is authorized on its own.
+		return nil, true
+	case strings.HasPrefix(p, blobPrefix) && perm == cbfsconfig.PermRead:
+		return nil, true
+	}
+	return []access{{strings.TrimLeft(p, "/"), perm}}, false
+}
+
+func fromOtherNode(req *http.Request) bool {
+	s := globalConfig.NodeSecret
+	return s != "" && hmac.Equal([]byte(req.Header.Get(nodeAuthHeader)), []byte(s))
+}
+
+func authChallenge(w http.ResponseWriter, msg string) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="cbfs"`)
+	http.Error(w, msg, 401)
+}
+
+// The user name (if any) and token a request was made with.
+func requestCredentials(req *http.Request) (name, token string) {
+	if u, p, ok := req.BasicAuth(); ok {
+		return u, p
+	}
+	if h := req.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return "", strings.TrimSpace(h[len("Bearer "):])
+	}
+	return "", ""
+}
+
+// Is the request from another node, or a user allowed to change the
+// config?  Only they may see its secrets.
+func configAdmin(req *http.Request) bool {
+	if fromOtherNode(req) {
+		return true
+	}
+	name, token := requestCredentials(req)
+	if token == "" {
+		return false
+	}
+	_, user, ok := globalConfig.Authenticate(name, token)
+	return ok && user.Allows(strings.TrimLeft(configPrefix, "/"),
+		cbfsconfig.PermWrite)
+}
+
+// Authenticate and authorize a request.  Responds and returns false
+// if the request may not proceed.
+func checkAuth(w http.ResponseWriter, req *http.Request) bool {
+	if fromOtherNode(req) {
+		return true
+	}
+
+	name, token := requestCredentials(req)
+	if token == "" {
+		if globalConfig.AuthRequired {
+			authChallenge(w, "authentication required")
+			return false
+		}
+		return true
+	}
+
+	name, user, ok := globalConfig.Authenticate(name, token)
+	if !ok {
+		authChallenge(w, "invalid credentials")
+		return false
+	}
+	return authorize(w, req, name, user)
+}
+
+// Does an authenticated user have the access a request needs?
+// Responds and returns false if not.
+func authorize(w http.ResponseWriter, req *http.Request, name string,
+	user cbfsconfig.AuthUser) bool {
+
+	needs, _ := requiredAccess(req)
+	for _, a := range needs {
+		if !user.Allows(a.path, a.perm) {
+			http.Error(w, "permission denied for "+name, 403)
+			return false
+		}
+	}
+	return true
+}
+
+// Adds the node secret to requests made to other nodes.
+type nodeAuthTransport struct {
+	base http.RoundTripper
+}
+
+func (t nodeAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if s := globalConfig.NodeSecret; s != "" {
+		r := *req
+		r.Header = http.Header{}
+		for k, v := range req.Header {
+			r.Header[k] = v
+		}
+		r.Header.Set(nodeAuthHeader, s)
+		req = &r
+	}
+	return base.RoundTrip(req)
+}
+
+// Client for talking to other nodes over the regular transport.
+var nodeHTTPClient = &http.Client{Transport: nodeAuthTransport{}}
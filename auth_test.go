@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/cbfs/config"
+)
+
+func TestRequiredAccess(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		dest   string
+		exp    []access
+		open   bool
+	}{
+		{"GET", "/a/b", "", []access{{"a/b", 'r'}}, false},
+		{"HEAD", "/a/b", "", []access{{"a/b", 'r'}}, false},
+		{"PUT", "/a/b", "", []access{{"a/b", 'w'}}, false},
+		{"DELETE", "/a/b", "", []access{{"a/b", 'd'}}, false},
+		{"COPY", "/a/b", "/c", []access{{"a/b", 'r'}, {"c", 'w'}}, false},
+		{"MOVE", "/a/b", "/c",
+			[]access{{"a/b", 'r'}, {"c", 'w'}, {"a/b", 'd'}}, false},
+		{"GET", "/.cbfs/list/a/", "", []access{{"a/", 'r'}}, false},
+		{"GET", "/.cbfs/revisions/a/b", "", []access{{"a/b", 'r'}}, false},
+		{"POST", "/.cbfs/revisions/a/b", "", []access{{"a/b", 'w'}}, false},
+		{"POST", "/.cbfs/upload/a/", "", []access{{"a/", 'w'}}, false},
+		{"GET", "/.cbfs/nodes/", "", nil, true},
+		{"GET", "/.cbfs/blob/abc", "", nil, true},
+		{"PUT", "/.cbfs/blob/abc", "", []access{{".cbfs/blob/abc", 'w'}}, false},
+		{"PUT", "/.cbfs/multipart/xyz/1", "", nil, true},
+		{"GET", "/.cbfs/config/", "", []access{{".cbfs/config/", 'r'}}, false},
+		{"PUT", "/.cbfs/config/", "", []access{{".cbfs/config/", 'w'}}, false},
+		{"POST", "/.cbfs/batch/", "", nil, true},
+		{"POST", "/.cbfs/extract/a/", "", []access{{"a/", 'w'}}, false},
+		{"GET", "/.cbfs/chunks/a/b", "", []access{{"a/b", 'r'}}, false},
+		{"POST", "/.cbfs/retention/a/b", "", []access{{"a/b", 'w'}}, false},
+		{"DELETE", "/.cbfs/locks/jobs/x", "", []access{{"jobs/x", 'd'}}, false},
+		{"DELETE", "/.cbfs/trash/a/", "", []access{{"a/", 'd'}}, false},
+		{"POST", "/.cbfs/trash/a?to=/b", "",
+			[]access{{"a", 'w'}, {"b", 'w'}}, false},
+		{"POST", "/.cbfs/compose/c?source=/a&source=b", "",
+			[]access{{"c", 'w'}, {"a", 'r'}, {"b", 'r'}}, false},
+	}
+
+	for _, test := range tests {
+		u, err := url.Parse(test.path)
+		if err != nil {
+			t.Fatalf("Error parsing %v: %v", test.path, err)
+		}
+		req := &http.Request{
+			Method: test.method,
+			URL:    u,
+			Header: http.Header{},
+		}
+		if test.dest != "" {
+			req.Header.Set("Destination", test.dest)
+		}
+		got, open := requiredAccess(req)
+		if open != test.open || !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("Expected %v (open=%v) for %v %v, got %v (open=%v)",
+				test.exp, test.open, test.method, test.path, got, open)
+		}
+	}
+}
+
+func TestSendConfigSecrets(t *testing.T) {
+	conf := cbfsconfig.DefaultConfig()
+	conf.NodeSecret = "node-secret"
+	conf.SigningKey = "signing-key"
+	conf.BackupSecretKey = "backup-secret"
+	conf.EncryptionKeys = []string{"key-one", "key-two"}
+	conf.Users = map[string]cbfsconfig.AuthUser{
+		"admin": {TokenHash: cbfsconfig.HashToken("admin-token"),
+			Grants: []cbfsconfig.Grant{{".cbfs/", "rwd"}}},
+		"reader": {TokenHash: cbfsconfig.HashToken("reader-token"),
+			Grants: []cbfsconfig.Grant{{"", "r"}}},
+	}
+	conf.Webhooks = []cbfsconfig.Webhook{{URL: "http://h/", Secret: "hook-secret"}}
+	conf.Mirrors = map[string]cbfsconfig.Mirror{
+		"m": {Remote: "http://r/", Direction: "push", Token: "mirror-token"}}
+	secrets := []string{"node-secret", "signing-key", "backup-secret", "hook-secret",
+		"mirror-token", "key-one", "key-two", conf.Users["admin"].TokenHash,
+		conf.Users["reader"].TokenHash}
+
+	defer func(c *cbfsconfig.CBFSConfig) { globalConfig = c }(globalConfig)
+	globalConfig = &conf
+
+	tests := []struct {
+		query, token string
+		code         int
+		secret       bool
+	}{
+		{"", "", 200, false},
+		{"", "admin-token", 200, false},
+		{"?secrets=true", "", 403, false},
+		{"?secrets=true", "reader-token", 403, false},
+		{"?secrets=true", "admin-token", 200, true},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", configPrefix+test.query, nil)
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		sendConfig(w, req, conf)
+		if w.Code != test.code {
+			t.Errorf("Expected %v for %q with %q, got %v",
+				test.code, test.query, test.token, w.Code)
+			continue
+		}
+		for _, s := range secrets {
+			if got := strings.Contains(w.Body.String(), s); got != test.secret {
+				t.Errorf("Expected %q in config for %q with %q: %v, got %v",
+					s, test.query, test.token, test.secret, got)
+			}
+		}
+	}
+
+	req := httptest.NewRequest("GET", configPrefix+"?secrets=true", nil)
+	req.Header.Set(nodeAuthHeader, "node-secret")
+	w := httptest.NewRecorder()
+	sendConfig(w, req, conf)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "node-secret") {
+		t.Errorf("Expected another node to see secrets, got %v", w.Code)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"compress/gzip"
 	"encoding/hex"
 	"encoding/json"
@@ -25,12 +26,41 @@ import (
 const backupKey = "/@backup"
 
 type backupItem struct {
-	Fn   string                `json:"filename"`
-	Oid  string                `json:"oid"`
-	When time.Time             `json:"when"`
-	Conf cbfsconfig.CBFSConfig `json:"conf"`
+	Fn        string                `json:"filename"`
+	Oid       string                `json:"oid"`
+	When      time.Time             `json:"when"`
+	Started   time.Time             `json:"started,omitempty"`
+	Parent    string                `json:"parent,omitempty"`
+	Encrypted bool                  `json:"encrypted,omitempty"`
+	Conf      cbfsconfig.CBFSConfig `json:"conf"`
 }
 
+// The first record of an incremental backup.  Files that haven't
+// changed since the parent backup are recorded by path alone and
+// their metadata must be found by walking the parent chain.
+type backupManifest struct {
+	Parent  string    `json:"parent"`
+	Since   time.Time `json:"since"`
+	Created time.Time `json:"created"`
+
+	// The OID of each file as of the parent backup
+	oids map[string]string
+}
+
+// Whether a file must be recorded in full, having changed since the
+// backup m is based on (or there being no such backup).  Files can
+// come back with an old modification time (restored, copied or taken
+// out of the trash), so they're compared by OID as well.
+func (m *backupManifest) changed(f *namedFile) bool {
+	if m == nil {
+		return true
+	}
+	oid, ok := m.oids[f.name]
+	return !ok || oid != f.meta.OID || f.meta.Modified.After(m.Since)
+}
+
+var errNoSuchBackup = errors.New("no such backup")
+
 type backups struct {
 	Latest  backupItem   `json:"latest"`
 	Backups []backupItem `json:"backups"`
@@ -40,21 +70,25 @@ func logDuration(m string, startTime time.Time) {
 	log.Printf("Completed %v in %v", m, time.Since(startTime))
 }
 
-func streamFileMeta(w io.Writer,
+// Stream file metadata as JSON records to emit.  If m is given,
+// files unchanged since its parent backup are written without their
+// metadata.
+func streamFileMeta(emit func(path string, rec interface{}) error,
 	fch chan *namedFile,
-	ech chan error) error {
+	ech chan error,
+	m *backupManifest) error {
 
-	enc := json.NewEncoder(w)
 	for {
 		select {
 		case f, ok := <-fch:
 			if !ok {
 				return nil
 			}
-			err := enc.Encode(map[string]interface{}{
-				"path": f.name,
-				"meta": f.meta,
-			})
+			rec := map[string]interface{}{"path": f.name}
+			if m.changed(f) {
+				rec["meta"] = f.meta
+			}
+			err := emit(f.name, rec)
 			if err != nil {
 				return err
 			}
@@ -67,7 +101,7 @@ func streamFileMeta(w io.Writer,
 	}
 }
 
-func backupTo(w io.Writer) (err error) {
+func backupTo(w io.Writer, m *backupManifest) (err error) {
 	fch := make(chan *namedFile)
 	ech := make(chan error)
 	qch := make(chan bool)
@@ -78,15 +112,53 @@ func backupTo(w io.Writer) (err error) {
 
 	go pathGenerator("", fch, ech, qch)
 
-	gz := gzip.NewWriter(w)
-	defer func() {
-		e := gz.Close()
+	bw := newBackupWriter(w, m)
+	if m != nil {
+		err = bw.writeRecord("", map[string]interface{}{
+			"manifest": m,
+		})
 		if err != nil {
-			err = e
+			return err
 		}
-	}()
+	}
+
+	if err := streamFileMeta(bw.writeRecord, fch, ech, m); err != nil {
+		return err
+	}
+	return bw.Close()
+}
+
+// Write a backup to w, encrypted with secret if there is one.
+func encryptedBackupTo(w io.Writer, m *backupManifest, secret []byte) error {
+	if len(secret) == 0 {
+		return backupTo(w, m)
+	}
+	ew, err := cbfsconfig.NewBackupEncrypter(w, secret)
+	if err != nil {
+		return err
+	}
+	if err := backupTo(ew, m); err != nil {
+		return err
+	}
+	return ew.Close()
+}
+
+func findBackup(fn string) (backupItem, error) {
+	b := backups{}
+	err := couchbase.Get(backupKey, &b)
+	if err != nil {
+		if gomemcached.IsNotFound(err) {
+			err = errNoSuchBackup
+		}
+		return backupItem{}, err
+	}
 
-	return streamFileMeta(gz, fch, ech)
+	for _, bi := range b.Backups {
+		if bi.Fn == fn {
+			return bi, nil
+		}
+	}
+	return backupItem{}, errNoSuchBackup
 }
 
 func recordBackupObject() error {
@@ -115,8 +187,7 @@ func recordRemoteBackupObjects() {
 		return
 	}
 	for _, n := range rn {
-		u := fmt.Sprintf("http://%s%s",
-			n.Address(), markBackupPrefix)
+		u := n.URLFor(markBackupPrefix)
 		c := n.Client()
 		res, err := c.Post(u, "application/octet-stream", nil)
 		if err != nil {
@@ -147,7 +218,9 @@ func removeDeadBackups(b *backups) {
 
 }
 
-func storeBackupObject(fn, h string) error {
+func storeBackupObject(fn, h, parent string, started time.Time,
+	encrypted bool) error {
+
 	b := backups{}
 	err := couchbase.Get(backupKey, &b)
 	if err != nil && !gomemcached.IsNotFound(err) {
@@ -157,7 +230,16 @@ func storeBackupObject(fn, h string) error {
 
 	removeDeadBackups(&b)
 
-	ob := backupItem{fn, h, time.Now().UTC(), *globalConfig}
+	ob := backupItem{
+		Fn:        fn,
+		Oid:       h,
+		When:      time.Now().UTC(),
+		Started:   started,
+		Parent:    parent,
+		Encrypted: encrypted,
+		// Only a record of the settings; nothing reads its secrets.
+		Conf: globalConfig.Redacted(),
+	}
 
 	b.Latest = ob
 	b.Backups = append(b.Backups, ob)
@@ -165,8 +247,128 @@ func storeBackupObject(fn, h string) error {
 	return couchbase.Set(backupKey, 0, &b)
 }
 
-func backupToCBFS(fn string) error {
-	f, err := NewHashRecord(*root, "")
+// The OID of each file in the backup b, following its parents for
+// files it recorded without their metadata.  Encrypted backups are
+// read with secret.
+func backupFileOIDs(b backupItem, secret []byte) (map[string]string, error) {
+	rv := map[string]string{}
+	var missing map[string]bool
+	for {
+		found, err := readBackupOIDs(b, secret)
+		if err != nil {
+			return nil, err
+		}
+		if missing == nil {
+			missing = map[string]bool{}
+			for p, oid := range found {
+				if oid == "" {
+					missing[p] = true
+				} else {
+					rv[p] = oid
+				}
+			}
+		} else {
+			for p := range missing {
+				if oid := found[p]; oid != "" {
+					rv[p] = oid
+					delete(missing, p)
+				}
+			}
+		}
+		if len(missing) == 0 || b.Parent == "" {
+			// Anything still missing is recorded in full.
+			return rv, nil
+		}
+		parent := b.Parent
+		if b, err = findBackup(parent); err != nil {
+			return nil, fmt.Errorf("finding parent backup %v: %v",
+				parent, err)
+		}
+	}
+}
+
+// The paths in a single backup and their OIDs, or "" for those
+// recorded without metadata.
+func readBackupOIDs(b backupItem, secret []byte) (map[string]string, error) {
+	r := blobReader(b.Oid)
+	defer r.Close()
+
+	br := bufio.NewReader(r)
+	in := io.Reader(br)
+	hdr, _ := br.Peek(len(cbfsconfig.BackupEncMagic))
+	if cbfsconfig.IsEncryptedBackup(hdr) {
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("backup %v is encrypted; secret is required",
+				b.Fn)
+		}
+		var err error
+		in, err = cbfsconfig.NewBackupDecrypter(br, secret)
+		if err != nil {
+			return nil, err
+		}
+	}
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	rv := map[string]string{}
+	d := json.NewDecoder(gz)
+	for {
+		ob := struct {
+			Path string
+			Meta *struct {
+				OID string
+			}
+		}{}
+		switch err := d.Decode(&ob); err {
+		case nil:
+		case io.EOF:
+			return rv, nil
+		default:
+			return nil, err
+		}
+		if ob.Path == "" {
+			// The manifest or index.
+			continue
+		}
+		rv[ob.Path] = ""
+		if ob.Meta != nil {
+			rv[ob.Path] = ob.Meta.OID
+		}
+	}
+}
+
+// Back up all file metadata into fn.  If parent names a previous
+// backup, only files changed since that backup started are recorded
+// in full.  With a secret, the backup is encrypted with a key derived
+// from it.
+func backupToCBFS(fn, parent string, secret []byte) error {
+	started := time.Now().UTC()
+
+	var m *backupManifest
+	if parent != "" {
+		pb, err := findBackup(parent)
+		if err != nil {
+			return fmt.Errorf("finding parent backup %v: %v", parent, err)
+		}
+		m = &backupManifest{
+			Parent:  parent,
+			Since:   pb.Started,
+			Created: started,
+		}
+		// Backups made before start times were recorded.
+		if m.Since.IsZero() {
+			m.Since = pb.When
+		}
+		m.oids, err = backupFileOIDs(pb, secret)
+		if err != nil {
+			return fmt.Errorf("reading parent backup %v: %v", parent, err)
+		}
+	}
+
+	f, err := NewHashRecord(pickVolume(), "")
 	if err != nil {
 		return err
 	}
@@ -174,7 +376,7 @@ func backupToCBFS(fn string) error {
 
 	pr, pw := io.Pipe()
 
-	go func() { pw.CloseWithError(backupTo(pw)) }()
+	go func() { pw.CloseWithError(encryptedBackupTo(pw, m, secret)) }()
 
 	h, length, err := f.Process(pr)
 	if err != nil {
@@ -197,7 +399,7 @@ func backupToCBFS(fn string) error {
 		return err
 	}
 
-	err = storeBackupObject(fn, h)
+	err = storeBackupObject(fn, h, parent, started, len(secret) > 0)
 	if err != nil {
 		return err
 	}
@@ -234,9 +436,46 @@ func doBackupDocs(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// Encrypted backups are only as private as the connection the
+	// secret arrives over.
+	secret := []byte(req.FormValue("secret"))
+
+	parent := req.FormValue("parent")
+	run := func() error { return backupToCBFS(fn, parent, secret) }
+	if scheme, bucket, key, ok := parseBucketURL(fn); ok {
+		if key == "" {
+			http.Error(w, "Missing object key in "+fn, 400)
+			return
+		}
+		if parent != "" {
+			http.Error(w, "Incremental backups can only be stored in cbfs",
+				400)
+			return
+		}
+		run = func() error {
+			return backupToBucket(newBackupBucket(scheme, bucket), key,
+				secret)
+		}
+	}
+
+	if parent != "" {
+		_, err := findBackup(parent)
+		switch err {
+		case nil:
+		case errNoSuchBackup:
+			http.Error(w, fmt.Sprintf("No such parent backup: %v",
+				parent), 400)
+			return
+		default:
+			http.Error(w, fmt.Sprintf("Error finding parent backup: %v",
+				err), 500)
+			return
+		}
+	}
+
 	if bg, _ := strconv.ParseBool(req.FormValue("bg")); bg {
 		go func() {
-			err := backupToCBFS(fn)
+			err := run()
 			if err != nil {
 				log.Printf("Error performing bg backup: %v", err)
 			}
@@ -245,7 +484,7 @@ func doBackupDocs(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err := backupToCBFS(fn)
+	err := run()
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error performing backup: %v", err), 500)
 		return
@@ -267,8 +506,21 @@ func doGetBackupInfo(w http.ResponseWriter, req *http.Request) {
 	}
 
 	removeDeadBackups(&b)
+	// Records made before configs were stored redacted.
+	b.Latest.Conf = b.Latest.Conf.Redacted()
+	for i := range b.Backups {
+		b.Backups[i].Conf = b.Backups[i].Conf.Redacted()
+	}
+
+	st, err := getBackupStatus()
+	if err != nil {
+		log.Printf("Error getting backup status: %v", err)
+	}
 
-	sendJson(w, req, &b)
+	sendJson(w, req, struct {
+		backups
+		Scheduled backupStatus `json:"scheduled"`
+	}{b, st})
 }
 
 var errExists = errors.New("item exists")
@@ -284,6 +536,16 @@ func maybeStoreMeta(k string, fm fileMeta, exp int, force bool) error {
 	return err
 }
 
+// The expiration recorded with a backed up file, with relative ones
+// made absolute from when it was modified.
+func backedUpExpiration(fm fileMeta) int {
+	exp := getExpiration(fm.Headers)
+	if exp > 0 && exp < 60*60*24*30 {
+		exp = int(fm.Modified.Add(time.Second * time.Duration(exp)).Unix())
+	}
+	return exp
+}
+
 func doRestoreDocument(w http.ResponseWriter, req *http.Request, fn string) {
 	d := json.NewDecoder(req.Body)
 	fm := fileMeta{}
@@ -316,10 +578,7 @@ func doRestoreDocument(w http.ResponseWriter, req *http.Request, fn string) {
 
 	exp := getExpiration(req.Header)
 	if exp == -1 {
-		exp = getExpiration(fm.Headers)
-		if exp > 0 && exp < 60*60*24*30 {
-			exp = int(fm.Modified.Add(time.Second * time.Duration(exp)).Unix())
-		}
+		exp = backedUpExpiration(fm)
 	}
 
 	if exp < 0 {
@@ -328,7 +587,7 @@ func doRestoreDocument(w http.ResponseWriter, req *http.Request, fn string) {
 		return
 	}
 
-	force := false
+	force, _ := strconv.ParseBool(req.FormValue("force"))
 	err = maybeStoreMeta(fn, fm, exp, force)
 	switch err {
 	case errExists:
@@ -368,8 +627,10 @@ func loadBackupHashes(oid string) (*hashset.Hashset, int, error) {
 		ob := struct {
 			Meta struct {
 				OID   string
+				Parts []blobPart
 				Older []struct {
-					OID string
+					OID   string
+					Parts []blobPart
 				}
 			}
 		}{}
@@ -377,6 +638,11 @@ func loadBackupHashes(oid string) (*hashset.Hashset, int, error) {
 		err := d.Decode(&ob)
 		switch err {
 		case nil:
+			if ob.Meta.OID == "" {
+				// Manifest or unchanged file in an
+				// incremental backup.
+				continue
+			}
 			oid, err := hex.DecodeString(ob.Meta.OID)
 			if err != nil {
 				return nil, visited, err
@@ -387,6 +653,7 @@ func loadBackupHashes(oid string) (*hashset.Hashset, int, error) {
 			}
 			rv.Add(oid)
 			visited++
+			parts := ob.Meta.Parts
 			for _, obs := range ob.Meta.Older {
 				oid, err = hex.DecodeString(obs.OID)
 				if err != nil {
@@ -394,6 +661,15 @@ func loadBackupHashes(oid string) (*hashset.Hashset, int, error) {
 				}
 				rv.Add(oid)
 				visited++
+				parts = append(parts, obs.Parts...)
+			}
+			for _, p := range parts {
+				oid, err = hex.DecodeString(p.OID)
+				if err != nil {
+					return nil, visited, err
+				}
+				rv.Add(oid)
+				visited++
 			}
 		case io.EOF:
 			return rv, visited, nil
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/couchbaselabs/cbfs/config"
+	"github.com/couchbaselabs/cbfs/sigv4"
+)
+
+// What came of restoring a backup from a bucket.
+type bucketRestoreResult struct {
+	Restored     int `json:"restored"`
+	Existing     int `json:"existing"`
+	Expired      int `json:"expired"`
+	MissingBlobs int `json:"missingBlobs"`
+	Failed       int `json:"failed"`
+}
+
+// Split an s3://bucket/key or gs://bucket/key URL.
+func parseBucketURL(s string) (scheme, bucket, key string, ok bool) {
+	for _, scheme := range []string{"s3", "gs"} {
+		if !strings.HasPrefix(s, scheme+"://") {
+			continue
+		}
+		parts := strings.SplitN(s[len(scheme)+3:], "/", 2)
+		if len(parts) > 1 {
+			key = strings.Trim(parts[1], "/")
+		}
+		return scheme, parts[0], key, parts[0] != ""
+	}
+	return "", "", "", false
+}
+
+// A bucket backups are kept in, with the configured credentials if
+// there are any.
+func newBackupBucket(scheme, name string) s3Bucket {
+	b := newS3Bucket(name)
+	if scheme == "gs" {
+		b = newGCSBucket(name)
+	}
+	if globalConfig.BackupAccessKey != "" {
+		b.creds = sigv4.Credentials{
+			AccessKey: globalConfig.BackupAccessKey,
+			SecretKey: globalConfig.BackupSecretKey,
+		}
+	}
+	return b
+}
+
+// Write a full backup straight into a bucket, a part at a time.
+func backupToBucket(b s3Bucket, key string, secret []byte) error {
+	u, err := b.startUpload(key, int(globalConfig.BackupPartSize))
+	if err != nil {
+		return err
+	}
+	err = encryptedBackupTo(u, nil, secret)
+	if err == nil {
+		err = u.Close()
+	}
+	if err != nil {
+		if e := u.abort(); e != nil {
+			log.Printf("Error aborting upload of %v: %v", key, e)
+		}
+		return err
+	}
+	log.Printf("Completed backup to %v/%v", b.host(), key)
+	return nil
+}
+
+// Restore the files in a full backup whose paths match.  Everything
+// is read before anything is restored, so an encrypted backup that's
+// been damaged or cut short restores nothing.
+func restoreFromBackup(r io.Reader, secret []byte, match *regexp.Regexp,
+	force bool) (bucketRestoreResult, error) {
+
+	rv := bucketRestoreResult{}
+	br := bufio.NewReader(r)
+	in := io.Reader(br)
+	hdr, _ := br.Peek(len(cbfsconfig.BackupEncMagic))
+	if cbfsconfig.IsEncryptedBackup(hdr) {
+		if len(secret) == 0 {
+			return rv, errors.New("backup is encrypted; secret is required")
+		}
+		var err error
+		in, err = cbfsconfig.NewBackupDecrypter(br, secret)
+		if err != nil {
+			return rv, err
+		}
+	}
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return rv, err
+	}
+
+	type record struct {
+		Path     string          `json:"path"`
+		Meta     *fileMeta       `json:"meta"`
+		Manifest *backupManifest `json:"manifest"`
+	}
+	todo := []record{}
+	d := json.NewDecoder(gz)
+	for {
+		ob := record{}
+		err := d.Decode(&ob)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return rv, err
+		}
+		switch {
+		case ob.Manifest != nil && ob.Manifest.Parent != "":
+			return rv, errors.New("incremental backups must be " +
+				"restored with cbfsadm restore")
+		case ob.Meta != nil && match.MatchString(ob.Path):
+			todo = append(todo, ob)
+		}
+	}
+
+	for _, ob := range todo {
+		fm := *ob.Meta
+		exp := backedUpExpiration(fm)
+		if exp < 0 {
+			rv.Expired++
+			continue
+		}
+		if _, err := referenceBlob(fm.OID); err != nil {
+			rv.MissingBlobs++
+		}
+		switch err := maybeStoreMeta(ob.Path, fm, exp, force); err {
+		case nil:
+			rv.Restored++
+		case errExists:
+			rv.Existing++
+		default:
+			log.Printf("Error restoring %v -> %v: %v", ob.Path, fm.OID, err)
+			rv.Failed++
+		}
+	}
+	return rv, nil
+}
+
+// POST /.cbfs/backup/restore/ with src=s3://bucket/key (or gs://)
+// restores the files in a full backup there, read straight from the
+// bucket.  match limits it to paths matching a regex, force replaces
+// existing files and secret reads encrypted backups.
+func doRestoreBackup(w http.ResponseWriter, req *http.Request) {
+	src := req.FormValue("src")
+	scheme, bucket, key, ok := parseBucketURL(src)
+	if !ok || key == "" {
+		http.Error(w, "src must be an s3:// or gs:// object", 400)
+		return
+	}
+	match, err := regexp.Compile(req.FormValue("match"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid match: %v", err), 400)
+		return
+	}
+	force, _ := strconv.ParseBool(req.FormValue("force"))
+
+	r, err := newBackupBucket(scheme, bucket).get(key)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading %v: %v", src, err), 500)
+		return
+	}
+	defer r.Close()
+
+	res, err := restoreFromBackup(r, []byte(req.FormValue("secret")),
+		match, force)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error restoring %v: %v", src, err), 500)
+		return
+	}
+	log.Printf("Restored %v files from %v", res.Restored, src)
+	sendJson(w, req, res)
+}
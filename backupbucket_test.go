@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseBucketURL(t *testing.T) {
+	tests := []struct {
+		in                  string
+		scheme, bucket, key string
+		ok                  bool
+	}{
+		{"s3://b/some/key.gz", "s3", "b", "some/key.gz", true},
+		{"gs://b/key/", "gs", "b", "key", true},
+		{"gs://b", "gs", "b", "", true},
+		{"s3://", "s3", "", "", false},
+		{"backups/x.gz", "", "", "", false},
+		{"cbfs://b/x.gz", "", "", "", false},
+	}
+	for _, test := range tests {
+		scheme, bucket, key, ok := parseBucketURL(test.in)
+		if scheme != test.scheme || bucket != test.bucket ||
+			key != test.key || ok != test.ok {
+			t.Errorf("Expected %v, %v, %v, %v for %q, got %v, %v, %v, %v",
+				test.scheme, test.bucket, test.key, test.ok, test.in,
+				scheme, bucket, key, ok)
+		}
+	}
+}
+
+func TestGCSBucketHost(t *testing.T) {
+	if h := newGCSBucket("b").host(); h != "b.storage.googleapis.com" {
+		t.Errorf("Expected the GCS host, got %v", h)
+	}
+	b := newS3Bucket("b")
+	b.region = "eu-west-1"
+	if h := b.host(); h != "b.s3.eu-west-1.amazonaws.com" {
+		t.Errorf("Expected the S3 host, got %v", h)
+	}
+}
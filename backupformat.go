@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+)
+
+// Backups are written in version 2 of the backup format.  The records
+// are the same JSON as version 1's, but rather than one gzip stream
+// they're compressed in blocks of up to backupBlockRecords, each its
+// own gzip member, so a reader can start at any block.  After the
+// last block comes a member holding an index of the paths in each
+// block, then a trailer member whose gzip header says where the index
+// starts.  Readers that don't know about the index see a gzip stream
+// of records as before, with one more record at the end.
+const backupFormat = 2
+
+const backupBlockRecords = 1000
+
+// The gzip header subfield in the trailer holding the index offset.
+var backupTrailerID = [2]byte{'C', 'B'}
+
+type backupIndexBlock struct {
+	Offset int64    `json:"offset"`
+	Length int64    `json:"length"`
+	Paths  []string `json:"paths"`
+}
+
+type backupIndex struct {
+	Version  int                `json:"version"`
+	Manifest *backupManifest    `json:"manifest,omitempty"`
+	Blocks   []backupIndexBlock `json:"blocks"`
+}
+
+// Counts bytes on their way to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// Writes records in blocks, indexing them as it goes.
+type backupWriter struct {
+	w     *countingWriter
+	gz    *gzip.Writer
+	enc   *json.Encoder
+	index backupIndex
+}
+
+func newBackupWriter(w io.Writer, m *backupManifest) *backupWriter {
+	return &backupWriter{
+		w:     &countingWriter{w: w},
+		index: backupIndex{Version: backupFormat, Manifest: m},
+	}
+}
+
+// Write a record, noting its path in the index if it has one.
+func (b *backupWriter) writeRecord(path string, rec interface{}) error {
+	if b.gz == nil {
+		b.index.Blocks = append(b.index.Blocks,
+			backupIndexBlock{Offset: b.w.n, Paths: []string{}})
+		b.gz = gzip.NewWriter(b.w)
+		b.enc = json.NewEncoder(b.gz)
+	}
+	if err := b.enc.Encode(rec); err != nil {
+		return err
+	}
+	blk := &b.index.Blocks[len(b.index.Blocks)-1]
+	if path != "" {
+		blk.Paths = append(blk.Paths, path)
+	}
+	if len(blk.Paths) >= backupBlockRecords {
+		return b.endBlock()
+	}
+	return nil
+}
+
+func (b *backupWriter) endBlock() error {
+	if b.gz == nil {
+		return nil
+	}
+	err := b.gz.Close()
+	b.gz = nil
+	blk := &b.index.Blocks[len(b.index.Blocks)-1]
+	blk.Length = b.w.n - blk.Offset
+	return err
+}
+
+// Finish the last block and write the index and trailer.
+func (b *backupWriter) Close() error {
+	if err := b.endBlock(); err != nil {
+		return err
+	}
+
+	at := b.w.n
+	gz := gzip.NewWriter(b.w)
+	err := json.NewEncoder(gz).Encode(map[string]interface{}{
+		"index": b.index,
+	})
+	if e := gz.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = b.w.Write(backupTrailer(at))
+	return err
+}
+
+// An empty gzip member whose header holds the index's offset.
+func backupTrailer(at int64) []byte {
+	extra := make([]byte, 12)
+	copy(extra, backupTrailerID[:])
+	binary.LittleEndian.PutUint16(extra[2:], 8)
+	binary.LittleEndian.PutUint64(extra[4:], uint64(at))
+
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	gz.Extra = extra
+	gz.Close()
+	return buf.Bytes()
+}
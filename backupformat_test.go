@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestBackupWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	bw := newBackupWriter(buf, &backupManifest{Parent: "p"})
+	if err := bw.writeRecord("", map[string]string{"manifest": "m"}); err != nil {
+		t.Fatalf("Error writing manifest: %v", err)
+	}
+	n := backupBlockRecords + 10
+	for i := 0; i < n; i++ {
+		p := fmt.Sprintf("f%d", i)
+		if err := bw.writeRecord(p, map[string]string{"path": p}); err != nil {
+			t.Fatalf("Error writing %v: %v", p, err)
+		}
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+	data := buf.Bytes()
+
+	// Read as one stream, everything's there, then the index.
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	d := json.NewDecoder(gz)
+	records := 0
+	var last map[string]json.RawMessage
+	for {
+		last = nil
+		err := d.Decode(&last)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error decoding after %v records: %v", records, err)
+		}
+		if _, ok := last["index"]; ok {
+			continue
+		}
+		records++
+	}
+	if records != n+1 {
+		t.Errorf("Expected %v records, got %v", n+1, records)
+	}
+
+	// The trailer says where the index is.
+	trailer := backupTrailer(0)
+	tgz, err := gzip.NewReader(bytes.NewReader(data[len(data)-len(trailer):]))
+	if err != nil {
+		t.Fatalf("Error reading trailer: %v", err)
+	}
+	extra := tgz.Header.Extra
+	if len(extra) != 12 || extra[0] != 'C' || extra[1] != 'B' {
+		t.Fatalf("Expected an index offset in the trailer, got %v", extra)
+	}
+	at := int64(binary.LittleEndian.Uint64(extra[4:]))
+
+	igz, err := gzip.NewReader(bytes.NewReader(data[at:]))
+	if err != nil {
+		t.Fatalf("Error reading index: %v", err)
+	}
+	igz.Multistream(false)
+	ix := struct{ Index backupIndex }{}
+	if err := json.NewDecoder(igz).Decode(&ix); err != nil {
+		t.Fatalf("Error decoding index: %v", err)
+	}
+	if ix.Index.Version != backupFormat || ix.Index.Manifest.Parent != "p" ||
+		len(ix.Index.Blocks) != 2 {
+		t.Fatalf("Unexpected index: %+v", ix.Index)
+	}
+
+	// Each block can be read on its own.
+	blk := ix.Index.Blocks[1]
+	if len(blk.Paths) != 10 || blk.Paths[0] != fmt.Sprint("f", n-10) {
+		t.Errorf("Unexpected second block paths: %v", blk.Paths)
+	}
+	bgz, err := gzip.NewReader(bytes.NewReader(
+		data[blk.Offset : blk.Offset+blk.Length]))
+	if err != nil {
+		t.Fatalf("Error reading block: %v", err)
+	}
+	rec := map[string]string{}
+	if err := json.NewDecoder(bgz).Decode(&rec); err != nil {
+		t.Fatalf("Error decoding block: %v", err)
+	}
+	if rec["path"] != blk.Paths[0] {
+		t.Errorf("Expected %v first in the block, got %v", blk.Paths[0], rec)
+	}
+}
+
+func TestBackupManifestChanged(t *testing.T) {
+	t0 := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	t1 := t0.Add(time.Hour)
+	m := &backupManifest{Since: t0, oids: map[string]string{
+		"same": "a", "touched": "b", "rewritten": "c",
+	}}
+
+	tests := []struct {
+		name, oid string
+		modified  time.Time
+		exp       bool
+	}{
+		{"same", "a", t0, false},
+		{"touched", "b", t1, true},
+		// Restored or copied with the old time.
+		{"rewritten", "x", t0, true},
+		{"new", "d", t0, true},
+	}
+
+	for _, test := range tests {
+		f := &namedFile{name: test.name,
+			meta: fileMeta{OID: test.oid, Modified: test.modified}}
+		if got := m.changed(f); got != test.exp {
+			t.Errorf("Expected %v for %v, got %v", test.exp, test.name, got)
+		}
+		if !(*backupManifest)(nil).changed(f) {
+			t.Errorf("Expected %v to be recorded in a full backup", test.name)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// Most operations accepted in one batch.
+const batchMaxOps = 10000
+
+var errBatchMissing = errors.New("not found")
+
+// One operation in a batch.
+type batchOp struct {
+	// delete, touch, set-header or copy
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	// Only act if the file has this OID
+	IfMatch string `json:"ifMatch,omitempty"`
+	// Where to copy to, and whether to replace a file there
+	Destination string `json:"destination,omitempty"`
+	Overwrite   *bool  `json:"overwrite,omitempty"`
+	// Headers to set (an empty value removes the header)
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+type batchResult struct {
+	Op     string `json:"op"`
+	Path   string `json:"path"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// The request equivalent to an operation.  Credentials come from the
+// batch request so each operation is authorized on its own.
+func batchRequest(batch *http.Request, method, path string) (*http.Request, error) {
+	u := &url.URL{Path: "/" + strings.TrimLeft(path, "/")}
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range []string{"Authorization", nodeAuthHeader} {
+		if v := batch.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	return req, nil
+}
+
+// Change a file's meta in place, without making a new revision.
+func batchUpdateMeta(req *http.Request, f func(*fileMeta)) (int, error) {
+	_, k := resolvePath(req)
+	err := couchbase.Update(k, 0, func(in []byte) ([]byte, error) {
+		if in == nil {
+			return nil, errBatchMissing
+		}
+		existing := fileMeta{}
+		err := json.Unmarshal(in, &existing)
+		if err != nil {
+			return in, err
+		}
+		if !shouldStoreMeta(req.Header, true, existing) {
+			return in, errUploadPrecondition
+		}
+		f(&existing)
+		return json.Marshal(existing)
+	})
+	switch {
+	case err == nil:
+		return 204, nil
+	case err == errUploadPrecondition:
+		return 412, err
+	case err == errBatchMissing, gomemcached.IsNotFound(err):
+		return 404, errBatchMissing
+	}
+	return 500, err
+}
+
+func runBatchOp(batch *http.Request, op batchOp) (int, string) {
+	if op.Path == "" || strings.HasPrefix(strings.TrimLeft(op.Path, "/"), ".cbfs/") {
+		return 400, "invalid path"
+	}
+
+	method := map[string]string{
+		"delete":     "DELETE",
+		"touch":      "PUT",
+		"set-header": "PUT",
+		"copy":       "COPY",
+	}[op.Op]
+	if method == "" {
+		return 400, fmt.Sprintf("unknown op: %q", op.Op)
+	}
+
+	req, err := batchRequest(batch, method, op.Path)
+	if err != nil {
+		return 400, err.Error()
+	}
+	if op.IfMatch != "" {
+		req.Header.Set("If-Match", `"`+op.IfMatch+`"`)
+	}
+	if op.Op == "copy" {
+		if op.Destination == "" {
+			return 400, "missing destination"
+		}
+		req.Header.Set("Destination", "/"+strings.TrimLeft(op.Destination, "/"))
+		if op.Overwrite != nil && !*op.Overwrite {
+			req.Header.Set("Overwrite", "F")
+		}
+	}
+
+	body := &bytes.Buffer{}
+	cw := &captureResponseWriter{w: body, hdr: http.Header{}}
+	if !checkAuth(cw, req) {
+		return cw.statusCode, strings.TrimSpace(body.String())
+	}
+
+	switch op.Op {
+	case "delete":
+		doDeleteUserDoc(cw, req)
+	case "copy":
+		doCopyUserDoc(cw, req, false)
+	case "touch":
+		now := time.Now().UTC()
+		code, err := batchUpdateMeta(req, func(fm *fileMeta) {
+			fm.Modified = now
+		})
+		if code != 404 {
+			return code, errString(err)
+		}
+		// Touching a missing file makes an empty one.
+		req.Body = ioutil.NopCloser(strings.NewReader(""))
+		putUserFile(cw, req)
+	case "set-header":
+		hdr := http.Header{}
+		for k, v := range op.Headers {
+			hdr.Set(k, v)
+		}
+		if err := checkUserMeta(hdr); err != nil {
+			return 400, err.Error()
+		}
+		code, err := batchUpdateMeta(req, func(fm *fileMeta) {
+			if fm.Headers == nil {
+				fm.Headers = http.Header{}
+			}
+			for k, v := range op.Headers {
+				if v == "" {
+					fm.Headers.Del(k)
+				} else {
+					fm.Headers.Set(k, v)
+				}
+			}
+		})
+		return code, errString(err)
+	}
+	if cw.statusCode >= 300 {
+		return cw.statusCode, strings.TrimSpace(body.String())
+	}
+	return cw.statusCode, ""
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func doBatch(w http.ResponseWriter, req *http.Request) {
+	ops := []batchOp{}
+	d := json.NewDecoder(req.Body)
+	if err := d.Decode(&ops); err != nil {
+		http.Error(w, fmt.Sprintf("Error reading operations: %v", err), 400)
+		return
+	}
+	if len(ops) > batchMaxOps {
+		http.Error(w, fmt.Sprintf("Too many operations (%v > %v)",
+			len(ops), batchMaxOps), 413)
+		return
+	}
+
+	results := make([]batchResult, 0, len(ops))
+	failed := 0
+	for _, op := range ops {
+		code, msg := runBatchOp(req, op)
+		if code >= 300 {
+			failed++
+		}
+		results = append(results, batchResult{
+			Op: op.Op, Path: op.Path, Status: code, Error: msg,
+		})
+	}
+	if failed > 0 {
+		log.Printf("%v of %v batch operations failed", failed, len(ops))
+	}
+
+	sendJson(w, req, results)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBatchOpInvalid(t *testing.T) {
+	tests := []struct {
+		op   batchOp
+		code int
+	}{
+		{batchOp{Op: "delete"}, 400},
+		{batchOp{Op: "delete", Path: "/.cbfs/config/"}, 400},
+		{batchOp{Op: "chmod", Path: "a"}, 400},
+		{batchOp{Op: "copy", Path: "a"}, 400},
+	}
+
+	req, err := http.NewRequest("POST", batchPrefix, nil)
+	if err != nil {
+		t.Fatalf("Error making request: %v", err)
+	}
+	for _, test := range tests {
+		code, msg := runBatchOp(req, test.op)
+		if code != test.code || msg == "" {
+			t.Errorf("Expected %v for %+v, got %v (%q)",
+				test.code, test.op, code, msg)
+		}
+	}
+}
+
+func TestBatchRequestCredentials(t *testing.T) {
+	batch, err := http.NewRequest("POST", batchPrefix, nil)
+	if err != nil {
+		t.Fatalf("Error making request: %v", err)
+	}
+	batch.SetBasicAuth("u", "p")
+	batch.Header.Set("If-Match", `"abc"`)
+
+	req, err := batchRequest(batch, "DELETE", "a b/c")
+	if err != nil {
+		t.Fatalf("Error making request: %v", err)
+	}
+	if req.URL.Path != "/a b/c" || req.Method != "DELETE" {
+		t.Errorf("Expected DELETE /a b/c, got %v %v", req.Method, req.URL.Path)
+	}
+	if u, p, ok := req.BasicAuth(); !ok || u != "u" || p != "p" {
+		t.Errorf("Expected credentials u/p, got %v/%v", u, p)
+	}
+	if h := req.Header.Get("If-Match"); h != "" {
+		t.Errorf("Expected no If-Match from the batch, got %q", h)
+	}
+}
+
+func TestBatchBadBody(t *testing.T) {
+	tests := []struct {
+		body string
+		code int
+	}{
+		{"not json", 400},
+		{`{"op": "delete"}`, 400},
+		{"[" + strings.Repeat(`{},`, batchMaxOps) + "{}]", 413},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("POST", batchPrefix,
+			strings.NewReader(test.body))
+		if err != nil {
+			t.Fatalf("Error making request: %v", err)
+		}
+		w := httptest.NewRecorder()
+		doBatch(w, req)
+		if w.Code != test.code {
+			t.Errorf("Expected %v for %.20q, got %v", test.code, test.body, w.Code)
+		}
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"net/http"
 	"os"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/couchbase/gomemcached"
@@ -27,6 +28,20 @@ type BlobOwnership struct {
 	Type       string               `json:"type"`
 	Garbage    bool                 `json:"garbage"`
 	Referenced time.Time            `json:"referenced"`
+	// Set when the blob is stored as erasure coded shards
+	EC *erasureSet `json:"ec,omitempty"`
+	// Set when this blob is a shard of another
+	Shard bool `json:"shard,omitempty"`
+	// Copies wanted by a path replica policy, if any
+	Replicas int `json:"replicas,omitempty"`
+	// When each node last checked its copy against the hash
+	Verified map[string]time.Time `json:"verified,omitempty"`
+	// When the blob was last read, to the nearest hour or so
+	Accessed time.Time `json:"accessed,omitempty"`
+	// The hash that named the blob, once it's been checked
+	Hash string `json:"hash,omitempty"`
+	// Nodes the files made of this blob are pinned to
+	Pinned []string `json:"pinned,omitempty"`
 }
 
 type internodeCommand uint8
@@ -153,7 +168,7 @@ func blobReader(oid string) io.ReadCloser {
 }
 
 func copyBlob(w io.Writer, oid string) error {
-	f, err := openLocalBlob(oid)
+	f, err := openCheckedLocalBlob(oid)
 	if err == nil {
 		// Doing it locally
 		defer f.Close()
@@ -162,7 +177,7 @@ func copyBlob(w io.Writer, oid string) error {
 	} else {
 		// Doing it remotely
 		c := captureResponseWriter{w: w, hdr: http.Header{}}
-		return getBlobFromRemote(&c, oid, http.Header{}, *cachePercentage)
+		return getBlobFromRemote(&c, oid, http.Header{}, cachePercent())
 	}
 }
 
@@ -268,6 +283,8 @@ func recordBlobAccess(h string) {
 	if err != nil {
 		log.Printf("Error incrementing node identifier: %v", err)
 	}
+
+	noteBlobRead(h)
 }
 
 // Returns the number of known owners (-1 if it can't be determined)
@@ -286,6 +303,7 @@ func removeBlobOwnershipRecord(h, node string) int {
 		err := json.Unmarshal(in, &ownership)
 		if err == nil {
 			delete(ownership.Nodes, node)
+			delete(ownership.Verified, node)
 		} else {
 			log.Printf("Error unmarhaling blob removal from %s for %v: %v",
 				in, h, err)
@@ -294,7 +312,9 @@ func removeBlobOwnershipRecord(h, node string) int {
 
 		numOwners = len(ownership.Nodes)
 
-		if len(ownership.Nodes) == 0 && node == serverId {
+		// Erasure coded blobs live on without full copies.
+		if len(ownership.Nodes) == 0 && node == serverId &&
+			(ownership.EC == nil || ownership.Garbage) {
 			return nil, nil
 		}
 
@@ -333,16 +353,17 @@ func maybeRemoveBlobOwnership(h string) (rv error) {
 
 		err := json.Unmarshal(in, &ownership)
 		if err == nil {
-			if ownership.Garbage {
+			if ownership.Garbage || ownership.EC != nil {
 				// OK
 			} else if time.Since(ownership.Nodes[serverId]) < time.Hour {
 				rv = errors.New("too soon")
 				return nil, cb.UpdateCancel
-			} else if len(ownership.Nodes)-1 < globalConfig.MinReplicas {
+			} else if len(ownership.Nodes)-1 < wantedReplicas(ownership.Replicas) {
 				rv = errors.New("Insufficient replicas")
 				return nil, cb.UpdateCancel
 			}
 			delete(ownership.Nodes, serverId)
+			delete(ownership.Verified, serverId)
 		} else {
 			log.Printf("Error unmarhaling blob removal of %v from %s: %v",
 				h, in, err)
@@ -350,7 +371,7 @@ func maybeRemoveBlobOwnership(h string) (rv error) {
 			return nil, cb.UpdateCancel
 		}
 
-		if len(ownership.Nodes) == 0 {
+		if len(ownership.Nodes) == 0 && (ownership.EC == nil || ownership.Garbage) {
 			removedLast = true
 			return nil, nil
 		}
@@ -385,6 +406,20 @@ func increaseReplicaCount(oid string, length int64, by int) error {
 }
 
 func ensureMinimumReplicaCount() error {
+	if err := updateReplicationReport(); err != nil {
+		log.Printf("Error updating replication report: %v", err)
+	}
+	err := ensureDefaultReplicaCount()
+	if perr := ensurePolicyReplicaCount(); err == nil {
+		err = perr
+	}
+	if perr := ensurePinnedReplicas(); err == nil {
+		err = perr
+	}
+	return err
+}
+
+func ensureDefaultReplicaCount() error {
 	nl, err := findAllNodes()
 	if err != nil {
 		return err
@@ -442,34 +477,48 @@ func ensureMinimumReplicaCount() error {
 	return nil
 }
 
-func pruneBlob(oid string, nodemap map[string]string, nl NodeList) {
-	if len(nodemap) <= globalConfig.MaxReplicas {
+// Copies on nodes the blob is pinned to are never pruned.
+func pruneBlob(oid string, nodemap map[string]string, pins []string,
+	nl NodeList, max int) {
+
+	if len(nodemap) <= max {
 		log.Printf("Asked to prune a blob that has too few replicas: %v",
 			oid)
 	}
 
-	log.Printf("Pruning blob %v down from %v repls to %v",
-		oid, len(nodemap), globalConfig.MaxReplicas)
-
-	nm := map[string]StorageNode{}
+	holders := NodeList{}
 	for _, n := range nl {
-		nm[n.name] = n
+		if _, ok := nodemap[n.name]; ok && !pinnedTo(pins, n.name) {
+			holders = append(holders, n)
+		}
+	}
+	if len(holders) == 0 {
+		return
 	}
 
+	log.Printf("Pruning blob %v down from %v repls to %v",
+		oid, len(nodemap), max)
+
 	remaining := len(nodemap)
-	for n := range nodemap {
-		if remaining <= globalConfig.MaxReplicas {
+	for _, sn := range holders.pruneOrder() {
+		if remaining <= max {
 			break
 		}
 		remaining--
-		if sn, ok := nm[n]; ok {
-			queueBlobRemoval(sn, oid)
-		}
+		queueBlobRemoval(sn, oid)
 	}
 
 }
 
 func pruneExcessiveReplicas() error {
+	err := pruneDefaultReplicas()
+	if perr := prunePolicyReplicas(); err == nil {
+		err = perr
+	}
+	return err
+}
+
+func pruneDefaultReplicas() error {
 	nl, err := findAllNodes()
 	if err != nil {
 		return err
@@ -480,7 +529,8 @@ func pruneExcessiveReplicas() error {
 			Id  string
 			Doc struct {
 				Json struct {
-					Nodes map[string]string
+					Nodes  map[string]string
+					Pinned []string
 				}
 			}
 		}
@@ -511,25 +561,26 @@ func pruneExcessiveReplicas() error {
 	}
 
 	for _, r := range viewRes.Rows {
-		pruneBlob(r.Id[1:], r.Doc.Json.Nodes, nl)
+		pruneBlob(r.Id[1:], r.Doc.Json.Nodes, r.Doc.Json.Pinned, nl,
+			globalConfig.MaxReplicas)
 	}
 	return nil
 }
 
 func hasBlob(oid string) bool {
-	_, err := os.Stat(hashFilename(*root, oid))
+	_, err := os.Stat(blobFilename(oid))
 	return err == nil
 }
 
 var fetchLocks namedLock
 
 func performFetch(oid, prev string) {
-	c := captureResponseWriter{w: ioutil.Discard, hdr: http.Header{}}
+	c := captureResponseWriter{w: repairWriter{ioutil.Discard}, hdr: http.Header{}}
 
 	// If we already have it, we don't need it more.
-	st, err := os.Stat(hashFilename(*root, oid))
+	st, err := os.Stat(blobFilename(oid))
 	if err == nil {
-		err = recordBlobOwnership(oid, st.Size(), false)
+		err = recordBlobOwnership(oid, localBlobSize(st), false)
 		if err != nil {
 			log.Printf("Error recording fetched blob %v: %v",
 				oid, err)
@@ -592,8 +643,22 @@ func salvageBlob(oid, deadNode string, todo int, nl NodeList) bool {
 
 var internodeTaskQueue chan internodeTask
 
+// How many internode task workers are running, and a way to tell
+// one to stop.
+var taskWorkerCount struct {
+	sync.Mutex
+	n int
+}
+var taskWorkerQuit = make(chan bool)
+
 func internodeTaskWorker() {
-	for c := range internodeTaskQueue {
+	for {
+		var c internodeTask
+		select {
+		case c = <-internodeTaskQueue:
+		case <-taskWorkerQuit:
+			return
+		}
 		switch c.cmd {
 		case removeObjectCmd:
 			if err := c.node.deleteBlob(c.oid); err != nil {
@@ -620,9 +685,20 @@ func internodeTaskWorker() {
 }
 
 func initTaskQueueWorkers() {
-	for i := 0; i < *taskWorkers; i++ {
+	setTaskWorkers(*taskWorkers)
+}
+
+// Start or stop internode task workers until n are running.
+func setTaskWorkers(n int) {
+	taskWorkerCount.Lock()
+	defer taskWorkerCount.Unlock()
+	for ; taskWorkerCount.n < n; taskWorkerCount.n++ {
 		go internodeTaskWorker()
 	}
+	for ; taskWorkerCount.n > n; taskWorkerCount.n-- {
+		// Whichever worker finishes its task first.
+		go func() { taskWorkerQuit <- true }()
+	}
 }
 
 func queueBlobRemoval(n StorageNode, oid string) {
@@ -675,34 +751,54 @@ func maybeQueueBlobFetch(oid, prev string) bool {
 }
 
 type errNotLocal struct {
-	urls []string
+	oid   string
+	nodes NodeList
+}
+
+// Where to find the blob, those in zone z first.
+func (e errNotLocal) urls(z string) []string {
+	return e.nodes.preferZone(z).BlobURLs(e.oid)
 }
 
 func (e errNotLocal) Error() string {
-	return fmt.Sprintf("non-local, try one of these: %v", e.urls)
+	return fmt.Sprintf("non-local, try one of these: %v", e.urls(""))
 }
 
 func openBlob(oid string, localOnly bool) (io.ReadCloser, error) {
-	f, err := openLocalBlob(oid)
+	f, err := openHotBlob(oid)
 	if err == nil {
 		return f, err
 	}
+	repairing := err == errCorruptBlob
 
 	// Special case, just describe where things are.
 	bo, err := getBlobOwnership(oid)
 	if err != nil {
 		return nil, err
 	}
-	nl := bo.ResolveNodes()
+	if _, ours := bo.Nodes[serverId]; ours && !repairing {
+		log.Printf("Registered local copy of %v is missing, repairing", oid)
+		go repairLocalBlob(oid)
+		repairing = true
+	}
+	nl := bo.ResolveRemoteNodes()
+	if len(nl) == 0 && bo.EC != nil {
+		return openErasureSet(oid, bo)
+	}
 	if len(nl) == 0 {
 		return nil, errors.New("no copies found")
 	}
 
 	if localOnly {
-		return nil, errNotLocal{nl.BlobURLs(oid)}
+		return nil, errNotLocal{oid, nl}
 	}
 
-	return openRemote(oid, bo.Length, *cachePercentage, nl)
+	// A repair is already writing a new local copy.
+	cachePerc := cachePercent()
+	if repairing {
+		cachePerc = 0
+	}
+	return openRemote(oid, bo.Length, cachePerc, nl.preferZone(*zone))
 }
 
 type readerClosers struct {
@@ -722,6 +818,9 @@ func (r *readerClosers) Close() (err error) {
 }
 
 func openRemote(oid string, l int64, cachePerc int, nl NodeList) (io.ReadCloser, error) {
+	if f, ok := blobReadCache.open(oid); ok {
+		return f, nil
+	}
 	for _, sid := range nl {
 		resp, err := sid.ClientForTransfer(l).Get(sid.BlobURL(oid))
 		if err != nil {
@@ -741,10 +840,10 @@ func openRemote(oid string, l int64, cachePerc int, nl NodeList) (io.ReadCloser,
 			availableSpace() > l)
 
 		if !shouldCache {
-			return resp.Body, nil
+			return blobReadCache.fill(oid, l, resp.Body), nil
 		}
 
-		hw, err := NewHashRecord(*root, oid)
+		hw, err := NewHashRecord(pickVolume(), oid)
 		r := io.TeeReader(resp.Body, hw)
 		rv := &hwFinisher{r, hw, oid, l}
 		return &readerClosers{rv, []io.Closer{rv, resp.Body}}, nil
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+const (
+	bulkDeleteKeyPrefix = "/@bulkdelete/"
+	bulkDeleteWorkers   = 8
+	// How long the outcome of a finished deletion stays around
+	bulkDeleteKeep = 24 * time.Hour
+)
+
+var errNoSuchBulkDelete = errors.New("no such task")
+
+// A server-side deletion of everything under a path.
+type bulkDelete struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Path      string    `json:"path"`
+	Node      string    `json:"node"`
+	State     string    `json:"state"`
+	Deleted   int64     `json:"deleted"`
+	Errors    int64     `json:"errors"`
+	LastError string    `json:"lastError,omitempty"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+}
+
+func getBulkDelete(id string) (bulkDelete, error) {
+	bd := bulkDelete{}
+	err := couchbase.Get(bulkDeleteKeyPrefix+id, &bd)
+	if gomemcached.IsNotFound(err) || (err == nil && bd.Type != "bulkdelete") {
+		err = errNoSuchBulkDelete
+	}
+	return bd, err
+}
+
+func (bd *bulkDelete) store() error {
+	return couchbase.Set(bulkDeleteKeyPrefix+bd.ID,
+		int(bulkDeleteKeep.Seconds()), bd)
+}
+
+// Start deleting everything under a path in the background.
+func startBulkDelete(path string) (*bulkDelete, error) {
+	id, err := newRandomID("rm-", 8)
+	if err != nil {
+		return nil, err
+	}
+	bd := &bulkDelete{
+		ID:      id,
+		Type:    "bulkdelete",
+		Path:    path,
+		Node:    serverId,
+		State:   "running",
+		Started: time.Now().UTC(),
+	}
+	if err := bd.store(); err != nil {
+		return nil, err
+	}
+	if err := setTaskState(id, "running"); err != nil {
+		log.Printf("Error recording task %v: %v", id, err)
+	}
+
+	go bd.run()
+	return bd, nil
+}
+
+func (bd *bulkDelete) progress() {
+	d, e := atomic.LoadInt64(&bd.Deleted), atomic.LoadInt64(&bd.Errors)
+	setTaskDetail(bd.ID, fmt.Sprintf("deleted %v under %v, %v errors",
+		d, bd.Path, e))
+	snap := *bd
+	snap.Deleted, snap.Errors = d, e
+	if err := snap.store(); err != nil {
+		log.Printf("Error recording progress of %v: %v", bd.ID, err)
+	}
+}
+
+func (bd *bulkDelete) run() {
+	defer setTaskState(bd.ID, "")
+
+	ch := make(chan *namedFile, 1000)
+	errs := make(chan error, 100)
+	quit := make(chan bool)
+	go pathGenerator(bd.Path+"/", ch, errs, quit)
+
+	var mu sync.Mutex
+	failed := func(err error) {
+		atomic.AddInt64(&bd.Errors, 1)
+		mu.Lock()
+		bd.LastError = err.Error()
+		mu.Unlock()
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < bulkDeleteWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for nf := range ch {
+				if nf.err != nil {
+					if !gomemcached.IsNotFound(nf.err) {
+						failed(nf.err)
+					}
+					continue
+				}
+				_, err := deleteFile(shortName(nf.name))
+				switch {
+				case err == nil:
+					atomic.AddInt64(&bd.Deleted, 1)
+					duFileChanged(nf.name, nf.meta, fileMeta{})
+					notifyObject("deleted", nf.name, nf.meta)
+				case !gomemcached.IsNotFound(err):
+					log.Printf("Error deleting %v: %v", nf.name, err)
+					failed(err)
+				}
+			}
+		}()
+	}
+
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for running := true; running; {
+		select {
+		case err, ok := <-errs:
+			if ok {
+				failed(err)
+			} else {
+				errs = nil
+			}
+		case <-t.C:
+			mu.Lock()
+			bd.progress()
+			mu.Unlock()
+		case <-done:
+			running = false
+		}
+	}
+	if errs != nil {
+		for err := range errs {
+			failed(err)
+		}
+	}
+
+	bd.State = "done"
+	if bd.Errors > 0 {
+		bd.State = "failed"
+	}
+	bd.Finished = time.Now().UTC()
+	if err := bd.store(); err != nil {
+		log.Printf("Error recording completion of %v: %v", bd.ID, err)
+	}
+	log.Printf("Deleted %v files under %v (%v errors)",
+		bd.Deleted, bd.Path, bd.Errors)
+}
+
+func doDeleteRecursive(w http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(req.URL.Path, "/")
+	if path == "" {
+		http.Error(w, "Refusing to delete everything", 400)
+		return
+	}
+
+	bd, err := startBulkDelete(path)
+	if err != nil {
+		log.Printf("Error starting deletion of %v: %v", path, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Location", taskPrefix+bd.ID)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(202)
+	fmt.Fprintf(w, "{\"id\": %q}\n", bd.ID)
+}
+
+func doGetBulkDelete(w http.ResponseWriter, req *http.Request, id string) {
+	bd, err := getBulkDelete(id)
+	switch err {
+	case nil:
+	case errNoSuchBulkDelete:
+		http.Error(w, err.Error(), 404)
+		return
+	default:
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	sendJson(w, req, bd)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Bundles are tars of a full backup along with the blobs it refers
+// to, so they can be restored into a cluster that's lost every copy.
+// Each blob comes just before the metadata of the first file made of
+// it:
+//
+//	cbfs-bundle.json  {"version": 1, "created": ...}
+//	blobs/<oid>       blob content
+//	meta/<path>       a file's metadata, as in a backup
+const (
+	bundleVersion    = 1
+	bundleHeaderName = "cbfs-bundle.json"
+	bundleBlobDir    = "blobs/"
+	bundleMetaDir    = "meta/"
+)
+
+// The blobs holding a file's content, with their lengths.
+func contentParts(fm fileMeta) []blobPart {
+	if len(fm.Parts) > 0 {
+		return fm.Parts
+	}
+	return []blobPart{{fm.OID, fm.Length}}
+}
+
+func writeTarEntry(tw *tar.Writer, name string, t time.Time,
+	data []byte) error {
+
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: t,
+	})
+	if err == nil {
+		_, err = tw.Write(data)
+	}
+	return err
+}
+
+// Write a bundle of everything under path.
+func writeBundle(w io.Writer, path string) error {
+	quit := make(chan bool)
+	defer close(quit)
+	ch := make(chan *namedFile)
+	cherr := make(chan error)
+
+	go pathGenerator(path, ch, cherr, quit)
+	go logErrors("bundle", cherr)
+
+	defer logDuration("bundle", time.Now())
+
+	tw := tar.NewWriter(w)
+	now := time.Now().UTC()
+	hdr, err := json.Marshal(map[string]interface{}{
+		"version": bundleVersion,
+		"created": now,
+	})
+	if err == nil {
+		err = writeTarEntry(tw, bundleHeaderName, now, hdr)
+	}
+	if err != nil {
+		return err
+	}
+
+	written := map[string]bool{}
+	for nf := range ch {
+		if nf.err != nil {
+			log.Printf("Error on %v: %v", nf.name, nf.err)
+			continue
+		}
+
+		for _, p := range contentParts(nf.meta) {
+			if written[p.OID] {
+				continue
+			}
+			err := tw.WriteHeader(&tar.Header{
+				Name:    bundleBlobDir + p.OID,
+				Mode:    0644,
+				Size:    p.Length,
+				ModTime: nf.meta.Modified,
+			})
+			if err != nil {
+				return err
+			}
+			if err := copyBlob(tw, p.OID); err != nil {
+				return fmt.Errorf("error copying blob %v of %v: %v",
+					p.OID, nf.name, err)
+			}
+			written[p.OID] = true
+		}
+
+		meta, err := json.Marshal(nf.meta)
+		if err != nil {
+			return err
+		}
+		err = writeTarEntry(tw, bundleMetaDir+nf.name, nf.meta.Modified, meta)
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// GET /.cbfs/backup/bundle/<path> streams a bundle of everything under
+// path.
+func doBundle(w http.ResponseWriter, req *http.Request, path string) {
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=%q", archiveFilename(path, "tar")))
+	w.Header().Set("Content-Type", "application/x-tar")
+
+	if canGzip(req) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		w = &geezyWriter{w, gz}
+	}
+
+	w.WriteHeader(200)
+	if err := writeBundle(w, path); err != nil {
+		log.Printf("Error writing bundle of %q: %v", path, err)
+		// Cut the response off so it can't be mistaken for a
+		// complete bundle.
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestContentParts(t *testing.T) {
+	whole := fileMeta{OID: "abc", Length: 10}
+	exp := []blobPart{{"abc", 10}}
+	if got := contentParts(whole); !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v for a whole file, got %v", exp, got)
+	}
+
+	parts := []blobPart{{"p1", 6}, {"p2", 4}}
+	split := fileMeta{OID: "abc", Length: 10, Parts: parts}
+	if got := contentParts(split); !reflect.DeepEqual(got, parts) {
+		t.Errorf("Expected %v for a file in parts, got %v", parts, got)
+	}
+}
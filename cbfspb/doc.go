@@ -0,0 +1,9 @@
+// Package cbfspb holds the cbfs gRPC API definition.  The Go code is
+// generated from cbfs.proto, which needs protoc with the Go plugins:
+//
+//	go get google.golang.org/protobuf/cmd/protoc-gen-go \
+//		google.golang.org/grpc/cmd/protoc-gen-go-grpc
+//	go generate github.com/couchbaselabs/cbfs/cbfspb
+package cbfspb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative cbfs.proto
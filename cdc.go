@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"io"
+)
+
+// Random values for each byte, fixed forever since changing them
+// would move every chunk boundary and defeat dedup against anything
+// already stored.
+var gearTable = func() (rv [256]uint64) {
+	// splitmix64
+	x := uint64(0x63626673) // "cbfs"
+	for i := range rv {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		rv[i] = z ^ (z >> 31)
+	}
+	return
+}()
+
+// Reads from a stream up to the next content-defined chunk boundary,
+// found with a gear rolling hash.  Chunks are never smaller than min
+// (except at the end) or bigger than max.
+type cdcReader struct {
+	r        *bufio.Reader
+	min, max int64
+	mask     uint64
+	n        int64
+	h        uint64
+	done     bool
+}
+
+// Split chunks averaging about avg bytes.
+func cdcChunker(avg int64) chunker {
+	bits := uint(0)
+	for int64(1)<<(bits+1) <= avg {
+		bits++
+	}
+	// The high bits of a gear hash depend on the most bytes.
+	mask := ((uint64(1) << bits) - 1) << (64 - bits)
+	min, max := avg/4, avg*4
+	return func(br *bufio.Reader) io.Reader {
+		return &cdcReader{r: br, min: min, max: max, mask: mask}
+	}
+}
+
+func (c *cdcReader) Read(p []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+	if c.r.Buffered() == 0 {
+		if _, err := c.r.Peek(1); err != nil {
+			return 0, err
+		}
+	}
+	buf, _ := c.r.Peek(c.r.Buffered())
+	if len(buf) > len(p) {
+		buf = buf[:len(p)]
+	}
+
+	i := 0
+	for i < len(buf) {
+		c.h = (c.h << 1) + gearTable[buf[i]]
+		c.n++
+		i++
+		if c.n >= c.max || (c.n >= c.min && c.h&c.mask == 0) {
+			c.done = true
+			break
+		}
+	}
+	n := copy(p, buf[:i])
+	c.r.Discard(n)
+	return n, nil
+}
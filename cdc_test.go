@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// Split data into chunks, returning the hash of each.
+func cdcSplit(t *testing.T, data []byte, avg int64) []string {
+	next := cdcChunker(avg)
+	br := bufio.NewReader(bytes.NewReader(data))
+	rv := []string{}
+	total := 0
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			break
+		}
+		chunk, err := ioutil.ReadAll(next(br))
+		if err != nil {
+			t.Fatalf("Error reading chunk: %v", err)
+		}
+		if int64(len(chunk)) > avg*4 {
+			t.Errorf("Chunk of %v bytes is over the max", len(chunk))
+		}
+		total += len(chunk)
+		rv = append(rv, fmt.Sprintf("%x", sha1.Sum(chunk)))
+	}
+	if total != len(data) {
+		t.Fatalf("Chunks add up to %v bytes, expected %v", total, len(data))
+	}
+	return rv
+}
+
+func TestCDCInsertion(t *testing.T) {
+	data := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	changed := append(append(append([]byte{}, data[:500000]...),
+		"a small insertion"...), data[500000:]...)
+
+	before := cdcSplit(t, data, 16*1024)
+	after := cdcSplit(t, changed, 16*1024)
+	if len(before) < 16 {
+		t.Fatalf("Expected dozens of chunks, got %v", len(before))
+	}
+
+	seen := map[string]bool{}
+	for _, c := range before {
+		seen[c] = true
+	}
+	fresh := 0
+	for _, c := range after {
+		if !seen[c] {
+			fresh++
+		}
+	}
+	if fresh > 2 {
+		t.Errorf("Expected an insertion to change at most 2 of %v chunks, changed %v",
+			len(after), fresh)
+	}
+}
+
+// The client splits files the same way to send only changed chunks,
+// so boundaries must never move.  client_test.go pins the same ones.
+func TestCDCBoundaries(t *testing.T) {
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	next := cdcChunker(16 * 1024)
+	br := bufio.NewReader(bytes.NewReader(data))
+	got := []int{}
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			break
+		}
+		chunk, err := ioutil.ReadAll(next(br))
+		if err != nil {
+			t.Fatalf("Error reading chunk: %v", err)
+		}
+		got = append(got, len(chunk))
+	}
+
+	exp := []int{13881, 18960, 26712, 6188, 6663, 5608, 5328, 14878, 5256,
+		22906, 4404, 56390, 10934, 8338, 19161, 4602, 31935}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected chunks of %v, got %v", exp, got)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	changeSeqKey       = "/@changeseq"
+	changeKeyPrefix    = "/@change/"
+	changesDefaultMax  = 1000
+	changesPollFreq    = time.Second
+	changesDefaultWait = time.Minute
+	// A change missing this long after a later one was recorded is
+	// never going to show up.
+	changeGapTimeout = 30 * time.Second
+)
+
+func changeKey(seq uint64) string {
+	return changeKeyPrefix + strconv.FormatUint(seq, 10)
+}
+
+func changeExpiration() int {
+	d := globalConfig.ChangesRetention
+	if d > time.Hour*24*30 {
+		return int(time.Now().Add(d).Unix())
+	}
+	return int(d.Seconds())
+}
+
+// Give an event the next sequence number and store it in the changes
+// feed.
+func recordChange(ev *objectEvent) error {
+	seq, err := couchbase.Incr(changeSeqKey, 1, 1, 0)
+	if err != nil {
+		return err
+	}
+	ev.Seq = seq
+	return couchbase.Set(changeKey(seq), changeExpiration(), ev)
+}
+
+func lastChangeSeq() (uint64, error) {
+	return couchbase.Incr(changeSeqKey, 0, 0, 0)
+}
+
+// Read up to limit changes after since, returning them and the
+// sequence number to resume from.
+func readChanges(since uint64, limit int) ([]objectEvent, uint64, error) {
+	cur, err := lastChangeSeq()
+	if err != nil || cur <= since {
+		return nil, since, err
+	}
+	end := cur
+	if end-since > uint64(limit) {
+		end = since + uint64(limit)
+	}
+
+	keys := make([]string, 0, end-since)
+	for seq := since + 1; seq <= end; seq++ {
+		keys = append(keys, changeKey(seq))
+	}
+	res, err := couchbase.GetBulk(keys)
+	if err != nil {
+		return nil, since, err
+	}
+
+	found := map[uint64]objectEvent{}
+	for seq := since + 1; seq <= end; seq++ {
+		r, ok := res[changeKey(seq)]
+		ev := objectEvent{}
+		if ok && json.Unmarshal(r.Body, &ev) == nil {
+			found[seq] = ev
+		}
+	}
+	changes, last := settleChanges(since, end, end < cur, found,
+		time.Now())
+	return changes, last, nil
+}
+
+// Put the changes found between since and end in order.  A sequence
+// number with nothing stored may belong to a write still in flight,
+// so reading stops there unless a later change is old enough to say
+// it was lost, or the whole range is gone (i.e. it has expired) and
+// there's more after it.
+func settleChanges(since, end uint64, more bool,
+	found map[uint64]objectEvent, now time.Time) ([]objectEvent, uint64) {
+
+	if len(found) == 0 {
+		if more {
+			return nil, end
+		}
+		return nil, since
+	}
+
+	rv := []objectEvent{}
+	last := since
+	for seq := since + 1; seq <= end; seq++ {
+		if ev, ok := found[seq]; ok {
+			rv = append(rv, ev)
+			last = seq
+			continue
+		}
+		lost := false
+		for later := seq + 1; later <= end; later++ {
+			if ev, ok := found[later]; ok {
+				lost = now.Sub(ev.Time) > changeGapTimeout
+				break
+			}
+		}
+		if !lost {
+			break
+		}
+		last = seq
+	}
+	return rv, last
+}
+
+type changesOptions struct {
+	since uint64
+	limit int
+	feed  string
+	wait  time.Duration
+}
+
+func changesOptionsFrom(req *http.Request) (changesOptions, error) {
+	o := changesOptions{
+		limit: changesDefaultMax,
+		feed:  req.FormValue("feed"),
+		wait:  changesDefaultWait,
+	}
+	since := req.FormValue("since")
+	if since == "" {
+		since = req.Header.Get("Last-Event-ID")
+	}
+	var err error
+	switch since {
+	case "":
+	case "now":
+		o.since, err = lastChangeSeq()
+		if err != nil {
+			return o, err
+		}
+	default:
+		o.since, err = strconv.ParseUint(since, 10, 64)
+		if err != nil {
+			return o, fmt.Errorf("invalid since: %v", since)
+		}
+	}
+	if l := req.FormValue("limit"); l != "" {
+		o.limit, err = strconv.Atoi(l)
+		if err != nil || o.limit < 1 {
+			return o, fmt.Errorf("invalid limit: %v", l)
+		}
+		if o.limit > changesDefaultMax {
+			o.limit = changesDefaultMax
+		}
+	}
+	if t := req.FormValue("timeout"); t != "" {
+		o.wait, err = time.ParseDuration(t)
+		if err != nil {
+			return o, fmt.Errorf("invalid timeout: %v", t)
+		}
+	}
+	if o.feed == "" && req.Header.Get("Accept") == "text/event-stream" {
+		o.feed = "eventsource"
+	}
+	switch o.feed {
+	case "", "normal", "longpoll", "eventsource":
+	default:
+		return o, fmt.Errorf("invalid feed: %v", o.feed)
+	}
+	return o, nil
+}
+
+// Serve the changes feed.  The normal feed returns whatever's there,
+// longpoll waits for at least one change, and eventsource streams
+// changes as server-sent events until the client goes away.
+func doChanges(w http.ResponseWriter, req *http.Request) {
+	o, err := changesOptionsFrom(req)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if o.feed == "eventsource" {
+		streamChanges(w, req, o)
+		return
+	}
+
+	deadline := time.Now().Add(o.wait)
+	for {
+		changes, last, err := readChanges(o.since, o.limit)
+		if err != nil {
+			log.Printf("Error reading changes since %v: %v", o.since, err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if len(changes) > 0 || o.feed != "longpoll" ||
+			time.Now().After(deadline) {
+
+			if changes == nil {
+				changes = []objectEvent{}
+			}
+			sendJson(w, req, map[string]interface{}{
+				"results":  changes,
+				"last_seq": last,
+			})
+			return
+		}
+		o.since = last
+		select {
+		case <-req.Context().Done():
+			return
+		case <-time.After(changesPollFreq):
+		}
+	}
+}
+
+func streamChanges(w http.ResponseWriter, req *http.Request, o changesOptions) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	f.Flush()
+
+	heartbeat := time.Now()
+	for {
+		changes, last, err := readChanges(o.since, o.limit)
+		if err != nil {
+			log.Printf("Error reading changes since %v: %v", o.since, err)
+			return
+		}
+		for _, ev := range changes {
+			data, err := json.Marshal(ev)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n",
+				ev.Seq, data); err != nil {
+				return
+			}
+		}
+		if len(changes) > 0 {
+			heartbeat = time.Now()
+		} else if time.Since(heartbeat) > o.wait {
+			if _, err := fmt.Fprintf(w, ": %d\n\n", last); err != nil {
+				return
+			}
+			heartbeat = time.Now()
+		}
+		f.Flush()
+		o.since = last
+
+		if len(changes) < o.limit {
+			select {
+			case <-req.Context().Done():
+				return
+			case <-time.After(changesPollFreq):
+			}
+		}
+	}
+}
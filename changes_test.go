@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSettleChanges(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-2 * changeGapTimeout)
+	ev := func(seq uint64, when time.Time) objectEvent {
+		return objectEvent{Seq: seq, Time: when}
+	}
+
+	tests := []struct {
+		name  string
+		since uint64
+		end   uint64
+		more  bool
+		found []objectEvent
+		exp   []uint64
+		last  uint64
+	}{
+		{"all there", 0, 3, false,
+			[]objectEvent{ev(1, now), ev(2, now), ev(3, now)},
+			[]uint64{1, 2, 3}, 3},
+		{"in flight", 10, 13, false,
+			[]objectEvent{ev(11, now), ev(13, now)},
+			[]uint64{11}, 11},
+		{"lost", 10, 13, false,
+			[]objectEvent{ev(11, old), ev(13, old)},
+			[]uint64{11, 13}, 13},
+		{"trailing gap", 10, 13, false,
+			[]objectEvent{ev(11, old)},
+			[]uint64{11}, 11},
+		{"nothing yet", 5, 7, false, nil, nil, 5},
+		{"expired", 5, 7, true, nil, nil, 7},
+	}
+
+	for _, test := range tests {
+		found := map[uint64]objectEvent{}
+		for _, e := range test.found {
+			found[e.Seq] = e
+		}
+		got, last := settleChanges(test.since, test.end, test.more,
+			found, now)
+		var seqs []uint64
+		for _, e := range got {
+			seqs = append(seqs, e.Seq)
+		}
+		if !reflect.DeepEqual(seqs, test.exp) || last != test.last {
+			t.Errorf("%v: Expected %v through %v, got %v through %v",
+				test.name, test.exp, test.last, seqs, last)
+		}
+	}
+}
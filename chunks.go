@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Should a file of this length be stored in chunks?
+func shouldChunk(length int64) bool {
+	return globalConfig.ChunkThreshold > 0 && globalConfig.ChunkSize > 0 &&
+		length > globalConfig.ChunkThreshold
+}
+
+// Gives a reader for the next chunk of a stream.
+type chunker func(br *bufio.Reader) io.Reader
+
+func fixedChunker(size int64) chunker {
+	return func(br *bufio.Reader) io.Reader {
+		return io.LimitReader(br, size)
+	}
+}
+
+// The configured way of splitting files into chunks.
+func configuredChunker() chunker {
+	if globalConfig.ContentDefinedChunks {
+		return cdcChunker(globalConfig.ChunkSize)
+	}
+	return fixedChunker(globalConfig.ChunkSize)
+}
+
+// Store a stream as a sequence of blobs split by next.  Identical
+// chunks of different files are stored once.  If hashin is given, the
+// content as a whole must match it.
+func storeChunks(fn string, r io.Reader, next chunker,
+	hashin string) ([]blobPart, error) {
+
+	var check *oidHash
+	if hashin != "" {
+		check = newOIDHash(hashin)
+		r = io.TeeReader(r, check)
+	}
+	br := bufio.NewReader(r)
+
+	parts := []blobPart{}
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		f, err := NewHashRecord(pickVolume(), "")
+		if err != nil {
+			return nil, err
+		}
+		h, length, err := f.Process(next(br))
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if err := recordBlobOwnership(h, length, true); err != nil {
+			return nil, err
+		}
+		if want := replicaTarget(fn); want > 1 {
+			go increaseReplicaCount(h, length, want-1)
+		}
+		parts = append(parts, blobPart{h, length})
+	}
+
+	if check != nil && check.match(hashin) == "" {
+		return nil, fmt.Errorf("Invalid hash %v != %v",
+			hashin, check.sum())
+	}
+	return parts, nil
+}
+
+// Store an upload as a sequence of chunks rather than one blob.
+func putChunkedFile(w http.ResponseWriter, req *http.Request, fn string,
+	expires time.Time) {
+
+	start := time.Now()
+	parts, err := storeChunks(fn, req.Body, configuredChunker(),
+		req.Header.Get("X-CBFS-Hash"))
+	if err != nil {
+		log.Printf("Error storing chunks of %v: %v", fn, err)
+		http.Error(w, fmt.Sprintf("Error completing blob write: %v", err), 500)
+		return
+	}
+
+	revs := globalConfig.DefaultVersionCount
+	if i, err := strconv.Atoi(req.Header.Get("X-CBFS-KeepRevs")); err == nil {
+		revs = i
+	}
+
+	fm := fileMeta{Headers: storedHeaders(req.Header), Expires: expires}
+	h, err := storeComposed(fn, fm, parts, getExpiration(req.Header),
+		revs, req.Header)
+	if err != nil {
+		sendComposeError(w, fn, err)
+		return
+	}
+
+	log.Printf("Wrote %v -> %v in %v chunks in %v",
+		req.URL.Path, h, len(parts), time.Since(start))
+	w.Header().Set("Etag", fileETag(h))
+	w.WriteHeader(201)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestShouldChunk(t *testing.T) {
+	defer func(th, sz int64) {
+		globalConfig.ChunkThreshold, globalConfig.ChunkSize = th, sz
+	}(globalConfig.ChunkThreshold, globalConfig.ChunkSize)
+
+	tests := []struct {
+		threshold, size, length int64
+		exp                     bool
+	}{
+		{0, 1024, 1 << 30, false},
+		{4096, 1024, 4096, false},
+		{4096, 1024, 4097, true},
+		{4096, 0, 1 << 30, false},
+		{4096, 1024, -1, false},
+	}
+
+	for _, test := range tests {
+		globalConfig.ChunkThreshold = test.threshold
+		globalConfig.ChunkSize = test.size
+		if got := shouldChunk(test.length); got != test.exp {
+			t.Errorf("Expected %v for %v byte file with %+v, got %v",
+				test.exp, test.length, test, got)
+		}
+	}
+}
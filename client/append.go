@@ -0,0 +1,42 @@
+package cbfsclient
+
+import (
+	"io"
+	"net/url"
+	"strings"
+)
+
+// Add data to the end of a file, creating it if it doesn't exist.
+// The existing content isn't rewritten.  Returns the file's new OID.
+func (c Client) Append(dest string, r io.Reader) (string, error) {
+	res, err := c.httpClient().Post(c.URLFor(dest)+"?append=true",
+		"application/octet-stream", r)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 201 {
+		return "", newStatusError(res)
+	}
+	return strings.Trim(res.Header.Get("Etag"), `"`), nil
+}
+
+// Make dest the concatenation of the sources without copying their
+// content.  Returns dest's new OID.
+func (c Client) Compose(dest string, sources ...string) (string, error) {
+	v := url.Values{"source": sources}
+	res, err := c.httpClient().Post(
+		c.URLFor("/.cbfs/compose/"+noSlash(dest))+"?"+v.Encode(),
+		"", nil)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case 201:
+		return strings.Trim(res.Header.Get("Etag"), `"`), nil
+	case 404:
+		return "", Missing
+	}
+	return "", newStatusError(res)
+}
@@ -0,0 +1,25 @@
+package cbfsclient
+
+import (
+	"io"
+	"net/url"
+	"strings"
+)
+
+// Stream an archive of everything under a directory ("" for
+// everything) in the given format: tar, tar.gz (or tgz), or zip.
+func (c Client) Archive(dir, format string) (io.ReadCloser, error) {
+	u := c.URLFor("/.cbfs/archive/" + strings.Trim(dir, "/"))
+	if format != "" {
+		u += "?format=" + url.QueryEscape(format)
+	}
+	res, err := c.httpClient().Get(u)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		defer res.Body.Close()
+		return nil, newStatusError(res)
+	}
+	return res.Body, nil
+}
@@ -0,0 +1,82 @@
+package cbfsclient
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Hosts that belong to a cbfs cluster this process talks to.  The
+// token is only ever sent to these.
+var clusterHosts = struct {
+	sync.RWMutex
+	m map[string]bool
+}{m: map[string]bool{}}
+
+func addClusterHost(h string) {
+	clusterHosts.Lock()
+	defer clusterHosts.Unlock()
+	clusterHosts.m[h] = true
+}
+
+func isClusterHost(h string) bool {
+	clusterHosts.RLock()
+	defer clusterHosts.RUnlock()
+	return clusterHosts.m[h]
+}
+
+type tokenTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Authorization") == "" && isClusterHost(req.URL.Host) {
+		r := *req
+		r.Header = http.Header{}
+		for k, v := range req.Header {
+			r.Header[k] = v
+		}
+		r.Header.Set("Authorization", "Bearer "+t.token)
+		req = &r
+	}
+	return t.base.RoundTrip(req)
+}
+
+// Send the given API token on all requests to cbfs nodes made
+// through http.DefaultClient.  Nodes are those a Client has been
+// created for or has discovered, plus any listed in urls.
+func UseToken(token string, urls ...string) {
+	if token == "" {
+		return
+	}
+	for _, s := range urls {
+		if u, err := url.Parse(s); err == nil {
+			addClusterHost(u.Host)
+		}
+	}
+	base := http.DefaultClient.Transport
+	if tt, ok := base.(*tokenTransport); ok {
+		base = tt.base
+	}
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	http.DefaultClient.Transport = &tokenTransport{token, base}
+}
+
+// Find the user's API token in $CBFS_TOKEN or ~/.cbfstoken.
+func TokenFromEnv() string {
+	if t := os.Getenv("CBFS_TOKEN"); t != "" {
+		return t
+	}
+	data, err := ioutil.ReadFile(filepath.Join(os.Getenv("HOME"), ".cbfstoken"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
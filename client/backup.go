@@ -0,0 +1,163 @@
+package cbfsclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Options for making a backup.
+type BackupOptions struct {
+	// Previous backup to make an incremental backup against
+	Parent string
+	// If true, return as soon as the backup has started
+	Background bool
+	// Encrypt the backup with a key derived from this
+	Secret []byte
+}
+
+// Back up all file metadata into the cbfs file fn.
+func (c Client) Backup(fn string, opts BackupOptions) error {
+	return c.BackupContext(context.Background(), fn, opts)
+}
+
+// Like Backup, but stops waiting when ctx is done.  The backup
+// itself carries on in the server.
+func (c Client) BackupContext(ctx context.Context, fn string,
+	opts BackupOptions) error {
+
+	form := url.Values{
+		"fn": []string{fn},
+		"bg": []string{strconv.FormatBool(opts.Background)},
+	}
+	if opts.Parent != "" {
+		form.Set("parent", opts.Parent)
+	}
+	if len(opts.Secret) > 0 {
+		form.Set("secret", string(opts.Secret))
+	}
+
+	req, err := http.NewRequest("POST", c.URLFor("/.cbfs/backup/"),
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := c.httpClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 201 && res.StatusCode != 202 {
+		return newStatusError(res)
+	}
+	return nil
+}
+
+// Options for restoring a backup kept in S3 or GCS.
+type RestoreBackupOptions struct {
+	// Only restore paths matching this regex
+	Match string
+	// Replace files that already exist
+	Force bool
+	// Secret the backup was encrypted with
+	Secret []byte
+}
+
+// What came of restoring a backup.
+type RestoreBackupResult struct {
+	Restored     int `json:"restored"`
+	Existing     int `json:"existing"`
+	Expired      int `json:"expired"`
+	MissingBlobs int `json:"missingBlobs"`
+	Failed       int `json:"failed"`
+}
+
+// Have the server restore the files in a full backup at an
+// s3://bucket/key or gs://bucket/key URL, which it reads itself.
+func (c Client) RestoreBackup(src string,
+	opts RestoreBackupOptions) (RestoreBackupResult, error) {
+
+	return c.RestoreBackupContext(context.Background(), src, opts)
+}
+
+// Like RestoreBackup, but stops waiting when ctx is done.  The
+// restore itself carries on in the server.
+func (c Client) RestoreBackupContext(ctx context.Context, src string,
+	opts RestoreBackupOptions) (RestoreBackupResult, error) {
+
+	rv := RestoreBackupResult{}
+	form := url.Values{
+		"src":   []string{src},
+		"match": []string{opts.Match},
+		"force": []string{strconv.FormatBool(opts.Force)},
+	}
+	if len(opts.Secret) > 0 {
+		form.Set("secret", string(opts.Secret))
+	}
+
+	req, err := http.NewRequest("POST", c.URLFor("/.cbfs/backup/restore/"),
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return rv, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := c.httpClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return rv, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return rv, newStatusError(res)
+	}
+	err = json.NewDecoder(res.Body).Decode(&rv)
+	return rv, err
+}
+
+// Restore the file at path from its backed up metadata.  The
+// expiration (in seconds, or absolute unix time) overrides the one
+// recorded with the file unless it's -1.  Returns Exists if there's
+// already a file there.
+func (c Client) Restore(path string, meta FileMeta, expiration int) error {
+	return c.RestoreContext(context.Background(), path, meta, expiration)
+}
+
+// Like Restore, but stops when ctx is done.
+func (c Client) RestoreContext(ctx context.Context, path string,
+	meta FileMeta, expiration int) error {
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	return c.withNodes(ctx, c.Backoff, c.u, func(base string) error {
+		req, err := http.NewRequest("POST",
+			base+".cbfs/backup/restore/"+noSlash(path),
+			bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-CBFS-Expiration", strconv.Itoa(expiration))
+
+		res, err := c.httpClient().Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		switch res.StatusCode {
+		case 201:
+			return nil
+		case 409:
+			return Exists
+		}
+		return newStatusError(res)
+	})
+}
@@ -0,0 +1,58 @@
+package cbfsclient
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/dustin/httputil"
+)
+
+// One operation in a batch.
+type BatchOp struct {
+	// "delete", "touch", "set-header" or "copy"
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	// Only act if the file has this OID
+	IfMatch string `json:"ifMatch,omitempty"`
+	// Where to copy to, and whether to replace a file there
+	Destination string `json:"destination,omitempty"`
+	Overwrite   *bool  `json:"overwrite,omitempty"`
+	// Headers to set (an empty value removes the header)
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// The outcome of one operation in a batch.
+type BatchResult struct {
+	Op     string `json:"op"`
+	Path   string `json:"path"`
+	Status int    `json:"status"` // HTTP status of the operation
+	Error  string `json:"error"`
+}
+
+// Did the operation succeed?
+func (r BatchResult) OK() bool {
+	return r.Status < 300
+}
+
+// Run a batch of operations on the server in one request.  The
+// results are in the same order as the operations.  A failed
+// operation doesn't stop the ones after it.
+func (c Client) Batch(ops []BatchOp) ([]BatchResult, error) {
+	data, err := json.Marshal(ops)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.httpClient().Post(c.URLFor("/.cbfs/batch/"),
+		"application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, httputil.HTTPError(res)
+	}
+
+	rv := []BatchResult{}
+	err = json.NewDecoder(res.Body).Decode(&rv)
+	return rv, err
+}
@@ -0,0 +1,53 @@
+package cbfsclient
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Something that happened to a file.
+type Change struct {
+	Seq      uint64    `json:"seq"`
+	Event    string    `json:"event"`
+	Path     string    `json:"path"`
+	OID      string    `json:"oid"`
+	Length   int64     `json:"length"`
+	Revno    int       `json:"revno"`
+	Modified time.Time `json:"modified"`
+	Time     time.Time `json:"time"`
+	Node     string    `json:"node"`
+}
+
+// A batch of changes from the changes feed.
+type ChangesResult struct {
+	Results []Change `json:"results"`
+	// Pass this as since to get the changes after these
+	LastSeq uint64 `json:"last_seq"`
+}
+
+// Get up to limit changes after the given sequence number.  If wait
+// is non-zero and nothing's changed, wait up to that long for
+// something to.
+func (c Client) Changes(since uint64, limit int,
+	wait time.Duration) (ChangesResult, error) {
+
+	v := url.Values{"since": {strconv.FormatUint(since, 10)}}
+	if limit > 0 {
+		v.Set("limit", strconv.Itoa(limit))
+	}
+	if wait > 0 {
+		v.Set("feed", "longpoll")
+		v.Set("timeout", wait.String())
+	}
+	rv := ChangesResult{}
+	err := getJsonData(c.URLFor("/.cbfs/changes/")+"?"+v.Encode(), &rv)
+	return rv, err
+}
+
+// Get the sequence number of the latest change.
+func (c Client) ChangesHead() (uint64, error) {
+	rv := ChangesResult{}
+	err := getJsonData(c.URLFor("/.cbfs/changes/")+"?since=now&limit=1", &rv)
+	return rv.LastSeq, err
+}
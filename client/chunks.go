@@ -0,0 +1,113 @@
+package cbfsclient
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The server isn't configured to store files in chunks.
+var NotChunked = errors.New("server doesn't store files in chunks")
+
+// This has to split content exactly as the server does (see chunks.go
+// and cdc.go there), or nothing will match.
+
+var gearTable = func() (rv [256]uint64) {
+	// splitmix64
+	x := uint64(0x63626673) // "cbfs"
+	for i := range rv {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		rv[i] = z ^ (z >> 31)
+	}
+	return
+}()
+
+type cdcReader struct {
+	r        *bufio.Reader
+	min, max int64
+	mask     uint64
+	n        int64
+	h        uint64
+	done     bool
+}
+
+func (c *cdcReader) Read(p []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+	if c.r.Buffered() == 0 {
+		if _, err := c.r.Peek(1); err != nil {
+			return 0, err
+		}
+	}
+	buf, _ := c.r.Peek(c.r.Buffered())
+	if len(buf) > len(p) {
+		buf = buf[:len(p)]
+	}
+
+	i := 0
+	for i < len(buf) {
+		c.h = (c.h << 1) + gearTable[buf[i]]
+		c.n++
+		i++
+		if c.n >= c.max || (c.n >= c.min && c.h&c.mask == 0) {
+			c.done = true
+			break
+		}
+	}
+	n := copy(p, buf[:i])
+	c.r.Discard(n)
+	return n, nil
+}
+
+// Gives a reader for the next chunk of a stream.
+func (s ChunkSignatures) chunker() func(br *bufio.Reader) io.Reader {
+	size := s.ChunkSize
+	if !s.ContentDefined {
+		return func(br *bufio.Reader) io.Reader {
+			return io.LimitReader(br, size)
+		}
+	}
+
+	bits := uint(0)
+	for int64(1)<<(bits+1) <= size {
+		bits++
+	}
+	mask := ((uint64(1) << bits) - 1) << (64 - bits)
+	return func(br *bufio.Reader) io.Reader {
+		return &cdcReader{r: br, min: size / 4, max: size * 4, mask: mask}
+	}
+}
+
+// Split content into the chunks the server would store it as.
+func (s ChunkSignatures) Split(r io.Reader) ([]BlobPart, error) {
+	if s.ChunkSize <= 0 {
+		return nil, NotChunked
+	}
+	newHash, ok := hashBuilders[s.Hash]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash: %v", s.Hash)
+	}
+
+	next := s.chunker()
+	br := bufio.NewReader(r)
+	rv := []BlobPart{}
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			return rv, nil
+		} else if err != nil {
+			return nil, err
+		}
+		h := newHash()
+		n, err := io.Copy(h, next(br))
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, BlobPart{hex.EncodeToString(h.Sum(nil)), n})
+	}
+}
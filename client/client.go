@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/dustin/httputil"
 )
@@ -18,6 +19,16 @@ type Client struct {
 	u     string
 	pu    *url.URL
 	nodes map[string]StorageNode
+
+	// HTTP client to make requests with (http.DefaultClient if nil)
+	HTTPClient *http.Client
+	// How to retry idempotent requests that fail transiently
+	Backoff Backoff
+	// Check downloaded content against the hash nodes send for it
+	VerifyHashes bool
+	// Prefer reading files from nodes in this zone, and tell nodes
+	// so they can do the same
+	Zone string
 }
 
 // Construct a new cbfs client.
@@ -27,7 +38,32 @@ func New(u string) (*Client, error) {
 		return nil, err
 	}
 	uc.Path = "/"
-	return &Client{u: uc.String(), pu: uc}, nil
+	addClusterHost(uc.Host)
+	return &Client{u: uc.String(), pu: uc, Backoff: DefaultBackoff}, nil
+}
+
+func (c Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// An HTTP client that keeps up to perHost idle connections open to
+// each node, for applications making many concurrent requests.  It
+// sends the token given to UseToken, if any, and uses HTTP/2 with
+// nodes that offer it over TLS.
+func PooledHTTPClient(perHost int) *http.Client {
+	var rt http.RoundTripper = &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost: perHost,
+		IdleConnTimeout:     90 * time.Second,
+		ForceAttemptHTTP2:   true,
+	}
+	if tt, ok := http.DefaultClient.Transport.(*tokenTransport); ok {
+		rt = &tokenTransport{tt.token, rt}
+	}
+	return &http.Client{Transport: rt}
 }
 
 // Get the full URL for the given filename.
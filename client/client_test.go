@@ -1,9 +1,20 @@
 package cbfsclient
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/tleyden/fakehttp"
@@ -56,6 +67,30 @@ func TestRandomNode(t *testing.T) {
 
 }
 
+func TestRandomNodeWeights(t *testing.T) {
+	c, err := New("http://localhost:8484/")
+	if err != nil {
+		t.Fatalf("Error parsing thing: %v", err)
+	}
+	c.nodes = map[string]StorageNode{
+		"big":   {HBAgeStr: "1s", Weight: 9},
+		"small": {HBAgeStr: "1s", Weight: 1},
+		"stale": {HBAgeStr: "1h", Weight: 100},
+	}
+
+	picked := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		name, _, err := c.RandomNode()
+		if err != nil {
+			t.Fatalf("Error picking a node: %v", err)
+		}
+		picked[name]++
+	}
+	if picked["stale"] > 0 || picked["big"] < 800 || picked["small"] < 50 {
+		t.Errorf("Expected about 900 big and 100 small, got %v", picked)
+	}
+}
+
 // Some assertions around filehandle's applicability
 func TestTypes(t *testing.T) {
 	_ = os.FileInfo(&FileHandle{})
@@ -65,3 +100,422 @@ func TestTypes(t *testing.T) {
 	_ = io.WriterTo(&FileHandle{})
 	_ = io.Seeker(&FileHandle{})
 }
+
+func TestContextOps(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+
+		switch req.Method + " " + req.URL.Path {
+		case "GET /.cbfs/info/file/a/b":
+			w.Write([]byte(`{"meta":{"oid":"abc","length":5},"path":"/a/b"}`))
+		case "GET /a/b":
+			w.Write([]byte("hello"))
+		case "DELETE /a/b":
+			w.WriteHeader(204)
+		case "POST /.cbfs/backup/restore/a/b":
+			w.WriteHeader(409)
+		default:
+			http.Error(w, "not found", 404)
+		}
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatalf("Error making client: %v", err)
+	}
+	c.Backoff = Backoff{Attempts: 1}
+	ctx := context.Background()
+
+	fm, err := c.StatContext(ctx, "/a/b")
+	if err != nil || fm.OID != "abc" || fm.Length != 5 {
+		t.Errorf("Expected abc/5 from stat, got %+v, %v", fm, err)
+	}
+	if _, err := c.StatContext(ctx, "nope"); err != Missing {
+		t.Errorf("Expected Missing from stat, got %v", err)
+	}
+
+	r, err := c.GetContext(ctx, "a/b")
+	if err != nil {
+		t.Fatalf("Error getting a/b: %v", err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if string(data) != "hello" || err != nil {
+		t.Errorf("Expected hello, got %q, %v", data, err)
+	}
+	if _, err := c.GetContext(ctx, "nope"); err != Missing {
+		t.Errorf("Expected Missing from get, got %v", err)
+	}
+
+	if err := c.DeleteContext(ctx, "a/b"); err != nil {
+		t.Errorf("Expected delete to succeed, got %v", err)
+	}
+	if err := c.DeleteContext(ctx, "nope"); err != Missing {
+		t.Errorf("Expected Missing from delete, got %v", err)
+	}
+
+	if err := c.RestoreContext(ctx, "a/b", fm, -1); err != Exists {
+		t.Errorf("Expected Exists from restore, got %v", err)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.StatContext(cctx, "a/b"); err == nil {
+		t.Errorf("Expected an error with a canceled context")
+	}
+}
+
+func TestPutCompress(t *testing.T) {
+	got := map[string]string{}
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+
+		if req.URL.Path == "/.cbfs/nodes/" {
+			w.Write([]byte(`{"n":{"Addr":"` + ts.Listener.Addr().String() +
+				`","hbage_str":"1s"}}`))
+			return
+		}
+		var r io.Reader = req.Body
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r)
+			if err != nil {
+				t.Errorf("Error reading gzip: %v", err)
+				return
+			}
+			r = gz
+		}
+		data, _ := ioutil.ReadAll(r)
+		got[req.URL.Path] = req.Header.Get("Content-Encoding") + ":" + string(data)
+		w.WriteHeader(201)
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatalf("Error making client: %v", err)
+	}
+
+	text := strings.Repeat("some text ", 100)
+	tests := []struct {
+		name, content string
+		compress      bool
+		exp           string
+	}{
+		{"/a.txt", text, true, "gzip:" + text},
+		{"/b.txt", text, false, ":" + text},
+		{"/c.bin", "\x00\x01\x02", true, ":\x00\x01\x02"},
+	}
+	for _, test := range tests {
+		err := c.Put(test.name, test.name, strings.NewReader(test.content),
+			PutOptions{Compress: test.compress})
+		if err != nil {
+			t.Errorf("Error putting %v: %v", test.name, err)
+		}
+		if got[test.name] != test.exp {
+			t.Errorf("Expected %.20q for %v, got %.20q",
+				test.exp, test.name, got[test.name])
+		}
+	}
+}
+
+func TestPutConditions(t *testing.T) {
+	tests := []struct {
+		opts        PutOptions
+		match, none string
+	}{
+		{PutOptions{}, "", ""},
+		{PutOptions{IfMatch: "*"}, "*", ""},
+		{PutOptions{IfMatch: "abc"}, `"abc"`, ""},
+		{PutOptions{IfNoneMatch: "*"}, "", "*"},
+		{PutOptions{IfMatch: "abc", IfNoneMatch: "def"}, `"abc"`, `"def"`},
+	}
+
+	for _, test := range tests {
+		h := http.Header{}
+		test.opts.setConditions(h)
+		if h.Get("If-Match") != test.match || h.Get("If-None-Match") != test.none {
+			t.Errorf("Expected %q/%q for %+v, got %v",
+				test.match, test.none, test.opts, h)
+		}
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+
+		if req.URL.String() != "/a/b.txt?meta=json" {
+			http.Error(w, "not found", 404)
+			return
+		}
+		w.Write([]byte(`{"path":"a/b.txt","oid":"abc","length":5,
+			"ctype":"text/plain","revno":2,"meta":{"owner":"x"},
+			"nodes":[{"name":"n1","addr":"10.0.0.1:8484"}]}`))
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatalf("Error making client: %v", err)
+	}
+
+	fi, err := c.Describe("/a/b.txt")
+	if err != nil {
+		t.Fatalf("Error describing: %v", err)
+	}
+	if fi.OID != "abc" || fi.Length != 5 || fi.Meta["owner"] != "x" ||
+		len(fi.Nodes) != 1 || fi.Nodes[0].Addr != "10.0.0.1:8484" {
+		t.Errorf("Unexpected description: %+v", fi)
+	}
+
+	if _, err := c.Describe("/missing"); err != Missing {
+		t.Errorf("Expected Missing, got %v", err)
+	}
+}
+
+func TestGetFromHolder(t *testing.T) {
+	holder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+		w.Write([]byte("direct"))
+	}))
+	defer holder.Close()
+	haddr := strings.TrimPrefix(holder.URL, "http://")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+
+		switch req.Method + " " + req.URL.Path {
+		case "GET /.cbfs/nodes/":
+			fmt.Fprintf(w, `{"h":{"addr":%q,"hbage_str":"1s"},
+				"d":{"addr":"10.0.0.2:8484","hbage_str":"1s","draining":true}}`,
+				haddr)
+		case "HEAD /a":
+			w.Header().Set(FileNodesHeader, "10.0.0.2:8484, "+haddr)
+		case "HEAD /b":
+		default:
+			w.Write([]byte("proxied"))
+		}
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatalf("Error making client: %v", err)
+	}
+	c.Backoff = Backoff{Attempts: 1}
+
+	for path, exp := range map[string]string{"a": "direct", "b": "proxied"} {
+		r, err := c.Get(path)
+		if err != nil {
+			t.Fatalf("Error getting %v: %v", path, err)
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if string(data) != exp || err != nil {
+			t.Errorf("Expected %q for %v, got %q, %v", exp, path, data, err)
+		}
+	}
+}
+
+func TestRmRecursive(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+
+		switch req.Method + " " + req.URL.String() {
+		case "DELETE /a/b/?recursive=true":
+			w.WriteHeader(202)
+			w.Write([]byte(`{"id": "rm-1"}`))
+		case "GET /.cbfs/tasks/rm-1":
+			w.Write([]byte(`{"id":"rm-1","path":"a/b","state":"done","deleted":3}`))
+		default:
+			http.Error(w, "not found", 404)
+		}
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatalf("Error making client: %v", err)
+	}
+
+	id, err := c.RmRecursive("/a/b/")
+	if id != "rm-1" || err != nil {
+		t.Fatalf("Expected rm-1, got %q, %v", id, err)
+	}
+	task, err := c.RmTask(id)
+	if err != nil || !task.Done() || task.Deleted != 3 {
+		t.Errorf("Expected 3 deleted and done, got %+v, %v", task, err)
+	}
+	if _, err := c.RmRecursive("nope"); err == nil {
+		t.Errorf("Expected an error starting a delete of nope")
+	}
+}
+
+func TestUserMeta(t *testing.T) {
+	h := http.Header{
+		"X-Cbfs-Meta-Owner": {"bob"},
+		"X-Cbfs-Meta-":      {"nameless"},
+		"Content-Type":      {"text/plain"},
+	}
+	got := UserMeta(h)
+	exp := map[string]string{"owner": "bob"}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+}
+
+func TestVerifyBody(t *testing.T) {
+	const content = "some content"
+	const bad = "sha1=1d3a9e5e8a2f4e7a2da3e1b0a1ae4c2a1c2b8c2f"
+	sum := "sha1=" + fmt.Sprintf("%x", sha1.Sum([]byte(content)))
+
+	tests := []struct {
+		header, trailer string
+		ok              bool
+	}{
+		{"", "", true},
+		{sum, "", true},
+		{bad, "", false},
+		{"blake3=abc", "", true},
+		{"", sum, true},
+		{"", bad, false},
+	}
+
+	for _, test := range tests {
+		ts := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, req *http.Request) {
+				if test.header != "" {
+					w.Header().Set(HashHeader, test.header)
+				}
+				if test.trailer != "" {
+					w.Header().Set("Trailer", HashHeader)
+				}
+				io.WriteString(w, content)
+				if test.trailer != "" {
+					w.Header().Set(HashHeader, test.trailer)
+				}
+			}))
+		res, err := http.Get(ts.URL)
+		if err != nil {
+			t.Fatalf("Error fetching: %v", err)
+		}
+		b, err := ioutil.ReadAll(VerifyBody(res))
+		res.Body.Close()
+		ts.Close()
+
+		_, mismatch := err.(*HashMismatch)
+		switch {
+		case test.ok && err != nil:
+			t.Errorf("Unexpected error for %+v: %v", test, err)
+		case !test.ok && !mismatch:
+			t.Errorf("Expected a mismatch for %+v, got %v", test, err)
+		case test.ok && string(b) != content:
+			t.Errorf("Expected %q for %+v, got %q", content, test, b)
+		}
+	}
+}
+
+func TestVerifyContent(t *testing.T) {
+	const content = "some content"
+	sum := fmt.Sprintf("%x", sha1.Sum([]byte(content)))
+
+	if err := VerifyContent(strings.NewReader(content), sum); err != nil {
+		t.Errorf("Unexpected error verifying content: %v", err)
+	}
+	err := VerifyContent(strings.NewReader("other content"), sum)
+	if _, ok := err.(*HashMismatch); !ok {
+		t.Errorf("Expected a mismatch, got %v", err)
+	}
+	if err := VerifyContent(strings.NewReader(content), "abc"); err != nil {
+		t.Errorf("Unexpected error for an unknown hash: %v", err)
+	}
+}
+
+func TestChunkSignaturesSplit(t *testing.T) {
+	fixed := ChunkSignatures{Hash: "sha1", ChunkSize: 4}
+	got, err := fixed.Split(strings.NewReader("0123456789"))
+	if err != nil {
+		t.Fatalf("Error splitting: %v", err)
+	}
+	exp := []BlobPart{}
+	for _, s := range []string{"0123", "4567", "89"} {
+		exp = append(exp,
+			BlobPart{fmt.Sprintf("%x", sha1.Sum([]byte(s))), int64(len(s))})
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+
+	// Same boundaries as the server's TestCDCBoundaries.
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	cdc := ChunkSignatures{Hash: "sha1", ChunkSize: 16 * 1024,
+		ContentDefined: true}
+	got, err = cdc.Split(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error splitting: %v", err)
+	}
+	lengths := []int64{}
+	for _, p := range got {
+		lengths = append(lengths, p.Length)
+	}
+	explen := []int64{13881, 18960, 26712, 6188, 6663, 5608, 5328, 14878,
+		5256, 22906, 4404, 56390, 10934, 8338, 19161, 4602, 31935}
+	if !reflect.DeepEqual(lengths, explen) {
+		t.Errorf("Expected chunks of %v, got %v", explen, lengths)
+	}
+
+	if _, err := (ChunkSignatures{Hash: "sha1"}).Split(
+		strings.NewReader("x")); err != NotChunked {
+		t.Errorf("Expected NotChunked without a chunk size, got %v", err)
+	}
+}
+
+func TestSameContent(t *testing.T) {
+	sum := func(s string) string {
+		return fmt.Sprintf("%x", sha1.Sum([]byte(s)))
+	}
+	whole := FileMeta{OID: sum("0123456789"), Length: 10}
+	parts := FileMeta{OID: sum("manifest"), Length: 10,
+		Parts: []BlobPart{{sum("0123"), 4}, {sum("456789"), 6}}}
+
+	tests := []struct {
+		fm      FileMeta
+		content string
+		exp     bool
+	}{
+		{whole, "0123456789", true},
+		{whole, "0123456788", false},
+		{parts, "0123456789", true},
+		{parts, "0123456788", false},
+		{parts, "012345678", false},
+		{parts, "0123456789a", false},
+		{FileMeta{}, "", true},
+		{FileMeta{}, "a", false},
+	}
+
+	for _, test := range tests {
+		got, err := test.fm.SameContent(strings.NewReader(test.content), "sha1")
+		if err != nil {
+			t.Errorf("Error comparing %q: %v", test.content, err)
+		} else if got != test.exp {
+			t.Errorf("Expected %v for %q with %v, got %v",
+				test.exp, test.content, test.fm.Blobs(), got)
+		}
+	}
+
+	if _, err := parts.SameContent(strings.NewReader(""), "blake3"); err != UnknownHash {
+		t.Errorf("Expected UnknownHash for an unknown hash, got %v", err)
+	}
+
+	if !whole.SameBlobs(whole) || whole.SameBlobs(parts) {
+		t.Errorf("Whole file compared wrong")
+	}
+	reparted := parts
+	reparted.OID = sum("rehashed manifest")
+	if !parts.SameBlobs(reparted) {
+		t.Errorf("Expected the same parts to be the same content")
+	}
+}
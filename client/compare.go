@@ -0,0 +1,83 @@
+package cbfsclient
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+)
+
+// A file's blobs are named by a hash this client can't make.
+var UnknownHash = errors.New("blob named by an unknown hash")
+
+// The blobs holding the file's content, whether or not it was stored
+// in parts.
+func (fm FileMeta) Blobs() []BlobPart {
+	if len(fm.Parts) > 0 {
+		return fm.Parts
+	}
+	if fm.Length == 0 {
+		return nil
+	}
+	return []BlobPart{{fm.OID, fm.Length}}
+}
+
+// Whether two files have the same content, going by their blobs.
+func (fm FileMeta) SameBlobs(other FileMeta) bool {
+	if fm.Length != other.Length {
+		return false
+	}
+	if fm.OID == other.OID {
+		return true
+	}
+	a, b := fm.Blobs(), other.Blobs()
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether r has the file's content.  Files stored in parts are
+// checked a part at a time, since their OID names the list of parts
+// and not the content.  hashName is the hash the cluster names new
+// blobs by; blobs of other lengths are checked with whichever hash
+// could have named them.
+func (fm FileMeta) SameContent(r io.Reader, hashName string) (bool, error) {
+	for _, p := range fm.Blobs() {
+		h := NewHash(hashName)
+		switch {
+		case h != nil && h.Size()*2 == len(p.OID):
+		case h == nil:
+			// The cluster's hash could be any length.
+			return false, UnknownHash
+		default:
+			f, ok := hashesBySize[len(p.OID)]
+			if !ok {
+				return false, UnknownHash
+			}
+			h = f()
+		}
+		n, err := io.CopyN(h, r, p.Length)
+		if err == io.EOF {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		if n != p.Length || hex.EncodeToString(h.Sum(nil)) != p.OID {
+			return false, nil
+		}
+	}
+	// Anything left over means r is longer.
+	switch _, err := io.ReadFull(r, make([]byte, 1)); err {
+	case nil:
+		return false, nil
+	case io.EOF:
+		return true, nil
+	default:
+		return false, err
+	}
+}
@@ -13,20 +13,47 @@ func (c Client) confURL() string {
 	return c.URLFor(".cbfs/config/")
 }
 
-// Get the current configuration.
+// Get the current configuration, with its secrets redacted.
 func (c Client) GetConfig() (rv cbfsconfig.CBFSConfig, err error) {
 	err = getJsonData(c.confURL(), &rv)
 	return
 }
 
+// Get the current configuration with its secrets, which requires
+// permission to change it.
+func (c Client) GetConfigSecrets() (rv cbfsconfig.CBFSConfig, err error) {
+	err = getJsonData(c.confURL()+"?secrets=true", &rv)
+	return
+}
+
+// The name of the hash the cluster names new blobs by.
+func (c Client) BlobHash() (string, error) {
+	conf, err := c.GetConfig()
+	if err != nil {
+		return "", err
+	}
+	if conf.Hash == "" {
+		return "sha1", nil
+	}
+	return conf.Hash, nil
+}
+
 // Set a configuration parameter by name.
 func (c Client) SetConfigParam(key, val string) error {
+	return c.UpdateConfig(func(conf *cbfsconfig.CBFSConfig) error {
+		return conf.SetParameter(key, val)
+	})
+}
+
+// Fetch the current configuration, modify it with f, and store the
+// result.
+func (c Client) UpdateConfig(f func(*cbfsconfig.CBFSConfig) error) error {
 	conf, err := c.GetConfig()
 	if err != nil {
 		return err
 	}
 
-	err = conf.SetParameter(key, val)
+	err = f(&conf)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,51 @@
+package cbfsclient
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/dustin/httputil"
+)
+
+// When a copy, move or restore would overwrite a file and wasn't
+// allowed to.
+var Exists = errors.New("destination exists")
+
+func (c Client) copyOrMove(method, src, dest string, overwrite bool) error {
+	req, err := http.NewRequest(method, c.URLFor(src), nil)
+	if err != nil {
+		return err
+	}
+	du := url.URL{Path: "/" + noSlash(dest)}
+	req.Header.Set("Destination", du.String())
+	if !overwrite {
+		req.Header.Set("Overwrite", "F")
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case 201:
+		return nil
+	case 404:
+		return Missing
+	case 412:
+		return Exists
+	}
+	return httputil.HTTPErrorf(res, "error in %v of %v: %S\n%B",
+		method, src)
+}
+
+// Copy a file within cbfs without transferring its content.
+func (c Client) Copy(src, dest string, overwrite bool) error {
+	return c.copyOrMove("COPY", src, dest, overwrite)
+}
+
+// Rename a file within cbfs without transferring its content.
+func (c Client) Move(src, dest string, overwrite bool) error {
+	return c.copyOrMove("MOVE", src, dest, overwrite)
+}
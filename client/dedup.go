@@ -0,0 +1,38 @@
+package cbfsclient
+
+import (
+	"fmt"
+)
+
+// A blob shared by more than one file.
+type DedupBlob struct {
+	OID    string `json:"oid"`
+	Refs   int64  `json:"refs"`
+	Length int64  `json:"length"`
+	// Bytes not stored thanks to sharing this blob
+	Saved int64 `json:"savedBytes"`
+}
+
+// How much content addressing saves across the current revisions of
+// all files.
+type DedupReport struct {
+	// References to blobs (a file stored in parts has several)
+	References int64 `json:"references"`
+	// Distinct blobs referenced
+	Blobs int64 `json:"blobs"`
+	// Total size of all the files
+	LogicalBytes int64 `json:"logicalBytes"`
+	// Size of a single copy of each distinct blob
+	StoredBytes int64   `json:"storedBytes"`
+	SavedBytes  int64   `json:"savedBytes"`
+	Ratio       float64 `json:"ratio"`
+	// The most referenced blobs
+	Top []DedupBlob `json:"top"`
+}
+
+// Get a deduplication report listing the top most referenced blobs.
+func (c Client) Dedup(top int) (DedupReport, error) {
+	rv := DedupReport{}
+	err := getJsonData(c.URLFor(fmt.Sprintf("/.cbfs/dedup/?top=%d", top)), &rv)
+	return rv, err
+}
@@ -0,0 +1,181 @@
+package cbfsclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// How the server splits files into chunks, and the chunks a file is
+// made of now.
+type ChunkSignatures struct {
+	Path           string     `json:"path"`
+	Hash           string     `json:"hash"`
+	ChunkSize      int64      `json:"chunkSize"`
+	ContentDefined bool       `json:"contentDefined"`
+	OID            string     `json:"oid"`
+	Length         int64      `json:"length"`
+	Parts          []BlobPart `json:"parts"`
+}
+
+// What a delta upload did.
+type DeltaStats struct {
+	Chunks    int   // Chunks in the new content
+	Sent      int   // Chunks that had to be sent
+	Bytes     int64 // Length of the new content
+	SentBytes int64 // Bytes that had to be sent
+}
+
+// Get the chunk signatures of a file.  Returns Missing if there's no
+// such file.
+func (c Client) ChunkSignatures(fn string) (ChunkSignatures, error) {
+	rv := ChunkSignatures{}
+	res, err := c.httpClient().Get(c.URLFor("/.cbfs/chunks/" + noSlash(fn)))
+	if err != nil {
+		return rv, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case 200:
+	case 404:
+		return rv, Missing
+	default:
+		return rv, newStatusError(res)
+	}
+	err = json.NewDecoder(res.Body).Decode(&rv)
+	return rv, err
+}
+
+// Use a blob the server already has as part n of the upload.
+// Returns Missing if the server doesn't have it.
+func (m *MultipartUpload) RefPart(n int, oid string) error {
+	req, err := http.NewRequest("PUT",
+		m.c.URLFor(fmt.Sprintf("/.cbfs/multipart/%s/%d", m.ID, n)), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-CBFS-Blob", oid)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case 201:
+		return nil
+	case 404:
+		return Missing
+	}
+	return newStatusError(res)
+}
+
+// Replace dest with size bytes from r, sending only the chunks its
+// current content doesn't already have.  Returns Missing if dest
+// doesn't exist, or NotChunked if the server wouldn't chunk it, in
+// which case there's nothing to save over a regular upload.
+//
+// Only ContentType, Expiration, Expires, RetainUntil, the conditions
+// and revision retention are used from the options.
+func (c Client) PutDelta(dest string, r io.ReaderAt, size int64,
+	concurrency int, opts PutOptions) (DeltaStats, error) {
+
+	stats := DeltaStats{Bytes: size}
+	if size == 0 {
+		// Multipart uploads need at least one part.
+		return stats, c.Put("", dest, io.NewSectionReader(r, 0, 0), opts)
+	}
+	sig, err := c.ChunkSignatures(dest)
+	if err != nil {
+		return stats, err
+	}
+	chunks, err := sig.Split(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return stats, err
+	}
+	stats.Chunks = len(chunks)
+
+	have := map[string]bool{}
+	for _, p := range sig.Parts {
+		have[p.OID] = true
+	}
+
+	m, err := c.InitMultipart(dest, opts)
+	if err != nil {
+		return stats, err
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	refs := make([]partRef, len(chunks))
+	offsets := make([]int64, len(chunks))
+	for i := 1; i < len(chunks); i++ {
+		offsets[i] = offsets[i-1] + chunks[i-1].Length
+	}
+
+	ch := make(chan int)
+	errs := make(chan error, len(chunks))
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range ch {
+				p := chunks[n]
+				if have[p.OID] {
+					err := DefaultBackoff.Do(func() error {
+						return m.RefPart(n+1, p.OID)
+					})
+					if err == nil {
+						refs[n] = partRef{n + 1, p.OID}
+						continue
+					}
+					if err != Missing {
+						errs <- err
+						continue
+					}
+					// Collected since we asked; send it after all.
+				}
+
+				var h string
+				err := DefaultBackoff.Do(func() (err error) {
+					h, err = m.PutPart(n+1,
+						io.NewSectionReader(r, offsets[n], p.Length), p.Length)
+					return err
+				})
+				if err != nil {
+					errs <- err
+					continue
+				}
+				refs[n] = partRef{n + 1, h}
+				mu.Lock()
+				stats.Sent++
+				stats.SentBytes += p.Length
+				mu.Unlock()
+			}
+		}()
+	}
+	for n := range chunks {
+		ch <- n
+	}
+	close(ch)
+	wg.Wait()
+	close(errs)
+
+	if err := <-errs; err != nil {
+		if !IsTransient(err) {
+			m.Abort()
+		}
+		return stats, err
+	}
+
+	err = DefaultBackoff.Do(func() error { return m.complete(refs) })
+	if err != nil && !IsTransient(err) {
+		m.Abort()
+	}
+	return stats, err
+}
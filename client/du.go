@@ -0,0 +1,43 @@
+package cbfsclient
+
+import (
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Space used by everything under a directory.
+type DuStats struct {
+	Path    string `json:"path"`
+	Objects int64  `json:"objects"`
+	// Total size of the files
+	LogicalBytes int64 `json:"logicalBytes"`
+	// Distinct blobs holding the files' content, and their size
+	Blobs        int64 `json:"blobs"`
+	DedupedBytes int64 `json:"dedupedBytes"`
+	// Size of every stored copy of those blobs, if asked for
+	PhysicalBytes int64     `json:"physicalBytes"`
+	Children      []DuStats `json:"children"`
+	// When the server worked these out
+	Computed time.Time `json:"computed"`
+}
+
+// Get the space used under a directory ("" for everything),
+// optionally broken down by immediate subdirectory.  Working out the
+// physical size means reading every blob under the directory.
+func (c Client) Du(dir string, children, physical bool) (DuStats, error) {
+	u := c.URLFor("/.cbfs/du/" + strings.Trim(dir, "/"))
+	q := url.Values{}
+	if children {
+		q.Set("children", "true")
+	}
+	if physical {
+		q.Set("physical", "true")
+	}
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	rv := DuStats{}
+	err := getJsonData(u, &rv)
+	return rv, err
+}
@@ -0,0 +1,71 @@
+package cbfsclient
+
+import (
+	"encoding/json"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Progress of an archive being unpacked on the server.
+type ExtractTask struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path"`
+	Format    string    `json:"format"`
+	Node      string    `json:"node"`
+	State     string    `json:"state"` // running, done or failed
+	Files     int64     `json:"files"`
+	Bytes     int64     `json:"bytes"`
+	Errors    int64     `json:"errors"`
+	LastError string    `json:"lastError"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+}
+
+// Is the extraction over?
+func (t ExtractTask) Done() bool {
+	return t.State != "running"
+}
+
+// Send a tar, tar.gz or zip archive to be unpacked into files under
+// a path on the server, with up to workers (0 for the server's
+// default) stored at once.  An empty format has the server work it
+// out.  Returns the ID of the task doing it.
+func (c Client) Extract(path, format string, workers int,
+	r io.Reader) (string, error) {
+
+	v := url.Values{}
+	if format != "" {
+		v.Set("format", format)
+	}
+	if workers > 0 {
+		v.Set("workers", strconv.Itoa(workers))
+	}
+	u := c.URLFor("/.cbfs/extract/" + strings.Trim(path, "/"))
+	if len(v) > 0 {
+		u += "?" + v.Encode()
+	}
+
+	res, err := c.httpClient().Post(u, "application/octet-stream", r)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 202 {
+		return "", newStatusError(res)
+	}
+	rv := struct {
+		ID string `json:"id"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&rv)
+	return rv.ID, err
+}
+
+// Get the progress of an extraction.
+func (c Client) ExtractTask(id string) (ExtractTask, error) {
+	rv := ExtractTask{}
+	err := getJsonData(c.URLFor("/.cbfs/tasks/"+id), &rv)
+	return rv, err
+}
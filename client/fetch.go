@@ -1,6 +1,7 @@
 package cbfsclient
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -56,13 +57,21 @@ func (b brokenReader) Read([]byte) (int, error) {
 }
 
 type fetchWorker struct {
-	n  StorageNode
-	cb FetchCallback
+	n      StorageNode
+	cb     FetchCallback
+	verify bool
 }
 
 func (fw fetchWorker) Work(i interface{}) error {
 	oid := i.(string)
-	res, err := http.Get(fw.n.BlobURL(oid))
+	req, err := http.NewRequest("GET", fw.n.BlobURL(oid), nil)
+	if err != nil {
+		return err
+	}
+	if fw.verify {
+		req.Header.Set(WantHashHeader, "true")
+	}
+	res, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -70,7 +79,11 @@ func (fw fetchWorker) Work(i interface{}) error {
 	if res.StatusCode != 200 {
 		return httputil.HTTPError(res)
 	}
-	return fw.cb(oid, res.Body)
+	body := io.Reader(res.Body)
+	if fw.verify {
+		body = VerifyBody(res)
+	}
+	return fw.cb(oid, body)
 }
 
 // Fetch many blobs in bulk.
@@ -108,7 +121,7 @@ func (c *Client) Blobs(totalConcurrency, destinationConcurrency int,
 	}()
 
 	s := saturate.New(dests, func(n string) saturate.Worker {
-		return &fetchWorker{nodeMap[n], cb}
+		return &fetchWorker{nodeMap[n], cb, c.VerifyHashes}
 	},
 		&saturate.Config{
 			DestConcurrency:  destinationConcurrency,
@@ -123,45 +136,124 @@ func (c *Client) Blobs(totalConcurrency, destinationConcurrency int,
 //
 // This ensures the request is coming directly from a node that
 // already has the blob vs. proxying.
-func (c Client) Get(path string) (io.ReadCloser, error) {
-	req, err := http.NewRequest("GET", c.URLFor(path), nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("X-CBFS-LocalOnly", "true")
+func (c *Client) Get(path string) (io.ReadCloser, error) {
+	return c.GetContext(context.Background(), path)
+}
 
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
+// Like Get, but stops when ctx is done.  Transient failures before
+// the content starts arriving are retried on another node.
+//
+// The file is read straight from the nodes holding it where the
+// cluster says which those are, so it doesn't pass through the node
+// the client was made with.
+func (c *Client) GetContext(ctx context.Context, path string) (io.ReadCloser, error) {
+	var rv io.ReadCloser
+	get := func(base string) error {
+		req, err := http.NewRequest("GET", base+noSlash(path), nil)
+		if err != nil {
+			return err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("X-CBFS-LocalOnly", "true")
+		if c.Zone != "" {
+			req.Header.Set(ZoneHeader, c.Zone)
+		}
+		if c.VerifyHashes {
+			req.Header.Set(WantHashHeader, "true")
+		}
 
-	switch res.StatusCode {
-	case 200:
-		return res.Body, nil
-	case 300:
-		defer res.Body.Close()
-		redirectTarget := res.Header.Get("Location")
-		log.Printf("Redirecting to %v", redirectTarget)
-		resRedirect, err := http.Get(redirectTarget)
+		res, err := c.httpClient().Do(req)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		// if we follow the redirect, make sure response code == 200
-		switch resRedirect.StatusCode {
+
+		switch res.StatusCode {
 		case 200:
-			return resRedirect.Body, nil
+			rv = c.body(res)
+			return nil
+		case 300:
+			res.Body.Close()
+			redirectTarget := res.Header.Get("Location")
+			log.Printf("Redirecting to %v", redirectTarget)
+			req, err := http.NewRequest("GET", redirectTarget, nil)
+			if err != nil {
+				return err
+			}
+			if c.VerifyHashes {
+				req.Header.Set(WantHashHeader, "true")
+			}
+			resRedirect, err := c.httpClient().Do(req.WithContext(ctx))
+			if err != nil {
+				return err
+			}
+			// if we follow the redirect, make sure response code == 200
+			if resRedirect.StatusCode != 200 {
+				defer resRedirect.Body.Close()
+				return newStatusError(resRedirect)
+			}
+			rv = c.body(resRedirect)
+			return nil
+		case 404:
+			res.Body.Close()
+			return Missing
 		default:
-			return nil, fmt.Errorf(
-				"Got %v response following redirect to %v",
-				resRedirect.StatusCode,
-				redirectTarget,
-			)
+			defer res.Body.Close()
+			return newStatusError(res)
 		}
+	}
 
-	default:
-		defer res.Body.Close()
-		return nil, httputil.HTTPError(res)
+	// Any failure finding or reading from the holders just means
+	// going through the usual node instead.
+	nodes, _ := c.holders(ctx, path)
+	for _, n := range nodes {
+		if err := get(n.URLFor("/")); err == nil || ctx.Err() != nil {
+			return rv, err
+		}
+	}
+	err := c.withNodes(ctx, c.Backoff, c.u, get)
+	return rv, err
+}
+
+// A response's body, checked against its hash if wanted.
+func (c Client) body(res *http.Response) io.ReadCloser {
+	if c.VerifyHashes {
+		return VerifyBody(res)
 	}
+	return res.Body
+}
+
+// Get the current metadata of the file at the given path.
+func (c Client) Stat(path string) (FileMeta, error) {
+	return c.StatContext(context.Background(), path)
+}
+
+// Like Stat, but stops when ctx is done.
+func (c Client) StatContext(ctx context.Context, path string) (FileMeta, error) {
+	j := struct {
+		Meta FileMeta
+		Path string
+	}{}
+	err := c.withNodes(ctx, c.Backoff, c.u, func(base string) error {
+		req, err := http.NewRequest("GET",
+			base+".cbfs/info/file/"+noSlash(path), nil)
+		if err != nil {
+			return err
+		}
+		res, err := c.httpClient().Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		switch res.StatusCode {
+		case 200:
+		case 404:
+			return Missing
+		default:
+			return newStatusError(res)
+		}
+		return json.NewDecoder(res.Body).Decode(&j)
+	})
+	return j.Meta, err
 }
 
 // File info
@@ -228,7 +320,7 @@ func (f *FileHandle) WriteTo(w io.Writer) (int64, error) {
 			fmt.Sprintf("bytes=%v-%v", f.off, f.length-1))
 	}
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := f.c.httpClient().Do(req)
 	if err != nil {
 		return 0, err
 	}
@@ -260,7 +352,7 @@ func (f *FileHandle) ReadAt(p []byte, off int64) (n int, err error) {
 		return 0, err
 	}
 	req.Header.Set("Range", fmt.Sprintf("bytes=%v-%v", off, end-1))
-	res, err := http.DefaultClient.Do(req)
+	res, err := f.c.httpClient().Do(req)
 	if err != nil {
 		return 0, err
 	}
@@ -339,31 +431,18 @@ func (f *FileHandle) Seek(offset int64, whence int) (ret int64, err error) {
 
 // Get a reference to the file at the given path.
 func (c Client) OpenFile(path string) (*FileHandle, error) {
-	res, err := http.Get(c.URLFor("/.cbfs/info/file/" + noSlash(path)))
-	if err != nil {
-		return nil, err
-	}
-	defer res.Body.Close()
-	if res.StatusCode != 200 {
-		return nil, httputil.HTTPError(res)
-	}
-	j := struct {
-		Meta FileMeta
-		Path string
-	}{}
-	d := json.NewDecoder(res.Body)
-	err = d.Decode(&j)
+	meta, err := c.Stat(path)
 	if err != nil {
 		return nil, err
 	}
 
-	h := j.Meta.OID
+	h := meta.OID
 
 	infos, err := c.GetBlobInfos(h)
 	if err != nil {
 		return nil, err
 	}
 
-	return &FileHandle{c, h, 0, j.Meta.Length, j.Meta,
+	return &FileHandle{c, h, 0, meta.Length, meta,
 		infos[h].Nodes}, nil
 }
@@ -0,0 +1,52 @@
+package cbfsclient
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// A node that can serve a whole file from its own disks.
+type FileNode struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+	Zone string `json:"zone,omitempty"`
+}
+
+// Everything the server will say about a file without sending it.
+type FileInfo struct {
+	Path        string            `json:"path"`
+	OID         string            `json:"oid"`
+	Length      int64             `json:"length"`
+	ContentType string            `json:"ctype"`
+	Modified    time.Time         `json:"modified"`
+	Revno       int               `json:"revno"`
+	OldestRev   int               `json:"oldestRev"`
+	Meta        map[string]string `json:"meta"`  // User metadata
+	Nodes       []FileNode        `json:"nodes"` // Freshest first
+	// Number of blobs the file is stored in, if more than one
+	Parts       int       `json:"parts"`
+	Expires     time.Time `json:"expires"`
+	RetainUntil time.Time `json:"retainUntil"`
+	// Nodes that keep a copy, or "*" for all of them
+	Pinned []string `json:"pinned"`
+}
+
+// Describe a file, including where it's stored.  Returns Missing if
+// there's no such file.
+func (c Client) Describe(path string) (FileInfo, error) {
+	rv := FileInfo{}
+	res, err := c.httpClient().Get(c.URLFor(noSlash(path) + "?meta=json"))
+	if err != nil {
+		return rv, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case 200:
+	case 404:
+		return rv, Missing
+	default:
+		return rv, newStatusError(res)
+	}
+	err = json.NewDecoder(res.Body).Decode(&rv)
+	return rv, err
+}
@@ -0,0 +1,112 @@
+package cbfsclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// What to look for with Find.  Zero values match anything.
+type FindQuery struct {
+	Name        string // Glob on the base name
+	IName       string // Case insensitive Name
+	MinSize     int64
+	MaxSize     int64     // 0 for no limit
+	Newer       time.Time // Modified after this
+	Older       time.Time // Modified before this
+	ContentType string    // Content type prefix
+	// User metadata the file must have, with the value if not ""
+	Meta map[string]string
+	// Files to ask for at a time (0 for the server default)
+	PageSize int
+}
+
+// A file found by Find.
+type FindResult struct {
+	Path string   `json:"path"`
+	Meta FileMeta `json:"meta"`
+}
+
+func (q FindQuery) values() url.Values {
+	v := url.Values{}
+	set := func(k, s string) {
+		if s != "" {
+			v.Set(k, s)
+		}
+	}
+	set("name", q.Name)
+	set("iname", q.IName)
+	set("ctype", q.ContentType)
+	if q.MinSize > 0 {
+		v.Set("minsize", strconv.FormatInt(q.MinSize, 10))
+	}
+	if q.MaxSize > 0 {
+		v.Set("maxsize", strconv.FormatInt(q.MaxSize, 10))
+	}
+	if !q.Newer.IsZero() {
+		v.Set("newer", q.Newer.UTC().Format(time.RFC3339))
+	}
+	if !q.Older.IsZero() {
+		v.Set("older", q.Older.UTC().Format(time.RFC3339))
+	}
+	for k, m := range q.Meta {
+		if m == "" {
+			v.Add("meta", k)
+		} else {
+			v.Add("meta", k+"="+m)
+		}
+	}
+	if q.PageSize > 0 {
+		v.Set("limit", strconv.Itoa(q.PageSize))
+	}
+	return v
+}
+
+// Search the server for files under dir matching q, calling f with
+// each in path order.
+func (c Client) Find(ctx context.Context, dir string, q FindQuery,
+	f func(FindResult) error) error {
+
+	v := q.values()
+	if dir = strings.Trim(dir, "/"); dir != "" {
+		dir += "/"
+	}
+	base := c.URLFor("/.cbfs/find/" + dir)
+	for {
+		page := struct {
+			Files []FindResult `json:"files"`
+			Next  string       `json:"continuationToken"`
+		}{}
+		req, err := http.NewRequest("GET", base+"?"+v.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		res, err := c.httpClient().Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		if res.StatusCode != 200 {
+			err = newStatusError(res)
+		} else {
+			err = json.NewDecoder(res.Body).Decode(&page)
+		}
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, r := range page.Files {
+			if err := f(r); err != nil {
+				return err
+			}
+		}
+		if page.Next == "" {
+			return nil
+		}
+		v.Set("continuation-token", page.Next)
+	}
+}
@@ -1,14 +1,14 @@
 package cbfsclient
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
-
-	"github.com/dustin/httputil"
 )
 
 // Represents a directory as returned from a List operation.
@@ -26,6 +26,13 @@ type PrevMeta struct {
 	Length   float64     `json:"length"`   // Length
 	Modified time.Time   `json:"modified"` // Modified date
 	Revno    int         `json:"revno"`    // Revision number
+	Parts    []BlobPart  `json:"parts"`    // Parts, if stored in pieces
+}
+
+// A blob holding one piece of a file stored in parts.
+type BlobPart struct {
+	OID    string `json:"oid"`
+	Length int64  `json:"length"`
 }
 
 // Current file meta.
@@ -41,12 +48,32 @@ type FileMeta struct {
 	Previous []PrevMeta `json:"older"`
 	// Current revision number
 	Revno int `json:"revno"`
+	// Blobs making up the file if it was stored in parts.  The
+	// content is not in OID in this case.
+	Parts []BlobPart `json:"parts"`
+	// When the server will remove the file, if ever
+	Expires time.Time `json:"expires"`
+	// Until when the file can't be overwritten or deleted
+	RetainUntil time.Time `json:"retainUntil"`
+	// Nodes that keep a copy of the file, or "*" for all of them
+	Pinned []string `json:"pinned"`
 }
 
 // Results from a list operation.
 type ListResult struct {
 	Dirs  map[string]Dir      // Immediate directories
 	Files map[string]FileMeta // Immediate files
+	// Names of the dirs and files in order (paged listings only)
+	Order []string `json:"order"`
+	// Token for the next page, empty on the last one
+	Next string `json:"continuationToken"`
+}
+
+// How to page through a listing.
+type ListOptions struct {
+	Depth int    // How deep to list (default 1)
+	Limit int    // Most entries per page (0 for all)
+	Sort  string // "name" (default), "mtime" or "size"
 }
 
 var fourOhFour = errors.New("not found")
@@ -61,12 +88,85 @@ func (c Client) ListOrEmpty(ustr string) (ListResult, error) {
 	return listing, err
 }
 
+// Same as ListDepth, but return an empty result on 404.
+func (c Client) ListDepthOrEmpty(ustr string, depth int) (ListResult, error) {
+	listing, err := c.ListDepth(ustr, depth)
+	if err == fourOhFour {
+		err = nil
+	}
+
+	return listing, err
+}
+
 func (c Client) List(ustr string) (ListResult, error) {
 	return c.ListDepth(ustr, 1)
 }
 
 // List the contents below the given location.
 func (c Client) ListDepth(ustr string, depth int) (ListResult, error) {
+	return c.ListContext(context.Background(), ustr, depth)
+}
+
+// Like ListDepth, but stops when ctx is done.
+func (c Client) ListContext(ctx context.Context, ustr string,
+	depth int) (ListResult, error) {
+
+	return c.list(ctx, ustr, url.Values{
+		"includeMeta": []string{"true"},
+		"depth":       []string{strconv.Itoa(depth)},
+	})
+}
+
+// Get one page of a listing.  Pass the previous page's Next to get
+// the page after it, or "" for the first.
+func (c Client) ListPage(ctx context.Context, ustr string, opts ListOptions,
+	token string) (ListResult, error) {
+
+	depth := opts.Depth
+	if depth < 1 {
+		depth = 1
+	}
+	sort := opts.Sort
+	if sort == "" {
+		sort = "name"
+	}
+	q := url.Values{
+		"includeMeta": []string{"true"},
+		"depth":       []string{strconv.Itoa(depth)},
+		"sort":        []string{sort},
+	}
+	if opts.Limit > 0 {
+		q.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if token != "" {
+		q.Set("continuation-token", token)
+	}
+	return c.list(ctx, ustr, q)
+}
+
+// Call f with each page of a listing, in order.
+func (c Client) ListPages(ctx context.Context, ustr string, opts ListOptions,
+	f func(ListResult) error) error {
+
+	token := ""
+	for {
+		page, err := c.ListPage(ctx, ustr, opts, token)
+		if err != nil {
+			return err
+		}
+		if err := f(page); err != nil {
+			return err
+		}
+		if page.Next == "" {
+			return nil
+		}
+		token = page.Next
+	}
+}
+
+func (c Client) list(ctx context.Context, ustr string,
+	q url.Values) (ListResult, error) {
+
 	result := ListResult{}
 
 	inputUrl := *c.pu
@@ -82,29 +182,38 @@ func (c Client) ListDepth(ustr string, depth int) (ListResult, error) {
 	if inputUrl.Path == "/.cbfs/list" {
 		inputUrl.Path = "/.cbfs/list/"
 	}
-	inputUrl.RawQuery = fmt.Sprintf("includeMeta=true&depth=%d", depth)
-
-	req, err := http.NewRequest("GET", inputUrl.String(), nil)
-	if err != nil {
-		return result, err
-	}
-
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return result, err
-	}
-	defer res.Body.Close()
-	switch res.StatusCode {
-	case 404:
-		return result, fourOhFour
-	case 200:
-		// ok
-	default:
-		return result, httputil.HTTPErrorf(res,
-			"error in request to %v: %S\n%B", inputUrl)
-	}
-
-	d := json.NewDecoder(res.Body)
-	err = d.Decode(&result)
+	inputUrl.RawQuery = q.Encode()
+	err := c.withNodes(ctx, c.Backoff, c.u, func(base string) error {
+		u := inputUrl
+		if base != c.u {
+			bu, err := url.Parse(base)
+			if err != nil {
+				return err
+			}
+			u.Scheme, u.Host = bu.Scheme, bu.Host
+		}
+		req, err := http.NewRequest("GET", u.String(), nil)
+		if err != nil {
+			return err
+		}
+
+		res, err := c.httpClient().Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		switch res.StatusCode {
+		case 404:
+			return fourOhFour
+		case 200:
+			// ok
+		default:
+			return newStatusError(res)
+		}
+
+		result = ListResult{}
+		d := json.NewDecoder(res.Body)
+		return d.Decode(&result)
+	})
 	return result, err
 }
@@ -0,0 +1,82 @@
+package cbfsclient
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Someone else holds a lock.
+var LockHeld = errors.New("lock is held")
+
+// An advisory lock.  Token is only known to whoever holds it.
+type Lock struct {
+	Name     string    `json:"name"`
+	Owner    string    `json:"owner,omitempty"`
+	Token    string    `json:"token,omitempty"`
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires"`
+}
+
+func (c Client) lockRequest(method, name string, v url.Values) (Lock, error) {
+	rv := Lock{}
+	u := c.URLFor("/.cbfs/locks/" + noSlash(name))
+	if len(v) > 0 {
+		u += "?" + v.Encode()
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return rv, err
+	}
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return rv, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case 200, 409:
+	case 204:
+		return rv, nil
+	case 404:
+		return rv, Missing
+	default:
+		return rv, newStatusError(res)
+	}
+	if err := json.NewDecoder(res.Body).Decode(&rv); err != nil {
+		return rv, err
+	}
+	if res.StatusCode == 409 {
+		return rv, LockHeld
+	}
+	return rv, nil
+}
+
+// Take a lock for ttl.  Returns LockHeld along with who has it if
+// someone else does.
+func (c Client) Lock(name, owner string, ttl time.Duration) (Lock, error) {
+	v := url.Values{"ttl": {ttl.String()}}
+	if owner != "" {
+		v.Set("owner", owner)
+	}
+	return c.lockRequest("POST", name, v)
+}
+
+// Hold a lock for another ttl from now.  Returns Missing if it
+// expired, or LockHeld if someone else has taken it since.
+func (c Client) RenewLock(l Lock, ttl time.Duration) (Lock, error) {
+	return c.lockRequest("PUT", l.Name,
+		url.Values{"token": {l.Token}, "ttl": {ttl.String()}})
+}
+
+// Release a lock.  Returns Missing if it had already expired.
+func (c Client) Unlock(l Lock) error {
+	_, err := c.lockRequest("DELETE", l.Name, url.Values{"token": {l.Token}})
+	return err
+}
+
+// Find who holds a lock.  Returns Missing if nobody does.
+func (c Client) LockInfo(name string) (Lock, error) {
+	return c.lockRequest("GET", name, nil)
+}
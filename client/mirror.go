@@ -0,0 +1,32 @@
+package cbfsclient
+
+import (
+	"time"
+)
+
+// How far a mirror to or from another cluster has got.
+type MirrorStatus struct {
+	Remote     string `json:"remote"`
+	Direction  string `json:"direction"`
+	Prefix     string `json:"prefix"`
+	DestPrefix string `json:"destPrefix"`
+	// Last change on the source that's been mirrored, and the
+	// latest one when the mirror last ran
+	Seq       uint64    `json:"seq"`
+	Head      uint64    `json:"head"`
+	LastRun   time.Time `json:"lastRun"`
+	CaughtUp  time.Time `json:"caughtUp"`
+	Files     int64     `json:"files"`
+	Bytes     int64     `json:"bytes"`
+	LastError string    `json:"lastError"`
+	Behind    uint64    `json:"behind"`
+	// How long it's been since the mirror was caught up
+	LagSeconds float64 `json:"lagSeconds"`
+}
+
+// Get the state of each configured mirror, by name.
+func (c Client) Mirrors() (map[string]MirrorStatus, error) {
+	rv := map[string]MirrorStatus{}
+	err := getJsonData(c.URLFor("/.cbfs/mirrors/"), &rv)
+	return rv, err
+}
@@ -0,0 +1,266 @@
+package cbfsclient
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/httputil"
+)
+
+// An upload of a file in independently stored parts.
+type MultipartUpload struct {
+	c     Client
+	ID    string           `json:"id"`
+	Path  string           `json:"path"`
+	Parts map[int]BlobPart `json:"parts"` // Parts stored so far
+}
+
+type partRef struct {
+	Part int    `json:"part"`
+	OID  string `json:"oid"`
+}
+
+// Begin a multipart upload to dest.
+//
+// Only ContentType, Expiration, Expires, RetainUntil, the conditions
+// and revision retention are used from the options.  The conditions
+// are checked when the upload begins and again when it's completed,
+// either returning PreconditionFailed if they don't hold.
+func (c Client) InitMultipart(dest string, opts PutOptions) (*MultipartUpload, error) {
+	form := url.Values{"path": []string{dest}}
+	if opts.ContentType != "" {
+		form.Set("type", opts.ContentType)
+	}
+
+	req, err := http.NewRequest("POST", c.URLFor("/.cbfs/multipart/"),
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if opts.keeprevset {
+		req.Header.Set("X-CBFS-KeepRevs", strconv.Itoa(opts.keeprevs))
+	}
+	if opts.Expiration > 0 {
+		req.Header.Set("X-CBFS-Expiration", strconv.Itoa(opts.Expiration))
+	}
+	if !opts.Expires.IsZero() {
+		req.Header.Set("X-CBFS-Expires", opts.Expires.UTC().Format(time.RFC3339))
+	}
+	if !opts.RetainUntil.IsZero() {
+		req.Header.Set("X-CBFS-Retain-Until",
+			opts.RetainUntil.UTC().Format(time.RFC3339))
+	}
+	opts.setConditions(req.Header)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 412 {
+		return nil, PreconditionFailed
+	}
+	if res.StatusCode != 200 {
+		return nil, httputil.HTTPErrorf(res,
+			"error starting multipart upload of %v: %S\n%B", dest)
+	}
+
+	rv := &MultipartUpload{c: c}
+	err = json.NewDecoder(res.Body).Decode(rv)
+	return rv, err
+}
+
+// Pick up an interrupted multipart upload.  Returns Missing if the
+// server no longer knows about it.
+func (c Client) ResumeMultipart(id string) (*MultipartUpload, error) {
+	res, err := http.Get(c.URLFor("/.cbfs/multipart/" + id))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case 200:
+	case 404:
+		return nil, Missing
+	default:
+		return nil, httputil.HTTPErrorf(res,
+			"error resuming upload %v: %S\n%B", id)
+	}
+
+	rv := &MultipartUpload{c: c}
+	err = json.NewDecoder(res.Body).Decode(rv)
+	return rv, err
+}
+
+// Store part n (starting at 1) of the upload, returning its hash.
+func (m *MultipartUpload) PutPart(n int, r io.Reader, length int64) (string, error) {
+	_, node, err := m.c.RandomNode()
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("PUT",
+		node.URLFor(fmt.Sprintf("/.cbfs/multipart/%s/%d", m.ID, n)), r)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = length
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 201 {
+		return "", newStatusError(res)
+	}
+	return res.Header.Get("X-CBFS-Hash"), nil
+}
+
+func (m *MultipartUpload) complete(parts []partRef) error {
+	b, err := json.Marshal(parts)
+	if err != nil {
+		return err
+	}
+
+	res, err := http.Post(m.c.URLFor("/.cbfs/multipart/"+m.ID),
+		"application/json", strings.NewReader(string(b)))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case 201:
+		return nil
+	case 412:
+		return PreconditionFailed
+	}
+	return newStatusError(res)
+}
+
+// Assemble all uploaded parts into the destination file.
+func (m *MultipartUpload) Complete() error {
+	return m.complete(nil)
+}
+
+// Abandon the upload.
+func (m *MultipartUpload) Abort() error {
+	req, err := http.NewRequest("DELETE",
+		m.c.URLFor("/.cbfs/multipart/"+m.ID), nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != 204 && res.StatusCode != 404 {
+		return httputil.HTTPErrorf(res, "error aborting upload of %v: %S",
+			m.Path)
+	}
+	return nil
+}
+
+// Store size bytes from r as dest, uploading partSize pieces in
+// parallel.  If any part ultimately fails, the upload is aborted.
+func (c Client) PutMultipart(dest string, r io.ReaderAt, size, partSize int64,
+	concurrency int, opts PutOptions) error {
+
+	m, err := c.InitMultipart(dest, opts)
+	if err != nil {
+		return err
+	}
+
+	err = m.Upload(r, size, partSize, concurrency)
+	if err != nil && !IsTransient(err) {
+		m.Abort()
+	}
+	return err
+}
+
+// Does part already hold this content?
+func sameContent(part BlobPart, r io.Reader, length int64) bool {
+	if part.Length != length {
+		return false
+	}
+	h := sha1.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return false
+	}
+	return hex.EncodeToString(h.Sum(nil)) == part.OID
+}
+
+// Upload size bytes from r in partSize pieces and complete the
+// upload.  Parts the server already has with the same content are
+// skipped, so this may be used to finish a resumed upload.  Each
+// part is retried with DefaultBackoff on transient failures.
+func (m *MultipartUpload) Upload(r io.ReaderAt, size, partSize int64,
+	concurrency int) error {
+
+	if partSize <= 0 {
+		return fmt.Errorf("invalid part size: %v", partSize)
+	}
+
+	nparts := int((size + partSize - 1) / partSize)
+	if nparts == 0 {
+		nparts = 1
+	}
+	refs := make([]partRef, nparts)
+
+	ch := make(chan int)
+	errs := make(chan error, nparts)
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range ch {
+				off := int64(n) * partSize
+				l := partSize
+				if off+l > size {
+					l = size - off
+				}
+
+				if p, ok := m.Parts[n+1]; ok &&
+					sameContent(p, io.NewSectionReader(r, off, l), l) {
+					refs[n] = partRef{n + 1, p.OID}
+					continue
+				}
+
+				var h string
+				err := DefaultBackoff.Do(func() (err error) {
+					h, err = m.PutPart(n+1, io.NewSectionReader(r, off, l), l)
+					return err
+				})
+				if err != nil {
+					errs <- err
+					continue
+				}
+				refs[n] = partRef{n + 1, h}
+			}
+		}()
+	}
+	for n := 0; n < nparts; n++ {
+		ch <- n
+	}
+	close(ch)
+	wg.Wait()
+	close(errs)
+
+	if err := <-errs; err != nil {
+		return err
+	}
+
+	return DefaultBackoff.Do(func() error { return m.complete(refs) })
+}
@@ -0,0 +1,77 @@
+package cbfsclient
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strings"
+)
+
+// Lists the addresses of the nodes that can serve a whole file from
+// their own disks, as sent in response to HEAD.
+const FileNodesHeader = "X-CBFS-Nodes"
+
+// Tells nodes which zone the client is in, so they can send it to a
+// node there for the content.
+const ZoneHeader = "X-CBFS-Zone"
+
+// The nodes holding all of a file, in the order they're worth trying:
+// the node the client was made with, then nodes in Zone, then the
+// rest at random.  Stale and draining nodes are left out.
+func (c *Client) holders(ctx context.Context, path string) ([]StorageNode, error) {
+	req, err := http.NewRequest("HEAD", c.URLFor(noSlash(path)), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.httpClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case 200:
+	case 404:
+		return nil, Missing
+	default:
+		return nil, newStatusError(res)
+	}
+
+	h := res.Header.Get(FileNodesHeader)
+	if h == "" {
+		return nil, nil
+	}
+	nodeMap, err := c.Nodes()
+	if err != nil {
+		return nil, err
+	}
+	byAddr := map[string]StorageNode{}
+	for _, n := range nodeMap {
+		if !stale(n.HBAgeStr) && !n.Draining {
+			byAddr[n.Addr] = n
+		}
+	}
+
+	var first, local, rest []StorageNode
+	for _, a := range strings.Split(h, ",") {
+		n, ok := byAddr[strings.TrimSpace(a)]
+		switch {
+		case !ok:
+		case c.pu != nil && n.Addr == c.pu.Host:
+			first = append(first, n)
+		case c.Zone != "" && n.Zone == c.Zone:
+			local = append(local, n)
+		default:
+			rest = append(rest, n)
+		}
+	}
+	shuffleNodes(local)
+	shuffleNodes(rest)
+	return append(append(first, local...), rest...), nil
+}
+
+func shuffleNodes(nodes []StorageNode) {
+	for i := range nodes {
+		j := i + rand.Intn(len(nodes)-i)
+		nodes[i], nodes[j] = nodes[j], nodes[i]
+	}
+}
@@ -3,7 +3,10 @@ package cbfsclient
 import (
 	"fmt"
 	"math/rand"
+	"net/http"
 	"time"
+
+	"github.com/dustin/httputil"
 )
 
 // Representation of a storage node.
@@ -20,6 +23,13 @@ type StorageNode struct {
 	Size      int64
 	UptimeStr string `json:"uptime_str"`
 	Version   string
+	Scheme    string
+	Zone      string
+	Draining  bool
+	// Serving reads, but not taking new blobs
+	Maintenance bool
+	// Share of new blobs relative to other nodes
+	Weight float64
 }
 
 func (a StorageNode) BlobURL(h string) string {
@@ -30,7 +40,11 @@ func (a StorageNode) URLFor(h string) string {
 	if h[0] != '/' {
 		h = "/" + h
 	}
-	return fmt.Sprintf("http://%s%s", a.Addr, h)
+	scheme := a.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, a.Addr, h)
 }
 
 // Get the information about the nodes in a cluster.
@@ -39,6 +53,9 @@ func (c *Client) Nodes() (map[string]StorageNode, error) {
 	if c.nodes == nil {
 		c.nodes = map[string]StorageNode{}
 		err = getJsonData(c.URLFor("/.cbfs/nodes/"), &c.nodes)
+		for _, n := range c.nodes {
+			addClusterHost(n.Addr)
+		}
 	}
 	return c.nodes, err
 }
@@ -53,6 +70,14 @@ func stale(s string) bool {
 	return d > staleDuration
 }
 
+// Older servers don't report weights, so their nodes are all equal.
+func (a StorageNode) weight() float64 {
+	if a.Weight > 0 {
+		return a.Weight
+	}
+	return 1
+}
+
 func (c *Client) RandomNode() (string, StorageNode, error) {
 	nodeMap, err := c.Nodes()
 	if err != nil {
@@ -60,9 +85,11 @@ func (c *Client) RandomNode() (string, StorageNode, error) {
 	}
 
 	nodes := make([]string, 0, len(nodeMap))
+	total := 0.0
 	for k, node := range nodeMap {
-		if !stale(node.HBAgeStr) {
+		if !stale(node.HBAgeStr) && !node.Draining && !node.Maintenance {
 			nodes = append(nodes, k)
+			total += node.weight()
 		}
 	}
 
@@ -70,7 +97,73 @@ func (c *Client) RandomNode() (string, StorageNode, error) {
 		return "", StorageNode{}, fmt.Errorf("No nodes available")
 	}
 
-	name := nodes[rand.Intn(len(nodes))]
+	// Bigger nodes are picked more often.
+	name := nodes[len(nodes)-1]
+	x := rand.Float64() * total
+	for _, k := range nodes {
+		if x -= nodeMap[k].weight(); x < 0 {
+			name = k
+			break
+		}
+	}
 
 	return name, nodeMap[name], nil
 }
+
+func (c Client) decommission(method, node string) error {
+	req, err := http.NewRequest(method,
+		c.URLFor("/.cbfs/decommission/"+node), nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return httputil.HTTPErrorf(res, "error decommissioning %v: %S\n%B",
+			node)
+	}
+	return nil
+}
+
+// Stop storing new blobs on a node and move its blobs elsewhere.  The
+// node is removed from the cluster once it's empty.
+func (c Client) Decommission(node string) error {
+	return c.decommission("POST", node)
+}
+
+// Let a node being decommissioned go back to normal service.
+func (c Client) CancelDecommission(node string) error {
+	return c.decommission("DELETE", node)
+}
+
+func (c Client) maintenance(method, node string) error {
+	req, err := http.NewRequest(method,
+		c.URLFor("/.cbfs/maintenance/"+node), nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return httputil.HTTPErrorf(res, "error changing maintenance of %v: %S\n%B",
+			node)
+	}
+	return nil
+}
+
+// Put a node into maintenance: it keeps serving what it has, but
+// takes no new blobs and isn't treated as dead while it's down.
+func (c Client) StartMaintenance(node string) error {
+	return c.maintenance("POST", node)
+}
+
+// Return a node in maintenance to normal service.
+func (c Client) EndMaintenance(node string) error {
+	return c.maintenance("DELETE", node)
+}
@@ -0,0 +1,68 @@
+package cbfsclient
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Pins a file to every node.
+const PinAll = "*"
+
+// The nodes a file is kept on.
+type Pins struct {
+	Path   string   `json:"path"`
+	Pinned []string `json:"pinned"`
+}
+
+func (c Client) pins(req *http.Request) (Pins, error) {
+	rv := Pins{}
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return rv, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case 200:
+	case 404:
+		return rv, Missing
+	default:
+		return rv, newStatusError(res)
+	}
+	err = json.NewDecoder(res.Body).Decode(&rv)
+	return rv, err
+}
+
+// Find which nodes a file is pinned to.  Returns Missing if there's
+// no such file.
+func (c Client) Pins(fn string) (Pins, error) {
+	req, err := http.NewRequest("GET",
+		c.URLFor("/.cbfs/pin/"+noSlash(fn)), nil)
+	if err != nil {
+		return Pins{}, err
+	}
+	return c.pins(req)
+}
+
+// Keep a copy of a file on each of the named nodes, or on all of
+// them with PinAll, replacing any earlier pins.
+func (c Client) Pin(fn string, nodes ...string) (Pins, error) {
+	v := url.Values{"nodes": {strings.Join(nodes, ",")}}
+	req, err := http.NewRequest("POST",
+		c.URLFor("/.cbfs/pin/"+noSlash(fn))+"?"+v.Encode(), nil)
+	if err != nil {
+		return Pins{}, err
+	}
+	return c.pins(req)
+}
+
+// Let a file's copies go wherever replication puts them.
+func (c Client) Unpin(fn string) (Pins, error) {
+	req, err := http.NewRequest("DELETE",
+		c.URLFor("/.cbfs/pin/"+noSlash(fn)), nil)
+	if err != nil {
+		return Pins{}, err
+	}
+	return c.pins(req)
+}
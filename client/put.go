@@ -2,39 +2,106 @@ package cbfsclient
 
 import (
 	"bytes"
-	"fmt"
+	"compress/gzip"
+	"context"
+	"errors"
 	"io"
-	"io/ioutil"
 	"mime"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// When a conditional store found the file had changed.
+var PreconditionFailed = errors.New("precondition failed")
+
 // Options for storing data.
 type PutOptions struct {
 	// If true, do a fast, unsafe store
 	Unsafe bool
 	// Expiration time
 	Expiration int
+	// When the server should remove the object (zero for never)
+	Expires time.Time
+	// Lock the object against overwrites and deletes until then
+	RetainUntil time.Time
 	// Hash to verify ("" for no verification)
 	Hash string
 	// Content type (detected if not specified)
 	ContentType string
 	// Optional reader transform (e.g. for encryption)
 	ContentTransform func(r io.Reader) io.Reader
+	// Only overwrite if the existing content has this hash ("*"
+	// for any existing content)
+	IfMatch string
+	// Don't store if the existing content has this hash ("*" to
+	// only create a new file)
+	IfNoneMatch string
+	// Gzip text-like content in transit
+	Compress bool
+	// Metadata to store with the file, sent as X-CBFS-Meta-* headers
+	Meta map[string]string
 
 	keeprevs   int
 	keeprevset bool
 }
 
+func conditionValue(hash string) string {
+	if hash == "*" {
+		return hash
+	}
+	return `"` + hash + `"`
+}
+
+// Add the IfMatch and IfNoneMatch conditions to a request.
+func (p PutOptions) setConditions(h http.Header) {
+	if p.IfMatch != "" {
+		h.Set("If-Match", conditionValue(p.IfMatch))
+	}
+	if p.IfNoneMatch != "" {
+		h.Set("If-None-Match", conditionValue(p.IfNoneMatch))
+	}
+}
+
 // Specify the number of revs to keep of this object.
 func (p *PutOptions) SetKeepRevs(to int) {
 	p.keeprevs = to
 	p.keeprevset = true
 }
 
+// Is content of this type worth compressing?
+func compressible(ctype string) bool {
+	for _, p := range []string{"text/", "application/json",
+		"application/javascript", "application/xml"} {
+		if strings.HasPrefix(ctype, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Gzip r on the fly.  Call done once the request is finished with
+// the result, so nothing's still reading r after.
+func gzipStream(r io.Reader) (rv io.Reader, done func()) {
+	pr, pw := io.Pipe()
+	finished := make(chan bool)
+	go func() {
+		defer close(finished)
+		gz := gzip.NewWriter(pw)
+		_, err := io.Copy(gz, r)
+		if err == nil {
+			err = gz.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, func() {
+		pr.Close()
+		<-finished
+	}
+}
+
 func recognizeTypeByName(n, def string) string {
 	byname := mime.TypeByExtension(n)
 	switch {
@@ -65,6 +132,14 @@ func recognizeTypeByName(n, def string) string {
 //
 // Options are optional.
 func (c Client) Put(srcname, dest string, r io.Reader, opts PutOptions) error {
+	return c.PutContext(context.Background(), srcname, dest, r, opts)
+}
+
+// Like Put, but stops when ctx is done.  If r can seek back to the
+// start, transient failures are retried on another node.
+func (c Client) PutContext(ctx context.Context, srcname, dest string,
+	r io.Reader, opts PutOptions) error {
+
 	someBytes := make([]byte, 512)
 	n, err := r.Read(someBytes)
 	if err != nil && err != io.EOF {
@@ -73,7 +148,8 @@ func (c Client) Put(srcname, dest string, r io.Reader, opts PutOptions) error {
 	someBytes = someBytes[:n]
 
 	length := int64(-1)
-	if s, ok := r.(io.Seeker); r != os.Stdin && ok {
+	s, rewind := r.(io.Seeker)
+	if rewind && r != os.Stdin {
 		length, err = s.Seek(0, 2)
 		if err != nil {
 			return err
@@ -84,9 +160,11 @@ func (c Client) Put(srcname, dest string, r io.Reader, opts PutOptions) error {
 			return err
 		}
 	} else {
+		rewind = false
 		r = io.MultiReader(bytes.NewReader(someBytes), r)
 	}
 
+	transformed := false
 	if opts.ContentTransform != nil {
 		oldr := r
 		r = opts.ContentTransform(r)
@@ -94,6 +172,8 @@ func (c Client) Put(srcname, dest string, r io.Reader, opts PutOptions) error {
 		// length.
 		if oldr != r {
 			length = -1
+			rewind = false
+			transformed = true
 		}
 	}
 
@@ -102,23 +182,6 @@ func (c Client) Put(srcname, dest string, r io.Reader, opts PutOptions) error {
 		return err
 	}
 
-	du := rn.URLFor(dest)
-	preq, err := http.NewRequest("PUT", du, r)
-	if err != nil {
-		return err
-	}
-	if opts.keeprevset {
-		preq.Header.Set("X-CBFS-KeepRevs",
-			strconv.Itoa(opts.keeprevs))
-	}
-	if opts.Unsafe {
-		preq.Header.Set("X-CBFS-Unsafe", "true")
-	}
-	if opts.Expiration > 0 {
-		preq.Header.Set("X-CBFS-Expiration",
-			strconv.Itoa(opts.Expiration))
-	}
-
 	ctype := opts.ContentType
 	if ctype == "" {
 		ctype = http.DetectContentType(someBytes)
@@ -128,23 +191,84 @@ func (c Client) Put(srcname, dest string, r io.Reader, opts PutOptions) error {
 		}
 	}
 
-	if length >= 0 {
-		preq.Header.Set("Content-Length", strconv.FormatInt(length, 10))
-	}
-	preq.Header.Set("Content-Type", ctype)
-	if opts.Hash != "" {
-		preq.Header.Set("X-CBFS-Hash", opts.Hash)
+	// Transformed content (e.g. encrypted) won't compress.
+	compress := opts.Compress && !transformed && compressible(ctype)
+	if compress {
+		length = -1
 	}
 
-	resp, err := http.DefaultClient.Do(preq)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 201 {
-		r, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
-		return fmt.Errorf("HTTP Error:  %v: %s", resp.Status, r)
+	b := Backoff{Attempts: 1}
+	if rewind {
+		b = c.Backoff
 	}
+	first := true
+	return c.withNodes(ctx, b, rn.URLFor("/"), func(base string) error {
+		if !first {
+			if _, err := s.Seek(0, 0); err != nil {
+				return err
+			}
+		}
+		first = false
+
+		body := r
+		if compress {
+			var done func()
+			body, done = gzipStream(r)
+			defer done()
+		}
+
+		preq, err := http.NewRequest("PUT", base+noSlash(dest), body)
+		if err != nil {
+			return err
+		}
+		if compress {
+			preq.Header.Set("Content-Encoding", "gzip")
+		}
+		preq = preq.WithContext(ctx)
+		if opts.keeprevset {
+			preq.Header.Set("X-CBFS-KeepRevs",
+				strconv.Itoa(opts.keeprevs))
+		}
+		if opts.Unsafe {
+			preq.Header.Set("X-CBFS-Unsafe", "true")
+		}
+		if opts.Expiration > 0 {
+			preq.Header.Set("X-CBFS-Expiration",
+				strconv.Itoa(opts.Expiration))
+		}
+		if !opts.Expires.IsZero() {
+			preq.Header.Set("X-CBFS-Expires",
+				opts.Expires.UTC().Format(time.RFC3339))
+		}
+		if !opts.RetainUntil.IsZero() {
+			preq.Header.Set("X-CBFS-Retain-Until",
+				opts.RetainUntil.UTC().Format(time.RFC3339))
+		}
+
+		if length >= 0 {
+			preq.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+		}
+		preq.Header.Set("Content-Type", ctype)
+		if opts.Hash != "" {
+			preq.Header.Set("X-CBFS-Hash", opts.Hash)
+		}
+		for k, v := range opts.Meta {
+			preq.Header.Set(UserMetaPrefix+k, v)
+		}
+		opts.setConditions(preq.Header)
+
+		resp, err := c.httpClient().Do(preq)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == 412 {
+			return PreconditionFailed
+		}
+		if resp.StatusCode != 201 {
+			return newStatusError(resp)
+		}
 
-	return nil
+		return nil
+	})
 }
@@ -0,0 +1,38 @@
+package cbfsclient
+
+import (
+	"github.com/couchbaselabs/cbfs/config"
+)
+
+// A quota on a path prefix and how much of it is in use.
+type QuotaUsage struct {
+	Prefix string `json:"prefix"`
+	// Limits (0 is unlimited)
+	Bytes   int64 `json:"bytes"`
+	Objects int64 `json:"objects"`
+	// Current size and number of files under the prefix
+	UsedBytes   int64 `json:"usedBytes"`
+	UsedObjects int64 `json:"usedObjects"`
+}
+
+// List the configured quotas along with their usage.
+func (c Client) Quotas() ([]QuotaUsage, error) {
+	rv := []QuotaUsage{}
+	err := getJsonData(c.URLFor("/.cbfs/quota/"), &rv)
+	return rv, err
+}
+
+// Set the quota on a path prefix.  A zero quota removes it.
+func (c Client) SetQuota(prefix string, q cbfsconfig.Quota) error {
+	return c.UpdateConfig(func(conf *cbfsconfig.CBFSConfig) error {
+		if conf.Quotas == nil {
+			conf.Quotas = map[string]cbfsconfig.Quota{}
+		}
+		if q == (cbfsconfig.Quota{}) {
+			delete(conf.Quotas, prefix)
+		} else {
+			conf.Quotas[prefix] = q
+		}
+		return nil
+	})
+}
@@ -0,0 +1,58 @@
+package cbfsclient
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// How long a file is locked against overwrites and deletes.
+type Retention struct {
+	Path        string    `json:"path"`
+	Locked      bool      `json:"locked"`
+	RetainUntil time.Time `json:"retainUntil"`
+	// The retention period configured for the file's path
+	Policy string `json:"policy"`
+}
+
+func (c Client) retention(req *http.Request) (Retention, error) {
+	rv := Retention{}
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return rv, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case 200:
+	case 404:
+		return rv, Missing
+	default:
+		return rv, newStatusError(res)
+	}
+	err = json.NewDecoder(res.Body).Decode(&rv)
+	return rv, err
+}
+
+// Find how long a file is locked.  Returns Missing if there's no such
+// file.
+func (c Client) Retention(fn string) (Retention, error) {
+	req, err := http.NewRequest("GET",
+		c.URLFor("/.cbfs/retention/"+noSlash(fn)), nil)
+	if err != nil {
+		return Retention{}, err
+	}
+	return c.retention(req)
+}
+
+// Lock a file until at least the given time.  Locks can only be
+// extended; the server refuses to shorten one.
+func (c Client) Retain(fn string, until time.Time) (Retention, error) {
+	v := url.Values{"until": {until.UTC().Format(time.RFC3339)}}
+	req, err := http.NewRequest("POST",
+		c.URLFor("/.cbfs/retention/"+noSlash(fn))+"?"+v.Encode(), nil)
+	if err != nil {
+		return Retention{}, err
+	}
+	return c.retention(req)
+}
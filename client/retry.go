@@ -0,0 +1,130 @@
+package cbfsclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// An unsuccessful HTTP response.
+type StatusError struct {
+	Code int
+	Msg  string
+	// Server's ID for the request, for finding it in the logs
+	RequestID string
+	// How long the server asked us to wait before trying again
+	RetryAfter time.Duration
+}
+
+func newStatusError(res *http.Response) *StatusError {
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+	rv := &StatusError{
+		Code:      res.StatusCode,
+		Msg:       string(msg),
+		RequestID: res.Header.Get("X-CBFS-Request-ID"),
+	}
+	if s, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+		rv.RetryAfter = time.Duration(s) * time.Second
+	}
+	return rv
+}
+
+func (s *StatusError) Error() string {
+	if s.RequestID != "" {
+		return fmt.Sprintf("HTTP Error:  %v: %s (request %v)",
+			s.Code, s.Msg, s.RequestID)
+	}
+	return fmt.Sprintf("HTTP Error:  %v: %s", s.Code, s.Msg)
+}
+
+// Is this an error that may go away if the request is retried?
+// Network failures, server errors and being rate limited are; other
+// client errors aren't.
+func IsTransient(err error) bool {
+	switch e := err.(type) {
+	case nil:
+		return false
+	case *StatusError:
+		return e.Code >= 500 || e.Code == 429
+	case *url.Error:
+		return IsTransient(e.Err)
+	case net.Error:
+		return true
+	}
+	return err == io.ErrUnexpectedEOF || err == io.EOF
+}
+
+// Exponential backoff for retrying transient failures.
+type Backoff struct {
+	// Total number of attempts
+	Attempts int
+	// Delay before the first retry, doubling after each
+	Initial time.Duration
+	// Longest delay between attempts
+	Max time.Duration
+}
+
+// Retry schedule used by the client's own operations.
+var DefaultBackoff = Backoff{Attempts: 6, Initial: time.Second, Max: time.Minute}
+
+// Run f until it succeeds, fails with a non-transient error, or
+// runs out of attempts.
+func (b Backoff) Do(f func() error) error {
+	return b.DoContext(context.Background(), f)
+}
+
+// Like Do, but stop retrying once ctx is done.
+func (b Backoff) DoContext(ctx context.Context, f func() error) error {
+	d := b.Initial
+	var err error
+	for i := 0; i < b.Attempts; i++ {
+		if i > 0 {
+			wait := d
+			if se, ok := err.(*StatusError); ok && se.RetryAfter > wait {
+				wait = se.RetryAfter
+			}
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return err
+			}
+			if d *= 2; d > b.Max {
+				d = b.Max
+			}
+		}
+		err = f()
+		if !IsTransient(err) || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// Run f with a node's base URL until it succeeds or fails
+// permanently, starting with base.  Retries go to a random node,
+// in case the one tried was the problem.
+func (c *Client) withNodes(ctx context.Context, b Backoff, base string,
+	f func(base string) error) error {
+
+	if b.Attempts < 1 {
+		b.Attempts = 1
+	}
+	first := true
+	return b.DoContext(ctx, func() error {
+		if !first {
+			if _, n, err := c.RandomNode(); err == nil {
+				base = n.URLFor("/")
+			}
+		}
+		first = false
+		return f(base)
+	})
+}
@@ -0,0 +1,116 @@
+package cbfsclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string   { return "timeout" }
+func (timeoutErr) Timeout() bool   { return true }
+func (timeoutErr) Temporary() bool { return true }
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err error
+		exp bool
+	}{
+		{nil, false},
+		{errors.New("whatever"), false},
+		{&StatusError{Code: 404, Msg: "not found"}, false},
+		{&StatusError{Code: 503, Msg: "busy"}, true},
+		{&StatusError{Code: 429, Msg: "slow down"}, true},
+		{io.ErrUnexpectedEOF, true},
+		{timeoutErr{}, true},
+		{&url.Error{Op: "Put", URL: "http://x/", Err: timeoutErr{}}, true},
+	}
+
+	for _, test := range tests {
+		if got := IsTransient(test.err); got != test.exp {
+			t.Errorf("Expected %v for %v, got %v", test.exp, test.err, got)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := Backoff{Attempts: 4, Initial: time.Millisecond, Max: 2 * time.Millisecond}
+
+	calls := 0
+	err := b.Do(func() error {
+		calls++
+		return &StatusError{Code: 500, Msg: "oops"}
+	})
+	if calls != 4 || err == nil {
+		t.Errorf("Expected 4 failing calls, got %v (%v)", calls, err)
+	}
+
+	calls = 0
+	err = b.Do(func() error {
+		calls++
+		if calls < 3 {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	})
+	if calls != 3 || err != nil {
+		t.Errorf("Expected success on the third call, got %v (%v)", calls, err)
+	}
+
+	calls = 0
+	b.Do(func() error {
+		calls++
+		return &StatusError{Code: 400, Msg: "bad"}
+	})
+	if calls != 1 {
+		t.Errorf("Expected no retries of a client error, got %v calls", calls)
+	}
+}
+
+func TestBackoffContext(t *testing.T) {
+	b := Backoff{Attempts: 4, Initial: time.Hour, Max: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	calls := 0
+	err := b.DoContext(ctx, func() error {
+		calls++
+		return &StatusError{Code: 503, Msg: "busy"}
+	})
+	if calls != 1 || err == nil {
+		t.Errorf("Expected one failing call before giving up, got %v (%v)",
+			calls, err)
+	}
+	// The server's Retry-After outweighs a shorter backoff.
+	b = Backoff{Attempts: 4, Initial: time.Millisecond, Max: time.Millisecond}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	calls = 0
+	b.DoContext(ctx, func() error {
+		calls++
+		return &StatusError{Code: 429, RetryAfter: time.Hour}
+	})
+	if calls != 1 {
+		t.Errorf("Expected to wait out Retry-After, got %v calls", calls)
+	}
+}
+
+func TestStatusErrorRequestID(t *testing.T) {
+	tests := []struct {
+		err *StatusError
+		exp string
+	}{
+		{&StatusError{Code: 500, Msg: "oops"}, "HTTP Error:  500: oops"},
+		{&StatusError{Code: 500, Msg: "oops", RequestID: "abc"},
+			"HTTP Error:  500: oops (request abc)"},
+	}
+	for _, test := range tests {
+		if got := test.err.Error(); got != test.exp {
+			t.Errorf("Expected %q, got %q", test.exp, got)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package cbfsclient
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/httputil"
+)
+
+// A version of a file held by the server.
+type Revision struct {
+	Revno    int         `json:"revno"`    // Revision number
+	OID      string      `json:"oid"`      // Hash
+	Length   int64       `json:"length"`   // Length
+	Modified time.Time   `json:"modified"` // Modified date
+	Headers  http.Header `json:"headers"`  // Headers
+	Parts    []BlobPart  `json:"parts"`    // Parts, if stored in pieces
+	Current  bool        `json:"current"`  // True for the live version
+}
+
+// List the revisions of a file, newest first.
+func (c Client) Revisions(fn string) ([]Revision, error) {
+	res, err := http.Get(c.URLFor("/.cbfs/revisions/" + noSlash(fn)))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case 200:
+	case 404:
+		return nil, Missing
+	default:
+		return nil, httputil.HTTPErrorf(res,
+			"error listing revisions of %v: %S\n%B", fn)
+	}
+
+	rv := struct {
+		Revisions []Revision `json:"revisions"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&rv)
+	return rv.Revisions, err
+}
+
+// Make an older revision of a file current again.
+func (c Client) Revert(fn string, revno int) error {
+	form := url.Values{"rev": []string{strconv.Itoa(revno)}}
+	res, err := http.Post(c.URLFor("/.cbfs/revisions/"+noSlash(fn)),
+		"application/x-www-form-urlencoded",
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case 201, 204:
+		return nil
+	case 404, 410:
+		return Missing
+	}
+	return httputil.HTTPErrorf(res, "error reverting %v: %S\n%B", fn)
+}
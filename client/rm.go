@@ -1,30 +1,94 @@
 package cbfsclient
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"net/http"
-	"github.com/dustin/httputil"
+	"strings"
+	"time"
 )
 
 // When a file is missing.
 var Missing = errors.New("file missing")
 
+// Remove a file.  Returns Missing if there was no such file.
 func (c Client) Rm(fn string) error {
-	u := c.URLFor(fn)
-	req, err := http.NewRequest("DELETE", u, nil)
+	return c.DeleteContext(context.Background(), fn)
+}
+
+// Same as Rm.
+func (c Client) Delete(fn string) error {
+	return c.DeleteContext(context.Background(), fn)
+}
+
+// Like Delete, but stops when ctx is done.
+func (c Client) DeleteContext(ctx context.Context, fn string) error {
+	return c.withNodes(ctx, c.Backoff, c.u, func(base string) error {
+		req, err := http.NewRequest("DELETE", base+noSlash(fn), nil)
+		if err != nil {
+			return err
+		}
+		res, err := c.httpClient().Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		switch res.StatusCode {
+		case 204:
+			return nil
+		case 404:
+			return Missing
+		}
+		return newStatusError(res)
+	})
+}
+
+// Progress of a recursive delete running on the server.
+type RmTask struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path"`
+	Node      string    `json:"node"`
+	State     string    `json:"state"` // running, done or failed
+	Deleted   int64     `json:"deleted"`
+	Errors    int64     `json:"errors"`
+	LastError string    `json:"lastError"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+}
+
+// Is the delete over?
+func (t RmTask) Done() bool {
+	return t.State != "running"
+}
+
+// Start removing everything under a path on the server.  Returns
+// the ID of the task doing it.
+func (c Client) RmRecursive(path string) (string, error) {
+	req, err := http.NewRequest("DELETE",
+		c.URLFor(strings.TrimRight(noSlash(path), "/"))+"/?recursive=true",
+		nil)
 	if err != nil {
-		return err
+		return "", err
 	}
-	res, err := http.DefaultClient.Do(req)
+	res, err := c.httpClient().Do(req)
 	if err != nil {
-		return err
+		return "", err
 	}
-	res.Body.Close()
-	if res.StatusCode == 404 {
-		return Missing
+	defer res.Body.Close()
+	if res.StatusCode != 202 {
+		return "", newStatusError(res)
 	}
-	if res.StatusCode != 204 {
-		return httputil.HTTPErrorf(res, "unexpected status deleting %v: %S\n%B, u")
-	}
-	return nil
+	rv := struct {
+		ID string `json:"id"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&rv)
+	return rv.ID, err
+}
+
+// Get the progress of a recursive delete.
+func (c Client) RmTask(id string) (RmTask, error) {
+	rv := RmTask{}
+	err := getJsonData(c.URLFor("/.cbfs/tasks/"+id), &rv)
+	return rv, err
 }
@@ -0,0 +1,100 @@
+package cbfsclient
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// A deleted file the server is keeping in its trash.
+type TrashEntry struct {
+	ID      string    `json:"id"`
+	Path    string    `json:"path"`    // Where it was deleted from
+	Deleted time.Time `json:"deleted"` // When it was deleted
+	Meta    FileMeta  `json:"meta"`    // The file as it was
+}
+
+// List what was deleted from under prefix, most recently deleted
+// first.
+func (c Client) ListTrash(prefix string) ([]TrashEntry, error) {
+	res, err := c.httpClient().Get(c.URLFor("/.cbfs/trash/" + noSlash(prefix)))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, newStatusError(res)
+	}
+	rv := struct {
+		Entries []TrashEntry `json:"entries"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&rv)
+	return rv.Entries, err
+}
+
+// Put a deleted file back.  An empty id means the most recent
+// deletion of path; an empty to means where it was.  Returns Missing
+// if there's nothing to restore, or PreconditionFailed if a file is
+// in the way and overwrite isn't set.
+func (c Client) RestoreTrash(path, id, to string, overwrite bool) error {
+	v := url.Values{}
+	if id != "" {
+		v.Set("id", id)
+	}
+	if to != "" {
+		v.Set("to", to)
+	}
+	if overwrite {
+		v.Set("overwrite", "true")
+	}
+	u := c.URLFor("/.cbfs/trash/" + noSlash(path))
+	if len(v) > 0 {
+		u += "?" + v.Encode()
+	}
+	res, err := c.httpClient().Post(u, "", nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case 201:
+		return nil
+	case 404:
+		return Missing
+	case 409:
+		return PreconditionFailed
+	}
+	return newStatusError(res)
+}
+
+// Permanently remove what was deleted from under prefix from the
+// trash, or with an id, just that entry.  Returns how many entries
+// went.
+func (c Client) PurgeTrash(prefix, id string) (int, error) {
+	u := c.URLFor("/.cbfs/trash/" + noSlash(prefix))
+	if id != "" {
+		u += "?id=" + url.QueryEscape(id)
+	}
+	req, err := http.NewRequest("DELETE", u, nil)
+	if err != nil {
+		return 0, err
+	}
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case 200:
+	case 404:
+		return 0, Missing
+	default:
+		return 0, newStatusError(res)
+	}
+	rv := struct {
+		Purged int `json:"purged"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&rv)
+	return rv.Purged, err
+}
@@ -0,0 +1,40 @@
+package cbfsclient
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Headers beginning with this are stored and returned with a file.
+const UserMetaPrefix = "X-CBFS-Meta-"
+
+// The metadata stored with a file, keyed by lower case name.
+func UserMeta(h http.Header) map[string]string {
+	rv := map[string]string{}
+	for k := range h {
+		if len(k) > len(UserMetaPrefix) &&
+			strings.EqualFold(k[:len(UserMetaPrefix)], UserMetaPrefix) {
+			rv[strings.ToLower(k[len(UserMetaPrefix):])] = h.Get(k)
+		}
+	}
+	return rv
+}
+
+// Find files with the named metadata set to value.
+func (c Client) SearchMeta(name, value string) ([]string, error) {
+	return c.searchMeta(url.Values{"name": {name}, "value": {value}})
+}
+
+// Find files with the named metadata set to anything.
+func (c Client) SearchMetaName(name string) ([]string, error) {
+	return c.searchMeta(url.Values{"name": {name}})
+}
+
+func (c Client) searchMeta(q url.Values) ([]string, error) {
+	rv := struct {
+		Files []string `json:"files"`
+	}{}
+	err := getJsonData(c.URLFor("/.cbfs/search/?"+q.Encode()), &rv)
+	return rv.Files, err
+}
@@ -0,0 +1,109 @@
+package cbfsclient
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	// Ask a node to send content's hash.
+	WantHashHeader = "X-CBFS-Want-Hash"
+	// Where a node sends content's hash, as "<algorithm>=<hex>",
+	// either as a header or a trailer.
+	HashHeader = "X-CBFS-Hash"
+)
+
+// Hashes content can be checked against.
+var hashBuilders = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha224": sha256.New224,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// A new hash of the named kind, or nil if this client doesn't know it.
+func NewHash(name string) hash.Hash {
+	if f, ok := hashBuilders[name]; ok {
+		return f()
+	}
+	return nil
+}
+
+// Content that didn't hash to what the node said it would.
+type HashMismatch struct {
+	Algorithm string
+	Want, Got string
+}
+
+func (h *HashMismatch) Error() string {
+	return fmt.Sprintf("%v mismatch: expected %v, got %v",
+		h.Algorithm, h.Want, h.Got)
+}
+
+type verifyingBody struct {
+	io.ReadCloser
+	res    *http.Response
+	hashes map[string]hash.Hash
+}
+
+// Wrap a response body so reading it fails with a *HashMismatch at
+// the end if it didn't match the hash the node sent.  Content whose
+// hash wasn't sent, or uses a hash this client doesn't know, is
+// passed through unchecked.
+func VerifyBody(res *http.Response) io.ReadCloser {
+	v := &verifyingBody{res.Body, res, map[string]hash.Hash{}}
+	if digest := res.Header.Get(HashHeader); digest != "" {
+		alg := strings.SplitN(digest, "=", 2)[0]
+		if f, ok := hashBuilders[alg]; ok {
+			v.hashes[alg] = f()
+		}
+	} else if _, ok := res.Trailer[http.CanonicalHeaderKey(HashHeader)]; ok {
+		// Which hash isn't known until the trailer arrives.
+		for alg, f := range hashBuilders {
+			v.hashes[alg] = f()
+		}
+	}
+	return v
+}
+
+func (v *verifyingBody) Read(p []byte) (int, error) {
+	n, err := v.ReadCloser.Read(p)
+	for _, h := range v.hashes {
+		h.Write(p[:n])
+	}
+	if err == io.EOF {
+		if e := v.check(); e != nil {
+			err = e
+		}
+	}
+	return n, err
+}
+
+func (v *verifyingBody) check() error {
+	digest := v.res.Header.Get(HashHeader)
+	if digest == "" {
+		digest = v.res.Trailer.Get(HashHeader)
+	}
+	parts := strings.SplitN(digest, "=", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+	h, ok := v.hashes[parts[0]]
+	if !ok {
+		return nil
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != parts[1] {
+		return &HashMismatch{parts[0], parts[1], got}
+	}
+	return nil
+}
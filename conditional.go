@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// The conditional headers that apply to storing a file.
+var writeConditions = []string{"If-Match", "If-None-Match",
+	"If-Unmodified-Since"}
+
+func fileETag(oid string) string {
+	return `"` + oid + `"`
+}
+
+// Does an If-Match or If-None-Match list contain etag?  Weak
+// validators only match when weak is true.
+func etagListMatches(list, etag string, weak bool) bool {
+	for _, t := range strings.Split(list, ",") {
+		t = strings.TrimSpace(t)
+		if strings.HasPrefix(t, "W/") {
+			if !weak {
+				continue
+			}
+			t = t[2:]
+		}
+		if t == "*" || t == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluate the conditional request headers against the current state
+// of a file in the order RFC 7232 prescribes.
+//
+// Returns 0 if the request should proceed, otherwise the status to
+// respond with (304 for reads that would return what the client
+// already has, 412 for failed preconditions).
+func evalConditions(h http.Header, read, exists bool,
+	etag string, modified time.Time) int {
+
+	modified = modified.Truncate(time.Second)
+
+	if im := h.Get("If-Match"); im != "" {
+		if !exists || !etagListMatches(im, etag, false) {
+			return 412
+		}
+	} else if ius := h.Get("If-Unmodified-Since"); ius != "" && exists {
+		t, err := http.ParseTime(ius)
+		if err == nil && modified.After(t) {
+			return 412
+		}
+	}
+
+	if inm := h.Get("If-None-Match"); inm != "" {
+		if exists && etagListMatches(inm, etag, true) {
+			if read {
+				return 304
+			}
+			return 412
+		}
+	} else if ims := h.Get("If-Modified-Since"); ims != "" && read && exists {
+		t, err := http.ParseTime(ims)
+		if err == nil && !modified.After(t) {
+			return 304
+		}
+	}
+
+	return 0
+}
+
+// Respond to a request whose conditions said not to proceed.
+func sendConditionFailure(w http.ResponseWriter, code int, etag string) {
+	if code == 304 {
+		w.Header().Set("Etag", etag)
+		w.WriteHeader(304)
+		return
+	}
+	http.Error(w, "precondition failed", code)
+}
+
+// The write conditions in h, or nil if there are none.
+func writeConditionsFrom(h http.Header) http.Header {
+	var rv http.Header
+	for _, k := range writeConditions {
+		if v := h.Get(k); v != "" {
+			if rv == nil {
+				rv = http.Header{}
+			}
+			rv.Set(k, v)
+		}
+	}
+	return rv
+}
+
+// Check a write's conditions against what's stored at k before
+// reading its body, so a doomed upload doesn't have to be sent.
+// They're checked again when the file is stored, which is what
+// makes the write atomic; this is only an early out.
+func precheckWrite(k string, h http.Header) int {
+	if writeConditionsFrom(h) == nil {
+		return 0
+	}
+	fm := fileMeta{}
+	err := couchbase.Get(k, &fm)
+	if err != nil && !gomemcached.IsNotFound(err) {
+		// Let the store decide.
+		return 0
+	}
+	return evalConditions(h, false, err == nil, fileETag(fm.OID), fm.Modified)
+}
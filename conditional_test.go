@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestEvalConditions(t *testing.T) {
+	mod := time.Date(2013, 5, 1, 12, 0, 0, 500, time.UTC)
+	before := mod.Add(-time.Hour).Format(http.TimeFormat)
+	at := mod.Format(http.TimeFormat)
+	etag := fileETag("abc")
+
+	tests := []struct {
+		hdr    string
+		val    string
+		read   bool
+		exists bool
+		exp    int
+	}{
+		{"", "", true, true, 0},
+		{"If-Match", `"abc"`, false, true, 0},
+		{"If-Match", `"x", "abc"`, false, true, 0},
+		{"If-Match", `W/"abc"`, false, true, 412},
+		{"If-Match", `"x"`, false, true, 412},
+		{"If-Match", "*", false, false, 412},
+		{"If-None-Match", "*", false, true, 412},
+		{"If-None-Match", "*", false, false, 0},
+		{"If-None-Match", `W/"abc"`, true, true, 304},
+		{"If-None-Match", `"x"`, true, true, 0},
+		{"If-Unmodified-Since", before, false, true, 412},
+		{"If-Unmodified-Since", at, false, true, 0},
+		{"If-Unmodified-Since", before, false, false, 0},
+		{"If-Modified-Since", at, true, true, 304},
+		{"If-Modified-Since", before, true, true, 0},
+		{"If-Modified-Since", at, false, true, 0},
+	}
+
+	for _, test := range tests {
+		h := http.Header{}
+		if test.hdr != "" {
+			h.Set(test.hdr, test.val)
+		}
+		got := evalConditions(h, test.read, test.exists, etag, mod)
+		if got != test.exp {
+			t.Errorf("Expected %v for %v: %v (read=%v, exists=%v), got %v",
+				test.exp, test.hdr, test.val, test.read, test.exists, got)
+		}
+	}
+}
+
+func TestWriteConditionsFrom(t *testing.T) {
+	h := http.Header{}
+	h.Set("Content-Type", "text/plain")
+	h.Set("If-Modified-Since", "Wed, 01 May 2013 12:00:00 GMT")
+	if got := writeConditionsFrom(h); got != nil {
+		t.Errorf("Expected no write conditions, got %v", got)
+	}
+
+	h.Set("If-Match", `"abc"`)
+	h.Set("If-None-Match", "*")
+	got := writeConditionsFrom(h)
+	if len(got) != 2 || got.Get("If-Match") != `"abc"` ||
+		got.Get("If-None-Match") != "*" {
+		t.Errorf("Expected only If-Match and If-None-Match, got %v", got)
+	}
+}
@@ -21,7 +21,10 @@ func StoreConfig(conf cbfsconfig.CBFSConfig) error {
 
 // Update this config from the db.
 func RetrieveConfig() (*cbfsconfig.CBFSConfig, error) {
-	conf := &cbfsconfig.CBFSConfig{}
+	// Start from the defaults so settings newer than the stored
+	// config get sensible values.
+	c := cbfsconfig.DefaultConfig()
+	conf := &c
 	err := couchbase.Get(configKey, conf)
 	return conf, err
 }
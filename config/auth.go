@@ -0,0 +1,84 @@
+package cbfsconfig
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Permissions that may be granted on a path prefix.
+const (
+	PermRead   = 'r'
+	PermWrite  = 'w'
+	PermDelete = 'd'
+)
+
+// Access to everything under a path prefix.  Paths under ".cbfs/"
+// are the administrative API.
+type Grant struct {
+	Prefix string `json:"prefix"`
+	// Any of r (read), w (write) and d (delete)
+	Perms string `json:"perms"`
+}
+
+// Parse a grant of the form prefix:perms.
+func ParseGrant(s string) (Grant, error) {
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		return Grant{}, fmt.Errorf("invalid grant %q (expected prefix:perms)", s)
+	}
+	g := Grant{strings.TrimLeft(s[:i], "/"), s[i+1:]}
+	if g.Perms == "" || strings.Trim(g.Perms, "rwd") != "" {
+		return Grant{}, fmt.Errorf("invalid permissions in %q (expected rwd)", s)
+	}
+	return g, nil
+}
+
+func (g Grant) String() string {
+	return g.Prefix + ":" + g.Perms
+}
+
+// Someone allowed to use the cluster.
+type AuthUser struct {
+	// Hex SHA-256 of the user's token; the token itself isn't kept
+	TokenHash string  `json:"tokenHash"`
+	Grants    []Grant `json:"grants"`
+	// Secret access key for signing S3 requests, with the user's
+	// name as the access key.  SigV4 needs the secret itself, so
+	// unlike the token it's kept as is.
+	S3Secret string `json:"s3Secret,omitempty"`
+}
+
+func HashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// Find the user a token belongs to.  If name is given (as with
+// basic auth), the token must belong to that user.
+func (conf CBFSConfig) Authenticate(name, token string) (string, AuthUser, bool) {
+	h := []byte(HashToken(token))
+	for n, u := range conf.Users {
+		if (name == "" || name == n) && hmac.Equal(h, []byte(u.TokenHash)) {
+			return n, u, true
+		}
+	}
+	return "", AuthUser{}, false
+}
+
+// Does the user have the given permission on path?  A grant covers
+// its prefix and everything under it, but not siblings that merely
+// start the same way.
+func (u AuthUser) Allows(path string, perm byte) bool {
+	path = strings.TrimLeft(path, "/")
+	for _, g := range u.Grants {
+		p := strings.Trim(g.Prefix, "/")
+		if (p == "" || path == p || strings.HasPrefix(path, p+"/")) &&
+			strings.IndexByte(g.Perms, perm) >= 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package cbfsconfig
+
+import (
+	"testing"
+)
+
+func TestParseGrant(t *testing.T) {
+	tests := []struct {
+		in  string
+		exp Grant
+		ok  bool
+	}{
+		{"pub/:r", Grant{"pub/", "r"}, true},
+		{"/home/bob/:rwd", Grant{"home/bob/", "rwd"}, true},
+		{":r", Grant{"", "r"}, true},
+		{"a:b:w", Grant{"a:b", "w"}, true},
+		{"pub/", Grant{}, false},
+		{"pub/:", Grant{}, false},
+		{"pub/:rx", Grant{}, false},
+	}
+
+	for _, test := range tests {
+		got, err := ParseGrant(test.in)
+		if (err == nil) != test.ok || got != test.exp {
+			t.Errorf("Expected %v (ok=%v) for %q, got %v (%v)",
+				test.exp, test.ok, test.in, got, err)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Users = map[string]AuthUser{
+		"alice": {TokenHash: HashToken("a-token")},
+		"bob":   {TokenHash: HashToken("b-token")},
+	}
+
+	tests := []struct {
+		name, token string
+		exp         string
+		ok          bool
+	}{
+		{"", "a-token", "alice", true},
+		{"bob", "b-token", "bob", true},
+		{"alice", "b-token", "", false},
+		{"", "nope", "", false},
+		{"", "", "", false},
+	}
+
+	for _, test := range tests {
+		got, _, ok := conf.Authenticate(test.name, test.token)
+		if ok != test.ok || got != test.exp {
+			t.Errorf("Expected %q (ok=%v) for %q/%q, got %q (ok=%v)",
+				test.exp, test.ok, test.name, test.token, got, ok)
+		}
+	}
+}
+
+func TestAllows(t *testing.T) {
+	u := AuthUser{Grants: []Grant{
+		{"pub/", "r"},
+		{"home/bob/", "rw"},
+		{".cbfs/config/", "r"},
+		{"user1", "rw"},
+	}}
+
+	tests := []struct {
+		path string
+		perm byte
+		exp  bool
+	}{
+		{"pub/x", PermRead, true},
+		{"/pub/x", PermRead, true},
+		{"pub/x", PermWrite, false},
+		{"public", PermRead, false},
+		{"home/bob/a/b", PermWrite, true},
+		{"home/bob/a/b", PermDelete, false},
+		{"home/bobby", PermRead, false},
+		{".cbfs/config/", PermRead, true},
+		{".cbfs/config/", PermWrite, false},
+		{"user1", PermWrite, true},
+		{"user1/x", PermWrite, true},
+		{"user10/x", PermRead, false},
+		{"user1x", PermRead, false},
+	}
+
+	for _, test := range tests {
+		if got := u.Allows(test.path, test.perm); got != test.exp {
+			t.Errorf("Expected %v for %v %c, got %v",
+				test.exp, test.path, test.perm, got)
+		}
+	}
+}
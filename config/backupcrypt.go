@@ -0,0 +1,225 @@
+package cbfsconfig
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Encrypted backups begin with a header of the magic, a random salt
+// the key is derived from the secret with, and a random nonce prefix.
+// The backup follows in chunks sealed with AES-256-GCM, each chunk's
+// nonce being the prefix followed by its index.  The last chunk is
+// marked in its additional data and is always short of a full one,
+// so a backup cut off anywhere fails to read rather than restoring
+// part of it.
+const (
+	BackupEncMagic = "CBFSBAK1"
+
+	backupSaltLen   = 16
+	backupPrefixLen = 8
+	backupChunkSize = 64 * 1024
+	backupTagSize   = 16
+	backupKDFRounds = 100000
+)
+
+var (
+	ErrNoBackupSecret  = errors.New("no backup secret given")
+	ErrBackupTruncated = errors.New("encrypted backup is truncated")
+)
+
+// Derive a 256 bit key from a secret with PBKDF2-HMAC-SHA256.
+func backupKey(secret, salt []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	rv := append([]byte{}, u...)
+	for i := 1; i < backupKDFRounds; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range rv {
+			rv[j] ^= u[j]
+		}
+	}
+	return rv
+}
+
+func backupAEAD(secret, salt []byte) (cipher.AEAD, error) {
+	if len(secret) == 0 {
+		return nil, ErrNoBackupSecret
+	}
+	block, err := aes.NewCipher(backupKey(secret, salt))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func backupNonce(prefix []byte, i uint32) []byte {
+	nonce := make([]byte, backupPrefixLen+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[backupPrefixLen:], i)
+	return nonce
+}
+
+func backupChunkAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// Whether a backup beginning with hdr is encrypted.
+func IsEncryptedBackup(hdr []byte) bool {
+	return bytes.HasPrefix(hdr, []byte(BackupEncMagic))
+}
+
+type backupEncrypter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	buf    []byte
+	n      uint32
+}
+
+// Encrypt what's written to the returned writer onto w with a key
+// derived from secret.  Close writes the last chunk, but doesn't close
+// w.
+func NewBackupEncrypter(w io.Writer, secret []byte) (io.WriteCloser, error) {
+	hdr := make([]byte, len(BackupEncMagic)+backupSaltLen+backupPrefixLen)
+	copy(hdr, BackupEncMagic)
+	if _, err := rand.Read(hdr[len(BackupEncMagic):]); err != nil {
+		return nil, err
+	}
+	salt := hdr[len(BackupEncMagic) : len(BackupEncMagic)+backupSaltLen]
+	aead, err := backupAEAD(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+	return &backupEncrypter{
+		w:      w,
+		aead:   aead,
+		prefix: hdr[len(BackupEncMagic)+backupSaltLen:],
+		buf:    make([]byte, 0, backupChunkSize),
+	}, nil
+}
+
+func (e *backupEncrypter) seal(last bool) error {
+	out := e.aead.Seal(nil, backupNonce(e.prefix, e.n), e.buf,
+		backupChunkAD(last))
+	e.n++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(out)
+	return err
+}
+
+func (e *backupEncrypter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more arrives, so the
+		// last one is always short.
+		if len(e.buf) == backupChunkSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):backupChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *backupEncrypter) Close() error {
+	if len(e.buf) == backupChunkSize {
+		if err := e.seal(false); err != nil {
+			return err
+		}
+	}
+	return e.seal(true)
+}
+
+type backupDecrypter struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	prefix []byte
+	n      uint32
+	buf    []byte
+	plain  []byte
+	done   bool
+}
+
+// Read a backup encrypted with secret from r.  Each chunk is checked
+// before any of it is returned, and reading fails at the end if the
+// backup was cut short.
+func NewBackupDecrypter(r io.Reader, secret []byte) (io.Reader, error) {
+	hdr := make([]byte, len(BackupEncMagic)+backupSaltLen+backupPrefixLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if !IsEncryptedBackup(hdr) {
+		return nil, errors.New("backup isn't encrypted")
+	}
+	salt := hdr[len(BackupEncMagic) : len(BackupEncMagic)+backupSaltLen]
+	aead, err := backupAEAD(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+	return &backupDecrypter{
+		r:      r,
+		aead:   aead,
+		prefix: hdr[len(BackupEncMagic)+backupSaltLen:],
+		buf:    make([]byte, backupChunkSize+backupTagSize),
+	}, nil
+}
+
+func (d *backupDecrypter) next() error {
+	n, err := io.ReadFull(d.r, d.buf)
+	last := false
+	switch err {
+	case nil:
+	case io.ErrUnexpectedEOF:
+		last = true
+	case io.EOF:
+		return ErrBackupTruncated
+	default:
+		return err
+	}
+	plain, err := d.aead.Open(d.buf[:0], backupNonce(d.prefix, d.n),
+		d.buf[:n], backupChunkAD(last))
+	if err != nil {
+		return fmt.Errorf("error decrypting backup chunk %v "+
+			"(wrong secret, or the backup is damaged or truncated)", d.n)
+	}
+	d.n++
+	d.plain = plain
+	d.done = last
+	return nil
+}
+
+func (d *backupDecrypter) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
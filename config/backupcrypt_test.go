@@ -0,0 +1,81 @@
+package cbfsconfig
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func encryptBackup(t *testing.T, data, secret []byte) []byte {
+	buf := &bytes.Buffer{}
+	w, err := NewBackupEncrypter(buf, secret)
+	if err != nil {
+		t.Fatalf("Error starting encryption: %v", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Error encrypting: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Error finishing encryption: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func decryptBackup(enc, secret []byte) ([]byte, error) {
+	r, err := NewBackupDecrypter(bytes.NewReader(enc), secret)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestBackupEncryption(t *testing.T) {
+	secret := []byte("sekrit")
+	for _, size := range []int{0, 1, backupChunkSize, 2*backupChunkSize + 5} {
+		data := bytes.Repeat([]byte{'x'}, size)
+		enc := encryptBackup(t, data, secret)
+		if !IsEncryptedBackup(enc) {
+			t.Errorf("Expected %v bytes encrypted to look encrypted", size)
+		}
+		if bytes.Contains(enc, []byte("xxxx")) {
+			t.Errorf("Expected no plaintext in %v bytes encrypted", size)
+		}
+		got, err := decryptBackup(enc, secret)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("Expected %v bytes back, got %v, %v", size, len(got), err)
+		}
+	}
+}
+
+func TestBackupDecryptionFailures(t *testing.T) {
+	secret := []byte("sekrit")
+	enc := encryptBackup(t, bytes.Repeat([]byte{'x'}, 3*backupChunkSize),
+		secret)
+	hdrLen := len(BackupEncMagic) + backupSaltLen + backupPrefixLen
+
+	flipped := append([]byte{}, enc...)
+	flipped[hdrLen+100] ^= 1
+
+	tests := []struct {
+		name   string
+		enc    []byte
+		secret []byte
+	}{
+		{"wrong secret", enc, []byte("other")},
+		{"no secret", enc, nil},
+		{"a flipped bit", flipped, secret},
+		{"a short last chunk", enc[:len(enc)-1], secret},
+		{"a missing last chunk", enc[:hdrLen+3*(backupChunkSize+backupTagSize)],
+			secret},
+		{"a cut in a chunk", enc[:hdrLen+backupChunkSize], secret},
+	}
+	for _, test := range tests {
+		if _, err := decryptBackup(test.enc, test.secret); err == nil {
+			t.Errorf("Expected an error decrypting with %v", test.name)
+		}
+	}
+
+	if IsEncryptedBackup([]byte{0x1f, 0x8b, 8, 0}) {
+		t.Errorf("Expected a gzip stream not to look encrypted")
+	}
+}
@@ -24,7 +24,11 @@ type CBFSConfig struct {
 	GCEnabled bool `json:"gcEnabled"`
 	// Maximum number of items to look for in a GC pass.
 	GCLimit int `json:"gclimit"`
-	// Hash algorithm to use
+	// Most blobs GC removes per second (0 for no limit)
+	GCRate int `json:"gcRate"`
+	// Most bytes of blobs GC removes per second (0 for no limit)
+	GCBytesRate int64 `json:"gcBytesRate"`
+	// Hash algorithm new blobs are named by (e.g. sha1, sha256, blake3)
 	Hash string `json:"hash"`
 	// Expected heartbeat frequency
 	HeartbeatFreq time.Duration `json:"hbfreq"`
@@ -32,6 +36,22 @@ type CBFSConfig struct {
 	MinReplicas int `json:"minrepl"`
 	// Maximum number of replicas to try to keep
 	MaxReplicas int `json:"maxrepl"`
+	// Replica counts for files under path prefixes, overriding the
+	// above
+	PathReplicas map[string]int `json:"pathReplicas"`
+	// Largest total size of a file's X-CBFS-Meta-* headers (0 for
+	// no limit)
+	MaxUserMeta int `json:"maxUserMeta"`
+	// Space and file count limits for files under path prefixes
+	Quotas map[string]Quota `json:"quotas"`
+	// URLs notified when files are created, overwritten or deleted
+	Webhooks []Webhook `json:"webhooks"`
+	// How long entries are kept in the changes feed
+	ChangesRetention time.Duration `json:"changesRetention"`
+	// Directories copied to or from other clusters, by name
+	Mirrors map[string]Mirror `json:"mirrors"`
+	// How often to catch mirrors up
+	MirrorFreq time.Duration `json:"mirrorFreq"`
 	// Number of blobs to remove from a stale node per period
 	NodeCleanCount int `json:"cleanCount"`
 	// Reconciliation frequency
@@ -64,6 +84,119 @@ type CBFSConfig struct {
 	TrimFullNodesSpace int64 `json:"trimFullSize"`
 	// How far time can drift from DB before warning
 	DriftWarnThresh time.Duration `json:"driftWarnThresh"`
+	// How long an idle multipart upload is kept before it's abandoned
+	MultipartExpiration time.Duration `json:"multipartExpiration"`
+	// Files bigger than this are stored as a sequence of chunks (0
+	// disables)
+	ChunkThreshold int64 `json:"chunkThreshold"`
+	// Size of each chunk of a chunked file
+	ChunkSize int64 `json:"chunkSize"`
+	// Split chunked files where their content says to (averaging
+	// ChunkSize) rather than at fixed offsets, so an insertion only
+	// changes the chunks around it
+	ContentDefinedChunks bool `json:"contentDefinedChunks"`
+	// How often to look for and remove expired files
+	ExpireFreq time.Duration `json:"expireFreq"`
+	// How long deleted files are kept in the trash (0 deletes them
+	// outright)
+	TrashRetention time.Duration `json:"trashRetention"`
+	// How long files under path prefixes can't be overwritten or
+	// deleted after they're written
+	PathRetention map[string]Retention `json:"pathRetention"`
+	// Secret used to sign and verify URLs
+	SigningKey string `json:"signingKey"`
+	// Refuse unsigned requests for user files
+	RequireSignedURLs bool `json:"requireSignedURLs"`
+	// Refuse requests without valid credentials
+	AuthRequired bool `json:"authRequired"`
+	// Users by name
+	Users map[string]AuthUser `json:"users"`
+	// Secret nodes use to authenticate to each other
+	NodeSecret string `json:"nodeSecret"`
+	// Requests per second each node serves clients in all (0 for
+	// no limit).  Requests from other nodes aren't limited: those
+	// with the NodeSecret, or without one, any from a node's address.
+	RateLimit int `json:"rateLimit"`
+	// Requests per second each node serves any one client, by
+	// authenticated user or else address (0 for no limit)
+	ClientRateLimit int `json:"clientRateLimit"`
+	// How much of the above rates may be used at once
+	RateBurst time.Duration `json:"rateBurst"`
+	// Base64 AES keys for blobs on disk.  New blobs are encrypted
+	// with the first; the rest are only used to read older blobs.
+	EncryptionKeys []string `json:"encryptionKeys"`
+	// Smallest blob to erasure code instead of replicating (0 disables)
+	ErasureMinSize int64 `json:"ecMinSize"`
+	// How long a blob must go unreferenced before it's erasure coded
+	ErasureAge time.Duration `json:"ecAge"`
+	// Number of data shards in an erasure coded blob
+	ErasureDataShards int `json:"ecData"`
+	// Number of parity shards in an erasure coded blob
+	ErasureParityShards int `json:"ecParity"`
+	// How often to look for blobs to erasure code
+	ErasureFreq time.Duration `json:"ecFreq"`
+	// How often to rebuild lost shards of erasure coded blobs
+	ErasureRepairFreq time.Duration `json:"ecRepairFreq"`
+	// How often to look for replicas sharing a zone
+	ZoneCheckFreq time.Duration `json:"zoneCheckFreq"`
+	// How often to move blobs off of nodes being decommissioned
+	DrainFreq time.Duration `json:"drainFreq"`
+	// How often to move blobs between nodes to even out disk use
+	RebalanceFreq time.Duration `json:"rebalanceFreq"`
+	// Percentage points a node's disk use may be over the mean for
+	// its tier before blobs are moved off of it (0 disables)
+	RebalanceSpread int `json:"rebalanceSpread"`
+	// Most blobs to look at moving off of a node at a time
+	RebalanceCount int `json:"rebalanceCount"`
+	// Move blobs nobody's read in this long to cold tier nodes (0
+	// disables)
+	ColdAfter time.Duration `json:"coldAfter"`
+	// How often to look for blobs to move to the cold tier
+	TierFreq time.Duration `json:"tierFreq"`
+	// Most blobs to rename under the configured hash each run (0
+	// disables)
+	RehashLimit int `json:"rehashLimit"`
+	// How often to look for blobs named by another hash
+	RehashFreq time.Duration `json:"rehashFreq"`
+	// How often to check the per-directory usage totals against the
+	// files
+	DuReconcileFreq time.Duration `json:"duReconcileFreq"`
+	// Local blobs up to this size are hashed before being served
+	ReadVerifySize int64 `json:"readVerifySize"`
+	// Local blobs at least this big are sent straight from disk by
+	// the kernel without being checked on the way, leaving bad
+	// copies to the scrubber (0 disables)
+	ZeroCopySize int64 `json:"zeroCopySize"`
+	// Redirect reads of files a node doesn't hold to one that does
+	// instead of passing them through (?direct= overrides it)
+	DirectReads bool `json:"directReads"`
+	// Requests taking at least this long are written to the slow
+	// request log (0 disables)
+	SlowRequestTime time.Duration `json:"slowRequestTime"`
+	// Bytes per second to re-read local blobs at to find bit rot
+	// (0 disables)
+	ScrubRate int64 `json:"scrubRate"`
+	// Bytes per second a node may pull in restoring lost copies of
+	// blobs, scaled down while its network or disk is busy (0 for
+	// no limit)
+	RepairRate int64 `json:"repairRate"`
+	// Where to write scheduled backups: a local directory, a
+	// cbfs:path prefix, an s3://bucket/prefix or a
+	// gs://bucket/prefix (empty disables)
+	BackupDest string `json:"backupDest"`
+	// How often to make a scheduled backup
+	BackupFreq time.Duration `json:"backupFreq"`
+	// Number of scheduled backups to keep (0 keeps all)
+	BackupKeep int `json:"backupKeep"`
+	// Remove scheduled backups older than this (0 keeps all)
+	BackupMaxAge time.Duration `json:"backupMaxAge"`
+	// Credentials for backups in S3 or GCS (an HMAC key for GCS).
+	// When empty, the AWS_* environment variables are used.
+	BackupAccessKey string `json:"backupAccessKey"`
+	BackupSecretKey string `json:"backupSecretKey"`
+	// Size of the parts backups are uploaded to S3 or GCS in, each
+	// held in memory while it's sent (at least 5MB)
+	BackupPartSize int64 `json:"backupPartSize"`
 }
 
 // Get the default configuration
@@ -91,6 +224,33 @@ func DefaultConfig() CBFSConfig {
 		TrimFullNodesCount:    10000,
 		TrimFullNodesSpace:    1 * 1024 * 1024 * 1024,
 		DriftWarnThresh:       5 * time.Minute,
+		MultipartExpiration:   time.Hour * 24 * 7,
+		ChunkSize:             64 * 1024 * 1024,
+		ExpireFreq:            time.Minute * 5,
+		ErasureAge:            time.Hour * 24 * 30,
+		ErasureDataShards:     6,
+		ErasureParityShards:   3,
+		ErasureFreq:           time.Hour,
+		ErasureRepairFreq:     time.Minute * 15,
+		ZoneCheckFreq:         time.Hour,
+		DrainFreq:             time.Minute * 5,
+		RebalanceFreq:         time.Hour,
+		RebalanceSpread:       10,
+		RebalanceCount:        1000,
+		TierFreq:              time.Hour,
+		RehashFreq:            time.Hour,
+		DuReconcileFreq:       time.Hour * 24,
+		ReadVerifySize:        16 * 1024 * 1024,
+		ScrubRate:             1024 * 1024,
+		RepairRate:            64 * 1024 * 1024,
+		BackupFreq:            time.Hour * 24,
+		BackupKeep:            14,
+		BackupPartSize:        64 * 1024 * 1024,
+		MaxUserMeta:           8192,
+		ChangesRetention:      time.Hour * 24 * 7,
+		MirrorFreq:            time.Minute,
+		RateBurst:             time.Second,
+		SlowRequestTime:       time.Second * 10,
 	}
 }
 
@@ -202,6 +362,19 @@ func (conf *CBFSConfig) SetParameter(name string, inval interface{}) error {
 			}
 			val.Field(i).SetInt(v)
 			return nil
+		case sf.Type.Kind() == reflect.Map, sf.Type.Kind() == reflect.Slice:
+			var data []byte
+			if s, ok := inval.(string); ok {
+				data = []byte(s)
+			} else if data, err = json.Marshal(inval); err != nil {
+				return err
+			}
+			v := reflect.New(sf.Type)
+			if err := json.Unmarshal(data, v.Interface()); err != nil {
+				return err
+			}
+			val.Field(i).Set(v.Elem())
+			return nil
 		default:
 			return fmt.Errorf("Unhandled type in field %v", name)
 		}
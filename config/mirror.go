@@ -0,0 +1,68 @@
+package cbfsconfig
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Asynchronous copying of the files under a directory to or from
+// another cbfs cluster, driven by the source's changes feed.  The
+// source always wins: whatever it has replaces what's at the
+// destination.  Don't mirror the same files in both directions.
+type Mirror struct {
+	// Base URL of the other cluster
+	Remote string `json:"remote"`
+	// "push" sends changes here to Remote; "pull" fetches Remote's
+	Direction string `json:"direction"`
+	// Files under this directory on the source are mirrored (all
+	// files if empty)
+	Prefix string `json:"prefix,omitempty"`
+	// Where they go on the destination (the same place if empty)
+	DestPrefix string `json:"destPrefix,omitempty"`
+	// Bytes per second to copy file content at (0 for no limit)
+	BytesPerSec int64 `json:"bytesPerSec,omitempty"`
+	// API token to send to the remote cluster
+	Token string `json:"token,omitempty"`
+}
+
+// Check that a mirror makes sense.
+func (m Mirror) Validate() error {
+	switch m.Direction {
+	case "push", "pull":
+	default:
+		return fmt.Errorf("mirror direction must be push or pull, not %q",
+			m.Direction)
+	}
+	u, err := url.Parse(m.Remote)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid mirror remote: %q", m.Remote)
+	}
+	return nil
+}
+
+// Where the file at path on the source goes on the destination, and
+// whether it's mirrored at all.
+func (m Mirror) DestPath(path string) (string, bool) {
+	path = strings.Trim(path, "/")
+	p := QuotaPrefix(m.Prefix)
+	dp := QuotaPrefix(m.DestPrefix)
+	if m.DestPrefix == "" {
+		dp = p
+	}
+
+	rel := path
+	if p != "" {
+		if !strings.HasPrefix(path, p+"/") {
+			return "", false
+		}
+		rel = path[len(p)+1:]
+	}
+	if dp == "" {
+		return rel, true
+	}
+	return dp + "/" + rel, true
+}
@@ -0,0 +1,50 @@
+package cbfsconfig
+
+import (
+	"testing"
+)
+
+func TestMirrorDestPath(t *testing.T) {
+	tests := []struct {
+		m    Mirror
+		path string
+		exp  string
+		ok   bool
+	}{
+		{Mirror{}, "a/b", "a/b", true},
+		{Mirror{Prefix: "a"}, "a/b", "a/b", true},
+		{Mirror{Prefix: "/a/"}, "/a/b/c", "a/b/c", true},
+		{Mirror{Prefix: "a"}, "ab/c", "", false},
+		{Mirror{Prefix: "a"}, "a", "", false},
+		{Mirror{Prefix: "a", DestPrefix: "dr/a"}, "a/b", "dr/a/b", true},
+		{Mirror{DestPrefix: "dr"}, "a/b", "dr/a/b", true},
+		{Mirror{Prefix: "a", DestPrefix: "/"}, "a/b", "b", true},
+	}
+
+	for _, test := range tests {
+		got, ok := test.m.DestPath(test.path)
+		if got != test.exp || ok != test.ok {
+			t.Errorf("Expected %q, %v for %v in %+v, got %q, %v",
+				test.exp, test.ok, test.path, test.m, got, ok)
+		}
+	}
+}
+
+func TestMirrorValidate(t *testing.T) {
+	tests := []struct {
+		m  Mirror
+		ok bool
+	}{
+		{Mirror{Remote: "http://dr:8484/", Direction: "push"}, true},
+		{Mirror{Remote: "https://dr/", Direction: "pull"}, true},
+		{Mirror{Remote: "http://dr/", Direction: "both"}, false},
+		{Mirror{Remote: "dr:8484", Direction: "push"}, false},
+	}
+
+	for _, test := range tests {
+		err := test.m.Validate()
+		if (err == nil) != test.ok {
+			t.Errorf("Expected ok=%v for %+v, got %v", test.ok, test.m, err)
+		}
+	}
+}
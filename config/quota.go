@@ -0,0 +1,41 @@
+package cbfsconfig
+
+import (
+	"sort"
+	"strings"
+)
+
+// Limits on the files under a path prefix.  Zero means unlimited.
+type Quota struct {
+	Bytes   int64 `json:"bytes,omitempty"`
+	Objects int64 `json:"objects,omitempty"`
+}
+
+// Normalize a quota prefix to a slash-free directory name.
+func QuotaPrefix(prefix string) string {
+	return strings.Trim(strings.TrimRight(prefix, "*"), "/")
+}
+
+// Find the quota prefixes covering a path, outermost first.  Unlike
+// PathReplicas, a quota prefix is a directory, so "a" covers "a/b"
+// but not "ab".
+func (conf CBFSConfig) QuotasFor(path string) []string {
+	path = strings.Trim(path, "/")
+	rv := []string{}
+	for prefix := range conf.Quotas {
+		p := QuotaPrefix(prefix)
+		if p == "" || path == p || strings.HasPrefix(path, p+"/") {
+			rv = append(rv, prefix)
+		}
+	}
+	sort.Sort(byQuotaDepth(rv))
+	return rv
+}
+
+type byQuotaDepth []string
+
+func (b byQuotaDepth) Len() int      { return len(b) }
+func (b byQuotaDepth) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byQuotaDepth) Less(i, j int) bool {
+	return len(QuotaPrefix(b[i])) < len(QuotaPrefix(b[j]))
+}
@@ -0,0 +1,34 @@
+package cbfsconfig
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestQuotasFor(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Quotas = map[string]Quota{
+		"/tenants/a/":  {Bytes: 1024},
+		"tenants/a/x*": {Objects: 10},
+		"tenants/b":    {Bytes: 2048, Objects: 5},
+	}
+
+	tests := []struct {
+		path string
+		exp  []string
+	}{
+		{"tenants/a/f", []string{"/tenants/a/"}},
+		{"/tenants/a/x/f", []string{"/tenants/a/", "tenants/a/x*"}},
+		{"tenants/a/xy", []string{"/tenants/a/"}},
+		{"tenants/b", []string{"tenants/b"}},
+		{"tenants/bb/f", []string{}},
+		{"other", []string{}},
+	}
+
+	for _, test := range tests {
+		got := conf.QuotasFor(test.path)
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("Expected %v for %v, got %v", test.exp, test.path, got)
+		}
+	}
+}
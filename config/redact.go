@@ -0,0 +1,93 @@
+package cbfsconfig
+
+// Stands in for secrets in a config sent to those who may not see
+// them.  Storing a config with it keeps the secret already there.
+const RedactedSecret = "(redacted)"
+
+func redact(s string) string {
+	if s == "" {
+		return s
+	}
+	return RedactedSecret
+}
+
+func unredact(s, old string) string {
+	if s == RedactedSecret {
+		return old
+	}
+	return s
+}
+
+// A copy of the config with its secrets replaced by RedactedSecret.
+func (conf CBFSConfig) Redacted() CBFSConfig {
+	conf.NodeSecret = redact(conf.NodeSecret)
+	conf.SigningKey = redact(conf.SigningKey)
+	conf.BackupSecretKey = redact(conf.BackupSecretKey)
+
+	keys := make([]string, len(conf.EncryptionKeys))
+	for i, k := range conf.EncryptionKeys {
+		keys[i] = redact(k)
+	}
+	conf.EncryptionKeys = keys
+
+	users := make(map[string]AuthUser, len(conf.Users))
+	for n, u := range conf.Users {
+		u.TokenHash = redact(u.TokenHash)
+		u.S3Secret = redact(u.S3Secret)
+		users[n] = u
+	}
+	conf.Users = users
+
+	hooks := make([]Webhook, len(conf.Webhooks))
+	for i, h := range conf.Webhooks {
+		h.Secret = redact(h.Secret)
+		hooks[i] = h
+	}
+	conf.Webhooks = hooks
+
+	mirrors := make(map[string]Mirror, len(conf.Mirrors))
+	for n, m := range conf.Mirrors {
+		m.Token = redact(m.Token)
+		mirrors[n] = m
+	}
+	conf.Mirrors = mirrors
+
+	return conf
+}
+
+// Put back the secrets from old that have been redacted, so a
+// redacted config can be changed and stored again.  Users and mirrors
+// are matched by name, webhooks by URL and encryption keys by
+// position, so rotating keys means giving them all.
+func (conf *CBFSConfig) Unredact(old CBFSConfig) {
+	conf.NodeSecret = unredact(conf.NodeSecret, old.NodeSecret)
+	conf.SigningKey = unredact(conf.SigningKey, old.SigningKey)
+	conf.BackupSecretKey = unredact(conf.BackupSecretKey, old.BackupSecretKey)
+
+	for i, k := range conf.EncryptionKeys {
+		oldKey := ""
+		if i < len(old.EncryptionKeys) {
+			oldKey = old.EncryptionKeys[i]
+		}
+		conf.EncryptionKeys[i] = unredact(k, oldKey)
+	}
+
+	for n, u := range conf.Users {
+		u.TokenHash = unredact(u.TokenHash, old.Users[n].TokenHash)
+		u.S3Secret = unredact(u.S3Secret, old.Users[n].S3Secret)
+		conf.Users[n] = u
+	}
+
+	oldHooks := map[string]string{}
+	for _, h := range old.Webhooks {
+		oldHooks[h.URL] = h.Secret
+	}
+	for i, h := range conf.Webhooks {
+		conf.Webhooks[i].Secret = unredact(h.Secret, oldHooks[h.URL])
+	}
+
+	for n, m := range conf.Mirrors {
+		m.Token = unredact(m.Token, old.Mirrors[n].Token)
+		conf.Mirrors[n] = m
+	}
+}
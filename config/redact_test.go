@@ -0,0 +1,82 @@
+package cbfsconfig
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func secretConfig() CBFSConfig {
+	conf := DefaultConfig()
+	conf.NodeSecret = "node-secret"
+	conf.SigningKey = "signing-key"
+	conf.BackupSecretKey = "backup-secret"
+	conf.EncryptionKeys = []string{"key-one", "key-two"}
+	conf.Users = map[string]AuthUser{
+		"alice": {TokenHash: HashToken("a-token"),
+			Grants: []Grant{{"a/", "r"}}, S3Secret: "s3-secret"},
+	}
+	conf.Webhooks = []Webhook{{URL: "http://h/", Secret: "hook-secret"},
+		{URL: "http://open/"}}
+	conf.Mirrors = map[string]Mirror{
+		"m": {Remote: "http://r/", Direction: "push", Token: "mirror-token"}}
+	return conf
+}
+
+func TestRedacted(t *testing.T) {
+	conf := secretConfig()
+	orig := secretConfig()
+	r := conf.Redacted()
+	if !reflect.DeepEqual(conf, orig) {
+		t.Errorf("Expected redacting not to change the original")
+	}
+
+	if r.NodeSecret != RedactedSecret || r.SigningKey != RedactedSecret ||
+		r.BackupSecretKey != RedactedSecret ||
+		r.Users["alice"].TokenHash != RedactedSecret ||
+		r.Users["alice"].S3Secret != RedactedSecret ||
+		r.Webhooks[0].Secret != RedactedSecret ||
+		r.Mirrors["m"].Token != RedactedSecret ||
+		!reflect.DeepEqual(r.EncryptionKeys,
+			[]string{RedactedSecret, RedactedSecret}) {
+		t.Errorf("Expected every secret redacted, got %+v", r)
+	}
+	if r.Webhooks[1].Secret != "" {
+		t.Errorf("Expected an unset secret to stay unset, got %q",
+			r.Webhooks[1].Secret)
+	}
+	if !reflect.DeepEqual(r.Users["alice"].Grants, orig.Users["alice"].Grants) {
+		t.Errorf("Expected grants to be left alone, got %v",
+			r.Users["alice"].Grants)
+	}
+
+	// Fetched, changed and stored again, it keeps its secrets.
+	data, err := json.Marshal(&r)
+	if err != nil {
+		t.Fatalf("Error marshaling: %v", err)
+	}
+	back := CBFSConfig{}
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatalf("Error unmarshaling: %v", err)
+	}
+	back.MinReplicas = 7
+	back.Unredact(orig)
+	orig.MinReplicas = 7
+	if !reflect.DeepEqual(back, orig) {
+		t.Errorf("Expected secrets back:\n%+v\n%+v", back, orig)
+	}
+}
+
+func TestUnredactKeepsNewSecrets(t *testing.T) {
+	conf := secretConfig().Redacted()
+	conf.NodeSecret = "new-secret"
+	conf.Webhooks[0].URL = "http://elsewhere/"
+	conf.Unredact(secretConfig())
+	if conf.NodeSecret != "new-secret" {
+		t.Errorf("Expected a changed secret to be kept, got %q", conf.NodeSecret)
+	}
+	if conf.Webhooks[0].Secret != "" {
+		t.Errorf("Expected no secret for a hook that didn't have one, got %q",
+			conf.Webhooks[0].Secret)
+	}
+}
@@ -0,0 +1,20 @@
+package cbfsconfig
+
+import (
+	"strings"
+)
+
+// Find the replica count configured for a path.  The PathReplicas
+// entry with the longest prefix of the path applies.  ok is false if
+// none does.
+func (conf CBFSConfig) ReplicasFor(path string) (n int, ok bool) {
+	path = strings.TrimLeft(path, "/")
+	best := -1
+	for prefix, count := range conf.PathReplicas {
+		p := strings.TrimRight(strings.TrimLeft(prefix, "/"), "*")
+		if strings.HasPrefix(path, p) && len(p) > best {
+			best, n, ok = len(p), count, true
+		}
+	}
+	return
+}
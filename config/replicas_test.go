@@ -0,0 +1,35 @@
+package cbfsconfig
+
+import (
+	"testing"
+)
+
+func TestReplicasFor(t *testing.T) {
+	conf := DefaultConfig()
+	conf.PathReplicas = map[string]int{
+		"/thumbnails/*":     2,
+		"masters/":          4,
+		"masters/archive/*": 5,
+	}
+
+	tests := []struct {
+		path string
+		n    int
+		ok   bool
+	}{
+		{"thumbnails/a.jpg", 2, true},
+		{"/thumbnails/x/y.jpg", 2, true},
+		{"masters/a.tif", 4, true},
+		{"masters/archive/old.tif", 5, true},
+		{"thumbnailsx", 0, false},
+		{"other/file", 0, false},
+	}
+
+	for _, test := range tests {
+		n, ok := conf.ReplicasFor(test.path)
+		if n != test.n || ok != test.ok {
+			t.Errorf("Expected %v (ok=%v) for %v, got %v (ok=%v)",
+				test.n, test.ok, test.path, n, ok)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package cbfsconfig
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// How long files are locked against overwrites and deletes after
+// they're written.  Written like "2160h" in the config.
+type Retention time.Duration
+
+func (r Retention) String() string {
+	return time.Duration(r).String()
+}
+
+func (r Retention) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(r).String())
+}
+
+func (r *Retention) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch x := v.(type) {
+	case string:
+		d, err := time.ParseDuration(x)
+		if err != nil {
+			return err
+		}
+		*r = Retention(d)
+	case float64:
+		*r = Retention(x)
+	default:
+		return unhandledValue(string(data))
+	}
+	return nil
+}
+
+// Find how long a file stored at path is locked for.  Like a quota
+// prefix, a retention prefix is a directory.  When several cover the
+// path, the longest period wins.
+func (conf CBFSConfig) RetentionFor(path string) time.Duration {
+	path = strings.Trim(path, "/")
+	rv := time.Duration(0)
+	for prefix, r := range conf.PathRetention {
+		p := QuotaPrefix(prefix)
+		if p == "" || path == p || strings.HasPrefix(path, p+"/") {
+			if time.Duration(r) > rv {
+				rv = time.Duration(r)
+			}
+		}
+	}
+	return rv
+}
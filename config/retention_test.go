@@ -0,0 +1,43 @@
+package cbfsconfig
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetentionFor(t *testing.T) {
+	conf := DefaultConfig()
+	err := conf.SetParameter("pathRetention",
+		`{"records/": "2160h", "records/tax*": "61320h", "logs": "24h"}`)
+	if err != nil {
+		t.Fatalf("Error setting retention: %v", err)
+	}
+
+	tests := []struct {
+		path string
+		exp  time.Duration
+	}{
+		{"records/a.pdf", 2160 * time.Hour},
+		{"/records/tax/2013.pdf", 61320 * time.Hour},
+		{"records/taxes.pdf", 2160 * time.Hour},
+		{"logs", 24 * time.Hour},
+		{"logsx/a", 0},
+		{"other", 0},
+	}
+
+	for _, test := range tests {
+		got := conf.RetentionFor(test.path)
+		if got != test.exp {
+			t.Errorf("Expected %v for %v, got %v", test.exp, test.path, got)
+		}
+	}
+}
+
+func TestRetentionErrors(t *testing.T) {
+	conf := DefaultConfig()
+	for _, v := range []string{`{"a": "forever"}`, `{"a": true}`} {
+		if err := conf.SetParameter("pathRetention", v); err == nil {
+			t.Errorf("Expected error setting retention to %v", v)
+		}
+	}
+}
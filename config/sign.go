@@ -0,0 +1,188 @@
+package cbfsconfig
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query parameters of a signed URL.  Every parameter beginning with
+// "sig" is covered by the signature, so restrictions can be added
+// without changing the scheme.
+const (
+	SignatureParam  = "signature"
+	SigExpiresParam = "sigexpires"
+	SigMethodParam  = "sigmethod"
+	SigPrefixParam  = "sigprefix"
+	SigMaxSizeParam = "sigmaxsize"
+	SigTypeParam    = "sigtype"
+)
+
+var (
+	ErrNoSigningKey     = errors.New("no signing key configured")
+	ErrUnsigned         = errors.New("request is not signed")
+	ErrBadSignature     = errors.New("invalid signature")
+	ErrSignatureExpired = errors.New("signature expired")
+	ErrWrongMethod      = errors.New("signature not valid for this method")
+	ErrOutsidePrefix    = errors.New("path not covered by signature")
+	ErrTooLarge         = errors.New("upload too large")
+	ErrWrongType        = errors.New("content type not allowed")
+)
+
+// Restrictions a signed URL places on what may be uploaded with it.
+type UploadPolicy struct {
+	// Allow any path under this prefix rather than just the one signed
+	Prefix string
+	// Largest allowed upload in bytes (0 for no limit)
+	MaxSize int64
+	// Required content type ("" for any, "image/*" for any image)
+	ContentType string
+}
+
+// Get the upload policy from a signed URL's query.
+func ParseUploadPolicy(q url.Values) UploadPolicy {
+	rv := UploadPolicy{
+		Prefix:      strings.TrimLeft(q.Get(SigPrefixParam), "/"),
+		ContentType: q.Get(SigTypeParam),
+	}
+	rv.MaxSize, _ = strconv.ParseInt(q.Get(SigMaxSizeParam), 10, 64)
+	return rv
+}
+
+func (p UploadPolicy) addParams(q url.Values) {
+	if p.Prefix != "" {
+		q.Set(SigPrefixParam, strings.TrimLeft(p.Prefix, "/"))
+	}
+	if p.MaxSize > 0 {
+		q.Set(SigMaxSizeParam, strconv.FormatInt(p.MaxSize, 10))
+	}
+	if p.ContentType != "" {
+		q.Set(SigTypeParam, p.ContentType)
+	}
+}
+
+// Check an upload of size bytes (-1 if unknown) of the given
+// content type against the policy.
+func (p UploadPolicy) Allows(size int64, ctype string) error {
+	if p.MaxSize > 0 && size > p.MaxSize {
+		return ErrTooLarge
+	}
+	if p.ContentType == "" {
+		return nil
+	}
+	if i := strings.Index(ctype, ";"); i >= 0 {
+		ctype = ctype[:i]
+	}
+	ctype = strings.ToLower(strings.TrimSpace(ctype))
+	want := strings.ToLower(p.ContentType)
+	if strings.HasSuffix(want, "/*") {
+		if strings.HasPrefix(ctype, want[:len(want)-1]) {
+			return nil
+		}
+	} else if ctype == want {
+		return nil
+	}
+	return ErrWrongType
+}
+
+// The parameters of q that a signature covers.
+func signedParams(q url.Values) url.Values {
+	rv := url.Values{}
+	for k, v := range q {
+		if strings.HasPrefix(k, "sig") && k != SignatureParam {
+			rv[k] = v
+		}
+	}
+	return rv
+}
+
+func (conf CBFSConfig) signature(path string, params url.Values) string {
+	mac := hmac.New(sha256.New, []byte(conf.SigningKey))
+	io.WriteString(mac, strings.TrimLeft(path, "/"))
+	io.WriteString(mac, "\n")
+	io.WriteString(mac, params.Encode())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Methods are signed as GET (read) or PUT (write).
+func signingMethod(m string) string {
+	if m == "HEAD" {
+		return "GET"
+	}
+	return m
+}
+
+// Get the query parameters that allow method on path until expires.
+func (conf CBFSConfig) SignURL(method, path string,
+	expires time.Time) (url.Values, error) {
+
+	return conf.SignUpload(method, path, UploadPolicy{}, expires)
+}
+
+// Get the query parameters that allow uploads by method (PUT, or
+// POST for form uploads) under the given policy until expires.  If
+// the policy has a prefix, path is ignored.
+func (conf CBFSConfig) SignUpload(method, path string, p UploadPolicy,
+	expires time.Time) (url.Values, error) {
+
+	q := url.Values{
+		SigMethodParam:  []string{signingMethod(method)},
+		SigExpiresParam: []string{strconv.FormatInt(expires.Unix(), 10)},
+	}
+	p.addParams(q)
+	if p.Prefix != "" {
+		path = p.Prefix
+	}
+	return conf.signURL(path, q)
+}
+
+func (conf CBFSConfig) signURL(path string, params url.Values) (url.Values, error) {
+	if conf.SigningKey == "" {
+		return nil, ErrNoSigningKey
+	}
+	params.Set(SignatureParam, conf.signature(path, params))
+	return params, nil
+}
+
+// Check that the query q properly signs a method request for path.
+// Any upload policy still needs to be checked by the caller.
+func (conf CBFSConfig) VerifySignature(method, path string,
+	q url.Values, now time.Time) error {
+
+	sig := q.Get(SignatureParam)
+	switch {
+	case sig == "":
+		return ErrUnsigned
+	case conf.SigningKey == "":
+		return ErrNoSigningKey
+	}
+
+	params := signedParams(q)
+	path = strings.TrimLeft(path, "/")
+	if prefix := params.Get(SigPrefixParam); prefix != "" {
+		p := strings.Trim(prefix, "/")
+		if p != "" && path != p && !strings.HasPrefix(path, p+"/") {
+			return ErrOutsidePrefix
+		}
+		path = prefix
+	}
+	exp := conf.signature(path, params)
+	if !hmac.Equal([]byte(sig), []byte(exp)) {
+		return ErrBadSignature
+	}
+
+	e, err := strconv.ParseInt(params.Get(SigExpiresParam), 10, 64)
+	if err != nil || now.Unix() > e {
+		return ErrSignatureExpired
+	}
+	if params.Get(SigMethodParam) != signingMethod(method) {
+		return ErrWrongMethod
+	}
+	return nil
+}
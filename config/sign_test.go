@@ -0,0 +1,143 @@
+package cbfsconfig
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSignURL(t *testing.T) {
+	conf := DefaultConfig()
+	now := time.Now()
+
+	if _, err := conf.SignURL("GET", "a/b", now); err != ErrNoSigningKey {
+		t.Fatalf("Expected %v without a key, got %v", ErrNoSigningKey, err)
+	}
+
+	conf.SigningKey = "sekrit"
+	q, err := conf.SignURL("GET", "/a/b", now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Error signing: %v", err)
+	}
+
+	other := conf
+	other.SigningKey = "other"
+
+	tampered := url.Values{}
+	for k, v := range q {
+		tampered[k] = v
+	}
+	tampered.Set(SigMethodParam, "PUT")
+
+	tests := []struct {
+		conf   CBFSConfig
+		method string
+		path   string
+		q      url.Values
+		now    time.Time
+		exp    error
+	}{
+		{conf, "GET", "a/b", q, now, nil},
+		{conf, "GET", "/a/b", q, now, nil},
+		{conf, "HEAD", "a/b", q, now, nil},
+		{conf, "PUT", "a/b", q, now, ErrWrongMethod},
+		{conf, "PUT", "a/b", tampered, now, ErrBadSignature},
+		{conf, "GET", "a/c", q, now, ErrBadSignature},
+		{other, "GET", "a/b", q, now, ErrBadSignature},
+		{conf, "GET", "a/b", q, now.Add(time.Hour), ErrSignatureExpired},
+		{conf, "GET", "a/b", url.Values{}, now, ErrUnsigned},
+	}
+
+	for _, test := range tests {
+		err := test.conf.VerifySignature(test.method, test.path, test.q, test.now)
+		if err != test.exp {
+			t.Errorf("Expected %v for %v %v, got %v",
+				test.exp, test.method, test.path, err)
+		}
+	}
+}
+
+func TestSignUploadPrefix(t *testing.T) {
+	conf := DefaultConfig()
+	conf.SigningKey = "sekrit"
+	now := time.Now()
+
+	q, err := conf.SignUpload("PUT", "ignored",
+		UploadPolicy{Prefix: "/up/u1/", MaxSize: 1024, ContentType: "image/*"},
+		now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Error signing: %v", err)
+	}
+
+	tests := []struct {
+		path string
+		exp  error
+	}{
+		{"up/u1/a.jpg", nil},
+		{"/up/u1/sub/b.png", nil},
+		{"up/u2/a.jpg", ErrOutsidePrefix},
+		{"ignored", ErrOutsidePrefix},
+	}
+	for _, test := range tests {
+		err := conf.VerifySignature("PUT", test.path, q, now)
+		if err != test.exp {
+			t.Errorf("Expected %v for %v, got %v", test.exp, test.path, err)
+		}
+	}
+
+	p := ParseUploadPolicy(q)
+	exp := UploadPolicy{Prefix: "up/u1/", MaxSize: 1024, ContentType: "image/*"}
+	if p != exp {
+		t.Errorf("Expected policy %+v, got %+v", exp, p)
+	}
+
+	// Without a trailing slash, the prefix still only covers its
+	// own directory.
+	q, err = conf.SignUpload("PUT", "ignored", UploadPolicy{Prefix: "up/u1"},
+		now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Error signing: %v", err)
+	}
+	tests = []struct {
+		path string
+		exp  error
+	}{
+		{"up/u1/a.jpg", nil},
+		{"up/u1", nil},
+		{"up/u10/a.jpg", ErrOutsidePrefix},
+		{"up/u1x", ErrOutsidePrefix},
+	}
+	for _, test := range tests {
+		err := conf.VerifySignature("PUT", test.path, q, now)
+		if err != test.exp {
+			t.Errorf("Expected %v for %v, got %v", test.exp, test.path, err)
+		}
+	}
+}
+
+func TestUploadPolicyAllows(t *testing.T) {
+	tests := []struct {
+		p     UploadPolicy
+		size  int64
+		ctype string
+		exp   error
+	}{
+		{UploadPolicy{}, 1 << 40, "whatever", nil},
+		{UploadPolicy{MaxSize: 10}, 10, "", nil},
+		{UploadPolicy{MaxSize: 10}, 11, "", ErrTooLarge},
+		{UploadPolicy{MaxSize: 10}, -1, "", nil},
+		{UploadPolicy{ContentType: "text/plain"}, 1, "text/plain; charset=utf-8", nil},
+		{UploadPolicy{ContentType: "text/plain"}, 1, "Text/Plain", nil},
+		{UploadPolicy{ContentType: "text/plain"}, 1, "text/html", ErrWrongType},
+		{UploadPolicy{ContentType: "image/*"}, 1, "image/png", nil},
+		{UploadPolicy{ContentType: "image/*"}, 1, "imagey/png", ErrWrongType},
+		{UploadPolicy{ContentType: "image/*"}, 1, "", ErrWrongType},
+	}
+
+	for _, test := range tests {
+		if err := test.p.Allows(test.size, test.ctype); err != test.exp {
+			t.Errorf("Expected %v for %+v with %v/%q, got %v",
+				test.exp, test.p, test.size, test.ctype, err)
+		}
+	}
+}
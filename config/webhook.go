@@ -0,0 +1,46 @@
+package cbfsconfig
+
+import (
+	"strings"
+)
+
+// A URL that's sent a JSON event whenever a file changes.
+type Webhook struct {
+	URL string `json:"url"`
+	// Only files under this directory (all files if empty)
+	Prefix string `json:"prefix,omitempty"`
+	// Event types to send: created, overwritten, deleted (all if
+	// empty)
+	Events []string `json:"events,omitempty"`
+	// If set, events are signed with an HMAC-SHA256 of this key
+	Secret string `json:"secret,omitempty"`
+}
+
+// Does this hook want to hear about the given event on path?
+func (h Webhook) Wants(event, path string) bool {
+	p := QuotaPrefix(h.Prefix)
+	path = strings.Trim(path, "/")
+	if p != "" && path != p && !strings.HasPrefix(path, p+"/") {
+		return false
+	}
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// The hooks that want to hear about the given event on path.
+func (conf CBFSConfig) WebhooksFor(event, path string) []Webhook {
+	rv := []Webhook{}
+	for _, h := range conf.Webhooks {
+		if h.Wants(event, path) {
+			rv = append(rv, h)
+		}
+	}
+	return rv
+}
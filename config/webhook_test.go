@@ -0,0 +1,33 @@
+package cbfsconfig
+
+import (
+	"testing"
+)
+
+func TestWebhookWants(t *testing.T) {
+	tests := []struct {
+		hook  Webhook
+		event string
+		path  string
+		exp   bool
+	}{
+		{Webhook{}, "created", "a/b", true},
+		{Webhook{Prefix: "a"}, "deleted", "a/b", true},
+		{Webhook{Prefix: "/a/"}, "deleted", "/a/b", true},
+		{Webhook{Prefix: "a/*"}, "deleted", "a", true},
+		{Webhook{Prefix: "a"}, "created", "ab", false},
+		{Webhook{Prefix: "a/b"}, "created", "a", false},
+		{Webhook{Events: []string{"deleted"}}, "deleted", "x", true},
+		{Webhook{Events: []string{"deleted"}}, "created", "x", false},
+		{Webhook{Prefix: "a", Events: []string{"created", "overwritten"}},
+			"overwritten", "a/x", true},
+	}
+
+	for _, test := range tests {
+		got := test.hook.Wants(test.event, test.path)
+		if got != test.exp {
+			t.Errorf("Expected %v for %+v on %v %v, got %v",
+				test.exp, test.hook, test.event, test.path, got)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+var errSourceChanged = errors.New("source changed during move")
+
+// Find the destination path of a COPY or MOVE.  The Destination
+// header may be a bare path or a full URL.
+func copyDestination(req *http.Request) (string, error) {
+	d := req.Header.Get("Destination")
+	if d == "" {
+		return "", errors.New("no Destination header")
+	}
+	u, err := url.Parse(d)
+	if err != nil {
+		return "", err
+	}
+
+	dest := u.Path
+	for len(dest) > 0 && dest[0] == '/' {
+		dest = dest[1:]
+	}
+	switch {
+	case dest == "", strings.HasSuffix(dest, "/"):
+		return "", fmt.Errorf("invalid destination: %v", d)
+	case strings.Contains(dest, "//"):
+		return "", fmt.Errorf("too many slashes in destination: %v", d)
+	case strings.HasPrefix(dest, ".cbfs/"):
+		return "", fmt.Errorf("can't copy into %v", d)
+	}
+	return dest, nil
+}
+
+// Copy (or move) a file by writing new metadata that points at the
+// same blob.  No content is transferred.
+func doCopyUserDoc(w http.ResponseWriter, req *http.Request, move bool) {
+	src, k := resolvePath(req)
+	dest, err := copyDestination(req)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if dest == src {
+		http.Error(w, "source and destination are the same", 403)
+		return
+	}
+
+	got := fileMeta{}
+	err = couchbase.Get(k, &got)
+	switch {
+	case err == nil:
+	case gomemcached.IsNotFound(err):
+		http.Error(w, "not found", 404)
+		return
+	default:
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if move && httpRetentionError(w, src, checkRetention(src, got, time.Now())) {
+		return
+	}
+
+	_, err = referenceBlob(got.OID)
+	if err != nil {
+		log.Printf("Missing blob %v while copying %v -> %v",
+			got.OID, src, dest)
+		http.Error(w, fmt.Sprintf("Error referencing blob: %v", err), 500)
+		return
+	}
+
+	fm := fileMeta{
+		Headers:  got.Headers,
+		OID:      got.OID,
+		Length:   got.Length,
+		Parts:    got.Parts,
+		Userdata: got.Userdata,
+		Modified: time.Now().UTC(),
+	}
+
+	// Preconditions given on the request apply to the destination.
+	hdr := http.Header{}
+	for _, h := range []string{"If-Match", "If-None-Match"} {
+		if v := req.Header.Get(h); v != "" {
+			hdr.Set(h, v)
+		}
+	}
+	if req.Header.Get("Overwrite") == "F" {
+		hdr.Set("If-None-Match", "*")
+	}
+
+	revs := globalConfig.DefaultVersionCount
+	if i, err := strconv.Atoi(req.Header.Get("X-CBFS-KeepRevs")); err == nil {
+		revs = i
+	}
+
+	err = storeMeta(dest, getExpiration(req.Header), fm, revs, hdr)
+	if httpQuotaError(w, dest, err) || httpRetentionError(w, dest, err) {
+		return
+	}
+	switch err {
+	case nil:
+	case errUploadPrecondition:
+		http.Error(w, "precondition failed", 412)
+		return
+	default:
+		log.Printf("Error storing file meta of %v -> %v: %v",
+			dest, fm.OID, err)
+		http.Error(w, fmt.Sprintf("Error recording file meta: %v", err), 500)
+		return
+	}
+
+	if move {
+		err = couchbase.Update(k, 0, func(in []byte) ([]byte, error) {
+			existing := fileMeta{}
+			err := json.Unmarshal(in, &existing)
+			if err != nil || existing.OID != got.OID {
+				return in, errSourceChanged
+			}
+			if err := checkRetention(src, existing, time.Now()); err != nil {
+				return in, err
+			}
+			return nil, nil
+		})
+		if err != nil && !gomemcached.IsNotFound(err) {
+			log.Printf("Error removing %v after move to %v: %v",
+				src, dest, err)
+			http.Error(w, fmt.Sprintf("Copied, but couldn't remove %v: %v",
+				src, err), 500)
+			return
+		}
+		if err == nil {
+			duFileChanged(src, got, fileMeta{})
+			notifyObject("deleted", src, got)
+		}
+		log.Printf("Moved %v -> %v (%v)", src, dest, fm.OID)
+	} else {
+		log.Printf("Copied %v -> %v (%v)", src, dest, fm.OID)
+	}
+
+	w.WriteHeader(201)
+}
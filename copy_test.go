@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCopyDestination(t *testing.T) {
+	tests := []struct {
+		in  string
+		exp string
+		ok  bool
+	}{
+		{"/a/b", "a/b", true},
+		{"http://cbfs:8484/a/b%20c", "a/b c", true},
+		{"", "", false},
+		{"/", "", false},
+		{"/a/", "", false},
+		{"/a//b", "", false},
+		{"/.cbfs/blob/x", "", false},
+	}
+
+	for _, test := range tests {
+		req := &http.Request{Header: http.Header{}}
+		req.Header.Set("Destination", test.in)
+		got, err := copyDestination(req)
+		if (err == nil) != test.ok || got != test.exp {
+			t.Errorf("Expected %q (ok=%v) for %q, got %q (%v)",
+				test.exp, test.ok, test.in, got, err)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+var keyCommand = flag.String("keyCommand", "",
+	"Command printing base64 blob encryption keys, one per line")
+
+// Encrypted blobs begin with a header of the magic, the fingerprint
+// of the key, and a random nonce prefix.  The plaintext follows in
+// chunks sealed independently, so reads can seek.  Each chunk's nonce
+// is the prefix followed by its index, and the last chunk is marked
+// in its additional data so truncation is detected.
+const (
+	encMagic     = "CBFSAES1"
+	encFPLen     = 8
+	encPrefixLen = 8
+	encHeaderLen = len(encMagic) + encFPLen + encPrefixLen
+	encChunkSize = 64 * 1024
+	encTagSize   = 16
+)
+
+var errEncTruncated = errors.New("encrypted blob is truncated")
+
+type blobKey struct {
+	fp   [encFPLen]byte
+	aead cipher.AEAD
+}
+
+func parseBlobKey(s string) (*blobKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	rv := &blobKey{aead: aead}
+	sum := sha256.Sum256(raw)
+	copy(rv.fp[:], sum[:])
+	return rv, nil
+}
+
+var keyCommandOutput struct {
+	once sync.Once
+	keys []string
+}
+
+// Run the key command once; its keys take precedence over the
+// cluster config.
+func commandKeys() []string {
+	k := &keyCommandOutput
+	k.once.Do(func() {
+		if *keyCommand == "" {
+			return
+		}
+		out, err := exec.Command("/bin/sh", "-c", *keyCommand).Output()
+		if err != nil {
+			log.Fatalf("Error running key command: %v", err)
+		}
+		s := bufio.NewScanner(bytes.NewReader(out))
+		for s.Scan() {
+			if l := strings.TrimSpace(s.Text()); l != "" {
+				k.keys = append(k.keys, l)
+			}
+		}
+	})
+	return k.keys
+}
+
+var keyCache = struct {
+	sync.Mutex
+	m map[string]*blobKey
+}{m: map[string]*blobKey{}}
+
+// All known blob keys, the one to encrypt with first.
+func blobKeys() []*blobKey {
+	srcs := append(append([]string{}, commandKeys()...),
+		globalConfig.EncryptionKeys...)
+
+	keyCache.Lock()
+	defer keyCache.Unlock()
+	var rv []*blobKey
+	for _, s := range srcs {
+		k, ok := keyCache.m[s]
+		if !ok {
+			var err error
+			k, err = parseBlobKey(s)
+			if err != nil {
+				log.Printf("Ignoring invalid encryption key: %v", err)
+			}
+			keyCache.m[s] = k
+		}
+		if k != nil {
+			rv = append(rv, k)
+		}
+	}
+	return rv
+}
+
+func currentBlobKey() *blobKey {
+	if keys := blobKeys(); len(keys) > 0 {
+		return keys[0]
+	}
+	return nil
+}
+
+func findBlobKey(fp []byte) *blobKey {
+	for _, k := range blobKeys() {
+		if bytes.Equal(k.fp[:], fp) {
+			return k
+		}
+	}
+	return nil
+}
+
+func chunkNonce(prefix []byte, i int64) []byte {
+	nonce := make([]byte, encPrefixLen+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encPrefixLen:], uint32(i))
+	return nonce
+}
+
+func chunkAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// Size of the plaintext of an encrypted blob of the given size.
+func encPlainSize(size int64) (int64, error) {
+	body := size - int64(encHeaderLen)
+	if body < encTagSize {
+		return 0, errEncTruncated
+	}
+	full := body / (encChunkSize + encTagSize)
+	return body - encTagSize*(full+1), nil
+}
+
+type encryptingWriter struct {
+	w      io.Writer
+	key    *blobKey
+	prefix []byte
+	buf    []byte
+	n      int64
+}
+
+func newEncryptingWriter(w io.Writer, key *blobKey) (*encryptingWriter, error) {
+	prefix := make([]byte, encPrefixLen)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	hdr := append(append([]byte(encMagic), key.fp[:]...), prefix...)
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+	return &encryptingWriter{w: w, key: key, prefix: prefix,
+		buf: make([]byte, 0, encChunkSize)}, nil
+}
+
+func (e *encryptingWriter) seal(last bool) error {
+	out := e.key.aead.Seal(nil, chunkNonce(e.prefix, e.n), e.buf, chunkAD(last))
+	e.n++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(out)
+	return err
+}
+
+func (e *encryptingWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data arrives, so
+		// the last one is always known at Close.
+		if len(e.buf) == encChunkSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):encChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Write the final chunk.  Doesn't close the underlying writer.
+func (e *encryptingWriter) Close() error {
+	if len(e.buf) == encChunkSize {
+		if err := e.seal(false); err != nil {
+			return err
+		}
+	}
+	return e.seal(true)
+}
+
+type decryptingReader struct {
+	f      *os.File
+	key    *blobKey
+	prefix []byte
+	size   int64
+	pos    int64
+	chunk  int64
+	plain  []byte
+}
+
+func (d *decryptingReader) load(i int64) error {
+	if d.plain != nil && d.chunk == i {
+		return nil
+	}
+	lastChunk := d.size / encChunkSize
+	off := int64(encHeaderLen) + i*(encChunkSize+encTagSize)
+	l := int64(encChunkSize + encTagSize)
+	if i == lastChunk {
+		l = d.size - i*encChunkSize + encTagSize
+	}
+	sealed := make([]byte, l)
+	if _, err := d.f.ReadAt(sealed, off); err != nil {
+		return err
+	}
+	plain, err := d.key.aead.Open(sealed[:0], chunkNonce(d.prefix, i),
+		sealed, chunkAD(i == lastChunk))
+	if err != nil {
+		return fmt.Errorf("error decrypting chunk %v: %v", i, err)
+	}
+	d.chunk, d.plain = i, plain
+	return nil
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	if d.pos >= d.size {
+		return 0, io.EOF
+	}
+	i := d.pos / encChunkSize
+	if err := d.load(i); err != nil {
+		return 0, err
+	}
+	n := copy(p, d.plain[d.pos-i*encChunkSize:])
+	d.pos += int64(n)
+	return n, nil
+}
+
+func (d *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case os.SEEK_CUR:
+		offset += d.pos
+	case os.SEEK_END:
+		offset += d.size
+	}
+	if offset < 0 {
+		return d.pos, errors.New("negative position")
+	}
+	d.pos = offset
+	return offset, nil
+}
+
+func (d *decryptingReader) Close() error {
+	return d.f.Close()
+}
+
+// If f holds a blob encrypted with a known key, wrap it in a reader
+// of the plaintext.  Anything else is treated as a plain blob.
+func maybeDecrypt(f *os.File) (ReadSeekCloser, error) {
+	hdr := make([]byte, encHeaderLen)
+	n, _ := f.ReadAt(hdr, 0)
+	if n < encHeaderLen || string(hdr[:len(encMagic)]) != encMagic {
+		return f, nil
+	}
+	key := findBlobKey(hdr[len(encMagic) : len(encMagic)+encFPLen])
+	if key == nil {
+		return f, nil
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size, err := encPlainSize(st.Size())
+	if err != nil {
+		return nil, err
+	}
+	return &decryptingReader{
+		f:      f,
+		key:    key,
+		prefix: hdr[len(encMagic)+encFPLen:],
+		size:   size,
+	}, nil
+}
+
+// Size of the content of a local blob file, which may be smaller than
+// the file itself if it's encrypted.
+func blobContentSize(fn string, fi os.FileInfo) int64 {
+	if len(blobKeys()) == 0 {
+		return fi.Size()
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return fi.Size()
+	}
+	defer f.Close()
+	r, err := maybeDecrypt(f)
+	if err != nil {
+		return fi.Size()
+	}
+	size, err := r.Seek(0, os.SEEK_END)
+	if err != nil {
+		return fi.Size()
+	}
+	return size
+}
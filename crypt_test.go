@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+const testBlobKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+func writeEncrypted(t *testing.T, data []byte) *os.File {
+	key, err := parseBlobKey(testBlobKey)
+	if err != nil {
+		t.Fatalf("Error parsing key: %v", err)
+	}
+	f, err := ioutil.TempFile("", "crypttest")
+	if err != nil {
+		t.Fatalf("Error creating temp file: %v", err)
+	}
+	os.Remove(f.Name())
+
+	e, err := newEncryptingWriter(f, key)
+	if err != nil {
+		t.Fatalf("Error starting encryption: %v", err)
+	}
+	// Odd sized writes to exercise chunk boundaries.
+	for b := data; len(b) > 0; {
+		n := 1000
+		if n > len(b) {
+			n = len(b)
+		}
+		if _, err := e.Write(b[:n]); err != nil {
+			t.Fatalf("Error writing: %v", err)
+		}
+		b = b[n:]
+	}
+	if err := e.Close(); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+	return f
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	defer func(k []string) { globalConfig.EncryptionKeys = k }(globalConfig.EncryptionKeys)
+	globalConfig.EncryptionKeys = []string{testBlobKey}
+
+	data := make([]byte, 3*encChunkSize+17)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	sizes := []int{0, 1, encChunkSize - 1, encChunkSize, encChunkSize + 1,
+		2 * encChunkSize, len(data)}
+	for _, size := range sizes {
+		f := writeEncrypted(t, data[:size])
+		defer f.Close()
+
+		st, err := f.Stat()
+		if err != nil {
+			t.Fatalf("Error statting: %v", err)
+		}
+		if ps, err := encPlainSize(st.Size()); err != nil || ps != int64(size) {
+			t.Errorf("Expected plain size %v, got %v (%v)", size, ps, err)
+		}
+
+		r, err := maybeDecrypt(f)
+		if err != nil {
+			t.Fatalf("Error opening %v bytes: %v", size, err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(got, data[:size]) {
+			t.Errorf("Round trip of %v bytes failed: got %v bytes (%v)",
+				size, len(got), err)
+		}
+
+		if size < 10 {
+			continue
+		}
+		off := int64(size - 10)
+		if _, err := r.Seek(off, os.SEEK_SET); err != nil {
+			t.Fatalf("Error seeking: %v", err)
+		}
+		got, err = ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(got, data[off:size]) {
+			t.Errorf("Expected %v bytes after seeking in %v, got %v (%v)",
+				size-int(off), size, len(got), err)
+		}
+	}
+}
+
+func TestEncryptionTamper(t *testing.T) {
+	defer func(k []string) { globalConfig.EncryptionKeys = k }(globalConfig.EncryptionKeys)
+	globalConfig.EncryptionKeys = []string{testBlobKey}
+
+	data := bytes.Repeat([]byte("x"), 2*encChunkSize)
+
+	f := writeEncrypted(t, data)
+	defer f.Close()
+	st, _ := f.Stat()
+	// Dropping the last chunk leaves a valid looking file.
+	f.Truncate(st.Size() - encTagSize)
+
+	r, err := maybeDecrypt(f)
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, r)
+	}
+	if err == nil {
+		t.Errorf("Expected an error reading a truncated blob")
+	}
+
+	f2 := writeEncrypted(t, data)
+	defer f2.Close()
+	f2.WriteAt([]byte{'!'}, int64(encHeaderLen+5))
+	r, err = maybeDecrypt(f2)
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, r)
+	}
+	if err == nil {
+		t.Errorf("Expected an error reading a modified blob")
+	}
+}
+
+func TestPlainBlobPassthrough(t *testing.T) {
+	f, err := ioutil.TempFile("", "crypttest")
+	if err != nil {
+		t.Fatalf("Error creating temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	f.Write([]byte(encMagic + "but not really encrypted"))
+
+	r, err := maybeDecrypt(f)
+	if err != nil || r != f {
+		t.Errorf("Expected plain file back, got %v (%v)", r, err)
+	}
+}
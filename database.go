@@ -12,7 +12,7 @@ import (
 var couchbase *cb.Bucket
 
 const ddocKey = "/@ddocVersion"
-const ddocVersion = 3
+const ddocVersion = 17
 const designDoc = `
 {
     "spatialInfos": [],
@@ -60,13 +60,39 @@ const designDoc = `
         }
     ],
     "views": {
+        "blob_access": {
+            "map": "function (doc, meta) {\n  if (doc.type === \"blob\" && !doc.garbage && !doc.ec && !doc.shard) {\n    var t = doc.referenced || \"\";\n    if (doc.accessed && doc.accessed > t) {\n      t = doc.accessed;\n    }\n    for (var n in doc.nodes) {\n      if (doc.nodes[n] > t) {\n        t = doc.nodes[n];\n      }\n    }\n    emit(t, null);\n  }\n}"
+        },
+        "blob_hashes": {
+            "map": "function (doc, meta) {\n  if (doc.type === \"blob\" && !doc.garbage && !doc.ec && !doc.shard) {\n    emit(doc.hash || \"\", doc.length);\n  }\n}"
+        },
+        "blob_refs": {
+            "map": "function (doc, meta) {\n  if (doc.type === \"file\") {\n    if (doc.parts && doc.parts.length) {\n      for (var i = 0; i < doc.parts.length; i++) {\n        emit(doc.parts[i].oid, doc.parts[i].length);\n      }\n    } else {\n      emit(doc.oid, doc.length);\n    }\n  }\n}",
+            "reduce": "_stats"
+        },
+        "dir_blobs": {
+            "map": "function (doc, meta) {\n  if (doc.type === \"file\") {\n    var blobs = doc.parts && doc.parts.length ? doc.parts : [{oid: doc.oid, length: doc.length}];\n    var segs = (doc.name ? doc.name : meta.id).split(\"/\");\n    for (var i = 0; i < segs.length; i++) {\n      var dir = segs.slice(0, i).join(\"/\");\n      for (var j = 0; j < blobs.length; j++) {\n        emit([dir, blobs[j].oid], blobs[j].length);\n      }\n    }\n  }\n}",
+            "reduce": "_stats"
+        },
+        "erasure_candidates": {
+            "map": "function (doc, meta) {\n  if (doc.type === \"blob\" && !doc.garbage && !doc.ec && !doc.shard) {\n    emit(doc.length, null);\n  }\n}"
+        },
+        "erasure_sets": {
+            "map": "function (doc, meta) {\n  if (doc.type === \"blob\" && doc.ec) {\n    emit(doc.oid, null);\n  }\n}"
+        },
         "file_blobs": {
-            "map": "function (doc, meta) {\n  if (doc.type === \"file\") {\n    var toEmit = {};\n    toEmit[doc.oid] = doc.name ? doc.name : meta.id;\n    if (doc.older) {\n      for (var i = 0; i < doc.older.length; i++) {\n        toEmit[doc.older[i].oid] = doc.name ? doc.name : meta.id;\n      }\n    }\n    for (var k in toEmit) {\n      emit([k, \"file\", doc.name ? doc.name : meta.id], null);\n    }\n  } else if (doc.type === \"blob\") {\n    var replicas=0;\n    for (var node in doc.nodes) {\n      replicas++;\n      emit([doc.oid, \"blob\", node], null);\n    }\n    if (replicas === 0) {\n      emit([doc.oid, \"blob\", \"\"], null);\n    }\n  }\n}"
+            "map": "function (doc, meta) {\n  if (doc.type === \"file\" || doc.type === \"trash\") {\n    var f = doc.type === \"trash\" ? doc.meta : doc;\n    var toEmit = {};\n    var addParts = function(parts) {\n      for (var j = 0; parts && j < parts.length; j++) {\n        toEmit[parts[j].oid] = true;\n      }\n    };\n    toEmit[f.oid] = true;\n    addParts(f.parts);\n    if (f.older) {\n      for (var i = 0; i < f.older.length; i++) {\n        toEmit[f.older[i].oid] = true;\n        addParts(f.older[i].parts);\n      }\n    }\n    for (var k in toEmit) {\n      emit([k, \"file\", doc.name ? doc.name : meta.id], null);\n    }\n  } else if (doc.type === \"multipart\") {\n    for (var n in doc.parts) {\n      emit([doc.parts[n].oid, \"file\", meta.id], null);\n    }\n  } else if (doc.type === \"blob\") {\n    var replicas=0;\n    for (var node in doc.nodes) {\n      replicas++;\n      emit([doc.oid, \"blob\", node], doc.length);\n    }\n    if (replicas === 0) {\n      emit([doc.oid, \"blob\", \"\"], doc.length);\n    }\n    if (doc.ec) {\n      for (var s = 0; s < doc.ec.shards.length; s++) {\n        emit([doc.ec.shards[s], \"file\", meta.id], null);\n      }\n    }\n  }\n}"
         },
         "file_browse": {
             "map": "function (doc, meta) {\n  if(doc.type == \"file\") {  \n    var idarr = (doc.name ? doc.name : meta.id).split(\"/\");\n    emit(idarr, doc.length);\n  }\n}",
             "reduce": "_stats"
         },
+        "file_expirations": {
+            "map": "function (doc, meta) {\n  if (doc.type === \"file\" && doc.expires) {\n    emit(doc.retainUntil > doc.expires ? doc.retainUntil : doc.expires, null);\n  }\n}"
+        },
+        "file_meta": {
+            "map": "function (doc, meta) {\n  if (doc.type === \"file\" && doc.headers) {\n    for (var h in doc.headers) {\n      var l = h.toLowerCase();\n      if (l.indexOf(\"x-cbfs-meta-\") === 0) {\n        for (var i = 0; i < doc.headers[h].length; i++) {\n          emit([l.substring(12), doc.headers[h][i]], doc.name ? doc.name : meta.id);\n        }\n      }\n    }\n  }\n}"
+        },
         "garbage": {
             "map": "function (doc, meta) {\n  if (doc.type === 'blob') {\n    emit(doc.garbage ? 'garbage' : 'live', doc.length);\n  }\n}",
             "reduce": "_stats"
@@ -79,9 +105,19 @@ const designDoc = `
             "map": "function (doc, meta) {\n  if (doc.type === \"node\") {\n    emit(meta.id.substring(1), 0);\n  } else if (doc.type === \"blob\") {\n    for (var n in doc.nodes) {\n      emit(n, doc.length);\n    }\n  }\n}",
             "reduce": "_sum"
         },
+        "pinned_blobs": {
+            "map": "function (doc, meta) {\n  if (doc.type === \"blob\" && !doc.garbage && doc.pinned && doc.pinned.length) {\n    var nreps = 0;\n    for (var x in doc.nodes) {\n      nreps++;\n    }\n    emit(nreps, null);\n  }\n}"
+        },
         "repcounts": {
-            "map": "function (doc, meta) {\n  if (doc.type === \"blob\" && !doc.garbage) {\n    var nreps = 0;\n    for (var x in doc.nodes) {\n      nreps++;\n    }\n    emit(nreps, null);\n  }\n}",
+            "map": "function (doc, meta) {\n  if (doc.type === \"blob\" && !doc.garbage && !doc.ec && !doc.shard && !doc.replicas) {\n    var nreps = 0;\n    for (var x in doc.nodes) {\n      nreps++;\n    }\n    emit(nreps, null);\n  }\n}",
             "reduce": "_count"
+        },
+        "replica_policy": {
+            "map": "function (doc, meta) {\n  if (doc.type === \"blob\" && !doc.garbage && !doc.ec && !doc.shard && doc.replicas) {\n    var nreps = 0;\n    for (var x in doc.nodes) {\n      nreps++;\n    }\n    emit(doc.replicas - nreps, nreps);\n  }\n}",
+            "reduce": "_count"
+        },
+        "trash": {
+            "map": "function (doc, meta) {\n  if (doc.type === \"trash\") {\n    emit(doc.path, doc.meta.length);\n  }\n}"
         }
     }
 }
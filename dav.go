@@ -0,0 +1,657 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/couchbase/gomemcached"
+)
+
+var davBind = flag.String("davbind", "",
+	"Address to serve WebDAV on (empty to disable)")
+
+const (
+	davLockTimeout = "Second-3600"
+	davAllow       = "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, PROPPATCH, " +
+		"MKCOL, COPY, MOVE, LOCK, UNLOCK"
+)
+
+// Serve the cbfs namespace over WebDAV so it can be mounted as a
+// network drive.  Directories only exist while something's in them,
+// so a MKCOL is only remembered by the node that served it until a
+// file is stored there.  Locks are not enforced; every LOCK succeeds
+// so clients that insist on locking can still write.
+func serveDAV() {
+	if *davBind == "" {
+		return
+	}
+
+	s := &http.Server{
+		Addr:        *davBind,
+		Handler:     http2Handler(instrumentHandler(doDAV)),
+		ReadTimeout: *readTimeout,
+	}
+	log.Printf("Listening to WebDAV requests on %s", *davBind)
+
+	l, err := rateListen("tcp", *davBind)
+	if err != nil {
+		log.Fatalf("Error listening for WebDAV requests: %v", err)
+	}
+	serveUntilShutdown(s, maybeTLSListener(l))
+}
+
+// Empty collections made on this node.
+var davDirs = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: map[string]bool{}}
+
+func davDirMade(p string) bool {
+	davDirs.Lock()
+	defer davDirs.Unlock()
+	return davDirs.m[p]
+}
+
+func davMakeDir(p string) {
+	davDirs.Lock()
+	defer davDirs.Unlock()
+	davDirs.m[p] = true
+}
+
+// Forget collections at or under p.
+func davForgetDirs(p string) {
+	davDirs.Lock()
+	defer davDirs.Unlock()
+	for d := range davDirs.m {
+		if d == p || strings.HasPrefix(d, p+"/") {
+			delete(davDirs.m, d)
+		}
+	}
+}
+
+// Collections containing p need no longer be remembered once it's
+// stored.
+func davFilled(p string) {
+	davDirs.Lock()
+	defer davDirs.Unlock()
+	for i := strings.LastIndex(p, "/"); i > 0; i = strings.LastIndex(p, "/") {
+		p = p[:i]
+		delete(davDirs.m, p)
+	}
+}
+
+// Remembered collections directly within p.
+func davMadeChildren(p string) []string {
+	davDirs.Lock()
+	defer davDirs.Unlock()
+	rv := []string{}
+	for d := range davDirs.m {
+		rest := d
+		if p != "" {
+			if !strings.HasPrefix(d, p+"/") {
+				continue
+			}
+			rest = d[len(p)+1:]
+		}
+		if rest != "" && !strings.Contains(rest, "/") {
+			rv = append(rv, rest)
+		}
+	}
+	return rv
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection"`
+}
+
+type davProp struct {
+	DisplayName   string           `xml:"D:displayname,omitempty"`
+	ResourceType  *davResourceType `xml:"D:resourcetype"`
+	ContentLength string           `xml:"D:getcontentlength,omitempty"`
+	ContentType   string           `xml:"D:getcontenttype,omitempty"`
+	LastModified  string           `xml:"D:getlastmodified,omitempty"`
+	ETag          string           `xml:"D:getetag,omitempty"`
+	Extra         string           `xml:",innerxml"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davResponse struct {
+	Href     string        `xml:"D:href"`
+	Propstat []davPropstat `xml:"D:propstat"`
+}
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	Xmlns     string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+const davSupportedLock = "<D:supportedlock><D:lockentry>" +
+	"<D:lockscope><D:exclusive/></D:lockscope>" +
+	"<D:locktype><D:write/></D:locktype>" +
+	"</D:lockentry></D:supportedlock>"
+
+func davStatus(code int) string {
+	return fmt.Sprintf("HTTP/1.1 %d %s", code, http.StatusText(code))
+}
+
+func davHref(p string, dir bool) string {
+	h := (&url.URL{Path: "/" + p}).EscapedPath()
+	if dir && !strings.HasSuffix(h, "/") {
+		h += "/"
+	}
+	return h
+}
+
+func davBaseName(p string) string {
+	return p[strings.LastIndex(p, "/")+1:]
+}
+
+func davFileResponse(p string, fm fileMeta) davResponse {
+	return davResponse{
+		Href: davHref(p, false),
+		Propstat: []davPropstat{{
+			Prop: davProp{
+				DisplayName:   davBaseName(p),
+				ResourceType:  &davResourceType{},
+				ContentLength: fmt.Sprint(fm.Length),
+				ContentType:   fm.Headers.Get("Content-Type"),
+				LastModified:  fm.Modified.UTC().Format(http.TimeFormat),
+				ETag:          fileETag(fm.OID),
+				Extra:         davSupportedLock,
+			},
+			Status: davStatus(200),
+		}},
+	}
+}
+
+func davDirResponse(p string) davResponse {
+	return davResponse{
+		Href: davHref(p, true),
+		Propstat: []davPropstat{{
+			Prop: davProp{
+				DisplayName:  davBaseName(p),
+				ResourceType: &davResourceType{&struct{}{}},
+				Extra:        davSupportedLock,
+			},
+			Status: davStatus(200),
+		}},
+	}
+}
+
+func sendDAVXML(w http.ResponseWriter, code int, ob interface{}) {
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(code)
+	io.WriteString(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(ob); err != nil {
+		log.Printf("Error encoding XML output: %v", err)
+	}
+}
+
+// Authorize req as if it were the given method on the same path.
+func davAllowed(w http.ResponseWriter, req *http.Request, method string) bool {
+	r := *req
+	r.Method = method
+	if !checkAuth(w, &r) {
+		return false
+	}
+	if why := blobRefusal(); why != "" && storesBlob(&r) {
+		http.Error(w, why, 503)
+		return false
+	}
+	return true
+}
+
+// Look up the file at p, if there is one.
+func davFile(p string) (fileMeta, bool, error) {
+	fm := fileMeta{}
+	if p == "" {
+		return fm, false, nil
+	}
+	err := couchbase.Get(shortName(p), &fm)
+	switch {
+	case err == nil:
+		return fm, true, nil
+	case gomemcached.IsNotFound(err):
+		return fm, false, nil
+	}
+	return fm, false, err
+}
+
+func doDAV(w http.ResponseWriter, req *http.Request) {
+	p := strings.Trim(req.URL.Path, "/")
+	if strings.HasPrefix(p+"/", ".cbfs/") {
+		http.Error(w, "not found", 404)
+		return
+	}
+
+	switch req.Method {
+	case "OPTIONS":
+		w.Header().Set("DAV", "1, 2")
+		w.Header().Set("MS-Author-Via", "DAV")
+		w.Header().Set("Allow", davAllow)
+		w.WriteHeader(200)
+	case "PROPFIND":
+		if davAllowed(w, req, "GET") {
+			davPropfind(w, req, p)
+		}
+	case "PROPPATCH":
+		if davAllowed(w, req, "PUT") {
+			davProppatch(w, req, p)
+		}
+	case "MKCOL":
+		if davAllowed(w, req, "PUT") {
+			davMkcol(w, req, p)
+		}
+	case "LOCK":
+		if davAllowed(w, req, "PUT") {
+			davLock(w, req, p)
+		}
+	case "UNLOCK":
+		if davAllowed(w, req, "PUT") {
+			w.WriteHeader(204)
+		}
+	case "GET", "HEAD", "PUT":
+		if !davAllowed(w, req, req.Method) {
+			return
+		}
+		switch req.Method {
+		case "GET":
+			doGetUserDoc(w, req)
+		case "HEAD":
+			doHeadUserFile(w, req)
+		case "PUT":
+			putUserFile(w, req)
+			davFilled(p)
+		}
+	case "DELETE":
+		if davAllowed(w, req, req.Method) {
+			davDelete(w, req, p)
+		}
+	case "COPY", "MOVE":
+		// Collection destinations end in a slash, which regular
+		// copies don't allow.
+		d := req.Header.Get("Destination")
+		if strings.HasSuffix(d, "/") {
+			req.Header.Set("Destination", strings.TrimRight(d, "/"))
+		}
+		if davAllowed(w, req, req.Method) {
+			davCopy(w, req, p, req.Method == "MOVE")
+		}
+	default:
+		w.Header().Set("Allow", davAllow)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func davPropfind(w http.ResponseWriter, req *http.Request, p string) {
+	fm, isFile, err := davFile(p)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if isFile {
+		sendDAVXML(w, 207, davMultistatus{Xmlns: "DAV:",
+			Responses: []davResponse{davFileResponse(p, fm)}})
+		return
+	}
+
+	fl, err := listFiles(p, true, 1)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	made := davMadeChildren(p)
+	if p != "" && len(fl.Files) == 0 && len(fl.Dirs) == 0 &&
+		len(made) == 0 && !davDirMade(p) {
+		http.Error(w, "not found", 404)
+		return
+	}
+
+	ms := davMultistatus{Xmlns: "DAV:",
+		Responses: []davResponse{davDirResponse(p)}}
+
+	// Depth infinity is treated as 1, which is all clients ask
+	// for in practice.
+	if req.Header.Get("Depth") != "0" {
+		prefix := ""
+		if p != "" {
+			prefix = p + "/"
+		}
+
+		dirs := map[string]bool{}
+		for d := range fl.Dirs {
+			dirs[d] = true
+		}
+		for _, d := range made {
+			dirs[d] = true
+		}
+		names := []string{}
+		for d := range dirs {
+			names = append(names, d)
+		}
+		sort.Strings(names)
+		for _, d := range names {
+			ms.Responses = append(ms.Responses, davDirResponse(prefix+d))
+		}
+
+		names = names[:0]
+		for f := range fl.Files {
+			names = append(names, f)
+		}
+		sort.Strings(names)
+		for _, f := range names {
+			fm := fileMeta{}
+			rm, _ := fl.Files[f].(*json.RawMessage)
+			if rm == nil {
+				continue
+			}
+			if err := json.Unmarshal(*rm, &fm); err != nil {
+				log.Printf("Error reading metadata of %v%v: %v",
+					prefix, f, err)
+				continue
+			}
+			ms.Responses = append(ms.Responses, davFileResponse(prefix+f, fm))
+		}
+	}
+
+	sendDAVXML(w, 207, ms)
+}
+
+type davPropNames struct {
+	Props []struct {
+		XMLName xml.Name
+	} `xml:",any"`
+}
+
+// Dead properties aren't stored, but clients (Windows in particular)
+// expect setting them to work, so report every change as made.
+func davProppatch(w http.ResponseWriter, req *http.Request, p string) {
+	_, isFile, err := davFile(p)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	update := struct {
+		Set    []davPropNames `xml:"set>prop"`
+		Remove []davPropNames `xml:"remove>prop"`
+	}{}
+	if err := xml.NewDecoder(req.Body).Decode(&update); err != nil {
+		http.Error(w, "Error parsing request: "+err.Error(), 400)
+		return
+	}
+
+	extra := ""
+	for _, pn := range append(update.Set, update.Remove...) {
+		for _, prop := range pn.Props {
+			name, ns := &bytes.Buffer{}, &bytes.Buffer{}
+			xml.EscapeText(name, []byte(prop.XMLName.Local))
+			xml.EscapeText(ns, []byte(prop.XMLName.Space))
+			extra += fmt.Sprintf(`<x:%s xmlns:x="%s"/>`, name.String(),
+				ns.String())
+		}
+	}
+
+	sendDAVXML(w, 207, davMultistatus{Xmlns: "DAV:",
+		Responses: []davResponse{{
+			Href: davHref(p, !isFile),
+			Propstat: []davPropstat{{
+				Prop:   davProp{Extra: extra},
+				Status: davStatus(200),
+			}},
+		}}})
+}
+
+func davMkcol(w http.ResponseWriter, req *http.Request, p string) {
+	if req.ContentLength > 0 {
+		http.Error(w, "MKCOL bodies are not supported", 415)
+		return
+	}
+	if p == "" {
+		http.Error(w, "already exists", 405)
+		return
+	}
+	_, isFile, err := davFile(p)
+	switch {
+	case err != nil:
+		http.Error(w, err.Error(), 500)
+		return
+	case isFile:
+		http.Error(w, "a file exists there", 405)
+		return
+	}
+	davMakeDir(p)
+	w.WriteHeader(201)
+}
+
+func newDAVLockToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("opaquelocktoken:%x-%x-%x-%x-%x",
+		b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// The lock token named in an If header, for lock refreshes.
+func davIfToken(h string) string {
+	i := strings.Index(h, "<opaquelocktoken:")
+	if i < 0 {
+		return ""
+	}
+	j := strings.IndexByte(h[i:], '>')
+	if j < 0 {
+		return ""
+	}
+	return h[i+1 : i+j]
+}
+
+func davLock(w http.ResponseWriter, req *http.Request, p string) {
+	info := struct {
+		Owner struct {
+			Inner string `xml:",innerxml"`
+		} `xml:"owner"`
+	}{}
+	token := davIfToken(req.Header.Get("If"))
+	if token == "" {
+		if err := xml.NewDecoder(req.Body).Decode(&info); err != nil &&
+			err != io.EOF {
+			http.Error(w, "Error parsing request: "+err.Error(), 400)
+			return
+		}
+		var err error
+		if token, err = newDAVLockToken(); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+
+	depth := "infinity"
+	if req.Header.Get("Depth") == "0" {
+		depth = "0"
+	}
+	href := &bytes.Buffer{}
+	xml.EscapeText(href, []byte(davHref(p, false)))
+
+	w.Header().Set("Lock-Token", "<"+token+">")
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(200)
+	io.WriteString(w, xml.Header)
+	fmt.Fprintf(w, `<D:prop xmlns:D="DAV:"><D:lockdiscovery><D:activelock>`+
+		`<D:locktype><D:write/></D:locktype>`+
+		`<D:lockscope><D:exclusive/></D:lockscope>`+
+		`<D:depth>%s</D:depth><D:owner>%s</D:owner>`+
+		`<D:timeout>%s</D:timeout>`+
+		`<D:locktoken><D:href>%s</D:href></D:locktoken>`+
+		`<D:lockroot><D:href>%s</D:href></D:lockroot>`+
+		`</D:activelock></D:lockdiscovery></D:prop>`,
+		depth, info.Owner.Inner, davLockTimeout, token, href.String())
+}
+
+// Run f on every file under the collection p, stopping at the first
+// error.
+func davEachFile(p string, f func(name string) error) error {
+	quit := make(chan bool)
+	defer close(quit)
+	ch := make(chan *namedFile)
+	cherr := make(chan error)
+
+	go pathGenerator(p+"/", ch, cherr, quit)
+
+	var err error
+	for ch != nil || cherr != nil {
+		select {
+		case nf, ok := <-ch:
+			switch {
+			case !ok:
+				ch = nil
+			case err != nil:
+			case nf.err != nil:
+				if !gomemcached.IsNotFound(nf.err) {
+					err = nf.err
+				}
+			default:
+				err = f(nf.name)
+			}
+		case e, ok := <-cherr:
+			if !ok {
+				cherr = nil
+			} else if err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+func davDelete(w http.ResponseWriter, req *http.Request, p string) {
+	_, isFile, err := davFile(p)
+	switch {
+	case err != nil:
+		http.Error(w, err.Error(), 500)
+		return
+	case isFile:
+		doDeleteUserDoc(w, req)
+		return
+	case p == "":
+		http.Error(w, "can't delete the root", 403)
+		return
+	}
+
+	n := 0
+	err = davEachFile(p, func(name string) error {
+		_, err := deleteFile(shortName(name))
+		if err == nil || gomemcached.IsNotFound(err) {
+			n++
+			return nil
+		}
+		return err
+	})
+	if httpRetentionError(w, p, err) {
+		return
+	}
+	if err != nil {
+		log.Printf("Error deleting %v: %v", p, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	made := davDirMade(p)
+	davForgetDirs(p)
+	if n == 0 && !made {
+		http.Error(w, "not found", 404)
+		return
+	}
+	log.Printf("Deleted %v files under %v", n, p)
+	w.WriteHeader(204)
+}
+
+func davCopy(w http.ResponseWriter, req *http.Request, p string, move bool) {
+	_, isFile, err := davFile(p)
+	switch {
+	case err != nil:
+		http.Error(w, err.Error(), 500)
+		return
+	case isFile:
+		doCopyUserDoc(w, req, move)
+		return
+	case p == "":
+		http.Error(w, "can't copy the root", 403)
+		return
+	}
+
+	dest, err := copyDestination(req)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if dest == p || strings.HasPrefix(dest, p+"/") {
+		http.Error(w, "can't copy a collection into itself", 403)
+		return
+	}
+
+	// Copy each file with the regular handler, so each one gets the
+	// same treatment (preconditions, revisions, etc) as a single
+	// file COPY or MOVE would.
+	n := 0
+	err = davEachFile(p, func(name string) error {
+		r := *req
+		u := *req.URL
+		u.Path = "/" + name
+		r.URL = &u
+		r.Header = http.Header{}
+		for k, v := range req.Header {
+			r.Header[k] = v
+		}
+		r.Header.Set("Destination", "/"+dest+name[len(p):])
+
+		cw := &captureResponseWriter{w: ioutil.Discard, hdr: http.Header{}}
+		doCopyUserDoc(cw, &r, move)
+		switch cw.statusCode {
+		case 201, 404:
+			n++
+			return nil
+		case 412:
+			return errUploadPrecondition
+		}
+		return fmt.Errorf("error copying %v: status %v", name, cw.statusCode)
+	})
+	switch {
+	case err == errUploadPrecondition:
+		http.Error(w, "precondition failed", 412)
+		return
+	case err != nil:
+		log.Printf("Error copying %v -> %v: %v", p, dest, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	made := davDirMade(p)
+	if made {
+		davMakeDir(dest)
+	}
+	if move {
+		davForgetDirs(p)
+	}
+	if n == 0 && !made {
+		http.Error(w, "not found", 404)
+		return
+	}
+	w.WriteHeader(201)
+}
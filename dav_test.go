@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/xml"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestDAVIfToken(t *testing.T) {
+	tests := []struct {
+		in, exp string
+	}{
+		{"", ""},
+		{"(<opaquelocktoken:abc-123>)", "opaquelocktoken:abc-123"},
+		{"<http://h/x> (<opaquelocktoken:abc>)", "opaquelocktoken:abc"},
+		{"(<opaquelocktoken:abc", ""},
+		{`(["etag"])`, ""},
+	}
+
+	for _, test := range tests {
+		got := davIfToken(test.in)
+		if got != test.exp {
+			t.Errorf("Expected %q for %q, got %q", test.exp, test.in, got)
+		}
+	}
+}
+
+func TestDAVHref(t *testing.T) {
+	tests := []struct {
+		in  string
+		dir bool
+		exp string
+	}{
+		{"", true, "/"},
+		{"a/b", false, "/a/b"},
+		{"a/b", true, "/a/b/"},
+		{"a b/c?d", false, "/a%20b/c%3Fd"},
+	}
+
+	for _, test := range tests {
+		got := davHref(test.in, test.dir)
+		if got != test.exp {
+			t.Errorf("Expected %q for %q, got %q", test.exp, test.in, got)
+		}
+	}
+}
+
+func TestDAVMadeDirs(t *testing.T) {
+	defer func() { davDirs.m = map[string]bool{} }()
+	for _, d := range []string{"a", "a/b", "a/b/c", "a/d", "e"} {
+		davMakeDir(d)
+	}
+
+	tests := []struct {
+		in  string
+		exp []string
+	}{
+		{"", []string{"a", "e"}},
+		{"a", []string{"b", "d"}},
+		{"a/b", []string{"c"}},
+		{"x", []string{}},
+	}
+	for _, test := range tests {
+		got := davMadeChildren(test.in)
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("Expected %v in %q, got %v", test.exp, test.in, got)
+		}
+	}
+
+	davFilled("a/b/c/file")
+	if davDirMade("a/b") || davDirMade("a") || !davDirMade("a/d") {
+		t.Errorf("Expected only a/b/c's parents forgotten, got %v", davDirs.m)
+	}
+	davForgetDirs("a")
+	if davDirMade("a/d") || !davDirMade("e") {
+		t.Errorf("Expected only a's collections forgotten, got %v", davDirs.m)
+	}
+}
+
+func TestDAVMultistatusXML(t *testing.T) {
+	ms := davMultistatus{Xmlns: "DAV:",
+		Responses: []davResponse{davDirResponse("a/b")}}
+	b, err := xml.Marshal(ms)
+	if err != nil {
+		t.Fatalf("Error marshaling: %v", err)
+	}
+	for _, exp := range []string{`<D:multistatus xmlns:D="DAV:">`,
+		"<D:href>/a/b/</D:href>", "<D:displayname>b</D:displayname>",
+		"<D:resourcetype><D:collection></D:collection></D:resourcetype>",
+		"<D:status>HTTP/1.1 200 OK</D:status>"} {
+		if !strings.Contains(string(b), exp) {
+			t.Errorf("Expected %s in %s", exp, b)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	cb "github.com/couchbaselabs/go-couchbase"
@@ -97,8 +98,9 @@ func shortTaskName(n string) string {
 }
 
 func endedTask(named string, t time.Time) {
-	taskDurations[shortTaskName(named)].Update(
-		int64(time.Since(t) / time.Millisecond))
+	d := time.Since(t)
+	taskDurations[shortTaskName(named)].Update(int64(d / time.Millisecond))
+	recordTaskDuration(shortTaskName(named), d)
 }
 
 type rateConn struct {
@@ -108,24 +110,28 @@ type rateConn struct {
 func (r *rateConn) WriteTo(w io.Writer) (int64, error) {
 	n, err := io.Copy(w, r.c)
 	readBytes.Update(n)
+	atomic.AddUint64(&bytesIn, uint64(n))
 	return n, err
 }
 
 func (r *rateConn) Write(b []byte) (n int, err error) {
 	n, err = r.c.Write(b)
 	writeBytes.Update(int64(n))
+	atomic.AddUint64(&bytesOut, uint64(n))
 	return
 }
 
 func (r *rateConn) ReadFrom(rr io.Reader) (int64, error) {
 	n, err := io.Copy(r.c, rr)
 	writeBytes.Update(n)
+	atomic.AddUint64(&bytesOut, uint64(n))
 	return n, err
 }
 
 func (r *rateConn) Read(b []byte) (n int, err error) {
 	n, err = r.c.Read(b)
 	readBytes.Update(int64(n))
+	atomic.AddUint64(&bytesIn, uint64(n))
 	return
 }
 
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+	cb "github.com/couchbaselabs/go-couchbase"
+)
+
+var errNoSuchNode = errors.New("no such node")
+
+// Nonzero while this node is being decommissioned.
+var localDraining int32
+
+func setDraining(to bool) {
+	v := int32(0)
+	if to {
+		v = 1
+	}
+	atomic.StoreInt32(&localDraining, v)
+}
+
+func isDraining() bool {
+	return atomic.LoadInt32(&localDraining) != 0
+}
+
+// Nodes that may be given new blobs.
+func (nl NodeList) accepting() NodeList {
+	rv := make(NodeList, 0, len(nl))
+	for _, n := range nl {
+		if !n.Draining && !n.Stopping && !n.Maintenance {
+			rv = append(rv, n)
+		}
+	}
+	return rv
+}
+
+// Whether a request would store a new blob on this node.
+func storesBlob(req *http.Request) bool {
+	p := req.URL.Path
+	switch req.Method {
+	case "PUT":
+		return !strings.HasPrefix(p, "/.cbfs/") ||
+			strings.HasPrefix(p, blobPrefix) ||
+			strings.HasPrefix(p, multipartPrefix)
+	case "POST":
+		return p == blobPrefix || strings.HasPrefix(p, formUploadPrefix) ||
+			strings.HasPrefix(p, extractPrefix) ||
+			(!strings.HasPrefix(p, "/.cbfs/") &&
+				req.URL.Query().Get("append") == "true")
+	}
+	return false
+}
+
+// Change a node's record.  f returns false to leave it as it was.
+func updateNode(node string, f func(sn *StorageNode) bool) error {
+	err := couchbase.Update("/"+node, 0, func(in []byte) ([]byte, error) {
+		if len(in) == 0 {
+			return nil, errNoSuchNode
+		}
+		sn := StorageNode{}
+		if err := json.Unmarshal(in, &sn); err != nil {
+			return nil, err
+		}
+		if sn.Type != "node" {
+			return nil, errNoSuchNode
+		}
+		if !f(&sn) {
+			return nil, cb.UpdateCancel
+		}
+		return json.Marshal(sn)
+	})
+	if err == cb.UpdateCancel {
+		err = nil
+	}
+	return err
+}
+
+// Mark or unmark a node as being decommissioned.
+func setNodeDraining(node string, draining bool) error {
+	return updateNode(node, func(sn *StorageNode) bool {
+		if sn.Draining == draining {
+			return false
+		}
+		sn.Draining = draining
+		return true
+	})
+}
+
+func doDecommission(w http.ResponseWriter, req *http.Request, node string) {
+	err := setNodeDraining(node, req.Method != "DELETE")
+	switch {
+	case err == errNoSuchNode || gomemcached.IsNotFound(err):
+		http.Error(w, fmt.Sprintf("No such node: %q", node), 404)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if req.Method == "DELETE" {
+		log.Printf("Canceled decommission of %v", node)
+		w.WriteHeader(204)
+		return
+	}
+
+	log.Printf("Decommissioning %v", node)
+	if err := induceTask("drainNodes"); err != nil && err != taskAlreadyQueued {
+		log.Printf("Error starting drain of %v: %v", node, err)
+	}
+	w.WriteHeader(202)
+}
+
+// Count the blobs with fewer copies than they should have.
+func underReplicatedCount() (int, error) {
+	count := 0
+	query := func(view string, params map[string]interface{}) error {
+		viewRes := struct {
+			Rows []struct {
+				Value int
+			}
+			Errors []cb.ViewError
+		}{}
+		params["stale"] = false
+		err := couchbase.ViewCustom("cbfs", view, params, &viewRes)
+		if err == nil && len(viewRes.Errors) > 0 {
+			err = fmt.Errorf("View errors: %v", viewRes.Errors)
+		}
+		for _, r := range viewRes.Rows {
+			count += r.Value
+		}
+		return err
+	}
+
+	if globalConfig.MinReplicas > 1 {
+		err := query("repcounts", map[string]interface{}{
+			"startkey": 1,
+			"endkey":   globalConfig.MinReplicas - 1,
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	err := query("replica_policy", map[string]interface{}{"startkey": 1})
+	return count, err
+}
+
+func nodeBlobCount(node string) (int, error) {
+	viewRes := struct {
+		Rows []struct {
+			Value int
+		}
+	}{}
+	err := couchbase.ViewCustom("cbfs", "node_blobs",
+		map[string]interface{}{
+			"key":   node,
+			"stale": false,
+		}, &viewRes)
+	if err != nil || len(viewRes.Rows) == 0 {
+		return 0, err
+	}
+	return viewRes.Rows[0].Value, nil
+}
+
+// Move some of a node's blobs elsewhere, removing its copies only
+// once the rest of the cluster has enough of them.
+func drainSomeOffOf(n StorageNode, targets NodeList) error {
+	viewRes := struct {
+		Rows []struct {
+			Id  string
+			Doc struct {
+				Json struct {
+					Nodes    map[string]string
+					Garbage  bool
+					Shard    bool
+					Replicas int
+				}
+			}
+		}
+		Errors []cb.ViewError
+	}{}
+
+	err := couchbase.ViewCustom("cbfs", "node_blobs",
+		map[string]interface{}{
+			"key":          n.name,
+			"limit":        globalConfig.NodeCleanCount,
+			"reduce":       false,
+			"include_docs": true,
+			"stale":        false,
+		}, &viewRes)
+	if err != nil {
+		return err
+	}
+	if len(viewRes.Errors) > 0 {
+		return fmt.Errorf("View errors: %v", viewRes.Errors)
+	}
+
+	for _, r := range viewRes.Rows {
+		oid := r.Id[1:]
+		others := len(r.Doc.Json.Nodes) - 1
+		want := wantedReplicas(r.Doc.Json.Replicas)
+		if r.Doc.Json.Shard {
+			// Shards have one copy each, so always move them.
+			want = others + 1
+		}
+
+		switch {
+		case r.Doc.Json.Garbage:
+			removeBlobOwnershipRecord(oid, n.name)
+		case others >= want:
+			queueBlobRemoval(n, oid)
+		default:
+			// The new copies remove this one when they land.
+			if !salvageBlob(oid, n.name, want-others, targets) {
+				log.Printf("Queue is full draining %v", n)
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// Move everything off of nodes being decommissioned, and forget them
+// once they're empty and nothing is left under-replicated.
+func drainNodes() error {
+	nl, err := findAllNodes()
+	if err != nil {
+		return err
+	}
+	targets := nl.accepting()
+
+	for _, n := range nl {
+		if !n.Draining {
+			continue
+		}
+		if time.Since(n.Time) > globalConfig.StaleNodeLimit {
+			// checkStaleNodes will salvage what it had.
+			log.Printf("Not draining %v, it's not responding", n)
+			continue
+		}
+
+		remaining, err := nodeBlobCount(n.name)
+		if err != nil {
+			return err
+		}
+		if remaining > 0 {
+			setTaskDetail("drainNodes", fmt.Sprintf("%v: %v blobs remaining",
+				n.name, remaining))
+			log.Printf("Draining %v blobs from %v", remaining, n)
+			if err := drainSomeOffOf(n, targets); err != nil {
+				return err
+			}
+			if !relockTask("drainNodes") {
+				return errors.New("Lost lock")
+			}
+			continue
+		}
+
+		under, err := underReplicatedCount()
+		if err != nil {
+			return err
+		}
+		if under > 0 {
+			setTaskDetail("drainNodes", fmt.Sprintf(
+				"%v: empty, waiting on %v under-replicated blobs",
+				n.name, under))
+			log.Printf("%v is empty, but %v blobs are under-replicated",
+				n, under)
+			continue
+		}
+
+		setTaskDetail("drainNodes", n.name+": removing")
+		forgetNode(n.name)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestStoresBlob(t *testing.T) {
+	tests := []struct {
+		method, path string
+		exp          bool
+	}{
+		{"PUT", "/some/file", true},
+		{"PUT", blobPrefix + "abc", true},
+		{"PUT", multipartPrefix + "id/1", true},
+		{"PUT", configPrefix, false},
+		{"POST", blobPrefix, true},
+		{"POST", formUploadPrefix + "dir", true},
+		{"POST", taskPrefix + "drainNodes", false},
+		{"GET", "/some/file", false},
+		{"DELETE", blobPrefix + "abc", false},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, test.path, nil)
+		if err != nil {
+			t.Fatalf("Error making request: %v", err)
+		}
+		if got := storesBlob(req); got != test.exp {
+			t.Errorf("Expected %v for %v %v, got %v",
+				test.exp, test.method, test.path, got)
+		}
+	}
+}
+
+func TestAccepting(t *testing.T) {
+	nl := testZoneNodes()
+	nl[1].Draining = true
+	nl[4].Draining = true
+	nl[3].Stopping = true
+	nl[5].Maintenance = true
+
+	exp := "[a1 b1]"
+	if got := fmt.Sprint(nodeNames(nl.accepting())); got != exp {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	cb "github.com/couchbase/go-couchbase"
+)
+
+const dedupViewLimit = 1000
+
+// A blob shared by more than one file.
+type dedupBlob struct {
+	OID    string `json:"oid"`
+	Refs   int64  `json:"refs"`
+	Length int64  `json:"length"`
+	Saved  int64  `json:"savedBytes"`
+}
+
+// How much content addressing saves across the current revisions of
+// all files.  Files stored in parts count a reference per part.
+type dedupReport struct {
+	References   int64       `json:"references"`
+	Blobs        int64       `json:"blobs"`
+	LogicalBytes int64       `json:"logicalBytes"`
+	StoredBytes  int64       `json:"storedBytes"`
+	SavedBytes   int64       `json:"savedBytes"`
+	Ratio        float64     `json:"ratio"`
+	Top          []dedupBlob `json:"top"`
+}
+
+type dedupRow struct {
+	Key   string
+	Value struct {
+		Count, Sum int64
+	}
+}
+
+// Most referenced first, then largest.
+type dedupBlobs []dedupBlob
+
+func (d dedupBlobs) Len() int      { return len(d) }
+func (d dedupBlobs) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d dedupBlobs) Less(i, j int) bool {
+	if d[i].Refs != d[j].Refs {
+		return d[i].Refs > d[j].Refs
+	}
+	if d[i].Length != d[j].Length {
+		return d[i].Length > d[j].Length
+	}
+	return d[i].OID < d[j].OID
+}
+
+// Add one blob's references to the report, keeping the top n.
+func (r *dedupReport) add(row dedupRow, n int) {
+	if row.Value.Count < 1 {
+		return
+	}
+	length := row.Value.Sum / row.Value.Count
+	r.References += row.Value.Count
+	r.Blobs++
+	r.LogicalBytes += row.Value.Sum
+	r.StoredBytes += length
+
+	if row.Value.Count < 2 || n < 1 {
+		return
+	}
+	r.Top = append(r.Top, dedupBlob{row.Key, row.Value.Count, length,
+		row.Value.Sum - length})
+	if len(r.Top) > 4*n {
+		sort.Sort(dedupBlobs(r.Top))
+		r.Top = r.Top[:n]
+	}
+}
+
+func (r *dedupReport) finish(n int) {
+	sort.Sort(dedupBlobs(r.Top))
+	if len(r.Top) > n {
+		r.Top = r.Top[:n]
+	}
+	r.SavedBytes = r.LogicalBytes - r.StoredBytes
+	if r.StoredBytes > 0 {
+		r.Ratio = float64(r.LogicalBytes) / float64(r.StoredBytes)
+	}
+}
+
+func dedupStats(top int) (dedupReport, error) {
+	rv := dedupReport{Top: []dedupBlob{}}
+	params := map[string]interface{}{
+		"group": true,
+		"limit": dedupViewLimit,
+	}
+	for {
+		viewRes := struct {
+			Rows   []dedupRow
+			Errors []cb.ViewError
+		}{}
+		err := couchbase.ViewCustom("cbfs", "blob_refs", params, &viewRes)
+		if err != nil {
+			return rv, err
+		}
+		if len(viewRes.Errors) > 0 {
+			return rv, fmt.Errorf("View errors: %v", viewRes.Errors)
+		}
+
+		for _, row := range viewRes.Rows {
+			rv.add(row, top)
+		}
+
+		if len(viewRes.Rows) < dedupViewLimit {
+			break
+		}
+		params["startkey"] = viewRes.Rows[len(viewRes.Rows)-1].Key
+		params["skip"] = 1
+	}
+	rv.finish(top)
+	return rv, nil
+}
+
+func doDedupReport(w http.ResponseWriter, req *http.Request) {
+	top := 10
+	if s := req.FormValue("top"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid top parameter", 400)
+			return
+		}
+		top = n
+	}
+
+	rep, err := dedupStats(top)
+	if err != nil {
+		log.Printf("Error computing dedup stats: %v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	sendJson(w, req, rep)
+}
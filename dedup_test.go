@@ -0,0 +1,56 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDedupReport(t *testing.T) {
+	row := func(oid string, count, sum int64) dedupRow {
+		r := dedupRow{Key: oid}
+		r.Value.Count, r.Value.Sum = count, sum
+		return r
+	}
+	rows := []dedupRow{
+		row("a", 1, 100),
+		row("b", 3, 30),
+		row("c", 2, 2000),
+		row("d", 3, 300),
+		row("e", 0, 0),
+		row("f", 5, 5),
+	}
+
+	rep := dedupReport{}
+	for _, r := range rows {
+		rep.add(r, 1)
+	}
+	rep.finish(3)
+
+	exp := dedupReport{
+		References:   14,
+		Blobs:        5,
+		LogicalBytes: 2435,
+		StoredBytes:  1211,
+		SavedBytes:   1224,
+		Ratio:        2435.0 / 1211.0,
+		Top: []dedupBlob{
+			{"f", 5, 1, 4},
+			{"d", 3, 100, 200},
+			{"b", 3, 10, 20},
+		},
+	}
+	// With n=1 the top list is trimmed as it goes, but only once
+	// it grows past 4n, so all of these are still in it.
+	if !reflect.DeepEqual(rep, exp) {
+		t.Errorf("Expected %+v, got %+v", exp, rep)
+	}
+
+	rep = dedupReport{}
+	for _, r := range rows {
+		rep.add(r, 0)
+	}
+	rep.finish(0)
+	if len(rep.Top) != 0 || rep.Blobs != 5 {
+		t.Errorf("Expected no top blobs, got %+v", rep)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// How files are split into chunks, and the chunks a file is made of
+// now, so a client can work out which parts of a new version it has
+// to send.
+type chunkSignatures struct {
+	Path           string     `json:"path"`
+	Hash           string     `json:"hash"`
+	ChunkSize      int64      `json:"chunkSize"`
+	ContentDefined bool       `json:"contentDefined"`
+	OID            string     `json:"oid"`
+	Length         int64      `json:"length"`
+	Parts          []blobPart `json:"parts"`
+}
+
+// GET /.cbfs/chunks/<path> gives the chunk signatures of a file.
+func doGetChunks(w http.ResponseWriter, req *http.Request, fn string) {
+	fn = strings.Trim(fn, "/")
+	fm := fileMeta{}
+	err := couchbase.Get(shortName(fn), &fm)
+	switch {
+	case err == nil && fm.Type == "file":
+	case err == nil || gomemcached.IsNotFound(err):
+		http.Error(w, "not found", 404)
+		return
+	default:
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	parts := fileParts(fm)
+	if parts == nil {
+		parts = []blobPart{}
+	}
+	sendJson(w, req, &chunkSignatures{
+		Path:           fn,
+		Hash:           globalConfig.Hash,
+		ChunkSize:      globalConfig.ChunkSize,
+		ContentDefined: globalConfig.ContentDefinedChunks,
+		OID:            fm.OID,
+		Length:         fm.Length,
+		Parts:          parts,
+	})
+}
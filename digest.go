@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/hex"
+	"hash"
+	"net/http"
+)
+
+const (
+	// Clients ask for content's hash with this header...
+	wantHashHeader = "X-CBFS-Want-Hash"
+	// ...and get it back in this one, as "<algorithm>=<hex>".
+	hashHeader = "X-CBFS-Hash"
+)
+
+func wantsHash(req *http.Request) bool {
+	return req.Header.Get(wantHashHeader) != ""
+}
+
+// A blob's hash as sent in hashHeader.
+func blobDigest(oid string) string {
+	name := globalConfig.Hash
+	if names := hashesFor(oid); len(names) > 0 {
+		name = names[0]
+	}
+	return name + "=" + oid
+}
+
+// Hashes everything written through it and sends the result as a
+// trailer, for content (such as files stored in parts) whose hash
+// isn't known until it's all been sent.
+type trailerHasher struct {
+	http.ResponseWriter
+	h hash.Hash
+}
+
+func newTrailerHasher(w http.ResponseWriter) *trailerHasher {
+	w.Header().Set("Trailer", hashHeader)
+	return &trailerHasher{w, getHash()}
+}
+
+func (t *trailerHasher) WriteHeader(code int) {
+	// Trailers only go out with chunked responses.
+	t.Header().Del("Content-Length")
+	t.ResponseWriter.WriteHeader(code)
+}
+
+func (t *trailerHasher) Write(b []byte) (int, error) {
+	t.h.Write(b)
+	return t.ResponseWriter.Write(b)
+}
+
+func (t *trailerHasher) finish() {
+	t.Header().Set(hashHeader,
+		globalConfig.Hash+"="+hex.EncodeToString(t.h.Sum(nil)))
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Whether to send a client reading a file this node doesn't hold to a
+// node that does, rather than pass the content through.
+func wantsDirect(req *http.Request) bool {
+	if d, err := strconv.ParseBool(req.FormValue("direct")); err == nil {
+		return d
+	}
+	return globalConfig.DirectReads
+}
+
+// Whether this node holds every blob a file is made of.
+func hasLocalFile(fm fileMeta) bool {
+	if len(fm.Parts) == 0 {
+		return hasLocalBlob(fm.OID)
+	}
+	for _, p := range fm.Parts {
+		if !hasLocalBlob(p.OID) {
+			return false
+		}
+	}
+	return true
+}
+
+// Redirect a read to a live node holding the whole file, one in the
+// client's zone if there is one.  The node it's sent to is told not
+// to redirect again, so a copy that's gone missing there is fetched
+// rather than bounced around.  Returns whether it redirected.
+func redirectToHolder(w http.ResponseWriter, req *http.Request,
+	fm fileMeta) bool {
+
+	nl, err := fileNodes(fm)
+	if err != nil {
+		log.Printf("Error finding the nodes holding %v: %v", fm.OID, err)
+		return false
+	}
+	for _, n := range nl.minusLocal().preferZone(requestZone(req)) {
+		if time.Since(n.Time) < globalConfig.StaleNodeLimit && !n.Stopping {
+			q := req.URL.Query()
+			q.Set("direct", "false")
+			u := n.URLFor(req.URL.EscapedPath()) + "?" + q.Encode()
+			http.Redirect(w, req, u, http.StatusFound)
+			return true
+		}
+	}
+	return false
+}
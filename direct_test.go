@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestWantsDirect(t *testing.T) {
+	defer func(d bool) { globalConfig.DirectReads = d }(globalConfig.DirectReads)
+
+	tests := []struct {
+		query   string
+		cluster bool
+		exp     bool
+	}{
+		{"", false, false},
+		{"", true, true},
+		{"?direct=true", false, true},
+		{"?direct=false", true, false},
+		{"?direct=maybe", true, true},
+	}
+	for _, test := range tests {
+		globalConfig.DirectReads = test.cluster
+		req, err := http.NewRequest("GET", "http://x/a/file"+test.query, nil)
+		if err != nil {
+			t.Fatalf("Error making request: %v", err)
+		}
+		if got := wantsDirect(req); got != test.exp {
+			t.Errorf("Expected %v for %q with directReads=%v, got %v",
+				test.exp, test.query, test.cluster, got)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Milliseconds the block device holding path has spent doing I/O
+// (io_ticks in its sysfs stat file).
+func diskIOTicks(path string) (uint64, error) {
+	st := syscall.Stat_t{}
+	if err := syscall.Stat(path, &st); err != nil {
+		return 0, err
+	}
+	dev := uint64(st.Dev)
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+	data, err := ioutil.ReadFile(
+		fmt.Sprintf("/sys/dev/block/%d:%d/stat", major, minor))
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 10 {
+		return 0, fmt.Errorf("unexpected disk stats for %v: %q", path, data)
+	}
+	return strconv.ParseUint(fields[9], 10, 64)
+}
@@ -0,0 +1,9 @@
+// +build !linux
+
+package main
+
+import "errors"
+
+func diskIOTicks(path string) (uint64, error) {
+	return 0, errors.New("disk stats aren't available on this platform")
+}
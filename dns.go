@@ -145,7 +145,7 @@ func (d dnsService) listHosts(w dns.ResponseWriter, r *dns.Msg) {
 }
 
 func (d dnsService) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
-	if *verbose {
+	if verboseLogging() {
 		log.Printf("Incoming DNS Query: %v", r)
 	}
 	q := dns.Question{}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+const (
+	duViewPage = 1000
+	// How long to reuse a subtree's numbers
+	duCacheAge = time.Minute
+
+	duKeyPrefix = "/@du/"
+	// Which generation of per-directory totals is live, and which
+	// reconcileDu is building.  Until one's been built, du falls back
+	// to reading the dir_blobs view.
+	duGenKey = "/@du-gen"
+
+	// How often queued reference changes are stored
+	duFlushPeriod = 5 * time.Second
+	// Changes to more directories and blobs than this are dropped
+	// while waiting, for reconcileDu to put right
+	duMaxPending = 100000
+)
+
+var duCounterNames = []string{"blobs+", "blobs-", "bytes+", "bytes-"}
+
+var errDuUnchanged = errors.New("unchanged")
+
+// Space used by everything under a directory.
+type duStats struct {
+	Path    string `json:"path"`
+	Objects int64  `json:"objects"`
+	// Total size of the files
+	Logical int64 `json:"logicalBytes"`
+	// Distinct blobs the files are stored in, and their size
+	Blobs   int64 `json:"blobs"`
+	Deduped int64 `json:"dedupedBytes"`
+	// Size of every stored copy of those blobs, only worked out
+	// when asked for with ?physical=true
+	Physical int64 `json:"physicalBytes,omitempty"`
+	// For the root, when reconcileDu last worked out its blob totals
+	BlobsAsOf time.Time `json:"blobsAsOf,omitempty"`
+	Children  []duStats `json:"children,omitempty"`
+	Computed  time.Time `json:"computed"`
+}
+
+var duCache = struct {
+	sync.Mutex
+	m map[duQuery]duStats
+}{m: map[duQuery]duStats{}}
+
+// How much space a blob takes across the cluster.
+func blobPhysicalSize(b BlobOwnership) int64 {
+	if b.EC != nil {
+		return b.EC.ShardSize * int64(len(b.EC.Shards))
+	}
+	return b.Length * int64(len(b.Nodes))
+}
+
+// Add up the distinct blobs referenced under a directory.  The view
+// does the deduplication, so this reads one row per blob rather than
+// one per file, but that's still every blob under the directory, so
+// it's only done when the physical size is asked for or the
+// per-directory totals aren't ready.
+func duBlobs(dir string, st *duStats) error {
+	startKey := []interface{}{dir}
+	endKey := []interface{}{dir, &(json.RawMessage{'{', '}'})}
+	last := ""
+	for {
+		viewRes := struct {
+			Rows []struct {
+				Key   []string
+				Value struct {
+					Count, Max int64
+				}
+			}
+		}{}
+		err := couchbase.ViewCustom("cbfs", "dir_blobs",
+			map[string]interface{}{
+				"group_level": 2,
+				"limit":       duViewPage,
+				"start_key":   startKey,
+				"end_key":     endKey,
+			}, &viewRes)
+		if err != nil {
+			return err
+		}
+
+		oids := []string{}
+		for _, r := range viewRes.Rows {
+			if len(r.Key) != 2 || r.Key[1] == last {
+				continue
+			}
+			oids = append(oids, r.Key[1])
+			st.Blobs++
+			st.Deduped += r.Value.Max
+		}
+		blobs, err := getBlobs(oids)
+		if err != nil {
+			return err
+		}
+		for _, b := range blobs {
+			st.Physical += blobPhysicalSize(b)
+		}
+
+		if len(viewRes.Rows) < duViewPage {
+			return nil
+		}
+		last = viewRes.Rows[len(viewRes.Rows)-1].Key[1]
+		startKey = []interface{}{dir, last}
+	}
+}
+
+// The directories a file counts towards: every one above it,
+// including the root ("").
+func duDirs(path string) []string {
+	segs := strings.Split(strings.Trim(path, "/"), "/")
+	rv := make([]string, len(segs))
+	for i := range segs {
+		rv[i] = strings.Join(segs[:i], "/")
+	}
+	return rv
+}
+
+// A generation of per-directory totals.  reconcileDu builds each one
+// afresh while the one before stays live.
+type duGeneration struct {
+	Live int `json:"live"`
+	// Set while reconcileDu is building the next one
+	Building   int       `json:"building,omitempty"`
+	Reconciled time.Time `json:"reconciled"`
+}
+
+func getDuGeneration() (duGeneration, error) {
+	g := duGeneration{}
+	err := couchbase.Get(duGenKey, &g)
+	if gomemcached.IsNotFound(err) {
+		err = nil
+	}
+	return g, err
+}
+
+func duDirKey(gen int, dir string) string {
+	h := sha1.New()
+	h.Write([]byte(dir))
+	return duKeyPrefix + strconv.Itoa(gen) + "/" + hex.EncodeToString(h.Sum(nil))
+}
+
+// How many of a directory's files refer to a blob.
+func duRefKey(gen int, dir, oid string) string {
+	return duDirKey(gen, dir) + "/" + oid
+}
+
+// A directory's running totals.  Counters can only go up, so what's
+// added and what's taken away are counted separately.
+func duCounterKey(gen int, dir, name string) string {
+	return duDirKey(gen, dir) + "/" + name
+}
+
+// The root's totals, which aren't kept running since that would
+// take a reference count for every blob.
+func duRootKey(gen int) string {
+	return duDirKey(gen, "") + "/totals"
+}
+
+type duTotals struct {
+	Blobs int64 `json:"blobs"`
+	Bytes int64 `json:"bytes"`
+}
+
+// A change in how many references a file makes to a blob.
+type duRefChange struct {
+	blobPart
+	delta int64
+}
+
+func duFileBlobs(fm fileMeta) []blobPart {
+	if fm.OID == "" {
+		return nil
+	}
+	return contentParts(fm)
+}
+
+// The blob references a change from old to new adds and drops, with
+// those the two share cancelled out.  Either may be empty for a file
+// created or deleted.
+func duRefChanges(old, new fileMeta) []duRefChange {
+	m := map[string]*duRefChange{}
+	add := func(parts []blobPart, delta int64) {
+		for _, p := range parts {
+			c, ok := m[p.OID]
+			if !ok {
+				c = &duRefChange{blobPart: p}
+				m[p.OID] = c
+			}
+			c.delta += delta
+		}
+	}
+	add(duFileBlobs(old), -1)
+	add(duFileBlobs(new), 1)
+
+	rv := []duRefChange{}
+	for _, c := range m {
+		if c.delta != 0 {
+			rv = append(rv, *c)
+		}
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].OID < rv[j].OID })
+	return rv
+}
+
+// Change a directory's reference count for a blob, adding the blob
+// to the directory's totals as the count becomes positive and
+// taking it away as it drops back.  Counts may go negative for a
+// while when a file's removal is counted before its creation.
+func duUpdateRefs(gen int, dir string, b blobPart, f func(int64) int64) error {
+	was, now := int64(0), int64(0)
+	err := couchbase.Update(duRefKey(gen, dir, b.OID), 0,
+		func(in []byte) ([]byte, error) {
+			was = 0
+			if in != nil {
+				json.Unmarshal(in, &was)
+			}
+			now = f(was)
+			switch {
+			case now == was:
+				return in, errDuUnchanged
+			case now == 0:
+				return nil, nil
+			}
+			return json.Marshal(now)
+		})
+	switch {
+	case err == errDuUnchanged:
+		return nil
+	case err != nil:
+		return err
+	}
+
+	suffix := ""
+	switch {
+	case was <= 0 && now > 0:
+		suffix = "+"
+	case was > 0 && now <= 0:
+		suffix = "-"
+	default:
+		return nil
+	}
+	_, err = couchbase.Incr(duCounterKey(gen, dir, "blobs"+suffix), 1, 1, 0)
+	if err == nil {
+		l := uint64(b.Length)
+		_, err = couchbase.Incr(duCounterKey(gen, dir, "bytes"+suffix), l, l, 0)
+	}
+	return err
+}
+
+type duRef struct {
+	dir string
+	blobPart
+}
+
+// Reference count changes waiting for duFlushLoop, which stores them
+// in batches so writes don't wait on a document per directory and
+// blob.  Changes to the same directory and blob are combined.
+var duPending = struct {
+	sync.Mutex
+	m       map[duRef]int64
+	dropped bool
+}{m: map[duRef]int64{}}
+
+// Queue the changes to the totals of the directories above path for
+// a file changing from old to new.  The root's totals aren't kept
+// this way.  Changes that don't fit in the queue, or that are lost
+// with the node, are put right the next time reconcileDu runs.
+func duFileChanged(path string, old, new fileMeta) {
+	changes := duRefChanges(old, new)
+	if len(changes) == 0 {
+		return
+	}
+
+	duPending.Lock()
+	defer duPending.Unlock()
+	for _, dir := range duDirs(path)[1:] {
+		for _, c := range changes {
+			r := duRef{dir, c.blobPart}
+			if _, ok := duPending.m[r]; !ok && len(duPending.m) >= duMaxPending {
+				if !duPending.dropped {
+					log.Printf("Too many usage changes waiting, " +
+						"dropping them for reconcileDu to put right")
+					duPending.dropped = true
+				}
+				return
+			}
+			duPending.m[r] += c.delta
+		}
+	}
+}
+
+func duFlushLoop() {
+	for range time.Tick(duFlushPeriod) {
+		if err := duFlush(); err != nil {
+			log.Printf("Error storing usage changes: %v", err)
+		}
+	}
+}
+
+// Store the queued reference changes in the live generation, and in
+// the one being built if there is one.
+func duFlush() error {
+	duPending.Lock()
+	pending := duPending.m
+	duPending.m = map[duRef]int64{}
+	duPending.dropped = false
+	duPending.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	g, err := getDuGeneration()
+	if err != nil {
+		return err
+	}
+	gens := []int{g.Live}
+	if g.Building != 0 {
+		gens = append(gens, g.Building)
+	}
+	for r, delta := range pending {
+		if delta == 0 {
+			continue
+		}
+		for _, gen := range gens {
+			err := duUpdateRefs(gen, r.dir, r.blobPart, func(n int64) int64 {
+				return n + delta
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func duCounter(gen int, dir, name string) (int64, error) {
+	n, err := couchbase.Incr(duCounterKey(gen, dir, name), 0, 0, 0)
+	return int64(n), err
+}
+
+// The distinct blobs under a directory and their size from the live
+// generation's totals.
+func duStored(g duGeneration, dir string, st *duStats) error {
+	if dir == "" {
+		t := duTotals{}
+		err := couchbase.Get(duRootKey(g.Live), &t)
+		st.Blobs, st.Deduped, st.BlobsAsOf = t.Blobs, t.Bytes, g.Reconciled
+		return err
+	}
+
+	var counts [4]int64
+	for i, name := range duCounterNames {
+		n, err := duCounter(g.Live, dir, name)
+		if err != nil {
+			return err
+		}
+		counts[i] = n
+	}
+	st.Blobs = counts[0] - counts[1]
+	st.Deduped = counts[2] - counts[3]
+	return nil
+}
+
+// Work out every directory's totals afresh from the dir_blobs view
+// as a new generation, then make it the live one.  Changes stored
+// while it's being built go to both, so the live totals are never
+// overwritten and the new ones are current when they take over.
+// The generation before the live one is removed along the way,
+// though not its counts for blobs no longer in the view.
+func reconcileDu() error {
+	start := time.Now()
+	g, err := getDuGeneration()
+	if err != nil {
+		return err
+	}
+	// A build that was cut short is picked up where it was.
+	if g.Building == 0 {
+		g.Building = g.Live + 1
+		if err := couchbase.Set(duGenKey, 0, g); err != nil {
+			return err
+		}
+	}
+	gen, old := g.Building, g.Live-1
+
+	root := duTotals{}
+	var startKey interface{} = []interface{}{}
+	var last []string
+	lastDir := ""
+	rows := 0
+	for {
+		viewRes := struct {
+			Rows []struct {
+				Key   []string
+				Value struct {
+					Count, Max int64
+				}
+			}
+		}{}
+		err := couchbase.ViewCustom("cbfs", "dir_blobs",
+			map[string]interface{}{
+				"group_level": 2,
+				"limit":       duViewPage,
+				"start_key":   startKey,
+				"stale":       false,
+			}, &viewRes)
+		if err != nil {
+			return err
+		}
+
+		for _, r := range viewRes.Rows {
+			if len(r.Key) != 2 ||
+				(last != nil && r.Key[0] == last[0] && r.Key[1] == last[1]) {
+				continue
+			}
+			rows++
+			dir := r.Key[0]
+			if dir == "" {
+				root.Blobs++
+				root.Bytes += r.Value.Max
+				continue
+			}
+
+			if old >= 0 {
+				couchbase.Delete(duRefKey(old, dir, r.Key[1]))
+				if dir != lastDir {
+					for _, name := range duCounterNames {
+						couchbase.Delete(duCounterKey(old, dir, name))
+					}
+				}
+			}
+			lastDir = dir
+
+			count := r.Value.Count
+			err := duUpdateRefs(gen, dir, blobPart{r.Key[1], r.Value.Max},
+				func(int64) int64 { return count })
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(viewRes.Rows) < duViewPage {
+			break
+		}
+		last = viewRes.Rows[len(viewRes.Rows)-1].Key
+		startKey = last
+	}
+
+	if err := couchbase.Set(duRootKey(gen), 0, root); err != nil {
+		return err
+	}
+	if old >= 0 {
+		couchbase.Delete(duRootKey(old))
+	}
+	log.Printf("Reconciled usage of %v directory blobs in %v",
+		rows, time.Since(start))
+	return couchbase.Set(duGenKey, 0,
+		duGeneration{Live: gen, Reconciled: time.Now().UTC()})
+}
+
+func computeDu(dir string, physical bool) (duStats, error) {
+	st := duStats{Path: dir, Computed: time.Now().UTC()}
+	var err error
+	st.Logical, st.Objects, err = prefixUsage(dir)
+	if err != nil {
+		return st, err
+	}
+	if !physical {
+		g, err := getDuGeneration()
+		if err != nil {
+			return st, err
+		}
+		if g.Live != 0 {
+			return st, duStored(g, dir, &st)
+		}
+	}
+	return st, duBlobs(dir, &st)
+}
+
+type duQuery struct {
+	dir      string
+	physical bool
+}
+
+// Get the space used under a directory, reusing recent numbers.
+func duFor(dir string, physical bool) (duStats, error) {
+	q := duQuery{dir, physical}
+	duCache.Lock()
+	st, ok := duCache.m[q]
+	duCache.Unlock()
+	if ok && time.Since(st.Computed) < duCacheAge {
+		return st, nil
+	}
+
+	st, err := computeDu(dir, physical)
+	if err != nil {
+		return st, err
+	}
+
+	duCache.Lock()
+	defer duCache.Unlock()
+	for k, v := range duCache.m {
+		if time.Since(v.Computed) >= duCacheAge {
+			delete(duCache.m, k)
+		}
+	}
+	duCache.m[q] = st
+	return st, nil
+}
+
+func doDu(w http.ResponseWriter, req *http.Request, dir string) {
+	dir = strings.Trim(dir, "/")
+	physical, _ := strconv.ParseBool(req.FormValue("physical"))
+
+	st, err := duFor(dir, physical)
+	if err != nil {
+		log.Printf("Error computing usage of %q: %v", dir, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if st.Objects == 0 {
+		http.Error(w, "not found", 404)
+		return
+	}
+
+	if children, _ := strconv.ParseBool(req.FormValue("children")); children {
+		fl, err := listFiles(dir, false, 1)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		names := []string{}
+		for n := range fl.Dirs {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			if dir != "" {
+				n = dir + "/" + n
+			}
+			c, err := duFor(n, physical)
+			if err != nil {
+				log.Printf("Error computing usage of %q: %v", n, err)
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			st.Children = append(st.Children, c)
+		}
+	}
+
+	sendJson(w, req, st)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBlobPhysicalSize(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		b   BlobOwnership
+		exp int64
+	}{
+		{BlobOwnership{Length: 100}, 0},
+		{BlobOwnership{Length: 100,
+			Nodes: map[string]time.Time{"a": now, "b": now}}, 200},
+		{BlobOwnership{Length: 100,
+			Nodes: map[string]time.Time{"a": now},
+			EC: &erasureSet{Data: 2, Parity: 1, ShardSize: 50,
+				Shards: []string{"x", "y", "z"}}}, 150},
+	}
+
+	for _, test := range tests {
+		if got := blobPhysicalSize(test.b); got != test.exp {
+			t.Errorf("Expected %v for %+v, got %v", test.exp, test.b, got)
+		}
+	}
+}
+
+func TestDuDirs(t *testing.T) {
+	tests := []struct {
+		path string
+		exp  []string
+	}{
+		{"a", []string{""}},
+		{"/a/b/c", []string{"", "a", "a/b"}},
+	}
+
+	for _, test := range tests {
+		if got := duDirs(test.path); !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("Expected %q for %q, got %q", test.exp, test.path, got)
+		}
+	}
+}
+
+func TestDuRefChanges(t *testing.T) {
+	parted := fileMeta{OID: "m", Length: 30,
+		Parts: []blobPart{{"x", 10}, {"y", 10}, {"x", 10}}}
+	tests := []struct {
+		name     string
+		old, new fileMeta
+		exp      []duRefChange
+	}{
+		{"created", fileMeta{}, fileMeta{OID: "a", Length: 5},
+			[]duRefChange{{blobPart{"a", 5}, 1}}},
+		{"deleted", fileMeta{OID: "a", Length: 5}, fileMeta{},
+			[]duRefChange{{blobPart{"a", 5}, -1}}},
+		{"same", fileMeta{OID: "a", Length: 5}, fileMeta{OID: "a", Length: 5},
+			[]duRefChange{}},
+		{"parts", fileMeta{OID: "y", Length: 10}, parted,
+			[]duRefChange{{blobPart{"x", 10}, 2}}},
+	}
+
+	for _, test := range tests {
+		got := duRefChanges(test.old, test.new)
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%v: expected %+v, got %+v", test.name, test.exp, got)
+		}
+	}
+}
+
+func TestDuFileChangedQueues(t *testing.T) {
+	defer func() { duPending.m = map[duRef]int64{} }()
+	duPending.m = map[duRef]int64{}
+
+	a, b := blobPart{"a", 5}, blobPart{"b", 7}
+	duFileChanged("x/y/f", fileMeta{}, fileMeta{OID: "a", Length: 5})
+	duFileChanged("x/g", fileMeta{}, fileMeta{OID: "a", Length: 5})
+	duFileChanged("x/y/f", fileMeta{OID: "a", Length: 5},
+		fileMeta{OID: "b", Length: 7})
+	duFileChanged("top", fileMeta{}, fileMeta{OID: "b", Length: 7})
+
+	// The root isn't counted, and changes to the same blob combine.
+	exp := map[duRef]int64{
+		{"x", a}:   1,
+		{"x/y", a}: 0,
+		{"x", b}:   1,
+		{"x/y", b}: 1,
+	}
+	if !reflect.DeepEqual(duPending.m, exp) {
+		t.Errorf("Expected %v queued, got %v", exp, duPending.m)
+	}
+
+	for i := len(duPending.m); i < duMaxPending; i++ {
+		duPending.m[duRef{"filler", blobPart{strconv.Itoa(i), 1}}] = 1
+	}
+	duFileChanged("x/h", fileMeta{}, fileMeta{OID: "c", Length: 1})
+	duFileChanged("x/h", fileMeta{}, fileMeta{OID: "a", Length: 5})
+	if _, ok := duPending.m[duRef{"x", blobPart{"c", 1}}]; ok ||
+		len(duPending.m) != duMaxPending {
+		t.Errorf("Expected changes dropped once full, got %v queued",
+			len(duPending.m))
+	}
+	if duPending.m[duRef{"x", a}] != 2 {
+		t.Errorf("Expected changes already queued still combined, got %v",
+			duPending.m[duRef{"x", a}])
+	}
+}
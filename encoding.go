@@ -0,0 +1,112 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Content-Encoding we can read and write.
+type contentCoding struct {
+	newReader func(io.Reader) (io.ReadCloser, error)
+	newWriter func(io.Writer) io.WriteCloser
+}
+
+var contentCodings = map[string]contentCoding{
+	"gzip": {
+		func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+		func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+	},
+}
+
+// Which coding to use when a client accepts more than one equally.
+var codingPreference = []string{"zstd", "gzip"}
+
+// How much a client wants the named coding, from its Accept-Encoding
+// header.  Zero means not at all.
+func codingQuality(accept, name string) float64 {
+	star := -1.0
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		c := strings.ToLower(strings.TrimSpace(fields[0]))
+		if c != name && c != "*" {
+			continue
+		}
+		q := 1.0
+		for _, p := range fields[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if f, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if c == name {
+			return q
+		}
+		star = q
+	}
+	if star > 0 {
+		return star
+	}
+	return 0
+}
+
+func canGzip(req *http.Request) bool {
+	return codingQuality(req.Header.Get("Accept-Encoding"), "gzip") > 0
+}
+
+// The best coding we support for a response to req, or "" to send
+// it as is.
+func negotiateCoding(req *http.Request) string {
+	accept := req.Header.Get("Accept-Encoding")
+	best, bestq := "", 0.0
+	for _, c := range codingPreference {
+		if _, ok := contentCodings[c]; !ok {
+			continue
+		}
+		if q := codingQuality(accept, c); q > bestq {
+			best, bestq = c, q
+		}
+	}
+	return best
+}
+
+func supportedCodings() string {
+	rv := []string{}
+	for c := range contentCodings {
+		rv = append(rv, c)
+	}
+	sort.Strings(rv)
+	return strings.Join(rv, ", ")
+}
+
+// Remove any Content-Encoding from an upload.  Content is always
+// stored decoded so hashes, lengths and ranges refer to the content
+// itself.  On failure, returns the HTTP status to respond with.
+func decodeRequestBody(req *http.Request) (int, error) {
+	ce := strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding")))
+	if ce == "" || ce == "identity" {
+		return 0, nil
+	}
+	c, ok := contentCodings[ce]
+	if !ok {
+		return 415, fmt.Errorf("unsupported Content-Encoding %q", ce)
+	}
+	r, err := c.newReader(req.Body)
+	if err != nil {
+		return 400, fmt.Errorf("error decoding %v content: %v", ce, err)
+	}
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{r, req.Body}
+	req.ContentLength = -1
+	req.Header.Del("Content-Encoding")
+	req.Header.Del("Content-Length")
+	return 0, nil
+}
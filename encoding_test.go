@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestCodingQuality(t *testing.T) {
+	tests := []struct {
+		accept, name string
+		exp          float64
+	}{
+		{"", "gzip", 0},
+		{"gzip", "gzip", 1},
+		{"deflate, gzip", "gzip", 1},
+		{"gzip;q=0.5, zstd", "gzip", 0.5},
+		{"gzip;q=0", "gzip", 0},
+		{"*", "gzip", 1},
+		{"*;q=0.2, zstd", "gzip", 0.2},
+		{"*, gzip;q=0", "gzip", 0},
+		{"GZIP", "gzip", 1},
+		{"gzipx", "gzip", 0},
+	}
+
+	for _, test := range tests {
+		got := codingQuality(test.accept, test.name)
+		if got != test.exp {
+			t.Errorf("Expected %v for %v in %q, got %v",
+				test.exp, test.name, test.accept, got)
+		}
+	}
+}
+
+func TestNegotiateCoding(t *testing.T) {
+	tests := []struct {
+		accept, exp string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"br, gzip;q=0.1", "gzip"},
+		{"gzip;q=0", ""},
+	}
+	if _, ok := contentCodings["zstd"]; ok {
+		tests = append(tests, struct{ accept, exp string }{"gzip, zstd", "zstd"},
+			struct{ accept, exp string }{"gzip, zstd;q=0.5", "gzip"})
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/x", nil)
+		req.Header.Set("Accept-Encoding", test.accept)
+		if got := negotiateCoding(req); got != test.exp {
+			t.Errorf("Expected %q for %q, got %q", test.exp, test.accept, got)
+		}
+	}
+}
+
+func TestDecodeRequestBody(t *testing.T) {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	gz.Write([]byte("hello"))
+	gz.Close()
+
+	req, _ := http.NewRequest("PUT", "/x", bytes.NewReader(buf.Bytes()))
+	req.Header.Set("Content-Encoding", "gzip")
+	if code, err := decodeRequestBody(req); err != nil {
+		t.Fatalf("Error decoding: %v %v", code, err)
+	}
+	got, err := ioutil.ReadAll(req.Body)
+	if string(got) != "hello" || err != nil {
+		t.Errorf("Expected hello, got %q, %v", got, err)
+	}
+	if req.Header.Get("Content-Encoding") != "" || req.ContentLength != -1 {
+		t.Errorf("Expected the encoding removed, got %v, %v",
+			req.Header, req.ContentLength)
+	}
+
+	req, _ = http.NewRequest("PUT", "/x", bytes.NewReader([]byte("plain")))
+	req.Header.Set("Content-Encoding", "br")
+	if code, err := decodeRequestBody(req); code != 415 || err == nil {
+		t.Errorf("Expected 415 for br, got %v %v", code, err)
+	}
+
+	req.Header.Set("Content-Encoding", "gzip")
+	if code, err := decodeRequestBody(req); code != 400 || err == nil {
+		t.Errorf("Expected 400 for bad gzip, got %v %v", code, err)
+	}
+}
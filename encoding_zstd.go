@@ -0,0 +1,26 @@
+// +build zstd
+
+package main
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func init() {
+	contentCodings["zstd"] = contentCoding{
+		func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+		func(w io.Writer) io.WriteCloser {
+			// Only invalid options make this fail.
+			e, _ := zstd.NewWriter(w)
+			return e
+		},
+	}
+}
@@ -0,0 +1,619 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"time"
+
+	cb "github.com/couchbaselabs/go-couchbase"
+)
+
+// Blobs are split into stripes of this much per data shard.
+const ecStripeUnit = 64 * 1024
+
+// Where the shards of an erasure coded blob are.  Shard i holds the
+// ith unit of every stripe, data shards first.
+type erasureSet struct {
+	Data      int      `json:"data"`
+	Parity    int      `json:"parity"`
+	ShardSize int64    `json:"shardSize"`
+	Shards    []string `json:"shards"`
+}
+
+// Each shard starts with a header naming what it's a shard of, so
+// shards never share a hash with any other blob.
+func shardHeader(oid string, i int, set erasureSet) []byte {
+	return []byte(fmt.Sprintf("cbfs-shard %v %v/%v+%v\n",
+		oid, i, set.Data, set.Parity))
+}
+
+// Split r into stripes and write each shard's units to ws.  The last
+// stripe is zero padded.  Returns the size of each shard.
+func writeStripes(r io.Reader, code *rsCode, ws []io.Writer) (int64, error) {
+	buf := make([]byte, code.data*ecStripeUnit)
+	pieces := make([][]byte, code.total())
+	for i := range pieces {
+		if i < code.data {
+			pieces[i] = buf[i*ecStripeUnit : (i+1)*ecStripeUnit]
+		} else {
+			pieces[i] = make([]byte, ecStripeUnit)
+		}
+	}
+
+	written := int64(0)
+	for {
+		n, err := io.ReadFull(r, buf)
+		switch {
+		case err == io.EOF:
+			return written, nil
+		case err != nil && err != io.ErrUnexpectedEOF:
+			return written, err
+		}
+		for i := n; i < len(buf); i++ {
+			buf[i] = 0
+		}
+		code.encode(pieces)
+		for i, w := range ws {
+			if _, err := w.Write(pieces[i]); err != nil {
+				return written, err
+			}
+		}
+		written += ecStripeUnit
+		if err == io.ErrUnexpectedEOF {
+			return written, nil
+		}
+	}
+}
+
+// Create temp files for the given shards with their headers written.
+func createShardFiles(oid string, set erasureSet, which []int) ([]*os.File, error) {
+	rv := make([]*os.File, 0, len(which))
+	for _, i := range which {
+		f, err := ioutil.TempFile(*root, "tmp")
+		if err == nil {
+			rv = append(rv, f)
+			_, err = f.Write(shardHeader(oid, i, set))
+		}
+		if err != nil {
+			removeShardFiles(rv)
+			return nil, err
+		}
+	}
+	return rv, nil
+}
+
+func removeShardFiles(fs []*os.File) {
+	for _, f := range fs {
+		f.Close()
+		os.Remove(f.Name())
+	}
+}
+
+// Store a shard file on the given node, returning its hash.
+func storeShard(f *os.File, n StorageNode) (string, error) {
+	size, err := f.Seek(0, os.SEEK_END)
+	if err == nil {
+		_, err = f.Seek(0, os.SEEK_SET)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("POST", n.URLFor(blobPrefix), f)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	res, err := n.ClientForTransfer(size).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 201 {
+		return "", fmt.Errorf("error storing shard on %v: %v", n, res.Status)
+	}
+
+	h := res.Header.Get("X-CBFS-Hash")
+	return h, markShard(h)
+}
+
+func markShard(oid string) error {
+	return couchbase.Update("/"+oid, 0, func(in []byte) ([]byte, error) {
+		ownership := BlobOwnership{}
+		if err := json.Unmarshal(in, &ownership); err != nil {
+			return nil, err
+		}
+		ownership.Shard = true
+		return json.Marshal(ownership)
+	})
+}
+
+// Pick distinct live nodes with room for a shard.
+func pickShardNodes(nl NodeList, exclude map[string]bool, count int,
+	size int64) (NodeList, error) {
+
+	candidates := NodeList{}
+	for _, n := range nl.accepting().withAtLeast(size) {
+		if !n.IsDead() && !exclude[n.name] {
+			candidates = append(candidates, n)
+		}
+	}
+	if len(candidates) < count {
+		return nil, fmt.Errorf("need %v nodes for shards, only %v available",
+			count, len(candidates))
+	}
+	for i := range candidates {
+		j := rand.Intn(i + 1)
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	}
+	return candidates[:count], nil
+}
+
+// Compute the given shards of a blob from its content and store them
+// on nodes not in exclude.  The stored shard hashes are filled in to
+// set.Shards.
+func storeShards(oid string, r io.Reader, code *rsCode, set *erasureSet,
+	which []int, nl NodeList, exclude map[string]bool) error {
+
+	files, err := createShardFiles(oid, *set, which)
+	if err != nil {
+		return err
+	}
+	defer removeShardFiles(files)
+
+	ws := make([]io.Writer, code.total())
+	for i := range ws {
+		ws[i] = ioutil.Discard
+	}
+	for i, f := range files {
+		ws[which[i]] = f
+	}
+
+	sh := newOIDHash(oid)
+	size, err := writeStripes(io.TeeReader(r, sh), code, ws)
+	if err != nil {
+		return err
+	}
+	if sh.match(oid) == "" {
+		return fmt.Errorf("content of %v hashed to %v", oid, sh.sum())
+	}
+	set.ShardSize = size
+
+	nodes, err := pickShardNodes(nl, exclude, len(which), size)
+	if err != nil {
+		return err
+	}
+	for i, f := range files {
+		h, err := storeShard(f, nodes[i])
+		if err != nil {
+			return err
+		}
+		set.Shards[which[i]] = h
+	}
+	return nil
+}
+
+// Replace the full copies of a blob with erasure coded shards.
+func erasureEncodeBlob(bo BlobOwnership, code *rsCode, nl NodeList) error {
+	set := erasureSet{
+		Data:   code.data,
+		Parity: code.parity,
+		Shards: make([]string, code.total()),
+	}
+	all := make([]int, code.total())
+	for i := range all {
+		all[i] = i
+	}
+
+	r := blobReader(bo.OID)
+	defer r.Close()
+	err := storeShards(bo.OID, r, code, &set, all, nl, nil)
+	if err != nil {
+		return err
+	}
+
+	err = couchbase.Update("/"+bo.OID, 0, func(in []byte) ([]byte, error) {
+		ownership := BlobOwnership{}
+		if err := json.Unmarshal(in, &ownership); err != nil {
+			return nil, err
+		}
+		if ownership.Garbage {
+			return nil, cb.UpdateCancel
+		}
+		ownership.EC = &set
+		return json.Marshal(ownership)
+	})
+	if err != nil {
+		// The shards are unreferenced and will be collected.
+		return err
+	}
+
+	for _, n := range nl {
+		if _, ok := bo.Nodes[n.name]; ok {
+			queueBlobRemoval(n, bo.OID)
+		}
+	}
+	return nil
+}
+
+func erasureEncodeBlobs() error {
+	if globalConfig.ErasureMinSize <= 0 {
+		return nil
+	}
+
+	code, err := newRSCode(globalConfig.ErasureDataShards,
+		globalConfig.ErasureParityShards)
+	if err != nil {
+		return err
+	}
+
+	nl, err := findAllNodes()
+	if err != nil {
+		return err
+	}
+	if len(nl) < code.total() {
+		log.Printf("Not enough nodes to erasure code %v+%v",
+			code.data, code.parity)
+		return nil
+	}
+
+	cutoff := time.Now().Add(-globalConfig.ErasureAge)
+	params := map[string]interface{}{
+		"startkey":     globalConfig.ErasureMinSize,
+		"limit":        globalConfig.ReplicationCheckLimit,
+		"include_docs": true,
+		"stale":        false,
+	}
+
+	encoded := 0
+	for {
+		viewRes := struct {
+			Rows []struct {
+				Id  string
+				Key int64
+				Doc struct {
+					Json BlobOwnership
+				}
+			}
+			Errors []cb.ViewError
+		}{}
+
+		err := couchbase.ViewCustom("cbfs", "erasure_candidates",
+			params, &viewRes)
+		if err != nil {
+			return err
+		}
+		if len(viewRes.Errors) > 0 {
+			return fmt.Errorf("View errors: %v", viewRes.Errors)
+		}
+
+		for _, r := range viewRes.Rows {
+			bo := r.Doc.Json
+			if bo.latestReference().After(cutoff) {
+				continue
+			}
+			err := erasureEncodeBlob(bo, code, nl)
+			log.Printf("Erasure coding %v (%v bytes), result=%v",
+				bo.OID, bo.Length, errorOrSuccess(err))
+			if err == nil {
+				encoded++
+			}
+			if !relockTask("erasureEncode") {
+				return errors.New("Lost lock")
+			}
+		}
+
+		if len(viewRes.Rows) < globalConfig.ReplicationCheckLimit {
+			break
+		}
+		last := viewRes.Rows[len(viewRes.Rows)-1]
+		params["startkey"] = last.Key
+		params["startkey_docid"] = last.Id
+		params["skip"] = 1
+	}
+
+	if encoded > 0 {
+		log.Printf("Erasure coded %v blobs", encoded)
+	}
+	return nil
+}
+
+// Open a shard of oid and skip past its header.
+func openShard(oid string, i int, set erasureSet) (io.ReadCloser, error) {
+	shard := set.Shards[i]
+	var rc io.ReadCloser
+	rc, err := openLocalBlob(shard)
+	if err != nil {
+		bo, err := getBlobOwnership(shard)
+		if err != nil {
+			return nil, err
+		}
+		nl := bo.ResolveNodes()
+		if len(nl) == 0 {
+			return nil, errors.New("no copies found")
+		}
+		rc, err = openRemote(shard, bo.Length, 0, nl)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	exp := shardHeader(oid, i, set)
+	hdr := make([]byte, len(exp))
+	_, err = io.ReadFull(rc, hdr)
+	if err == nil && string(hdr) != string(exp) {
+		err = fmt.Errorf("%v is not shard %v of %v", shard, i, oid)
+	}
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return rc, nil
+}
+
+// Reads the content of an erasure coded blob, reconstructing it from
+// whichever shards are available.
+type erasureReader struct {
+	oid    string
+	set    erasureSet
+	length int64
+	code   *rsCode
+
+	shards []io.ReadCloser
+	// Position in each open shard, past the header
+	spos   []int64
+	failed []bool
+
+	stripe    []byte
+	stripeNum int64
+	pos       int64
+}
+
+func openErasureSet(oid string, bo BlobOwnership) (*erasureReader, error) {
+	code, err := newRSCode(bo.EC.Data, bo.EC.Parity)
+	if err != nil {
+		return nil, err
+	}
+	return &erasureReader{
+		oid:       oid,
+		set:       *bo.EC,
+		length:    bo.Length,
+		code:      code,
+		shards:    make([]io.ReadCloser, code.total()),
+		spos:      make([]int64, code.total()),
+		failed:    make([]bool, code.total()),
+		stripeNum: -1,
+	}, nil
+}
+
+func (e *erasureReader) closeShard(i int) {
+	if e.shards[i] != nil {
+		e.shards[i].Close()
+		e.shards[i] = nil
+	}
+}
+
+// Read unit s of shard i.
+func (e *erasureReader) readUnit(i int, s int64) ([]byte, error) {
+	want := s * ecStripeUnit
+	if e.shards[i] != nil && e.spos[i] > want {
+		e.closeShard(i)
+	}
+	if e.shards[i] == nil {
+		rc, err := openShard(e.oid, i, e.set)
+		if err != nil {
+			return nil, err
+		}
+		e.shards[i], e.spos[i] = rc, 0
+	}
+
+	if e.spos[i] < want {
+		n, err := io.CopyN(ioutil.Discard, e.shards[i], want-e.spos[i])
+		e.spos[i] += n
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	buf := make([]byte, ecStripeUnit)
+	n, err := io.ReadFull(e.shards[i], buf)
+	e.spos[i] += int64(n)
+	return buf, err
+}
+
+func (e *erasureReader) loadStripe(s int64) error {
+	units := make([][]byte, e.code.total())
+	got := 0
+	// Data shards come first, so with all of them no decoding is
+	// needed.
+	for i := 0; i < e.code.total() && got < e.code.data; i++ {
+		if e.failed[i] {
+			continue
+		}
+		u, err := e.readUnit(i, s)
+		if err != nil {
+			log.Printf("Error reading shard %v of %v: %v", i, e.oid, err)
+			e.closeShard(i)
+			e.failed[i] = true
+			continue
+		}
+		units[i] = u
+		got++
+	}
+
+	if err := e.code.reconstruct(units, true); err != nil {
+		return fmt.Errorf("can't read %v: %v", e.oid, err)
+	}
+
+	if e.stripe == nil {
+		e.stripe = make([]byte, e.code.data*ecStripeUnit)
+	}
+	for i := 0; i < e.code.data; i++ {
+		copy(e.stripe[i*ecStripeUnit:], units[i])
+	}
+	e.stripeNum = s
+	return nil
+}
+
+func (e *erasureReader) Read(p []byte) (int, error) {
+	if e.pos >= e.length {
+		return 0, io.EOF
+	}
+	stripeLen := int64(e.code.data * ecStripeUnit)
+	s := e.pos / stripeLen
+	if s != e.stripeNum {
+		if err := e.loadStripe(s); err != nil {
+			return 0, err
+		}
+	}
+	start := e.pos - s*stripeLen
+	end := stripeLen
+	if s*stripeLen+end > e.length {
+		end = e.length - s*stripeLen
+	}
+	n := copy(p, e.stripe[start:end])
+	e.pos += int64(n)
+	return n, nil
+}
+
+func (e *erasureReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case os.SEEK_CUR:
+		offset += e.pos
+	case os.SEEK_END:
+		offset += e.length
+	}
+	if offset < 0 {
+		return e.pos, errors.New("negative position")
+	}
+	e.pos = offset
+	return offset, nil
+}
+
+func (e *erasureReader) Close() error {
+	for i := range e.shards {
+		e.closeShard(i)
+	}
+	return nil
+}
+
+// Rebuild any shards of an erasure coded blob that have no copies.
+// Shards are deterministic, so rebuilt ones have the same hashes.
+// Returns the number rebuilt.
+func repairErasureSet(bo BlobOwnership, nl NodeList) (int, error) {
+	set := *bo.EC
+	set.Shards = append([]string{}, set.Shards...)
+	shards, err := getBlobs(set.Shards)
+	if err != nil {
+		return 0, err
+	}
+
+	missing := []int{}
+	holders := map[string]bool{}
+	for i, s := range set.Shards {
+		b, ok := shards[s]
+		if !ok || len(b.Nodes) == 0 {
+			missing = append(missing, i)
+			continue
+		}
+		for n := range b.Nodes {
+			holders[n] = true
+		}
+	}
+	if len(missing) == 0 {
+		return 0, nil
+	}
+	if len(set.Shards)-len(missing) < set.Data {
+		return 0, fmt.Errorf("%v has lost %v of %v shards", bo.OID,
+			len(missing), len(set.Shards))
+	}
+
+	r, err := openErasureSet(bo.OID, bo)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	err = storeShards(bo.OID, r, r.code, &set, missing, nl, holders)
+	if err != nil {
+		return 0, err
+	}
+	for _, i := range missing {
+		if set.Shards[i] != bo.EC.Shards[i] {
+			return 0, fmt.Errorf("rebuilt shard %v of %v as %v, expected %v",
+				i, bo.OID, set.Shards[i], bo.EC.Shards[i])
+		}
+	}
+	return len(missing), nil
+}
+
+func repairErasureSets() error {
+	nl, err := findAllNodes()
+	if err != nil {
+		return err
+	}
+
+	params := map[string]interface{}{
+		"limit":        globalConfig.ReplicationCheckLimit,
+		"include_docs": true,
+		"stale":        false,
+	}
+
+	repaired, failed := 0, 0
+	for {
+		viewRes := struct {
+			Rows []struct {
+				Key string
+				Doc struct {
+					Json BlobOwnership
+				}
+			}
+			Errors []cb.ViewError
+		}{}
+
+		err := couchbase.ViewCustom("cbfs", "erasure_sets", params, &viewRes)
+		if err != nil {
+			return err
+		}
+		if len(viewRes.Errors) > 0 {
+			return fmt.Errorf("View errors: %v", viewRes.Errors)
+		}
+
+		for _, r := range viewRes.Rows {
+			bo := r.Doc.Json
+			if bo.EC == nil {
+				continue
+			}
+			n, err := repairErasureSet(bo, nl)
+			if err != nil {
+				log.Printf("Error repairing %v: %v", bo.OID, err)
+				failed++
+			}
+			repaired += n
+		}
+
+		if !relockTask("erasureRepair") {
+			return errors.New("Lost lock")
+		}
+		if len(viewRes.Rows) < globalConfig.ReplicationCheckLimit {
+			break
+		}
+		params["startkey"] = viewRes.Rows[len(viewRes.Rows)-1].Key
+		params["skip"] = 1
+	}
+
+	if repaired > 0 || failed > 0 {
+		log.Printf("Rebuilt %v shards of erasure coded blobs, %v failed",
+			repaired, failed)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+	cb "github.com/couchbaselabs/go-couchbase"
+)
+
+// Integer expirations up to this many seconds are relative to now;
+// larger ones are absolute unix times (same rule as memcached).
+const maxRelativeExpiration = 60 * 60 * 24 * 30
+
+var errNotExpired = errors.New("not expired")
+
+// Parse an object expiration.  Accepts seconds (relative or absolute
+// as above), an HTTP date, or an RFC 3339 timestamp.  An empty
+// string means no expiration.
+func parseExpires(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		switch {
+		case i <= 0:
+			return time.Time{}, fmt.Errorf("invalid expiration: %v", s)
+		case i <= maxRelativeExpiration:
+			return now.Add(time.Duration(i) * time.Second).UTC(), nil
+		}
+		return time.Unix(i, 0).UTC(), nil
+	}
+	if t, err := http.ParseTime(s); err == nil {
+		return t.UTC(), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid expiration: %q", s)
+}
+
+// The raw expiration requested by an upload, from the X-CBFS-Expires
+// header or the expires query parameter.
+func requestedExpires(req *http.Request) string {
+	if h := req.Header.Get("X-CBFS-Expires"); h != "" {
+		return h
+	}
+	return req.URL.Query().Get("expires")
+}
+
+// A locked file doesn't expire until its retention runs out.
+func (fm fileMeta) expired(now time.Time) bool {
+	return !fm.Expires.IsZero() && !fm.Expires.After(now) && !fm.retained(now)
+}
+
+// Remove the file at k if it's still expired.
+func removeExpiredFile(k string, now time.Time) error {
+	fm := fileMeta{}
+	err := couchbase.Update(k, 0, func(in []byte) ([]byte, error) {
+		fm = fileMeta{}
+		if err := json.Unmarshal(in, &fm); err != nil {
+			return in, err
+		}
+		if fm.Type != "file" || !fm.expired(now) {
+			return in, errNotExpired
+		}
+		return nil, nil
+	})
+	if err == nil {
+		duFileChanged(eventPath(k, fm), fm, fileMeta{})
+		notifyObject("deleted", eventPath(k, fm), fm)
+	}
+	return err
+}
+
+// Delete files whose expiration has passed.  Their blobs are left
+// for the garbage collector, which is kicked off if anything went.
+func expireFiles() error {
+	now := time.Now().UTC()
+	params := map[string]interface{}{
+		"stale":  false,
+		"endkey": now.Format(time.RFC3339Nano),
+		"limit":  globalConfig.GCLimit,
+	}
+
+	count := 0
+	for {
+		viewRes := struct {
+			Rows []struct {
+				ID  string
+				Key string
+			}
+			Errors []cb.ViewError
+		}{}
+		err := couchbase.ViewCustom("cbfs", "file_expirations",
+			params, &viewRes)
+		if err != nil {
+			return err
+		}
+		if len(viewRes.Errors) > 0 {
+			return fmt.Errorf("View errors: %v", viewRes.Errors)
+		}
+
+		removed := 0
+		for _, r := range viewRes.Rows {
+			err := removeExpiredFile(r.ID, now)
+			switch {
+			case err == nil:
+				removed++
+			case err == errNotExpired, gomemcached.IsNotFound(err):
+			default:
+				log.Printf("Error expiring %v: %v", r.ID, err)
+			}
+		}
+		count += removed
+
+		if len(viewRes.Rows) < globalConfig.GCLimit {
+			break
+		}
+		if !relockTask("expireFiles") {
+			return errors.New("Lost lock")
+		}
+
+		// Go on from the last row rather than the start, so files
+		// that stay (retained, or failing to delete) don't hold up
+		// those after them.
+		last := viewRes.Rows[len(viewRes.Rows)-1]
+		params["startkey"] = last.Key
+		params["startkey_docid"] = last.ID
+		params["skip"] = 1
+	}
+
+	if count > 0 {
+		log.Printf("Expired %v files", count)
+		atomic.AddUint64(&filesExpired, uint64(count))
+		if err := induceTask("garbageCollectBlobs"); err != nil &&
+			err != taskAlreadyQueued {
+			log.Printf("Error starting garbage collection: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseExpires(t *testing.T) {
+	now := time.Date(2013, 4, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in  string
+		exp time.Time
+	}{
+		{"", time.Time{}},
+		{"60", now.Add(time.Minute)},
+		{"2592000", now.Add(30 * 24 * time.Hour)},
+		{"1400000000", time.Unix(1400000000, 0).UTC()},
+		{"Mon, 01 Apr 2013 13:00:00 GMT", now.Add(time.Hour)},
+		{"2013-04-02T12:00:00Z", now.Add(24 * time.Hour)},
+		{"2013-04-01T14:00:00+02:00", now},
+	}
+
+	for _, test := range tests {
+		got, err := parseExpires(test.in, now)
+		if err != nil {
+			t.Errorf("Error parsing %q: %v", test.in, err)
+			continue
+		}
+		if !got.Equal(test.exp) {
+			t.Errorf("Expected %v for %q, got %v", test.exp, test.in, got)
+		}
+	}
+
+	for _, in := range []string{"0", "-5", "tomorrow", "1.5"} {
+		if got, err := parseExpires(in, now); err == nil {
+			t.Errorf("Expected error parsing %q, got %v", in, got)
+		}
+	}
+}
+
+func TestFileExpired(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		expires time.Time
+		exp     bool
+	}{
+		{time.Time{}, false},
+		{now.Add(time.Second), false},
+		{now, true},
+		{now.Add(-time.Hour), true},
+	}
+
+	for _, test := range tests {
+		fm := fileMeta{Expires: test.expires}
+		if got := fm.expired(now); got != test.exp {
+			t.Errorf("Expected %v for %v, got %v", test.exp, test.expires, got)
+		}
+	}
+}
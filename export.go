@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"log"
 	"net/http"
 )
@@ -16,7 +17,10 @@ func doExport(w http.ResponseWriter, req *http.Request,
 	go pathGenerator(path, ch, cherr, quit)
 	go logErrors("export", cherr)
 
-	err := streamFileMeta(w, ch, cherr)
+	enc := json.NewEncoder(w)
+	err := streamFileMeta(func(_ string, rec interface{}) error {
+		return enc.Encode(rec)
+	}, ch, cherr, nil)
 	if err != nil {
 		log.Printf("Error exporting meta: %v", err)
 	}
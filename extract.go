@@ -0,0 +1,384 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+const (
+	extractKeyPrefix = "/@extract/"
+	// How long the outcome of a finished extraction stays around
+	extractKeep = 24 * time.Hour
+	// Archive entries up to this size are read ahead for the workers.
+	// Bigger ones are stored as they're read.
+	extractBufferSize = 1024 * 1024
+	// Most workers an extraction may ask for.
+	extractMaxWorkers = 32
+)
+
+var errNoSuchExtract = errors.New("no such task")
+
+// What's recorded of a server-side unpacking of an archive into
+// files under a path.
+type extractStatus struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Path      string    `json:"path"`
+	Format    string    `json:"format"`
+	Node      string    `json:"node"`
+	State     string    `json:"state"`
+	Files     int64     `json:"files"`
+	Bytes     int64     `json:"bytes"`
+	Errors    int64     `json:"errors"`
+	LastError string    `json:"lastError,omitempty"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+}
+
+// An extraction running on this node.  The workers count with
+// atomics; the rest of the status is guarded by mu.
+type extractTask struct {
+	extractStatus
+	mu                   sync.Mutex
+	files, bytes, errors int64
+}
+
+func isExtractID(id string) bool {
+	return strings.HasPrefix(id, "extract-")
+}
+
+func getExtractTask(id string) (extractStatus, error) {
+	et := extractStatus{}
+	err := couchbase.Get(extractKeyPrefix+id, &et)
+	if gomemcached.IsNotFound(err) || (err == nil && et.Type != "extract") {
+		err = errNoSuchExtract
+	}
+	return et, err
+}
+
+// One file in an archive.
+type extractEntry struct {
+	name string
+	size int64
+	open func() (io.Reader, error)
+}
+
+// Walks an archive, sending entries that can be stored in any order
+// to ch and storing the rest itself.
+type extractWalker func(f *os.File, size int64,
+	ch chan<- extractEntry, store func(extractEntry)) error
+
+var extractFormats = map[string]extractWalker{
+	"tar":    walkTar(false),
+	"tar.gz": walkTar(true),
+	"tgz":    walkTar(true),
+	"zip":    walkZip,
+}
+
+func walkTar(gz bool) extractWalker {
+	return func(f *os.File, size int64,
+		ch chan<- extractEntry, store func(extractEntry)) error {
+
+		var r io.Reader = f
+		if gz {
+			gzr, err := gzip.NewReader(f)
+			if err != nil {
+				return err
+			}
+			defer gzr.Close()
+			r = gzr
+		}
+
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+				continue
+			}
+
+			if hdr.Size > extractBufferSize {
+				store(extractEntry{hdr.Name, hdr.Size,
+					func() (io.Reader, error) { return tr, nil }})
+				continue
+			}
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			ch <- extractEntry{hdr.Name, hdr.Size,
+				func() (io.Reader, error) {
+					return bytes.NewReader(data), nil
+				}}
+		}
+	}
+}
+
+func walkZip(f *os.File, size int64,
+	ch chan<- extractEntry, store func(extractEntry)) error {
+
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		return err
+	}
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		zf := zf
+		ch <- extractEntry{zf.Name, int64(zf.UncompressedSize64),
+			func() (io.Reader, error) { return zf.Open() }}
+	}
+	return nil
+}
+
+// Guess an archive's format from its first few bytes.
+func sniffArchive(f *os.File) string {
+	b := make([]byte, 4)
+	n, _ := f.ReadAt(b, 0)
+	switch {
+	case n >= 4 && string(b) == "PK\x03\x04":
+		return "zip"
+	case n >= 2 && b[0] == 0x1f && b[1] == 0x8b:
+		return "tar.gz"
+	}
+	return "tar"
+}
+
+// Where an archive entry goes, never outside the prefix.
+func extractPath(prefix, name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" || prefix == "" {
+		return name
+	}
+	return prefix + "/" + name
+}
+
+func (et *extractTask) snapshot() extractStatus {
+	et.mu.Lock()
+	rv := et.extractStatus
+	et.mu.Unlock()
+	rv.Files = atomic.LoadInt64(&et.files)
+	rv.Bytes = atomic.LoadInt64(&et.bytes)
+	rv.Errors = atomic.LoadInt64(&et.errors)
+	return rv
+}
+
+func (et *extractTask) store() error {
+	return couchbase.Set(extractKeyPrefix+et.ID,
+		int(extractKeep.Seconds()), et.snapshot())
+}
+
+func (et *extractTask) failed(err error) {
+	atomic.AddInt64(&et.errors, 1)
+	et.mu.Lock()
+	et.LastError = err.Error()
+	et.mu.Unlock()
+}
+
+func (et *extractTask) progress() {
+	setTaskDetail(et.ID, fmt.Sprintf("extracted %v files into %v, %v errors",
+		atomic.LoadInt64(&et.files), et.Path, atomic.LoadInt64(&et.errors)))
+	if err := et.store(); err != nil {
+		log.Printf("Error recording progress of %v: %v", et.ID, err)
+	}
+}
+
+// Store one archive entry as a file.
+func (et *extractTask) extract(e extractEntry) {
+	fn := extractPath(et.Path, e.name)
+	if fn == "" {
+		return
+	}
+	err := func() error {
+		r, err := e.open()
+		if err != nil {
+			return err
+		}
+		if rc, ok := r.(io.Closer); ok {
+			defer rc.Close()
+		}
+		req, err := localMirrorRequest("PUT", fn, r)
+		if err != nil {
+			return err
+		}
+		req.ContentLength = e.size
+		if ct := mime.TypeByExtension(path.Ext(fn)); ct != "" {
+			req.Header.Set("Content-Type", ct)
+		}
+		return serveLocalMirror(putUserFile, req, 201)
+	}()
+	if err != nil {
+		log.Printf("Error extracting %v: %v", fn, err)
+		et.failed(fmt.Errorf("%v: %v", fn, err))
+		return
+	}
+	atomic.AddInt64(&et.files, 1)
+	atomic.AddInt64(&et.bytes, e.size)
+}
+
+func (et *extractTask) run(f *os.File, size int64, workers int) {
+	defer setTaskState(et.ID, "")
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	ch := make(chan extractEntry)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range ch {
+				et.extract(e)
+			}
+		}()
+	}
+
+	done := make(chan bool)
+	go func() {
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				et.progress()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err := extractFormats[et.Format](f, size, ch, et.extract)
+	close(ch)
+	wg.Wait()
+	close(done)
+	if err != nil {
+		et.failed(err)
+	}
+
+	et.mu.Lock()
+	et.State = "done"
+	if atomic.LoadInt64(&et.errors) > 0 {
+		et.State = "failed"
+	}
+	et.Finished = time.Now().UTC()
+	et.mu.Unlock()
+	if err := et.store(); err != nil {
+		log.Printf("Error recording completion of %v: %v", et.ID, err)
+	}
+	log.Printf("Extracted %v files into %v (%v errors)",
+		atomic.LoadInt64(&et.files), et.Path, atomic.LoadInt64(&et.errors))
+}
+
+// POST /.cbfs/extract/<path> unpacks the archive in the body into
+// files under path in the background.
+func doExtract(w http.ResponseWriter, req *http.Request, path string) {
+	path = strings.Trim(path, "/")
+	if strings.Contains(path, "//") {
+		http.Error(w,
+			fmt.Sprintf("Too many slashes in the path name: %v", path), 400)
+		return
+	}
+
+	workers := 4
+	if s := req.FormValue("workers"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > extractMaxWorkers {
+			http.Error(w, "Invalid workers: "+s, 400)
+			return
+		}
+		workers = n
+	}
+
+	format := req.FormValue("format")
+	if _, ok := extractFormats[format]; format != "" && !ok {
+		http.Error(w, "Unsupported archive format: "+format, 400)
+		return
+	}
+
+	// Spool the archive so it can be unpacked after we respond.
+	f, err := ioutil.TempFile(pickVolume(), "tmp")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	size, err := io.Copy(f, req.Body)
+	if err == nil && format == "" {
+		format = sniffArchive(f)
+	}
+	if err == nil {
+		_, err = f.Seek(0, 0)
+	}
+	var id string
+	if err == nil {
+		id, err = newRandomID("extract-", 8)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		http.Error(w, "Error reading archive: "+err.Error(), 500)
+		return
+	}
+
+	et := &extractTask{extractStatus: extractStatus{
+		ID:      id,
+		Type:    "extract",
+		Path:    path,
+		Format:  format,
+		Node:    serverId,
+		State:   "running",
+		Started: time.Now().UTC(),
+	}}
+	if err := et.store(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if err := setTaskState(id, "running"); err != nil {
+		log.Printf("Error recording task %v: %v", id, err)
+	}
+	go et.run(f, size, workers)
+
+	w.Header().Set("Location", taskPrefix+id)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(202)
+	fmt.Fprintf(w, "{\"id\": %q}\n", id)
+}
+
+func doGetExtract(w http.ResponseWriter, req *http.Request, id string) {
+	et, err := getExtractTask(id)
+	switch err {
+	case nil:
+	case errNoSuchExtract:
+		http.Error(w, err.Error(), 404)
+		return
+	default:
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	sendJson(w, req, &et)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"testing"
+)
+
+func TestExtractPath(t *testing.T) {
+	tests := []struct {
+		prefix, name, exp string
+	}{
+		{"data", "a/b.txt", "data/a/b.txt"},
+		{"data", "/a/b.txt", "data/a/b.txt"},
+		{"data", "../../etc/passwd", "data/etc/passwd"},
+		{"data", "a/../../b", "data/b"},
+		{"", "a/./b", "a/b"},
+		{"data", "/", ""},
+	}
+
+	for _, test := range tests {
+		if got := extractPath(test.prefix, test.name); got != test.exp {
+			t.Errorf("Expected %q for %q in %q, got %q",
+				test.exp, test.name, test.prefix, got)
+		}
+	}
+}
+
+// Write an archive with a file to a temp file and walk it back.
+func walkTestArchive(t *testing.T, format string,
+	write func(w io.Writer)) map[string]string {
+
+	f, err := ioutil.TempFile("", "extracttest")
+	if err != nil {
+		t.Fatalf("Error making temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	write(f)
+
+	if got := sniffArchive(f); got != format {
+		t.Errorf("Expected to sniff %v, got %v", format, got)
+	}
+	size, _ := f.Seek(0, 2)
+	f.Seek(0, 0)
+
+	got := map[string]string{}
+	keep := func(e extractEntry) {
+		r, err := e.open()
+		if err != nil {
+			t.Fatalf("Error opening %v: %v", e.name, err)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Error reading %v: %v", e.name, err)
+		}
+		got[e.name] = string(data)
+	}
+	ch := make(chan extractEntry)
+	done := make(chan bool)
+	go func() {
+		for e := range ch {
+			keep(e)
+		}
+		close(done)
+	}()
+	err = extractFormats[format](f, size, ch, keep)
+	close(ch)
+	<-done
+	if err != nil {
+		t.Fatalf("Error walking %v: %v", format, err)
+	}
+	return got
+}
+
+func TestWalkArchives(t *testing.T) {
+	exp := map[string]string{"a.txt": "hello", "d/b.txt": "world"}
+	names := []string{}
+	for n := range exp {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	got := walkTestArchive(t, "tar", func(w io.Writer) {
+		tw := tar.NewWriter(w)
+		tw.WriteHeader(&tar.Header{Name: "d/", Typeflag: tar.TypeDir})
+		for _, n := range names {
+			tw.WriteHeader(&tar.Header{Name: n, Mode: 0644,
+				Size: int64(len(exp[n]))})
+			io.WriteString(tw, exp[n])
+		}
+		tw.Close()
+	})
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v from tar, got %v", exp, got)
+	}
+
+	got = walkTestArchive(t, "zip", func(w io.Writer) {
+		zw := zip.NewWriter(w)
+		zw.Create("d/")
+		for _, n := range names {
+			zf, _ := zw.Create(n)
+			io.WriteString(zf, exp[n])
+		}
+		zw.Close()
+	})
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v from zip, got %v", exp, got)
+	}
+}
+
+func TestExtractSnapshot(t *testing.T) {
+	et := &extractTask{extractStatus: extractStatus{ID: "extract-x",
+		State: "running"}}
+	et.failed(errors.New("oops"))
+	atomic.AddInt64(&et.files, 2)
+	atomic.AddInt64(&et.bytes, 10)
+
+	s := et.snapshot()
+	if s.Files != 2 || s.Bytes != 10 || s.Errors != 1 ||
+		s.LastError != "oops" || s.ID != "extract-x" {
+		t.Errorf("Unexpected snapshot %+v", s)
+	}
+}
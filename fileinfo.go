@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Lists the nodes that can serve a whole file from their own disks.
+const fileNodesHeader = "X-CBFS-Nodes"
+
+// The nodes holding every blob a file is made of, freshest first.
+// Any of them can serve it without fetching from elsewhere.
+func fileNodes(fm fileMeta) (NodeList, error) {
+	oids := []string{fm.OID}
+	if len(fm.Parts) > 0 {
+		oids = oids[:0]
+		for _, p := range fm.Parts {
+			oids = append(oids, p.OID)
+		}
+	}
+	blobs, err := getBlobs(oids)
+	if err != nil {
+		return nil, err
+	}
+
+	var common map[string]bool
+	for _, oid := range oids {
+		have := map[string]bool{}
+		for n := range blobs[oid].Nodes {
+			if common == nil || common[n] {
+				have[n] = true
+			}
+		}
+		common = have
+	}
+	if len(common) == 0 {
+		return NodeList{}, nil
+	}
+
+	all, err := findAllNodes()
+	if err != nil {
+		return nil, err
+	}
+	rv := NodeList{}
+	for _, n := range all {
+		if common[n.name] {
+			rv = append(rv, n)
+		}
+	}
+	return rv, nil
+}
+
+// Add the headers describing a file beyond what any GET has.
+func setFileInfoHeaders(w http.ResponseWriter, path string, fm fileMeta) {
+	w.Header().Set("X-CBFS-Hash", fm.OID)
+	if len(fm.Parts) > 0 {
+		w.Header().Set("X-CBFS-Parts", strconv.Itoa(len(fm.Parts)))
+	}
+	nl, err := fileNodes(fm)
+	if err != nil {
+		log.Printf("Error finding the nodes holding %v: %v", path, err)
+		return
+	}
+	addrs := make([]string, 0, len(nl))
+	for _, n := range nl {
+		addrs = append(addrs, n.Address())
+	}
+	w.Header().Set(fileNodesHeader, strings.Join(addrs, ", "))
+}
+
+// GET /path?meta=json describes a file instead of sending it.
+func sendFileInfo(w http.ResponseWriter, req *http.Request, path string,
+	fm fileMeta) {
+
+	nl, err := fileNodes(fm)
+	if err != nil {
+		http.Error(w, "Error finding nodes: "+err.Error(), 500)
+		return
+	}
+	nodes := []map[string]string{}
+	for _, n := range nl {
+		node := map[string]string{"name": n.name, "addr": n.Address()}
+		if n.Zone != "" {
+			node["zone"] = n.Zone
+		}
+		nodes = append(nodes, node)
+	}
+
+	meta := map[string]string{}
+	for k := range fm.Headers {
+		if isUserMetaHeader(k) {
+			meta[strings.ToLower(k[len(userMetaPrefix):])] = fm.Headers.Get(k)
+		}
+	}
+
+	oldestRev := fm.Revno
+	if len(fm.Previous) > 0 {
+		oldestRev = fm.Previous[0].Revno
+	}
+
+	rv := map[string]interface{}{
+		"path":      path,
+		"oid":       fm.OID,
+		"length":    fm.Length,
+		"ctype":     fm.Headers.Get("Content-Type"),
+		"modified":  fm.Modified,
+		"revno":     fm.Revno,
+		"oldestRev": oldestRev,
+		"meta":      meta,
+		"nodes":     nodes,
+	}
+	if len(fm.Parts) > 0 {
+		rv["parts"] = len(fm.Parts)
+	}
+	if !fm.Expires.IsZero() {
+		rv["expires"] = fm.Expires
+	}
+	if fm.retained(time.Now()) {
+		rv["retainUntil"] = fm.RetainUntil
+	}
+	if len(fm.Pinned) > 0 {
+		rv["pinned"] = fm.Pinned
+	}
+	sendJson(w, req, rv)
+}
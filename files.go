@@ -1,14 +1,12 @@
 package main
 
 import (
-	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 )
 
@@ -27,13 +25,26 @@ type ReadSeekCloser interface {
 }
 
 func openLocalBlob(hstr string) (ReadSeekCloser, error) {
-	return os.Open(hashFilename(*root, hstr))
+	f, err := os.Open(blobFilename(hstr))
+	if err != nil {
+		return nil, err
+	}
+	rv, err := maybeDecrypt(f)
+	if err != nil {
+		f.Close()
+	}
+	return rv, err
+}
+
+func localBlobSize(info os.FileInfo) int64 {
+	return blobContentSize(blobFilename(info.Name()), info)
 }
 
 func removeObject(h string) error {
 	err := maybeRemoveBlobOwnership(h)
 	if err == nil {
-		err = os.Remove(hashFilename(*root, h))
+		hotBlobCache().forget(h)
+		err = os.Remove(blobFilename(h))
 		log.Printf("Removed local copy of %v, result=%v",
 			h, errorOrSuccess(err))
 	}
@@ -42,7 +53,8 @@ func removeObject(h string) error {
 
 func forceRemoveObject(h string) error {
 	removeBlobOwnershipRecord(h, serverId)
-	return os.Remove(hashFilename(*root, h))
+	hotBlobCache().forget(h)
+	return os.Remove(blobFilename(h))
 }
 
 func verifyObjectHash(h string) error {
@@ -52,14 +64,14 @@ func verifyObjectHash(h string) error {
 	}
 	defer f.Close()
 
-	sh := getHash()
+	sh := newOIDHash(h)
 	_, err = io.Copy(sh, f)
 	if err != nil {
 		return err
 	}
 
-	hstring := hex.EncodeToString(sh.Sum([]byte{}))
-	if h != hstring {
+	if sh.match(h) == "" {
+		hstring := sh.sum()
 		err = forceRemoveObject(h)
 		log.Printf("Removed corrupt file from disk: %v (was %v), result=%v",
 			h, hstring, errorOrSuccess(err))
@@ -91,7 +103,7 @@ func verifyWorker(ch chan os.FileInfo) {
 			force = true
 		}
 		if err == nil {
-			recordBlobOwnership(info.Name(), info.Size(), force)
+			recordBlobOwnership(info.Name(), localBlobSize(info), force)
 		} else {
 			log.Printf("Invalid hash for object %v found at verification: %v",
 				info.Name(), err)
@@ -105,13 +117,11 @@ func verifyWorker(ch chan os.FileInfo) {
 
 func quickVerifyWorker(ch chan os.FileInfo) {
 	for info := range ch {
-		recordBlobOwnership(info.Name(), info.Size(), false)
+		recordBlobOwnership(info.Name(), localBlobSize(info), false)
 	}
 }
 
 func reconcileWith(wf func(chan os.FileInfo)) error {
-	explen := getHash().Size() * 2
-
 	vch := make(chan os.FileInfo)
 	defer close(vch)
 
@@ -119,17 +129,8 @@ func reconcileWith(wf func(chan os.FileInfo)) error {
 		go wf(vch)
 	}
 
-	return filepath.Walk(*root, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() && !strings.HasPrefix(info.Name(), "tmp") &&
-			len(info.Name()) == explen {
-
-			vch <- info
-
-			return err
-		}
+	return walkLocalBlobs(func(info os.FileInfo) error {
+		vch <- info
 		return nil
 	})
 }
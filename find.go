@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	findViewPage = 1000
+	// Most files a single find request looks at, so requests over
+	// big trees with few matches return (with a token) in
+	// reasonable time.
+	findMaxScan    = 100000
+	findLimit      = 1000
+	findTimeFormat = time.RFC3339
+)
+
+// What a find matches.  Zero values match anything.
+type findQuery struct {
+	name    string // glob on the file's base name
+	iname   string // case insensitive name
+	minSize int64
+	maxSize int64 // 0 for no limit
+	newer   time.Time
+	older   time.Time
+	ctype   string // content type prefix
+	// user metadata that must be present, with the value if it's
+	// not empty
+	meta map[string]string
+}
+
+type findResult struct {
+	Path string   `json:"path"`
+	Meta fileMeta `json:"meta"`
+}
+
+func parseFindQuery(req *http.Request) (findQuery, error) {
+	q := findQuery{
+		name:  req.FormValue("name"),
+		iname: strings.ToLower(req.FormValue("iname")),
+		ctype: req.FormValue("ctype"),
+		meta:  map[string]string{},
+	}
+	for _, p := range []string{q.name, q.iname} {
+		if _, err := path.Match(p, ""); err != nil {
+			return q, fmt.Errorf("invalid pattern %q: %v", p, err)
+		}
+	}
+
+	for _, s := range []struct {
+		param string
+		into  *int64
+	}{{"minsize", &q.minSize}, {"maxsize", &q.maxSize}} {
+		v := req.FormValue(s.param)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return q, fmt.Errorf("invalid %v: %q", s.param, v)
+		}
+		*s.into = n
+	}
+
+	for _, s := range []struct {
+		param string
+		into  *time.Time
+	}{{"newer", &q.newer}, {"older", &q.older}} {
+		v := req.FormValue(s.param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(findTimeFormat, v)
+		if err != nil {
+			return q, fmt.Errorf("invalid %v: %q", s.param, v)
+		}
+		*s.into = t
+	}
+
+	for _, m := range req.Form["meta"] {
+		parts := strings.SplitN(m, "=", 2)
+		if parts[0] == "" {
+			return q, fmt.Errorf("invalid meta: %q", m)
+		}
+		v := ""
+		if len(parts) == 2 {
+			v = parts[1]
+		}
+		q.meta[strings.ToLower(parts[0])] = v
+	}
+	return q, nil
+}
+
+func (q findQuery) matches(fn string, fm fileMeta) bool {
+	base := path.Base(fn)
+	if q.name != "" {
+		if ok, _ := path.Match(q.name, base); !ok {
+			return false
+		}
+	}
+	if q.iname != "" {
+		if ok, _ := path.Match(q.iname, strings.ToLower(base)); !ok {
+			return false
+		}
+	}
+	switch {
+	case fm.Length < q.minSize,
+		q.maxSize > 0 && fm.Length > q.maxSize,
+		!q.newer.IsZero() && !fm.Modified.After(q.newer),
+		!q.older.IsZero() && !fm.Modified.Before(q.older),
+		!strings.HasPrefix(fm.Headers.Get("Content-Type"), q.ctype):
+		return false
+	}
+	for k, v := range q.meta {
+		got, ok := fm.Headers[http.CanonicalHeaderKey(userMetaPrefix+k)]
+		if !ok || (v != "" && (len(got) == 0 || got[0] != v)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Find up to limit files under a directory, starting after the file
+// named by after.  Returns the path to continue from if the search
+// stopped early.
+func findFiles(dir string, q findQuery, limit int,
+	after string) ([]findResult, string, error) {
+
+	prefix := []interface{}{}
+	if dir != "" {
+		for _, k := range strings.Split(dir, "/") {
+			prefix = append(prefix, k)
+		}
+	}
+	startKey := prefix
+	if after != "" {
+		startKey = []interface{}{}
+		for _, k := range strings.Split(after, "/") {
+			startKey = append(startKey, k)
+		}
+	}
+	endKey := append(append([]interface{}{}, prefix...),
+		&(json.RawMessage{'{', '}'}))
+
+	now := time.Now()
+	rv := []findResult{}
+	scanned := 0
+	for {
+		viewRes := struct {
+			Rows []struct {
+				Key []string
+				ID  string
+			}
+		}{}
+		err := couchbase.ViewCustom("cbfs", "file_browse",
+			map[string]interface{}{
+				"reduce":    false,
+				"limit":     findViewPage,
+				"start_key": startKey,
+				"end_key":   endKey,
+			}, &viewRes)
+		if err != nil {
+			return nil, "", err
+		}
+
+		ids := make([]string, 0, len(viewRes.Rows))
+		for _, r := range viewRes.Rows {
+			ids = append(ids, r.ID)
+		}
+		docs, err := couchbase.GetBulk(ids)
+		if err != nil {
+			return nil, "", err
+		}
+
+		for _, r := range viewRes.Rows {
+			fn := strings.Join(r.Key, "/")
+			if fn == after {
+				continue
+			}
+			after = fn
+			scanned++
+
+			res, ok := docs[r.ID]
+			fm := fileMeta{}
+			if !ok || json.Unmarshal(res.Body, &fm) != nil ||
+				fm.expired(now) || !q.matches(fn, fm) {
+				continue
+			}
+			rv = append(rv, findResult{fn, fm})
+			if len(rv) >= limit || scanned >= findMaxScan {
+				return rv, fn, nil
+			}
+		}
+
+		if len(viewRes.Rows) < findViewPage {
+			return rv, "", nil
+		}
+		if scanned >= findMaxScan {
+			return rv, after, nil
+		}
+		startKey = []interface{}{}
+		for _, k := range viewRes.Rows[len(viewRes.Rows)-1].Key {
+			startKey = append(startKey, k)
+		}
+	}
+}
+
+func doFind(w http.ResponseWriter, req *http.Request, dir string) {
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	dir = strings.Trim(dir, "/")
+
+	q, err := parseFindQuery(req)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	limit := findLimit
+	if s := req.FormValue("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, fmt.Sprintf("Invalid limit: %q", s), 400)
+			return
+		}
+		limit = n
+	}
+
+	after := ""
+	if tok := req.FormValue("continuation-token"); tok != "" {
+		b, err := base64.URLEncoding.DecodeString(tok)
+		if err != nil || !strings.HasPrefix(string(b), dir) {
+			http.Error(w, errBadListToken.Error(), 400)
+			return
+		}
+		after = string(b)
+	}
+
+	found, next, err := findFiles(dir, q, limit, after)
+	if err != nil {
+		log.Printf("Error finding files under %q: %v", dir, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	rv := struct {
+		Files []findResult `json:"files"`
+		Next  string       `json:"continuationToken,omitempty"`
+	}{Files: found}
+	if next != "" {
+		rv.Next = base64.URLEncoding.EncodeToString([]byte(next))
+	}
+	sendJson(w, req, rv)
+}
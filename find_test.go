@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFindMatches(t *testing.T) {
+	mod := time.Date(2014, 3, 1, 0, 0, 0, 0, time.UTC)
+	fm := fileMeta{
+		Headers: http.Header{
+			"Content-Type":      {"image/png"},
+			"X-Cbfs-Meta-Owner": {"bob"},
+		},
+		Length:   1000,
+		Modified: mod,
+	}
+
+	tests := []struct {
+		query string
+		exp   bool
+	}{
+		{"", true},
+		{"name=*.png", true},
+		{"name=*.PNG", false},
+		{"iname=*.PNG", true},
+		{"name=a*", false},
+		{"minsize=1000&maxsize=1000", true},
+		{"minsize=1001", false},
+		{"maxsize=999", false},
+		{"newer=2014-02-01T00:00:00Z&older=2014-04-01T00:00:00Z", true},
+		{"newer=2014-03-01T00:00:00Z", false},
+		{"older=2014-03-01T00:00:00Z", false},
+		{"ctype=image/", true},
+		{"ctype=text/", false},
+		{"meta=owner", true},
+		{"meta=Owner=bob", true},
+		{"meta=owner=al", false},
+		{"meta=source", false},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", findPrefix+"a/?"+test.query, nil)
+		if err != nil {
+			t.Fatalf("Error making request: %v", err)
+		}
+		q, err := parseFindQuery(req)
+		if err != nil {
+			t.Errorf("Error parsing %q: %v", test.query, err)
+			continue
+		}
+		if got := q.matches("a/b/pic.png", fm); got != test.exp {
+			t.Errorf("Expected %v for %q, got %v", test.exp, test.query, got)
+		}
+	}
+}
+
+func TestFindQueryInvalid(t *testing.T) {
+	for _, query := range []string{"name=[", "minsize=x", "maxsize=-1",
+		"newer=yesterday", "meta==x"} {
+
+		req, err := http.NewRequest("GET", findPrefix+"?"+query, nil)
+		if err != nil {
+			t.Fatalf("Error making request: %v", err)
+		}
+		if _, err := parseFindQuery(req); err == nil {
+			t.Errorf("Expected an error parsing %q", query)
+		}
+	}
+}
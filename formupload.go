@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/couchbaselabs/cbfs/config"
+)
+
+// Store a file sent from an HTML form (multipart/form-data), as a
+// browser would post it.  The content comes from the "file" field.
+// If the path ends in a slash, the name of the uploaded file is
+// appended to it.
+func doFormUpload(w http.ResponseWriter, req *http.Request, path string) {
+	mr, err := req.MultipartReader()
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	q := req.URL.Query()
+	signed := q.Get(cbfsconfig.SignatureParam) != ""
+	policy := cbfsconfig.ParseUploadPolicy(q)
+
+	for {
+		part, err := mr.NextPart()
+		switch {
+		case err == io.EOF:
+			http.Error(w, "no file in form", 400)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if part.FormName() != "file" {
+			continue
+		}
+
+		fn := path
+		if fn == "" || strings.HasSuffix(fn, "/") {
+			name := part.FileName()
+			if name == "" || strings.Contains(name, "/") {
+				http.Error(w, "missing or invalid file name", 400)
+				return
+			}
+			if signed && policy.Prefix == "" {
+				// Only the exact path was signed.
+				http.Error(w, cbfsconfig.ErrOutsidePrefix.Error(), 403)
+				return
+			}
+			fn += name
+		}
+
+		ctype := part.Header.Get("Content-Type")
+		if err := policy.Allows(-1, ctype); err != nil {
+			http.Error(w, err.Error(), signatureErrorCode(err))
+			return
+		}
+
+		var body io.ReadCloser = part
+		if policy.MaxSize > 0 {
+			body = http.MaxBytesReader(w, part, policy.MaxSize)
+		}
+
+		putUserFile(w, &http.Request{
+			Method:        "PUT",
+			URL:           &url.URL{Path: "/" + fn, RawQuery: req.URL.RawQuery},
+			Header:        http.Header{"Content-Type": []string{ctype}},
+			Body:          body,
+			ContentLength: -1,
+			RemoteAddr:    req.RemoteAddr,
+		})
+		return
+	}
+}
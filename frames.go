@@ -126,7 +126,7 @@ func checkFrameClient(addr string) {
 }
 
 func connectNewFramesClient(addr string) *frameClient {
-	c, err := net.DialTimeout("tcp", addr, frameConnectTimeout)
+	c, err := dialNode(addr, &net.Dialer{Timeout: frameConnectTimeout})
 	if err != nil {
 		log.Printf("Error connecting to %v: %v", addr, err)
 		return nil
@@ -136,7 +136,7 @@ func connectNewFramesClient(addr string) *frameClient {
 		Dialer:  conn,
 		Timeout: time.Second * 5,
 	}
-	hc := &http.Client{Transport: frt}
+	hc := &http.Client{Transport: nodeAuthTransport{hopTransport{frt}}}
 	frameClientsLock.Lock()
 	defer frameClientsLock.Unlock()
 
@@ -158,7 +158,7 @@ func getFrameClient(addr string) *http.Client {
 	}
 	if fc == nil {
 		log.Printf("Failed to find or get frames client for %v", addr)
-		return http.DefaultClient
+		return nodeHTTPClient
 	}
 	return fc.client
 }
@@ -173,7 +173,7 @@ func serveFrame() {
 		log.Fatalf("Error setting up frames listener.")
 	}
 
-	ll, err := frames.ListenerListener(l)
+	ll, err := frames.ListenerListener(maybeTLSListener(l))
 	if err != nil {
 		log.Fatalf("Error listen listening: %v", err)
 	}
@@ -182,5 +182,5 @@ func serveFrame() {
 		Handler: http.HandlerFunc(httpHandler),
 	}
 
-	log.Fatal(s.Serve(ll))
+	serveUntilShutdown(s, ll)
 }
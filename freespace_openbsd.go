@@ -4,8 +4,8 @@ import (
 	"syscall"
 )
 
-func filesystemFree() (int64, error) {
+func filesystemFree(dir string) (int64, error) {
 	fs := syscall.Statfs_t{}
-	err := syscall.Statfs(*root, &fs)
+	err := syscall.Statfs(dir, &fs)
 	return int64(fs.F_bfree) * int64(fs.F_bsize), err
 }
@@ -6,8 +6,8 @@ import (
 	"syscall"
 )
 
-func filesystemFree() (int64, error) {
+func filesystemFree(dir string) (int64, error) {
 	fs := syscall.Statfs_t{}
-	err := syscall.Statfs(*root, &fs)
+	err := syscall.Statfs(dir, &fs)
 	return int64(fs.Bfree) * int64(fs.Bsize), err
 }
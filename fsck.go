@@ -2,8 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"time"
+
+	cb "github.com/couchbaselabs/go-couchbase"
 )
 
 // Take a stream of namedFiles and clump them into batches of at most
@@ -28,11 +32,299 @@ func keyClumper(ch chan *namedFile, size int) chan []*namedFile {
 	return outch
 }
 
+// A problem fsck found with a file, or when all's well and it's
+// asked for, how many copies it has.
+type fsckStatus struct {
+	Path  string `json:"path"`
+	OID   string `json:"oid,omitempty"`
+	Reps  int    `json:"reps,omitempty"`
+	EType string `json:"etype,omitempty"`
+	Error string `json:"error,omitempty"`
+	// Set when fsck fixed the problem
+	Repaired bool `json:"repaired,omitempty"`
+}
+
+type fsckChecker struct {
+	repair bool
+	nodes  NodeList
+	// Blobs with problems already reported, so files sharing them
+	// don't repair them again
+	checked map[string][]fsckStatus
+}
+
+func newFsckChecker(repair bool) (*fsckChecker, error) {
+	nl, err := findAllNodes()
+	if err != nil {
+		return nil, err
+	}
+	return &fsckChecker{
+		repair:  repair,
+		nodes:   nl,
+		checked: map[string][]fsckStatus{},
+	}, nil
+}
+
+// The blobs a file is made of.
+func fileBlobs(fm fileMeta) []string {
+	oids := []string{fm.OID}
+	for _, p := range fm.Parts {
+		oids = append(oids, p.OID)
+	}
+	return oids
+}
+
+// Look for copies of a blob that has no ownership record, recording
+// any that turn up.
+func recoverBlobOwnership(oid string, nl NodeList) (BlobOwnership, error) {
+	b := BlobOwnership{OID: oid, Type: "blob", Nodes: map[string]time.Time{}}
+	for _, n := range nl {
+		res, err := n.Client().Head(n.BlobURL(oid))
+		if err != nil {
+			continue
+		}
+		res.Body.Close()
+		if res.StatusCode == 200 {
+			b.Nodes[n.name] = time.Now().UTC()
+			b.Length = res.ContentLength
+		}
+	}
+	if len(b.Nodes) == 0 {
+		return b, fmt.Errorf("no node has it")
+	}
+	// Something else may have recorded it meanwhile.
+	_, err := couchbase.Add("/"+oid, 0, b)
+	return b, err
+}
+
+// Check a blob's ownership record, which is nil if it has none.
+func (c *fsckChecker) checkBlob(oid string, b *BlobOwnership) []fsckStatus {
+	if rv, ok := c.checked[oid]; ok {
+		return rv
+	}
+	var rv []fsckStatus
+	problem := func(etype, format string, args ...interface{}) int {
+		rv = append(rv, fsckStatus{OID: oid, EType: etype,
+			Error: fmt.Sprintf(format, args...)})
+		return len(rv) - 1
+	}
+	defer func() {
+		if len(rv) > 0 {
+			c.checked[oid] = rv
+		}
+	}()
+
+	switch {
+	case !isBlobName(oid):
+		problem("hash", "not a blob name")
+		return rv
+	case b == nil:
+		i := problem("blob", "not found")
+		if !c.repair {
+			return rv
+		}
+		found, err := recoverBlobOwnership(oid, c.nodes)
+		if err != nil {
+			rv[i].Error += ": " + err.Error()
+			return rv
+		}
+		rv[i].Repaired = true
+		b = &found
+	case b.OID != "" && b.OID != oid:
+		problem("hash", "ownership record is for %v", b.OID)
+		return rv
+	}
+
+	known := map[string]bool{}
+	for _, n := range c.nodes {
+		known[n.name] = true
+	}
+	for n := range b.Nodes {
+		if known[n] {
+			continue
+		}
+		i := problem("owner", "owned by unknown node %v", n)
+		if c.repair {
+			removeBlobOwnershipRecord(oid, n)
+			delete(b.Nodes, n)
+			rv[i].Repaired = true
+		}
+	}
+
+	have := len(b.Nodes)
+	switch {
+	case b.EC != nil || b.Shard:
+		// Erasure coding keeps its own count.
+	case have == 0:
+		problem("blob", "no copies left")
+	case have < wantedReplicas(b.Replicas):
+		want := wantedReplicas(b.Replicas)
+		i := problem("replicas", "%v of %v copies", have, want)
+		if c.repair {
+			err := increaseReplicaCount(oid, b.Length, want-have)
+			rv[i].Repaired = err == nil
+		}
+	case have > globalConfig.MaxReplicas && have > b.Replicas:
+		max := globalConfig.MaxReplicas
+		if b.Replicas > max {
+			max = b.Replicas
+		}
+		i := problem("replicas", "%v copies, at most %v wanted", have, max)
+		if c.repair {
+			nodemap := map[string]string{}
+			for n := range b.Nodes {
+				nodemap[n] = n
+			}
+			pruneBlob(oid, nodemap, b.Pinned, c.nodes, max)
+			rv[i].Repaired = true
+		}
+	}
+	return rv
+}
+
+// Check a file's length against its blobs', which should all have
+// been looked up.
+func (c *fsckChecker) checkLength(nf *namedFile,
+	blobs map[string]BlobOwnership) *fsckStatus {
+
+	fm := nf.meta
+	length := fm.Length
+	if len(fm.Parts) == 0 {
+		b, ok := blobs[fm.OID]
+		if !ok || b.Length == fm.Length {
+			return nil
+		}
+		length = b.Length
+	} else {
+		parts := make([]blobPart, len(fm.Parts))
+		copy(parts, fm.Parts)
+		changed := false
+		for i, p := range parts {
+			if b, ok := blobs[p.OID]; ok && b.Length != p.Length {
+				parts[i].Length = b.Length
+				changed = true
+			}
+		}
+		length = partsLength(parts)
+		if length == fm.Length && !changed {
+			return nil
+		}
+		fm.Parts = parts
+	}
+
+	st := &fsckStatus{Path: nf.name, OID: fm.OID, EType: "size",
+		Error: fmt.Sprintf("length %v, its blobs add up to %v",
+			nf.meta.Length, length)}
+	if length == nf.meta.Length {
+		st.Error = "part lengths don't match their blobs"
+	}
+	if c.repair {
+		err := setFileLength(nf.name, fm.OID, length, fm.Parts)
+		if err != nil {
+			st.Error += ": " + err.Error()
+		} else {
+			st.Repaired = true
+		}
+	}
+	return st
+}
+
+// Correct the length a file has recorded, unless it's been replaced.
+func setFileLength(path, oid string, length int64, parts []blobPart) error {
+	err := couchbase.Update(shortName(path), 0, func(in []byte) ([]byte, error) {
+		fm := fileMeta{}
+		if err := json.Unmarshal(in, &fm); err != nil || fm.OID != oid {
+			return nil, cb.UpdateCancel
+		}
+		fm.Length = length
+		if len(fm.Parts) == len(parts) {
+			fm.Parts = parts
+		}
+		return json.Marshal(fm)
+	})
+	if err == cb.UpdateCancel {
+		err = nil
+	}
+	return err
+}
+
+// Check a batch of files, returning what's wrong with them, and with
+// errsOnly false, how many copies the sound ones have.
+func (c *fsckChecker) check(nfc []*namedFile, errsOnly bool) ([]fsckStatus, error) {
+	oids := []string{}
+	for _, nf := range nfc {
+		if nf.err == nil {
+			oids = append(oids, fileBlobs(nf.meta)...)
+		}
+	}
+	blobs, err := getBlobs(oids)
+	if err != nil {
+		return nil, err
+	}
+	for _, oid := range oids {
+		if _, ok := blobs[oid]; ok {
+			continue
+		}
+		// If we didn't get it in the first pass, try harder.
+		if b, err := getBlobOwnership(oid); err == nil {
+			log.Printf("Got %v on the second try", oid)
+			blobs[oid] = b
+		}
+	}
+
+	var rv []fsckStatus
+	for _, nf := range nfc {
+		if nf.err != nil {
+			rv = append(rv, fsckStatus{
+				Path:  nf.name,
+				OID:   nf.meta.OID,
+				EType: "file",
+				Error: nf.err.Error(),
+			})
+			continue
+		}
+
+		var problems []fsckStatus
+		for _, oid := range fileBlobs(nf.meta) {
+			var b *BlobOwnership
+			if found, ok := blobs[oid]; ok {
+				b = &found
+			}
+			problems = append(problems, c.checkBlob(oid, b)...)
+		}
+		if st := c.checkLength(nf, blobs); st != nil {
+			problems = append(problems, *st)
+		}
+
+		for _, st := range problems {
+			st.Path = nf.name
+			rv = append(rv, st)
+		}
+		if len(problems) == 0 && !errsOnly {
+			rv = append(rv, fsckStatus{
+				Path: nf.name,
+				OID:  nf.meta.OID,
+				Reps: len(blobs[nf.meta.OID].Nodes),
+			})
+		}
+	}
+	return rv, nil
+}
+
+// Check the files under a path: that the blobs they're made of are
+// recorded with the right hash and length, have as many copies as
+// they should, and are only owned by nodes in the cluster.  A POST
+// repairs what it can.
 func dofsck(w http.ResponseWriter, req *http.Request,
 	path string) {
 
 	errsOnly := req.FormValue("errsonly") != ""
 
+	c, err := newFsckChecker(req.Method == "POST")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
 	quit := make(chan bool)
 	defer close(quit)
 	ch := make(chan *namedFile)
@@ -50,98 +342,14 @@ func dofsck(w http.ResponseWriter, req *http.Request,
 	w.WriteHeader(200)
 
 	e := json.NewEncoder(w)
-	type status struct {
-		Path  string `json:"path"`
-		OID   string `json:"oid,omitempty"`
-		Reps  int    `json:"reps,omitempty"`
-		EType string `json:"etype,omitempty"`
-		Error string `json:"error,omitempty"`
-	}
-
 	for nfc := range keyClumper(ch, 1000) {
-		keys := []string{}
-		fnmap := map[string][]string{}
-		unprocessed := map[string]string{}
-
-		for _, nf := range nfc {
-			if nf.err != nil {
-				if err := e.Encode(status{
-					Path:  nf.name,
-					OID:   nf.meta.OID,
-					EType: "file",
-					Error: nf.err.Error(),
-				}); err != nil {
-					log.Printf("Error encoding: %v", err)
-					return
-				}
-			}
-			keys = append(keys, "/"+nf.meta.OID)
-			unprocessed[nf.name] = nf.meta.OID
-
-			a, ok := fnmap[nf.meta.OID]
-			if ok {
-				a = append(a, nf.name)
-			} else {
-				a = []string{nf.name}
-			}
-			fnmap[nf.meta.OID] = a
-		}
-
-		bres, err := couchbase.GetBulk(keys)
+		statuses, err := c.check(nfc, errsOnly)
 		if err != nil {
 			log.Printf("Error getting bulk keys: %v", err)
 			return
 		}
-
-		for k, v := range bres {
-			names := fnmap[k[1:]]
-			for _, name := range names {
-				delete(unprocessed, name)
-			}
-
-			ownership := BlobOwnership{}
-			err := json.Unmarshal(v.Body, &ownership)
-			if err != nil {
-				for _, name := range names {
-					if err = e.Encode(status{
-						Path:  name,
-						OID:   k[1:],
-						EType: "blob",
-						Error: err.Error(),
-					}); err != nil {
-						log.Printf("Error encoding: %v", err)
-						return
-					}
-				}
-			}
-
-			if !errsOnly {
-				for _, name := range names {
-					if err := e.Encode(status{
-						Path: name,
-						OID:  k[1:],
-						Reps: len(ownership.Nodes),
-					}); err != nil {
-						log.Printf("Error encoding: %v", err)
-						return
-					}
-				}
-			}
-		}
-
-		for k, v := range unprocessed {
-			// If we didn't get it in the first pass, try harder.
-			_, err := getBlobOwnership(v)
-			if err == nil {
-				log.Printf("Got %v on the second try", v)
-				continue
-			}
-			if err := e.Encode(status{
-				Path:  k,
-				OID:   v,
-				EType: "blob",
-				Error: "not found",
-			}); err != nil {
+		for _, st := range statuses {
+			if err := e.Encode(st); err != nil {
 				log.Printf("Error encoding: %v", err)
 				return
 			}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFsckCheckBlob(t *testing.T) {
+	oid := strings.Repeat("ab", 20)
+	c := &fsckChecker{
+		nodes:   NodeList{{name: "a"}, {name: "b"}, {name: "c"}},
+		checked: map[string][]fsckStatus{},
+	}
+	owned := func(nodes ...string) *BlobOwnership {
+		b := &BlobOwnership{OID: oid, Nodes: map[string]time.Time{}}
+		for _, n := range nodes {
+			b.Nodes[n] = time.Now()
+		}
+		return b
+	}
+
+	tests := []struct {
+		oid string
+		b   *BlobOwnership
+		exp string
+	}{
+		{oid, owned("a", "b", "c"), ""},
+		{oid, nil, "blob"},
+		{"xyz", owned("a", "b", "c"), "hash"},
+		{oid, &BlobOwnership{OID: "other"}, "hash"},
+		{oid, owned("a", "b"), "replicas"},
+		{oid, owned("a", "b", "c", "gone"), "owner"},
+		{oid, owned(), "blob"},
+	}
+	for _, test := range tests {
+		c.checked = map[string][]fsckStatus{}
+		got := c.checkBlob(test.oid, test.b)
+		types := []string{}
+		for _, st := range got {
+			if st.Repaired {
+				t.Errorf("Expected nothing repaired, got %+v", st)
+			}
+			types = append(types, st.EType)
+		}
+		if s := strings.Join(types, ","); s != test.exp {
+			t.Errorf("Expected %q for %+v, got %q (%+v)",
+				test.exp, test.b, s, got)
+		}
+	}
+}
+
+func TestFsckCheckLength(t *testing.T) {
+	c := &fsckChecker{}
+	blobs := map[string]BlobOwnership{
+		"whole": {Length: 10},
+		"p1":    {Length: 5},
+		"p2":    {Length: 7},
+	}
+
+	tests := []struct {
+		fm  fileMeta
+		exp string
+	}{
+		{fileMeta{OID: "whole", Length: 10}, ""},
+		{fileMeta{OID: "whole", Length: 11},
+			"length 11, its blobs add up to 10"},
+		{fileMeta{OID: "missing", Length: 11}, ""},
+		{fileMeta{OID: "manifest", Length: 12,
+			Parts: []blobPart{{"p1", 5}, {"p2", 7}}}, ""},
+		{fileMeta{OID: "manifest", Length: 12,
+			Parts: []blobPart{{"p1", 7}, {"p2", 5}}},
+			"part lengths don't match their blobs"},
+		{fileMeta{OID: "manifest", Length: 10,
+			Parts: []blobPart{{"p1", 5}, {"p2", 5}}},
+			"length 10, its blobs add up to 12"},
+	}
+	for _, test := range tests {
+		got := ""
+		if st := c.checkLength(&namedFile{name: "f", meta: test.fm},
+			blobs); st != nil {
+			got = st.Error
+		}
+		if got != test.exp {
+			t.Errorf("Expected %q for %+v, got %q", test.exp, test.fm, got)
+		}
+	}
+}
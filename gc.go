@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+const (
+	gcRunsKey = "/@gcRuns"
+	// How many past garbage collections to remember
+	gcRunsKept = 20
+)
+
+// What one garbage collection did.
+type gcRun struct {
+	Node         string    `json:"node"`
+	Started      time.Time `json:"started"`
+	Finished     time.Time `json:"finished"`
+	Scanned      int       `json:"scanned"`
+	Removed      int       `json:"removed"`
+	RemovedBytes int64     `json:"removedBytes"`
+	Skipped      int       `json:"skipped"`
+	InBackup     int       `json:"inBackup"`
+	Error        string    `json:"error,omitempty"`
+}
+
+type gcRunList struct {
+	Type string  `json:"type"`
+	Runs []gcRun `json:"runs"`
+}
+
+func (r gcRun) String() string {
+	return fmt.Sprintf("scanned %v, removed %v (%v bytes), skipped %v, in backup %v",
+		r.Scanned, r.Removed, r.RemovedBytes, r.Skipped, r.InBackup)
+}
+
+// Keeps removals under the configured rates.  The rates are checked
+// on every removal so changes take effect in the middle of a run.
+type gcPacer struct {
+	start        time.Time
+	blobs, bytes int64
+}
+
+func newGCPacer() *gcPacer {
+	return &gcPacer{start: time.Now()}
+}
+
+// Account for removing a blob of the given length, waiting if that's
+// ahead of either rate.
+func (p *gcPacer) removed(length int64) {
+	p.blobs++
+	p.bytes += length
+	if d := p.delay(globalConfig.GCRate, globalConfig.GCBytesRate); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// How long to wait to get back under the rates.
+func (p *gcPacer) delay(rate int, byteRate int64) time.Duration {
+	want := time.Duration(0)
+	if rate > 0 {
+		want = time.Duration(float64(p.blobs) / float64(rate) *
+			float64(time.Second))
+	}
+	if byteRate > 0 {
+		bw := time.Duration(float64(p.bytes) / float64(byteRate) *
+			float64(time.Second))
+		if bw > want {
+			want = bw
+		}
+	}
+	return want - time.Since(p.start)
+}
+
+// Remember a garbage collection, newest first.
+func recordGCRun(run gcRun) error {
+	return couchbase.Update(gcRunsKey, 0, func(in []byte) ([]byte, error) {
+		rl := gcRunList{}
+		json.Unmarshal(in, &rl)
+		rl.Type = "gcruns"
+		rl.Runs = append([]gcRun{run}, rl.Runs...)
+		if len(rl.Runs) > gcRunsKept {
+			rl.Runs = rl.Runs[:gcRunsKept]
+		}
+		return json.Marshal(&rl)
+	})
+}
+
+func doListGCRuns(w http.ResponseWriter, req *http.Request) {
+	rl := gcRunList{}
+	err := couchbase.Get(gcRunsKey, &rl)
+	if err != nil && !gomemcached.IsNotFound(err) {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if rl.Runs == nil {
+		rl.Runs = []gcRun{}
+	}
+	sendJson(w, req, map[string]interface{}{
+		"enabled":   globalConfig.GCEnabled,
+		"freq":      globalConfig.GCFreq.String(),
+		"limit":     globalConfig.GCLimit,
+		"rate":      globalConfig.GCRate,
+		"bytesRate": globalConfig.GCBytesRate,
+		"runs":      rl.Runs,
+	})
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGCPacerDelay(t *testing.T) {
+	tests := []struct {
+		blobs, bytes int64
+		rate         int
+		byteRate     int64
+		exp          time.Duration
+	}{
+		{100, 1 << 30, 0, 0, 0},
+		{100, 0, 10, 0, 10 * time.Second},
+		{1, 1 << 20, 0, 1 << 19, 2 * time.Second},
+		// Whichever is further behind wins.
+		{10, 1 << 20, 10, 1 << 19, 2 * time.Second},
+		{40, 1 << 20, 10, 1 << 19, 4 * time.Second},
+	}
+
+	for _, test := range tests {
+		p := &gcPacer{start: time.Now(), blobs: test.blobs, bytes: test.bytes}
+		got := p.delay(test.rate, test.byteRate)
+		if got > test.exp || got < test.exp-time.Second {
+			t.Errorf("Expected about %v for %+v, got %v", test.exp, test, got)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var grpcBind = flag.String("grpcbind", "",
+	"Address to serve the gRPC API on (empty to disable, needs -tags grpc)")
+
+// Largest chunk of content sent in one gRPC message.
+const grpcChunkSize = 64 * 1024
+
+// A request to the regular API standing in for a gRPC call, so the
+// call is authorized and served just like its HTTP equivalent.  md
+// is the call's metadata.
+func grpcHTTPRequest(method, path string, md map[string][]string) (*http.Request, error) {
+	u := &url.URL{Path: "/" + strings.TrimLeft(path, "/")}
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range md["authorization"] {
+		req.Header.Add("Authorization", a)
+	}
+	return req, nil
+}
+
+// Collects a handler's response to a gRPC call.  Successful response
+// bodies are passed to send in chunks (or dropped if send is nil),
+// and error responses are kept to report.
+type grpcResponseWriter struct {
+	hdr    http.Header
+	code   int
+	send   func([]byte) error
+	errmsg bytes.Buffer
+}
+
+func newGRPCResponseWriter(send func([]byte) error) *grpcResponseWriter {
+	return &grpcResponseWriter{hdr: http.Header{}, send: send}
+}
+
+func (g *grpcResponseWriter) Header() http.Header {
+	return g.hdr
+}
+
+func (g *grpcResponseWriter) WriteHeader(code int) {
+	if g.code == 0 {
+		g.code = code
+	}
+}
+
+func (g *grpcResponseWriter) Write(b []byte) (int, error) {
+	g.WriteHeader(200)
+	switch {
+	case g.code >= 300:
+		return g.errmsg.Write(b)
+	case g.send == nil:
+		return len(b), nil
+	}
+
+	n := 0
+	for len(b) > 0 {
+		c := b
+		if len(c) > grpcChunkSize {
+			c = c[:grpcChunkSize]
+		}
+		if err := g.send(c); err != nil {
+			return n, err
+		}
+		n += len(c)
+		b = b[len(c):]
+	}
+	return n, nil
+}
+
+// The response status, and its message if it failed.
+func (g *grpcResponseWriter) status() (int, string) {
+	if g.code == 0 {
+		return 200, ""
+	}
+	return g.code, strings.TrimSpace(g.errmsg.String())
+}
@@ -0,0 +1,408 @@
+// +build grpc
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/couchbaselabs/cbfs/cbfspb"
+)
+
+// Serve the gRPC API.  Calls are translated onto the regular
+// handlers, so they behave (and are authorized) the same as over
+// HTTP.
+func serveGRPC() {
+	if *grpcBind == "" {
+		return
+	}
+
+	l, err := rateListen("tcp", *grpcBind)
+	if err != nil {
+		log.Fatalf("Error listening for gRPC requests: %v", err)
+	}
+	s := grpc.NewServer()
+	cbfspb.RegisterCBFSServer(s, &grpcServer{})
+	log.Printf("Listening to gRPC requests on %s", *grpcBind)
+	onShutdown(func(ctx context.Context) error {
+		done := make(chan bool)
+		go func() {
+			s.GracefulStop()
+			close(done)
+		}()
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			s.Stop()
+			return ctx.Err()
+		}
+	})
+	if err := s.Serve(maybeTLSListener(l)); err != nil {
+		log.Fatal(err)
+	}
+}
+
+type grpcServer struct {
+	cbfspb.UnimplementedCBFSServer
+}
+
+func grpcError(code int, msg string) error {
+	c := codes.Internal
+	switch code {
+	case 400:
+		c = codes.InvalidArgument
+	case 401:
+		c = codes.Unauthenticated
+	case 403:
+		c = codes.PermissionDenied
+	case 404, 410:
+		c = codes.NotFound
+	case 409:
+		c = codes.AlreadyExists
+	case 412:
+		c = codes.FailedPrecondition
+	case 416:
+		c = codes.OutOfRange
+	case 501:
+		c = codes.Unimplemented
+	case 503:
+		c = codes.Unavailable
+	}
+	if msg == "" {
+		msg = http.StatusText(code)
+	}
+	return status.Error(c, msg)
+}
+
+// Build and authorize the HTTP request equivalent to a call.
+func grpcAuthorize(ctx context.Context, method, path string,
+	hdr http.Header) (*http.Request, error) {
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	req, err := grpcHTTPRequest(method, path, md)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+	req = req.WithContext(ctx)
+
+	w := newGRPCResponseWriter(nil)
+	if !checkAuth(w, req) {
+		return nil, grpcError(w.status())
+	}
+	if why := blobRefusal(); why != "" && storesBlob(req) {
+		return nil, grpcError(503, why)
+	}
+	return req, nil
+}
+
+// Run a handler for a call, reporting its failure.
+func grpcServe(h func(http.ResponseWriter, *http.Request),
+	req *http.Request, send func([]byte) error) error {
+
+	w := newGRPCResponseWriter(send)
+	h(w, req)
+	if code, msg := w.status(); code >= 300 {
+		return grpcError(code, msg)
+	}
+	return nil
+}
+
+func grpcFileInfo(p string, fm fileMeta) *cbfspb.FileInfo {
+	fi := &cbfspb.FileInfo{
+		Path:        p,
+		Oid:         fm.OID,
+		Length:      fm.Length,
+		ContentType: fm.Headers.Get("Content-Type"),
+		Modified:    fm.Modified.UnixNano(),
+		Revno:       int32(fm.Revno),
+	}
+	if fm.Userdata != nil {
+		fi.Userdata = string(*fm.Userdata)
+	}
+	return fi
+}
+
+func grpcStat(p string) (*cbfspb.FileInfo, error) {
+	fm := fileMeta{}
+	err := couchbase.Get(shortName(p), &fm)
+	switch {
+	case gomemcached.IsNotFound(err):
+		return nil, grpcError(404, "not found")
+	case err != nil:
+		return nil, grpcError(500, err.Error())
+	case fm.expired(time.Now()) || fm.Type != "file":
+		return nil, grpcError(404, "not found")
+	}
+	return grpcFileInfo(p, fm), nil
+}
+
+func (grpcServer) Stat(ctx context.Context,
+	r *cbfspb.StatRequest) (*cbfspb.FileInfo, error) {
+
+	req, err := grpcAuthorize(ctx, "GET", r.GetPath(), nil)
+	if err != nil {
+		return nil, err
+	}
+	p, _ := resolvePath(req)
+	return grpcStat(p)
+}
+
+func (grpcServer) Get(r *cbfspb.GetRequest, stream cbfspb.CBFS_GetServer) error {
+	hdr := http.Header{}
+	switch {
+	case r.GetOffset() < 0 || r.GetLength() < 0:
+		return grpcError(400, "invalid range")
+	case r.GetLength() > 0:
+		hdr.Set("Range", "bytes="+strconv.FormatInt(r.GetOffset(), 10)+"-"+
+			strconv.FormatInt(r.GetOffset()+r.GetLength()-1, 10))
+	case r.GetOffset() > 0:
+		hdr.Set("Range", "bytes="+strconv.FormatInt(r.GetOffset(), 10)+"-")
+	}
+
+	req, err := grpcAuthorize(stream.Context(), "GET", r.GetPath(), hdr)
+	if err != nil {
+		return err
+	}
+	if r.GetRevno() != 0 {
+		req.Form = url.Values{"rev": []string{strconv.Itoa(int(r.GetRevno()))}}
+	}
+	return grpcServe(doGetUserDoc, req, func(b []byte) error {
+		return stream.Send(&cbfspb.GetResponse{Data: b})
+	})
+}
+
+func (grpcServer) Put(stream cbfspb.CBFS_PutServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	h := first.GetHeader()
+	if h == nil {
+		return grpcError(400, "the first message must be a header")
+	}
+
+	hdr := http.Header{}
+	if h.GetContentType() != "" {
+		hdr.Set("Content-Type", h.GetContentType())
+	}
+	if h.GetHash() != "" {
+		hdr.Set("X-CBFS-Hash", h.GetHash())
+	}
+	if h.KeepRevs != nil {
+		hdr.Set("X-CBFS-KeepRevs", strconv.Itoa(int(h.GetKeepRevs())))
+	}
+	if h.GetUnsafe() {
+		hdr.Set("X-CBFS-Unsafe", "true")
+	}
+	switch h.GetIfMatch() {
+	case "":
+	case "*":
+		hdr.Set("If-Match", "*")
+	default:
+		hdr.Set("If-Match", `"`+h.GetIfMatch()+`"`)
+	}
+	if h.GetExpires() > 0 {
+		hdr.Set("X-CBFS-Expires",
+			time.Unix(h.GetExpires(), 0).UTC().Format(time.RFC3339))
+	}
+
+	req, err := grpcAuthorize(stream.Context(), "PUT", h.GetPath(), hdr)
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	// Unblock the reader if the handler gives up early.
+	defer pr.Close()
+	go func() {
+		for {
+			m, err := stream.Recv()
+			if err == io.EOF {
+				pw.Close()
+				return
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := pw.Write(m.GetData()); err != nil {
+				return
+			}
+		}
+	}()
+	req.Body = pr
+	req.ContentLength = -1
+
+	if err := grpcServe(putUserFile, req, nil); err != nil {
+		return err
+	}
+	p, _ := resolvePath(req)
+	fi, err := grpcStat(p)
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(fi)
+}
+
+func (grpcServer) List(ctx context.Context,
+	r *cbfspb.ListRequest) (*cbfspb.ListResponse, error) {
+
+	req, err := grpcAuthorize(ctx, "GET", listPrefix+r.GetPath(), nil)
+	if err != nil {
+		return nil, err
+	}
+	p := minusPrefix(req.URL.Path, listPrefix)
+	depth := int(r.GetDepth())
+	if depth < 1 {
+		depth = 1
+	}
+
+	fl, err := listFiles(p, true, depth)
+	if err != nil {
+		return nil, grpcError(500, err.Error())
+	}
+	prefix := ""
+	if p != "" {
+		prefix = p + "/"
+	}
+
+	// Directory details only come in JSON form.
+	typed := struct {
+		Files map[string]fileMeta
+		Dirs  map[string]struct {
+			Descendants, Size, Smallest, Largest int64
+		}
+	}{}
+	data, err := json.Marshal(fl)
+	if err == nil {
+		err = json.Unmarshal(data, &typed)
+	}
+	if err != nil {
+		return nil, grpcError(500, err.Error())
+	}
+
+	rv := &cbfspb.ListResponse{}
+	for n, fm := range typed.Files {
+		rv.Files = append(rv.Files, grpcFileInfo(prefix+n, fm))
+	}
+	for n, d := range typed.Dirs {
+		rv.Dirs = append(rv.Dirs, &cbfspb.DirInfo{
+			Path:        prefix + n,
+			Descendants: d.Descendants,
+			Size:        d.Size,
+			Smallest:    d.Smallest,
+			Largest:     d.Largest,
+		})
+	}
+	return rv, nil
+}
+
+func (grpcServer) Delete(ctx context.Context,
+	r *cbfspb.DeleteRequest) (*cbfspb.DeleteResponse, error) {
+
+	hdr := http.Header{}
+	if r.GetIfMatch() != "" {
+		hdr.Set("If-Match", `"`+r.GetIfMatch()+`"`)
+	}
+	req, err := grpcAuthorize(ctx, "DELETE", r.GetPath(), hdr)
+	if err != nil {
+		return nil, err
+	}
+	if err := grpcServe(doDeleteUserDoc, req, nil); err != nil {
+		return nil, err
+	}
+	return &cbfspb.DeleteResponse{}, nil
+}
+
+func (grpcServer) Copy(ctx context.Context,
+	r *cbfspb.CopyRequest) (*cbfspb.CopyResponse, error) {
+
+	method := "COPY"
+	if r.GetMove() {
+		method = "MOVE"
+	}
+	hdr := http.Header{}
+	hdr.Set("Destination", (&url.URL{Path: "/" + r.GetDestination()}).String())
+	if !r.GetOverwrite() {
+		hdr.Set("Overwrite", "F")
+	}
+	req, err := grpcAuthorize(ctx, method, r.GetSource(), hdr)
+	if err != nil {
+		return nil, err
+	}
+	err = grpcServe(func(w http.ResponseWriter, req *http.Request) {
+		doCopyUserDoc(w, req, r.GetMove())
+	}, req, nil)
+	if status.Code(err) == codes.FailedPrecondition && !r.GetOverwrite() {
+		err = grpcError(409, "destination exists")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &cbfspb.CopyResponse{}, nil
+}
+
+func (grpcServer) Nodes(ctx context.Context,
+	r *cbfspb.NodesRequest) (*cbfspb.NodesResponse, error) {
+
+	if _, err := grpcAuthorize(ctx, "GET", nodePrefix, nil); err != nil {
+		return nil, err
+	}
+	nl, err := findAllNodes()
+	if err != nil {
+		return nil, grpcError(500, err.Error())
+	}
+
+	rv := &cbfspb.NodesResponse{}
+	for _, node := range nl {
+		rv.Nodes = append(rv.Nodes, &cbfspb.Node{
+			Name:      node.name,
+			Addr:      node.Address(),
+			Started:   node.Started.UnixNano(),
+			Heartbeat: node.Time.UnixNano(),
+			Size:      node.storageSize,
+			Used:      node.Used,
+			Free:      node.Free,
+			Version:   node.Version,
+			Zone:      node.Zone,
+			Draining:  node.Draining,
+		})
+	}
+	return rv, nil
+}
+
+func (grpcServer) Backup(ctx context.Context,
+	r *cbfspb.BackupRequest) (*cbfspb.BackupResponse, error) {
+
+	req, err := grpcAuthorize(ctx, "POST", backupPrefix, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Form = url.Values{
+		"fn": []string{r.GetPath()},
+		"bg": []string{strconv.FormatBool(r.GetBackground())},
+	}
+	if r.GetParent() != "" {
+		req.Form.Set("parent", r.GetParent())
+	}
+	if err := grpcServe(doBackupDocs, req, nil); err != nil {
+		return nil, err
+	}
+	return &cbfspb.BackupResponse{}, nil
+}
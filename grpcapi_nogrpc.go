@@ -0,0 +1,11 @@
+// +build !grpc
+
+package main
+
+import "log"
+
+func serveGRPC() {
+	if *grpcBind != "" {
+		log.Fatalf("-grpcbind needs cbfs built with -tags grpc")
+	}
+}
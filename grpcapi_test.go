@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestGRPCHTTPRequest(t *testing.T) {
+	req, err := grpcHTTPRequest("GET", "a b/c?d",
+		map[string][]string{"authorization": {"Bearer x"}})
+	if err != nil {
+		t.Fatalf("Error making request: %v", err)
+	}
+	if req.URL.Path != "/a b/c?d" {
+		t.Errorf("Expected /a b/c?d, got %q", req.URL.Path)
+	}
+	if got := req.Header.Get("Authorization"); got != "Bearer x" {
+		t.Errorf("Expected Bearer x, got %q", got)
+	}
+}
+
+func TestGRPCResponseWriter(t *testing.T) {
+	chunks := 0
+	buf := &bytes.Buffer{}
+	w := newGRPCResponseWriter(func(b []byte) error {
+		if len(b) > grpcChunkSize {
+			t.Errorf("Expected at most %v bytes, got %v", grpcChunkSize, len(b))
+		}
+		chunks++
+		buf.Write(b)
+		return nil
+	})
+	data := strings.Repeat("x", 2*grpcChunkSize+1)
+	n, err := w.Write([]byte(data))
+	if n != len(data) || err != nil || chunks != 3 || buf.String() != data {
+		t.Errorf("Expected %v bytes in 3 chunks, got %v in %v (%v)",
+			len(data), n, chunks, err)
+	}
+	if code, msg := w.status(); code != 200 || msg != "" {
+		t.Errorf("Expected 200, got %v %q", code, msg)
+	}
+
+	w = newGRPCResponseWriter(func([]byte) error {
+		t.Errorf("Expected no content sent for an error")
+		return nil
+	})
+	w.WriteHeader(412)
+	w.Write([]byte("precondition failed\n"))
+	if code, msg := w.status(); code != 412 || msg != "precondition failed" {
+		t.Errorf("Expected 412 precondition failed, got %v %q", code, msg)
+	}
+
+	oops := errors.New("oops")
+	w = newGRPCResponseWriter(func([]byte) error { return oops })
+	if _, err := w.Write([]byte("hi")); err != oops {
+		t.Errorf("Expected %v, got %v", oops, err)
+	}
+}
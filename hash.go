@@ -11,7 +11,9 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	_ "crypto/md5"
@@ -31,21 +33,115 @@ var hashBuilders = map[string]crypto.Hash{
 	"ripemd160": crypto.RIPEMD160,
 }
 
-func getHash() hash.Hash {
-	h, ok := hashBuilders[globalConfig.Hash]
+// Hashes from outside the standard library, registered by the files
+// that build them in.
+var extraHashBuilders = map[string]func() hash.Hash{}
+
+// A new hash of the named kind, or nil if it's not available.
+func newHash(name string) hash.Hash {
+	if f, ok := extraHashBuilders[name]; ok {
+		return f()
+	}
+	h, ok := hashBuilders[name]
 	if !ok {
 		return nil
 	}
 	if !h.Available() {
-		log.Printf("Hash %v is not available", globalConfig.Hash)
+		log.Printf("Hash %v is not available", name)
 		return nil
 	}
 	return h.New()
 }
 
+// The hash new blobs are named by.
+func getHash() hash.Hash {
+	return newHash(globalConfig.Hash)
+}
+
+func availableHashes() []string {
+	rv := []string{}
+	for name, h := range hashBuilders {
+		if h.Available() {
+			rv = append(rv, name)
+		}
+	}
+	for name := range extraHashBuilders {
+		rv = append(rv, name)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+var hashSizesOnce sync.Once
+var hashSizes map[string]int
+
+// The hashes that could have named a blob, judging by its length,
+// with the configured one first.
+func hashesFor(oid string) []string {
+	hashSizesOnce.Do(func() {
+		hashSizes = map[string]int{}
+		for _, name := range availableHashes() {
+			hashSizes[name] = newHash(name).Size() * 2
+		}
+	})
+
+	rv := []string{}
+	if hashSizes[globalConfig.Hash] == len(oid) {
+		rv = append(rv, globalConfig.Hash)
+	}
+	for _, name := range availableHashes() {
+		if name != globalConfig.Hash && hashSizes[name] == len(oid) {
+			rv = append(rv, name)
+		}
+	}
+	return rv
+}
+
+// Hashes content with every hash that could have named a blob, so
+// blobs named by a hash other than the configured one can still be
+// checked.
+type oidHash struct {
+	io.Writer
+	names  []string
+	hashes []hash.Hash
+}
+
+func newOIDHash(oid string) *oidHash {
+	rv := &oidHash{names: hashesFor(oid)}
+	ws := []io.Writer{}
+	for _, name := range rv.names {
+		h := newHash(name)
+		rv.hashes = append(rv.hashes, h)
+		ws = append(ws, h)
+	}
+	rv.Writer = io.MultiWriter(ws...)
+	return rv
+}
+
+// The hash that named oid after the content that was written, or ""
+// if none of them did.
+func (o *oidHash) match(oid string) string {
+	for i, h := range o.hashes {
+		if hex.EncodeToString(h.Sum(nil)) == oid {
+			return o.names[i]
+		}
+	}
+	return ""
+}
+
+// What the content hashes to under the most likely hash.
+func (o *oidHash) sum() string {
+	if len(o.hashes) == 0 {
+		return ""
+	}
+	return hex.EncodeToString(o.hashes[0].Sum(nil))
+}
+
 type hashRecord struct {
 	tmpf    *os.File
+	enc     io.Closer
 	sh      hash.Hash
+	check   *oidHash
 	w       io.Writer
 	hashin  string
 	base    string
@@ -53,20 +149,54 @@ type hashRecord struct {
 }
 
 func NewHashRecord(tmpdir, hashin string) (*hashRecord, error) {
+	return newHashRecord(tmpdir, hashin, false)
+}
+
+// Like NewHashRecord, for content sent by clients.  The hash a client
+// gives is checked, but the blob is named by the configured hash
+// whatever the client named it by, so it never needs rehashing.
+func NewUploadRecord(tmpdir, hashin string) (*hashRecord, error) {
+	return newHashRecord(tmpdir, hashin, true)
+}
+
+func newHashRecord(tmpdir, hashin string, rekey bool) (*hashRecord, error) {
 	tmpf, err := ioutil.TempFile(tmpdir, "tmp")
 	if err != nil {
 		return nil, err
 	}
 
-	sh := getHash()
-
-	return &hashRecord{
+	rv := &hashRecord{
 		tmpf:   tmpf,
-		sh:     sh,
-		w:      io.MultiWriter(tmpf, sh),
 		hashin: hashin,
-		base:   *root,
-	}, nil
+		base:   tmpdir,
+	}
+
+	// Content with a known name is checked against whichever hash
+	// could have made it, so blobs named by an older hash can still
+	// be copied around.
+	ws := []io.Writer{}
+	if hashin == "" || rekey {
+		rv.sh = getHash()
+		ws = append(ws, rv.sh)
+	}
+	if hashin != "" {
+		rv.check = newOIDHash(hashin)
+		ws = append(ws, rv.check)
+	}
+	sh := io.MultiWriter(ws...)
+	rv.w = io.MultiWriter(tmpf, sh)
+
+	if key := currentBlobKey(); key != nil {
+		enc, err := newEncryptingWriter(tmpf, key)
+		if err != nil {
+			rv.Close()
+			return nil, err
+		}
+		rv.enc = enc
+		rv.w = io.MultiWriter(enc, sh)
+	}
+
+	return rv, nil
 }
 
 func (h *hashRecord) Write(p []byte) (n int, err error) {
@@ -78,17 +208,31 @@ func (h *hashRecord) Write(p []byte) (n int, err error) {
 }
 
 func (h *hashRecord) Finish() (string, error) {
+	if h.enc != nil {
+		if err := h.enc.Close(); err != nil {
+			return "", err
+		}
+	}
 	err := h.tmpf.Close()
 	if err != nil {
 		return "", err
 	}
 
-	hs := hex.EncodeToString(h.sh.Sum([]byte{}))
+	hs := h.hashin
+	if h.check != nil && h.check.match(hs) == "" {
+		return "", fmt.Errorf("Invalid hash %v != %v",
+			h.hashin, h.check.sum())
+	}
+	if h.sh != nil {
+		hs = hex.EncodeToString(h.sh.Sum([]byte{}))
+	}
 	fn := hashFilename(h.base, hs)
 
-	if h.hashin != "" && h.hashin != hs {
-		return "", fmt.Errorf("Invalid hash %v != %v",
-			h.hashin, hs)
+	// Don't keep a second copy on another volume.
+	if v, ok := blobVolume(hs); ok && v != h.base {
+		os.Remove(h.tmpf.Name())
+		h.tmpf = nil
+		return hs, nil
 	}
 
 	err = os.Rename(h.tmpf.Name(), fn)
@@ -128,27 +272,30 @@ func (h *hashRecord) Close() error {
 }
 
 func cleanTmpFiles() error {
-	d, err := os.Open(*root)
-	if err != nil {
-		return err
-	}
-	fi, err := d.Readdir(0)
-	if err != nil {
-		return err
-	}
 	now := time.Now()
 	cleaned := 0
-	for _, fn := range fi {
-		cutoff := fn.ModTime().Add(1 * time.Hour)
-		if strings.HasPrefix(fn.Name(), "tmp") &&
-			cutoff.Before(now) {
-
-			err = os.Remove(filepath.Join(*root, fn.Name()))
-			if err == nil {
-				cleaned++
-			} else {
-				log.Printf("Error cleaning %v: %v",
-					fn.Name(), err)
+	for _, v := range volumes() {
+		d, err := os.Open(v)
+		if err != nil {
+			return err
+		}
+		fi, err := d.Readdir(0)
+		d.Close()
+		if err != nil {
+			return err
+		}
+		for _, fn := range fi {
+			cutoff := fn.ModTime().Add(1 * time.Hour)
+			if strings.HasPrefix(fn.Name(), "tmp") &&
+				cutoff.Before(now) {
+
+				err = os.Remove(filepath.Join(v, fn.Name()))
+				if err == nil {
+					cleaned++
+				} else {
+					log.Printf("Error cleaning %v: %v",
+						fn.Name(), err)
+				}
 			}
 		}
 	}
@@ -179,3 +326,8 @@ var validHashRegexp = regexp.MustCompile(`^[a-f0-9]+$`)
 func validHash(hash string) bool {
 	return validHashRegexp.MatchString(hash)
 }
+
+// Could this be the name of a blob made by any available hash?
+func isBlobName(name string) bool {
+	return validHash(name) && len(hashesFor(name)) > 0
+}
@@ -0,0 +1,15 @@
+// +build blake3
+
+package main
+
+import (
+	"hash"
+
+	"lukechampine.com/blake3"
+)
+
+func init() {
+	extraHashBuilders["blake3"] = func() hash.Hash {
+		return blake3.New(32, nil)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"io/ioutil"
@@ -217,6 +218,103 @@ func TestHashWriterWithBadHash(t *testing.T) {
 	})
 }
 
+func TestHashWriterOtherHash(t *testing.T) {
+	testWithTempDir(t, func(tmpdir string) {
+		sum := sha256.Sum256(randomData)
+		oid := hex.EncodeToString(sum[:])
+		hr, err := NewHashRecord(tmpdir, oid)
+		if err != nil {
+			t.Fatalf("Error establishing hash record: %v", err)
+		}
+		defer hr.Close()
+		h, _, err := hr.Process(bytes.NewReader(randomData))
+		if err != nil {
+			t.Fatalf("Error processing: %v", err)
+		}
+		if h != oid {
+			t.Fatalf("Expected hash %v, got %v", oid, h)
+		}
+		err = validateHashFile(hashFilename(tmpdir, oid))
+		if err != nil {
+			t.Fatalf("Didn't find valid hash: %v", err)
+		}
+	})
+}
+
+func TestUploadRecordRekeys(t *testing.T) {
+	testWithTempDir(t, func(tmpdir string) {
+		sum := sha256.Sum256(randomData)
+		hr, err := NewUploadRecord(tmpdir, hex.EncodeToString(sum[:]))
+		if err != nil {
+			t.Fatalf("Error establishing hash record: %v", err)
+		}
+		defer hr.Close()
+		h, _, err := hr.Process(bytes.NewReader(randomData))
+		if err != nil {
+			t.Fatalf("Error processing: %v", err)
+		}
+		if h != hashOfRandomData {
+			t.Fatalf("Expected hash %v, got %v", hashOfRandomData, h)
+		}
+		err = validateHashFile(hashFilename(tmpdir, hashOfRandomData))
+		if err != nil {
+			t.Fatalf("Didn't find valid hash: %v", err)
+		}
+	})
+}
+
+func TestUploadRecordWithBadHash(t *testing.T) {
+	testWithTempDir(t, func(tmpdir string) {
+		hr, err := NewUploadRecord(tmpdir, "fde65ea0f4a6d1b0eb20c3b6b7e054512d2c45dc")
+		if err != nil {
+			t.Fatalf("Error establishing hash record: %v", err)
+		}
+		defer hr.Close()
+		_, _, err = hr.Process(bytes.NewReader(randomData))
+		if err == nil || !strings.Contains(err.Error(), "Invalid hash") {
+			t.Fatalf("Expected invalid hash error, got %v", err)
+		}
+	})
+}
+
+func TestOIDHashMatch(t *testing.T) {
+	once.Do(initData)
+	sum := sha256.Sum256(randomData)
+	tests := []struct {
+		oid  string
+		hash string
+	}{
+		{hashOfRandomData, globalConfig.Hash},
+		{hex.EncodeToString(sum[:]), "sha256"},
+		{"fde65ea0f4a6d1b0eb20c3b6b7e054512d2c45dc", ""},
+		{"abc123", ""},
+	}
+
+	for _, test := range tests {
+		h := newOIDHash(test.oid)
+		h.Write(randomData)
+		if got := h.match(test.oid); got != test.hash {
+			t.Errorf("Expected %v to match %q, got %q",
+				test.oid, test.hash, got)
+		}
+	}
+}
+
+func TestHashesFor(t *testing.T) {
+	once.Do(initData)
+	names := hashesFor(hashOfRandomData)
+	if len(names) == 0 || names[0] != globalConfig.Hash {
+		t.Errorf("Expected %v first for %v, got %v",
+			globalConfig.Hash, hashOfRandomData, names)
+	}
+	if names := hashesFor("abc123"); len(names) != 0 {
+		t.Errorf("Expected no hashes for a short name, got %v", names)
+	}
+	if isBlobName("abc123") {
+		t.Errorf("Expected abc123 not to be a blob name")
+	}
+}
+
 func TestValidHash(t *testing.T) {
 	tests := []struct {
 		hash  string
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
@@ -16,7 +17,7 @@ var noFSFree = errors.New("no filesystemFree")
 var spaceUsed int64
 
 func availableSpace() int64 {
-	freeSpace, err := filesystemFree()
+	freeSpace, err := volumesFree()
 	if err != nil {
 		if err != noFSFree {
 			log.Printf("Error getting filesystem info: %v", err)
@@ -102,9 +103,25 @@ func oneHeartbeat(startTime time.Time) {
 		Used:      spaceUsed,
 		Free:      availableSpace(),
 		Version:   VERSION,
+		Scheme:    localScheme(),
+		Zone:      *zone,
+		Tier:      *tier,
+		Volumes:   volumeInfos(),
+		Weight:    configuredWeight(),
 	}
 
-	err = couchbase.Set("/"+serverId, 0, aboutMe)
+	// Keep any decommission or maintenance mark an admin has put on
+	// our record.
+	err = couchbase.Update("/"+serverId, 0, func(in []byte) ([]byte, error) {
+		existing := StorageNode{}
+		if json.Unmarshal(in, &existing) == nil {
+			aboutMe.Draining = existing.Draining
+			aboutMe.Maintenance = existing.Maintenance
+		}
+		return json.Marshal(aboutMe)
+	})
+	setDraining(aboutMe.Draining)
+	setMaintenance(aboutMe.Maintenance)
 	if err != nil {
 		log.Printf("Failed to record a heartbeat: %v", err)
 	}
@@ -125,7 +142,10 @@ func heartbeat() {
 	for {
 		select {
 		case <-ticker.C:
-			oneHeartbeat(startTime)
+			// Don't undo announceStopping.
+			if !isStopping() {
+				oneHeartbeat(startTime)
+			}
 		case <-configChange:
 			if period != globalConfig.HeartbeatFreq {
 				period = globalConfig.HeartbeatFreq
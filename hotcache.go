@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"flag"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dustin/go-humanize"
+)
+
+var hotCacheSize = flag.String("hotCache", "",
+	"Memory to keep small, frequently read blobs in (e.g. 256MB)")
+var hotCacheObject = flag.String("hotCacheObject", "64KB",
+	"Largest blob -hotCache keeps")
+
+// Counts how often keys are seen in a fixed amount of space, halving
+// every count once enough have been seen so old popularity fades.
+type countMinSketch struct {
+	rows    [4][]uint8
+	mask    uint64
+	added   int
+	resetAt int
+}
+
+const sketchMax = 15
+
+func newCountMinSketch(width int) *countMinSketch {
+	w := 64
+	for w < width {
+		w *= 2
+	}
+	s := &countMinSketch{mask: uint64(w - 1), resetAt: 10 * w}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, w)
+	}
+	return s
+}
+
+func (s *countMinSketch) indexes(k string) [4]uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(k))
+	a := h.Sum64()
+	b := a>>32 | 1
+	var rv [4]uint64
+	for i := range rv {
+		rv[i] = (a + uint64(i)*b) & s.mask
+	}
+	return rv
+}
+
+func (s *countMinSketch) add(k string) {
+	for i, x := range s.indexes(k) {
+		if s.rows[i][x] < sketchMax {
+			s.rows[i][x]++
+		}
+	}
+	s.added++
+	if s.added >= s.resetAt {
+		for i := range s.rows {
+			for x := range s.rows[i] {
+				s.rows[i][x] /= 2
+			}
+		}
+		s.added /= 2
+	}
+}
+
+func (s *countMinSketch) estimate(k string) uint8 {
+	rv := uint8(sketchMax)
+	for i, x := range s.indexes(k) {
+		if s.rows[i][x] < rv {
+			rv = s.rows[i][x]
+		}
+	}
+	return rv
+}
+
+// Small blobs kept in memory.  A blob only gets in by pushing out
+// one that's been read less often recently (TinyLFU admission), so a
+// burst of one-off reads can't flush out what's actually hot.
+type hotCache struct {
+	mu        sync.Mutex
+	max       int64
+	maxObject int64
+	size      int64
+	lru       *list.List // of *hotCacheEntry, most recent first
+	entries   map[string]*list.Element
+	sketch    *countMinSketch
+
+	hits, misses, admitted, rejected uint64
+}
+
+type hotCacheEntry struct {
+	oid  string
+	data []byte
+}
+
+// Counters for metrics.
+type hotCacheStats struct {
+	Size     int64
+	Blobs    int
+	Hits     uint64
+	Misses   uint64
+	Admitted uint64
+	Rejected uint64
+}
+
+// Holds the *hotCache, if -hotCache is given.  A reload can start
+// one while blobs are being read, so it's reached through
+// hotBlobCache.
+var blobHotCache atomic.Value
+
+// The hot cache, or nil if there isn't one.
+func hotBlobCache() *hotCache {
+	c, _ := blobHotCache.Load().(*hotCache)
+	return c
+}
+
+func setHotBlobCache(c *hotCache) {
+	blobHotCache.Store(c)
+}
+
+func initHotCache() {
+	if *hotCacheSize == "" {
+		return
+	}
+	max, err := humanize.ParseBytes(*hotCacheSize)
+	if err != nil {
+		log.Fatalf("Error parsing hot cache size: %v", err)
+	}
+	maxObject, err := humanize.ParseBytes(*hotCacheObject)
+	if err != nil {
+		log.Fatalf("Error parsing hot cache object size: %v", err)
+	}
+	if max > 0 {
+		setHotBlobCache(newHotCache(int64(max), int64(maxObject)))
+	}
+}
+
+func newHotCache(max, maxObject int64) *hotCache {
+	// Track a few times as many blobs as could fit if they were
+	// all half the largest size.
+	width := 4 * int(max/(maxObject/2+1))
+	return &hotCache{
+		max:       max,
+		maxObject: maxObject,
+		lru:       list.New(),
+		entries:   map[string]*list.Element{},
+		sketch:    newCountMinSketch(width),
+	}
+}
+
+// A blob's content, if it's in memory.  Every lookup counts toward
+// the blob being let in.
+func (c *hotCache) get(oid string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sketch.add(oid)
+	if el, ok := c.entries[oid]; ok {
+		c.hits++
+		c.lru.MoveToFront(el)
+		return el.Value.(*hotCacheEntry).data, true
+	}
+	c.misses++
+	return nil, false
+}
+
+// Should a blob of this size be read into memory?
+func (c *hotCache) admit(oid string, size int64) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if size > c.maxObject || size > c.max {
+		return false
+	}
+	if c.size+size <= c.max {
+		return true
+	}
+	victim := c.lru.Back().Value.(*hotCacheEntry)
+	if c.sketch.estimate(oid) > c.sketch.estimate(victim.oid) {
+		return true
+	}
+	c.rejected++
+	return false
+}
+
+// Keep an admitted blob, pushing out the least recently read to make
+// room.
+func (c *hotCache) put(oid string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[oid]; ok {
+		return
+	}
+	for c.size+int64(len(data)) > c.max && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+	c.entries[oid] = c.lru.PushFront(&hotCacheEntry{oid, data})
+	c.size += int64(len(data))
+	c.admitted++
+}
+
+// Change the cache's limits, dropping blobs that no longer fit.
+func (c *hotCache) resize(max, maxObject int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.max, c.maxObject = max, maxObject
+	for el := c.lru.Back(); el != nil; {
+		prev := el.Prev()
+		if int64(len(el.Value.(*hotCacheEntry).data)) > maxObject {
+			c.remove(el)
+		}
+		el = prev
+	}
+	for c.size > c.max && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *hotCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*hotCacheEntry)
+	delete(c.entries, e.oid)
+	c.size -= int64(len(e.data))
+}
+
+// Drop a blob that's no longer stored here.
+func (c *hotCache) forget(oid string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[oid]; ok {
+		c.remove(el)
+	}
+}
+
+func (c *hotCache) stats() hotCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return hotCacheStats{
+		Size:     c.size,
+		Blobs:    c.lru.Len(),
+		Hits:     c.hits,
+		Misses:   c.misses,
+		Admitted: c.admitted,
+		Rejected: c.rejected,
+	}
+}
+
+type memBlob struct {
+	*bytes.Reader
+}
+
+func (memBlob) Close() error { return nil }
+
+// Open a local blob, from memory if it's hot enough to be kept there.
+func openHotBlob(oid string) (ReadSeekCloser, error) {
+	c := hotBlobCache()
+	if data, ok := c.get(oid); ok {
+		return memBlob{bytes.NewReader(data)}, nil
+	}
+	f, err := openCheckedLocalBlob(oid)
+	if err != nil || c == nil {
+		return f, err
+	}
+
+	size, err := f.Seek(0, os.SEEK_END)
+	if err == nil {
+		_, err = f.Seek(0, os.SEEK_SET)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !c.admit(oid, size) {
+		return f, nil
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	c.put(oid, data)
+	return memBlob{bytes.NewReader(data)}, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCountMinSketch(t *testing.T) {
+	s := newCountMinSketch(100)
+	for i := 0; i < 5; i++ {
+		s.add("hot")
+	}
+	s.add("warm")
+	if e := s.estimate("hot"); e != 5 {
+		t.Errorf("Expected hot seen 5 times, got %v", e)
+	}
+	if e := s.estimate("cold"); e != 0 {
+		t.Errorf("Expected cold not seen, got %v", e)
+	}
+
+	for i := 0; i < 100; i++ {
+		s.add("hot")
+	}
+	if e := s.estimate("hot"); e != sketchMax {
+		t.Errorf("Expected hot to saturate at %v, got %v", sketchMax, e)
+	}
+
+	// Enough other traffic ages everything.
+	for i := 0; i < s.resetAt; i++ {
+		s.add(fmt.Sprintf("k%d", i))
+	}
+	if e := s.estimate("hot"); e >= sketchMax {
+		t.Errorf("Expected hot to have aged, got %v", e)
+	}
+}
+
+func TestHotCacheAdmission(t *testing.T) {
+	c := newHotCache(10, 5)
+
+	read := func(oid string) bool {
+		_, ok := c.get(oid)
+		if !ok && c.admit(oid, 5) {
+			c.put(oid, []byte("12345"))
+		}
+		return ok
+	}
+
+	// There's room for the first two whatever they are.
+	read("a")
+	read("a")
+	read("b")
+	if !read("a") || !read("b") {
+		t.Fatalf("Expected a and b to be cached")
+	}
+
+	// A one-off read doesn't push out anything more popular, b
+	// being the least recently read.
+	read("a")
+	read("c")
+	if _, ok := c.entries["c"]; ok {
+		t.Errorf("Expected c to be kept out")
+	}
+
+	// Once it's read more than b, it takes b's place.
+	for i := 0; i < 3; i++ {
+		read("c")
+	}
+	if !read("c") || !read("a") {
+		t.Errorf("Expected a and c to be cached")
+	}
+	if _, ok := c.entries["b"]; ok {
+		t.Errorf("Expected b to be evicted")
+	}
+
+	if c.admit("big", 6) {
+		t.Errorf("Expected a blob over the object size to be refused")
+	}
+
+	c.forget("a")
+	st := c.stats()
+	if st.Blobs != 1 || st.Size != 5 || st.Admitted != 3 || st.Rejected == 0 {
+		t.Errorf("Unexpected stats: %+v", st)
+	}
+}
@@ -21,26 +21,57 @@ const (
 	blobPrefix       = "/.cbfs/blob/"
 	blobInfoPath     = "/.cbfs/blob/info/"
 	nodePrefix       = "/.cbfs/nodes/"
+	zonesPrefix      = "/.cbfs/zones/"
+	drainPrefix      = "/.cbfs/decommission/"
+	maintPrefix      = "/.cbfs/maintenance/"
 	metaPrefix       = "/.cbfs/meta/"
 	proxyPrefix      = "/.cbfs/viewproxy/"
 	crudproxyPrefix  = "/.cbfs/crudproxy/"
 	fetchPrefix      = "/.cbfs/fetch/"
 	listPrefix       = "/.cbfs/list/"
 	configPrefix     = "/.cbfs/config/"
+	configReloadPath = "/.cbfs/config/reload"
 	zipPrefix        = "/.cbfs/zip/"
 	tarPrefix        = "/.cbfs/tar/"
+	archivePrefix    = "/.cbfs/archive/"
+	extractPrefix    = "/.cbfs/extract/"
+	composePrefix    = "/.cbfs/compose/"
+	chunksPrefix     = "/.cbfs/chunks/"
 	fsckPrefix       = "/.cbfs/fsck/"
+	orphansPrefix    = "/.cbfs/orphans/"
+	trashPrefix      = "/.cbfs/trash/"
+	retentionPrefix  = "/.cbfs/retention/"
+	pinPrefix        = "/.cbfs/pin/"
+	locksPrefix      = "/.cbfs/locks/"
 	taskPrefix       = "/.cbfs/tasks/"
 	taskinfoPrefix   = "/.cbfs/tasks/info/"
+	gcRunsPrefix     = "/.cbfs/tasks/gc/"
 	pingPrefix       = "/.cbfs/ping/"
 	fileInfoPrefix   = "/.cbfs/info/file/"
 	framePrefix      = "/.cbfs/info/frames/"
 	markBackupPrefix = "/.cbfs/backup/mark/"
 	restorePrefix    = "/.cbfs/backup/restore/"
 	backupStrmPrefix = "/.cbfs/backup/stream/"
+	bundlePrefix     = "/.cbfs/backup/bundle/"
 	backupPrefix     = "/.cbfs/backup/"
+	multipartPrefix  = "/.cbfs/multipart/"
+	revisionsPrefix  = "/.cbfs/revisions/"
+	formUploadPrefix = "/.cbfs/upload/"
+	metricsPath      = "/.cbfs/metrics"
 	quitPrefix       = "/.cbfs/exit/"
 	debugPrefix      = "/.cbfs/debug/"
+	dedupPrefix      = "/.cbfs/dedup/"
+	quotaPrefix      = "/.cbfs/quota/"
+	batchPrefix      = "/.cbfs/batch/"
+	searchPrefix     = "/.cbfs/search/"
+	findPrefix       = "/.cbfs/find/"
+	duPrefix         = "/.cbfs/du/"
+	changesPrefix    = "/.cbfs/changes/"
+	mirrorsPrefix    = "/.cbfs/mirrors/"
+	tiersPrefix      = "/.cbfs/tiers/"
+	replStatusPath   = "/.cbfs/replication/status"
+	uiPrefix         = "/.cbfs/ui/"
+	uiStatusPath     = "/.cbfs/ui/status"
 )
 
 type storInfo struct {
@@ -85,7 +116,8 @@ func altStoreFile(name string, r io.Reader,
 	}
 
 	nodes, err := findRemoteNodes()
-	nodes = nodes.withAtLeast(length)
+	nodes = nodes.accepting().withAtLeast(length).byWeight().
+		spreadAcrossZones(map[string]bool{*zone: true})
 	if err == nil && len(nodes) > 0 {
 		r1, r2 := newMultiReader(r)
 		r = r2
@@ -95,7 +127,7 @@ func altStoreFile(name string, r io.Reader,
 
 			rv := storInfo{node: nodes[0].Address()}
 
-			rurl := "http://" + nodes[0].Address() + blobPrefix
+			rurl := nodes[0].URLFor(blobPrefix)
 			log.Printf("Piping secondary storage of %v to %v",
 				name, nodes[0])
 
@@ -136,7 +168,7 @@ func altStoreFile(name string, r io.Reader,
 }
 
 func doPostRawBlob(w http.ResponseWriter, req *http.Request) {
-	f, err := NewHashRecord(*root, "")
+	f, err := NewHashRecord(pickVolume(), "")
 	if err != nil {
 		log.Printf("Error writing tmp file: %v", err)
 		http.Error(w, err.Error(), 500)
@@ -172,9 +204,47 @@ func putUserFile(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	fn, _ := resolvePath(req)
+	if code, err := decodeRequestBody(req); err != nil {
+		if code == 415 {
+			w.Header().Set("Accept-Encoding", supportedCodings())
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	fn, k := resolvePath(req)
+
+	expires, err := parseExpires(requestedExpires(req), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if _, err := parseExpires(req.Header.Get(retainUntilHeader), time.Now()); err != nil {
+		http.Error(w, "invalid retention: "+err.Error(), 400)
+		return
+	}
+
+	if err := checkUserMeta(req.Header); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if req.ContentLength > 0 &&
+		httpQuotaError(w, fn, checkQuotaSize(fn, req.ContentLength)) {
+		return
+	}
 
-	f, err := NewHashRecord(*root, req.Header.Get("X-CBFS-Hash"))
+	if code := precheckWrite(k, req.Header); code != 0 {
+		sendConditionFailure(w, code, "")
+		return
+	}
+
+	if shouldChunk(req.ContentLength) {
+		putChunkedFile(w, req, fn, expires)
+		return
+	}
+
+	f, err := NewUploadRecord(pickVolume(), req.Header.Get("X-CBFS-Hash"))
 	if err != nil {
 		log.Printf("Error writing tmp file: %v", err)
 		http.Error(w, "Error writing tmp file", 500)
@@ -210,10 +280,11 @@ func putUserFile(w http.ResponseWriter, req *http.Request) {
 	}
 
 	fm := fileMeta{
-		Headers:  req.Header,
+		Headers:  storedHeaders(req.Header),
 		OID:      h,
 		Length:   length,
 		Modified: time.Now().UTC(),
+		Expires:  expires,
 	}
 
 	// We *should* have two replicas at this point.
@@ -261,6 +332,9 @@ func putUserFile(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, "precondition failed", 412)
 		return
 	}
+	if httpQuotaError(w, fn, err) || httpRetentionError(w, fn, err) {
+		return
+	}
 	if err != nil {
 		log.Printf("Error storing file meta of %v -> %v: %v",
 			fn, h, err)
@@ -271,13 +345,13 @@ func putUserFile(w http.ResponseWriter, req *http.Request) {
 
 	log.Printf("Wrote %v -> %v", req.URL.Path, h)
 
-	if globalConfig.MinReplicas > replicas {
+	if want := replicaTarget(fn); want > replicas {
 		// We're below min replica count.  Start fixing that
 		// up immediately.
-		go increaseReplicaCount(h, length,
-			globalConfig.MinReplicas-replicas)
+		go increaseReplicaCount(h, length, want-replicas)
 	}
 
+	w.Header().Set("Etag", fileETag(h))
 	w.WriteHeader(201)
 }
 
@@ -294,7 +368,7 @@ func putRawHash(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	f, err := NewHashRecord(*root, inputhash)
+	f, err := NewHashRecord(pickVolume(), inputhash)
 	if err != nil {
 		log.Printf("Error writing tmp file: %v", err)
 		http.Error(w, err.Error(), 500)
@@ -331,6 +405,10 @@ func doPut(w http.ResponseWriter, req *http.Request) {
 		putRawHash(w, req)
 	case strings.HasPrefix(req.URL.Path, metaPrefix):
 		putMeta(w, req, minusPrefix(req.URL.Path, metaPrefix))
+	case strings.HasPrefix(req.URL.Path, multipartPrefix):
+		putMultipartPart(w, req, minusPrefix(req.URL.Path, multipartPrefix))
+	case strings.HasPrefix(req.URL.Path, locksPrefix):
+		doAcquireLock(w, req, minusPrefix(req.URL.Path, locksPrefix))
 	case *enableCRUDProxy && strings.HasPrefix(req.URL.Path, crudproxyPrefix):
 		proxyCRUDPut(w, req, minusPrefix(req.URL.Path, crudproxyPrefix))
 	case strings.HasPrefix(req.URL.Path, "/.cbfs/"):
@@ -345,7 +423,28 @@ func isResponseHeader(s string) bool {
 	case "content-type":
 		return true
 	}
-	return false
+	return isUserMetaHeader(s)
+}
+
+// Upload settings that are read back from a file's stored headers.
+var storedSettingHeaders = []string{"X-CBFS-Expiration", "X-CBFS-KeepRevs",
+	"X-CBFS-Expires", retainUntilHeader}
+
+// The headers worth keeping with a file: those served back with it
+// and the settings read from it later.  Everything else, credentials
+// in particular, is dropped.
+func storedHeaders(h http.Header) http.Header {
+	rv := http.Header{}
+	for k, v := range h {
+		keep := isResponseHeader(k)
+		for _, s := range storedSettingHeaders {
+			keep = keep || strings.EqualFold(k, s)
+		}
+		if keep {
+			rv[k] = v
+		}
+	}
+	return rv
 }
 
 func resolvePath(req *http.Request) (path string, key string) {
@@ -367,12 +466,18 @@ func resolvePath(req *http.Request) (path string, key string) {
 func doHeadUserFile(w http.ResponseWriter, req *http.Request) {
 	path, k := resolvePath(req)
 	got := fileMeta{}
+	done := traceDB(req, "get", k)
 	err := couchbase.Get(k, &got)
+	done(err)
 	if err != nil {
 		log.Printf("Error getting file %#v: %v", path, err)
 		http.Error(w, err.Error(), 404)
 		return
 	}
+	if got.expired(time.Now()) {
+		http.Error(w, "file expired", 404)
+		return
+	}
 
 	if req.FormValue("rev") != "" {
 		http.Error(w, "rev parameter not specified", 400)
@@ -390,12 +495,26 @@ func doHeadUserFile(w http.ResponseWriter, req *http.Request) {
 		oldestRev = got.Previous[0].Revno
 	}
 
+	if code := evalConditions(req.Header, true, true,
+		fileETag(got.OID), got.Modified); code != 0 {
+		sendConditionFailure(w, code, fileETag(got.OID))
+		return
+	}
+
 	w.Header().Set("X-CBFS-Revno", strconv.Itoa(got.Revno))
 	w.Header().Set("X-CBFS-OldestRev", strconv.Itoa(oldestRev))
+	if got.retained(time.Now()) {
+		w.Header().Set(retainUntilHeader, got.RetainUntil.Format(time.RFC3339))
+	}
+	if len(got.Pinned) > 0 {
+		w.Header().Set(pinnedHeader, strings.Join(got.Pinned, ", "))
+	}
 	w.Header().Set("Last-Modified",
 		got.Modified.UTC().Format(http.TimeFormat))
-	w.Header().Set("Etag", `"`+got.OID+`"`)
+	w.Header().Set("Etag", fileETag(got.OID))
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", got.Length))
+	w.Header().Set("Accept-Ranges", "bytes")
+	setFileInfoHeaders(w, path, got)
 
 	w.WriteHeader(200)
 }
@@ -440,19 +559,30 @@ func doHead(w http.ResponseWriter, req *http.Request) {
 func doGetUserDoc(w http.ResponseWriter, req *http.Request) {
 	path, k := resolvePath(req)
 	got := fileMeta{}
+	done := traceDB(req, "get", k)
 	err := couchbase.Get(k, &got)
+	done(err)
 	if err != nil {
 		log.Printf("Error getting file %#v: %v", path, err)
 		http.Error(w, err.Error(), 404)
 		return
 	}
+	if got.expired(time.Now()) {
+		http.Error(w, "file expired", 404)
+		return
+	}
 	if got.Type != "file" {
 		log.Printf("%v is not a file", path)
 		http.Error(w, fmt.Sprintf("Item at %v is not a file.", path), 404)
 		return
 	}
+	if req.FormValue("meta") == "json" {
+		sendFileInfo(w, req, path, got)
+		return
+	}
 
 	oid := got.OID
+	parts := got.Parts
 	respHeaders := got.Headers
 	modified := got.Modified
 	revno := got.Revno
@@ -475,6 +605,7 @@ func doGetUserDoc(w http.ResponseWriter, req *http.Request) {
 		for _, rev := range got.Previous {
 			if rev.Revno == revno {
 				oid = rev.OID
+				parts = rev.Parts
 				modified = rev.Modified
 				respHeaders = rev.Headers
 				break
@@ -487,34 +618,66 @@ func doGetUserDoc(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	if canGzip(req) && shouldGzip(got) {
-		w.Header().Set("Content-Encoding", "gzip")
-		gz := gzip.NewWriter(w)
-		defer gz.Close()
-		w = &geezyWriter{w, gz}
+	if code := evalConditions(req.Header, true, true,
+		fileETag(oid), modified); code != 0 {
+		sendConditionFailure(w, code, fileETag(oid))
+		return
+	}
+
+	localOnly := req.Header.Get("X-CBFS-LocalOnly") != ""
+	content := fileMeta{OID: oid, Parts: parts}
+	if !localOnly && redirectToZone(w, req, content) {
+		return
+	}
+	if !localOnly && req.Method == "GET" && wantsDirect(req) &&
+		!hasLocalFile(content) && redirectToHolder(w, req, content) {
+		return
+	}
+
+	// Ranges refer to the stored bytes, so never compress them.
+	wantRange := req.Header.Get("Range") != ""
+	if shouldGzip(got) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if ce := negotiateCoding(req); ce != "" && !wantRange {
+			w.Header().Set("Content-Encoding", ce)
+			cw := contentCodings[ce].newWriter(w)
+			defer cw.Close()
+			w = &geezyWriter{w, cw}
+		}
 	}
 
 	w.Header().Set("X-CBFS-Revno", strconv.Itoa(revno))
 	w.Header().Set("X-CBFS-OldestRev", strconv.Itoa(oldestRev))
+	if got.retained(time.Now()) {
+		w.Header().Set(retainUntilHeader, got.RetainUntil.Format(time.RFC3339))
+	}
+	if len(got.Pinned) > 0 {
+		w.Header().Set(pinnedHeader, strings.Join(got.Pinned, ", "))
+	}
 
-	inm := req.Header.Get("If-None-Match")
-	if len(inm) > 2 {
-		inm = inm[1 : len(inm)-1]
-		if got.OID == inm {
-			w.WriteHeader(304)
-			return
+	if wantRange && !localOnly && len(parts) == 0 && !hasLocalBlob(oid) {
+		for k, v := range respHeaders {
+			if isResponseHeader(k) {
+				w.Header()[k] = v
+			}
 		}
+		w.Header().Set("Etag", fileETag(oid))
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+		go recordBlobAccess(oid)
+		proxyBlobRange(w, req, oid, modified)
+		return
 	}
 
-	f, err := openBlob(oid, req.Header.Get("X-CBFS-LocalOnly") != "")
+	f, err := openFileContent(oid, parts, localOnly)
 	if err == nil {
 		// normal path
 		defer f.Close()
 	} else if notloc, ok := err.(errNotLocal); ok {
-		w.Header().Set("Location", notloc.urls[0])
+		urls := notloc.urls(requestZone(req))
+		w.Header().Set("Location", urls[0])
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		w.WriteHeader(300)
-		json.NewEncoder(w).Encode(notloc.urls)
+		json.NewEncoder(w).Encode(urls)
 		return
 	} else {
 		http.Error(w, err.Error(), 500)
@@ -527,12 +690,25 @@ func doGetUserDoc(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	w.Header().Set("Etag", `"`+oid+`"`)
+	w.Header().Set("Etag", fileETag(oid))
+	w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+
+	// The hash only covers the whole, unencoded content.
+	if wantsHash(req) && !wantRange && w.Header().Get("Content-Encoding") == "" {
+		if len(parts) == 0 {
+			w.Header().Set(hashHeader, blobDigest(oid))
+		} else if req.Method == "GET" {
+			th := newTrailerHasher(w)
+			defer th.finish()
+			w = th
+		}
+	}
 
 	go recordBlobAccess(oid)
 	if r, ok := f.(io.ReadSeeker); ok {
 		http.ServeContent(w, req, path, modified, r)
 	} else {
+		w.Header().Set("Accept-Ranges", "bytes")
 		w.WriteHeader(200)
 		_, err := io.Copy(w, f)
 		if err != nil {
@@ -541,20 +717,119 @@ func doGetUserDoc(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func hasLocalBlob(oid string) bool {
+	f, err := openLocalBlob(oid)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// Does the If-Range header (if any) still refer to this content?
+func ifRangeMatches(req *http.Request, oid string, modified time.Time) bool {
+	ir := req.Header.Get("If-Range")
+	switch {
+	case ir == "":
+		return true
+	case strings.HasPrefix(ir, `"`):
+		return ir == fileETag(oid)
+	}
+	t, err := http.ParseTime(ir)
+	return err == nil && !modified.Truncate(time.Second).After(t)
+}
+
+// Serve a byte range of a blob we don't have by forwarding the
+// range request to a node that does.  That node's raw blob handler
+// deals with parsing, multi-range responses and 416s.
+func proxyBlobRange(w http.ResponseWriter, req *http.Request,
+	oid string, modified time.Time) {
+
+	ownership, err := getBlobOwnership(oid)
+	if err != nil {
+		http.Error(w, "Can't find info for blob "+oid, 404)
+		return
+	}
+
+	if len(ownership.Nodes) == 0 && ownership.EC != nil {
+		r, err := openErasureSet(oid, ownership)
+		if err != nil {
+			http.Error(w, err.Error(), 502)
+			return
+		}
+		defer r.Close()
+		http.ServeContent(w, req, "", modified, r)
+		return
+	}
+
+	for _, n := range ownership.ResolveNodes().preferZone(*zone) {
+		preq, err := http.NewRequest("GET", n.BlobURL(oid), nil)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if ifRangeMatches(req, oid, modified) {
+			preq.Header.Set("Range", req.Header.Get("Range"))
+		}
+		preq.Header.Set(requestIDHeader, req.Header.Get(requestIDHeader))
+
+		res, err := n.ClientForTransfer(ownership.Length).Do(preq)
+		if err != nil {
+			log.Printf("Error reading range of %s from node %v: %v",
+				oid, n, err)
+			continue
+		}
+
+		switch res.StatusCode {
+		case 200, 206, 416:
+		default:
+			log.Printf("Error response %v from node %v getting %v",
+				res.Status, n, oid)
+			res.Body.Close()
+			continue
+		}
+
+		for _, h := range []string{"Content-Range", "Content-Length"} {
+			if v := res.Header.Get(h); v != "" {
+				w.Header().Set(h, v)
+			}
+		}
+		if ct := res.Header.Get("Content-Type"); strings.HasPrefix(ct,
+			"multipart/") || w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", ct)
+		}
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.WriteHeader(res.StatusCode)
+
+		_, err = io.Copy(w, res.Body)
+		res.Body.Close()
+		if err != nil {
+			log.Printf("Error proxying range of %v: %v", oid, err)
+		}
+		return
+	}
+	http.Error(w, "couldn't get blob from any node", 502)
+}
+
 func doServeRawBlob(w http.ResponseWriter, req *http.Request, oid string) {
 	if !validHash(oid) {
 		http.Error(w, "Error invalid hash: "+oid, 400)
 		return
 	}
-	f, err := openLocalBlob(oid)
+	f, err := openHotBlob(oid)
 	if err != nil {
 		http.Error(w, "Error opening blob: "+err.Error(), 404)
-		removeBlobOwnershipRecord(oid, serverId)
+		if os.IsNotExist(err) {
+			repairMissingBlob(oid)
+		}
 		return
 	}
 	defer f.Close()
 
 	w.Header().Set("Content-Type", "application/octet-stream")
+	if wantsHash(req) && req.Header.Get("Range") == "" {
+		w.Header().Set(hashHeader, blobDigest(oid))
+	}
 
 	go recordBlobAccess(oid)
 	http.ServeContent(w, req, "", time.Time{}, f)
@@ -572,7 +847,8 @@ func getBlobFromRemote(w http.ResponseWriter, oid string,
 		return err
 	}
 
-	f, err := openRemote(oid, ownership.Length, cachePerc, ownership.ResolveNodes())
+	f, err := openRemote(oid, ownership.Length, cachePerc,
+		ownership.ResolveNodes().preferZone(*zone))
 	if err != nil {
 		return err
 	}
@@ -593,11 +869,6 @@ func getBlobFromRemote(w http.ResponseWriter, oid string,
 	return err
 }
 
-func canGzip(req *http.Request) bool {
-	acceptable := req.Header.Get("accept-encoding")
-	return strings.Contains(acceptable, "gzip")
-}
-
 type captureResponseWriter struct {
 	w          io.Writer
 	hdr        http.Header
@@ -655,22 +926,62 @@ func doGet(w http.ResponseWriter, req *http.Request) {
 	switch {
 	case req.URL.Path == pingPrefix:
 		doPing(w, req)
+	case req.URL.Path == metricsPath:
+		doMetrics(w, req)
 	case req.URL.Path == framePrefix:
 		doGetFramesData(w, req)
 	case req.URL.Path == blobPrefix:
 		doList(w, req)
+	case req.URL.Path == zonesPrefix:
+		doListZones(w, req)
+	case req.URL.Path == tiersPrefix:
+		doListTiers(w, req)
+	case req.URL.Path == replStatusPath:
+		doReplicationStatus(w, req)
 	case req.URL.Path == nodePrefix:
 		doListNodes(w, req)
 	case req.URL.Path == taskinfoPrefix:
 		doListTaskInfo(w, req)
+	case req.URL.Path == gcRunsPrefix:
+		doListGCRuns(w, req)
 	case req.URL.Path == taskPrefix:
 		doListTasks(w, req)
 	case req.URL.Path == configPrefix:
 		doGetConfig(w, req)
 	case strings.HasPrefix(req.URL.Path, backupStrmPrefix):
 		doExport(w, req, minusPrefix(req.URL.Path, backupStrmPrefix))
+	case strings.HasPrefix(req.URL.Path, bundlePrefix):
+		doBundle(w, req, minusPrefix(req.URL.Path, bundlePrefix))
 	case req.URL.Path == backupPrefix:
 		doGetBackupInfo(w, req)
+	case req.URL.Path == dedupPrefix:
+		doDedupReport(w, req)
+	case req.URL.Path == quotaPrefix:
+		doListQuotas(w, req)
+	case req.URL.Path == changesPrefix,
+		req.URL.Path == strings.TrimSuffix(changesPrefix, "/"):
+		doChanges(w, req)
+	case req.URL.Path == mirrorsPrefix:
+		doListMirrors(w, req)
+	case req.URL.Path == searchPrefix:
+		doSearchUserMeta(w, req)
+	case strings.HasPrefix(req.URL.Path, taskPrefix) &&
+		isExtractID(minusPrefix(req.URL.Path, taskPrefix)):
+		doGetExtract(w, req, minusPrefix(req.URL.Path, taskPrefix))
+	case strings.HasPrefix(req.URL.Path, taskPrefix):
+		doGetBulkDelete(w, req, minusPrefix(req.URL.Path, taskPrefix))
+	case strings.HasPrefix(req.URL.Path, duPrefix):
+		doDu(w, req, minusPrefix(req.URL.Path, duPrefix))
+	case strings.HasPrefix(req.URL.Path, findPrefix):
+		doFind(w, req, minusPrefix(req.URL.Path, findPrefix))
+	case strings.HasPrefix(req.URL.Path, chunksPrefix):
+		doGetChunks(w, req, minusPrefix(req.URL.Path, chunksPrefix))
+	case strings.HasPrefix(req.URL.Path, retentionPrefix):
+		doGetRetention(w, req, minusPrefix(req.URL.Path, retentionPrefix))
+	case strings.HasPrefix(req.URL.Path, pinPrefix):
+		doGetPins(w, req, minusPrefix(req.URL.Path, pinPrefix))
+	case strings.HasPrefix(req.URL.Path, locksPrefix):
+		doGetLock(w, req, minusPrefix(req.URL.Path, locksPrefix))
 	case strings.HasPrefix(req.URL.Path, fileInfoPrefix):
 		doFileInfo(w, req,
 			minusPrefix(req.URL.Path, fileInfoPrefix))
@@ -680,6 +991,12 @@ func doGet(w http.ResponseWriter, req *http.Request) {
 	case strings.HasPrefix(req.URL.Path, metaPrefix):
 		doGetMeta(w, req,
 			minusPrefix(req.URL.Path, metaPrefix))
+	case strings.HasPrefix(req.URL.Path, multipartPrefix):
+		doGetMultipart(w, req,
+			minusPrefix(req.URL.Path, multipartPrefix))
+	case strings.HasPrefix(req.URL.Path, revisionsPrefix):
+		doListRevisions(w, req,
+			minusPrefix(req.URL.Path, revisionsPrefix))
 	case strings.HasPrefix(req.URL.Path, blobPrefix):
 		doServeRawBlob(w, req, minusPrefix(req.URL.Path, blobPrefix))
 	case *enableViewProxy && strings.HasPrefix(req.URL.Path, proxyPrefix):
@@ -692,10 +1009,18 @@ func doGet(w http.ResponseWriter, req *http.Request) {
 		doZipDocs(w, req, minusPrefix(req.URL.Path, zipPrefix))
 	case strings.HasPrefix(req.URL.Path, tarPrefix):
 		doTarDocs(w, req, minusPrefix(req.URL.Path, tarPrefix))
+	case strings.HasPrefix(req.URL.Path, archivePrefix):
+		doArchiveDocs(w, req, minusPrefix(req.URL.Path, archivePrefix))
 	case strings.HasPrefix(req.URL.Path, fsckPrefix):
 		dofsck(w, req, minusPrefix(req.URL.Path, fsckPrefix))
+	case req.URL.Path == orphansPrefix:
+		doOrphans(w, req)
+	case strings.HasPrefix(req.URL.Path, trashPrefix):
+		doListTrash(w, req, minusPrefix(req.URL.Path, trashPrefix))
 	case strings.HasPrefix(req.URL.Path, debugPrefix):
 		doDebug(w, req)
+	case strings.HasPrefix(req.URL.Path, strings.TrimSuffix(uiPrefix, "/")):
+		doUI(w, req)
 	case strings.HasPrefix(req.URL.Path, "/.cbfs/"):
 		http.Error(w, "Can't GET here", 400)
 	default:
@@ -724,19 +1049,34 @@ func doDeleteOID(w http.ResponseWriter, req *http.Request) {
 
 func doDeleteUserDoc(w http.ResponseWriter, req *http.Request) {
 	_, k := resolvePath(req)
+	existing := fileMeta{}
 	err := couchbase.Update(k, 0, func(in []byte) ([]byte, error) {
-		existing := fileMeta{}
+		existing = fileMeta{}
 		err := json.Unmarshal(in, &existing)
 		if !shouldStoreMeta(req.Header, err == nil, existing) {
 			return in, errUploadPrecondition
 		}
+		if err == nil {
+			path := eventPath(k, existing)
+			if err := checkRetention(path, existing, time.Now()); err != nil {
+				return in, err
+			}
+			if err := moveToTrash(path, existing); err != nil {
+				return in, err
+			}
+		}
 		return nil, nil
 	})
 	if err == nil {
+		duFileChanged(eventPath(k, existing), existing, fileMeta{})
+		notifyObject("deleted", eventPath(k, existing), existing)
+		refreshFilePins(existing)
 		w.WriteHeader(204)
 	} else if err == errUploadPrecondition {
 		http.Error(w, "precondition failed", 412)
-	} else {
+	} else if _, ok := err.(trashError); ok {
+		http.Error(w, err.Error(), 500)
+	} else if !httpRetentionError(w, eventPath(k, existing), err) {
 		http.Error(w, err.Error(), 404)
 	}
 }
@@ -745,10 +1085,24 @@ func doDelete(w http.ResponseWriter, req *http.Request) {
 	switch {
 	case strings.HasPrefix(req.URL.Path, blobPrefix):
 		doDeleteOID(w, req)
+	case strings.HasPrefix(req.URL.Path, multipartPrefix):
+		doAbortMultipart(w, req, minusPrefix(req.URL.Path, multipartPrefix))
+	case strings.HasPrefix(req.URL.Path, drainPrefix):
+		doDecommission(w, req, minusPrefix(req.URL.Path, drainPrefix))
+	case strings.HasPrefix(req.URL.Path, maintPrefix):
+		doMaintenance(w, req, minusPrefix(req.URL.Path, maintPrefix))
+	case strings.HasPrefix(req.URL.Path, trashPrefix):
+		doPurgeTrash(w, req, minusPrefix(req.URL.Path, trashPrefix))
+	case strings.HasPrefix(req.URL.Path, pinPrefix):
+		doSetPins(w, req, minusPrefix(req.URL.Path, pinPrefix))
+	case strings.HasPrefix(req.URL.Path, locksPrefix):
+		doReleaseLock(w, req, minusPrefix(req.URL.Path, locksPrefix))
 	case *enableCRUDProxy && strings.HasPrefix(req.URL.Path, crudproxyPrefix):
 		proxyCRUDDelete(w, req, minusPrefix(req.URL.Path, crudproxyPrefix))
 	case strings.HasPrefix(req.URL.Path, "/.cbfs/"):
 		http.Error(w, "Can't DELETE here", 400)
+	case req.FormValue("recursive") == "true":
+		doDeleteRecursive(w, req)
 	default:
 		doDeleteUserDoc(w, req)
 	}
@@ -821,26 +1175,78 @@ func doLinkFile(w http.ResponseWriter, req *http.Request) {
 func doPost(w http.ResponseWriter, req *http.Request) {
 	if req.URL.Path == blobPrefix {
 		doPostRawBlob(w, req)
+	} else if req.URL.Path == configReloadPath {
+		doReloadConfig(w, req)
 	} else if req.URL.Path == blobInfoPath {
 		doBlobInfo(w, req)
 	} else if strings.HasPrefix(req.URL.Path, markBackupPrefix) {
 		doMarkBackup(w, req)
+	} else if req.URL.Path == restorePrefix {
+		doRestoreBackup(w, req)
 	} else if strings.HasPrefix(req.URL.Path, restorePrefix) {
 		doRestoreDocument(w, req, minusPrefix(req.URL.Path, restorePrefix))
 	} else if strings.HasPrefix(req.URL.Path, taskPrefix) {
 		doInduceTask(w, req, minusPrefix(req.URL.Path, taskPrefix))
+	} else if strings.HasPrefix(req.URL.Path, drainPrefix) {
+		doDecommission(w, req, minusPrefix(req.URL.Path, drainPrefix))
+	} else if strings.HasPrefix(req.URL.Path, maintPrefix) {
+		doMaintenance(w, req, minusPrefix(req.URL.Path, maintPrefix))
 	} else if strings.HasPrefix(req.URL.Path, backupPrefix) {
 		doBackupDocs(w, req)
+	} else if req.URL.Path == multipartPrefix {
+		doInitMultipart(w, req)
+	} else if strings.HasPrefix(req.URL.Path, multipartPrefix) {
+		doCompleteMultipart(w, req, minusPrefix(req.URL.Path, multipartPrefix))
+	} else if strings.HasPrefix(req.URL.Path, formUploadPrefix) {
+		doFormUpload(w, req, minusPrefix(req.URL.Path, formUploadPrefix))
+	} else if strings.HasPrefix(req.URL.Path, revisionsPrefix) {
+		doRevertFile(w, req, minusPrefix(req.URL.Path, revisionsPrefix))
+	} else if req.URL.Path == batchPrefix {
+		doBatch(w, req)
+	} else if strings.HasPrefix(req.URL.Path, extractPrefix) {
+		doExtract(w, req, minusPrefix(req.URL.Path, extractPrefix))
+	} else if req.URL.Path == orphansPrefix {
+		doOrphans(w, req)
+	} else if strings.HasPrefix(req.URL.Path, fsckPrefix) {
+		dofsck(w, req, minusPrefix(req.URL.Path, fsckPrefix))
+	} else if strings.HasPrefix(req.URL.Path, trashPrefix) {
+		doRestoreTrash(w, req, minusPrefix(req.URL.Path, trashPrefix))
+	} else if strings.HasPrefix(req.URL.Path, retentionPrefix) {
+		doSetRetention(w, req, minusPrefix(req.URL.Path, retentionPrefix))
+	} else if strings.HasPrefix(req.URL.Path, pinPrefix) {
+		doSetPins(w, req, minusPrefix(req.URL.Path, pinPrefix))
+	} else if strings.HasPrefix(req.URL.Path, locksPrefix) {
+		doAcquireLock(w, req, minusPrefix(req.URL.Path, locksPrefix))
+	} else if strings.HasPrefix(req.URL.Path, composePrefix) {
+		doCompose(w, req, minusPrefix(req.URL.Path, composePrefix))
 	} else if strings.HasPrefix(req.URL.Path, quitPrefix) {
 		doExit(w, req)
 	} else if strings.HasPrefix(req.URL.Path, "/.cbfs/") {
 		http.Error(w, "Can't POST here", 400)
+	} else if req.URL.Query().Get("append") == "true" {
+		doAppendFile(w, req)
 	} else {
 		doLinkFile(w, req)
 	}
 }
 
 func httpHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "OPTIONS" {
+		doOptions(w, req)
+		return
+	}
+	if !checkRateLimit(w, req) {
+		return
+	}
+	proceed, signed := checkSignature(w, req)
+	if !proceed || !(signed || checkAuth(w, req)) {
+		return
+	}
+	if why := blobRefusal(); why != "" && storesBlob(req) {
+		http.Error(w, why, 503)
+		return
+	}
+
 	switch req.Method {
 	case "PUT":
 		doPut(w, req)
@@ -852,6 +1258,8 @@ func httpHandler(w http.ResponseWriter, req *http.Request) {
 		doHead(w, req)
 	case "DELETE":
 		doDelete(w, req)
+	case "COPY", "MOVE":
+		doCopyUserDoc(w, req, req.Method == "MOVE")
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
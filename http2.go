@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+var enableHTTP2 = flag.Bool("http2", false,
+	"Speak HTTP/2 to clients and other nodes (cleartext without TLS; "+
+		"every node must have it)")
+var internodeConns = flag.Int("internodeConns", 0,
+	"Idle connections to keep open to each other node (0: none)")
+
+// The transport for requests to other nodes.  Connections are kept
+// open when there's a pool or HTTP/2 multiplexes over them.
+func internodeTransport(timeout time.Duration) http.RoundTripper {
+	t := TimeoutTransport(timeout)
+	if *internodeConns > 0 || *enableHTTP2 {
+		t.DisableKeepAlives = false
+		t.MaxIdleConnsPerHost = *internodeConns
+		t.IdleConnTimeout = 90 * time.Second
+	}
+	if !*enableHTTP2 {
+		return t
+	}
+	if tlsEnabled() {
+		t.ForceAttemptHTTP2 = true
+		return t
+	}
+
+	// HTTP/2 with prior knowledge over plain TCP.
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(n, addr string, _ *tls.Config) (net.Conn, error) {
+			return t.Dial(n, addr)
+		},
+	}
+}
+
+// A handler that also accepts cleartext HTTP/2 if that's enabled.
+// Over TLS it's negotiated instead (see initTLS).
+func http2Handler(h http.Handler) http.Handler {
+	if *enableHTTP2 && !tlsEnabled() {
+		return h2c.NewHandler(h, &http2.Server{})
+	}
+	return h
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestInternodeTransport(t *testing.T) {
+	defer func(h bool, n int) { *enableHTTP2, *internodeConns = h, n }(
+		*enableHTTP2, *internodeConns)
+
+	tests := []struct {
+		http2     bool
+		conns     int
+		keepAlive bool
+	}{
+		{false, 0, false},
+		{false, 8, true},
+		{true, 0, true},
+	}
+
+	for _, test := range tests {
+		*enableHTTP2, *internodeConns = test.http2, test.conns
+		rt := internodeTransport(time.Second)
+		if tr, ok := rt.(*http.Transport); ok {
+			if tr.DisableKeepAlives == test.keepAlive ||
+				tr.MaxIdleConnsPerHost != test.conns {
+				t.Errorf("Expected keepalive=%v with %v conns for %+v, got %v/%v",
+					test.keepAlive, test.conns, test,
+					!tr.DisableKeepAlives, tr.MaxIdleConnsPerHost)
+			}
+		} else if !test.http2 {
+			t.Errorf("Expected an HTTP/1 transport for %+v, got %T", test, rt)
+		}
+	}
+}
+
+func TestCleartextHTTP2(t *testing.T) {
+	defer func(h bool) { *enableHTTP2 = h }(*enableHTTP2)
+	*enableHTTP2 = true
+
+	ts := httptest.NewServer(http2Handler(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(req.Proto))
+		})))
+	defer ts.Close()
+
+	hc := &http.Client{Transport: internodeTransport(time.Second)}
+	res, err := hc.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("Error fetching: %v", err)
+	}
+	defer res.Body.Close()
+	proto, err := ioutil.ReadAll(res.Body)
+	if err != nil || string(proto) != "HTTP/2.0" {
+		t.Errorf("Expected HTTP/2.0, got %q, %v", proto, err)
+	}
+}
@@ -11,7 +11,6 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -27,11 +26,28 @@ func doGetConfig(w http.ResponseWriter, req *http.Request) {
 		log.Printf("Error updating config: %v", err)
 	}
 
+	sendConfig(w, req, *globalConfig)
+}
+
+// Send conf with its secrets redacted, unless they're asked for (with
+// secrets=true) by another node or a user allowed to change the
+// config.
+func sendConfig(w http.ResponseWriter, req *http.Request,
+	conf cbfsconfig.CBFSConfig) {
+
+	if secrets, _ := strconv.ParseBool(req.FormValue("secrets")); !secrets {
+		conf = conf.Redacted()
+	} else if !configAdmin(req) {
+		http.Error(w, "Seeing the config's secrets requires "+
+			"permission to change it", 403)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(200)
 
 	e := json.NewEncoder(w)
-	err = e.Encode(&globalConfig)
+	err := e.Encode(&conf)
 	if err != nil {
 		log.Printf("Error sending config: %v", err)
 	}
@@ -48,6 +64,19 @@ func putConfig(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// A config that was fetched redacted keeps the secrets it had.
+	old, err := RetrieveConfig()
+	switch {
+	case err == nil:
+	case gomemcached.IsNotFound(err):
+		old = globalConfig
+	default:
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error reading current config: %v", err)
+		return
+	}
+	conf.Unredact(*old)
+
 	err = StoreConfig(conf)
 	if err != nil {
 		w.WriteHeader(500)
@@ -94,17 +123,9 @@ func doList(w http.ResponseWriter, req *http.Request) {
 	}
 
 	w.WriteHeader(200)
-	explen := getHash().Size() * 2
-	filepath.Walk(*root, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() && !strings.HasPrefix(info.Name(), "tmp") &&
-			len(info.Name()) == explen {
-			_, e := w.Write([]byte(info.Name() + "\n"))
-			return e
-		}
-		return nil
+	walkLocalBlobs(func(info os.FileInfo) error {
+		_, e := w.Write([]byte(info.Name() + "\n"))
+		return e
 	})
 }
 
@@ -260,6 +281,15 @@ func doListNodes(w http.ResponseWriter, req *http.Request) {
 			"bindaddr":   node.BindAddr,
 			"framesbind": node.FrameBind,
 			"version":    node.Version,
+			"scheme":     node.scheme(),
+			"zone":       node.Zone,
+			"tier":       node.tier(),
+			"draining":   node.Draining,
+			"stopping":   node.Stopping,
+			"weight":     node.placementWeight(),
+		}
+		if node.Maintenance {
+			respob[node.name]["maintenance"] = true
 		}
 		// Grandfathering these in.
 		if !node.Started.IsZero() {
@@ -387,7 +417,13 @@ func doListDocs(w http.ResponseWriter, req *http.Request,
 		depth = i
 	}
 
-	fl, err := listFiles(path, includeMeta == "true", depth)
+	opts, err := listOptionsFrom(req)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	fl, err := listFilesPage(path, includeMeta == "true", depth, opts)
 	if err != nil {
 		log.Printf("Error executing file browse view: %v", err)
 		w.WriteHeader(500)
@@ -395,7 +431,8 @@ func doListDocs(w http.ResponseWriter, req *http.Request,
 		return
 	}
 
-	if len(fl.Dirs) == 0 && len(fl.Files) == 0 {
+	// A page past the end of a directory is just empty.
+	if len(fl.Dirs) == 0 && len(fl.Files) == 0 && opts.after == nil {
 		w.WriteHeader(404)
 		return
 	}
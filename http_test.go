@@ -1,7 +1,10 @@
 package main
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestMinusPrefix(t *testing.T) {
@@ -11,3 +14,43 @@ func TestMinusPrefix(t *testing.T) {
 			minusPrefix(aPath, blobPrefix))
 	}
 }
+
+func TestIfRangeMatches(t *testing.T) {
+	mod := time.Date(2013, 5, 1, 12, 0, 0, 500, time.UTC)
+	tests := []struct {
+		ifRange string
+		exp     bool
+	}{
+		{"", true},
+		{`"abc"`, true},
+		{`"def"`, false},
+		{mod.Format(http.TimeFormat), true},
+		{mod.Add(-time.Hour).Format(http.TimeFormat), false},
+		{"garbage", false},
+	}
+
+	for _, test := range tests {
+		req := &http.Request{Header: http.Header{}}
+		if test.ifRange != "" {
+			req.Header.Set("If-Range", test.ifRange)
+		}
+		if got := ifRangeMatches(req, "abc", mod); got != test.exp {
+			t.Errorf("Expected %v for %q, got %v", test.exp, test.ifRange, got)
+		}
+	}
+}
+
+func TestDeleteRecursiveEverything(t *testing.T) {
+	for _, p := range []string{"/", "//"} {
+		req, err := http.NewRequest("DELETE", p+"?recursive=true", nil)
+		if err != nil {
+			t.Fatalf("Error making request: %v", err)
+		}
+		w := httptest.NewRecorder()
+		doDelete(w, req)
+		if w.Code != 400 {
+			t.Errorf("Expected 400 deleting everything at %q, got %v",
+				p, w.Code)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewRandomID(t *testing.T) {
+	a, err := newRandomID("rm-", 8)
+	if err != nil {
+		t.Fatalf("Error making an ID: %v", err)
+	}
+	if !strings.HasPrefix(a, "rm-") || len(a) != 3+16 {
+		t.Errorf("Expected rm- and 16 hex digits, got %q", a)
+	}
+	b, err := newRandomID("rm-", 8)
+	if err != nil {
+		t.Fatalf("Error making an ID: %v", err)
+	}
+	if a == b {
+		t.Errorf("Got %q twice", a)
+	}
+}
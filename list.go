@@ -1,14 +1,125 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type fileListing struct {
 	Files map[string]interface{} `json:"files"`
 	Dirs  map[string]interface{} `json:"dirs"`
 	Path  string                 `json:"path"`
+	// Names of the files and dirs in the requested order, when
+	// paging or sorting.
+	Order []string `json:"order,omitempty"`
+	// Pass this back to get the next page.
+	Next string `json:"continuationToken,omitempty"`
+}
+
+var errBadListToken = errors.New("invalid continuation token")
+
+// How to page through and order a listing.  The zero value lists
+// everything in name order.
+type listOptions struct {
+	// Most entries to return (0 for all of them)
+	limit int
+	// "name", "mtime" or "size"
+	sort string
+	// Where the previous page left off
+	after *listCursor
+}
+
+// The last entry of a page.
+type listCursor struct {
+	Sort  string `json:"s"`
+	Name  string `json:"n"`
+	Value int64  `json:"v,omitempty"`
+}
+
+func (c listCursor) token() string {
+	data, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	return base64.URLEncoding.EncodeToString(data)
+}
+
+func parseListToken(sort, tok string) (*listCursor, error) {
+	data, err := base64.URLEncoding.DecodeString(tok)
+	if err != nil {
+		return nil, errBadListToken
+	}
+	c := &listCursor{}
+	if json.Unmarshal(data, c) != nil || c.Sort != sort {
+		return nil, errBadListToken
+	}
+	return c, nil
+}
+
+func (o listOptions) paged() bool {
+	return o.limit > 0 || o.sort != "" || o.after != nil
+}
+
+func (o listOptions) sortName() string {
+	if o.sort == "" {
+		return "name"
+	}
+	return o.sort
+}
+
+// Read the limit, sort and continuation-token parameters.
+func listOptionsFrom(req *http.Request) (listOptions, error) {
+	opts := listOptions{sort: req.FormValue("sort")}
+	switch opts.sort {
+	case "", "name", "mtime", "size":
+	default:
+		return opts, fmt.Errorf("invalid sort: %q", opts.sort)
+	}
+	if s := req.FormValue("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return opts, fmt.Errorf("invalid limit: %q", s)
+		}
+		opts.limit = n
+	}
+	if tok := req.FormValue("continuation-token"); tok != "" {
+		var err error
+		opts.after, err = parseListToken(opts.sortName(), tok)
+		if err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+type listEntry struct {
+	name  string
+	file  bool
+	value int64
+}
+
+// Ordered by value, then name.
+type listEntries []listEntry
+
+func (l listEntries) Len() int      { return len(l) }
+func (l listEntries) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l listEntries) Less(i, j int) bool {
+	if l[i].value != l[j].value {
+		return l[i].value < l[j].value
+	}
+	return l[i].name < l[j].name
+}
+
+func (e listEntry) isAfter(c *listCursor) bool {
+	return c == nil || e.value > c.Value ||
+		(e.value == c.Value && e.name > c.Name)
 }
 
 func toStringJoin(in []interface{}, sep string) string {
@@ -22,6 +133,12 @@ func toStringJoin(in []interface{}, sep string) string {
 func listFiles(path string, includeMeta bool,
 	depth int) (fileListing, error) {
 
+	return listFilesPage(path, includeMeta, depth, listOptions{})
+}
+
+func listFilesPage(path string, includeMeta bool,
+	depth int, opts listOptions) (fileListing, error) {
+
 	emptyObject := &(json.RawMessage{'{', '}'})
 	viewRes := struct {
 		Rows []struct {
@@ -43,13 +160,29 @@ func listFiles(path string, includeMeta bool,
 	startKey := endKey[:len(endKey)-1]
 	groupLevel := len(startKey) + depth
 
+	params := map[string]interface{}{
+		"group_level": groupLevel,
+		"start_key":   startKey,
+		"end_key":     endKey,
+	}
+	// In name order the view does the paging.  Anything else has
+	// to look at the whole directory.
+	byName := opts.sortName() == "name"
+	if byName {
+		if opts.after != nil {
+			sk := append([]interface{}{}, startKey...)
+			for _, k := range strings.Split(opts.after.Name, "/") {
+				sk = append(sk, k)
+			}
+			params["start_key"] = append(sk, emptyObject)
+		}
+		if opts.limit > 0 {
+			params["limit"] = opts.limit + 1
+		}
+	}
+
 	// query the view
-	err := couchbase.ViewCustom("cbfs", "file_browse",
-		map[string]interface{}{
-			"group_level": groupLevel,
-			"start_key":   startKey,
-			"end_key":     endKey,
-		}, &viewRes)
+	err := couchbase.ViewCustom("cbfs", "file_browse", params, &viewRes)
 	if err != nil {
 		return fileListing{}, err
 	}
@@ -69,6 +202,7 @@ func listFiles(path string, includeMeta bool,
 	// divide items up into files and directories
 	files := map[string]interface{}{}
 	dirs := map[string]interface{}{}
+	entries := listEntries{}
 	for _, r := range viewRes.Rows {
 		key := shortName(toStringJoin(r.Key, "/"))
 		subkey := r.Key
@@ -76,15 +210,26 @@ func listFiles(path string, includeMeta bool,
 			subkey = r.Key[len(r.Key)-depth:]
 		}
 		name := toStringJoin(subkey, "/")
+		e := listEntry{name: name}
 		res, ok := bulkResult[key]
 		if ok == true {
 			// this means we have a file
+			e.file = true
 			if includeMeta {
 				rm := json.RawMessage(res.Body)
 				files[name] = &rm
 			} else {
 				files[name] = emptyObject
 			}
+			switch opts.sort {
+			case "size":
+				e.value = r.Value.Sum
+			case "mtime":
+				fm := struct{ Modified time.Time }{}
+				if json.Unmarshal(res.Body, &fm) == nil {
+					e.value = fm.Modified.UnixNano()
+				}
+			}
 		} else {
 			// no record in the multi-get means this is a directory
 			dirs[name] = struct {
@@ -93,7 +238,11 @@ func listFiles(path string, includeMeta bool,
 				Min   int64 `json:"smallest"`
 				Max   int64 `json:"largest"`
 			}{r.Value.Count, r.Value.Sum, r.Value.Min, r.Value.Max}
+			if opts.sort == "size" {
+				e.value = r.Value.Sum
+			}
 		}
+		entries = append(entries, e)
 	}
 
 	rv := fileListing{
@@ -102,5 +251,55 @@ func listFiles(path string, includeMeta bool,
 		Files: files,
 	}
 
+	if opts.paged() {
+		rv.Order, rv.Next = pageEntries(entries, byName, opts)
+		if len(rv.Order) < len(entries) {
+			keep := map[string]bool{}
+			for _, n := range rv.Order {
+				keep[n] = true
+			}
+			for n := range files {
+				if !keep[n] {
+					delete(files, n)
+				}
+			}
+			for n := range dirs {
+				if !keep[n] {
+					delete(dirs, n)
+				}
+			}
+		}
+	}
+
 	return rv, nil
 }
+
+// Pick the entries on the requested page, returning their names in
+// order and the token for the next page, if there is one.
+func pageEntries(entries listEntries, byName bool,
+	opts listOptions) (names []string, next string) {
+
+	if !byName {
+		sort.Sort(entries)
+		i := sort.Search(len(entries), func(i int) bool {
+			return entries[i].isAfter(opts.after)
+		})
+		entries = entries[i:]
+	}
+
+	more := opts.limit > 0 && len(entries) > opts.limit
+	if more {
+		entries = entries[:opts.limit]
+	}
+
+	names = make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.name)
+	}
+	if more {
+		last := entries[len(entries)-1]
+		next = listCursor{Sort: opts.sortName(), Name: last.name,
+			Value: last.value}.token()
+	}
+	return
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestPageEntries(t *testing.T) {
+	entries := listEntries{
+		{"d", false, 30},
+		{"a", true, 10},
+		{"c", true, 20},
+		{"b", true, 10},
+	}
+
+	tests := []struct {
+		byName bool
+		limit  int
+		after  *listCursor
+		exp    []string
+		more   bool
+	}{
+		{true, 0, nil, []string{"d", "a", "c", "b"}, false},
+		{true, 2, nil, []string{"d", "a"}, true},
+		{false, 0, nil, []string{"a", "b", "c", "d"}, false},
+		{false, 3, nil, []string{"a", "b", "c"}, true},
+		{false, 2, &listCursor{Name: "b", Value: 10}, []string{"c", "d"}, false},
+		{false, 1, &listCursor{Name: "a", Value: 10}, []string{"b"}, true},
+		{false, 0, &listCursor{Name: "d", Value: 30}, []string{}, false},
+	}
+
+	for _, test := range tests {
+		e := append(listEntries{}, entries...)
+		got, next := pageEntries(e, test.byName,
+			listOptions{limit: test.limit, sort: "size", after: test.after})
+		if !reflect.DeepEqual(got, test.exp) || (next != "") != test.more {
+			t.Errorf("Expected %v (more=%v) for %+v, got %v (next=%q)",
+				test.exp, test.more, test, got, next)
+		}
+	}
+}
+
+func TestListOptions(t *testing.T) {
+	tok := listCursor{Sort: "mtime", Name: "x/y", Value: 42}.token()
+
+	tests := []struct {
+		query string
+		exp   listOptions
+		ok    bool
+	}{
+		{"", listOptions{}, true},
+		{"limit=10", listOptions{limit: 10}, true},
+		{"sort=size", listOptions{sort: "size"}, true},
+		{"sort=mtime&continuation-token=" + tok, listOptions{sort: "mtime",
+			after: &listCursor{"mtime", "x/y", 42}}, true},
+		{"sort=size&continuation-token=" + tok, listOptions{}, false},
+		{"continuation-token=garbage!", listOptions{}, false},
+		{"limit=-1", listOptions{}, false},
+		{"sort=color", listOptions{}, false},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "/.cbfs/list/?"+test.query, nil)
+		if err != nil {
+			t.Fatalf("Error making request: %v", err)
+		}
+		got, err := listOptionsFrom(req)
+		if (err == nil) != test.ok {
+			t.Errorf("Expected ok=%v for %q, got %v", test.ok, test.query, err)
+			continue
+		}
+		if test.ok && !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("Expected %+v for %q, got %+v", test.exp, test.query, got)
+		}
+	}
+}
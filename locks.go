@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+const (
+	lockKeyPrefix = "/@lock/"
+	// Longest lock name, keeping keys under memcached's limit
+	maxLockName = 200
+
+	defaultLockTTL = time.Minute
+	maxLockTTL     = time.Hour * 24
+)
+
+var (
+	errNoSuchLock = errors.New("no such lock")
+	errLockHeld   = errors.New("lock is held by someone else")
+)
+
+// An advisory lock.  Whoever holds the token holds the lock until it
+// expires, unless they renew or release it first.
+type advisoryLock struct {
+	Type     string    `json:"type"`
+	Name     string    `json:"name"`
+	Owner    string    `json:"owner,omitempty"`
+	Token    string    `json:"token,omitempty"`
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires"`
+}
+
+// Is the lock still held at the given time?  The stored document may
+// outlive it by up to a second, since memcached expires by the second.
+func (l advisoryLock) held(now time.Time) bool {
+	return l.Expires.After(now)
+}
+
+// The lock as shown to anyone but its holder.
+func (l advisoryLock) public() advisoryLock {
+	l.Token = ""
+	return l
+}
+
+func lockExpiration(ttl time.Duration) int {
+	if ttl > time.Hour*24*30 {
+		return int(time.Now().Add(ttl).Unix())
+	}
+	// Round up so the document never goes before the lock does.
+	return int((ttl + time.Second - 1) / time.Second)
+}
+
+func lockName(s string) (string, error) {
+	s = strings.Trim(s, "/")
+	switch {
+	case s == "":
+		return "", errors.New("missing lock name")
+	case len(s) > maxLockName:
+		return "", fmt.Errorf("lock name is longer than %v bytes", maxLockName)
+	}
+	return s, nil
+}
+
+// Parse the ttl parameter of a lock request.
+func parseLockTTL(s string) (time.Duration, error) {
+	if s == "" {
+		return defaultLockTTL, nil
+	}
+	d, err := time.ParseDuration(s)
+	switch {
+	case err != nil:
+		return 0, err
+	case d < time.Second:
+		return 0, fmt.Errorf("ttl must be at least a second, not %v", d)
+	case d > maxLockTTL:
+		return 0, fmt.Errorf("ttl must be at most %v, not %v", maxLockTTL, d)
+	}
+	return d, nil
+}
+
+// Take a lock that isn't held, or is already held with token (so a
+// retried acquire succeeds).
+func acquireLock(name, owner, token string, ttl time.Duration) (advisoryLock, error) {
+	rv := advisoryLock{}
+	err := couchbase.Update(lockKeyPrefix+name, lockExpiration(ttl),
+		func(in []byte) ([]byte, error) {
+			now := time.Now().UTC()
+			existing := advisoryLock{}
+			if in != nil && json.Unmarshal(in, &existing) == nil &&
+				existing.held(now) && existing.Token != token {
+				rv = existing
+				return in, errLockHeld
+			}
+			rv = advisoryLock{
+				Type:     "lock",
+				Name:     name,
+				Owner:    owner,
+				Token:    token,
+				Acquired: now,
+				Expires:  now.Add(ttl),
+			}
+			if existing.Token == token && existing.held(now) {
+				rv.Acquired = existing.Acquired
+			}
+			return json.Marshal(&rv)
+		})
+	return rv, err
+}
+
+// Change a held lock.  f returns the new document, or nil to delete
+// it.
+func updateHeldLock(name, token string, exp int,
+	f func(advisoryLock) *advisoryLock) (advisoryLock, error) {
+
+	rv := advisoryLock{}
+	err := couchbase.Update(lockKeyPrefix+name, exp,
+		func(in []byte) ([]byte, error) {
+			rv = advisoryLock{}
+			if in == nil {
+				return nil, errNoSuchLock
+			}
+			if err := json.Unmarshal(in, &rv); err != nil {
+				return in, err
+			}
+			if !rv.held(time.Now()) {
+				return in, errNoSuchLock
+			}
+			if rv.Token != token {
+				return in, errLockHeld
+			}
+			l := f(rv)
+			if l == nil {
+				return nil, nil
+			}
+			rv = *l
+			return json.Marshal(l)
+		})
+	if gomemcached.IsNotFound(err) {
+		err = errNoSuchLock
+	}
+	return rv, err
+}
+
+func renewLock(name, token string, ttl time.Duration) (advisoryLock, error) {
+	return updateHeldLock(name, token, lockExpiration(ttl),
+		func(l advisoryLock) *advisoryLock {
+			l.Expires = time.Now().UTC().Add(ttl)
+			return &l
+		})
+}
+
+func releaseLock(name, token string) (advisoryLock, error) {
+	return updateHeldLock(name, token, 0,
+		func(advisoryLock) *advisoryLock { return nil })
+}
+
+// A 409 shows who does hold the lock.
+func sendLockError(w http.ResponseWriter, err error, l advisoryLock) {
+	switch err {
+	case errNoSuchLock:
+		http.Error(w, err.Error(), 404)
+	case errLockHeld:
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(409)
+		json.NewEncoder(w).Encode(l.public())
+	default:
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+// GET /.cbfs/locks/<name> tells who holds a lock.
+func doGetLock(w http.ResponseWriter, req *http.Request, name string) {
+	name, err := lockName(name)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	l := advisoryLock{}
+	err = couchbase.Get(lockKeyPrefix+name, &l)
+	switch {
+	case gomemcached.IsNotFound(err), err == nil && !l.held(time.Now()):
+		http.Error(w, errNoSuchLock.Error(), 404)
+	case err != nil:
+		http.Error(w, err.Error(), 500)
+	default:
+		sendJson(w, req, l.public())
+	}
+}
+
+// POST /.cbfs/locks/<name>?ttl=...&owner=... takes a lock, responding
+// with the token needed to renew or release it.  A token may be given
+// to retry an acquire.  409 means someone else has it.
+//
+// PUT /.cbfs/locks/<name>?token=...&ttl=... renews a held lock.
+func doAcquireLock(w http.ResponseWriter, req *http.Request, name string) {
+	name, err := lockName(name)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	ttl, err := parseLockTTL(req.FormValue("ttl"))
+	if err != nil {
+		http.Error(w, "Invalid ttl: "+err.Error(), 400)
+		return
+	}
+	token := req.FormValue("token")
+	if req.Method == "PUT" && token == "" {
+		http.Error(w, "missing token", 400)
+		return
+	}
+
+	var l advisoryLock
+	if req.Method == "PUT" {
+		l, err = renewLock(name, token, ttl)
+	} else {
+		if token == "" {
+			if token, err = newRandomID("", 16); err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+		}
+		l, err = acquireLock(name, req.FormValue("owner"), token, ttl)
+	}
+	if err != nil {
+		sendLockError(w, err, l)
+		return
+	}
+	sendJson(w, req, l)
+}
+
+// DELETE /.cbfs/locks/<name>?token=... releases a held lock.
+func doReleaseLock(w http.ResponseWriter, req *http.Request, name string) {
+	name, err := lockName(name)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	token := req.FormValue("token")
+	if token == "" {
+		http.Error(w, "missing token", 400)
+		return
+	}
+	if l, err := releaseLock(name, token); err != nil {
+		sendLockError(w, err, l)
+		return
+	}
+	w.WriteHeader(204)
+}
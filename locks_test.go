@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLockTTL(t *testing.T) {
+	tests := []struct {
+		in  string
+		exp time.Duration
+		ok  bool
+	}{
+		{"", defaultLockTTL, true},
+		{"30s", 30 * time.Second, true},
+		{"24h", 24 * time.Hour, true},
+		{"500ms", 0, false},
+		{"25h", 0, false},
+		{"soon", 0, false},
+	}
+
+	for _, test := range tests {
+		got, err := parseLockTTL(test.in)
+		if (err == nil) != test.ok || got != test.exp {
+			t.Errorf("Expected %v (ok=%v) for %q, got %v (%v)",
+				test.exp, test.ok, test.in, got, err)
+		}
+	}
+}
+
+func TestLockName(t *testing.T) {
+	tests := []struct {
+		in, exp string
+		ok      bool
+	}{
+		{"jobs/a", "jobs/a", true},
+		{"/jobs/a/", "jobs/a", true},
+		{"/", "", false},
+		{strings.Repeat("x", maxLockName+1), "", false},
+	}
+
+	for _, test := range tests {
+		got, err := lockName(test.in)
+		if (err == nil) != test.ok || got != test.exp {
+			t.Errorf("Expected %q (ok=%v) for %q, got %q (%v)",
+				test.exp, test.ok, test.in, got, err)
+		}
+	}
+}
+
+func TestLockExpiration(t *testing.T) {
+	tests := []struct {
+		ttl time.Duration
+		exp int
+	}{
+		{time.Second, 1},
+		{1500 * time.Millisecond, 2},
+		{time.Hour, 3600},
+	}
+
+	for _, test := range tests {
+		if got := lockExpiration(test.ttl); got != test.exp {
+			t.Errorf("Expected %v for %v, got %v", test.exp, test.ttl, got)
+		}
+	}
+}
+
+func TestLockPublic(t *testing.T) {
+	now := time.Now()
+	l := advisoryLock{Name: "a", Token: "secret", Expires: now.Add(time.Second)}
+	if p := l.public(); p.Token != "" || p.Name != "a" {
+		t.Errorf("Expected the token to be hidden, got %+v", p)
+	}
+	if l.Token != "secret" {
+		t.Errorf("Expected the lock itself to keep its token")
+	}
+	if !l.held(now) || l.held(now.Add(time.Second)) {
+		t.Errorf("Expected the lock to be held only until it expires")
+	}
+}
@@ -3,17 +3,26 @@
 package main
 
 import (
+	"io"
 	"log"
 	"log/syslog"
+	"os"
 )
 
-func initLogger(slog bool) {
+func initLogger(slog, jsonFormat bool) {
+	var out io.Writer = os.Stderr
 	if slog {
 		lw, err := syslog.New(syslog.LOG_INFO, "cbfs")
 		if err != nil {
 			log.Fatalf("Can't initialize syslog: %v", err)
 		}
-		log.SetOutput(lw)
+		out = lw
 		log.SetFlags(0)
 	}
+	if jsonFormat {
+		jsonLog = &jsonLogWriter{w: out}
+		out = jsonLog
+		log.SetFlags(0)
+	}
+	log.SetOutput(out)
 }
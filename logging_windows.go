@@ -2,9 +2,15 @@ package main
 
 import (
 	"log"
+	"os"
 )
 
-func initLogger(slog bool) {
+func initLogger(slog, jsonFormat bool) {
+	if jsonFormat {
+		jsonLog = &jsonLogWriter{w: os.Stderr}
+		log.SetOutput(jsonLog)
+		log.SetFlags(0)
+	}
 	if slog {
 		log.Printf("No syslog support on Windows, using regular logging")
 	}
@@ -12,7 +12,6 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/couchbaselabs/cbfs/config"
@@ -39,6 +38,8 @@ var viewTimeout = flag.Duration("viewTimeout", 5*time.Second,
 var internodeTimeout = flag.Duration("internodeTimeout", 5*time.Second,
 	"Internode client read timeout")
 var useSyslog = flag.Bool("syslog", false, "Log to syslog")
+var logJSON = flag.Bool("logJSON", false,
+	"Log JSON records, including one per request")
 
 var globalConfig *cbfsconfig.CBFSConfig
 
@@ -60,6 +61,7 @@ type prevMeta struct {
 	Length   int64       `json:"length"`
 	Modified time.Time   `json:"modified"`
 	Revno    int         `json:"revno"`
+	Parts    []blobPart  `json:"parts,omitempty"`
 }
 
 type fileMeta struct {
@@ -72,12 +74,18 @@ type fileMeta struct {
 	Previous []prevMeta       `json:"older"`
 	Revno    int              `json:"revno"`
 	Type     string           `json:"type"`
+	Parts    []blobPart       `json:"parts,omitempty"`
+	Expires  time.Time        `json:"expires"`
+	// Can't be overwritten or deleted before this
+	RetainUntil time.Time `json:"retainUntil"`
+	// Nodes that keep a copy of every blob, or pinAll
+	Pinned []string `json:"pinned,omitempty"`
 }
 
 func (fm fileMeta) MarshalJSON() ([]byte, error) {
 	m := map[string]interface{}{
 		"oid":      fm.OID,
-		"headers":  map[string][]string(fm.Headers),
+		"headers":  map[string][]string(storedHeaders(fm.Headers)),
 		"type":     "file",
 		"ctype":    fm.Headers.Get("Content-Type"),
 		"length":   fm.Length,
@@ -92,7 +100,26 @@ func (fm fileMeta) MarshalJSON() ([]byte, error) {
 		m["name"] = fm.Name
 	}
 	if len(fm.Previous) > 0 {
-		m["older"] = fm.Previous
+		// Records written before credentials were dropped may still
+		// have them in older revisions.
+		older := make([]prevMeta, len(fm.Previous))
+		for i, p := range fm.Previous {
+			p.Headers = storedHeaders(p.Headers)
+			older[i] = p
+		}
+		m["older"] = older
+	}
+	if len(fm.Parts) > 0 {
+		m["parts"] = fm.Parts
+	}
+	if !fm.Expires.IsZero() {
+		m["expires"] = fm.Expires
+	}
+	if !fm.RetainUntil.IsZero() {
+		m["retainUntil"] = fm.RetainUntil
+	}
+	if len(fm.Pinned) > 0 {
+		m["pinned"] = fm.Pinned
 	}
 	return json.Marshal(m)
 }
@@ -116,26 +143,8 @@ func mustEncode(i interface{}) []byte {
 }
 
 func shouldStoreMeta(header http.Header, exists bool, fm fileMeta) bool {
-	if ifmatch := header.Get("If-Match"); ifmatch != "" {
-		if !exists {
-			return false
-		}
-		if ifmatch != "*" {
-			if !strings.Contains(ifmatch, `"`+fm.OID+`"`) {
-				return false
-			}
-		}
-	}
-	if ifnonematch := header.Get("If-None-Match"); ifnonematch != "" && exists {
-		if ifnonematch == "*" {
-			return false
-		}
-		if strings.Contains(ifnonematch, `"`+fm.OID+`"`) {
-			return false
-		}
-	}
-	// TODO: If-Unmodified-Since
-	return true
+	return evalConditions(header, false, exists,
+		fileETag(fm.OID), fm.Modified) == 0
 }
 
 func storeMeta(fn string, exp int, fm fileMeta, revs int, header http.Header) error {
@@ -143,14 +152,37 @@ func storeMeta(fn string, exp int, fm fileMeta, revs int, header http.Header) er
 	if k != fn {
 		fm.Name = fn
 	}
-	return couchbase.Update(k, exp, func(in []byte) ([]byte, error) {
+	quotas, err := quotaUsagesFor(fn)
+	if err != nil {
+		return err
+	}
+	fm.RetainUntil = retainUntil(fn, fm)
+	event := ""
+	replaced := fileMeta{}
+	err = couchbase.Update(k, exp, func(in []byte) ([]byte, error) {
 		existing := fileMeta{}
 		err := json.Unmarshal(in, &existing)
+		replaced = existing
 		if !shouldStoreMeta(header, err == nil, existing) {
 			return in, errUploadPrecondition
 		}
+		grown, added := fm.Length, int64(1)
+		if err == nil {
+			if err := checkRetention(fn, existing, time.Now()); err != nil {
+				return in, err
+			}
+			grown, added = fm.Length-existing.Length, 0
+		}
+		if err := checkQuotas(quotas, grown, added); err != nil {
+			return in, err
+		}
+		event = "created"
 		if err == nil {
-			fm.Userdata = existing.Userdata
+			event = "overwritten"
+			if fm.Userdata == nil {
+				fm.Userdata = existing.Userdata
+			}
+			fm.Pinned = existing.Pinned
 			fm.Revno = existing.Revno + 1
 
 			if revs == -1 || revs > 0 {
@@ -160,6 +192,7 @@ func storeMeta(fn string, exp int, fm fileMeta, revs int, header http.Header) er
 					Length:   existing.Length,
 					Modified: existing.Modified,
 					Revno:    existing.Revno,
+					Parts:    existing.Parts,
 				}
 
 				fm.Previous = append(existing.Previous,
@@ -173,24 +206,37 @@ func storeMeta(fn string, exp int, fm fileMeta, revs int, header http.Header) er
 		}
 		return json.Marshal(fm)
 	})
+	if err == nil {
+		recordReplicaPolicy(fn, fm)
+		refreshFilePins(fm)
+		if replaced.OID != fm.OID {
+			refreshFilePins(replaced)
+		}
+		duFileChanged(fn, replaced, fm)
+		notifyObject(event, fn, fm)
+	}
+	return err
 }
 
 func main() {
 	flag.Parse()
+	loadNodeConfig()
 
 	rand.Seed(time.Now().UnixNano())
 
-	initLogger(*useSyslog)
+	initLogger(*useSyslog, *logJSON)
+	initRecentErrors()
+	initSlowLog()
 	initNodeListKeys()
 
-	http.DefaultTransport = TimeoutTransport(*internodeTimeout)
+	http.DefaultTransport = hopTransport{internodeTransport(*internodeTimeout)}
 	expvar.Publish("httpclients", httputil.InitHTTPTracker(false))
 
 	if getHash() == nil {
 		fmt.Fprintf(os.Stderr,
 			"Unsupported hash specified: %v.  Supported hashes:\n",
 			globalConfig.Hash)
-		for h := range hashBuilders {
+		for _, h := range availableHashes() {
 			fmt.Fprintf(os.Stderr, " * %v\n", h)
 		}
 		os.Exit(1)
@@ -200,6 +246,7 @@ func main() {
 	if err != nil {
 		log.Fatalf("Error initializing server ID: %v", err)
 	}
+	initTracing()
 
 	if *maxStorageString != "" {
 		ms, err := humanize.ParseBytes(*maxStorageString)
@@ -215,8 +262,10 @@ func main() {
 		log.Fatalf("Can't connect to couchbase: %v", err)
 	}
 
-	if err = os.MkdirAll(*root, 0777); err != nil {
-		log.Fatalf("Couldn't create storage dir: %v", err)
+	for _, v := range volumes() {
+		if err = os.MkdirAll(v, 0777); err != nil {
+			log.Fatalf("Couldn't create storage dir %v: %v", v, err)
+		}
 	}
 
 	err = updateConfig()
@@ -224,6 +273,8 @@ func main() {
 		log.Printf("Error updating initial config, using default: %v",
 			err)
 	}
+	initReadCache()
+	initHotCache()
 	if *verbose {
 		log.Printf("Server config:")
 		globalConfig.Dump(os.Stdout)
@@ -238,14 +289,22 @@ func main() {
 
 	go heartbeat()
 	go startTasks()
+	go scrubLoop()
+	go repairPaceLoop()
+	go duFlushLoop()
 
 	time.AfterFunc(time.Second*time.Duration(rand.Intn(30)+5), grabSomeData)
 
 	go serveFrame()
+	go serveS3()
+	go serveDAV()
+	go serveGRPC()
+
+	startWebhooks()
 
 	s := &http.Server{
 		Addr:        *bindAddr,
-		Handler:     http.HandlerFunc(httpHandler),
+		Handler:     http2Handler(instrumentHandler(httpHandler)),
 		ReadTimeout: *readTimeout,
 	}
 	log.Printf("Listening to web requests on %s as server %s",
@@ -255,5 +314,8 @@ func main() {
 	if err != nil {
 		log.Fatalf("Error listening: %v", err)
 	}
-	log.Fatal(s.Serve(l))
+	handleShutdown()
+	handleReloads()
+	go serveUntilShutdown(s, maybeTLSListener(l))
+	<-shutdownDone
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// Nonzero while this node is in maintenance.
+var localMaintenance int32
+
+func setMaintenance(to bool) {
+	v := int32(0)
+	if to {
+		v = 1
+	}
+	atomic.StoreInt32(&localMaintenance, v)
+}
+
+func inMaintenance() bool {
+	return atomic.LoadInt32(&localMaintenance) != 0
+}
+
+// Why this node won't take new blobs, or "" if it will.
+func blobRefusal() string {
+	switch {
+	case isDraining():
+		return "This node is being decommissioned"
+	case inMaintenance():
+		return "This node is in maintenance"
+	}
+	return ""
+}
+
+// Put a node into maintenance or take it out.  A node in maintenance
+// keeps what it has and serves reads, but gets no new blobs, and
+// isn't written off as dead however long it goes without a
+// heartbeat.
+func setNodeMaintenance(node string, on bool) error {
+	return updateNode(node, func(sn *StorageNode) bool {
+		if sn.Maintenance == on {
+			return false
+		}
+		sn.Maintenance = on
+		return true
+	})
+}
+
+func doMaintenance(w http.ResponseWriter, req *http.Request, node string) {
+	on := req.Method != "DELETE"
+	err := setNodeMaintenance(node, on)
+	switch {
+	case err == errNoSuchNode || gomemcached.IsNotFound(err):
+		http.Error(w, fmt.Sprintf("No such node: %q", node), 404)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if on {
+		log.Printf("Put %v into maintenance", node)
+	} else {
+		log.Printf("Took %v out of maintenance", node)
+	}
+	w.WriteHeader(204)
+}
@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestBlobRefusal(t *testing.T) {
+	defer setDraining(false)
+	defer setMaintenance(false)
+
+	if why := blobRefusal(); why != "" {
+		t.Errorf("Expected to take blobs, got %q", why)
+	}
+	setMaintenance(true)
+	if why := blobRefusal(); why != "This node is in maintenance" {
+		t.Errorf("Expected a maintenance refusal, got %q", why)
+	}
+	setDraining(true)
+	if why := blobRefusal(); why != "This node is being decommissioned" {
+		t.Errorf("Expected a decommission refusal, got %q", why)
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics in Prometheus text exposition format.
+
+var (
+	latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5,
+		1, 2.5, 5, 10, 30, 60}
+	taskBuckets = []float64{.1, 1, 5, 15, 60, 300, 900, 3600, 4 * 3600,
+		12 * 3600, 24 * 3600}
+
+	httpLatency  = newHistogramVec(latencyBuckets)
+	httpRequests = newCounterVec()
+	taskLatency  = newHistogramVec(taskBuckets)
+
+	bytesIn, bytesOut uint64
+
+	gcRemoved, gcSkipped, gcInBackup int64
+	gcRuns, filesExpired             uint64
+)
+
+type promHistogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func (h *promHistogram) observe(v float64) {
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *promHistogram) write(w io.Writer, name, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep,
+			strconv.FormatFloat(b, 'g', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %v\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+// Histograms keyed by a preformatted label set.
+type histogramVec struct {
+	mu      sync.Mutex
+	buckets []float64
+	h       map[string]*promHistogram
+}
+
+func newHistogramVec(buckets []float64) *histogramVec {
+	return &histogramVec{buckets: buckets, h: map[string]*promHistogram{}}
+}
+
+func (v *histogramVec) observe(labels string, val float64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	h, ok := v.h[labels]
+	if !ok {
+		h = &promHistogram{buckets: v.buckets,
+			counts: make([]uint64, len(v.buckets))}
+		v.h[labels] = h
+	}
+	h.observe(val)
+}
+
+func (v *histogramVec) write(w io.Writer, name string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, k := range sortedKeys(v.h) {
+		v.h[k].write(w, name, k)
+	}
+}
+
+type counterVec struct {
+	mu sync.Mutex
+	c  map[string]uint64
+}
+
+func newCounterVec() *counterVec {
+	return &counterVec{c: map[string]uint64{}}
+}
+
+func (v *counterVec) inc(labels string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.c[labels]++
+}
+
+func (v *counterVec) write(w io.Writer, name string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	keys := make([]string, 0, len(v.c))
+	for k := range v.c {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s} %d\n", name, k, v.c[k])
+	}
+}
+
+func sortedKeys(m map[string]*promHistogram) []string {
+	rv := make([]string, 0, len(m))
+	for k := range m {
+		rv = append(rv, k)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+func promHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func promValue(w io.Writer, name, typ, help string, v interface{}) {
+	promHeader(w, name, typ, help)
+	fmt.Fprintf(w, "%s %v\n", name, v)
+}
+
+// Captures the status of a response for metrics and logging.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = 200
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+// Passes files through to the connection so they can go out with
+// sendfile.
+func (s *statusRecorder) ReadFrom(r io.Reader) (int64, error) {
+	if s.status == 0 {
+		s.status = 200
+	}
+	var n int64
+	var err error
+	if rf, ok := s.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(s.ResponseWriter, r)
+	}
+	s.bytes += n
+	return n, err
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func instrumentHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		id := assignRequestID(w, req)
+		var trace *requestTrace
+		if slowLog != nil || tracing != nil {
+			if trace = startTrace(id); trace != nil {
+				defer endTrace(id)
+			}
+		}
+		endSpan := func(int) {}
+		if tracing != nil && trace != nil {
+			trace.ctx, endSpan = tracing.serverSpan(req, endpointName(req))
+			req = req.WithContext(trace.ctx)
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		h(rec, req)
+		if rec.status == 0 {
+			rec.status = 200
+		}
+		endSpan(rec.status)
+		logRequest(req, rec, id, start)
+		recordRequestTime(req, rec, id, trace, start)
+
+		method := fmt.Sprintf("method=%q", req.Method)
+		httpLatency.observe(method, time.Since(start).Seconds())
+		httpRequests.inc(fmt.Sprintf("%s,code=\"%d\"", method, rec.status))
+	}
+}
+
+func recordTaskDuration(name string, d time.Duration) {
+	taskLatency.observe(fmt.Sprintf("task=%q", name), d.Seconds())
+}
+
+func recordGCStats(removed, skipped, inBackup int) {
+	atomic.StoreInt64(&gcRemoved, int64(removed))
+	atomic.StoreInt64(&gcSkipped, int64(skipped))
+	atomic.StoreInt64(&gcInBackup, int64(inBackup))
+	atomic.AddUint64(&gcRuns, 1)
+}
+
+func localBlobCount() (int64, error) {
+	viewRes := struct {
+		Rows []struct {
+			Value float64
+		}
+	}{}
+
+	err := couchbase.ViewCustom("cbfs", "node_blobs",
+		map[string]interface{}{
+			"group_level": 1,
+			"key":         serverId,
+			"stale":       "update_after",
+		}, &viewRes)
+	if err != nil || len(viewRes.Rows) == 0 {
+		return 0, err
+	}
+	return int64(viewRes.Rows[0].Value), nil
+}
+
+func doMetrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(200)
+
+	promHeader(w, "cbfs_http_request_duration_seconds", "histogram",
+		"Time taken to serve HTTP requests by method.")
+	httpLatency.write(w, "cbfs_http_request_duration_seconds")
+	promHeader(w, "cbfs_http_requests_total", "counter",
+		"HTTP requests served by method and status.")
+	httpRequests.write(w, "cbfs_http_requests_total")
+
+	promValue(w, "cbfs_received_bytes_total", "counter",
+		"Bytes read from client and peer connections.",
+		atomic.LoadUint64(&bytesIn))
+	promValue(w, "cbfs_sent_bytes_total", "counter",
+		"Bytes written to client and peer connections.",
+		atomic.LoadUint64(&bytesOut))
+
+	if n, err := localBlobCount(); err == nil {
+		promValue(w, "cbfs_blobs", "gauge",
+			"Blobs stored on this node.", n)
+	}
+	promValue(w, "cbfs_disk_free_bytes", "gauge",
+		"Space available for new blobs.", availableSpace())
+	promValue(w, "cbfs_disk_used_bytes", "gauge",
+		"Space used by blobs on this node.", atomic.LoadInt64(&spaceUsed))
+
+	promValue(w, "cbfs_internode_queue_depth", "gauge",
+		"Replication and removal tasks waiting to run.",
+		len(internodeTaskQueue))
+	promValue(w, "cbfs_internode_queue_capacity", "gauge",
+		"Size of the internode task queue.", cap(internodeTaskQueue))
+
+	promHeader(w, "cbfs_task_duration_seconds", "histogram",
+		"Time taken by periodic tasks run on this node.")
+	taskLatency.write(w, "cbfs_task_duration_seconds")
+
+	promValue(w, "cbfs_gc_runs_total", "counter",
+		"Garbage collections run by this node.", atomic.LoadUint64(&gcRuns))
+	promValue(w, "cbfs_gc_last_removed_blobs", "gauge",
+		"Blobs scheduled for removal by the last garbage collection.",
+		atomic.LoadInt64(&gcRemoved))
+	promValue(w, "cbfs_gc_last_skipped_blobs", "gauge",
+		"Recently used blobs skipped by the last garbage collection.",
+		atomic.LoadInt64(&gcSkipped))
+	promValue(w, "cbfs_gc_last_backup_blobs", "gauge",
+		"Blobs kept by the last garbage collection for backups.",
+		atomic.LoadInt64(&gcInBackup))
+	promValue(w, "cbfs_expired_files_total", "counter",
+		"Files removed after their expiration.",
+		atomic.LoadUint64(&filesExpired))
+
+	if st, err := getBackupStatus(); err == nil && !st.LastSuccess.IsZero() {
+		promValue(w, "cbfs_backup_last_success_timestamp_seconds", "gauge",
+			"When the last scheduled backup completed.",
+			st.LastSuccess.Unix())
+	}
+
+	if rr, err := getReplicationReport(); err == nil {
+		promHeader(w, "cbfs_under_replicated_blobs", "gauge",
+			"Blobs short of their wanted copies, by how many, as of the last check.")
+		for _, b := range rr.Buckets {
+			fmt.Fprintf(w, "cbfs_under_replicated_blobs{missing=\"%d\"} %d\n",
+				b.Missing, b.Blobs)
+		}
+	}
+
+	promValue(w, "cbfs_read_repairs_total", "counter",
+		"Bad or missing local blobs found while serving and replaced.",
+		atomic.LoadUint64(&readRepairs))
+
+	promValue(w, "cbfs_scrubbed_bytes_total", "counter",
+		"Bytes of local blobs re-read to check their hashes.",
+		atomic.LoadUint64(&scrubbedBytes))
+	promValue(w, "cbfs_scrub_corrupt_total", "counter",
+		"Local blobs the scrubber found bad and quarantined.",
+		atomic.LoadUint64(&scrubCorrupt))
+
+	promValue(w, "cbfs_repair_rate_share", "gauge",
+		"Share of repairRate blob repairs may use given how busy the node is.",
+		repairPace.share())
+
+	promValue(w, "cbfs_rate_limited_total", "counter",
+		"Client requests refused for going over a rate limit.",
+		atomic.LoadUint64(&rateLimited))
+
+	if c := hotBlobCache(); c != nil {
+		st := c.stats()
+		promValue(w, "cbfs_hot_cache_bytes", "gauge",
+			"Bytes of blobs held in memory.", st.Size)
+		promValue(w, "cbfs_hot_cache_blobs", "gauge",
+			"Blobs held in memory.", st.Blobs)
+		promValue(w, "cbfs_hot_cache_hits_total", "counter",
+			"Blob reads served from memory.", st.Hits)
+		promValue(w, "cbfs_hot_cache_misses_total", "counter",
+			"Blob reads that weren't in memory.", st.Misses)
+		promValue(w, "cbfs_hot_cache_admitted_total", "counter",
+			"Blobs read into memory.", st.Admitted)
+		promValue(w, "cbfs_hot_cache_rejected_total", "counter",
+			"Blobs kept out of memory as less popular than what's there.",
+			st.Rejected)
+	}
+
+	promValue(w, "cbfs_goroutines", "gauge",
+		"Goroutines currently running.", runtime.NumGoroutine())
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHistogramVecWrite(t *testing.T) {
+	v := newHistogramVec([]float64{0.5, 1})
+	v.observe(`method="GET"`, 0.25)
+	v.observe(`method="GET"`, 0.75)
+	v.observe(`method="GET"`, 3)
+
+	b := &bytes.Buffer{}
+	v.write(b, "x")
+	exp := `x_bucket{method="GET",le="0.5"} 1
+x_bucket{method="GET",le="1"} 2
+x_bucket{method="GET",le="+Inf"} 3
+x_sum{method="GET"} 4
+x_count{method="GET"} 3
+`
+	if b.String() != exp {
+		t.Errorf("Expected:\n%v\ngot:\n%v", exp, b.String())
+	}
+}
+
+func TestStatusRecorder(t *testing.T) {
+	tests := []struct {
+		code  int
+		body  string
+		exp   int
+		bytes int64
+	}{
+		{0, "hi", 200, 2},
+		{404, "nope", 404, 4},
+		{204, "", 204, 0},
+	}
+
+	for _, test := range tests {
+		rec := &statusRecorder{ResponseWriter: httptest.NewRecorder()}
+		if test.code != 0 {
+			rec.WriteHeader(test.code)
+		}
+		rec.Write([]byte(test.body))
+		if rec.status != test.exp || rec.bytes != test.bytes {
+			t.Errorf("Expected %v/%v, got %v/%v",
+				test.exp, test.bytes, rec.status, rec.bytes)
+		}
+	}
+}
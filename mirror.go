@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+	"github.com/couchbaselabs/cbfs/config"
+)
+
+const (
+	mirrorStateKeyPrefix = "/@mirror/"
+	mirrorBatchSize      = 100
+)
+
+// No timeout: throttled copies of big files take as long as they
+// take.
+var mirrorClient = &http.Client{}
+
+var errMirrorMissing = errors.New("no such file")
+
+// How far a mirror has got.
+type mirrorState struct {
+	// Last change on the source that's been mirrored
+	Seq uint64 `json:"seq"`
+	// Latest change on the source when the mirror last ran
+	Head     uint64    `json:"head"`
+	LastRun  time.Time `json:"lastRun"`
+	CaughtUp time.Time `json:"caughtUp"`
+	Files    int64     `json:"files"`
+	Bytes    int64     `json:"bytes"`
+	LastErr  string    `json:"lastError,omitempty"`
+}
+
+type mirrorStatus struct {
+	Remote     string `json:"remote"`
+	Direction  string `json:"direction"`
+	Prefix     string `json:"prefix,omitempty"`
+	DestPrefix string `json:"destPrefix,omitempty"`
+	mirrorState
+	// Changes not yet mirrored, and how long it's been since there
+	// weren't any
+	Behind     uint64  `json:"behind"`
+	LagSeconds float64 `json:"lagSeconds"`
+}
+
+func newMirrorStatus(m cbfsconfig.Mirror, st mirrorState,
+	now time.Time) mirrorStatus {
+
+	rv := mirrorStatus{
+		Remote:      m.Remote,
+		Direction:   m.Direction,
+		Prefix:      m.Prefix,
+		DestPrefix:  m.DestPrefix,
+		mirrorState: st,
+	}
+	if st.Head > st.Seq {
+		rv.Behind = st.Head - st.Seq
+		if !st.CaughtUp.IsZero() {
+			rv.LagSeconds = now.Sub(st.CaughtUp).Seconds()
+		}
+	}
+	return rv
+}
+
+func getMirrorState(name string) (mirrorState, error) {
+	st := mirrorState{}
+	err := couchbase.Get(mirrorStateKeyPrefix+name, &st)
+	if gomemcached.IsNotFound(err) {
+		err = nil
+	}
+	return st, err
+}
+
+func setMirrorState(name string, st mirrorState) error {
+	return couchbase.Set(mirrorStateKeyPrefix+name, 0, st)
+}
+
+// A file being copied from one end of a mirror to the other.
+type mirrorFile struct {
+	header http.Header
+	length int64
+	body   io.ReadCloser
+}
+
+// One end of a mirror.
+type mirrorEnd interface {
+	// The latest change here
+	head() (uint64, error)
+	// Changes after since, and the sequence number to resume from
+	changes(since uint64, limit int) ([]objectEvent, uint64, error)
+	// The etag of the file at path, or "" if there isn't one
+	etag(path string) (string, error)
+	// Open the file at path, with a nil body if its etag is etag.
+	// Returns errMirrorMissing if there's no such file.
+	open(path, etag string) (mirrorFile, error)
+	store(path string, f mirrorFile) error
+	remove(path string) error
+	String() string
+}
+
+// The headers that go along with a file's content.
+func mirrorHeaders(h http.Header) http.Header {
+	rv := http.Header{}
+	for k, v := range h {
+		if isResponseHeader(k) {
+			rv[k] = v
+		}
+	}
+	return rv
+}
+
+// This cluster.
+type localMirrorEnd struct{}
+
+func (localMirrorEnd) head() (uint64, error) {
+	return lastChangeSeq()
+}
+
+func (localMirrorEnd) changes(since uint64,
+	limit int) ([]objectEvent, uint64, error) {
+
+	return readChanges(since, limit)
+}
+
+func (localMirrorEnd) meta(path string) (fileMeta, error) {
+	fm := fileMeta{}
+	err := couchbase.Get(shortName(path), &fm)
+	if gomemcached.IsNotFound(err) ||
+		(err == nil && (fm.Type != "file" || fm.expired(time.Now()))) {
+		err = errMirrorMissing
+	}
+	return fm, err
+}
+
+func (l localMirrorEnd) etag(path string) (string, error) {
+	fm, err := l.meta(path)
+	if err == errMirrorMissing {
+		return "", nil
+	}
+	return fileETag(fm.OID), err
+}
+
+func (l localMirrorEnd) open(path, etag string) (mirrorFile, error) {
+	fm, err := l.meta(path)
+	if err != nil {
+		return mirrorFile{}, err
+	}
+	rv := mirrorFile{header: mirrorHeaders(fm.Headers), length: fm.Length}
+	if fileETag(fm.OID) != etag {
+		rv.body, err = openFileContent(fm.OID, fm.Parts, false)
+	}
+	return rv, err
+}
+
+// A request for the user file at path.
+func localMirrorRequest(method, path string,
+	body io.Reader) (*http.Request, error) {
+
+	req, err := http.NewRequest(method, "/", body)
+	if err == nil {
+		req.URL.Path = "/" + path
+	}
+	return req, err
+}
+
+// Run a handler on req, returning an error for anything but the given
+// status codes.
+func serveLocalMirror(h func(http.ResponseWriter, *http.Request),
+	req *http.Request, ok ...int) error {
+
+	out := &bytes.Buffer{}
+	w := &captureResponseWriter{w: out, hdr: http.Header{}}
+	h(w, req)
+	for _, code := range ok {
+		if w.statusCode == code {
+			return nil
+		}
+	}
+	return fmt.Errorf("HTTP error %v: %s", w.statusCode,
+		bytes.TrimSpace(out.Bytes()))
+}
+
+func (localMirrorEnd) store(path string, f mirrorFile) error {
+	req, err := localMirrorRequest("PUT", path, f.body)
+	if err != nil {
+		return err
+	}
+	req.Header = f.header
+	req.ContentLength = f.length
+	return serveLocalMirror(putUserFile, req, 201)
+}
+
+func (localMirrorEnd) remove(path string) error {
+	req, err := localMirrorRequest("DELETE", path, nil)
+	if err != nil {
+		return err
+	}
+	return serveLocalMirror(doDeleteUserDoc, req, 204, 404)
+}
+
+func (localMirrorEnd) String() string {
+	return "local"
+}
+
+// Another cluster.
+type remoteMirrorEnd struct {
+	base  string
+	token string
+}
+
+func (r remoteMirrorEnd) urlFor(path string) string {
+	u, err := url.Parse(r.base)
+	if err != nil {
+		return r.base
+	}
+	u.Path = strings.TrimRight(u.Path, "/") + "/" + path
+	return u.String()
+}
+
+func (r remoteMirrorEnd) do(method, u string, body io.Reader,
+	hdr http.Header) (*http.Response, error) {
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	return mirrorClient.Do(req)
+}
+
+func (r remoteMirrorEnd) changesSince(since string,
+	limit int) ([]objectEvent, uint64, error) {
+
+	v := url.Values{"since": {since}, "limit": {strconv.Itoa(limit)}}
+	res, err := r.do("GET", r.urlFor(".cbfs/changes/")+"?"+v.Encode(),
+		nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, 0, fmt.Errorf("HTTP error getting changes: %v",
+			res.Status)
+	}
+	rv := struct {
+		Results []objectEvent `json:"results"`
+		LastSeq uint64        `json:"last_seq"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&rv)
+	return rv.Results, rv.LastSeq, err
+}
+
+func (r remoteMirrorEnd) head() (uint64, error) {
+	_, last, err := r.changesSince("now", 1)
+	return last, err
+}
+
+func (r remoteMirrorEnd) changes(since uint64,
+	limit int) ([]objectEvent, uint64, error) {
+
+	return r.changesSince(strconv.FormatUint(since, 10), limit)
+}
+
+func (r remoteMirrorEnd) etag(path string) (string, error) {
+	res, err := r.do("HEAD", r.urlFor(path), nil, nil)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case 200:
+		return res.Header.Get("Etag"), nil
+	case 404:
+		return "", nil
+	}
+	return "", fmt.Errorf("HTTP error checking %v: %v", path, res.Status)
+}
+
+func (r remoteMirrorEnd) open(path, etag string) (mirrorFile, error) {
+	hdr := http.Header{}
+	if etag != "" {
+		hdr.Set("If-None-Match", etag)
+	}
+	res, err := r.do("GET", r.urlFor(path), nil, hdr)
+	if err != nil {
+		return mirrorFile{}, err
+	}
+	rv := mirrorFile{header: mirrorHeaders(res.Header),
+		length: res.ContentLength}
+	switch res.StatusCode {
+	case 200:
+		rv.body = res.Body
+		return rv, nil
+	case 304:
+		err = nil
+	case 404:
+		err = errMirrorMissing
+	default:
+		err = fmt.Errorf("HTTP error getting %v: %v", path, res.Status)
+	}
+	res.Body.Close()
+	return rv, err
+}
+
+func (r remoteMirrorEnd) store(path string, f mirrorFile) error {
+	req, err := http.NewRequest("PUT", r.urlFor(path), f.body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = f.length
+	for k, v := range f.header {
+		req.Header[k] = v
+	}
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	res, err := mirrorClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 201 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("HTTP error storing %v: %v %s", path, res.Status,
+			bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func (r remoteMirrorEnd) remove(path string) error {
+	res, err := r.do("DELETE", r.urlFor(path), nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case 200, 204, 404:
+		return nil
+	}
+	return fmt.Errorf("HTTP error removing %v: %v", path, res.Status)
+}
+
+func (r remoteMirrorEnd) String() string {
+	return r.base
+}
+
+// Where a mirror copies from and to.
+func mirrorEnds(m cbfsconfig.Mirror) (src, dst mirrorEnd) {
+	remote := remoteMirrorEnd{m.Remote, m.Token}
+	if m.Direction == "pull" {
+		return remote, localMirrorEnd{}
+	}
+	return localMirrorEnd{}, remote
+}
+
+// The mirrored paths touched by a batch of changes, each once, in the
+// order they were last changed.
+func mirrorPaths(m cbfsconfig.Mirror, changes []objectEvent) []string {
+	last := map[string]int{}
+	for i, c := range changes {
+		if _, ok := m.DestPath(c.Path); ok {
+			last[c.Path] = i
+		}
+	}
+	rv := []string{}
+	for i, c := range changes {
+		if j, ok := last[c.Path]; ok && j == i {
+			rv = append(rv, c.Path)
+		}
+	}
+	return rv
+}
+
+// Make the file at dpath on dst whatever's at path on src, returning
+// the number of bytes copied.  The source wins: whatever it has
+// replaces what's at the destination, and if it has nothing the
+// destination's copy is removed.
+func mirrorOne(m cbfsconfig.Mirror, src, dst mirrorEnd,
+	path, dpath string) (int64, error) {
+
+	etag, err := dst.etag(dpath)
+	if err != nil {
+		return 0, err
+	}
+	f, err := src.open(path, etag)
+	switch {
+	case err == errMirrorMissing:
+		if etag == "" {
+			return 0, nil
+		}
+		return 0, dst.remove(dpath)
+	case err != nil:
+		return 0, err
+	case f.body == nil:
+		return 0, nil
+	}
+	defer f.body.Close()
+
+	cr := &countingReader{r: throttledReader{f.body, m.BytesPerSec}}
+	f.body = ioutil.NopCloser(cr)
+	err = dst.store(dpath, f)
+	return cr.n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Mirror the changes on the source up to where it was when we
+// started.  The state's sequence number only moves past a batch once
+// everything in it has been copied, so a failure means the batch is
+// tried again next time.
+func catchUpMirror(name string, m cbfsconfig.Mirror, st *mirrorState) error {
+	src, dst := mirrorEnds(m)
+	head, err := src.head()
+	if err != nil {
+		return err
+	}
+	st.Head = head
+
+	for st.Seq < st.Head {
+		changes, last, err := src.changes(st.Seq, mirrorBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, p := range mirrorPaths(m, changes) {
+			dp, _ := m.DestPath(p)
+			setTaskDetail("mirror", name+": "+p)
+			n, err := mirrorOne(m, src, dst, p, dp)
+			if err != nil {
+				return fmt.Errorf("error mirroring %v from %v to %v: %v",
+					p, src, dst, err)
+			}
+			st.Files++
+			st.Bytes += n
+		}
+		if last == st.Seq {
+			// Waiting on a change that's still being written.
+			break
+		}
+		st.Seq = last
+		if err := setMirrorState(name, *st); err != nil {
+			log.Printf("Error recording state of mirror %v: %v", name, err)
+		}
+	}
+	if st.Seq >= st.Head {
+		st.CaughtUp = time.Now().UTC()
+	}
+	return nil
+}
+
+func runMirror(name string, m cbfsconfig.Mirror) error {
+	st, err := getMirrorState(name)
+	if err != nil {
+		return err
+	}
+	err = m.Validate()
+	if err == nil {
+		err = catchUpMirror(name, m, &st)
+	}
+	st.LastRun = time.Now().UTC()
+	st.LastErr = ""
+	if err != nil {
+		st.LastErr = err.Error()
+	}
+	if e := setMirrorState(name, st); e != nil {
+		log.Printf("Error recording state of mirror %v: %v", name, e)
+	}
+	return err
+}
+
+// Catch up all the configured mirrors.
+func runMirrors() error {
+	names := []string{}
+	for name := range globalConfig.Mirrors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var rv error
+	for _, name := range names {
+		if err := runMirror(name, globalConfig.Mirrors[name]); err != nil {
+			log.Printf("Error running mirror %v: %v", name, err)
+			if rv == nil {
+				rv = err
+			}
+		}
+	}
+	return rv
+}
+
+func doListMirrors(w http.ResponseWriter, req *http.Request) {
+	now := time.Now()
+	rv := map[string]mirrorStatus{}
+	for name, m := range globalConfig.Mirrors {
+		st, err := getMirrorState(name)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		rv[name] = newMirrorStatus(m, st, now)
+	}
+	sendJson(w, req, rv)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/config"
+)
+
+func TestMirrorPaths(t *testing.T) {
+	ev := func(path string) objectEvent {
+		return objectEvent{Path: path}
+	}
+	changes := []objectEvent{ev("a/x"), ev("b/y"), ev("a/z"), ev("a/x"),
+		ev("ab/w")}
+
+	tests := []struct {
+		prefix string
+		exp    []string
+	}{
+		{"", []string{"b/y", "a/z", "a/x", "ab/w"}},
+		{"a", []string{"a/z", "a/x"}},
+		{"c", []string{}},
+	}
+
+	for _, test := range tests {
+		got := mirrorPaths(cbfsconfig.Mirror{Prefix: test.prefix}, changes)
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("Expected %v for prefix %q, got %v",
+				test.exp, test.prefix, got)
+		}
+	}
+}
+
+func TestMirrorStatusLag(t *testing.T) {
+	now := time.Now()
+	m := cbfsconfig.Mirror{Remote: "http://dr/", Direction: "push"}
+
+	st := newMirrorStatus(m, mirrorState{Seq: 10, Head: 10,
+		CaughtUp: now.Add(-time.Hour)}, now)
+	if st.Behind != 0 || st.LagSeconds != 0 {
+		t.Errorf("Expected no lag when caught up, got %v, %v",
+			st.Behind, st.LagSeconds)
+	}
+
+	st = newMirrorStatus(m, mirrorState{Seq: 7, Head: 10,
+		CaughtUp: now.Add(-time.Minute)}, now)
+	if st.Behind != 3 || st.LagSeconds != 60 {
+		t.Errorf("Expected 3 changes and 60s behind, got %v, %v",
+			st.Behind, st.LagSeconds)
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+const multipartKeyPrefix = "/@multipart/"
+
+// Names a stored blob to use as a part instead of a request body.
+const blobRefHeader = "X-CBFS-Blob"
+
+var errNoSuchUpload = errors.New("no such upload")
+
+// State of an upload in progress.  Parts are referenced from here
+// (via the file_blobs view) so they survive GC until completion.
+type multipartUpload struct {
+	ID      string           `json:"id"`
+	Type    string           `json:"type"`
+	Path    string           `json:"path"`
+	Headers http.Header      `json:"headers"`
+	Created time.Time        `json:"created"`
+	Parts   map[int]blobPart `json:"parts"`
+	// Conditions given when the upload began, checked again when
+	// it's completed
+	Conditions http.Header `json:"conditions,omitempty"`
+}
+
+func multipartExpiration() int {
+	d := globalConfig.MultipartExpiration
+	if d > time.Hour*24*30 {
+		return int(time.Now().Add(d).Unix())
+	}
+	return int(d.Seconds())
+}
+
+func getMultipartUpload(id string) (multipartUpload, error) {
+	mu := multipartUpload{}
+	err := couchbase.Get(multipartKeyPrefix+id, &mu)
+	if gomemcached.IsNotFound(err) {
+		err = errNoSuchUpload
+	}
+	return mu, err
+}
+
+func sendMultipartError(w http.ResponseWriter, err error) {
+	if err == errNoSuchUpload {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	http.Error(w, err.Error(), 500)
+}
+
+// POST /.cbfs/multipart/ with a path (and optionally type) form
+// value starts a new upload.
+func doInitMultipart(w http.ResponseWriter, req *http.Request) {
+	fn := req.FormValue("path")
+	for len(fn) > 0 && fn[0] == '/' {
+		fn = fn[1:]
+	}
+	switch {
+	case fn == "":
+		http.Error(w, "Missing path parameter", 400)
+		return
+	case strings.Contains(fn, "//"):
+		http.Error(w,
+			fmt.Sprintf("Too many slashes in the path name: %v", fn), 400)
+		return
+	}
+
+	if code := precheckWrite(shortName(fn), req.Header); code != 0 {
+		sendConditionFailure(w, code, "")
+		return
+	}
+
+	id, err := newRandomID("", 16)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	mu := multipartUpload{
+		ID:         id,
+		Type:       "multipart",
+		Path:       fn,
+		Headers:    http.Header{},
+		Created:    time.Now().UTC(),
+		Parts:      map[int]blobPart{},
+		Conditions: writeConditionsFrom(req.Header),
+	}
+	if t := req.FormValue("type"); t != "" {
+		mu.Headers.Set("Content-Type", t)
+	}
+	for _, h := range []string{"X-CBFS-Expiration", "X-CBFS-KeepRevs"} {
+		if v := req.Header.Get(h); v != "" {
+			mu.Headers.Set(h, v)
+		}
+	}
+	for k, v := range req.Header {
+		if isUserMetaHeader(k) {
+			mu.Headers[k] = v
+		}
+	}
+	if err := checkUserMeta(mu.Headers); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	// Relative expirations count from completion, so keep it as given.
+	if v := requestedExpires(req); v != "" {
+		if _, err := parseExpires(v, time.Now()); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		mu.Headers.Set("X-CBFS-Expires", v)
+	}
+	if v := req.Header.Get(retainUntilHeader); v != "" {
+		if _, err := parseExpires(v, time.Now()); err != nil {
+			http.Error(w, "invalid retention: "+err.Error(), 400)
+			return
+		}
+		mu.Headers.Set(retainUntilHeader, v)
+	}
+
+	err = couchbase.Set(multipartKeyPrefix+id, multipartExpiration(), &mu)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	log.Printf("Started multipart upload %v of %v", id, fn)
+	sendJson(w, req, &mu)
+}
+
+func doGetMultipart(w http.ResponseWriter, req *http.Request, id string) {
+	mu, err := getMultipartUpload(id)
+	if err != nil {
+		sendMultipartError(w, err)
+		return
+	}
+	sendJson(w, req, &mu)
+}
+
+// PUT /.cbfs/multipart/{id}/{partnum} stores one part, either the
+// request body or the blob named by the X-CBFS-Blob header.
+func putMultipartPart(w http.ResponseWriter, req *http.Request, rest string) {
+	parts := strings.Split(rest, "/")
+	if len(parts) != 2 {
+		http.Error(w, "Expected upload id and part number", 400)
+		return
+	}
+	id := parts[0]
+	partnum, err := strconv.Atoi(parts[1])
+	if err != nil || partnum < 1 {
+		http.Error(w, "Invalid part number: "+parts[1], 400)
+		return
+	}
+
+	mu, err := getMultipartUpload(id)
+	if err != nil {
+		sendMultipartError(w, err)
+		return
+	}
+
+	if oid := req.Header.Get(blobRefHeader); oid != "" {
+		refMultipartPart(w, id, partnum, oid)
+		return
+	}
+
+	f, err := NewUploadRecord(pickVolume(), req.Header.Get("X-CBFS-Hash"))
+	if err != nil {
+		log.Printf("Error writing tmp file: %v", err)
+		http.Error(w, "Error writing tmp file", 500)
+		return
+	}
+	defer f.Close()
+
+	h, length, err := f.Process(req.Body)
+	if err != nil {
+		log.Printf("Error completing part %v of %v: %v", partnum, id, err)
+		http.Error(w, fmt.Sprintf("Error completing blob write: %v", err), 500)
+		return
+	}
+
+	err = recordBlobOwnership(h, length, true)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error recording blob ownership: %v", err),
+			500)
+		return
+	}
+
+	if err := addMultipartPart(id, partnum, blobPart{h, length}); err != nil {
+		sendMultipartError(w, err)
+		return
+	}
+
+	if want := replicaTarget(mu.Path); want > 1 {
+		go increaseReplicaCount(h, length, want-1)
+	}
+
+	w.Header().Set("X-CBFS-Hash", h)
+	w.Header().Set("Etag", fileETag(h))
+	w.WriteHeader(201)
+}
+
+func addMultipartPart(id string, partnum int, part blobPart) error {
+	return couchbase.Update(multipartKeyPrefix+id, multipartExpiration(),
+		func(in []byte) ([]byte, error) {
+			mu := multipartUpload{}
+			if err := json.Unmarshal(in, &mu); err != nil {
+				return nil, errNoSuchUpload
+			}
+			mu.Parts[partnum] = part
+			return json.Marshal(&mu)
+		})
+}
+
+// Use a blob that's already stored as a part rather than sending it
+// again.
+func refMultipartPart(w http.ResponseWriter, id string, partnum int,
+	oid string) {
+
+	if !validHash(oid) {
+		http.Error(w, "Error invalid hash: "+oid, 400)
+		return
+	}
+	ownership, err := getBlobOwnership(oid)
+	switch {
+	case err == nil && !ownership.Garbage && len(ownership.Nodes) > 0:
+	case err == nil || gomemcached.IsNotFound(err):
+		http.Error(w, "no such blob: "+oid, 404)
+		return
+	default:
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	if err := addMultipartPart(id, partnum,
+		blobPart{oid, ownership.Length}); err != nil {
+		sendMultipartError(w, err)
+		return
+	}
+
+	w.Header().Set("X-CBFS-Hash", oid)
+	w.Header().Set("Etag", fileETag(oid))
+	w.WriteHeader(201)
+}
+
+// Order the parts to assemble.  If the client listed the parts it
+// expects (as [{"part": n, "oid": "..."}]), they must all be present
+// with matching hashes; otherwise every uploaded part is used.
+func selectMultipartParts(mu multipartUpload,
+	want []struct {
+		Part int    `json:"part"`
+		OID  string `json:"oid"`
+	}) ([]blobPart, error) {
+
+	rv := []blobPart{}
+	if len(want) == 0 {
+		nums := []int{}
+		for n := range mu.Parts {
+			nums = append(nums, n)
+		}
+		sort.Ints(nums)
+		for _, n := range nums {
+			rv = append(rv, mu.Parts[n])
+		}
+	}
+	for _, w := range want {
+		p, ok := mu.Parts[w.Part]
+		if !ok {
+			return nil, fmt.Errorf("part %v was not uploaded", w.Part)
+		}
+		if w.OID != "" && w.OID != p.OID {
+			return nil, fmt.Errorf("part %v is %v, not %v", w.Part, p.OID, w.OID)
+		}
+		rv = append(rv, p)
+	}
+	if len(rv) == 0 {
+		return nil, errors.New("no parts uploaded")
+	}
+	return rv, nil
+}
+
+// Store the list of parts of the file at path as a blob of its own.
+// This serves as the file's OID so the file has an identity (and
+// ETag) derived from its content.
+func storePartsManifest(path string, parts []blobPart) (string, error) {
+	b, err := json.Marshal(map[string]interface{}{"parts": parts})
+	if err != nil {
+		return "", err
+	}
+
+	f, err := NewHashRecord(pickVolume(), "")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h, length, err := f.Process(bytes.NewReader(b))
+	if err != nil {
+		return "", err
+	}
+
+	err = recordBlobOwnership(h, length, true)
+	if want := replicaTarget(path); err == nil && want > 1 {
+		go increaseReplicaCount(h, length, want-1)
+	}
+	return h, err
+}
+
+// POST /.cbfs/multipart/{id} assembles the uploaded parts into the
+// final file.  No part data is copied.
+func doCompleteMultipart(w http.ResponseWriter, req *http.Request, id string) {
+	mu, err := getMultipartUpload(id)
+	if err != nil {
+		sendMultipartError(w, err)
+		return
+	}
+
+	want := []struct {
+		Part int    `json:"part"`
+		OID  string `json:"oid"`
+	}{}
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&want); err != nil {
+			http.Error(w, "Error parsing part list: "+err.Error(), 400)
+			return
+		}
+	}
+
+	parts, err := selectMultipartParts(mu, want)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	h, err := storePartsManifest(mu.Path, parts)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error storing parts manifest: %v", err), 500)
+		return
+	}
+
+	now := time.Now().UTC()
+	expires, _ := parseExpires(mu.Headers.Get("X-CBFS-Expires"), now)
+	fm := fileMeta{
+		Headers:  mu.Headers,
+		OID:      h,
+		Length:   partsLength(parts),
+		Modified: now,
+		Parts:    parts,
+		Expires:  expires,
+	}
+
+	revs := globalConfig.DefaultVersionCount
+	if i, err := strconv.Atoi(mu.Headers.Get("X-CBFS-KeepRevs")); err == nil {
+		revs = i
+	}
+
+	// Conditions on completion replace those the upload began with.
+	cond := req.Header
+	if writeConditionsFrom(cond) == nil {
+		cond = mu.Conditions
+	}
+	err = storeMeta(mu.Path, getExpiration(mu.Headers), fm, revs, cond)
+	if httpQuotaError(w, mu.Path, err) || httpRetentionError(w, mu.Path, err) {
+		return
+	}
+	switch err {
+	case nil:
+	case errUploadPrecondition:
+		http.Error(w, "precondition failed", 412)
+		return
+	default:
+		log.Printf("Error storing file meta of %v -> %v: %v",
+			mu.Path, h, err)
+		http.Error(w, fmt.Sprintf("Error recording file meta: %v", err), 500)
+		return
+	}
+
+	if err := couchbase.Delete(multipartKeyPrefix + id); err != nil {
+		log.Printf("Error removing completed upload %v: %v", id, err)
+	}
+
+	log.Printf("Completed multipart upload %v: %v -> %v (%v parts)",
+		id, mu.Path, h, len(parts))
+
+	w.Header().Set("Etag", fileETag(h))
+	w.WriteHeader(201)
+}
+
+// DELETE /.cbfs/multipart/{id} abandons an upload.  Its parts are
+// left for garbage collection.
+func doAbortMultipart(w http.ResponseWriter, req *http.Request, id string) {
+	err := couchbase.Delete(multipartKeyPrefix + id)
+	switch {
+	case err == nil:
+		w.WriteHeader(204)
+	case gomemcached.IsNotFound(err):
+		http.Error(w, errNoSuchUpload.Error(), 404)
+	default:
+		http.Error(w, err.Error(), 500)
+	}
+}
@@ -33,6 +33,17 @@ type StorageNode struct {
 	Used      int64     `json:"used"`
 	Free      int64     `json:"free"`
 	Version   string    `json:"version"`
+	Scheme    string    `json:"scheme,omitempty"`
+	Zone      string    `json:"zone,omitempty"`
+	Draining  bool      `json:"draining,omitempty"`
+	Stopping  bool      `json:"stopping,omitempty"`
+	Tier      string    `json:"tier,omitempty"`
+	// This node's storage locations, when it has more than one
+	Volumes []volumeInfo `json:"volumes,omitempty"`
+	// Kept out of placement, but not aged out, while being worked on
+	Maintenance bool `json:"maintenance,omitempty"`
+	// Share of new blobs relative to other nodes, if set with -weight
+	Weight float64 `json:"weight,omitempty"`
 
 	name        string
 	storageSize int64
@@ -59,33 +70,44 @@ func (a StorageNode) FrameAddress() string {
 func (a StorageNode) Client() *http.Client {
 	addr := a.FrameAddress()
 	if addr == "" {
-		return http.DefaultClient
+		return nodeHTTPClient
 	}
 	return getFrameClient(addr)
 }
 
 func (a StorageNode) ClientForTransfer(l int64) *http.Client {
 	if l > largishObject {
-		return http.DefaultClient
+		return nodeHTTPClient
 	}
 	return a.Client()
 }
 
+// Nodes from before TLS support don't advertise a scheme.
+func (a StorageNode) scheme() string {
+	if a.Scheme == "" {
+		return "http"
+	}
+	return a.Scheme
+}
+
+func (a StorageNode) URLFor(path string) string {
+	return a.scheme() + "://" + a.Address() + path
+}
+
 func (a StorageNode) BlobURL(h string) string {
-	return fmt.Sprintf("http://%s/.cbfs/blob/%s",
-		a.Address(), h)
+	return a.URLFor(blobPrefix + h)
 }
 
 func (a StorageNode) fetchURL(h string) string {
-	return fmt.Sprintf("http://%s/.cbfs/fetch/%s",
-		a.Address(), h)
+	return a.URLFor(fetchPrefix + h)
 }
 
 func (n StorageNode) IsDead() bool {
 	// Get the freshest data.
 	nn, err := findNode(n.name)
 	if err == nil {
-		return time.Now().Sub(nn.Time) > globalConfig.StaleNodeLimit
+		return !nn.Maintenance &&
+			time.Now().Sub(nn.Time) > globalConfig.StaleNodeLimit
 	}
 	return false
 }
@@ -382,8 +404,9 @@ func (nl NodeList) candidatesFor(oid string, exclude NodeList) NodeList {
 
 	owners := ownership.ResolveNodes()
 
-	// Find a good destination candidate.
-	return nl.minus(owners).withAtLeast(ownership.Length)
+	// Find a good destination candidate, preferring other zones.
+	return nl.minus(owners).accepting().withAtLeast(ownership.Length).
+		byWeight().spreadAcrossZones(owners.zones())
 }
 
 func (nl NodeList) BlobURLs(h string) []string {
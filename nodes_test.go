@@ -25,3 +25,21 @@ func TestNodeSorting(t *testing.T) {
 		t.Fatalf("Error:  wrong order:  %v", nl)
 	}
 }
+
+func TestNodeURLs(t *testing.T) {
+	tests := []struct {
+		n   StorageNode
+		exp string
+	}{
+		{StorageNode{Addr: "10.0.0.1", BindAddr: ":8484"},
+			"http://10.0.0.1:8484/.cbfs/blob/abc"},
+		{StorageNode{Addr: "10.0.0.1", BindAddr: ":8484", Scheme: "https"},
+			"https://10.0.0.1:8484/.cbfs/blob/abc"},
+	}
+
+	for _, test := range tests {
+		if got := test.n.BlobURL("abc"); got != test.exp {
+			t.Errorf("Expected %v for %v, got %v", test.exp, test.n, got)
+		}
+	}
+}
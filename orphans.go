@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	cb "github.com/couchbaselabs/go-couchbase"
+)
+
+// Orphans younger than this aren't removed by default, since an
+// upload may not have stored its file yet.
+const orphanMinAge = 24 * time.Hour
+
+// A blob on this node's disks that no file refers to.
+type orphanBlob struct {
+	OID      string    `json:"oid"`
+	Node     string    `json:"node"`
+	Length   int64     `json:"length"`
+	Modified time.Time `json:"modified"`
+	InBackup bool      `json:"inBackup,omitempty"`
+	Removed  bool      `json:"removed,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Find which of the given blobs anything refers to, by walking every
+// reference in the file_blobs view.
+func markReferencedBlobs(blobs map[string]bool) error {
+	viewRes := struct {
+		Rows []struct {
+			Id  string
+			Key []string
+		}
+		Errors []cb.ViewError
+	}{}
+
+	limit := 1000
+	params := map[string]interface{}{
+		"stale": false,
+		"limit": limit,
+	}
+	done := false
+	for !done {
+		err := couchbase.ViewCustom("cbfs", "file_blobs", params, &viewRes)
+		if err != nil {
+			return err
+		}
+		if len(viewRes.Errors) > 0 {
+			return fmt.Errorf("View errors: %v", viewRes.Errors)
+		}
+		done = len(viewRes.Rows) < limit
+
+		for _, r := range viewRes.Rows {
+			if len(r.Key) < 2 {
+				continue
+			}
+			if _, ok := blobs[r.Key[0]]; ok && r.Key[1] == "file" {
+				blobs[r.Key[0]] = true
+			}
+		}
+		if len(viewRes.Rows) > 0 {
+			last := viewRes.Rows[len(viewRes.Rows)-1]
+			params["startkey"] = last.Key
+			params["startkey_docid"] = cb.DocID(last.Id)
+			params["skip"] = 1
+		}
+	}
+	return nil
+}
+
+// Does any file refer to a blob right now?
+func blobReferenced(oid string) (bool, error) {
+	viewRes := struct {
+		Rows   []struct{}
+		Errors []cb.ViewError
+	}{}
+	err := couchbase.ViewCustom("cbfs", "file_blobs",
+		map[string]interface{}{
+			"stale":    false,
+			"limit":    1,
+			"startkey": []interface{}{oid, "file"},
+			"endkey":   []interface{}{oid, "file", map[string]interface{}{}},
+		}, &viewRes)
+	if err == nil && len(viewRes.Errors) > 0 {
+		err = fmt.Errorf("View errors: %v", viewRes.Errors)
+	}
+	return len(viewRes.Rows) > 0, err
+}
+
+// Find the blobs on this node's disks nothing refers to.
+func findOrphans() ([]orphanBlob, error) {
+	infos := map[string]os.FileInfo{}
+	err := walkLocalBlobs(func(info os.FileInfo) error {
+		infos[info.Name()] = info
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := map[string]bool{}
+	for oid := range infos {
+		referenced[oid] = false
+	}
+	if err := markReferencedBlobs(referenced); err != nil {
+		return nil, err
+	}
+
+	backedup, err := loadExistingHashes()
+	if err != nil {
+		return nil, err
+	}
+
+	rv := []orphanBlob{}
+	for oid, info := range infos {
+		if referenced[oid] {
+			continue
+		}
+		o := orphanBlob{
+			OID:      oid,
+			Node:     serverId,
+			Length:   info.Size(),
+			Modified: info.ModTime().UTC(),
+		}
+		if b, err := hex.DecodeString(oid); err == nil && backedup.Contains(b) {
+			o.InBackup = true
+		}
+		rv = append(rv, o)
+	}
+	return rv, nil
+}
+
+// Remove an orphan unless something has come to refer to it since it
+// was found.
+func removeOrphan(o *orphanBlob) {
+	ref, err := blobReferenced(o.OID)
+	switch {
+	case err != nil:
+		o.Error = err.Error()
+	case ref:
+		o.Error = "referenced since it was found"
+	default:
+		if err := forceRemoveObject(o.OID); err != nil {
+			o.Error = err.Error()
+			return
+		}
+		log.Printf("Removed orphaned blob %v (%v bytes)", o.OID, o.Length)
+		o.Removed = true
+	}
+}
+
+// GET /.cbfs/orphans/ reports the blobs on this node nothing refers
+// to.  POST also removes those older than minage (default 24h) that
+// aren't needed for a backup.
+func doOrphans(w http.ResponseWriter, req *http.Request) {
+	minAge := orphanMinAge
+	if s := req.FormValue("minage"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			http.Error(w, "Invalid minage: "+err.Error(), 400)
+			return
+		}
+		minAge = d
+	}
+	remove := req.Method == "POST"
+
+	orphans, err := findOrphans()
+	if err != nil {
+		http.Error(w, "Error finding orphans: "+err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(200)
+
+	e := json.NewEncoder(w)
+	for i := range orphans {
+		o := &orphans[i]
+		if remove && !o.InBackup && time.Since(o.Modified) >= minAge {
+			removeOrphan(o)
+		}
+		if err := e.Encode(o); err != nil {
+			log.Printf("Error encoding: %v", err)
+			return
+		}
+	}
+}
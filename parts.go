@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// One blob making up part of a file stored in several pieces.
+type blobPart struct {
+	OID    string `json:"oid"`
+	Length int64  `json:"length"`
+}
+
+func partsLength(parts []blobPart) int64 {
+	rv := int64(0)
+	for _, p := range parts {
+		rv += p.Length
+	}
+	return rv
+}
+
+// Seekable reader over the concatenation of several blobs.  Blobs
+// are opened lazily as the read position reaches them.
+type partsReader struct {
+	parts []blobPart
+	total int64
+	off   int64
+	cur   io.ReadCloser
+	end   int64 // offset at which cur is exhausted
+}
+
+func newPartsReader(parts []blobPart) *partsReader {
+	return &partsReader{parts: parts, total: partsLength(parts)}
+}
+
+func (p *partsReader) open() error {
+	start := int64(0)
+	for _, part := range p.parts {
+		if p.off < start+part.Length {
+			r, err := openBlob(part.OID, false)
+			if err != nil {
+				return err
+			}
+			skip := p.off - start
+			if s, ok := r.(io.Seeker); ok {
+				_, err = s.Seek(skip, os.SEEK_SET)
+			} else {
+				_, err = io.CopyN(ioutil.Discard, r, skip)
+			}
+			if err != nil {
+				r.Close()
+				return err
+			}
+			p.cur = r
+			p.end = start + part.Length
+			return nil
+		}
+		start += part.Length
+	}
+	return io.EOF
+}
+
+func (p *partsReader) Read(b []byte) (int, error) {
+	for {
+		if p.off >= p.total {
+			return 0, io.EOF
+		}
+		if p.cur == nil {
+			if err := p.open(); err != nil {
+				return 0, err
+			}
+		}
+		if max := p.end - p.off; int64(len(b)) > max {
+			b = b[:max]
+		}
+		n, err := p.cur.Read(b)
+		p.off += int64(n)
+		if p.off == p.end {
+			p.cur.Close()
+			p.cur = nil
+			err = nil
+		}
+		switch {
+		case err == io.EOF:
+			return n, io.ErrUnexpectedEOF
+		case n == 0 && err == nil:
+			continue
+		}
+		return n, err
+	}
+}
+
+var errNegativeSeek = errors.New("negative seek")
+
+func (p *partsReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case os.SEEK_CUR:
+		offset += p.off
+	case os.SEEK_END:
+		offset += p.total
+	}
+	if offset < 0 {
+		return p.off, errNegativeSeek
+	}
+	if offset != p.off && p.cur != nil {
+		p.cur.Close()
+		p.cur = nil
+	}
+	p.off = offset
+	return offset, nil
+}
+
+func (p *partsReader) Close() error {
+	if p.cur != nil {
+		return p.cur.Close()
+	}
+	return nil
+}
+
+// Open the content of a file which may be a single blob or made up
+// of parts.
+func openFileContent(oid string, parts []blobPart,
+	localOnly bool) (io.ReadCloser, error) {
+
+	if len(parts) == 0 {
+		return openBlob(oid, localOnly)
+	}
+	return newPartsReader(parts), nil
+}
+
+func copyFileContent(w io.Writer, fm fileMeta) error {
+	if len(fm.Parts) == 0 {
+		return copyBlob(w, fm.OID)
+	}
+	r := newPartsReader(fm.Parts)
+	defer r.Close()
+	_, err := io.Copy(w, r)
+	return err
+}
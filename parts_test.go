@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPartsReader(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "partstest")
+	if err != nil {
+		t.Fatalf("Error making tmp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer func(r string) { *root = r }(*root)
+	*root = tmpdir
+
+	// Local blobs are checked against their names, so they need
+	// real ones.
+	parts := []blobPart{}
+	for _, c := range []string{"hello ", "", "parted ", "world"} {
+		h := getHash()
+		h.Write([]byte(c))
+		oid := hex.EncodeToString(h.Sum(nil))
+		fn := hashFilename(tmpdir, oid)
+		os.MkdirAll(filepath.Dir(fn), 0777)
+		if err := ioutil.WriteFile(fn, []byte(c), 0666); err != nil {
+			t.Fatalf("Error writing blob: %v", err)
+		}
+		parts = append(parts, blobPart{oid, int64(len(c))})
+	}
+	r := newPartsReader(parts)
+	defer r.Close()
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil || string(b) != "hello parted world" {
+		t.Fatalf("Expected full content, got %q (%v)", b, err)
+	}
+
+	tests := []struct {
+		off    int64
+		whence int
+		n      int
+		exp    string
+	}{
+		{4, os.SEEK_SET, 6, "o part"},
+		{-5, os.SEEK_END, 5, "world"},
+		{6, os.SEEK_SET, 7, "parted "},
+		{-3, os.SEEK_CUR, 5, "ed wo"},
+	}
+	for _, test := range tests {
+		if _, err := r.Seek(test.off, test.whence); err != nil {
+			t.Fatalf("Error seeking to %v/%v: %v", test.off, test.whence, err)
+		}
+		buf := make([]byte, test.n)
+		if _, err := io.ReadFull(r, buf); err != nil || string(buf) != test.exp {
+			t.Errorf("Expected %q after seek %v/%v, got %q (%v)",
+				test.exp, test.off, test.whence, buf, err)
+		}
+	}
+}
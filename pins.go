@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+	cb "github.com/couchbaselabs/go-couchbase"
+)
+
+// Pins a file to every node rather than a list of them.
+const pinAll = "*"
+
+// Lists the nodes a file is pinned to on GET and HEAD.
+const pinnedHeader = "X-CBFS-Pinned"
+
+var errNoPinFile = errors.New("no such file")
+
+// Whether pins keep a copy on a node.
+func pinnedTo(pins []string, node string) bool {
+	for _, p := range pins {
+		if p == pinAll || p == node {
+			return true
+		}
+	}
+	return false
+}
+
+// Tidy a list of pins: sorted, without repeats, and just pinAll if
+// that's among them.
+func normalizePins(pins []string) []string {
+	seen := map[string]bool{}
+	rv := []string{}
+	for _, p := range pins {
+		p = strings.TrimSpace(p)
+		if p == pinAll {
+			return []string{pinAll}
+		}
+		if p != "" && !seen[p] {
+			seen[p] = true
+			rv = append(rv, p)
+		}
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// Pin a file to the given nodes, or unpin it with none.
+func setFilePins(path string, pins []string) (fileMeta, error) {
+	fm := fileMeta{}
+	err := couchbase.Update(shortName(path), 0, func(in []byte) ([]byte, error) {
+		fm = fileMeta{}
+		if in == nil {
+			return nil, errNoPinFile
+		}
+		if err := json.Unmarshal(in, &fm); err != nil {
+			return in, err
+		}
+		if fm.Type != "file" {
+			return in, errNoPinFile
+		}
+		fm.Pinned = pins
+		return json.Marshal(fm)
+	})
+	if gomemcached.IsNotFound(err) {
+		err = errNoPinFile
+	}
+	return fm, err
+}
+
+// Bring the pins on a blob in line with those on the files made of
+// it.
+func refreshBlobPins(oid string) error {
+	ids, err := filesReferencing(oid)
+	if err != nil {
+		return err
+	}
+	pins := []string{}
+	for _, id := range ids {
+		fm := fileMeta{}
+		if err := couchbase.Get(id, &fm); err != nil || fm.Type != "file" {
+			continue
+		}
+		for _, b := range fileBlobs(fm) {
+			if b == oid {
+				pins = append(pins, fm.Pinned...)
+				break
+			}
+		}
+	}
+	pins = normalizePins(pins)
+
+	err = couchbase.Update("/"+oid, 0, func(in []byte) ([]byte, error) {
+		ownership := BlobOwnership{}
+		if err := json.Unmarshal(in, &ownership); err != nil {
+			return nil, err
+		}
+		if strings.Join(ownership.Pinned, ",") == strings.Join(pins, ",") {
+			return nil, cb.UpdateCancel
+		}
+		ownership.Pinned = pins
+		if len(pins) == 0 {
+			ownership.Pinned = nil
+		}
+		return json.Marshal(ownership)
+	})
+	if err == cb.UpdateCancel {
+		err = nil
+	}
+	return err
+}
+
+// Bring the pins on a pinned file's blobs up to date, after it's
+// stored, replaced or deleted.
+func refreshFilePins(fm fileMeta) {
+	if len(fm.Pinned) == 0 {
+		return
+	}
+	for _, oid := range fileBlobs(fm) {
+		if err := refreshBlobPins(oid); err != nil {
+			log.Printf("Error pinning %v: %v", oid, err)
+		}
+	}
+}
+
+// The nodes a pinned blob should be on but isn't.
+func missingPins(pins []string, holders map[string]string, nl NodeList) NodeList {
+	rv := NodeList{}
+	for _, n := range nl.accepting() {
+		_, has := holders[n.name]
+		fresh := time.Since(n.Time) < globalConfig.StaleNodeLimit
+		if !has && fresh && pinnedTo(pins, n.name) {
+			rv = append(rv, n)
+		}
+	}
+	return rv
+}
+
+// Get copies of pinned blobs onto the nodes they're pinned to, the
+// blobs with the fewest copies first.
+func ensurePinnedReplicas() error {
+	nl, err := findAllNodes()
+	if err != nil {
+		return err
+	}
+	params := map[string]interface{}{
+		"include_docs": true,
+		"limit":        globalConfig.ReplicationCheckLimit,
+		"stale":        false,
+	}
+
+	did := 0
+	defer func() {
+		if did > 0 {
+			log.Printf("Requested %v pinned copies", did)
+		}
+	}()
+	for {
+		viewRes := struct {
+			Rows []struct {
+				Id  string
+				Key int
+				Doc struct {
+					Json struct {
+						Nodes  map[string]string
+						Pinned []string
+					}
+				}
+			}
+			Errors []cb.ViewError
+		}{}
+
+		err := couchbase.ViewCustom("cbfs", "pinned_blobs", params, &viewRes)
+		if err != nil {
+			return err
+		}
+		if len(viewRes.Errors) > 0 {
+			return fmt.Errorf("View errors: %v", viewRes.Errors)
+		}
+
+		for _, r := range viewRes.Rows {
+			oid := r.Id[1:]
+			b := r.Doc.Json
+			for _, n := range missingPins(b.Pinned, b.Nodes, nl) {
+				if !maybeQueueBlobAcquire(n, oid, "") {
+					log.Printf("Queue is full ensuring pinned copies")
+					return nil
+				}
+				did++
+			}
+		}
+
+		if len(viewRes.Rows) < globalConfig.ReplicationCheckLimit {
+			return nil
+		}
+		if !relockTask("ensureMinReplCount") {
+			return errors.New("Lost lock")
+		}
+		last := viewRes.Rows[len(viewRes.Rows)-1]
+		params["startkey"] = last.Key
+		params["startkey_docid"] = last.Id
+		params["skip"] = 1
+	}
+}
+
+func sendPins(w http.ResponseWriter, req *http.Request, path string,
+	fm fileMeta) {
+
+	pins := fm.Pinned
+	if pins == nil {
+		pins = []string{}
+	}
+	sendJson(w, req, map[string]interface{}{
+		"path":   path,
+		"pinned": pins,
+	})
+}
+
+// GET /.cbfs/pin/<path> tells which nodes a file is pinned to.
+func doGetPins(w http.ResponseWriter, req *http.Request, path string) {
+	path = strings.TrimLeft(path, "/")
+	fm := fileMeta{}
+	err := couchbase.Get(shortName(path), &fm)
+	if err == nil && fm.Type != "file" {
+		err = errNoPinFile
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	sendPins(w, req, path, fm)
+}
+
+// POST /.cbfs/pin/<path>?nodes=a,b keeps copies of a file on those
+// nodes, or with nodes=* on every node.  DELETE unpins it.
+func doSetPins(w http.ResponseWriter, req *http.Request, path string) {
+	path = strings.TrimLeft(path, "/")
+	var pins []string
+	if req.Method != "DELETE" {
+		pins = normalizePins(strings.Split(req.FormValue("nodes"), ","))
+		if len(pins) == 0 {
+			http.Error(w, "missing nodes", 400)
+			return
+		}
+		nodes, err := findNodeMap()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		for _, p := range pins {
+			if _, ok := nodes[p]; !ok && p != pinAll {
+				http.Error(w, fmt.Sprintf("No such node: %q", p), 400)
+				return
+			}
+		}
+	}
+
+	fm, err := setFilePins(path, pins)
+	switch err {
+	case nil:
+	case errNoPinFile:
+		http.Error(w, err.Error(), 404)
+		return
+	default:
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	for _, oid := range fileBlobs(fm) {
+		if err := refreshBlobPins(oid); err != nil {
+			log.Printf("Error updating pins of %v: %v", oid, err)
+		}
+	}
+	if len(pins) > 0 {
+		log.Printf("Pinned %v to %v", path, pins)
+		err := induceTask("ensureMinReplCount")
+		if err != nil && err != taskAlreadyQueued {
+			log.Printf("Error starting replication of %v: %v", path, err)
+		}
+	} else {
+		log.Printf("Unpinned %v", path)
+	}
+	sendPins(w, req, path, fm)
+}
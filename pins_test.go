@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPinnedTo(t *testing.T) {
+	tests := []struct {
+		pins []string
+		node string
+		exp  bool
+	}{
+		{nil, "a", false},
+		{[]string{"a", "b"}, "b", true},
+		{[]string{"a", "b"}, "c", false},
+		{[]string{pinAll}, "c", true},
+	}
+	for _, test := range tests {
+		if got := pinnedTo(test.pins, test.node); got != test.exp {
+			t.Errorf("Expected pinnedTo(%v, %v) = %v, got %v",
+				test.pins, test.node, test.exp, got)
+		}
+	}
+}
+
+func TestNormalizePins(t *testing.T) {
+	tests := []struct {
+		in, exp []string
+	}{
+		{[]string{""}, []string{}},
+		{[]string{"b", " a", "b"}, []string{"a", "b"}},
+		{[]string{"a", "*", "b"}, []string{pinAll}},
+	}
+	for _, test := range tests {
+		if got := normalizePins(test.in); !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("Expected %q for %q, got %q", test.exp, test.in, got)
+		}
+	}
+}
+
+func TestMissingPins(t *testing.T) {
+	now := time.Now()
+	nl := NodeList{
+		{name: "has", Time: now},
+		{name: "lacks", Time: now},
+		{name: "stale", Time: now.Add(-time.Hour * 24)},
+		{name: "draining", Time: now, Draining: true},
+	}
+	holders := map[string]string{"has": "has"}
+
+	got := nodeNames(missingPins([]string{pinAll}, holders, nl))
+	if !reflect.DeepEqual(got, []string{"lacks"}) {
+		t.Errorf("Expected only lacks to need a copy, got %v", got)
+	}
+	got = nodeNames(missingPins([]string{"has"}, holders, nl))
+	if len(got) != 0 {
+		t.Errorf("Expected no missing copies, got %v", got)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+var nodeWeight = flag.Float64("weight", 0,
+	"Relative share of new blobs for this node (0: its storage in GiB)")
+
+// How much new data a node should take relative to the others.
+// Nodes that don't say are weighed by their storage size in GiB,
+// and nodes that can't say any of it count as 1.
+func (n StorageNode) placementWeight() float64 {
+	if n.Weight > 0 {
+		return n.Weight
+	}
+	if gib := float64(n.Used+n.Free) / (1 << 30); gib > 1 {
+		return gib
+	}
+	return 1
+}
+
+type weightedNodes struct {
+	nl   NodeList
+	keys []float64
+}
+
+func (w weightedNodes) Len() int           { return len(w.nl) }
+func (w weightedNodes) Less(i, j int) bool { return w.keys[i] < w.keys[j] }
+func (w weightedNodes) Swap(i, j int) {
+	w.nl[i], w.nl[j] = w.nl[j], w.nl[i]
+	w.keys[i], w.keys[j] = w.keys[j], w.keys[i]
+}
+
+// Shuffle nodes so each is first with a chance in proportion to its
+// weight.  Nodes that have missed a heartbeat go last, as they were.
+func (nl NodeList) byWeight() NodeList {
+	w := weightedNodes{append(NodeList{}, nl...), make([]float64, len(nl))}
+	for i, n := range w.nl {
+		if time.Since(n.Time) > 2*globalConfig.HeartbeatFreq {
+			w.keys[i] = math.Inf(1)
+		} else {
+			w.keys[i] = rand.ExpFloat64() / n.placementWeight()
+		}
+	}
+	sort.Stable(w)
+	return w.nl
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPlacementWeight(t *testing.T) {
+	tests := []struct {
+		n   StorageNode
+		exp float64
+	}{
+		{StorageNode{Weight: 3, Used: 1 << 40}, 3},
+		{StorageNode{Used: 1 << 30, Free: 3 << 30}, 4},
+		{StorageNode{Free: 1 << 20}, 1},
+	}
+	for _, test := range tests {
+		if got := test.n.placementWeight(); got != test.exp {
+			t.Errorf("Expected weight %v for %+v, got %v",
+				test.exp, test.n, got)
+		}
+	}
+}
+
+func TestByWeight(t *testing.T) {
+	now := time.Now()
+	nl := NodeList{
+		{name: "gone", Time: now.Add(-time.Hour), Weight: 100},
+		{name: "small", Time: now, Weight: 1},
+		{name: "big", Time: now, Weight: 4},
+	}
+
+	first := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		ordered := nl.byWeight()
+		if len(ordered) != 3 || ordered[2].name != "gone" {
+			t.Fatalf("Expected the stale node last, got %v",
+				nodeNames(ordered))
+		}
+		first[ordered[0].name]++
+	}
+	if first["big"] < 700 || first["small"] < 100 {
+		t.Errorf("Expected big first about 800 times, got %v", first)
+	}
+	if nl[0].name != "gone" {
+		t.Errorf("Expected the list to be left as it was, got %v",
+			nodeNames(nl))
+	}
+}
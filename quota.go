@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/couchbaselabs/cbfs/config"
+)
+
+// A configured quota along with what's currently stored under it.
+type quotaUsage struct {
+	Prefix string `json:"prefix"`
+	cbfsconfig.Quota
+	UsedBytes   int64 `json:"usedBytes"`
+	UsedObjects int64 `json:"usedObjects"`
+}
+
+// Storing a file would go over a quota.
+type quotaError struct {
+	prefix string
+	what   string
+	// The file alone is larger than the quota, so it can never
+	// be stored there.
+	tooBig bool
+}
+
+func (q quotaError) Error() string {
+	if q.tooBig {
+		return fmt.Sprintf("file is larger than the quota on %q", q.prefix)
+	}
+	return fmt.Sprintf("%s quota exceeded on %q", q.what, q.prefix)
+}
+
+func (q quotaError) status() int {
+	if q.tooBig {
+		return 413
+	}
+	return 507
+}
+
+func httpQuotaError(w http.ResponseWriter, fn string, err error) bool {
+	qe, ok := err.(quotaError)
+	if ok {
+		log.Printf("Refusing to store %v: %v", fn, qe)
+		http.Error(w, qe.Error(), qe.status())
+	}
+	return ok
+}
+
+// Check a file of the given size against the quotas covering it
+// without regard to what's already stored.
+func checkQuotaSize(fn string, length int64) error {
+	for _, prefix := range globalConfig.QuotasFor(fn) {
+		q := globalConfig.Quotas[prefix]
+		if q.Bytes > 0 && length > q.Bytes {
+			return quotaError{prefix: prefix, what: "byte", tooBig: true}
+		}
+	}
+	return nil
+}
+
+// Check growing the usage of the given quotas by some bytes and
+// files.  Shrinking is always allowed, even when over quota.
+func checkQuotas(quotas []quotaUsage, bytes, objects int64) error {
+	for _, q := range quotas {
+		switch {
+		case bytes > 0 && q.Bytes > 0 && bytes > q.Bytes:
+			return quotaError{prefix: q.Prefix, what: "byte", tooBig: true}
+		case bytes > 0 && q.Bytes > 0 && q.UsedBytes+bytes > q.Bytes:
+			return quotaError{prefix: q.Prefix, what: "byte"}
+		case objects > 0 && q.Objects > 0 &&
+			q.UsedObjects+objects > q.Objects:
+			return quotaError{prefix: q.Prefix, what: "object"}
+		}
+	}
+	return nil
+}
+
+// Get the total size and number of files under a quota prefix.
+// This comes from a view, so it can lag recent writes a bit.
+func prefixUsage(prefix string) (bytes, objects int64, err error) {
+	viewRes := struct {
+		Rows []struct {
+			Value struct {
+				Count, Sum int64
+			}
+		}
+	}{}
+
+	startKey := []interface{}{}
+	if p := cbfsconfig.QuotaPrefix(prefix); p != "" {
+		for _, k := range strings.Split(p, "/") {
+			startKey = append(startKey, k)
+		}
+	}
+	endKey := append(append([]interface{}{}, startKey...),
+		&(json.RawMessage{'{', '}'}))
+
+	err = couchbase.ViewCustom("cbfs", "file_browse",
+		map[string]interface{}{
+			"group_level": len(startKey),
+			"start_key":   startKey,
+			"end_key":     endKey,
+		}, &viewRes)
+	for _, r := range viewRes.Rows {
+		bytes += r.Value.Sum
+		objects += r.Value.Count
+	}
+	return
+}
+
+func quotaUsageOf(prefix string) (quotaUsage, error) {
+	q := quotaUsage{Prefix: prefix, Quota: globalConfig.Quotas[prefix]}
+	var err error
+	q.UsedBytes, q.UsedObjects, err = prefixUsage(prefix)
+	return q, err
+}
+
+// Find the quotas covering a path along with their usage.
+func quotaUsagesFor(fn string) ([]quotaUsage, error) {
+	rv := []quotaUsage{}
+	for _, prefix := range globalConfig.QuotasFor(fn) {
+		q, err := quotaUsageOf(prefix)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, q)
+	}
+	return rv, nil
+}
+
+type quotaUsages []quotaUsage
+
+func (q quotaUsages) Len() int           { return len(q) }
+func (q quotaUsages) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q quotaUsages) Less(i, j int) bool { return q[i].Prefix < q[j].Prefix }
+
+func doListQuotas(w http.ResponseWriter, req *http.Request) {
+	rv := quotaUsages{}
+	for prefix := range globalConfig.Quotas {
+		u, err := quotaUsageOf(prefix)
+		if err != nil {
+			log.Printf("Error finding usage of %v: %v", prefix, err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		rv = append(rv, u)
+	}
+	sort.Sort(rv)
+
+	sendJson(w, req, rv)
+}
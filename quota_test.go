@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/couchbaselabs/cbfs/config"
+)
+
+func TestCheckQuotas(t *testing.T) {
+	quotas := []quotaUsage{
+		{"a", cbfsconfig.Quota{Bytes: 100}, 60, 3},
+		{"a/b", cbfsconfig.Quota{Objects: 5}, 10, 4},
+	}
+
+	tests := []struct {
+		bytes, objects int64
+		exp            error
+	}{
+		{0, 0, nil},
+		{40, 1, nil},
+		{41, 0, quotaError{"a", "byte", false}},
+		{101, 0, quotaError{"a", "byte", true}},
+		{10, 2, quotaError{"a/b", "object", false}},
+		{-50, 2, quotaError{"a/b", "object", false}},
+		{-50, -1, nil},
+	}
+
+	for _, test := range tests {
+		err := checkQuotas(quotas, test.bytes, test.objects)
+		if err != test.exp {
+			t.Errorf("Expected %v for %v bytes and %v objects, got %v",
+				test.exp, test.bytes, test.objects, err)
+		}
+	}
+}
+
+func TestQuotaErrorStatus(t *testing.T) {
+	if s := (quotaError{tooBig: true}).status(); s != 413 {
+		t.Errorf("Expected 413 for a file too big to fit, got %v", s)
+	}
+	if s := (quotaError{}).status(); s != 507 {
+		t.Errorf("Expected 507 for a full prefix, got %v", s)
+	}
+}
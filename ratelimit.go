@@ -0,0 +1,164 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/config"
+)
+
+// Forget about clients that haven't made a request in this long.
+const rateIdleTime = time.Minute
+
+var rateLimited uint64
+
+// A token bucket holding up to burst requests, refilled at rate per
+// second.
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Take a request from the bucket if there's one, or say how long
+// until there will be.
+func (b *rateBucket) take(now time.Time, rate, burst float64) (bool, time.Duration) {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := (1 - b.tokens) / rate * float64(time.Second)
+	return false, time.Duration(math.Ceil(wait))
+}
+
+type rateLimiter struct {
+	mu      sync.Mutex
+	global  rateBucket
+	clients map[string]*rateBucket
+	swept   time.Time
+}
+
+var requestLimiter = &rateLimiter{clients: map[string]*rateBucket{}}
+
+func rateBurst(rate int, burst time.Duration) float64 {
+	return math.Max(1, float64(rate)*burst.Seconds())
+}
+
+// May client make a request now under conf's limits?  If not, how
+// long should it wait?
+func (l *rateLimiter) allow(conf *cbfsconfig.CBFSConfig, client string,
+	now time.Time) (bool, time.Duration) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.swept) > rateIdleTime {
+		for k, b := range l.clients {
+			if now.Sub(b.last) > rateIdleTime {
+				delete(l.clients, k)
+			}
+		}
+		l.swept = now
+	}
+
+	// A client over its own limit shouldn't use up everyone's.
+	if r := conf.ClientRateLimit; r > 0 {
+		b := l.clients[client]
+		if b == nil {
+			b = &rateBucket{}
+			l.clients[client] = b
+		}
+		if ok, wait := b.take(now, float64(r), rateBurst(r, conf.RateBurst)); !ok {
+			return false, wait
+		}
+	}
+	if r := conf.RateLimit; r > 0 {
+		return l.global.take(now, float64(r), rateBurst(r, conf.RateBurst))
+	}
+	return true, 0
+}
+
+func remoteHost(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return host
+}
+
+// Who a request counts against: the user its credentials
+// authenticate as, or else the address it came from.  Credentials
+// that don't authenticate count for nothing, so making them up can't
+// get a client a fresh allowance.
+func rateClient(conf *cbfsconfig.CBFSConfig, req *http.Request) string {
+	if name, token := requestCredentials(req); token != "" {
+		if n, _, ok := conf.Authenticate(name, token); ok {
+			return "user:" + n
+		}
+	}
+	return "addr:" + remoteHost(req)
+}
+
+// How often to refresh the addresses of the nodes in the cluster.
+const nodeAddrsAge = time.Minute
+
+var nodeAddrs = struct {
+	sync.Mutex
+	hosts   map[string]bool
+	fetched time.Time
+}{}
+
+// Is the request from one of the cluster's nodes?  Without a
+// NodeSecret, that's all there is to go on to keep replication and
+// other node traffic from being limited.
+func fromNodeAddr(req *http.Request) bool {
+	nodeAddrs.Lock()
+	defer nodeAddrs.Unlock()
+	if time.Since(nodeAddrs.fetched) > nodeAddrsAge {
+		nl, err := findAllNodes()
+		if err != nil {
+			log.Printf("Error finding nodes to exempt from rate limits: %v",
+				err)
+		} else {
+			nodeAddrs.hosts = map[string]bool{}
+			for _, n := range nl {
+				nodeAddrs.hosts[n.Addr] = true
+			}
+		}
+		nodeAddrs.fetched = time.Now()
+	}
+	return nodeAddrs.hosts[remoteHost(req)]
+}
+
+// Respond with 429 and return false if the request is over a rate
+// limit.  Requests from other nodes are never limited: those with the
+// NodeSecret, or any from a node's address when there isn't one.
+func checkRateLimit(w http.ResponseWriter, req *http.Request) bool {
+	conf := globalConfig
+	if (conf.RateLimit <= 0 && conf.ClientRateLimit <= 0) || fromOtherNode(req) {
+		return true
+	}
+	if conf.NodeSecret == "" && fromNodeAddr(req) {
+		return true
+	}
+	ok, wait := requestLimiter.allow(conf, rateClient(conf, req), time.Now())
+	if ok {
+		return true
+	}
+	atomic.AddUint64(&rateLimited, 1)
+	w.Header().Set("Retry-After",
+		strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too many requests", 429)
+	return false
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/config"
+)
+
+func TestRateLimiter(t *testing.T) {
+	conf := cbfsconfig.DefaultConfig()
+	conf.RateLimit = 3
+	conf.ClientRateLimit = 2
+
+	l := &rateLimiter{clients: map[string]*rateBucket{}}
+	start := time.Now()
+
+	tests := []struct {
+		client string
+		after  time.Duration
+		exp    bool
+		wait   time.Duration
+	}{
+		// Each client gets its burst of two.
+		{"a", 0, true, 0},
+		{"a", 0, true, 0},
+		{"a", 0, false, 500 * time.Millisecond},
+		// b is fine on its own, but the node's three are used.
+		{"b", 0, true, 0},
+		{"b", 0, false, 333333334},
+		{"a", 400 * time.Millisecond, false, 100 * time.Millisecond},
+		// Half a second later a has one again, and the node one
+		// and a half.
+		{"a", 500 * time.Millisecond, true, 0},
+		{"b", 500 * time.Millisecond, false, 166666667},
+	}
+
+	for i, test := range tests {
+		ok, wait := l.allow(&conf, test.client, start.Add(test.after))
+		if ok != test.exp || (test.wait > 0 && wait != test.wait) {
+			t.Errorf("%v: Expected %v (wait %v) for %v at %v, got %v (wait %v)",
+				i, test.exp, test.wait, test.client, test.after, ok, wait)
+		}
+	}
+
+	// Idle clients are forgotten.
+	l.allow(&conf, "c", start.Add(2*rateIdleTime))
+	if len(l.clients) != 1 {
+		t.Errorf("Expected only c to be remembered, got %v", l.clients)
+	}
+}
+
+func TestRateClient(t *testing.T) {
+	conf := cbfsconfig.DefaultConfig()
+	conf.Users = map[string]cbfsconfig.AuthUser{
+		"u": {TokenHash: cbfsconfig.HashToken("tok")},
+	}
+
+	tests := []struct {
+		header string
+		remote string
+		exp    string
+	}{
+		{"", "10.0.0.1:1234", "addr:10.0.0.1"},
+		{"Bearer tok", "10.0.0.1:1234", "user:u"},
+		// u:tok
+		{"Basic dTp0b2s=", "10.0.0.1:1234", "user:u"},
+		// Made up tokens count against the address.
+		{"Bearer bogus", "10.0.0.1:1234", "addr:10.0.0.1"},
+		{"Bearer bogus2", "10.0.0.1:1234", "addr:10.0.0.1"},
+	}
+
+	for _, test := range tests {
+		req := &http.Request{RemoteAddr: test.remote, Header: http.Header{}}
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+		if got := rateClient(&conf, req); got != test.exp {
+			t.Errorf("Expected %v for %q, got %v", test.exp, test.header, got)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"container/list"
+	"expvar"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dustin/go-humanize"
+)
+
+var readCacheDir = flag.String("readCache", "",
+	"Directory on a fast device to cache blobs read from other nodes in")
+var readCacheSize = flag.String("readCacheSize", "10GB",
+	"Most space -readCache may use")
+
+// Blobs read from other nodes without becoming a registered local
+// copy.  They're kept as this node's own blobs are (encrypted if
+// that's on), but nothing else knows about them, and the least
+// recently read are removed to make room.
+type readCache struct {
+	dir string
+
+	mu      sync.Mutex
+	max     int64
+	size    int64
+	lru     *list.List // of *readCacheEntry, most recent first
+	entries map[string]*list.Element
+	hits    int64
+	misses  int64
+}
+
+type readCacheEntry struct {
+	oid  string
+	size int64
+}
+
+// nil unless -readCache is given.
+var blobReadCache *readCache
+
+func initReadCache() {
+	if *readCacheDir == "" {
+		return
+	}
+	max, err := humanize.ParseBytes(*readCacheSize)
+	if err != nil {
+		log.Fatalf("Error parsing read cache size: %v", err)
+	}
+	blobReadCache, err = newReadCache(*readCacheDir, int64(max))
+	if err != nil {
+		log.Fatalf("Error setting up read cache: %v", err)
+	}
+	expvar.Publish("readcache", expvar.Func(blobReadCache.stats))
+}
+
+// Set up a cache in dir, keeping what's already there (most
+// recently modified first) up to max bytes.
+func newReadCache(dir string, max int64) (*readCache, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	c := &readCache{
+		dir:     dir,
+		max:     max,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+	}
+
+	var found []os.FileInfo
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case info.IsDir():
+		case strings.HasPrefix(info.Name(), "tmp"):
+			os.Remove(p)
+		case isBlobName(info.Name()):
+			found = append(found, info)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(newestFirst(found))
+	for _, info := range found {
+		c.insert(info.Name(), info.Size(), false)
+	}
+	c.evict()
+	return c, nil
+}
+
+type newestFirst []os.FileInfo
+
+func (n newestFirst) Len() int           { return len(n) }
+func (n newestFirst) Less(i, j int) bool { return n[i].ModTime().After(n[j].ModTime()) }
+func (n newestFirst) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+
+func (c *readCache) filename(oid string) string {
+	return hashFilename(c.dir, oid)
+}
+
+// Record a cached blob, most recent first unless it's being loaded.
+// The caller holds mu or is the only user.
+func (c *readCache) insert(oid string, size int64, recent bool) {
+	if _, ok := c.entries[oid]; ok {
+		return
+	}
+	e := &readCacheEntry{oid, size}
+	if recent {
+		c.entries[oid] = c.lru.PushFront(e)
+	} else {
+		c.entries[oid] = c.lru.PushBack(e)
+	}
+	c.size += size
+}
+
+// Drop the least recently read blobs until we're within max.  The
+// caller holds mu or is the only user.
+func (c *readCache) evict() {
+	for c.size > c.max && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Change the most space the cache may use, dropping blobs to fit.
+func (c *readCache) resize(max int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.max = max
+	c.evict()
+}
+
+func (c *readCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*readCacheEntry)
+	delete(c.entries, e.oid)
+	c.size -= e.size
+	if err := os.Remove(c.filename(e.oid)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing %v from the read cache: %v", e.oid, err)
+	}
+}
+
+// Open a cached blob, if we have it.
+func (c *readCache) open(oid string) (ReadSeekCloser, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[oid]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	f, err := os.Open(c.filename(oid))
+	if err == nil {
+		var rv ReadSeekCloser
+		if rv, err = maybeDecrypt(f); err == nil {
+			c.hits++
+			c.lru.MoveToFront(el)
+			return rv, true
+		}
+		f.Close()
+	}
+	log.Printf("Error opening %v from the read cache: %v", oid, err)
+	c.remove(el)
+	c.misses++
+	return nil, false
+}
+
+// Keep a copy of a blob of length l as it's read from r, if it fits.
+// Reading fails only if r does; a copy that can't be written or
+// isn't read to the end is just not kept.
+func (c *readCache) fill(oid string, l int64, r io.ReadCloser) io.ReadCloser {
+	if c == nil {
+		return r
+	}
+	c.mu.Lock()
+	tooBig := l > c.max
+	c.mu.Unlock()
+	if tooBig {
+		return r
+	}
+	hw, err := NewHashRecord(c.dir, oid)
+	if err != nil {
+		log.Printf("Error caching %v: %v", oid, err)
+		return r
+	}
+	return &readCacheFill{r, c, hw, oid, l, nil}
+}
+
+type readCacheFill struct {
+	io.ReadCloser
+	c   *readCache
+	hw  *hashRecord
+	oid string
+	l   int64
+	err error
+}
+
+func (f *readCacheFill) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+	if n > 0 && f.err == nil {
+		_, f.err = f.hw.Write(p[:n])
+	}
+	return n, err
+}
+
+func (f *readCacheFill) Close() error {
+	err := f.ReadCloser.Close()
+	if f.err == nil && f.hw.written == f.l {
+		f.err = f.c.add(f.hw)
+	}
+	if f.err != nil {
+		log.Printf("Error caching %v: %v", f.oid, f.err)
+	}
+	f.hw.Close()
+	return err
+}
+
+// Move a completely read blob into the cache.
+func (c *readCache) add(hw *hashRecord) error {
+	oid, err := hw.Finish()
+	if err != nil {
+		return err
+	}
+	st, err := os.Stat(c.filename(oid))
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.insert(oid, st.Size(), true)
+	c.evict()
+	return nil
+}
+
+func (c *readCache) stats() interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return map[string]interface{}{
+		"dir":    c.dir,
+		"max":    c.max,
+		"size":   c.size,
+		"blobs":  c.lru.Len(),
+		"hits":   c.hits,
+		"misses": c.misses,
+	}
+}
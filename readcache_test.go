@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadCache(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "readcachetest")
+	if err != nil {
+		t.Fatalf("Error making tmp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer func(r string) { *root = r }(*root)
+	*root = filepath.Join(tmpdir, "storage")
+
+	oidOf := func(s string) string {
+		h := getHash()
+		h.Write([]byte(s))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+
+	c, err := newReadCache(filepath.Join(tmpdir, "cache"), 10)
+	if err != nil {
+		t.Fatalf("Error making cache: %v", err)
+	}
+
+	cache := func(s string, oid string) {
+		r := c.fill(oid, int64(len(s)),
+			ioutil.NopCloser(strings.NewReader(s)))
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if string(data) != s || err != nil {
+			t.Fatalf("Expected to read %q through the cache, got %q, %v",
+				s, data, err)
+		}
+	}
+	cached := func(oid string) string {
+		f, ok := c.open(oid)
+		if !ok {
+			return ""
+		}
+		defer f.Close()
+		data, _ := ioutil.ReadAll(f)
+		return string(data)
+	}
+
+	hello, world, bye := oidOf("hello"), oidOf("world"), oidOf("bye")
+	cache("hello", hello)
+	cache("world", world)
+	if cached(hello) != "hello" || cached(world) != "world" {
+		t.Fatalf("Expected hello and world to be cached")
+	}
+
+	// Content that doesn't match its name isn't kept.
+	cache("jello", oidOf("yellow"))
+	if cached(oidOf("yellow")) != "" {
+		t.Errorf("Expected a mismatched blob not to be cached")
+	}
+
+	// Too big to ever fit.
+	cache("hello world", oidOf("hello world"))
+	if cached(oidOf("hello world")) != "" {
+		t.Errorf("Expected an oversized blob not to be cached")
+	}
+
+	// hello was read less recently than world, so it makes room.
+	cached(world)
+	cache("bye", bye)
+	if cached(hello) != "" || cached(world) != "world" || cached(bye) != "bye" {
+		t.Errorf("Expected hello to be evicted for bye")
+	}
+	if _, err := os.Stat(c.filename(hello)); !os.IsNotExist(err) {
+		t.Errorf("Expected evicted hello to be removed, got %v", err)
+	}
+
+	// What's there survives a restart.
+	c, err = newReadCache(c.dir, 10)
+	if err != nil {
+		t.Fatalf("Error reopening cache: %v", err)
+	}
+	if c.size != 8 || cached(world) != "world" || cached(bye) != "bye" {
+		t.Errorf("Expected world and bye after reopening, got %v bytes",
+			c.size)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+)
+
+var errCorruptBlob = errors.New("local copy of blob is corrupt")
+
+var readRepairs uint64
+
+// Set aside a bad local copy of a blob and fetch a good one from
+// another node.
+func repairLocalBlob(oid string) {
+	atomic.AddUint64(&readRepairs, 1)
+	err := quarantineBlob(oid)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error quarantining bad copy of %v: %v", oid, err)
+	}
+	if !maybeQueueBlobFetch(oid, "") {
+		log.Printf("Fetch queue is full, not repairing %v", oid)
+	}
+}
+
+// Fix up after finding we don't have a blob someone asked us for.  If
+// the registry says we should, get it back.
+func repairMissingBlob(oid string) {
+	bo, err := getBlobOwnership(oid)
+	if err != nil {
+		return
+	}
+	if _, ours := bo.Nodes[serverId]; ours {
+		log.Printf("Registered local copy of %v is missing, repairing", oid)
+		repairLocalBlob(oid)
+	}
+}
+
+// Open a local blob to serve, making sure its content matches its
+// name.  Blobs up to ReadVerifySize are checked before they're
+// returned.  Larger ones are checked as they're read, and the read
+// fails at the end if they don't match.  Either way, a bad copy is
+// repaired.  Blobs of ZeroCopySize or more aren't checked at all, so
+// they can be served with sendfile.
+func openCheckedLocalBlob(oid string) (ReadSeekCloser, error) {
+	f, err := openLocalBlob(oid)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := f.Seek(0, os.SEEK_END)
+	if err == nil {
+		_, err = f.Seek(0, os.SEEK_SET)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if z := globalConfig.ZeroCopySize; z > 0 && size >= z {
+		return f, nil
+	}
+	if size > globalConfig.ReadVerifySize {
+		return &verifyingReader{f, oid, newOIDHash(oid)}, nil
+	}
+
+	h := newOIDHash(oid)
+	if _, err := io.Copy(h, f); err != nil || h.match(oid) == "" {
+
+		f.Close()
+		log.Printf("Local copy of %v is bad (%v), repairing", oid, err)
+		repairLocalBlob(oid)
+		return nil, errCorruptBlob
+	}
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Hashes a blob as it's read from start to end, failing the final
+// read if the content doesn't match.  Seeking anywhere but the start
+// stops the check.
+type verifyingReader struct {
+	ReadSeekCloser
+	oid string
+	h   *oidHash
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.ReadSeekCloser.Read(p)
+	if v.h == nil {
+		return n, err
+	}
+	v.h.Write(p[:n])
+	if err == io.EOF && v.h.match(v.oid) == "" {
+		v.h = nil
+		log.Printf("Local copy of %v failed verification, repairing",
+			v.oid)
+		go repairLocalBlob(v.oid)
+		return n, errCorruptBlob
+	}
+	return n, err
+}
+
+func (v *verifyingReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := v.ReadSeekCloser.Seek(offset, whence)
+	if err == nil && pos == 0 {
+		v.h = newOIDHash(v.oid)
+	} else {
+		v.h = nil
+	}
+	return pos, err
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenCheckedLocalBlob(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "readrepairtest")
+	if err != nil {
+		t.Fatalf("Error making tmp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer func(r string) { *root = r }(*root)
+	*root = tmpdir
+	defer func(s int64) { globalConfig.ReadVerifySize = s }(globalConfig.ReadVerifySize)
+	defer func(s int64) { globalConfig.ZeroCopySize = s }(globalConfig.ZeroCopySize)
+
+	h := getHash()
+	h.Write([]byte("hello"))
+	oid := hex.EncodeToString(h.Sum(nil))
+	fn := hashFilename(tmpdir, oid)
+	os.MkdirAll(filepath.Dir(fn), 0777)
+
+	tests := []struct {
+		content    string
+		verifySize int64
+		zeroCopy   int64
+		exp        error
+	}{
+		{"hello", 1024, 0, nil},
+		{"hello", 0, 0, nil},
+		{"jello", 1024, 0, errCorruptBlob},
+		{"jello", 0, 0, errCorruptBlob},
+		{"jello", 0, 5, nil},
+		{"jello", 0, 6, errCorruptBlob},
+	}
+
+	for _, test := range tests {
+		if err := ioutil.WriteFile(fn, []byte(test.content), 0666); err != nil {
+			t.Fatalf("Error writing blob: %v", err)
+		}
+		globalConfig.ReadVerifySize = test.verifySize
+		globalConfig.ZeroCopySize = test.zeroCopy
+
+		f, err := openCheckedLocalBlob(oid)
+		if err == nil {
+			_, err = ioutil.ReadAll(f)
+			f.Close()
+		}
+		if err != test.exp {
+			t.Errorf("Expected %v for %q (verify up to %v, zero copy from %v), got %v",
+				test.exp, test.content, test.verifySize, test.zeroCopy, err)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	cb "github.com/couchbaselabs/go-couchbase"
+	"github.com/dustin/go-humanize"
+)
+
+// How long to let queued moves land before looking at node sizes
+// again.
+const rebalanceCheckFreq = 30 * time.Second
+
+// A node using more of its disk than the rest of its tier, how much
+// it should give up, and the nodes that could take it.
+type rebalancePlan struct {
+	from  StorageNode
+	bytes int64
+	to    NodeList
+	// The tier's share of storage in use, which nodes are moved to
+	mean float64
+}
+
+// How much of its storage a node is using, from 0 to 1.
+func (n StorageNode) usedShare() float64 {
+	total := n.Used + n.Free
+	if total <= 0 {
+		return 0
+	}
+	return float64(n.Used) / float64(total)
+}
+
+// Find the nodes whose disk use is more than spread (from 0 to 1)
+// over their tier's mean.  Each gives up enough to get back to the
+// mean, to the nodes below it, least used first.
+func planRebalance(nl NodeList, spread float64) []rebalancePlan {
+	var rv []rebalancePlan
+	for _, t := range []string{hotTier, coldTier} {
+		nodes := nl.inTier(t)
+		var used, total int64
+		for _, n := range nodes {
+			used += n.Used
+			total += n.Used + n.Free
+		}
+		if len(nodes) < 2 || total <= 0 {
+			continue
+		}
+		mean := float64(used) / float64(total)
+
+		under := NodeList{}
+		for _, n := range nodes {
+			if n.usedShare() < mean {
+				under = append(under, n)
+			}
+		}
+		sort.Slice(under, func(i, j int) bool {
+			return under[i].usedShare() < under[j].usedShare()
+		})
+
+		for _, n := range nodes {
+			if n.usedShare() > mean+spread {
+				rv = append(rv, rebalancePlan{
+					from:  n,
+					bytes: n.Used - int64(mean*float64(n.Used+n.Free)),
+					to:    under,
+					mean:  mean,
+				})
+			}
+		}
+	}
+	return rv
+}
+
+// Describe how far along a rebalance is.
+func rebalanceProgress(moved, total int64, elapsed time.Duration) string {
+	rv := fmt.Sprintf("moved %v of %v", humanize.Bytes(uint64(moved)),
+		humanize.Bytes(uint64(total)))
+	if moved > 0 && moved < total {
+		left := time.Duration(float64(elapsed) *
+			float64(total-moved) / float64(moved))
+		rv += fmt.Sprintf(", about %v left", left/time.Second*time.Second)
+	}
+	return rv
+}
+
+// Queue moves of blobs off of an overused node, stopping once enough
+// are on their way.  pending is what's already been sent to each
+// node, and queued the blobs already moving.
+func rebalanceSomeOffOf(p rebalancePlan, nl NodeList,
+	pending map[string]int64, queued map[string]bool) error {
+
+	viewRes := struct {
+		Rows []struct {
+			Id  string
+			Doc struct {
+				Json struct {
+					Nodes   map[string]string
+					Length  int64
+					Garbage bool
+					Shard   bool
+					Pinned  []string
+				}
+			}
+		}
+		Errors []cb.ViewError
+	}{}
+
+	err := couchbase.ViewCustom("cbfs", "node_blobs",
+		map[string]interface{}{
+			"key":          p.from.name,
+			"limit":        globalConfig.RebalanceCount,
+			"reduce":       false,
+			"include_docs": true,
+			"stale":        false,
+		}, &viewRes)
+	if err != nil {
+		return err
+	}
+	if len(viewRes.Errors) > 0 {
+		return fmt.Errorf("View errors: %v", viewRes.Errors)
+	}
+
+	moving := int64(0)
+	for _, r := range viewRes.Rows {
+		if moving >= p.bytes {
+			break
+		}
+		oid := r.Id[1:]
+		b := r.Doc.Json
+		if queued[oid] || b.Garbage || b.Shard ||
+			pinnedTo(b.Pinned, p.from.name) {
+			continue
+		}
+
+		holders, others := NodeList{}, NodeList{}
+		for name := range b.Nodes {
+			h := nl.named(name)
+			h.name = name
+			holders = append(holders, h)
+			if name != p.from.name {
+				others = append(others, h)
+			}
+		}
+
+		// Keep the copies in as many zones as they were.
+		targets := p.to.minus(holders).spreadAcrossZones(others.zones())
+		for _, n := range targets {
+			room := int64(p.mean*float64(n.Used+n.Free)) - n.Used
+			if room-pending[n.name] < b.Length {
+				continue
+			}
+			if !maybeQueueBlobAcquire(n, oid, p.from.name) {
+				log.Printf("Queue is full rebalancing %v", p.from)
+				return nil
+			}
+			log.Printf("Rebalancing %v from %v to %v", oid, p.from, n)
+			pending[n.name] += b.Length
+			queued[oid] = true
+			moving += b.Length
+			break
+		}
+	}
+	return nil
+}
+
+// Move blobs from nodes using a lot more of their disk than the rest
+// of their tier to those using less, until they're all about even or
+// the run has gone on for a period.
+func rebalanceNodes() error {
+	if globalConfig.RebalanceSpread <= 0 {
+		return nil
+	}
+	spread := float64(globalConfig.RebalanceSpread) / 100
+	start := time.Now()
+	total := int64(-1)
+	queued := map[string]bool{}
+
+	for {
+		nl, err := findAllNodes()
+		if err != nil {
+			return err
+		}
+		live := NodeList{}
+		for _, n := range nl.accepting() {
+			if time.Since(n.Time) < globalConfig.StaleNodeLimit {
+				live = append(live, n)
+			}
+		}
+		plans := planRebalance(live, spread)
+		if len(plans) == 0 {
+			if total >= 0 {
+				log.Printf("Rebalanced in %v", time.Since(start))
+			}
+			return nil
+		}
+
+		left := int64(0)
+		for _, p := range plans {
+			left += p.bytes
+		}
+		if total < left {
+			total = left
+		}
+		setTaskDetail("rebalance",
+			rebalanceProgress(total-left, total, time.Since(start)))
+
+		pending := map[string]int64{}
+		for _, p := range plans {
+			if err := rebalanceSomeOffOf(p, nl, pending, queued); err != nil {
+				return err
+			}
+		}
+		if len(queued) == 0 {
+			log.Printf("Nothing can be moved to even out %v", plans[0].from)
+			return nil
+		}
+
+		if time.Since(start) > globalConfig.RebalanceFreq {
+			return nil
+		}
+		time.Sleep(rebalanceCheckFreq)
+		if !relockTask("rebalance") {
+			return errors.New("Lost lock")
+		}
+	}
+}
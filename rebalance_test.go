@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPlanRebalance(t *testing.T) {
+	mk := func(name, tier string, used int64) StorageNode {
+		return StorageNode{name: name, Tier: tier, Used: used, Free: 100 - used}
+	}
+	nl := NodeList{
+		mk("full", "", 80), mk("mid", "", 50), mk("low", "", 30),
+		mk("empty", "", 0), mk("c1", coldTier, 90), mk("c2", coldTier, 85),
+	}
+
+	plans := planRebalance(nl, 0.1)
+	if len(plans) != 1 {
+		t.Fatalf("Expected one node to rebalance, got %v", plans)
+	}
+	p := plans[0]
+	if p.from.name != "full" || p.bytes != 40 {
+		t.Errorf("Expected to move 40 bytes off full, got %v off %v",
+			p.bytes, p.from)
+	}
+	if s := fmt.Sprint(nodeNames(p.to)); s != "[empty low]" {
+		t.Errorf("Expected to move to [empty low], got %v", s)
+	}
+
+	if plans := planRebalance(nl, 0.5); len(plans) != 0 {
+		t.Errorf("Expected nothing far enough off, got %v", plans)
+	}
+}
+
+func TestRebalanceProgress(t *testing.T) {
+	tests := []struct {
+		moved, total int64
+		exp          string
+	}{
+		{0, 2000, "moved 0 B of 2.0 kB"},
+		{500, 2000, "moved 500 B of 2.0 kB, about 3m0s left"},
+		{2000, 2000, "moved 2.0 kB of 2.0 kB"},
+	}
+	for _, test := range tests {
+		got := rebalanceProgress(test.moved, test.total, time.Minute)
+		if got != test.exp {
+			t.Errorf("Expected %q, got %q", test.exp, got)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Arithmetic in GF(2^8) with the polynomial x^8+x^4+x^3+x^2+1.
+var gfExp [510]byte
+var gfLog [256]int
+var gfMulTable [256][256]byte
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfExp[i+255] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMulTable[a][b] = gfExp[gfLog[a]+gfLog[b]]
+		}
+	}
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-gfLog[a]]
+}
+
+// out ^= c * in
+func gfMulAdd(c byte, in, out []byte) {
+	if c == 0 {
+		return
+	}
+	mt := &gfMulTable[c]
+	for i, b := range in {
+		out[i] ^= mt[b]
+	}
+}
+
+var errTooFewShards = errors.New("too few shards to reconstruct")
+
+// A systematic Reed-Solomon code.  The first data rows of the
+// encoding matrix are the identity, and the parity rows form a
+// Cauchy matrix, so any data rows of the whole are invertible.
+type rsCode struct {
+	data, parity int
+	matrix       [][]byte
+}
+
+func newRSCode(data, parity int) (*rsCode, error) {
+	if data < 1 || parity < 0 || data+parity > 256 {
+		return nil, fmt.Errorf("invalid erasure code %v+%v", data, parity)
+	}
+	rv := &rsCode{data, parity, make([][]byte, data+parity)}
+	for i := range rv.matrix {
+		rv.matrix[i] = make([]byte, data)
+		if i < data {
+			rv.matrix[i][i] = 1
+			continue
+		}
+		for j := 0; j < data; j++ {
+			rv.matrix[i][j] = gfInv(byte(i) ^ byte(j))
+		}
+	}
+	return rv, nil
+}
+
+func (c *rsCode) total() int {
+	return c.data + c.parity
+}
+
+// Compute the parity shards from the data shards.  All shards must
+// be allocated and the same size.
+func (c *rsCode) encode(shards [][]byte) {
+	for i := c.data; i < c.total(); i++ {
+		out := shards[i]
+		for j := range out {
+			out[j] = 0
+		}
+		for j := 0; j < c.data; j++ {
+			gfMulAdd(c.matrix[i][j], shards[j], out)
+		}
+	}
+}
+
+// Invert a square matrix by Gauss-Jordan elimination.
+func gfInvertMatrix(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	work := make([][]byte, n)
+	for i := range m {
+		work[i] = make([]byte, 2*n)
+		copy(work[i], m[i])
+		work[i][n+i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for r := col; r < n; r++ {
+			if work[r][col] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, errors.New("singular matrix")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+		inv := gfInv(work[col][col])
+		for j := range work[col] {
+			work[col][j] = gfMulTable[inv][work[col][j]]
+		}
+		for r := 0; r < n; r++ {
+			if r != col && work[r][col] != 0 {
+				gfMulAdd(work[r][col], work[col], work[r])
+			}
+		}
+	}
+	rv := make([][]byte, n)
+	for i := range work {
+		rv[i] = work[i][n:]
+	}
+	return rv, nil
+}
+
+// Fill in missing (nil) shards from those present.  If dataOnly is
+// set, missing parity shards are left alone.
+func (c *rsCode) reconstruct(shards [][]byte, dataOnly bool) error {
+	size := -1
+	var rows []int
+	for i, s := range shards {
+		if s != nil {
+			size = len(s)
+			if len(rows) < c.data {
+				rows = append(rows, i)
+			}
+		}
+	}
+	if len(rows) < c.data {
+		return errTooFewShards
+	}
+
+	missingData := false
+	for i := 0; i < c.data; i++ {
+		missingData = missingData || shards[i] == nil
+	}
+
+	if missingData {
+		sub := make([][]byte, c.data)
+		for i, r := range rows {
+			sub[i] = c.matrix[r]
+		}
+		dec, err := gfInvertMatrix(sub)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < c.data; i++ {
+			if shards[i] != nil {
+				continue
+			}
+			out := make([]byte, size)
+			for j, r := range rows {
+				gfMulAdd(dec[i][j], shards[r], out)
+			}
+			shards[i] = out
+		}
+	}
+
+	if dataOnly {
+		return nil
+	}
+	for i := c.data; i < c.total(); i++ {
+		if shards[i] != nil {
+			continue
+		}
+		out := make([]byte, size)
+		for j := 0; j < c.data; j++ {
+			gfMulAdd(c.matrix[i][j], shards[j], out)
+		}
+		shards[i] = out
+	}
+	return nil
+}
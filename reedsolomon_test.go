@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestReedSolomonReconstruct(t *testing.T) {
+	code, err := newRSCode(6, 3)
+	if err != nil {
+		t.Fatalf("Error creating code: %v", err)
+	}
+
+	orig := make([][]byte, code.total())
+	for i := range orig {
+		orig[i] = make([]byte, 1000)
+		if i < code.data {
+			rand.Read(orig[i])
+		}
+	}
+	code.encode(orig)
+
+	tests := [][]int{
+		{},
+		{0},
+		{8},
+		{0, 1, 2},
+		{3, 6, 7},
+		{5, 7, 8},
+	}
+
+	for _, missing := range tests {
+		shards := make([][]byte, len(orig))
+		copy(shards, orig)
+		for _, i := range missing {
+			shards[i] = nil
+		}
+		if err := code.reconstruct(shards, false); err != nil {
+			t.Errorf("Error reconstructing without %v: %v", missing, err)
+			continue
+		}
+		for i := range shards {
+			if !bytes.Equal(shards[i], orig[i]) {
+				t.Errorf("Shard %v wrong after reconstructing without %v",
+					i, missing)
+			}
+		}
+	}
+
+	shards := make([][]byte, len(orig))
+	copy(shards, orig)
+	shards[0], shards[1], shards[2], shards[3] = nil, nil, nil, nil
+	if err := code.reconstruct(shards, false); err != errTooFewShards {
+		t.Errorf("Expected %v with four missing, got %v", errTooFewShards, err)
+	}
+}
+
+func TestInvalidRSCode(t *testing.T) {
+	for _, c := range [][2]int{{0, 3}, {3, -1}, {200, 57}} {
+		if _, err := newRSCode(c[0], c[1]); err == nil {
+			t.Errorf("Expected an error for %v+%v", c[0], c[1])
+		}
+	}
+}
+
+func TestWriteStripes(t *testing.T) {
+	code, err := newRSCode(3, 2)
+	if err != nil {
+		t.Fatalf("Error creating code: %v", err)
+	}
+
+	data := make([]byte, 5*ecStripeUnit+123)
+	rand.Read(data)
+
+	bufs := make([]*bytes.Buffer, code.total())
+	ws := make([]io.Writer, code.total())
+	for i := range bufs {
+		bufs[i] = &bytes.Buffer{}
+		ws[i] = bufs[i]
+	}
+	size, err := writeStripes(bytes.NewReader(data), code, ws)
+	if err != nil {
+		t.Fatalf("Error writing stripes: %v", err)
+	}
+	if size != 2*ecStripeUnit {
+		t.Errorf("Expected shards of %v, got %v", 2*ecStripeUnit, size)
+	}
+
+	// Lose two shards and put it back together a stripe at a time.
+	got := []byte{}
+	for s := 0; s < int(size/ecStripeUnit); s++ {
+		units := make([][]byte, code.total())
+		for i := 2; i < code.total(); i++ {
+			off := s * ecStripeUnit
+			units[i] = bufs[i].Bytes()[off : off+ecStripeUnit]
+		}
+		if err := code.reconstruct(units, true); err != nil {
+			t.Fatalf("Error reconstructing stripe %v: %v", s, err)
+		}
+		for i := 0; i < code.data; i++ {
+			got = append(got, units[i]...)
+		}
+	}
+	if !bytes.Equal(got[:len(data)], data) {
+		t.Errorf("Reconstructed data doesn't match")
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	cb "github.com/couchbaselabs/go-couchbase"
+)
+
+// Record which hash named a blob.
+func setBlobHash(oid, name string) error {
+	err := couchbase.Update("/"+oid, 0, func(in []byte) ([]byte, error) {
+		ownership := BlobOwnership{}
+		if err := json.Unmarshal(in, &ownership); err != nil {
+			return nil, cb.UpdateCancel
+		}
+		ownership.Hash = name
+		return json.Marshal(ownership)
+	})
+	if err == cb.UpdateCancel {
+		err = nil
+	}
+	return err
+}
+
+// Point everything in a file's current and older versions at a blob
+// at its new name instead of its old one.
+func rekeyFileMeta(fm *fileMeta, from, to string) bool {
+	changed := false
+	rekeyParts := func(parts []blobPart) {
+		for i := range parts {
+			if parts[i].OID == from {
+				parts[i].OID = to
+				changed = true
+			}
+		}
+	}
+	if fm.OID == from {
+		fm.OID = to
+		changed = true
+	}
+	rekeyParts(fm.Parts)
+	for i := range fm.Previous {
+		if fm.Previous[i].OID == from {
+			fm.Previous[i].OID = to
+			changed = true
+		}
+		rekeyParts(fm.Previous[i].Parts)
+	}
+	return changed
+}
+
+// The ids of every file that refers to a blob, either directly, in an
+// older version, or as one of its parts.
+func filesReferencing(oid string) ([]string, error) {
+	queries := []struct {
+		view   string
+		params map[string]interface{}
+	}{
+		{"file_blobs", map[string]interface{}{
+			"stale":    false,
+			"startkey": []interface{}{oid, "file"},
+			"endkey":   []interface{}{oid, "file", map[string]interface{}{}},
+		}},
+		{"blob_refs", map[string]interface{}{
+			"stale":  false,
+			"reduce": false,
+			"key":    oid,
+		}},
+	}
+
+	seen := map[string]bool{}
+	rv := []string{}
+	for _, q := range queries {
+		viewRes := struct {
+			Rows []struct {
+				Id string
+			}
+			Errors []cb.ViewError
+		}{}
+		err := couchbase.ViewCustom("cbfs", q.view, q.params, &viewRes)
+		if err != nil {
+			return nil, err
+		}
+		if len(viewRes.Errors) > 0 {
+			return nil, fmt.Errorf("View errors: %v", viewRes.Errors)
+		}
+		for _, r := range viewRes.Rows {
+			if !seen[r.Id] {
+				seen[r.Id] = true
+				rv = append(rv, r.Id)
+			}
+		}
+	}
+	return rv, nil
+}
+
+// Update every file that refers to a blob by its old name.
+func rekeyFiles(from, to string) error {
+	ids, err := filesReferencing(from)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		err := couchbase.Update(id, 0, func(in []byte) ([]byte, error) {
+			fm := fileMeta{}
+			if err := json.Unmarshal(in, &fm); err != nil ||
+				fm.Type != "file" || !rekeyFileMeta(&fm, from, to) {
+
+				return nil, cb.UpdateCancel
+			}
+			return json.Marshal(fm)
+		})
+		if err != nil && err != cb.UpdateCancel {
+			return err
+		}
+	}
+	return nil
+}
+
+// Store a copy of a blob under the configured hash.
+func storeRehashed(oid, newOID string, length int64) error {
+	f, err := openBlob(oid, false)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hr, err := NewHashRecord(pickVolume(), newOID)
+	if err != nil {
+		return err
+	}
+	defer hr.Close()
+	if _, _, err := hr.Process(f); err != nil {
+		return err
+	}
+	if err := recordBlobOwnership(newOID, length, true); err != nil {
+		return err
+	}
+	if globalConfig.MinReplicas > 1 {
+		go increaseReplicaCount(newOID, length, globalConfig.MinReplicas-1)
+	}
+	return setBlobHash(newOID, globalConfig.Hash)
+}
+
+// Make sure a blob is named by the configured hash, giving it a new
+// name and moving its files over to it if it isn't.  The old blob is
+// left for garbage collection.
+func rehashBlob(oid string, length int64) error {
+	want := globalConfig.Hash
+	names := hashesFor(oid)
+	if len(names) == 1 && names[0] == want {
+		return setBlobHash(oid, want)
+	}
+
+	f, err := openBlob(oid, false)
+	if err != nil {
+		return err
+	}
+	check, cur := newOIDHash(oid), getHash()
+	_, err = io.Copy(io.MultiWriter(check, cur), f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	name := check.match(oid)
+	switch name {
+	case "":
+		return fmt.Errorf("content of %v doesn't match its name", oid)
+	case want:
+		return setBlobHash(oid, want)
+	}
+
+	newOID := hex.EncodeToString(cur.Sum(nil))
+	if err := storeRehashed(oid, newOID, length); err != nil {
+		return err
+	}
+	if err := rekeyFiles(oid, newOID); err != nil {
+		return err
+	}
+	log.Printf("Rehashed %v (%v) as %v (%v)", oid, name, newOID, want)
+	return setBlobHash(oid, name)
+}
+
+// Rename blobs not known to be named by the configured hash, up to
+// RehashLimit of them per run.
+func rehashBlobs() error {
+	limit := globalConfig.RehashLimit
+	if limit <= 0 {
+		return nil
+	}
+
+	// Everything keyed before and after the configured hash.
+	ranges := []map[string]interface{}{
+		{"endkey": globalConfig.Hash, "inclusive_end": false},
+		{"startkey": globalConfig.Hash + "\u0000"},
+	}
+
+	done, failed := 0, 0
+	for _, params := range ranges {
+		params["stale"] = false
+		params["reduce"] = false
+		params["limit"] = limit - done
+
+		viewRes := struct {
+			Rows []struct {
+				Id    string
+				Value int64
+			}
+			Errors []cb.ViewError
+		}{}
+		err := couchbase.ViewCustom("cbfs", "blob_hashes", params, &viewRes)
+		if err != nil {
+			return err
+		}
+		if len(viewRes.Errors) > 0 {
+			return fmt.Errorf("View errors: %v", viewRes.Errors)
+		}
+
+		for _, r := range viewRes.Rows {
+			oid := r.Id[1:]
+			setTaskDetail("rehashBlobs", oid)
+			if err := rehashBlob(oid, r.Value); err != nil {
+				log.Printf("Error rehashing %v: %v", oid, err)
+				failed++
+			}
+			done++
+			if !relockTask("rehashBlobs") {
+				return errors.New("Lost lock")
+			}
+		}
+		if done >= limit {
+			break
+		}
+	}
+
+	if done > 0 {
+		log.Printf("Checked the hashes of %v blobs, %v failed", done, failed)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRekeyFileMeta(t *testing.T) {
+	fm := fileMeta{
+		OID:   "old",
+		Parts: []blobPart{{"a", 1}, {"old", 2}},
+		Previous: []prevMeta{
+			{OID: "old"},
+			{OID: "b", Parts: []blobPart{{"old", 3}}},
+		},
+	}
+	exp := fileMeta{
+		OID:   "new",
+		Parts: []blobPart{{"a", 1}, {"new", 2}},
+		Previous: []prevMeta{
+			{OID: "new"},
+			{OID: "b", Parts: []blobPart{{"new", 3}}},
+		},
+	}
+
+	if !rekeyFileMeta(&fm, "old", "new") {
+		t.Fatalf("Expected a change")
+	}
+	if !reflect.DeepEqual(fm, exp) {
+		t.Errorf("Expected %+v, got %+v", exp, fm)
+	}
+	if rekeyFileMeta(&fm, "old", "new") {
+		t.Errorf("Expected no change the second time")
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/couchbase/gomemcached"
+	"github.com/dustin/go-humanize"
+)
+
+var nodeConfigFile = flag.String("config", "",
+	"File of flag settings (name = value per line), re-read on SIGHUP")
+
+// Flags that can change while the node runs, and what to do when one
+// has.  Anything else in the config file only changes on restart.
+var reloadableFlags = map[string]func() error{
+	"verbose":        nil,
+	"cachePercent":   nil,
+	"taskWorkers":    applyTaskWorkers,
+	"hotCache":       applyHotCache,
+	"hotCacheObject": applyHotCache,
+	"readCacheSize":  applyReadCacheSize,
+	"weight":         nil,
+}
+
+// Guards the values of the reloadable flags, which a reload sets
+// while requests read them.  Those read outside of startup and the
+// apply hooks go through the accessors below.
+var reloadableMu sync.RWMutex
+
+func verboseLogging() bool {
+	reloadableMu.RLock()
+	defer reloadableMu.RUnlock()
+	return *verbose
+}
+
+func cachePercent() int {
+	reloadableMu.RLock()
+	defer reloadableMu.RUnlock()
+	return *cachePercentage
+}
+
+func configuredWeight() float64 {
+	reloadableMu.RLock()
+	defer reloadableMu.RUnlock()
+	return *nodeWeight
+}
+
+// What a reload did.
+type reloadResult struct {
+	Changed []string `json:"changed"`
+	// Changed in the file, but not until the node restarts
+	NeedRestart []string `json:"needRestart,omitempty"`
+}
+
+var nodeConfig struct {
+	sync.Mutex
+	// Flags given on the command line, which the file can't override
+	cmdline map[string]bool
+	// Flags the file set last time it was read
+	fromFile map[string]bool
+}
+
+// Read a config file of "name = value" lines, with blank lines and
+// lines starting with # ignored.
+func parseNodeConfig(r io.Reader) (map[string]string, error) {
+	rv := map[string]string{}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %v: expected name = value", n)
+		}
+		name := strings.TrimLeft(strings.TrimSpace(parts[0]), "-")
+		if flag.Lookup(name) == nil {
+			return nil, fmt.Errorf("line %v: no such setting: %v", n, name)
+		}
+		rv[name] = strings.TrimSpace(parts[1])
+	}
+	return rv, s.Err()
+}
+
+func readNodeConfig() (map[string]string, error) {
+	f, err := os.Open(*nodeConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseNodeConfig(f)
+}
+
+// Apply the -config file at startup, before anything uses the flags.
+func loadNodeConfig() {
+	nodeConfig.cmdline = map[string]bool{}
+	nodeConfig.fromFile = map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		nodeConfig.cmdline[f.Name] = true
+	})
+	if *nodeConfigFile == "" {
+		return
+	}
+	settings, err := readNodeConfig()
+	if err != nil {
+		log.Fatalf("Error reading config file: %v", err)
+	}
+	for name, val := range settings {
+		if nodeConfig.cmdline[name] {
+			continue
+		}
+		if err := flag.Set(name, val); err != nil {
+			log.Fatalf("Error in config file: %v: %v", name, err)
+		}
+		nodeConfig.fromFile[name] = true
+	}
+}
+
+// Re-read the cluster config and the -config file, applying what can
+// be changed without a restart.
+func reloadNodeConfig() (reloadResult, error) {
+	nodeConfig.Lock()
+	defer nodeConfig.Unlock()
+
+	rv := reloadResult{Changed: []string{}}
+	if err := updateConfig(); err != nil && !gomemcached.IsNotFound(err) {
+		return rv, err
+	}
+	if *nodeConfigFile == "" {
+		return rv, nil
+	}
+	settings, err := readNodeConfig()
+	if err != nil {
+		return rv, err
+	}
+
+	// Settings taken out of the file go back to their defaults.
+	want := map[string]string{}
+	for name := range nodeConfig.fromFile {
+		want[name] = flag.Lookup(name).DefValue
+	}
+	for name, val := range settings {
+		want[name] = val
+	}
+
+	names := make([]string, 0, len(want))
+	for name := range want {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var apply []func() error
+	for _, name := range names {
+		f := flag.Lookup(name)
+		if nodeConfig.cmdline[name] || f.Value.String() == want[name] {
+			continue
+		}
+		hook, ok := reloadableFlags[name]
+		if !ok {
+			rv.NeedRestart = append(rv.NeedRestart, name)
+			continue
+		}
+		reloadableMu.Lock()
+		err := f.Value.Set(want[name])
+		reloadableMu.Unlock()
+		if err != nil {
+			return rv, fmt.Errorf("%v: %v", name, err)
+		}
+		rv.Changed = append(rv.Changed, name)
+		if hook != nil {
+			apply = append(apply, hook)
+		}
+	}
+
+	nodeConfig.fromFile = map[string]bool{}
+	for name := range settings {
+		nodeConfig.fromFile[name] = true
+	}
+
+	for _, hook := range apply {
+		if err := hook(); err != nil {
+			return rv, err
+		}
+	}
+	return rv, nil
+}
+
+func applyTaskWorkers() error {
+	if *taskWorkers < 1 {
+		return fmt.Errorf("taskWorkers must be at least 1")
+	}
+	setTaskWorkers(*taskWorkers)
+	return nil
+}
+
+func applyHotCache() error {
+	max, err := humanize.ParseBytes(*hotCacheSize)
+	if err != nil && *hotCacheSize != "" {
+		return fmt.Errorf("hotCache: %v", err)
+	}
+	maxObject, err := humanize.ParseBytes(*hotCacheObject)
+	if err != nil {
+		return fmt.Errorf("hotCacheObject: %v", err)
+	}
+	c := hotBlobCache()
+	if c == nil {
+		if max > 0 {
+			setHotBlobCache(newHotCache(int64(max), int64(maxObject)))
+		}
+		return nil
+	}
+	c.resize(int64(max), int64(maxObject))
+	return nil
+}
+
+func applyReadCacheSize() error {
+	max, err := humanize.ParseBytes(*readCacheSize)
+	if err != nil {
+		return fmt.Errorf("readCacheSize: %v", err)
+	}
+	if blobReadCache != nil {
+		blobReadCache.resize(int64(max))
+	}
+	return nil
+}
+
+func logReload(res reloadResult, err error) {
+	if err != nil {
+		log.Printf("Error reloading config: %v", err)
+		return
+	}
+	log.Printf("Reloaded config, changed %v", res.Changed)
+	if len(res.NeedRestart) > 0 {
+		log.Printf("Changes to %v take effect on restart", res.NeedRestart)
+	}
+}
+
+func handleReloads() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	go func() {
+		for range sigs {
+			logReload(reloadNodeConfig())
+		}
+	}()
+}
+
+func doReloadConfig(w http.ResponseWriter, req *http.Request) {
+	res, err := reloadNodeConfig()
+	logReload(res, err)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	sendJson(w, req, res)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseNodeConfig(t *testing.T) {
+	got, err := parseNodeConfig(strings.NewReader(`
+# tunables
+taskWorkers = 8
+-hotCache=256MB
+
+verbose = true
+`))
+	if err != nil {
+		t.Fatalf("Error parsing: %v", err)
+	}
+	exp := map[string]string{
+		"taskWorkers": "8",
+		"hotCache":    "256MB",
+		"verbose":     "true",
+	}
+	if len(got) != len(exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+	for k, v := range exp {
+		if got[k] != v {
+			t.Errorf("Expected %v = %q, got %q", k, v, got[k])
+		}
+	}
+
+	for _, bad := range []string{"taskWorkers 8", "noSuchFlag = 1"} {
+		if _, err := parseNodeConfig(strings.NewReader(bad)); err == nil {
+			t.Errorf("Expected an error parsing %q", bad)
+		}
+	}
+}
+
+func TestHotCacheResize(t *testing.T) {
+	c := newHotCache(10, 5)
+	c.put("a", []byte("123"))
+	c.put("b", []byte("12345"))
+	c.put("c", []byte("12"))
+
+	c.resize(10, 4)
+	if _, ok := c.entries["b"]; ok {
+		t.Errorf("Expected b to be dropped as too big")
+	}
+	c.resize(2, 4)
+	if c.lru.Len() != 1 || c.size != 2 {
+		t.Errorf("Expected only c left, have %v blobs in %v bytes",
+			c.lru.Len(), c.size)
+	}
+	if c.admit("d", 3) {
+		t.Errorf("Expected a blob over the new size to be refused")
+	}
+}
+
+func TestSetTaskWorkers(t *testing.T) {
+	defer setTaskWorkers(0)
+
+	setTaskWorkers(3)
+	setTaskWorkers(1)
+	taskWorkerCount.Lock()
+	n := taskWorkerCount.n
+	taskWorkerCount.Unlock()
+	if n != 1 {
+		t.Errorf("Expected 1 worker, have %v", n)
+	}
+}
+
+func TestApplyHotCache(t *testing.T) {
+	defer func(size string, c *hotCache) {
+		*hotCacheSize = size
+		setHotBlobCache(c)
+	}(*hotCacheSize, hotBlobCache())
+	setHotBlobCache(nil)
+
+	*hotCacheSize = "1MB"
+	if err := applyHotCache(); err != nil {
+		t.Fatalf("Error applying hot cache: %v", err)
+	}
+	c := hotBlobCache()
+	if c == nil || c.max != 1000000 {
+		t.Fatalf("Expected a 1MB hot cache, got %+v", c)
+	}
+
+	*hotCacheSize = "2MB"
+	if err := applyHotCache(); err != nil {
+		t.Fatalf("Error resizing hot cache: %v", err)
+	}
+	if hotBlobCache() != c || c.max != 2000000 {
+		t.Errorf("Expected the same cache resized, got %+v", hotBlobCache())
+	}
+}
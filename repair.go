@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often repair pacing looks at how busy the node is.
+const repairSampleFreq = time.Second
+
+// The least share of RepairRate repairs get, however busy the node
+// is, so lost copies are still restored eventually.
+const repairMinShare = 0.1
+
+// Network throughput below this isn't taken as the node's capacity,
+// so an idle node doesn't think a little traffic is a lot.
+const repairMinPeak = 1024 * 1024
+
+// Paces the blob fetches that restore lost copies.  They share one
+// budget per node, so however many run at once they stay within
+// RepairRate, scaled down while the node's network or disk is busy.
+type repairPacer struct {
+	mu     sync.Mutex
+	scale  float64
+	tokens float64
+	last   time.Time
+}
+
+var repairPace = &repairPacer{scale: 1}
+
+// Wait until n more bytes may be fetched.
+func (p *repairPacer) wait(n int) {
+	p.mu.Lock()
+	rate := float64(globalConfig.RepairRate) * p.scale
+	if rate <= 0 {
+		p.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	if p.last.IsZero() {
+		p.tokens = rate
+	} else {
+		p.tokens = math.Min(rate, p.tokens+now.Sub(p.last).Seconds()*rate)
+	}
+	p.last = now
+	// Going into debt makes whoever comes next wait for this too.
+	p.tokens -= float64(n)
+	var d time.Duration
+	if p.tokens < 0 {
+		d = time.Duration(-p.tokens / rate * float64(time.Second))
+	}
+	p.mu.Unlock()
+	time.Sleep(d)
+}
+
+// Give repairs whatever share of RepairRate the busier of the
+// network and disk leave.  Each is from 0 (idle) to 1, or negative
+// if unknown.
+func (p *repairPacer) adapt(netBusy, diskBusy float64) {
+	busy := math.Max(netBusy, diskBusy)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.scale = math.Min(1, math.Max(repairMinShare, 1-busy))
+}
+
+func (p *repairPacer) share() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.scale
+}
+
+// A writer paced as a repair.
+type repairWriter struct {
+	w io.Writer
+}
+
+func (r repairWriter) Write(b []byte) (int, error) {
+	repairPace.wait(len(b))
+	return r.w.Write(b)
+}
+
+// Judges how busy the network is against the most this node has
+// been seen to move, which fades so a one-off burst doesn't count
+// forever.
+type netMeter struct {
+	peak float64
+}
+
+// How busy the network is at rate bytes per second, from 0 to 1.
+func (m *netMeter) busy(rate float64) float64 {
+	m.peak = math.Max(m.peak*0.999, rate)
+	return rate / math.Max(m.peak, repairMinPeak)
+}
+
+// Milliseconds the device under each volume has spent doing I/O,
+// for those the platform can say.
+func volumeIOTicks() map[string]uint64 {
+	rv := map[string]uint64{}
+	for _, v := range volumes() {
+		if t, err := diskIOTicks(v); err == nil {
+			rv[v] = t
+		}
+	}
+	return rv
+}
+
+// The busiest volume's share of elapsed spent doing I/O, or -1 if
+// none can be told.
+func diskBusy(before, after map[string]uint64, elapsed time.Duration) float64 {
+	rv := -1.0
+	ms := float64(elapsed / time.Millisecond)
+	for v, t := range after {
+		if b, ok := before[v]; ok && t >= b && ms > 0 {
+			rv = math.Max(rv, float64(t-b)/ms)
+		}
+	}
+	return rv
+}
+
+func repairPaceLoop() {
+	m := &netMeter{}
+	lastBytes := atomic.LoadUint64(&bytesIn) + atomic.LoadUint64(&bytesOut)
+	lastTicks := volumeIOTicks()
+	last := time.Now()
+	for range time.Tick(repairSampleFreq) {
+		now := time.Now()
+		elapsed := now.Sub(last)
+		last = now
+
+		b := atomic.LoadUint64(&bytesIn) + atomic.LoadUint64(&bytesOut)
+		netBusy := m.busy(float64(b-lastBytes) / elapsed.Seconds())
+		lastBytes = b
+
+		ticks := volumeIOTicks()
+		repairPace.adapt(netBusy, diskBusy(lastTicks, ticks, elapsed))
+		lastTicks = ticks
+	}
+}
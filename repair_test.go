@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRepairPacerAdapt(t *testing.T) {
+	tests := []struct {
+		net, disk, exp float64
+	}{
+		{0, -1, 1},
+		{0.25, -1, 0.75},
+		{0.25, 0.5, 0.5},
+		{1, 0.2, repairMinShare},
+		{-1, -1, 1},
+	}
+	for _, test := range tests {
+		p := &repairPacer{}
+		p.adapt(test.net, test.disk)
+		if got := p.share(); got != test.exp {
+			t.Errorf("Expected a share of %v for net=%v disk=%v, got %v",
+				test.exp, test.net, test.disk, got)
+		}
+	}
+}
+
+func TestRepairPacerWait(t *testing.T) {
+	defer func(r int64) { globalConfig.RepairRate = r }(globalConfig.RepairRate)
+	globalConfig.RepairRate = 1000
+
+	p := &repairPacer{scale: 1}
+	start := time.Now()
+	// The first second's worth is there to start with.
+	p.wait(1000)
+	p.wait(100)
+	if d := time.Since(start); d < 80*time.Millisecond {
+		t.Errorf("Expected to wait about 100ms, took %v", d)
+	}
+
+	globalConfig.RepairRate = 0
+	start = time.Now()
+	p.wait(1 << 30)
+	if d := time.Since(start); d > 10*time.Millisecond {
+		t.Errorf("Expected no wait without a rate, took %v", d)
+	}
+}
+
+func TestNetMeter(t *testing.T) {
+	m := &netMeter{}
+	if b := m.busy(1024); b > 0.01 {
+		t.Errorf("Expected a trickle to look idle, got %v", b)
+	}
+	m.busy(100 * repairMinPeak)
+	if b := m.busy(50 * repairMinPeak); b < 0.45 || b > 0.55 {
+		t.Errorf("Expected half the peak to be about half busy, got %v", b)
+	}
+}
+
+func TestDiskBusy(t *testing.T) {
+	before := map[string]uint64{"a": 100, "b": 1000}
+	after := map[string]uint64{"a": 600, "b": 1100, "c": 5}
+	if got := diskBusy(before, after, time.Second); got != 0.5 {
+		t.Errorf("Expected the busiest volume at 0.5, got %v", got)
+	}
+	if got := diskBusy(nil, after, time.Second); got != -1 {
+		t.Errorf("Expected unknown without a previous sample, got %v", got)
+	}
+}
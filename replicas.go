@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	cb "github.com/couchbaselabs/go-couchbase"
+)
+
+// The number of copies a file stored at path should have.
+func replicaTarget(path string) int {
+	if n, ok := globalConfig.ReplicasFor(path); ok {
+		return n
+	}
+	return globalConfig.MinReplicas
+}
+
+// The number of copies a blob should have given its recorded policy
+// count (zero if none).
+func wantedReplicas(policy int) int {
+	if policy > 0 {
+		return policy
+	}
+	return globalConfig.MinReplicas
+}
+
+// Mark the blobs of a file stored under a path with a replica policy
+// with the count the policy asks for.  A blob shared by several files
+// keeps the largest count any of them asked for.
+func recordReplicaPolicy(path string, fm fileMeta) {
+	n, ok := globalConfig.ReplicasFor(path)
+	if !ok {
+		return
+	}
+	oids := []string{fm.OID}
+	for _, p := range fm.Parts {
+		oids = append(oids, p.OID)
+	}
+	for _, oid := range oids {
+		if err := setBlobReplicas(oid, n); err != nil {
+			log.Printf("Error setting replica count of %v to %v: %v",
+				oid, n, err)
+		}
+	}
+}
+
+func setBlobReplicas(oid string, n int) error {
+	err := couchbase.Update("/"+oid, 0, func(in []byte) ([]byte, error) {
+		ownership := BlobOwnership{}
+		if err := json.Unmarshal(in, &ownership); err != nil {
+			return nil, err
+		}
+		if ownership.Replicas >= n {
+			return nil, cb.UpdateCancel
+		}
+		ownership.Replicas = n
+		return json.Marshal(ownership)
+	})
+	if err == cb.UpdateCancel {
+		err = nil
+	}
+	return err
+}
+
+type policyRow struct {
+	Id  string
+	Key int
+	Doc struct {
+		Json struct {
+			Nodes    map[string]string
+			Replicas int
+			Pinned   []string
+		}
+	}
+}
+
+func queryReplicaPolicy(params map[string]interface{}) ([]policyRow, error) {
+	viewRes := struct {
+		Rows   []policyRow
+		Errors []cb.ViewError
+	}{}
+
+	params["reduce"] = false
+	params["limit"] = globalConfig.ReplicationCheckLimit
+	params["stale"] = false
+	err := couchbase.ViewCustom("cbfs", "replica_policy", params, &viewRes)
+	if err == nil && len(viewRes.Errors) > 0 {
+		err = fmt.Errorf("View errors: %v", viewRes.Errors)
+	}
+	return viewRes.Rows, err
+}
+
+// Add copies of blobs with a replica policy that have fewer than it
+// asks for.
+func ensurePolicyReplicaCount() error {
+	nl, err := findAllNodes()
+	if err != nil {
+		return err
+	}
+
+	rows, err := queryReplicaPolicy(map[string]interface{}{
+		"startkey": 1,
+	})
+	if err != nil {
+		return err
+	}
+
+	did := 0
+	for _, r := range rows {
+		if !salvageBlob(r.Id[1:], "", r.Key, nl) {
+			log.Printf("Queue is full ensuring policy repl count")
+			break
+		}
+		did++
+	}
+	if did > 0 {
+		log.Printf("Increased the replica count of %v policy items", did)
+	}
+	return nil
+}
+
+// Remove copies of blobs with a replica policy that have more than it
+// asks for.
+func prunePolicyReplicas() error {
+	nl, err := findAllNodes()
+	if err != nil {
+		return err
+	}
+
+	rows, err := queryReplicaPolicy(map[string]interface{}{
+		"endkey":       -1,
+		"include_docs": true,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rows {
+		pruneBlob(r.Id[1:], r.Doc.Json.Nodes, r.Doc.Json.Pinned, nl,
+			r.Doc.Json.Replicas)
+	}
+	return nil
+}
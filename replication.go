@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	cb "github.com/couchbaselabs/go-couchbase"
+)
+
+const (
+	replicationReportKey = "/@replicationReport"
+
+	// How many under-replicated blobs to keep as examples of each
+	// shortfall.
+	replicationSamples = 10
+)
+
+// Blobs short of their wanted copies by the same amount.
+type replicationBucket struct {
+	Missing int      `json:"missing"`
+	Blobs   int      `json:"blobs"`
+	Samples []string `json:"samples,omitempty"`
+}
+
+// Results of the last look for under-replicated blobs.
+type replicationReport struct {
+	UnderReplicated int                 `json:"underReplicated"`
+	Buckets         []replicationBucket `json:"buckets"`
+	Time            time.Time           `json:"time"`
+}
+
+func (r *replicationReport) add(missing, blobs int, samples []string) {
+	r.UnderReplicated += blobs
+	for i := range r.Buckets {
+		if r.Buckets[i].Missing == missing {
+			b := &r.Buckets[i]
+			b.Blobs += blobs
+			b.Samples = append(b.Samples, samples...)
+			if len(b.Samples) > replicationSamples {
+				b.Samples = b.Samples[:replicationSamples]
+			}
+			return
+		}
+	}
+	r.Buckets = append(r.Buckets, replicationBucket{missing, blobs, samples})
+	sort.Slice(r.Buckets, func(i, j int) bool {
+		return r.Buckets[i].Missing < r.Buckets[j].Missing
+	})
+}
+
+type replicationRow struct {
+	Id    string
+	Key   int
+	Value int
+}
+
+func queryReplication(view string, params map[string]interface{}) ([]replicationRow, error) {
+	viewRes := struct {
+		Rows   []replicationRow
+		Errors []cb.ViewError
+	}{}
+	params["stale"] = false
+	err := couchbase.ViewCustom("cbfs", view, params, &viewRes)
+	if err == nil && len(viewRes.Errors) > 0 {
+		err = fmt.Errorf("View errors: %v", viewRes.Errors)
+	}
+	return viewRes.Rows, err
+}
+
+// Some of the blobs with the given key in a view.
+func replicationSample(view string, key int) ([]string, error) {
+	rows, err := queryReplication(view, map[string]interface{}{
+		"reduce": false,
+		"key":    key,
+		"limit":  replicationSamples,
+	})
+	rv := []string{}
+	for _, r := range rows {
+		rv = append(rv, r.Id[1:])
+	}
+	return rv, err
+}
+
+// Count the blobs with fewer copies than they should have, by how
+// many they're missing.
+func buildReplicationReport() (replicationReport, error) {
+	report := replicationReport{
+		Buckets: []replicationBucket{},
+		Time:    time.Now().UTC(),
+	}
+
+	// Blobs going by the cluster's minimum are keyed by copies, and
+	// those with a policy by copies missing.
+	count := func(view string, params map[string]interface{},
+		missing func(key int) int) error {
+
+		params["group_level"] = 1
+		rows, err := queryReplication(view, params)
+		if err != nil {
+			return err
+		}
+		for _, r := range rows {
+			samples, err := replicationSample(view, r.Key)
+			if err != nil {
+				return err
+			}
+			report.add(missing(r.Key), r.Value, samples)
+		}
+		return nil
+	}
+
+	if globalConfig.MinReplicas > 1 {
+		err := count("repcounts", map[string]interface{}{
+			"startkey": 0,
+			"endkey":   globalConfig.MinReplicas - 1,
+		}, func(copies int) int { return globalConfig.MinReplicas - copies })
+		if err != nil {
+			return report, err
+		}
+	}
+	err := count("replica_policy", map[string]interface{}{"startkey": 1},
+		func(missing int) int { return missing })
+	return report, err
+}
+
+func updateReplicationReport() error {
+	report, err := buildReplicationReport()
+	if err != nil {
+		return err
+	}
+	return couchbase.Set(replicationReportKey, 0, report)
+}
+
+func getReplicationReport() (replicationReport, error) {
+	report := replicationReport{Buckets: []replicationBucket{}}
+	err := couchbase.Get(replicationReportKey, &report)
+	return report, err
+}
+
+func doReplicationStatus(w http.ResponseWriter, req *http.Request) {
+	report, err := getReplicationReport()
+	if err != nil {
+		log.Printf("Error getting replication report: %v", err)
+		http.Error(w, "No replication report yet", 404)
+		return
+	}
+	if ok, _ := strconv.ParseBool(req.FormValue("samples")); !ok {
+		for i := range report.Buckets {
+			report.Buckets[i].Samples = nil
+		}
+	}
+	sendJson(w, req, report)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestReplicationReportAdd(t *testing.T) {
+	r := replicationReport{}
+	samples := func(prefix string, n int) []string {
+		rv := []string{}
+		for i := 0; i < n; i++ {
+			rv = append(rv, fmt.Sprintf("%v%v", prefix, i))
+		}
+		return rv
+	}
+
+	r.add(2, 3, samples("a", 3))
+	r.add(1, 20, samples("b", replicationSamples))
+	r.add(2, 8, samples("c", 8))
+
+	if r.UnderReplicated != 31 {
+		t.Errorf("Expected 31 under-replicated, got %v", r.UnderReplicated)
+	}
+	if len(r.Buckets) != 2 {
+		t.Fatalf("Expected two buckets, got %+v", r.Buckets)
+	}
+	if b := r.Buckets[0]; b.Missing != 1 || b.Blobs != 20 {
+		t.Errorf("Expected 20 blobs missing 1 first, got %+v", b)
+	}
+	b := r.Buckets[1]
+	if b.Missing != 2 || b.Blobs != 11 {
+		t.Errorf("Expected 11 blobs missing 2, got %+v", b)
+	}
+	if len(b.Samples) != replicationSamples || b.Samples[3] != "c0" {
+		t.Errorf("Expected samples from both adds, capped, got %v", b.Samples)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Correlates a request with the log entries about it.  Passed along
+// on requests to other nodes and returned to clients.
+const requestIDHeader = "X-CBFS-Request-ID"
+
+// Set when logging JSON.
+var jsonLog *jsonLogWriter
+
+// Turns each log line into a JSON record.
+type jsonLogWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (j *jsonLogWriter) Write(p []byte) (int, error) {
+	err := j.writeRecord(map[string]interface{}{
+		"type": "log",
+		"msg":  strings.TrimRight(string(p), "\n"),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (j *jsonLogWriter) writeRecord(rec map[string]interface{}) error {
+	rec["ts"] = time.Now().UTC()
+	if serverId != "" {
+		rec["node"] = serverId
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, err = j.w.Write(data)
+	return err
+}
+
+// Use the caller's request ID if it sent one, otherwise make one up.
+// Either way, it's recorded on the request so anything that talks to
+// other nodes on its behalf can pass it along.
+func assignRequestID(w http.ResponseWriter, req *http.Request) string {
+	id := req.Header.Get(requestIDHeader)
+	if id == "" {
+		id, _ = newRandomID("", 8)
+		req.Header.Set(requestIDHeader, id)
+	}
+	w.Header().Set(requestIDHeader, id)
+	return id
+}
+
+func clientAddr(req *http.Request) string {
+	if fwd := req.Header.Get("X-Forwarded-For"); fwd != "" {
+		return strings.TrimSpace(strings.Split(fwd, ",")[0])
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func logRequest(req *http.Request, rec *statusRecorder, id string,
+	start time.Time) {
+
+	if jsonLog == nil {
+		return
+	}
+	jsonLog.writeRecord(map[string]interface{}{
+		"type":     "request",
+		"id":       id,
+		"client":   clientAddr(req),
+		"method":   req.Method,
+		"path":     req.URL.Path,
+		"status":   rec.status,
+		"bytes":    rec.bytes,
+		"duration": time.Since(start).Seconds(),
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAssignRequestID(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/x", nil)
+	w := httptest.NewRecorder()
+	id := assignRequestID(w, req)
+	if id == "" || w.Header().Get(requestIDHeader) != id ||
+		req.Header.Get(requestIDHeader) != id {
+		t.Errorf("Expected generated id %q everywhere, got %q/%q", id,
+			w.Header().Get(requestIDHeader), req.Header.Get(requestIDHeader))
+	}
+
+	req.Header.Set(requestIDHeader, "given")
+	w = httptest.NewRecorder()
+	if id := assignRequestID(w, req); id != "given" ||
+		w.Header().Get(requestIDHeader) != "given" {
+		t.Errorf("Expected given id to be kept, got %q", id)
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	tests := []struct {
+		remote, fwd, exp string
+	}{
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+		{"10.0.0.1:1234", "1.2.3.4, 10.0.0.9", "1.2.3.4"},
+		{"[::1]:80", "", "::1"},
+		{"weird", "", "weird"},
+	}
+	for _, test := range tests {
+		req := &http.Request{RemoteAddr: test.remote, Header: http.Header{}}
+		if test.fwd != "" {
+			req.Header.Set("X-Forwarded-For", test.fwd)
+		}
+		if got := clientAddr(req); got != test.exp {
+			t.Errorf("Expected %v for %v/%v, got %v",
+				test.exp, test.remote, test.fwd, got)
+		}
+	}
+}
+
+func TestJSONLogWriter(t *testing.T) {
+	b := &bytes.Buffer{}
+	j := &jsonLogWriter{w: b}
+	j.Write([]byte("hello world\n"))
+
+	rec := map[string]interface{}{}
+	if err := json.Unmarshal(b.Bytes(), &rec); err != nil {
+		t.Fatalf("Error decoding %q: %v", b.String(), err)
+	}
+	if rec["msg"] != "hello world" || rec["type"] != "log" {
+		t.Errorf("Unexpected record: %v", rec)
+	}
+}
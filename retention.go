@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// Locks a file until the given time, in any form X-CBFS-Expires
+// takes.  Relative times count from when the file is stored.
+const retainUntilHeader = "X-CBFS-Retain-Until"
+
+var errNoRetentionFile = errors.New("no such file")
+
+// Overwriting or deleting a file before its retention runs out, or
+// trying to shorten it.
+type retentionError struct {
+	path  string
+	until time.Time
+}
+
+func (r retentionError) Error() string {
+	return fmt.Sprintf("%v is locked until %v", r.path,
+		r.until.Format(time.RFC3339))
+}
+
+func httpRetentionError(w http.ResponseWriter, fn string, err error) bool {
+	re, ok := err.(retentionError)
+	if ok {
+		log.Printf("Refusing to change %v: %v", fn, re)
+		http.Error(w, re.Error(), 403)
+	}
+	return ok
+}
+
+func (fm fileMeta) retained(now time.Time) bool {
+	return fm.RetainUntil.After(now)
+}
+
+// Refuse to overwrite or delete a file that's still locked.
+func checkRetention(path string, fm fileMeta, now time.Time) error {
+	if fm.retained(now) {
+		return retentionError{path, fm.RetainUntil}
+	}
+	return nil
+}
+
+// When a file being stored at path is locked until: the later of
+// what its upload asked for and the retention configured for path.
+// The requested time was checked when the upload began.
+func retainUntil(path string, fm fileMeta) time.Time {
+	rv, _ := parseExpires(fm.Headers.Get(retainUntilHeader), fm.Modified)
+	if d := globalConfig.RetentionFor(path); d > 0 {
+		if t := fm.Modified.Add(d).UTC(); t.After(rv) {
+			rv = t
+		}
+	}
+	return rv
+}
+
+// Lock a file until at least the given time.  A lock can only be
+// extended.
+func extendRetention(path string, until time.Time) (fileMeta, error) {
+	fm := fileMeta{}
+	err := couchbase.Update(shortName(path), 0, func(in []byte) ([]byte, error) {
+		fm = fileMeta{}
+		if in == nil {
+			return nil, errNoRetentionFile
+		}
+		if err := json.Unmarshal(in, &fm); err != nil {
+			return in, err
+		}
+		if fm.Type != "file" {
+			return in, errNoRetentionFile
+		}
+		if until.Before(fm.RetainUntil) {
+			return in, retentionError{path, fm.RetainUntil}
+		}
+		fm.RetainUntil = until
+		return json.Marshal(fm)
+	})
+	if gomemcached.IsNotFound(err) {
+		err = errNoRetentionFile
+	}
+	return fm, err
+}
+
+func sendRetention(w http.ResponseWriter, req *http.Request, path string,
+	fm fileMeta) {
+
+	rv := map[string]interface{}{
+		"path":   path,
+		"locked": fm.retained(time.Now()),
+		"policy": globalConfig.RetentionFor(path).String(),
+	}
+	if !fm.RetainUntil.IsZero() {
+		rv["retainUntil"] = fm.RetainUntil
+	}
+	sendJson(w, req, rv)
+}
+
+// GET /.cbfs/retention/<path> tells how long a file is locked.
+func doGetRetention(w http.ResponseWriter, req *http.Request, path string) {
+	path = strings.TrimLeft(path, "/")
+	fm := fileMeta{}
+	err := couchbase.Get(shortName(path), &fm)
+	if err == nil && fm.Type != "file" {
+		err = errNoRetentionFile
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	sendRetention(w, req, path, fm)
+}
+
+// POST /.cbfs/retention/<path>?until=... locks a file until then.
+// Asking for less than it's already locked for is refused with 403.
+func doSetRetention(w http.ResponseWriter, req *http.Request, path string) {
+	path = strings.TrimLeft(path, "/")
+	until, err := parseExpires(req.FormValue("until"), time.Now())
+	if err == nil && until.IsZero() {
+		err = errors.New("missing until")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	fm, err := extendRetention(path, until)
+	if httpRetentionError(w, path, err) {
+		return
+	}
+	switch err {
+	case nil:
+	case errNoRetentionFile:
+		http.Error(w, err.Error(), 404)
+		return
+	default:
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	log.Printf("Locked %v until %v", path, until.Format(time.RFC3339))
+	sendRetention(w, req, path, fm)
+}
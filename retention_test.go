@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/config"
+)
+
+func TestRetainUntil(t *testing.T) {
+	defer func(r map[string]cbfsconfig.Retention) {
+		globalConfig.PathRetention = r
+	}(globalConfig.PathRetention)
+	globalConfig.PathRetention = map[string]cbfsconfig.Retention{
+		"records": cbfsconfig.Retention(48 * time.Hour),
+	}
+
+	now := time.Date(2013, 6, 1, 0, 0, 0, 0, time.UTC)
+	hdr := func(v string) http.Header {
+		h := http.Header{}
+		h.Set(retainUntilHeader, v)
+		return h
+	}
+
+	tests := []struct {
+		path string
+		h    http.Header
+		exp  time.Time
+	}{
+		{"other", nil, time.Time{}},
+		{"other", hdr("3600"), now.Add(time.Hour)},
+		{"other", hdr("2013-07-01T00:00:00Z"),
+			time.Date(2013, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{"records/a", nil, now.Add(48 * time.Hour)},
+		// The policy is a minimum.
+		{"records/a", hdr("3600"), now.Add(48 * time.Hour)},
+		{"records/a", hdr("2013-07-01T00:00:00Z"),
+			time.Date(2013, 7, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		got := retainUntil(test.path, fileMeta{Headers: test.h, Modified: now})
+		if !got.Equal(test.exp) {
+			t.Errorf("Expected %v for %v %v, got %v",
+				test.exp, test.path, test.h, got)
+		}
+	}
+}
+
+func TestCheckRetention(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		until  time.Time
+		locked bool
+	}{
+		{time.Time{}, false},
+		{now.Add(-time.Second), false},
+		{now, false},
+		{now.Add(time.Second), true},
+	}
+
+	for _, test := range tests {
+		err := checkRetention("a", fileMeta{RetainUntil: test.until}, now)
+		if _, ok := err.(retentionError); ok != test.locked {
+			t.Errorf("Expected locked=%v until %v, got %v",
+				test.locked, test.until, err)
+		}
+	}
+}
+
+func TestRetainedFilesDontExpire(t *testing.T) {
+	now := time.Now()
+	fm := fileMeta{
+		Expires:     now.Add(-time.Hour),
+		RetainUntil: now.Add(time.Hour),
+	}
+	if fm.expired(now) {
+		t.Errorf("Expected a locked file not to expire")
+	}
+	if !fm.expired(now.Add(2 * time.Hour)) {
+		t.Errorf("Expected the file to expire once unlocked")
+	}
+}
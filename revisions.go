@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// One stored version of a file.
+type fileRevision struct {
+	Revno    int         `json:"revno"`
+	OID      string      `json:"oid"`
+	Length   int64       `json:"length"`
+	Modified time.Time   `json:"modified"`
+	Headers  http.Header `json:"headers"`
+	Parts    []blobPart  `json:"parts,omitempty"`
+	Current  bool        `json:"current,omitempty"`
+}
+
+type revisionsByRevno []fileRevision
+
+func (r revisionsByRevno) Len() int           { return len(r) }
+func (r revisionsByRevno) Less(i, j int) bool { return r[i].Revno > r[j].Revno }
+func (r revisionsByRevno) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// All the versions of a file that are still held, newest first.
+func (fm fileMeta) revisions() []fileRevision {
+	rv := []fileRevision{{
+		Revno:    fm.Revno,
+		OID:      fm.OID,
+		Length:   fm.Length,
+		Modified: fm.Modified,
+		Headers:  storedHeaders(fm.Headers),
+		Parts:    fm.Parts,
+		Current:  true,
+	}}
+	for _, p := range fm.Previous {
+		rv = append(rv, fileRevision{
+			Revno:    p.Revno,
+			OID:      p.OID,
+			Length:   p.Length,
+			Modified: p.Modified,
+			Headers:  storedHeaders(p.Headers),
+			Parts:    p.Parts,
+		})
+	}
+	sort.Sort(revisionsByRevno(rv))
+	return rv
+}
+
+func findRevision(fm fileMeta, revno int) (fileRevision, bool) {
+	for _, r := range fm.revisions() {
+		if r.Revno == revno {
+			return r, true
+		}
+	}
+	return fileRevision{}, false
+}
+
+func getFileMeta(w http.ResponseWriter, path string) (fileMeta, bool) {
+	fm := fileMeta{}
+	err := couchbase.Get(shortName(path), &fm)
+	switch {
+	case err == nil && fm.Type == "file":
+		return fm, true
+	case err == nil, gomemcached.IsNotFound(err):
+		http.Error(w, "not found", 404)
+	default:
+		http.Error(w, err.Error(), 500)
+	}
+	return fm, false
+}
+
+func doListRevisions(w http.ResponseWriter, req *http.Request, path string) {
+	fm, ok := getFileMeta(w, path)
+	if !ok {
+		return
+	}
+	sendJson(w, req, map[string]interface{}{
+		"path":      path,
+		"revisions": fm.revisions(),
+	})
+}
+
+// Make an older revision current again.  The version being replaced
+// is kept in the history like any other overwrite.
+func doRevertFile(w http.ResponseWriter, req *http.Request, path string) {
+	revno, err := strconv.Atoi(req.FormValue("rev"))
+	if err != nil {
+		http.Error(w, "Invalid revno", 400)
+		return
+	}
+
+	fm, ok := getFileMeta(w, path)
+	if !ok {
+		return
+	}
+
+	rev, ok := findRevision(fm, revno)
+	switch {
+	case !ok:
+		http.Error(w,
+			fmt.Sprintf("Don't have this file with rev %v", revno), 410)
+		return
+	case rev.Current:
+		w.Header().Set("Etag", fileETag(rev.OID))
+		w.WriteHeader(204)
+		return
+	}
+
+	// Reverting shouldn't cost any history unless asked.
+	revs := len(fm.Previous) + 1
+	if i, err := strconv.Atoi(req.Header.Get("X-CBFS-KeepRevs")); err == nil {
+		revs = i
+	}
+
+	nfm := fileMeta{
+		Headers:  rev.Headers,
+		OID:      rev.OID,
+		Length:   rev.Length,
+		Modified: time.Now().UTC(),
+		Parts:    rev.Parts,
+	}
+	err = storeMeta(path, 0, nfm, revs, req.Header)
+	if httpQuotaError(w, path, err) || httpRetentionError(w, path, err) {
+		return
+	}
+	switch err {
+	case nil:
+	case errUploadPrecondition:
+		http.Error(w, "precondition failed", 412)
+		return
+	default:
+		log.Printf("Error reverting %v to rev %v: %v", path, revno, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	log.Printf("Reverted %v to rev %v (%v)", path, revno, rev.OID)
+	w.Header().Set("Etag", fileETag(rev.OID))
+	w.WriteHeader(201)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+func TestFileRevisions(t *testing.T) {
+	fm := fileMeta{
+		OID:   "c",
+		Revno: 5,
+		Previous: []prevMeta{
+			{OID: "a", Revno: 2},
+			{OID: "b", Revno: 4},
+		},
+	}
+
+	revs := fm.revisions()
+	exp := []struct {
+		revno   int
+		oid     string
+		current bool
+	}{
+		{5, "c", true},
+		{4, "b", false},
+		{2, "a", false},
+	}
+	if len(revs) != len(exp) {
+		t.Fatalf("Expected %v revisions, got %v", len(exp), revs)
+	}
+	for i, e := range exp {
+		r := revs[i]
+		if r.Revno != e.revno || r.OID != e.oid || r.Current != e.current {
+			t.Errorf("Expected %+v at %v, got %+v", e, i, r)
+		}
+	}
+
+	if r, ok := findRevision(fm, 4); !ok || r.OID != "b" {
+		t.Errorf("Expected to find rev 4 as b, got %+v/%v", r, ok)
+	}
+	if r, ok := findRevision(fm, 3); ok {
+		t.Errorf("Expected not to find rev 3, got %+v", r)
+	}
+}
+
+func TestRevisionsDropCredentials(t *testing.T) {
+	req, err := http.NewRequest("PUT", "http://localhost/a", nil)
+	if err != nil {
+		t.Fatalf("Error making request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer sekrit")
+	req.Header.Set("X-CBFS-Node-Auth", "nodesekrit")
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("X-CBFS-Meta-Color", "blue")
+	req.Header.Set("X-CBFS-KeepRevs", "2")
+
+	fm := fileMeta{Headers: storedHeaders(req.Header), OID: "b", Revno: 2,
+		// As stored before credentials were dropped
+		Previous: []prevMeta{{Headers: req.Header, OID: "a", Revno: 1}}}
+
+	for _, b := range [][]byte{mustEncode(fm.revisions()), mustEncode(fm)} {
+		if bytes.Contains(b, []byte("sekrit")) {
+			t.Errorf("Credentials in %s", b)
+		}
+		for _, want := range []string{"text/plain", "blue", "X-Cbfs-Keeprevs"} {
+			if !bytes.Contains(b, []byte(want)) {
+				t.Errorf("Expected %v in %s", want, b)
+			}
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/sigv4"
+	"github.com/dustin/httputil"
+)
+
+// Every part of a multipart upload but the last must be at least this
+// big.
+const s3MinPartSize = 5 * 1024 * 1024
+
+// An S3 bucket, with credentials from the usual AWS_* environment
+// variables.  Without them, requests are anonymous.
+type s3Bucket struct {
+	name, region string
+	creds        sigv4.Credentials
+	// Host the bucket is a subdomain of, if not AWS's
+	endpoint string
+}
+
+func newS3Bucket(name string) s3Bucket {
+	return s3Bucket{
+		name:   name,
+		region: sigv4.EnvRegion(),
+		creds:  sigv4.EnvCredentials(),
+	}
+}
+
+// A bucket in Google Cloud Storage, through its S3 compatible API.
+// The credentials are an HMAC key.
+func newGCSBucket(name string) s3Bucket {
+	b := newS3Bucket(name)
+	b.region = "auto"
+	b.endpoint = "storage.googleapis.com"
+	return b
+}
+
+func (b s3Bucket) host() string {
+	if b.endpoint != "" {
+		return b.name + "." + b.endpoint
+	}
+	return fmt.Sprintf("%s.s3.%s.amazonaws.com", b.name, b.region)
+}
+
+// Build a signed request for the given object key.  payloadHash is
+// the hex SHA256 of body.
+func (b s3Bucket) request(method, key string, query url.Values,
+	body io.Reader, payloadHash string) (*http.Request, error) {
+
+	u := "https://" + b.host() + "/" + sigv4.URIEscape(key, true)
+	if q := sigv4.CanonicalQuery(query); q != "" {
+		u += "?" + q
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil || !b.creds.Valid() {
+		return req, err
+	}
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	sigv4.Sign(req, b.creds, b.region, "s3", payloadHash, time.Now())
+	return req, nil
+}
+
+func (b s3Bucket) do(req *http.Request, expect int) (*http.Response, error) {
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != expect {
+		defer res.Body.Close()
+		return nil, httputil.HTTPErrorf(res, "S3 error on %v - %S\n%B",
+			req.URL.Path)
+	}
+	return res, nil
+}
+
+// Fetch an object.
+func (b s3Bucket) get(key string) (io.ReadCloser, error) {
+	req, err := b.request("GET", key, nil, nil, sigv4.EmptySHA256)
+	if err != nil {
+		return nil, err
+	}
+	res, err := b.do(req, 200)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (b s3Bucket) remove(key string) error {
+	req, err := b.request("DELETE", key, nil, nil, sigv4.EmptySHA256)
+	if err != nil {
+		return err
+	}
+	res, err := b.do(req, 204)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// List the keys under prefix.
+func (b s3Bucket) list(prefix string) ([]string, error) {
+	rv := []string{}
+	q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		req, err := b.request("GET", "", q, nil, sigv4.EmptySHA256)
+		if err != nil {
+			return nil, err
+		}
+		res, err := b.do(req, 200)
+		if err != nil {
+			return nil, err
+		}
+		lres := struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}{}
+		err = xml.NewDecoder(res.Body).Decode(&lres)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range lres.Contents {
+			rv = append(rv, c.Key)
+		}
+		if !lres.IsTruncated {
+			return rv, nil
+		}
+		q.Set("continuation-token", lres.NextContinuationToken)
+	}
+}
+
+// An object of unknown length being uploaded in parts, each held in
+// memory until it's sent.
+type s3Upload struct {
+	b        s3Bucket
+	key, id  string
+	partSize int
+	buf      []byte
+	etags    []string
+}
+
+// Start a multipart upload of the given key.
+func (b s3Bucket) startUpload(key string, partSize int) (*s3Upload, error) {
+	if partSize < s3MinPartSize {
+		partSize = s3MinPartSize
+	}
+	req, err := b.request("POST", key, url.Values{"uploads": {""}}, nil,
+		sigv4.EmptySHA256)
+	if err != nil {
+		return nil, err
+	}
+	res, err := b.do(req, 200)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	ires := struct {
+		UploadId string
+	}{}
+	if err := xml.NewDecoder(res.Body).Decode(&ires); err != nil {
+		return nil, err
+	}
+	return &s3Upload{
+		b:        b,
+		key:      key,
+		id:       ires.UploadId,
+		partSize: partSize,
+		buf:      make([]byte, 0, partSize),
+	}, nil
+}
+
+func (u *s3Upload) sendPart() error {
+	h := sha256.Sum256(u.buf)
+	q := url.Values{
+		"partNumber": {strconv.Itoa(len(u.etags) + 1)},
+		"uploadId":   {u.id},
+	}
+	req, err := u.b.request("PUT", u.key, q, bytes.NewReader(u.buf),
+		hex.EncodeToString(h[:]))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(len(u.buf))
+	res, err := u.b.do(req, 200)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	u.etags = append(u.etags, res.Header.Get("ETag"))
+	u.buf = u.buf[:0]
+	return nil
+}
+
+func (u *s3Upload) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(u.buf) == u.partSize {
+			if err := u.sendPart(); err != nil {
+				return written, err
+			}
+		}
+		n := copy(u.buf[len(u.buf):u.partSize], p)
+		u.buf = u.buf[:len(u.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Send the last part and put the object together from the parts.
+func (u *s3Upload) Close() error {
+	if len(u.buf) > 0 || len(u.etags) == 0 {
+		if err := u.sendPart(); err != nil {
+			return err
+		}
+	}
+
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	creq := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{}
+	for i, etag := range u.etags {
+		creq.Parts = append(creq.Parts, part{i + 1, etag})
+	}
+	body, err := xml.Marshal(creq)
+	if err != nil {
+		return err
+	}
+	h := sha256.Sum256(body)
+	req, err := u.b.request("POST", u.key, url.Values{"uploadId": {u.id}},
+		bytes.NewReader(body), hex.EncodeToString(h[:]))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(len(body))
+	res, err := u.b.do(req, 200)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// Failures that happen after the response has started come back
+	// as a 200 with an error document.
+	cres := struct {
+		XMLName xml.Name
+		Message string
+	}{}
+	if err := xml.NewDecoder(res.Body).Decode(&cres); err != nil {
+		return err
+	}
+	if cres.XMLName.Local == "Error" {
+		return errors.New("S3 error completing upload of " + u.key +
+			": " + cres.Message)
+	}
+	return nil
+}
+
+// Give up on an upload, dropping the parts sent so far.
+func (u *s3Upload) abort() error {
+	req, err := u.b.request("DELETE", u.key, url.Values{"uploadId": {u.id}},
+		nil, sigv4.EmptySHA256)
+	if err != nil {
+		return err
+	}
+	res, err := u.b.do(req, 204)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
@@ -0,0 +1,895 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+	"github.com/couchbaselabs/cbfs/sigv4"
+	cb "github.com/couchbaselabs/go-couchbase"
+)
+
+var s3Bind = flag.String("s3bind", "",
+	"Address to serve the S3 compatible API on (empty to disable)")
+
+const (
+	s3Xmlns      = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3TimeFormat = "2006-01-02T15:04:05.000Z"
+	s3MaxKeys    = 1000
+)
+
+// Serve a subset of the S3 API with buckets mapped to top level
+// directories.  Only path style requests are understood.  Requests
+// signed with AWS Signature Version 4 act as the user whose name is
+// the access key, if the signature is made with their S3 secret;
+// others are authenticated the same way as the regular API.
+func serveS3() {
+	if *s3Bind == "" {
+		return
+	}
+
+	s := &http.Server{
+		Addr:        *s3Bind,
+		Handler:     http2Handler(instrumentHandler(doS3)),
+		ReadTimeout: *readTimeout,
+	}
+	log.Printf("Listening to S3 requests on %s", *s3Bind)
+
+	l, err := rateListen("tcp", *s3Bind)
+	if err != nil {
+		log.Fatalf("Error listening for S3 requests: %v", err)
+	}
+	serveUntilShutdown(s, maybeTLSListener(l))
+}
+
+type s3Error struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string
+	Message   string
+	Resource  string
+	RequestId string
+}
+
+func s3ErrorCode(status int, notFound string) string {
+	switch status {
+	case 400:
+		return "InvalidArgument"
+	case 401, 403:
+		return "AccessDenied"
+	case 404:
+		return notFound
+	case 409:
+		return "Conflict"
+	case 412:
+		return "PreconditionFailed"
+	case 416:
+		return "InvalidRange"
+	case 501:
+		return "NotImplemented"
+	case 503:
+		return "SlowDown"
+	}
+	return "InternalError"
+}
+
+func sendS3XML(w http.ResponseWriter, code int, ob interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(code)
+	io.WriteString(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(ob); err != nil {
+		log.Printf("Error encoding XML output: %v", err)
+	}
+}
+
+// Passes successful responses from the regular handlers through, and
+// turns errors into S3 error documents.
+type s3ResponseWriter struct {
+	http.ResponseWriter
+	resource string
+	// S3 error code for a 404
+	notFound string
+	// Report a 404 as success, since S3 deletes are idempotent
+	missingOK bool
+
+	status int
+	code   string
+	msg    bytes.Buffer
+}
+
+func (s *s3ResponseWriter) WriteHeader(code int) {
+	switch {
+	case code == 404 && s.missingOK:
+		code = 204
+	case code == 201:
+		code = 200
+	case code >= 400:
+		s.status = code
+		return
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *s3ResponseWriter) Write(b []byte) (int, error) {
+	if s.status != 0 {
+		return s.msg.Write(b)
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *s3ResponseWriter) fail(status int, code, msg string) {
+	s.status, s.code = status, code
+	s.msg.Reset()
+	s.msg.WriteString(msg)
+}
+
+// Send the S3 form of any error response.
+func (s *s3ResponseWriter) finish() {
+	if s.status == 0 {
+		return
+	}
+	code := s.code
+	if code == "" {
+		code = s3ErrorCode(s.status, s.notFound)
+	}
+	sendS3XML(s.ResponseWriter, s.status, s3Error{
+		Code:      code,
+		Message:   strings.TrimSpace(s.msg.String()),
+		Resource:  s.resource,
+		RequestId: s.Header().Get(requestIDHeader),
+	})
+}
+
+// Undoes the aws-chunked encoding SDKs use for streaming uploads.
+// Chunk signatures and trailers are ignored.
+type awsChunkedReader struct {
+	r    *bufio.Reader
+	left int64
+	done bool
+}
+
+func (a *awsChunkedReader) Read(p []byte) (int, error) {
+	for a.left == 0 {
+		if a.done {
+			return 0, io.EOF
+		}
+		line, err := a.r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			// The end of the previous chunk.
+			continue
+		}
+		size := line
+		if i := strings.IndexByte(line, ';'); i >= 0 {
+			size = line[:i]
+		}
+		n, err := strconv.ParseInt(size, 16, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid aws-chunked header: %q", line)
+		}
+		if n == 0 {
+			a.done = true
+			return 0, io.EOF
+		}
+		a.left = n
+	}
+
+	if int64(len(p)) > a.left {
+		p = p[:a.left]
+	}
+	n, err := a.r.Read(p)
+	a.left -= int64(n)
+	if err == io.EOF && a.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func splitS3Path(p string) (bucket, key string) {
+	p = strings.TrimLeft(p, "/")
+	if i := strings.IndexByte(p, '/'); i >= 0 {
+		return p[:i], p[i+1:]
+	}
+	return p, ""
+}
+
+// A copy of req addressed to the regular API.  S3 never compresses,
+// so neither may the handlers this is passed to.
+func s3Request(req *http.Request, method, path string) *http.Request {
+	r := *req
+	u := *req.URL
+	u.Path = path
+	u.RawQuery = ""
+	r.URL = &u
+	r.Method = method
+	r.Form = nil
+	r.Header = http.Header{}
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Del("Accept-Encoding")
+	return &r
+}
+
+type s3UserKey struct{}
+
+// Check an AWS signature made with a user's name as the access key
+// and their S3 secret as the secret key.  Returns the request to go
+// on with, which carries the user for s3Authorized, or fails it and
+// returns false.  Unsigned requests go on as they are.
+func s3Authenticate(w *s3ResponseWriter, req *http.Request) (*http.Request, bool) {
+	users := globalConfig.Users
+	name, err := sigv4.Verify(req, func(name string) (string, bool) {
+		u := users[name]
+		return u.S3Secret, u.S3Secret != ""
+	}, time.Now())
+	switch err {
+	case nil:
+	case sigv4.ErrNotSigned:
+		return req, true
+	case sigv4.ErrMalformed:
+		w.fail(400, "AuthorizationHeaderMalformed", err.Error())
+		return nil, false
+	case sigv4.ErrUnknownKey:
+		w.fail(403, "InvalidAccessKeyId", err.Error())
+		return nil, false
+	case sigv4.ErrSkewed:
+		w.fail(403, "RequestTimeTooSkewed", err.Error())
+		return nil, false
+	default:
+		w.fail(403, "SignatureDoesNotMatch", err.Error())
+		return nil, false
+	}
+
+	req.Header.Del("Authorization")
+	req.Body = sigv4.CheckPayload(req.Body,
+		req.Header.Get("X-Amz-Content-Sha256"))
+	return req.WithContext(context.WithValue(req.Context(),
+		s3UserKey{}, name)), true
+}
+
+// Authenticate and authorize a translated request the way the
+// regular API would, or as the user that signed it.
+func s3Authorized(w http.ResponseWriter, r *http.Request) bool {
+	if name, ok := r.Context().Value(s3UserKey{}).(string); ok {
+		return authorize(w, r, name, globalConfig.Users[name])
+	}
+	return checkAuth(w, r)
+}
+
+// Authorize a translated request, and make sure it can be stored.
+func s3Allowed(w http.ResponseWriter, r *http.Request) bool {
+	if !s3Authorized(w, r) {
+		return false
+	}
+	if why := blobRefusal(); why != "" && storesBlob(r) {
+		http.Error(w, why, 503)
+		return false
+	}
+	return true
+}
+
+func doS3(w http.ResponseWriter, req *http.Request) {
+	sw := &s3ResponseWriter{
+		ResponseWriter: w,
+		resource:       req.URL.Path,
+		notFound:       "NoSuchKey",
+	}
+	defer sw.finish()
+
+	req, ok := s3Authenticate(sw, req)
+	if !ok {
+		return
+	}
+
+	if strings.HasPrefix(req.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{&awsChunkedReader{r: bufio.NewReader(req.Body)}, req.Body}
+		req.ContentLength = -1
+		req.Header.Del("Content-Length")
+		dl := req.Header.Get("X-Amz-Decoded-Content-Length")
+		if n, err := strconv.ParseInt(dl, 10, 64); err == nil {
+			req.ContentLength = n
+			req.Header.Set("Content-Length", dl)
+		}
+	}
+
+	bucket, key := splitS3Path(req.URL.Path)
+	q := req.URL.Query()
+	switch {
+	case bucket == "":
+		doS3Service(sw, req)
+	case key == "":
+		doS3Bucket(sw, req, bucket, q)
+	default:
+		doS3Object(sw, req, bucket, key, q)
+	}
+}
+
+type s3BucketEntry struct {
+	Name         string
+	CreationDate string
+}
+
+func doS3Service(w *s3ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.fail(405, "MethodNotAllowed", "")
+		return
+	}
+	if !s3Allowed(w, s3Request(req, "GET", "/")) {
+		return
+	}
+
+	fl, err := listFiles("", false, 1)
+	if err != nil {
+		w.fail(500, "", err.Error())
+		return
+	}
+	names := []string{}
+	for d := range fl.Dirs {
+		names = append(names, d)
+	}
+	sort.Strings(names)
+
+	res := struct {
+		XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Owner   struct {
+			ID          string
+			DisplayName string
+		}
+		Buckets []s3BucketEntry `xml:"Buckets>Bucket"`
+	}{Xmlns: s3Xmlns}
+	res.Owner.ID, res.Owner.DisplayName = "cbfs", "cbfs"
+	for _, n := range names {
+		res.Buckets = append(res.Buckets,
+			s3BucketEntry{n, time.Time{}.Format(s3TimeFormat)})
+	}
+	sendS3XML(w, 200, res)
+}
+
+// Buckets exist as long as something's in them, so creating one is
+// a no-op and any bucket may be used.
+func doS3Bucket(w *s3ResponseWriter, req *http.Request, bucket string,
+	q url.Values) {
+
+	w.notFound = "NoSuchBucket"
+	path := "/" + bucket + "/"
+	switch {
+	case req.Method == "GET" && q["location"] != nil:
+		if s3Allowed(w, s3Request(req, "GET", path)) {
+			sendS3XML(w, 200, struct {
+				XMLName xml.Name `xml:"LocationConstraint"`
+				Xmlns   string   `xml:"xmlns,attr"`
+			}{Xmlns: s3Xmlns})
+		}
+	case req.Method == "GET":
+		if s3Allowed(w, s3Request(req, "GET", path+q.Get("prefix"))) {
+			s3ListObjects(w, bucket, q)
+		}
+	case req.Method == "HEAD", req.Method == "PUT":
+		if s3Allowed(w, s3Request(req, req.Method, path)) {
+			w.WriteHeader(200)
+		}
+	case req.Method == "DELETE":
+		if !s3Allowed(w, s3Request(req, "DELETE", path)) {
+			return
+		}
+		fl, err := listFiles(bucket, false, 1)
+		switch {
+		case err != nil:
+			w.fail(500, "", err.Error())
+		case len(fl.Files) > 0 || len(fl.Dirs) > 0:
+			w.fail(409, "BucketNotEmpty", "The bucket is not empty")
+		default:
+			w.WriteHeader(204)
+		}
+	case req.Method == "POST" && q["delete"] != nil:
+		s3DeleteObjects(w, req, bucket)
+	default:
+		w.fail(501, "", "Unsupported bucket operation")
+	}
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type s3Prefix struct {
+	Prefix string
+}
+
+type s3Listing struct {
+	Contents       []s3Object
+	CommonPrefixes []s3Prefix
+	Truncated      bool
+	// The last key or prefix returned
+	Last string
+}
+
+func (l *s3Listing) count() int {
+	return len(l.Contents) + len(l.CommonPrefixes)
+}
+
+// View keys covering the paths beginning with p.
+func s3KeyRange(p string) (start, end []interface{}) {
+	parts := strings.Split(p, "/")
+	last := parts[len(parts)-1]
+	for _, s := range parts[:len(parts)-1] {
+		start = append(start, s)
+		end = append(end, s)
+	}
+	if last == "" {
+		end = append(end, map[string]interface{}{})
+	} else {
+		start = append(start, last)
+		end = append(end, last+"\ufff0")
+	}
+	return start, end
+}
+
+// The view key following everything under the directory d.
+func s3SkipKey(d string) []interface{} {
+	rv := []interface{}{}
+	for _, s := range strings.Split(strings.TrimSuffix(d, "/"), "/") {
+		rv = append(rv, s)
+	}
+	return append(rv, map[string]interface{}{})
+}
+
+// List up to max files in bucket beginning with prefix, after the
+// key (or common prefix) after.  With a delimiter, files below it
+// are rolled up into common prefixes.
+func s3List(bucket, prefix, delim, after string, max int) (s3Listing, error) {
+	rv := s3Listing{}
+	start, end := s3KeyRange(bucket + "/" + prefix)
+	skip := 0
+	switch {
+	case after == "" || after < prefix:
+	case !strings.HasPrefix(after, prefix):
+		return rv, nil
+	case strings.HasSuffix(after, "/"):
+		start = s3SkipKey(bucket + "/" + after)
+	default:
+		start, _ = s3KeyRange(bucket + "/" + after)
+		skip = 1
+	}
+
+	for {
+		viewRes := struct {
+			Rows []struct {
+				Key []string
+				Id  string
+			}
+			Errors []cb.ViewError
+		}{}
+		err := couchbase.ViewCustom("cbfs", "file_browse",
+			map[string]interface{}{
+				"reduce":   false,
+				"stale":    false,
+				"startkey": start,
+				"endkey":   end,
+				"skip":     skip,
+				"limit":    max + 1,
+			}, &viewRes)
+		if err == nil && len(viewRes.Errors) > 0 {
+			err = fmt.Errorf("View errors: %v", viewRes.Errors)
+		}
+		if err != nil {
+			return rv, err
+		}
+
+		ids := []string{}
+		for _, r := range viewRes.Rows {
+			ids = append(ids, r.Id)
+		}
+		metas, err := couchbase.GetBulk(ids)
+		if err != nil {
+			return rv, err
+		}
+
+		restarted := false
+		for _, r := range viewRes.Rows {
+			key := strings.Join(r.Key, "/")[len(bucket)+1:]
+			if !strings.HasPrefix(key, prefix) || key == after {
+				continue
+			}
+			if rv.count() == max {
+				rv.Truncated = true
+				return rv, nil
+			}
+
+			if i := strings.Index(key[len(prefix):], delim); delim != "" && i >= 0 {
+				cp := key[:len(prefix)+i+len(delim)]
+				rv.CommonPrefixes = append(rv.CommonPrefixes, s3Prefix{cp})
+				rv.Last = cp
+				start, skip = s3SkipKey(bucket+"/"+cp), 0
+				restarted = true
+				break
+			}
+
+			fm := fileMeta{}
+			if res, ok := metas[r.Id]; ok {
+				if err := json.Unmarshal(res.Body, &fm); err != nil {
+					log.Printf("Error decoding metadata of %v: %v", key, err)
+				}
+			}
+			rv.Contents = append(rv.Contents, s3Object{
+				Key:          key,
+				LastModified: fm.Modified.UTC().Format(s3TimeFormat),
+				ETag:         fileETag(fm.OID),
+				Size:         fm.Length,
+				StorageClass: "STANDARD",
+			})
+			rv.Last = key
+		}
+
+		switch {
+		case restarted:
+		case len(viewRes.Rows) <= max:
+			return rv, nil
+		default:
+			last := viewRes.Rows[len(viewRes.Rows)-1].Key
+			start = []interface{}{}
+			for _, s := range last {
+				start = append(start, s)
+			}
+			skip = 1
+		}
+	}
+}
+
+// ListObjects and ListObjectsV2.
+func s3ListObjects(w *s3ResponseWriter, bucket string, q url.Values) {
+	max := s3MaxKeys
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			w.fail(400, "", "Invalid max-keys: "+v)
+			return
+		}
+		if n < max {
+			max = n
+		}
+	}
+
+	delim := q.Get("delimiter")
+	if delim != "" && delim != "/" {
+		w.fail(501, "", "Only / is supported as a delimiter")
+		return
+	}
+
+	v2 := q.Get("list-type") == "2"
+	after := q.Get("marker")
+	if v2 {
+		after = q.Get("start-after")
+		if t := q.Get("continuation-token"); t != "" {
+			b, err := base64.URLEncoding.DecodeString(t)
+			if err != nil {
+				w.fail(400, "", "Invalid continuation token")
+				return
+			}
+			after = string(b)
+		}
+	}
+
+	l := s3Listing{}
+	if max > 0 {
+		var err error
+		l, err = s3List(bucket, q.Get("prefix"), delim, after, max)
+		if err != nil {
+			w.fail(500, "", err.Error())
+			return
+		}
+	}
+
+	res := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Xmlns                 string   `xml:"xmlns,attr"`
+		Name                  string
+		Prefix                string
+		Delimiter             string `xml:",omitempty"`
+		MaxKeys               int
+		IsTruncated           bool
+		Marker                string `xml:",omitempty"`
+		NextMarker            string `xml:",omitempty"`
+		KeyCount              *int   `xml:",omitempty"`
+		StartAfter            string `xml:",omitempty"`
+		ContinuationToken     string `xml:",omitempty"`
+		NextContinuationToken string `xml:",omitempty"`
+		Contents              []s3Object
+		CommonPrefixes        []s3Prefix
+	}{
+		Xmlns:          s3Xmlns,
+		Name:           bucket,
+		Prefix:         q.Get("prefix"),
+		Delimiter:      delim,
+		MaxKeys:        max,
+		IsTruncated:    l.Truncated,
+		Contents:       l.Contents,
+		CommonPrefixes: l.CommonPrefixes,
+	}
+	if v2 {
+		n := l.count()
+		res.KeyCount = &n
+		res.StartAfter = q.Get("start-after")
+		res.ContinuationToken = q.Get("continuation-token")
+		if l.Truncated {
+			res.NextContinuationToken =
+				base64.URLEncoding.EncodeToString([]byte(l.Last))
+		}
+	} else {
+		res.Marker = after
+		if l.Truncated {
+			res.NextMarker = l.Last
+		}
+	}
+	sendS3XML(w, 200, res)
+}
+
+// DeleteObjects.
+func s3DeleteObjects(w *s3ResponseWriter, req *http.Request, bucket string) {
+	body := struct {
+		Quiet   bool
+		Objects []struct {
+			Key string
+		} `xml:"Object"`
+	}{}
+	if err := xml.NewDecoder(req.Body).Decode(&body); err != nil {
+		w.fail(400, "MalformedXML", err.Error())
+		return
+	}
+
+	type deleteError struct {
+		Key     string
+		Code    string
+		Message string
+	}
+	res := struct {
+		XMLName xml.Name      `xml:"DeleteResult"`
+		Xmlns   string        `xml:"xmlns,attr"`
+		Deleted []s3Prefix    `xml:"Deleted"`
+		Errors  []deleteError `xml:"Error"`
+	}{Xmlns: s3Xmlns}
+
+	for _, o := range body.Objects {
+		path := bucket + "/" + o.Key
+		c := &captureResponseWriter{w: ioutil.Discard, hdr: http.Header{}}
+		if !s3Authorized(c, s3Request(req, "DELETE", "/"+path)) {
+			res.Errors = append(res.Errors,
+				deleteError{o.Key, "AccessDenied", "Access Denied"})
+			continue
+		}
+		_, err := deleteFile(shortName(path))
+		if _, ok := err.(retentionError); ok {
+			res.Errors = append(res.Errors,
+				deleteError{o.Key, "AccessDenied", err.Error()})
+			continue
+		}
+		if err != nil && !gomemcached.IsNotFound(err) {
+			res.Errors = append(res.Errors,
+				deleteError{o.Key, "InternalError", err.Error()})
+			continue
+		}
+		if !body.Quiet {
+			res.Deleted = append(res.Deleted, s3Prefix{o.Key})
+		}
+	}
+	sendS3XML(w, 200, res)
+}
+
+func doS3Object(w *s3ResponseWriter, req *http.Request, bucket, key string,
+	q url.Values) {
+
+	path := "/" + bucket + "/" + key
+	id := q.Get("uploadId")
+	if id != "" {
+		w.notFound = "NoSuchUpload"
+	}
+
+	switch {
+	case req.Method == "POST" && q["uploads"] != nil:
+		s3InitMultipart(w, req, bucket, key)
+	case req.Method == "POST" && id != "":
+		s3CompleteMultipart(w, req, bucket, key, id)
+	case req.Method == "PUT" && id != "":
+		n, err := strconv.Atoi(q.Get("partNumber"))
+		if err != nil || n < 1 || n > 10000 {
+			w.fail(400, "", "Invalid part number")
+			return
+		}
+		rest := fmt.Sprintf("%v/%v", id, n)
+		r := s3Request(req, "PUT", multipartPrefix+rest)
+		if s3Allowed(w, r) {
+			putMultipartPart(w, r, rest)
+		}
+	case req.Method == "GET" && id != "":
+		s3ListParts(w, req, bucket, key, id)
+	case req.Method == "DELETE" && id != "":
+		r := s3Request(req, "DELETE", multipartPrefix+id)
+		if s3Allowed(w, r) {
+			doAbortMultipart(w, r, id)
+		}
+	case req.Header.Get("X-Amz-Copy-Source") != "":
+		w.fail(501, "", "Copying objects is not supported")
+	case req.Method == "GET", req.Method == "HEAD", req.Method == "PUT",
+		req.Method == "DELETE":
+		r := s3Request(req, req.Method, path)
+		if !s3Allowed(w, r) {
+			return
+		}
+		switch req.Method {
+		case "GET":
+			doGetUserDoc(w, r)
+		case "HEAD":
+			doHeadUserFile(w, r)
+		case "PUT":
+			putUserFile(w, r)
+		case "DELETE":
+			w.missingOK = true
+			doDeleteUserDoc(w, r)
+		}
+	default:
+		w.fail(501, "", "Unsupported object operation")
+	}
+}
+
+func s3InitMultipart(w *s3ResponseWriter, req *http.Request, bucket, key string) {
+	r := s3Request(req, "POST", multipartPrefix)
+	r.Form = url.Values{"path": {bucket + "/" + key}}
+	if t := req.Header.Get("Content-Type"); t != "" {
+		r.Form.Set("type", t)
+	}
+	if !s3Allowed(w, r) {
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	c := &captureResponseWriter{w: buf, hdr: http.Header{}}
+	doInitMultipart(c, r)
+	if c.statusCode >= 400 {
+		w.WriteHeader(c.statusCode)
+		w.Write(buf.Bytes())
+		return
+	}
+	mu := multipartUpload{}
+	if err := json.Unmarshal(buf.Bytes(), &mu); err != nil {
+		w.fail(500, "", err.Error())
+		return
+	}
+
+	sendS3XML(w, 200, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Xmlns: s3Xmlns, Bucket: bucket, Key: key, UploadId: mu.ID})
+}
+
+func s3CompleteMultipart(w *s3ResponseWriter, req *http.Request,
+	bucket, key, id string) {
+
+	body := struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}{}
+	if err := xml.NewDecoder(req.Body).Decode(&body); err != nil {
+		w.fail(400, "MalformedXML", err.Error())
+		return
+	}
+	want := []map[string]interface{}{}
+	for _, p := range body.Parts {
+		want = append(want, map[string]interface{}{
+			"part": p.PartNumber,
+			"oid":  strings.Trim(p.ETag, `"`),
+		})
+	}
+	data, err := json.Marshal(want)
+	if err != nil {
+		w.fail(500, "", err.Error())
+		return
+	}
+
+	r := s3Request(req, "POST", multipartPrefix+id)
+	r.Body = ioutil.NopCloser(bytes.NewReader(data))
+	r.ContentLength = int64(len(data))
+	if !s3Allowed(w, r) {
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	c := &captureResponseWriter{w: buf, hdr: http.Header{}}
+	doCompleteMultipart(c, r, id)
+	switch {
+	case c.statusCode == 400:
+		w.fail(400, "InvalidPart", buf.String())
+		return
+	case c.statusCode >= 400:
+		w.WriteHeader(c.statusCode)
+		w.Write(buf.Bytes())
+		return
+	}
+
+	sendS3XML(w, 200, struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Location string
+		Bucket   string
+		Key      string
+		ETag     string
+	}{
+		Xmlns:    s3Xmlns,
+		Location: "/" + bucket + "/" + key,
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     c.hdr.Get("Etag"),
+	})
+}
+
+func s3ListParts(w *s3ResponseWriter, req *http.Request,
+	bucket, key, id string) {
+
+	if !s3Allowed(w, s3Request(req, "GET", multipartPrefix+id)) {
+		return
+	}
+	mu, err := getMultipartUpload(id)
+	if err != nil {
+		sendMultipartError(w, err)
+		return
+	}
+
+	type part struct {
+		PartNumber int
+		ETag       string
+		Size       int64
+	}
+	res := struct {
+		XMLName     xml.Name `xml:"ListPartsResult"`
+		Xmlns       string   `xml:"xmlns,attr"`
+		Bucket      string
+		Key         string
+		UploadId    string
+		IsTruncated bool
+		Parts       []part `xml:"Part"`
+	}{Xmlns: s3Xmlns, Bucket: bucket, Key: key, UploadId: id}
+
+	nums := []int{}
+	for n := range mu.Parts {
+		nums = append(nums, n)
+	}
+	sort.Ints(nums)
+	for _, n := range nums {
+		p := mu.Parts[n]
+		res.Parts = append(res.Parts, part{n, fileETag(p.OID), p.Length})
+	}
+	sendS3XML(w, 200, res)
+}
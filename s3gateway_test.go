@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/config"
+	"github.com/couchbaselabs/cbfs/sigv4"
+)
+
+func TestAWSChunkedReader(t *testing.T) {
+	tests := []struct {
+		in, exp string
+		err     bool
+	}{
+		{"5;chunk-signature=abc\r\nhello\r\n0;chunk-signature=def\r\n\r\n",
+			"hello", false},
+		{"3\r\nfoo\r\n4\r\nbars\r\n0\r\nx-amz-checksum-crc32:AAAA\r\n\r\n",
+			"foobars", false},
+		{"0;chunk-signature=abc\r\n\r\n", "", false},
+		{"5\r\nhel", "hel", true},
+		{"zz\r\nhello\r\n", "", true},
+	}
+
+	for _, test := range tests {
+		r := &awsChunkedReader{r: bufio.NewReader(strings.NewReader(test.in))}
+		got, err := ioutil.ReadAll(r)
+		if string(got) != test.exp || (err != nil) != test.err {
+			t.Errorf("Expected %q (err=%v) from %q, got %q, %v",
+				test.exp, test.err, test.in, got, err)
+		}
+	}
+}
+
+func TestSplitS3Path(t *testing.T) {
+	tests := []struct {
+		in, bucket, key string
+	}{
+		{"/", "", ""},
+		{"/b", "b", ""},
+		{"/b/", "b", ""},
+		{"/b/k", "b", "k"},
+		{"/b/some/deep/key", "b", "some/deep/key"},
+	}
+
+	for _, test := range tests {
+		b, k := splitS3Path(test.in)
+		if b != test.bucket || k != test.key {
+			t.Errorf("Expected %q, %q for %q, got %q, %q",
+				test.bucket, test.key, test.in, b, k)
+		}
+	}
+}
+
+func TestS3KeyRange(t *testing.T) {
+	obj := map[string]interface{}{}
+	tests := []struct {
+		in         string
+		start, end []interface{}
+	}{
+		{"b/", []interface{}{"b"}, []interface{}{"b", obj}},
+		{"b/dir/", []interface{}{"b", "dir"}, []interface{}{"b", "dir", obj}},
+		{"b/dir/ja", []interface{}{"b", "dir", "ja"},
+			[]interface{}{"b", "dir", "ja\ufff0"}},
+	}
+
+	for _, test := range tests {
+		start, end := s3KeyRange(test.in)
+		if !reflect.DeepEqual(start, test.start) ||
+			!reflect.DeepEqual(end, test.end) {
+			t.Errorf("Expected %v-%v for %q, got %v-%v",
+				test.start, test.end, test.in, start, end)
+		}
+	}
+
+	exp := []interface{}{"b", "dir", obj}
+	if got := s3SkipKey("b/dir/"); !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+}
+
+func TestS3ResponseWriter(t *testing.T) {
+	tests := []struct {
+		status    int
+		missingOK bool
+		expStatus int
+		expCode   string
+	}{
+		{201, false, 200, ""},
+		{204, false, 204, ""},
+		{404, false, 404, "NoSuchKey"},
+		{404, true, 204, ""},
+		{403, false, 403, "AccessDenied"},
+		{500, false, 500, "InternalError"},
+	}
+
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		sw := &s3ResponseWriter{ResponseWriter: rec, resource: "/b/k",
+			notFound: "NoSuchKey", missingOK: test.missingOK}
+		http.Error(sw, "cbfs message", test.status)
+		sw.finish()
+
+		if rec.Code != test.expStatus {
+			t.Errorf("Expected %v for %v, got %v",
+				test.expStatus, test.status, rec.Code)
+		}
+		if test.expCode == "" {
+			continue
+		}
+		e := s3Error{}
+		if err := xml.Unmarshal(rec.Body.Bytes(), &e); err != nil {
+			t.Errorf("Error parsing error document %q: %v", rec.Body, err)
+			continue
+		}
+		if e.Code != test.expCode || e.Message != "cbfs message" ||
+			e.Resource != "/b/k" {
+			t.Errorf("Expected %v error for %v, got %+v",
+				test.expCode, test.status, e)
+		}
+	}
+}
+
+func TestS3Authenticate(t *testing.T) {
+	conf := cbfsconfig.DefaultConfig()
+	conf.AuthRequired = true
+	conf.Users = map[string]cbfsconfig.AuthUser{
+		"alice": {TokenHash: cbfsconfig.HashToken("tok"),
+			Grants: []cbfsconfig.Grant{{"b/", "r"}}, S3Secret: "s3-secret"},
+		"bob": {TokenHash: cbfsconfig.HashToken("bob-tok")},
+	}
+	defer func(c *cbfsconfig.CBFSConfig) { globalConfig = c }(globalConfig)
+	globalConfig = &conf
+
+	signed := func(key, secret string) *http.Request {
+		req := httptest.NewRequest("GET", "/b/k", nil)
+		req.Header.Set("X-Amz-Content-Sha256", sigv4.EmptySHA256)
+		sigv4.Sign(req, sigv4.Credentials{AccessKey: key, SecretKey: secret},
+			"us-east-1", "s3", sigv4.EmptySHA256, time.Now())
+		return req
+	}
+
+	tests := []struct {
+		name, key, secret string
+		status            int
+		code              string
+	}{
+		{"good", "alice", "s3-secret", 0, ""},
+		{"wrong secret", "alice", "tok", 403, "SignatureDoesNotMatch"},
+		{"no s3 secret", "bob", "", 403, "InvalidAccessKeyId"},
+		{"no such user", "carol", "s3-secret", 403, "InvalidAccessKeyId"},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		sw := &s3ResponseWriter{ResponseWriter: rec, resource: "/b/k"}
+		req, ok := s3Authenticate(sw, signed(test.key, test.secret))
+		sw.finish()
+		if ok != (test.status == 0) {
+			t.Errorf("%v: expected ok=%v, got %v",
+				test.name, test.status == 0, ok)
+			continue
+		}
+		if !ok {
+			e := s3Error{}
+			if rec.Code != test.status ||
+				xml.Unmarshal(rec.Body.Bytes(), &e) != nil ||
+				e.Code != test.code {
+				t.Errorf("%v: expected %v %v, got %v %q",
+					test.name, test.status, test.code, rec.Code, rec.Body)
+			}
+			continue
+		}
+
+		if req.Header.Get("Authorization") != "" {
+			t.Errorf("%v: expected the signature dropped", test.name)
+		}
+		w := httptest.NewRecorder()
+		if !s3Authorized(w, s3Request(req, "GET", "/b/k")) {
+			t.Errorf("%v: expected %v to read b/k, got %v",
+				test.name, test.key, w.Code)
+		}
+		w = httptest.NewRecorder()
+		if s3Authorized(w, s3Request(req, "GET", "/c/k")) || w.Code != 403 {
+			t.Errorf("%v: expected %v denied c/k, got %v",
+				test.name, test.key, w.Code)
+		}
+	}
+
+	// Unsigned requests are left for the regular API's checks.
+	req := httptest.NewRequest("GET", "/b/k", nil)
+	req.Header.Set("Authorization", "Bearer tok")
+	got, ok := s3Authenticate(&s3ResponseWriter{
+		ResponseWriter: httptest.NewRecorder()}, req)
+	if !ok || got != req {
+		t.Errorf("Expected an unsigned request through as is")
+	}
+	if !s3Authorized(httptest.NewRecorder(), s3Request(got, "GET", "/b/k")) {
+		t.Errorf("Expected a bearer token to still work")
+	}
+}
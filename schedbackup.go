@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+const (
+	backupStatusKey    = "/@backupStatus"
+	backupNamePrefix   = "cbfs-backup-"
+	backupNameSuffix   = ".json.gz"
+	backupNameTimeForm = "20060102T150405Z"
+)
+
+// Outcome of scheduled backups.
+type backupStatus struct {
+	LastAttempt time.Time `json:"lastAttempt"`
+	LastSuccess time.Time `json:"lastSuccess"`
+	LastFile    string    `json:"lastFile,omitempty"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+// Somewhere scheduled backups may be kept.  Backups are named by
+// backupName and are always full.
+type backupDest interface {
+	store(name string) error
+	list() ([]string, error)
+	remove(name string) error
+	String() string
+}
+
+func backupName(t time.Time) string {
+	return backupNamePrefix + t.UTC().Format(backupNameTimeForm) +
+		backupNameSuffix
+}
+
+// When the named backup was made, if it's one of ours.
+func parseBackupName(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, backupNamePrefix) ||
+		!strings.HasSuffix(name, backupNameSuffix) {
+		return time.Time{}, false
+	}
+	ts := name[len(backupNamePrefix) : len(name)-len(backupNameSuffix)]
+	t, err := time.Parse(backupNameTimeForm, ts)
+	return t, err == nil
+}
+
+// Pick the backups to remove to keep at most keep of them (if keep
+// is positive) and none older than maxAge (if positive).  The newest
+// backup is never picked.
+func expiredBackups(names []string, keep int, maxAge time.Duration,
+	now time.Time) []string {
+
+	ours := []string{}
+	for _, n := range names {
+		if _, ok := parseBackupName(n); ok {
+			ours = append(ours, n)
+		}
+	}
+	// The timestamps sort lexically.
+	sort.Sort(sort.Reverse(sort.StringSlice(ours)))
+
+	rv := []string{}
+	for i, n := range ours {
+		t, _ := parseBackupName(n)
+		switch {
+		case i == 0:
+		case keep > 0 && i >= keep:
+			rv = append(rv, n)
+		case maxAge > 0 && now.Sub(t) > maxAge:
+			rv = append(rv, n)
+		}
+	}
+	return rv
+}
+
+func parseBackupDest(s string) (backupDest, error) {
+	switch {
+	case s == "":
+		return nil, nil
+	case strings.HasPrefix(s, "s3://"), strings.HasPrefix(s, "gs://"):
+		scheme, bucket, prefix, _ := parseBucketURL(s)
+		if prefix != "" {
+			prefix += "/"
+		}
+		return s3BackupDest{scheme, newBackupBucket(scheme, bucket),
+			prefix}, nil
+	case strings.HasPrefix(s, "cbfs:"):
+		p := strings.Trim(strings.TrimPrefix(s[len("cbfs:"):], "//"), "/")
+		return cbfsBackupDest(p), nil
+	case strings.HasPrefix(s, "file://"):
+		return dirBackupDest(s[len("file://"):]), nil
+	case filepath.IsAbs(s):
+		return dirBackupDest(s), nil
+	}
+	return nil, fmt.Errorf("unsupported backup destination: %q", s)
+}
+
+// Backups stored as files in the cluster itself.
+type cbfsBackupDest string
+
+func (d cbfsBackupDest) path(name string) string {
+	if d == "" {
+		return name
+	}
+	return string(d) + "/" + name
+}
+
+func (d cbfsBackupDest) store(name string) error {
+	return backupToCBFS(d.path(name), "", nil)
+}
+
+func (d cbfsBackupDest) list() ([]string, error) {
+	b := backups{}
+	err := couchbase.Get(backupKey, &b)
+	switch {
+	case gomemcached.IsNotFound(err):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	removeDeadBackups(&b)
+
+	rv := []string{}
+	for _, bi := range b.Backups {
+		if dir, name := filepath.Split(bi.Fn); strings.Trim(dir, "/") == string(d) {
+			rv = append(rv, name)
+		}
+	}
+	return rv, nil
+}
+
+func (d cbfsBackupDest) remove(name string) error {
+	return couchbase.Delete(shortName(d.path(name)))
+}
+
+func (d cbfsBackupDest) String() string {
+	return "cbfs:" + string(d)
+}
+
+// Backups stored in a directory.  Whichever node runs the backup
+// writes it, so this should be storage all nodes share.
+type dirBackupDest string
+
+func (d dirBackupDest) store(name string) error {
+	f, err := ioutil.TempFile(string(d), ".tmp"+name)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	err = backupTo(f, nil)
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(string(d), name))
+}
+
+func (d dirBackupDest) list() ([]string, error) {
+	fis, err := ioutil.ReadDir(string(d))
+	if err != nil {
+		return nil, err
+	}
+	rv := []string{}
+	for _, fi := range fis {
+		rv = append(rv, fi.Name())
+	}
+	return rv, nil
+}
+
+func (d dirBackupDest) remove(name string) error {
+	return os.Remove(filepath.Join(string(d), name))
+}
+
+func (d dirBackupDest) String() string {
+	return string(d)
+}
+
+// Backups stored in S3 or GCS.
+type s3BackupDest struct {
+	scheme string
+	bucket s3Bucket
+	prefix string
+}
+
+func (d s3BackupDest) store(name string) error {
+	return backupToBucket(d.bucket, d.prefix+name, nil)
+}
+
+func (d s3BackupDest) list() ([]string, error) {
+	keys, err := d.bucket.list(d.prefix)
+	if err != nil {
+		return nil, err
+	}
+	rv := []string{}
+	for _, k := range keys {
+		rv = append(rv, k[len(d.prefix):])
+	}
+	return rv, nil
+}
+
+func (d s3BackupDest) remove(name string) error {
+	return d.bucket.remove(d.prefix + name)
+}
+
+func (d s3BackupDest) String() string {
+	return d.scheme + "://" + d.bucket.name + "/" + d.prefix
+}
+
+func getBackupStatus() (backupStatus, error) {
+	st := backupStatus{}
+	err := couchbase.Get(backupStatusKey, &st)
+	if gomemcached.IsNotFound(err) {
+		err = nil
+	}
+	return st, err
+}
+
+// Make a backup to the configured destination and remove old ones.
+func scheduledBackup() error {
+	dest, err := parseBackupDest(globalConfig.BackupDest)
+	if err != nil || dest == nil {
+		return err
+	}
+
+	st, err := getBackupStatus()
+	if err != nil {
+		log.Printf("Error getting backup status: %v", err)
+	}
+	now := time.Now().UTC()
+	name := backupName(now)
+	st.LastAttempt = now
+
+	setTaskDetail("scheduledBackup", "writing "+name)
+	err = dest.store(name)
+	if err == nil {
+		st.LastSuccess = now
+		st.LastFile = name
+		st.LastError = ""
+		log.Printf("Completed scheduled backup %v to %v", name, dest)
+	} else {
+		st.LastError = err.Error()
+	}
+	if e := couchbase.Set(backupStatusKey, 0, st); e != nil {
+		log.Printf("Error recording backup status: %v", e)
+	}
+	if err != nil {
+		return err
+	}
+
+	names, err := dest.list()
+	if err != nil {
+		return err
+	}
+	old := expiredBackups(names, globalConfig.BackupKeep,
+		globalConfig.BackupMaxAge, now)
+	for _, n := range old {
+		setTaskDetail("scheduledBackup", "removing "+n)
+		if err := dest.remove(n); err != nil {
+			log.Printf("Error removing old backup %v from %v: %v",
+				n, dest, err)
+			continue
+		}
+		log.Printf("Removed old backup %v from %v", n, dest)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBackupName(t *testing.T) {
+	now := time.Date(2014, 3, 7, 12, 30, 5, 99, time.UTC)
+	name := backupName(now)
+	if name != "cbfs-backup-20140307T123005Z.json.gz" {
+		t.Errorf("Expected a timestamped name, got %v", name)
+	}
+	got, ok := parseBackupName(name)
+	if !ok || !got.Equal(now.Truncate(time.Second)) {
+		t.Errorf("Expected %v, got %v, %v", now, got, ok)
+	}
+
+	for _, bad := range []string{"other.json.gz", "cbfs-backup-x.json.gz",
+		"cbfs-backup-20140307T123005Z.json"} {
+		if _, ok := parseBackupName(bad); ok {
+			t.Errorf("Expected %v not to parse", bad)
+		}
+	}
+}
+
+func TestExpiredBackups(t *testing.T) {
+	now := time.Date(2014, 3, 10, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	names := []string{
+		backupName(now.Add(-3 * day)),
+		"unrelated",
+		backupName(now.Add(-1 * day)),
+		backupName(now),
+		backupName(now.Add(-2 * day)),
+	}
+
+	tests := []struct {
+		keep   int
+		maxAge time.Duration
+		exp    []string
+	}{
+		{0, 0, []string{}},
+		{2, 0, []string{names[4], names[0]}},
+		{0, 36 * time.Hour, []string{names[4], names[0]}},
+		{3, 36 * time.Hour, []string{names[4], names[0]}},
+		{1, 0, []string{names[2], names[4], names[0]}},
+		// The newest survives no matter what.
+		{0, time.Hour, []string{names[2], names[4], names[0]}},
+	}
+
+	for _, test := range tests {
+		got := expiredBackups(names, test.keep, test.maxAge, now.Add(time.Hour))
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("Expected %v for keep=%v, maxAge=%v, got %v",
+				test.exp, test.keep, test.maxAge, got)
+		}
+	}
+}
+
+func TestParseBackupDest(t *testing.T) {
+	tests := []struct {
+		in  string
+		exp string
+	}{
+		{"", ""},
+		{"/var/backups", "/var/backups"},
+		{"file:///var/backups", "/var/backups"},
+		{"cbfs:backups/", "cbfs:backups"},
+		{"cbfs:///backups", "cbfs:backups"},
+		{"s3://bucket", "s3://bucket/"},
+		{"s3://bucket/some/prefix/", "s3://bucket/some/prefix/"},
+		{"gs://bucket/prefix", "gs://bucket/prefix/"},
+	}
+
+	for _, test := range tests {
+		d, err := parseBackupDest(test.in)
+		if err != nil {
+			t.Errorf("Error parsing %q: %v", test.in, err)
+			continue
+		}
+		got := ""
+		if d != nil {
+			got = d.String()
+		}
+		if got != test.exp {
+			t.Errorf("Expected %q for %q, got %q", test.exp, test.in, got)
+		}
+	}
+
+	if _, err := parseBackupDest("backups"); err == nil {
+		t.Errorf("Expected error on a relative path")
+	}
+}
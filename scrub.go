@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	cb "github.com/couchbaselabs/go-couchbase"
+)
+
+// Where bad blobs are kept for inspection, relative to the volume
+// they were on.
+const quarantineDir = "quarantine"
+
+// How long to rest between passes over the local blobs.
+const scrubPassPause = time.Hour
+
+var scrubbedBytes, scrubCorrupt uint64
+
+// Move a bad local blob aside where it won't be served, and stop
+// advertising it.
+func quarantineBlob(oid string) error {
+	removeBlobOwnershipRecord(oid, serverId)
+	hotBlobCache().forget(oid)
+
+	// Stay on the same volume so this is just a rename.
+	v, _ := blobVolume(oid)
+	dir := filepath.Join(v, quarantineDir)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	to := filepath.Join(dir, fmt.Sprintf("%s.%d", oid, time.Now().Unix()))
+	err := os.Rename(hashFilename(v, oid), to)
+	if err == nil {
+		log.Printf("Quarantined %v as %v", oid, to)
+	}
+	return err
+}
+
+// Note when this node last confirmed its copy of a blob is intact.
+func recordBlobVerified(oid string) error {
+	err := couchbase.Update("/"+oid, 0, func(in []byte) ([]byte, error) {
+		ownership := BlobOwnership{}
+		if err := json.Unmarshal(in, &ownership); err != nil {
+			return nil, cb.UpdateCancel
+		}
+		if _, ok := ownership.Nodes[serverId]; !ok {
+			return nil, cb.UpdateCancel
+		}
+		if ownership.Verified == nil {
+			ownership.Verified = map[string]time.Time{}
+		}
+		ownership.Verified[serverId] = time.Now().UTC()
+		return json.Marshal(ownership)
+	})
+	if err == cb.UpdateCancel {
+		err = nil
+	}
+	return err
+}
+
+// Reads no faster than rate bytes per second (or as fast as it can
+// if that's zero).
+type throttledReader struct {
+	r    io.Reader
+	rate int64
+}
+
+func (t throttledReader) Read(p []byte) (int, error) {
+	if len(p) > 64*1024 {
+		p = p[:64*1024]
+	}
+	start := time.Now()
+	n, err := t.r.Read(p)
+	if rate := t.rate; rate > 0 {
+		want := time.Duration(int64(n) * int64(time.Second) / rate)
+		if d := want - time.Since(start); d > 0 {
+			time.Sleep(d)
+		}
+	}
+	return n, err
+}
+
+// Re-hash one local blob.  Returns false if it was bad.
+func scrubBlob(oid string) bool {
+	f, err := openLocalBlob(oid)
+	if err != nil {
+		// Removed since we found it, or unreadable for
+		// reasons unrelated to its content.
+		if !os.IsNotExist(err) {
+			log.Printf("Error opening %v to scrub: %v", oid, err)
+		}
+		return true
+	}
+	h := newOIDHash(oid)
+	n, err := io.Copy(h, throttledReader{f, globalConfig.ScrubRate})
+	f.Close()
+	atomic.AddUint64(&scrubbedBytes, uint64(n))
+
+	if err == nil && h.match(oid) != "" {
+		if err := recordBlobVerified(oid); err != nil {
+			log.Printf("Error recording verification of %v: %v",
+				oid, err)
+		}
+		return true
+	}
+	if os.IsNotExist(err) {
+		return true
+	}
+
+	atomic.AddUint64(&scrubCorrupt, 1)
+	log.Printf("Scrub found local copy of %v is bad (%v)", oid, err)
+	if err := quarantineBlob(oid); err != nil {
+		log.Printf("Error quarantining %v: %v", oid, err)
+	}
+	nl, err := findAllNodes()
+	if err != nil {
+		log.Printf("Error finding nodes to replace %v: %v", oid, err)
+	} else if !salvageBlob(oid, "", 1, nl) {
+		log.Printf("Queue is full replacing %v", oid)
+	}
+	return false
+}
+
+var errScrubDisabled = errors.New("scrubbing disabled")
+
+// Re-hash every local blob once.
+func scrubPass() (checked, bad int, err error) {
+	err = walkLocalBlobs(func(info os.FileInfo) error {
+		if globalConfig.ScrubRate <= 0 {
+			return errScrubDisabled
+		}
+		checked++
+		if !scrubBlob(info.Name()) {
+			bad++
+		}
+		return nil
+	})
+	return
+}
+
+// Continuously verify local blobs against their hashes, slowly
+// enough not to get in the way of anything else.
+func scrubLoop() {
+	for {
+		if globalConfig.ScrubRate <= 0 {
+			time.Sleep(time.Minute)
+			continue
+		}
+		start := time.Now()
+		checked, bad, err := scrubPass()
+		switch err {
+		case nil:
+			log.Printf("Scrubbed %v blobs in %v, %v bad",
+				checked, time.Since(start), bad)
+		case errScrubDisabled:
+		default:
+			log.Printf("Error scrubbing after %v blobs: %v", checked, err)
+		}
+		time.Sleep(scrubPassPause)
+	}
+}
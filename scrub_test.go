@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestThrottledReader(t *testing.T) {
+	start := time.Now()
+	n, err := io.Copy(ioutil.Discard,
+		throttledReader{bytes.NewReader(make([]byte, 256*1024)), 1024 * 1024})
+	if err != nil || n != 256*1024 {
+		t.Fatalf("Expected to read %v bytes, got %v (%v)", 256*1024, n, err)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("Expected at least 200ms, took %v", d)
+	}
+}
+
+func TestQuarantineBlob(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "scrubtest")
+	if err != nil {
+		t.Fatalf("Error making tmp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer func(r string) { *root = r }(*root)
+	*root = tmpdir
+
+	oid := "aa01"
+	fn := hashFilename(tmpdir, oid)
+	os.MkdirAll(filepath.Dir(fn), 0777)
+	if err := ioutil.WriteFile(fn, []byte("bad"), 0666); err != nil {
+		t.Fatalf("Error writing blob: %v", err)
+	}
+
+	if err := quarantineBlob(oid); err != nil {
+		t.Fatalf("Error quarantining: %v", err)
+	}
+	if _, err := os.Stat(fn); !os.IsNotExist(err) {
+		t.Errorf("Expected blob to be gone, got %v", err)
+	}
+	found, _ := filepath.Glob(filepath.Join(tmpdir, quarantineDir, oid+".*"))
+	if len(found) != 1 {
+		t.Errorf("Expected one quarantined copy, got %v", found)
+	}
+}
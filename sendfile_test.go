@@ -0,0 +1,86 @@
+// +build !windows
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Hides the connection's ReadFrom, forcing copies through userspace.
+type copyingWriter struct {
+	http.ResponseWriter
+}
+
+func (c copyingWriter) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{c.ResponseWriter}, r)
+}
+
+func cpuTime() time.Duration {
+	var ru syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &ru)
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+// Serve a blob-sized file the way blobs are served, reporting the
+// CPU time spent per GB.
+func benchmarkServeFile(b *testing.B, wrap func(http.ResponseWriter) http.ResponseWriter) {
+	f, err := ioutil.TempFile("", "sendfilebench")
+	if err != nil {
+		b.Fatalf("Error making tmp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	const size = 64 * 1024 * 1024
+	if _, err := io.CopyN(f, &randomDataMaker{rand.NewSource(1)}, size); err != nil {
+		b.Fatalf("Error filling tmp file: %v", err)
+	}
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			rec := &statusRecorder{ResponseWriter: w}
+			http.ServeContent(wrap(rec), req, "", time.Time{}, f)
+		}))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("Error listening: %v", err)
+	}
+	ts.Listener = &rateListener{l: l}
+	ts.Start()
+	defer ts.Close()
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	start := cpuTime()
+	for i := 0; i < b.N; i++ {
+		res, err := http.Get(ts.URL)
+		if err != nil {
+			b.Fatalf("Error fetching: %v", err)
+		}
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+	}
+	cpu := cpuTime() - start
+	b.ReportMetric(float64(cpu.Nanoseconds())/(float64(b.N)*size/1e9), "cpu-ns/GB")
+}
+
+func BenchmarkServeFileSendfile(b *testing.B) {
+	benchmarkServeFile(b, func(w http.ResponseWriter) http.ResponseWriter {
+		return w
+	})
+}
+
+func BenchmarkServeFileCopy(b *testing.B) {
+	benchmarkServeFile(b, func(w http.ResponseWriter) http.ResponseWriter {
+		return copyingWriter{w}
+	})
+}
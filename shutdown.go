@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var drainTimeout = flag.Duration("drainTimeout", 30*time.Second,
+	"How long to let in-flight requests and queued internode tasks finish on SIGTERM")
+
+// Nonzero once this node has begun shutting down.
+var localStopping int32
+
+func isStopping() bool {
+	return atomic.LoadInt32(&localStopping) != 0
+}
+
+// Things to stop at shutdown, each finishing what it's doing by the
+// context's deadline.
+var shutdownHooks struct {
+	sync.Mutex
+	fs []func(context.Context) error
+}
+
+func onShutdown(f func(context.Context) error) {
+	shutdownHooks.Lock()
+	defer shutdownHooks.Unlock()
+	shutdownHooks.fs = append(shutdownHooks.fs, f)
+}
+
+// Serve HTTP on l until the node shuts down, letting requests in
+// flight finish then.
+func serveUntilShutdown(s *http.Server, l net.Listener) {
+	onShutdown(s.Shutdown)
+	if err := s.Serve(l); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// Closed when shutdown has finished and the process may exit.
+var shutdownDone = make(chan bool)
+
+func handleShutdown() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Printf("Got %v, shutting down (draining for up to %v)",
+			sig, *drainTimeout)
+		shutdown(*drainTimeout)
+		close(shutdownDone)
+	}()
+}
+
+// Leave the cluster without making work for it: tell the other nodes
+// to stop sending new blobs here, finish requests in flight, give
+// queued internode tasks a chance to run, then let go of the
+// database.
+func shutdown(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	atomic.StoreInt32(&localStopping, 1)
+	if err := announceStopping(); err != nil {
+		log.Printf("Error marking this node as stopping: %v", err)
+	}
+
+	shutdownHooks.Lock()
+	hooks := shutdownHooks.fs
+	shutdownHooks.Unlock()
+
+	wg := sync.WaitGroup{}
+	for _, f := range hooks {
+		wg.Add(1)
+		go func(f func(context.Context) error) {
+			defer wg.Done()
+			if err := f(ctx); err != nil {
+				log.Printf("Error draining: %v", err)
+			}
+		}(f)
+	}
+	wg.Wait()
+
+	drainTaskQueue(ctx)
+
+	couchbase.Close()
+	log.Printf("Shut down")
+}
+
+// Mark this node's record as stopping, with a final heartbeat time
+// for stale node checks to count from.
+func announceStopping() error {
+	return couchbase.Update("/"+serverId, 0, func(in []byte) ([]byte, error) {
+		sn := StorageNode{}
+		if err := json.Unmarshal(in, &sn); err != nil {
+			return nil, err
+		}
+		sn.Stopping = true
+		sn.Time = time.Now().UTC()
+		return json.Marshal(sn)
+	})
+}
+
+// Wait for the internode task queue to empty, or ctx to be done.
+func drainTaskQueue(ctx context.Context) {
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+	for len(internodeTaskQueue) > 0 {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			log.Printf("Leaving %v internode tasks undone",
+				len(internodeTaskQueue))
+			return
+		}
+	}
+}
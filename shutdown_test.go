@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServeUntilShutdownDrains(t *testing.T) {
+	defer func(old []func(context.Context) error) {
+		shutdownHooks.fs = old
+	}(shutdownHooks.fs)
+	shutdownHooks.fs = nil
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	started := make(chan bool)
+	s := &http.Server{Handler: http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			close(started)
+			time.Sleep(50 * time.Millisecond)
+			w.Write([]byte("done"))
+		})}
+	served := make(chan bool)
+	go func() {
+		serveUntilShutdown(s, l)
+		close(served)
+	}()
+
+	body := make(chan string)
+	go func() {
+		res, err := http.Get("http://" + l.Addr().String() + "/")
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		body <- string(b)
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	shutdownHooks.Lock()
+	hooks := shutdownHooks.fs
+	shutdownHooks.Unlock()
+	if len(hooks) != 1 {
+		t.Fatalf("Expected one shutdown hook, got %v", len(hooks))
+	}
+	if err := hooks[0](ctx); err != nil {
+		t.Errorf("Error shutting down: %v", err)
+	}
+	if got := <-body; got != "done" {
+		t.Errorf("Expected the request in flight to finish, got %q", got)
+	}
+	<-served
+}
+
+func TestDrainTaskQueue(t *testing.T) {
+	defer func(old chan internodeTask) { internodeTaskQueue = old }(internodeTaskQueue)
+	internodeTaskQueue = make(chan internodeTask, 2)
+
+	drainTaskQueue(context.Background())
+
+	internodeTaskQueue <- internodeTask{cmd: fetchObjectCmd}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	drainTaskQueue(ctx)
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("Expected to wait for the queue, returned in %v", d)
+	}
+}
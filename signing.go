@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/config"
+)
+
+func signatureErrorCode(err error) int {
+	switch err {
+	case cbfsconfig.ErrTooLarge:
+		return 413
+	case cbfsconfig.ErrWrongType:
+		return 415
+	}
+	return 403
+}
+
+// Verify the signature on a request for a user file, if it has one
+// or the cluster requires one.  Responds and returns false if the
+// request may not proceed.  signed is true if a valid signature
+// authorized the request.
+func checkSignature(w http.ResponseWriter, req *http.Request) (proceed, signed bool) {
+	path := req.URL.Path
+	form := strings.HasPrefix(path, formUploadPrefix)
+	switch {
+	case form:
+		path = minusPrefix(path, formUploadPrefix)
+	case strings.HasPrefix(path, "/.cbfs/"):
+		return true, false
+	}
+
+	q := req.URL.Query()
+	if q.Get(cbfsconfig.SignatureParam) == "" {
+		if globalConfig.RequireSignedURLs && !fromOtherNode(req) {
+			http.Error(w, cbfsconfig.ErrUnsigned.Error(), 403)
+			return false, false
+		}
+		return true, false
+	}
+
+	err := globalConfig.VerifySignature(req.Method, path, q, time.Now())
+	if err == nil && req.Method == "POST" && !form {
+		// POST signatures are only for form uploads.
+		err = cbfsconfig.ErrWrongMethod
+	}
+	if err == nil && req.Method == "PUT" {
+		policy := cbfsconfig.ParseUploadPolicy(q)
+		err = policy.Allows(req.ContentLength, req.Header.Get("Content-Type"))
+		if policy.MaxSize > 0 {
+			req.Body = http.MaxBytesReader(w, req.Body, policy.MaxSize)
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), signatureErrorCode(err))
+		return false, false
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "Etag")
+	return true, true
+}
+
+// Answer CORS preflight requests so pages on other sites can use
+// signed URLs directly.
+func doOptions(w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	h.Set("Access-Control-Allow-Origin", "*")
+	h.Set("Access-Control-Allow-Methods", "GET, HEAD, PUT, POST")
+	if rh := req.Header.Get("Access-Control-Request-Headers"); rh != "" {
+		h.Set("Access-Control-Allow-Headers", rh)
+	}
+	h.Set("Access-Control-Max-Age", "3600")
+	w.WriteHeader(204)
+}
@@ -0,0 +1,170 @@
+// Package sigv4 signs and verifies HTTP requests with AWS Signature
+// Version 4, for S3 and the services that copy its API.
+package sigv4
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The hex SHA256 of an empty payload.
+const EmptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+type Credentials struct {
+	AccessKey, SecretKey string
+	// Set for temporary credentials
+	SessionToken string
+}
+
+// Credentials from the usual AWS_* environment variables.
+func EnvCredentials() Credentials {
+	return Credentials{
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+// Whether there's anything to sign with.  Requests without
+// credentials are sent anonymously.
+func (c Credentials) Valid() bool {
+	return c.AccessKey != "" && c.SecretKey != ""
+}
+
+// The region from the AWS_* environment variables, or us-east-1.
+func EnvRegion() string {
+	for _, k := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if r := os.Getenv(k); r != "" {
+			return r
+		}
+	}
+	return "us-east-1"
+}
+
+// Sign a request made at t, adding its X-Amz-Date and Authorization
+// headers.  The host and every header already set are signed.
+// payloadHash is the hex SHA256 of the body; S3 also wants it sent
+// as X-Amz-Content-Sha256, which is up to the caller.
+func Sign(req *http.Request, c Credentials, region, service,
+	payloadHash string, t time.Time) {
+
+	t = t.UTC()
+	amzdate := t.Format("20060102T150405Z")
+	day := t.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzdate)
+	if c.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.SessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	hdrs := map[string]string{"host": host}
+	for k, vs := range req.Header {
+		hdrs[strings.ToLower(k)] = canonicalValue(vs)
+	}
+	names := []string{}
+	for k := range hdrs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	sig := signature(req, hdrs, names, c.SecretKey, amzdate, scope,
+		payloadHash)
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.AccessKey, scope, strings.Join(names, ";"), sig))
+}
+
+// The hex signature of req over the named headers (lower case and
+// sorted), whose canonical values are in hdrs.
+func signature(req *http.Request, hdrs map[string]string, names []string,
+	secret, amzdate, scope, payloadHash string) string {
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canon := req.Method + "\n" + path + "\n" +
+		CanonicalQuery(req.URL.Query()) + "\n"
+	for _, k := range names {
+		canon += k + ":" + hdrs[k] + "\n"
+	}
+	canon += "\n" + strings.Join(names, ";") + "\n" + payloadHash
+
+	csum := sha256.Sum256([]byte(canon))
+	tosign := "AWS4-HMAC-SHA256\n" + amzdate + "\n" + scope + "\n" +
+		hex.EncodeToString(csum[:])
+
+	k := []byte("AWS4" + secret)
+	for _, part := range strings.Split(scope, "/") {
+		k = hmacSHA256(k, part)
+	}
+	return hex.EncodeToString(hmacSHA256(k, tosign))
+}
+
+func canonicalValue(vs []string) string {
+	vals := make([]string, len(vs))
+	for i, v := range vs {
+		vals[i] = strings.Join(strings.Fields(v), " ")
+	}
+	return strings.Join(vals, ",")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// URI encode the way SigV4 wants it: everything but unreserved
+// characters, and slashes if keepSlash.
+func URIEscape(s string, keepSlash bool) string {
+	rv := []byte{}
+	for _, c := range []byte(s) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z',
+			'0' <= c && c <= '9', strings.IndexByte("-_.~", c) >= 0,
+			c == '/' && keepSlash:
+			rv = append(rv, c)
+		default:
+			rv = append(rv, []byte(fmt.Sprintf("%%%02X", c))...)
+		}
+	}
+	return string(rv)
+}
+
+// A query string in the order and encoding it's signed in, which is
+// also a fine way to send it.  Parameters are sorted by name, then value.
+func CanonicalQuery(q url.Values) string {
+	enc := map[string][]string{}
+	keys := []string{}
+	for k, vs := range q {
+		ek := URIEscape(k, false)
+		keys = append(keys, ek)
+		for _, v := range vs {
+			enc[ek] = append(enc[ek], URIEscape(v, false))
+		}
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, k := range keys {
+		sort.Strings(enc[k])
+		for _, v := range enc[k] {
+			parts = append(parts, k+"="+v)
+		}
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,143 @@
+package sigv4
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// How far a signed request's date may be from the verifier's clock.
+const MaxSkew = 15 * time.Minute
+
+var (
+	ErrNotSigned    = errors.New("request isn't signed with AWS4-HMAC-SHA256")
+	ErrMalformed    = errors.New("malformed AWS4-HMAC-SHA256 authorization")
+	ErrUnknownKey   = errors.New("unknown access key")
+	ErrSkewed       = errors.New("request time too far from ours")
+	ErrBadSignature = errors.New("signature doesn't match")
+	ErrBadPayload   = errors.New("payload doesn't match its signed hash")
+)
+
+// The parts of an AWS4-HMAC-SHA256 Authorization header.
+type Authorization struct {
+	AccessKey, Day, Region, Service string
+	// Lower case, as they were signed
+	SignedHeaders []string
+	Signature     string
+}
+
+// Parse an Authorization header.  ErrNotSigned means it's some other
+// kind of authorization (or none at all).
+func ParseAuthorization(h string) (Authorization, error) {
+	const algo = "AWS4-HMAC-SHA256 "
+	if !strings.HasPrefix(h, algo) {
+		return Authorization{}, ErrNotSigned
+	}
+	a := Authorization{}
+	for _, f := range strings.Split(h[len(algo):], ",") {
+		kv := strings.SplitN(strings.TrimSpace(f), "=", 2)
+		if len(kv) != 2 {
+			return Authorization{}, ErrMalformed
+		}
+		switch kv[0] {
+		case "Credential":
+			parts := strings.Split(kv[1], "/")
+			if len(parts) != 5 || parts[4] != "aws4_request" {
+				return Authorization{}, ErrMalformed
+			}
+			a.AccessKey, a.Day = parts[0], parts[1]
+			a.Region, a.Service = parts[2], parts[3]
+		case "SignedHeaders":
+			a.SignedHeaders = strings.Split(kv[1], ";")
+		case "Signature":
+			a.Signature = kv[1]
+		}
+	}
+	if a.AccessKey == "" || len(a.SignedHeaders) == 0 || a.Signature == "" {
+		return Authorization{}, ErrMalformed
+	}
+	return a, nil
+}
+
+// Check a request's signature, returning the access key it was made
+// with.  secret looks up an access key's secret key, reporting false
+// for keys it doesn't know.  The body is covered only through its
+// X-Amz-Content-Sha256 header; see CheckPayload.
+func Verify(req *http.Request, secret func(accessKey string) (string, bool),
+	now time.Time) (string, error) {
+
+	a, err := ParseAuthorization(req.Header.Get("Authorization"))
+	if err != nil {
+		return "", err
+	}
+
+	amzdate := req.Header.Get("X-Amz-Date")
+	t, err := time.Parse("20060102T150405Z", amzdate)
+	if err != nil || a.Day != amzdate[:8] {
+		return "", ErrMalformed
+	}
+	if d := now.Sub(t); d > MaxSkew || d < -MaxSkew {
+		return "", ErrSkewed
+	}
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		return "", ErrMalformed
+	}
+
+	hdrs := map[string]string{}
+	for _, k := range a.SignedHeaders {
+		if k == "host" {
+			hdrs[k] = req.Host
+			continue
+		}
+		hdrs[k] = canonicalValue(req.Header[http.CanonicalHeaderKey(k)])
+	}
+	if _, ok := hdrs["host"]; !ok {
+		return "", ErrMalformed
+	}
+
+	key, ok := secret(a.AccessKey)
+	if !ok {
+		return "", ErrUnknownKey
+	}
+	scope := a.Day + "/" + a.Region + "/" + a.Service + "/aws4_request"
+	sig := signature(req, hdrs, a.SignedHeaders, key, amzdate, scope,
+		payloadHash)
+	if !hmac.Equal([]byte(sig), []byte(a.Signature)) {
+		return "", ErrBadSignature
+	}
+	return a.AccessKey, nil
+}
+
+// Hold a body to the payload hash it was signed with.  Reading it
+// fails with ErrBadPayload at the end if it doesn't match.  Bodies
+// that weren't hashed (UNSIGNED-PAYLOAD or streamed) are returned
+// as they are.
+func CheckPayload(body io.ReadCloser, payloadHash string) io.ReadCloser {
+	if _, err := hex.DecodeString(payloadHash); err != nil ||
+		len(payloadHash) != sha256.Size*2 {
+		return body
+	}
+	return &payloadChecker{body, sha256.New(), strings.ToLower(payloadHash)}
+}
+
+type payloadChecker struct {
+	io.ReadCloser
+	h    hash.Hash
+	want string
+}
+
+func (p *payloadChecker) Read(b []byte) (int, error) {
+	n, err := p.ReadCloser.Read(b)
+	p.h.Write(b[:n])
+	if err == io.EOF && hex.EncodeToString(p.h.Sum(nil)) != p.want {
+		err = ErrBadPayload
+	}
+	return n, err
+}
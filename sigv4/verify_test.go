@@ -0,0 +1,123 @@
+package sigv4
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func suiteSecret(key string) (string, bool) {
+	if key != suiteCreds.AccessKey {
+		return "", false
+	}
+	return suiteCreds.SecretKey, true
+}
+
+func signedRequest(t *testing.T, body string) *http.Request {
+	req, err := http.NewRequest("PUT",
+		"http://example.amazonaws.com/bucket/a%20key?Param1=value1",
+		strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("X-Amz-Content-Sha256", hashHex(body))
+	Sign(req, suiteCreds, "us-east-1", "s3", hashHex(body), suiteTime)
+	// Headers added after signing aren't covered, and don't matter.
+	req.Header.Set("User-Agent", "test")
+	return req
+}
+
+func TestVerify(t *testing.T) {
+	req := signedRequest(t, "hello")
+	key, err := Verify(req, suiteSecret, suiteTime.Add(time.Minute))
+	if err != nil || key != suiteCreds.AccessKey {
+		t.Fatalf("Expected to verify as %v, got %q, %v",
+			suiteCreds.AccessKey, key, err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(*http.Request)
+		now    time.Time
+		exp    error
+	}{
+		{"unsigned", func(r *http.Request) { r.Header.Del("Authorization") },
+			suiteTime, ErrNotSigned},
+		{"bearer", func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer tok")
+		}, suiteTime, ErrNotSigned},
+		{"signed header changed", func(r *http.Request) {
+			r.Header.Set("Content-Type", "text/html")
+		}, suiteTime, ErrBadSignature},
+		{"path changed", func(r *http.Request) { r.URL.Path = "/bucket/other" },
+			suiteTime, ErrBadSignature},
+		{"query changed", func(r *http.Request) { r.URL.RawQuery = "" },
+			suiteTime, ErrBadSignature},
+		{"method changed", func(r *http.Request) { r.Method = "DELETE" },
+			suiteTime, ErrBadSignature},
+		{"unknown key", func(r *http.Request) {
+			r.Header.Set("Authorization", strings.Replace(
+				r.Header.Get("Authorization"), "AKIDEXAMPLE", "NOBODY", 1))
+		}, suiteTime, ErrUnknownKey},
+		{"no date", func(r *http.Request) { r.Header.Del("X-Amz-Date") },
+			suiteTime, ErrMalformed},
+		{"stale", func(r *http.Request) {}, suiteTime.Add(time.Hour), ErrSkewed},
+		{"early", func(r *http.Request) {}, suiteTime.Add(-time.Hour), ErrSkewed},
+	}
+	for _, test := range tests {
+		req := signedRequest(t, "hello")
+		test.change(req)
+		if _, err := Verify(req, suiteSecret, test.now); err != test.exp {
+			t.Errorf("%v: expected %v, got %v", test.name, test.exp, err)
+		}
+	}
+}
+
+func TestParseAuthorization(t *testing.T) {
+	a, err := ParseAuthorization("AWS4-HMAC-SHA256 Credential=AK/20150830/us-east-1/s3/aws4_request, SignedHeaders=host;x-amz-date, Signature=abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.AccessKey != "AK" || a.Day != "20150830" || a.Region != "us-east-1" ||
+		a.Service != "s3" || strings.Join(a.SignedHeaders, ";") != "host;x-amz-date" ||
+		a.Signature != "abc" {
+		t.Errorf("Parsed wrong: %+v", a)
+	}
+
+	for _, h := range []string{
+		"AWS4-HMAC-SHA256 Credential=AK/20150830/us-east-1/s3, SignedHeaders=host, Signature=abc",
+		"AWS4-HMAC-SHA256 Credential=AK/20150830/us-east-1/s3/aws4_request, Signature=abc",
+		"AWS4-HMAC-SHA256 garbage",
+	} {
+		if _, err := ParseAuthorization(h); err != ErrMalformed {
+			t.Errorf("Expected %q to be malformed, got %v", h, err)
+		}
+	}
+}
+
+func TestCheckPayload(t *testing.T) {
+	body := func(s string) *http.Request {
+		req, _ := http.NewRequest("PUT", "http://x/", strings.NewReader(s))
+		return req
+	}
+
+	data, err := ioutil.ReadAll(CheckPayload(body("hello").Body, hashHex("hello")))
+	if err != nil || string(data) != "hello" {
+		t.Errorf("Expected a matching body through, got %q, %v", data, err)
+	}
+	_, err = ioutil.ReadAll(CheckPayload(body("hellO").Body, hashHex("hello")))
+	if err != ErrBadPayload {
+		t.Errorf("Expected %v, got %v", ErrBadPayload, err)
+	}
+	for _, h := range []string{"UNSIGNED-PAYLOAD",
+		"STREAMING-AWS4-HMAC-SHA256-PAYLOAD"} {
+		data, err = ioutil.ReadAll(CheckPayload(body("any").Body, h))
+		if err != nil || string(data) != "any" {
+			t.Errorf("Expected %v to pass the body through, got %q, %v",
+				h, data, err)
+		}
+	}
+}
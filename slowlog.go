@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samuel/go-metrics/metrics"
+)
+
+var slowLogFile = flag.String("slowLog", "",
+	"File to record requests slower than the slowRequestTime config in")
+
+// Set when -slowLog is given.
+var slowLog *jsonLogWriter
+
+// Requests for anything beyond this many endpoints are grouped
+// together, so junk requests can't grow the histograms without bound.
+const maxEndpoints = 256
+
+var (
+	endpointHistos   = map[string]metrics.Histogram{}
+	endpointHistosMu = sync.Mutex{}
+
+	expEndpoints = expvar.NewMap("endpoints")
+)
+
+func initSlowLog() {
+	if *slowLogFile == "" {
+		return
+	}
+	f, err := os.OpenFile(*slowLogFile,
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		log.Fatalf("Error opening slow request log: %v", err)
+	}
+	slowLog = &jsonLogWriter{w: f}
+}
+
+// What kind of request this is, for grouping latencies: the method
+// and either the API prefix or "file".
+func endpointName(req *http.Request) string {
+	p := req.URL.Path
+	if !strings.HasPrefix(p, "/.cbfs/") {
+		return req.Method + " file"
+	}
+	if i := strings.Index(p[len("/.cbfs/"):], "/"); i >= 0 {
+		p = p[:len("/.cbfs/")+i+1]
+	}
+	return req.Method + " " + p
+}
+
+// Rolling latencies (in milliseconds) of one endpoint, shown under
+// "endpoints" in /.cbfs/debug/.
+func endpointHisto(name string) metrics.Histogram {
+	endpointHistosMu.Lock()
+	defer endpointHistosMu.Unlock()
+	rv, ok := endpointHistos[name]
+	if !ok && len(endpointHistos) >= maxEndpoints {
+		name = "other"
+		rv, ok = endpointHistos[name]
+	}
+	if !ok {
+		rv = metrics.NewBiasedHistogram()
+		endpointHistos[name] = rv
+
+		expEndpoints.Set(name+"_ms", &metrics.HistogramExport{
+			Histogram:       rv,
+			Percentiles:     []float64{0.5, 0.9, 0.99, 0.999},
+			PercentileNames: []string{"p50", "p90", "p99", "p999"}})
+	}
+	return rv
+}
+
+// A request made to another node on behalf of one we're serving.
+type requestHop struct {
+	Node     string  `json:"node"`
+	Method   string  `json:"method"`
+	Path     string  `json:"path"`
+	Status   int     `json:"status,omitempty"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"duration"`
+}
+
+type requestTrace struct {
+	ctx  context.Context // carries the request's span, if tracing
+	mu   sync.Mutex
+	hops []requestHop
+}
+
+var (
+	tracesMu sync.Mutex
+	traces   = map[string]*requestTrace{}
+)
+
+// Start noting the requests made to other nodes carrying this
+// request ID.  Returns nil if it's already being traced.
+func startTrace(id string) *requestTrace {
+	tracesMu.Lock()
+	defer tracesMu.Unlock()
+	if _, ok := traces[id]; ok || id == "" {
+		return nil
+	}
+	rv := &requestTrace{}
+	traces[id] = rv
+	return rv
+}
+
+func endTrace(id string) {
+	tracesMu.Lock()
+	defer tracesMu.Unlock()
+	delete(traces, id)
+}
+
+func findTrace(id string) *requestTrace {
+	tracesMu.Lock()
+	defer tracesMu.Unlock()
+	return traces[id]
+}
+
+func (t *requestTrace) record(h requestHop) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.hops = append(t.hops, h)
+}
+
+func (t *requestTrace) recorded() []requestHop {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]requestHop{}, t.hops...)
+}
+
+// Notes requests to other nodes in the trace of the request they're
+// made for.
+type hopTransport struct {
+	base http.RoundTripper
+}
+
+func (t hopTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := findTrace(req.Header.Get(requestIDHeader))
+	if trace == nil {
+		return t.base.RoundTrip(req)
+	}
+	endSpan := func(int, error) {}
+	if tracing != nil && trace.ctx != nil {
+		// RoundTrippers mustn't modify the request they're given.
+		r := *req
+		r.Header = req.Header.Clone()
+		endSpan = tracing.clientSpan(trace.ctx, &r)
+		req = &r
+	}
+	start := time.Now()
+	res, err := t.base.RoundTrip(req)
+	h := requestHop{
+		Node:     req.URL.Host,
+		Method:   req.Method,
+		Path:     req.URL.Path,
+		Duration: time.Since(start).Seconds(),
+	}
+	if err != nil {
+		h.Error = err.Error()
+	} else {
+		h.Status = res.StatusCode
+	}
+	endSpan(h.Status, err)
+	trace.record(h)
+	return res, err
+}
+
+// Record how long a request took, writing it to the slow request log
+// if it was too long.
+func recordRequestTime(req *http.Request, rec *statusRecorder, id string,
+	trace *requestTrace, start time.Time) {
+
+	d := time.Since(start)
+	endpoint := endpointName(req)
+	endpointHisto(endpoint).Update(int64(d / time.Millisecond))
+
+	limit := globalConfig.SlowRequestTime
+	if slowLog == nil || limit <= 0 || d < limit {
+		return
+	}
+	r := map[string]interface{}{
+		"type":     "slow",
+		"id":       id,
+		"endpoint": endpoint,
+		"client":   clientAddr(req),
+		"method":   req.Method,
+		"path":     req.URL.Path,
+		"status":   rec.status,
+		"bytesIn":  req.ContentLength,
+		"bytesOut": rec.bytes,
+		"duration": d.Seconds(),
+	}
+	if req.URL.RawQuery != "" {
+		r["query"] = req.URL.RawQuery
+	}
+	if trace != nil {
+		r["hops"] = trace.recorded()
+	}
+	if err := slowLog.writeRecord(r); err != nil {
+		log.Printf("Error writing to the slow request log: %v", err)
+	}
+}
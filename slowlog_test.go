@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEndpointName(t *testing.T) {
+	tests := []struct {
+		method, path, exp string
+	}{
+		{"GET", "/some/file", "GET file"},
+		{"PUT", "/.cbfs/blob/abc", "PUT /.cbfs/blob/"},
+		{"GET", "/.cbfs/nodes/", "GET /.cbfs/nodes/"},
+		{"GET", "/.cbfs/ping", "GET /.cbfs/ping"},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, test.path, nil)
+		if err != nil {
+			t.Fatalf("Error making request: %v", err)
+		}
+		if got := endpointName(req); got != test.exp {
+			t.Errorf("Expected %v for %v %v, got %v",
+				test.exp, test.method, test.path, got)
+		}
+	}
+}
+
+type fakeRoundTripper int
+
+func (f fakeRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: int(f)}, nil
+}
+
+func TestSlowLog(t *testing.T) {
+	defer func(d time.Duration) { globalConfig.SlowRequestTime = d }(
+		globalConfig.SlowRequestTime)
+	defer func(l *jsonLogWriter) { slowLog = l }(slowLog)
+	buf := &bytes.Buffer{}
+	slowLog = &jsonLogWriter{w: buf}
+	globalConfig.SlowRequestTime = time.Hour
+
+	rt := hopTransport{fakeRoundTripper(206)}
+	h := instrumentHandler(func(w http.ResponseWriter, req *http.Request) {
+		preq, _ := http.NewRequest("GET", "http://other:8484/.cbfs/blob/abc", nil)
+		preq.Header.Set(requestIDHeader, req.Header.Get(requestIDHeader))
+		rt.RoundTrip(preq)
+		w.Write([]byte("hi"))
+	})
+
+	for _, slow := range []time.Duration{time.Hour, time.Nanosecond} {
+		globalConfig.SlowRequestTime = slow
+		req := httptest.NewRequest("GET", "/some/file?x=1", nil)
+		h(httptest.NewRecorder(), req)
+	}
+
+	var rec struct {
+		Type     string
+		Endpoint string
+		Query    string
+		BytesOut int64
+		Hops     []requestHop
+	}
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("Expected one slow request record, got %q: %v", buf, err)
+	}
+	if rec.Type != "slow" || rec.Endpoint != "GET file" || rec.Query != "x=1" ||
+		rec.BytesOut != 2 || len(rec.Hops) != 1 ||
+		rec.Hops[0].Node != "other:8484" || rec.Hops[0].Status != 206 {
+		t.Errorf("Unexpected slow request record: %+v", rec)
+	}
+	if len(traces) != 0 {
+		t.Errorf("Expected traces to be cleaned up, got %v", traces)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"archive/tar"
 	"compress/gzip"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 )
@@ -11,14 +12,6 @@ import (
 func doTarDocs(w http.ResponseWriter, req *http.Request,
 	path string) {
 
-	quit := make(chan bool)
-	defer close(quit)
-	ch := make(chan *namedFile)
-	cherr := make(chan error)
-
-	go pathGenerator(path, ch, cherr, quit)
-	go logErrors("tar", cherr)
-
 	w.Header().Set("Content-Disposition",
 		fmt.Sprintf("attachment; filename=%q", archiveFilename(path, "tar")))
 	w.Header().Set("Content-Type", "application/x-tar")
@@ -31,6 +24,18 @@ func doTarDocs(w http.ResponseWriter, req *http.Request,
 	}
 
 	w.WriteHeader(200)
+	writeTar(w, path)
+}
+
+// Write a tar of everything under path.
+func writeTar(w io.Writer, path string) {
+	quit := make(chan bool)
+	defer close(quit)
+	ch := make(chan *namedFile)
+	cherr := make(chan error)
+
+	go pathGenerator(path, ch, cherr, quit)
+	go logErrors("tar", cherr)
 
 	tw := tar.NewWriter(w)
 	for nf := range ch {
@@ -52,7 +57,7 @@ func doTarDocs(w http.ResponseWriter, req *http.Request,
 			continue
 		}
 
-		err = copyBlob(tw, nf.meta.OID)
+		err = copyFileContent(tw, nf.meta)
 		if err != nil {
 			log.Printf("Error copying blob for %v: %v",
 				nf.name, err)
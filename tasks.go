@@ -59,7 +59,7 @@ func init() {
 				return globalConfig.GCFreq
 			},
 			garbageCollectBlobs,
-			[]string{"ensureMinReplCount", "trimFullNodes"},
+			[]string{"ensureMinReplCount", "trimFullNodes", "rebalance"},
 		},
 		"ensureMinReplCount": {
 			func() time.Duration {
@@ -89,6 +89,83 @@ func init() {
 			trimFullNodes,
 			[]string{"ensureMinReplCount", "garbageCollectBlobs"},
 		},
+		"expireFiles": {
+			func() time.Duration {
+				return globalConfig.ExpireFreq
+			},
+			expireFiles,
+			nil,
+		},
+		"erasureEncode": {
+			func() time.Duration {
+				return globalConfig.ErasureFreq
+			},
+			erasureEncodeBlobs,
+			[]string{"garbageCollectBlobs", "erasureRepair"},
+		},
+		"checkZones": {
+			func() time.Duration {
+				return globalConfig.ZoneCheckFreq
+			},
+			checkZones,
+			[]string{"garbageCollectBlobs", "trimFullNodes"},
+		},
+		"drainNodes": {
+			func() time.Duration {
+				return globalConfig.DrainFreq
+			},
+			drainNodes,
+			[]string{"garbageCollectBlobs", "trimFullNodes"},
+		},
+		"rebalance": {
+			func() time.Duration {
+				return globalConfig.RebalanceFreq
+			},
+			rebalanceNodes,
+			[]string{"garbageCollectBlobs", "trimFullNodes", "drainNodes"},
+		},
+		"scheduledBackup": {
+			func() time.Duration {
+				return globalConfig.BackupFreq
+			},
+			scheduledBackup,
+			nil,
+		},
+		"erasureRepair": {
+			func() time.Duration {
+				return globalConfig.ErasureRepairFreq
+			},
+			repairErasureSets,
+			[]string{"erasureEncode"},
+		},
+		"migrateColdBlobs": {
+			func() time.Duration {
+				return globalConfig.TierFreq
+			},
+			migrateColdBlobs,
+			[]string{"garbageCollectBlobs", "trimFullNodes"},
+		},
+		"rehashBlobs": {
+			func() time.Duration {
+				return globalConfig.RehashFreq
+			},
+			rehashBlobs,
+			[]string{"garbageCollectBlobs"},
+		},
+		"mirror": {
+			func() time.Duration {
+				return globalConfig.MirrorFreq
+			},
+			runMirrors,
+			nil,
+		},
+		"reconcileDu": {
+			func() time.Duration {
+				return globalConfig.DuReconcileFreq
+			},
+			reconcileDu,
+			nil,
+		},
 	}
 
 	localPeriodicJobRecipes = map[string]*periodicJobRecipe{
@@ -141,6 +218,7 @@ type JobMarker struct {
 type TaskState struct {
 	State     string    `json:"state"`
 	Timestamp time.Time `json:"ts"`
+	Detail    string    `json:"detail,omitempty"`
 }
 
 type TaskList struct {
@@ -162,7 +240,7 @@ func setTaskState(task, state string) error {
 				return nil, nil
 			}
 		} else {
-			ob.Tasks[task] = TaskState{state, ts}
+			ob.Tasks[task] = TaskState{State: state, Timestamp: ts}
 		}
 		ob.Type = "tasks"
 		ob.Node = serverId
@@ -175,6 +253,32 @@ func setTaskState(task, state string) error {
 	return err
 }
 
+// Describe the progress of a running task.
+func setTaskDetail(task, detail string) error {
+	k := "/@" + serverId + "/tasks"
+
+	err := couchbase.Update(k, 0, func(in []byte) ([]byte, error) {
+		ob := TaskList{}
+		err := json.Unmarshal(in, &ob)
+		if err != nil {
+			return nil, cb.UpdateCancel
+		}
+		st, ok := ob.Tasks[task]
+		if !ok {
+			return nil, cb.UpdateCancel
+		}
+		st.Detail = detail
+		st.Timestamp = time.Now().UTC()
+		ob.Tasks[task] = st
+		return json.Marshal(ob)
+	})
+
+	if err == cb.UpdateCancel {
+		err = nil
+	}
+	return err
+}
+
 func listRunningTasks() (map[string]TaskList, error) {
 	nodes, err := findAllNodes()
 	if err != nil {
@@ -323,8 +427,8 @@ func validateLocal() error {
 
 func cleanupNode(node string) {
 	if globalConfig.NodeCleanCount < 1 {
-		log.Printf("Misconfigured cleaner (on %v): %v",
-			node, globalConfig)
+		log.Printf("Misconfigured cleaner (on %v): cleanCount=%v",
+			node, globalConfig.NodeCleanCount)
 		return
 	}
 
@@ -339,8 +443,11 @@ func cleanupNode(node string) {
 			Id  string
 			Doc struct {
 				Json struct {
-					Nodes   map[string]string
-					Garbage bool
+					Nodes    map[string]string
+					Garbage  bool
+					EC       *erasureSet
+					Shard    bool
+					Replicas int
 				}
 			}
 		}
@@ -369,7 +476,10 @@ func cleanupNode(node string) {
 			log.Printf("%v appears to be garbage during cleanup. Dropping",
 				r.Id[1:])
 			removeBlobOwnershipRecord(r.Id[1:], node)
-		} else if len(r.Doc.Json.Nodes) < globalConfig.MinReplicas {
+		} else if r.Doc.Json.EC != nil || r.Doc.Json.Shard {
+			// Erasure repair will rebuild lost shards.
+			removeBlobOwnershipRecord(r.Id[1:], node)
+		} else if len(r.Doc.Json.Nodes) < wantedReplicas(r.Doc.Json.Replicas) {
 			if !salvageBlob(r.Id[1:], node, 1, nodes) {
 				log.Printf("Queue is full during cleanup")
 				break
@@ -381,21 +491,26 @@ func cleanupNode(node string) {
 	}
 	log.Printf("Removed %v blobs from %v", foundRows, node)
 	if foundRows == 0 && len(viewRes.Errors) == 0 {
-		log.Printf("Removing node record: %v", node)
-		err = couchbase.Delete("/" + node)
-		if err != nil {
-			log.Printf("Error deleting %v node record: %v", node, err)
-		}
-		err = couchbase.Delete("/" + node + "/r")
-		if err != nil {
-			log.Printf("Error deleting %v node counter: %v", node, err)
-		}
-		err = removeFromNodeRegistry(node)
-		if err != nil {
-			log.Printf("Error deleting %v from registry: %v", node, err)
-		}
-		cleanNodeTaskMarkers(node)
+		forgetNode(node)
+	}
+}
+
+// Remove all record of a node that no longer holds anything.
+func forgetNode(node string) {
+	log.Printf("Removing node record: %v", node)
+	err := couchbase.Delete("/" + node)
+	if err != nil {
+		log.Printf("Error deleting %v node record: %v", node, err)
+	}
+	err = couchbase.Delete("/" + node + "/r")
+	if err != nil {
+		log.Printf("Error deleting %v node counter: %v", node, err)
 	}
+	err = removeFromNodeRegistry(node)
+	if err != nil {
+		log.Printf("Error deleting %v from registry: %v", node, err)
+	}
+	cleanNodeTaskMarkers(node)
 }
 
 func cleanNodeTaskMarkers(node string) {
@@ -434,7 +549,7 @@ func checkStaleNodes() error {
 	for _, node := range nl {
 		d := time.Since(node.Time)
 
-		if d > globalConfig.StaleNodeLimit {
+		if d > globalConfig.StaleNodeLimit && !node.Maintenance {
 			if node.IsLocal() {
 				log.Printf("Would've cleaned up myself after %v",
 					d)
@@ -554,6 +669,7 @@ func moveSomeOffOf(n StorageNode, nl NodeList) {
 				Json struct {
 					Nodes  map[string]string
 					Length int64
+					Pinned []string
 				}
 			}
 		}
@@ -578,6 +694,9 @@ func moveSomeOffOf(n StorageNode, nl NodeList) {
 	for _, row := range viewRes.Rows {
 		oid := row.Id[1:]
 		candidates := NodeList{}
+		if pinnedTo(row.Doc.Json.Pinned, n.name) {
+			continue
+		}
 
 		removed += row.Doc.Json.Length
 
@@ -627,7 +746,7 @@ func trimFullNodes() error {
 		return nil
 	}
 
-	hasSpace := nl.withAtLeast(globalConfig.TrimFullNodesSpace)
+	hasSpace := nl.accepting().withAtLeast(globalConfig.TrimFullNodesSpace)
 
 	if len(hasSpace) == 0 {
 		log.Printf("No needs have sufficient free space")
@@ -653,6 +772,20 @@ func garbageCollectBlobs() error {
 
 	log.Printf("Garbage collecting blobs without any file references")
 
+	run := gcRun{Node: serverId, Started: time.Now().UTC()}
+	err := collectGarbage(&run)
+	run.Finished = time.Now().UTC()
+	if err != nil {
+		run.Error = err.Error()
+	}
+	if err := recordGCRun(run); err != nil {
+		log.Printf("Error recording garbage collection: %v", err)
+	}
+	return err
+}
+
+func collectGarbage(run *gcRun) error {
+
 	backedup, err := loadExistingHashes()
 	if err != nil {
 		return err
@@ -660,7 +793,8 @@ func garbageCollectBlobs() error {
 
 	viewRes := struct {
 		Rows []struct {
-			Key []string
+			Key   []string
+			Value int64
 		}
 		Errors []cb.ViewError
 	}{}
@@ -670,7 +804,7 @@ func garbageCollectBlobs() error {
 		return err
 	}
 
-	count, skipped, inBackup := 0, 0, 0
+	pacer := newGCPacer()
 	startKey := "g"
 	done := false
 	for !done {
@@ -709,25 +843,33 @@ func garbageCollectBlobs() error {
 			case "file":
 				lastBlob = blobId
 			case "blob":
+				run.Scanned++
 				if blobId != lastBlob {
 					n, ok := nm[blobNode]
 					switch {
 					case blobNode == "":
+						// Erasure coded blobs are only forgotten
+						// once they're marked as garbage.
+						markGarbage(blobId)
 						removeBlobOwnershipRecord(blobId, serverId)
-						count++
+						run.Removed++
+						run.RemovedBytes += r.Value
+						pacer.removed(r.Value)
 					case ok:
 						if b, err := hex.DecodeString(blobId); err == nil &&
 							backedup.Contains(b) {
 
-							inBackup++
+							run.InBackup++
 						} else if okToClean(blobId) {
 							log.Printf("GC removing %v from %v", blobId, n)
 							queueBlobRemoval(n, blobId)
-							count++
+							run.Removed++
+							run.RemovedBytes += r.Value
+							pacer.removed(r.Value)
 						} else {
 							log.Printf("Not cleaning %v, recently used",
 								blobId)
-							skipped++
+							run.Skipped++
 						}
 					default:
 						log.Printf("No nodemap entry for %v",
@@ -741,10 +883,12 @@ func garbageCollectBlobs() error {
 			log.Printf("We lost the lock for garbage collecting.")
 			return errors.New("Lost lock")
 		}
+		setTaskDetail("garbageCollectBlobs", run.String())
 	}
 
-	log.Printf("Scheduled %d blobs for deletion, skipped %d, in backup %d",
-		count, skipped, inBackup)
+	log.Printf("Scheduled %d blobs (%d bytes) for deletion, skipped %d, in backup %d",
+		run.Removed, run.RemovedBytes, run.Skipped, run.InBackup)
+	recordGCStats(run.Removed, run.Skipped, run.InBackup)
 	return nil
 }
 
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	cb "github.com/couchbaselabs/go-couchbase"
+)
+
+var tier = flag.String("tier", "",
+	"Storage tier of this node: hot (the default) or cold")
+
+const (
+	hotTier       = "hot"
+	coldTier      = "cold"
+	tierReportKey = "/@tierReport"
+
+	// Don't rewrite a blob's access time more often than this.
+	accessGranularity = time.Hour
+)
+
+// Results of the last look for cold blobs.
+type tierReport struct {
+	Checked int       `json:"checked"`
+	Cold    int       `json:"cold"`
+	Moved   int       `json:"moved"`
+	Time    time.Time `json:"time"`
+}
+
+func (n StorageNode) tier() string {
+	if n.Tier == coldTier {
+		return coldTier
+	}
+	return hotTier
+}
+
+func (nl NodeList) inTier(t string) NodeList {
+	rv := NodeList{}
+	for _, n := range nl {
+		if n.tier() == t {
+			rv = append(rv, n)
+		}
+	}
+	return rv
+}
+
+// When a blob was last read or written.
+func (b BlobOwnership) lastAccess() time.Time {
+	t := b.latestReference()
+	if b.Accessed.After(t) {
+		t = b.Accessed
+	}
+	return t
+}
+
+// Pair up the hot copies of a cold blob with cold nodes to move them
+// to, as far as there are cold nodes to go around.
+func coldMoves(holders, nl NodeList, length int64) (from, to NodeList) {
+	hot := holders.inTier(hotTier)
+	cold := nl.inTier(coldTier).minus(holders)
+	for _, n := range cold.accepting().withAtLeast(length) {
+		if len(to) == len(hot) {
+			break
+		}
+		if time.Since(n.Time) < globalConfig.StaleNodeLimit {
+			to = append(to, n)
+		}
+	}
+	return hot[:len(to)], to
+}
+
+// Move copies of blobs nobody's read in a while to cold nodes.
+func migrateColdBlobs() error {
+	if globalConfig.ColdAfter <= 0 {
+		return nil
+	}
+	nl, err := findAllNodes()
+	if err != nil {
+		return err
+	}
+	if len(nl.inTier(coldTier)) == 0 {
+		return nil
+	}
+	nm := map[string]StorageNode{}
+	for _, n := range nl {
+		nm[n.name] = n
+	}
+
+	report := tierReport{Time: time.Now().UTC()}
+	cutoff := report.Time.Add(-globalConfig.ColdAfter)
+	params := map[string]interface{}{
+		"endkey":       cutoff.Format(time.RFC3339Nano),
+		"reduce":       false,
+		"include_docs": true,
+		"limit":        globalConfig.ReplicationCheckLimit,
+		"stale":        false,
+	}
+
+	for {
+		viewRes := struct {
+			Rows []struct {
+				Id  string
+				Key string
+				Doc struct {
+					Json BlobOwnership
+				}
+			}
+			Errors []cb.ViewError
+		}{}
+
+		err := couchbase.ViewCustom("cbfs", "blob_access", params, &viewRes)
+		if err != nil {
+			return err
+		}
+		if len(viewRes.Errors) > 0 {
+			return fmt.Errorf("View errors: %v", viewRes.Errors)
+		}
+
+		for _, r := range viewRes.Rows {
+			report.Checked++
+			b := r.Doc.Json
+			if b.lastAccess().After(cutoff) {
+				continue
+			}
+			holders := NodeList{}
+			for n := range b.Nodes {
+				// Pinned copies stay where they are.
+				if sn, ok := nm[n]; ok && !pinnedTo(b.Pinned, n) {
+					holders = append(holders, sn)
+				}
+			}
+			from, to := coldMoves(holders, nl, b.Length)
+			if len(from) > 0 {
+				report.Cold++
+			}
+			oid := r.Id[1:]
+			for i := range from {
+				if maybeQueueBlobAcquire(to[i], oid, from[i].name) {
+					log.Printf("Moving cold %v from %v to %v",
+						oid, from[i], to[i])
+					report.Moved++
+				}
+			}
+		}
+
+		if !relockTask("migrateColdBlobs") {
+			return errors.New("Lost lock")
+		}
+		if len(viewRes.Rows) < globalConfig.ReplicationCheckLimit {
+			break
+		}
+		last := viewRes.Rows[len(viewRes.Rows)-1]
+		params["startkey"] = last.Key
+		params["startkey_docid"] = last.Id
+		params["skip"] = 1
+	}
+
+	log.Printf("Checked tiers of %v blobs: %v cold, %v moving",
+		report.Checked, report.Cold, report.Moved)
+	return couchbase.Set(tierReportKey, 0, report)
+}
+
+// Note that a blob's been read, bringing it back to the hot tier if
+// it had gone cold.
+func noteBlobRead(oid string) {
+	if globalConfig.ColdAfter <= 0 {
+		return
+	}
+	now := time.Now().UTC()
+	ownership := BlobOwnership{}
+	wasCold := false
+	err := couchbase.Update("/"+oid, 0, func(in []byte) ([]byte, error) {
+		ownership = BlobOwnership{}
+		if err := json.Unmarshal(in, &ownership); err != nil {
+			return nil, cb.UpdateCancel
+		}
+		idle := now.Sub(ownership.lastAccess())
+		if idle < accessGranularity {
+			return nil, cb.UpdateCancel
+		}
+		wasCold = idle > globalConfig.ColdAfter
+		ownership.Accessed = now
+		return json.Marshal(ownership)
+	})
+	if err == cb.UpdateCancel {
+		return
+	}
+	if err != nil {
+		log.Printf("Error recording access of %v: %v", oid, err)
+		return
+	}
+	if wasCold {
+		promoteBlob(oid, ownership)
+	}
+}
+
+// Have a hot node take a copy of a blob only cold nodes have.
+func promoteBlob(oid string, b BlobOwnership) {
+	nl, err := findAllNodes()
+	if err != nil {
+		log.Printf("Error finding nodes to promote %v: %v", oid, err)
+		return
+	}
+	holders := NodeList{}
+	for _, n := range nl {
+		if _, ok := b.Nodes[n.name]; ok {
+			holders = append(holders, n)
+		}
+	}
+	if len(holders.inTier(hotTier)) > 0 {
+		return
+	}
+	hot := nl.inTier(hotTier).minus(holders)
+	for _, n := range hot.accepting().withAtLeast(b.Length) {
+		if maybeQueueBlobAcquire(n, oid, "") {
+			log.Printf("Promoting %v to %v", oid, n)
+			return
+		}
+	}
+}
+
+// How full each tier is.
+type tierStats struct {
+	Nodes []string `json:"nodes"`
+	Used  int64    `json:"used"`
+	Free  int64    `json:"free"`
+}
+
+func doListTiers(w http.ResponseWriter, req *http.Request) {
+	nl, err := findAllNodes()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	tiers := map[string]*tierStats{}
+	for _, n := range nl {
+		ts := tiers[n.tier()]
+		if ts == nil {
+			ts = &tierStats{}
+			tiers[n.tier()] = ts
+		}
+		ts.Nodes = append(ts.Nodes, n.name)
+		ts.Used += n.Used
+		ts.Free += n.Free
+	}
+	for _, ts := range tiers {
+		sort.Strings(ts.Nodes)
+	}
+
+	report := tierReport{}
+	if err := couchbase.Get(tierReportKey, &report); err != nil {
+		log.Printf("Error getting tier report: %v", err)
+	}
+
+	sendJson(w, req, map[string]interface{}{
+		"tiers":  tiers,
+		"report": report,
+	})
+}
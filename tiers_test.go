@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestColdMoves(t *testing.T) {
+	now := time.Now()
+	mk := func(name, tier string) StorageNode {
+		return StorageNode{name: name, Tier: tier, Time: now, Free: 1 << 30}
+	}
+	nl := NodeList{mk("h1", ""), mk("h2", "hot"), mk("h3", ""),
+		mk("c1", "cold"), mk("c2", "cold")}
+	stale := mk("c3", "cold")
+	stale.Time = now.Add(-2 * globalConfig.StaleNodeLimit)
+	nl = append(nl, stale)
+
+	tests := []struct {
+		holders  NodeList
+		from, to string
+	}{
+		{NodeList{nl[0], nl[1]}, "[h1 h2]", "[c1 c2]"},
+		{NodeList{nl[0], nl[1], nl[2]}, "[h1 h2]", "[c1 c2]"},
+		{NodeList{nl[0], nl[3]}, "[h1]", "[c2]"},
+		{NodeList{nl[3], nl[4]}, "[]", "[]"},
+	}
+
+	for _, test := range tests {
+		from, to := coldMoves(test.holders, nl, 1024)
+		gotFrom := fmt.Sprint(nodeNames(from))
+		gotTo := fmt.Sprint(nodeNames(to))
+		if gotFrom != test.from || gotTo != test.to {
+			t.Errorf("Expected %v -> %v for %v, got %v -> %v",
+				test.from, test.to, nodeNames(test.holders),
+				gotFrom, gotTo)
+		}
+	}
+}
+
+func TestLastAccess(t *testing.T) {
+	written := time.Now().Add(-48 * time.Hour)
+	read := written.Add(time.Hour)
+	b := BlobOwnership{Nodes: map[string]time.Time{"n1": written}}
+	if got := b.lastAccess(); !got.Equal(written) {
+		t.Errorf("Expected unread blob's last access at %v, got %v",
+			written, got)
+	}
+	b.Accessed = read
+	if got := b.lastAccess(); !got.Equal(read) {
+		t.Errorf("Expected last access at %v, got %v", read, got)
+	}
+}
@@ -61,7 +61,7 @@ func TimeoutTransport(timeout time.Duration) *http.Transport {
 	if dt > time.Minute {
 		dt = time.Minute
 	}
-	return &http.Transport{
+	t := &http.Transport{
 		Proxy:             http.ProxyFromEnvironment,
 		DisableKeepAlives: true,
 		Dial: func(n, addr string) (net.Conn, error) {
@@ -69,4 +69,6 @@ func TimeoutTransport(timeout time.Duration) *http.Transport {
 			return &timeoutConn{conn, timeout}, err
 		},
 	}
+	setTransportTLS(t)
+	return t
 }
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+)
+
+var tlsCert = flag.String("tlsCert", "",
+	"TLS certificate file; enables https for clients and other nodes")
+var tlsKey = flag.String("tlsKey", "", "TLS private key file")
+var tlsCA = flag.String("tlsCA", "",
+	"CA certificates for verifying peers (default: system roots)")
+var tlsClientAuth = flag.Bool("tlsClientAuth", false,
+	"Require clients to present a certificate signed by -tlsCA")
+var tlsSkipVerify = flag.Bool("tlsSkipVerify", false,
+	"Don't verify other nodes' certificates (testing only)")
+
+var (
+	tlsOnce    sync.Once
+	tlsServer  *tls.Config
+	tlsClient  *tls.Config
+	tlsInitErr error
+)
+
+func tlsEnabled() bool {
+	return *tlsCert != ""
+}
+
+func initTLS() {
+	if !tlsEnabled() {
+		return
+	}
+
+	cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+	if err != nil {
+		tlsInitErr = err
+		return
+	}
+
+	var pool *x509.CertPool
+	if *tlsCA != "" {
+		pem, err := ioutil.ReadFile(*tlsCA)
+		if err != nil {
+			tlsInitErr = err
+			return
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			tlsInitErr = errors.New("no certificates found in " + *tlsCA)
+			return
+		}
+	}
+
+	tlsServer = &tls.Config{Certificates: []tls.Certificate{cert}}
+	if *enableHTTP2 {
+		tlsServer.NextProtos = []string{"h2", "http/1.1"}
+	}
+	if *tlsClientAuth {
+		if pool == nil {
+			tlsInitErr = errors.New("-tlsClientAuth requires -tlsCA")
+			return
+		}
+		tlsServer.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsServer.ClientCAs = pool
+	}
+
+	// Present our own certificate to other nodes in case they
+	// require client certificates.
+	tlsClient = &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		RootCAs:            pool,
+		InsecureSkipVerify: *tlsSkipVerify,
+	}
+}
+
+// TLS configuration for our listeners, or nil if TLS is off.
+func serverTLSConfig() *tls.Config {
+	tlsOnce.Do(initTLS)
+	if tlsInitErr != nil {
+		log.Fatalf("Error setting up TLS: %v", tlsInitErr)
+	}
+	return tlsServer
+}
+
+// TLS configuration for talking to other nodes, or nil if TLS is off.
+func clientTLSConfig() *tls.Config {
+	serverTLSConfig()
+	return tlsClient
+}
+
+// Scheme this node serves requests on.
+func localScheme() string {
+	if tlsEnabled() {
+		return "https"
+	}
+	return "http"
+}
+
+func maybeTLSListener(l net.Listener) net.Listener {
+	if conf := serverTLSConfig(); conf != nil {
+		return tls.NewListener(l, conf)
+	}
+	return l
+}
+
+func dialNode(addr string, dialer *net.Dialer) (net.Conn, error) {
+	if conf := clientTLSConfig(); conf != nil {
+		return tls.DialWithDialer(dialer, "tcp", addr, conf)
+	}
+	return dialer.Dial("tcp", addr)
+}
+
+// Transport settings for https to other nodes.
+func setTransportTLS(t *http.Transport) {
+	if conf := clientTLSConfig(); conf != nil {
+		t.TLSClientConfig = conf
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/tools"
+)
+
+type revisionMeta struct {
+	Headers  map[string][]string `json:"headers"`
+	OID      string              `json:"oid"`
+	Length   int64               `json:"length"`
+	Modified time.Time           `json:"modified"`
+	Revno    int                 `json:"revno"`
+	Parts    *json.RawMessage    `json:"parts,omitempty"`
+}
+
+// Rewrite backed up file metadata to describe the file as it was at
+// t, using its recorded older revisions.  Returns false if the file
+// didn't exist yet (or its history doesn't go back that far).
+func metaAsOf(m *json.RawMessage, t time.Time) (*json.RawMessage, bool, error) {
+	cur := struct {
+		revisionMeta
+		Older []revisionMeta `json:"older"`
+	}{}
+	if err := json.Unmarshal(*m, &cur); err != nil {
+		return nil, false, err
+	}
+	if !cur.Modified.After(t) {
+		return m, true, nil
+	}
+
+	var chosen *revisionMeta
+	for i, r := range cur.Older {
+		if !r.Modified.After(t) && (chosen == nil || r.Revno > chosen.Revno) {
+			chosen = &cur.Older[i]
+		}
+	}
+	if chosen == nil {
+		return nil, false, nil
+	}
+
+	// Keep anything else (userdata, expiration, etc) as it was.
+	doc := map[string]interface{}{}
+	if err := json.Unmarshal(*m, &doc); err != nil {
+		return nil, false, err
+	}
+	doc["headers"] = chosen.Headers
+	doc["oid"] = chosen.OID
+	doc["length"] = chosen.Length
+	doc["modified"] = chosen.Modified
+	doc["revno"] = chosen.Revno
+	delete(doc, "ctype")
+	if ct := chosen.Headers["Content-Type"]; len(ct) > 0 {
+		doc["ctype"] = ct[0]
+	}
+	if chosen.Parts != nil {
+		doc["parts"] = chosen.Parts
+	} else {
+		delete(doc, "parts")
+	}
+
+	older := []revisionMeta{}
+	for _, r := range cur.Older {
+		if r.Revno < chosen.Revno {
+			older = append(older, r)
+		}
+	}
+	if len(older) > 0 {
+		doc["older"] = older
+	} else {
+		delete(doc, "older")
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, false, err
+	}
+	rv := json.RawMessage(data)
+	return &rv, true, nil
+}
+
+// Point a restore item at the revision current at t (if t is set),
+// reporting whether there was one.
+func existedAt(ob *restoreWorkItem, t time.Time) bool {
+	if t.IsZero() || ob.Meta == nil {
+		return true
+	}
+	m, ok, err := metaAsOf(ob.Meta, t)
+	switch {
+	case err != nil:
+		log.Printf("Error reading metadata of %v: %v", ob.Path, err)
+	case !ok:
+		cbfstool.Verbose(*restoreVerbose, "%v has no revision as of %v",
+			ob.Path, t)
+	default:
+		ob.Meta = m
+	}
+	return ok
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestMetaAsOf(t *testing.T) {
+	doc := json.RawMessage(`{
+  "oid": "c3", "length": 3, "revno": 3, "type": "file",
+  "modified": "2014-03-03T00:00:00Z",
+  "headers": {"Content-Type": ["text/plain"]},
+  "ctype": "text/plain",
+  "userdata": {"x": 1},
+  "older": [
+    {"oid": "c1", "length": 1, "revno": 1, "modified": "2014-03-01T00:00:00Z",
+     "headers": {"Content-Type": ["text/html"]}},
+    {"oid": "c2", "length": 2, "revno": 2, "modified": "2014-03-02T00:00:00Z",
+     "parts": [{"oid": "p1", "length": 2}]}
+  ]
+}`)
+
+	day := func(d int) time.Time {
+		return time.Date(2014, 3, d, 12, 0, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		at     time.Time
+		exists bool
+		oid    string
+		ctype  interface{}
+		nolder int
+		parts  bool
+	}{
+		{day(3), true, "c3", "text/plain", 2, false},
+		{day(2), true, "c2", nil, 1, true},
+		{day(1), true, "c1", "text/html", 0, false},
+		{time.Date(2014, 2, 28, 0, 0, 0, 0, time.UTC), false, "", nil, 0, false},
+	}
+
+	for _, test := range tests {
+		m, ok, err := metaAsOf(&doc, test.at)
+		if err != nil {
+			t.Fatalf("Error at %v: %v", test.at, err)
+		}
+		if ok != test.exists {
+			t.Errorf("Expected exists=%v at %v, got %v", test.exists, test.at, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		got := map[string]interface{}{}
+		if err := json.Unmarshal(*m, &got); err != nil {
+			t.Fatalf("Error decoding result at %v: %v", test.at, err)
+		}
+		older, _ := got["older"].([]interface{})
+		_, hasParts := got["parts"]
+		if got["oid"] != test.oid || got["ctype"] != test.ctype ||
+			len(older) != test.nolder || hasParts != test.parts {
+			t.Errorf("Expected %v/%v/%v older/parts=%v at %v, got %v",
+				test.oid, test.ctype, test.nolder, test.parts, test.at, got)
+		}
+		if got["userdata"] == nil {
+			t.Errorf("Expected userdata to be kept at %v, got %v", test.at, got)
+		}
+	}
+}
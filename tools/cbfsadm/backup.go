@@ -17,12 +17,21 @@ import (
 
 var backupFlags = flag.NewFlagSet("backup", flag.ExitOnError)
 var backupWait = backupFlags.Bool("w", false, "Wait for backup to complete")
+var backupParent = backupFlags.String("parent", "",
+	"Previous backup to make an incremental backup against")
+var backupEncrypt = backupFlags.Bool("encrypt", false,
+	"Encrypt the backup with -passphrase or -keyfile (send it over https)")
+var backupSecretFlags = newSecretFlags(backupFlags)
+var backupWithData = backupFlags.Bool("with-data", false,
+	"Write blob contents along with metadata to a local bundle file")
 
 type Backup struct {
-	Filename string
-	OID      string
-	When     time.Time
-	Conf     cbfsconfig.CBFSConfig
+	Filename  string
+	OID       string
+	When      time.Time
+	Parent    string
+	Encrypted bool
+	Conf      cbfsconfig.CBFSConfig
 }
 
 func backupCommand(ustr string, args []string) {
@@ -36,11 +45,37 @@ func backupCommand(ustr string, args []string) {
 		"fn": []string{fn},
 		"bg": []string{strconv.FormatBool(*backupWait == false)},
 	}
+	if *backupParent != "" {
+		form.Set("parent", *backupParent)
+	}
+	secret, err := backupSecretFlags.secret()
+	cbfstool.MaybeFatal(err, "Error getting backup secret: %v", err)
+	switch {
+	case *backupEncrypt && secret == nil:
+		log.Fatalf("-encrypt needs -passphrase or -keyfile")
+	case !*backupEncrypt && secret != nil:
+		log.Fatalf("-passphrase and -keyfile are for -encrypt")
+	case *backupEncrypt:
+		form.Set("secret", string(secret))
+	}
+
+	if *backupWithData {
+		if *backupParent != "" {
+			log.Fatalf("-with-data bundles are always full backups")
+		}
+		backupBundle(ustr, fn, secret)
+		return
+	}
 
 	start := time.Now()
 	res, err := http.Post(u.String(),
 		"application/x-www-form-urlencoded",
 		strings.NewReader(form.Encode()))
+	if err != nil && cbfstool.Interrupted() {
+		log.Printf("Stopped waiting after %v; the backup to %v may still finish",
+			time.Since(start), fn)
+		os.Exit(cbfstool.ExitInterrupted)
+	}
 	cbfstool.MaybeFatal(err, "Error executing POST to %v - %v", u, err)
 
 	defer res.Body.Close()
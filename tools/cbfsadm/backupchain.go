@@ -0,0 +1,265 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// Leading record of an incremental backup.
+type backupManifest struct {
+	Parent  string    `json:"parent"`
+	Since   time.Time `json:"since"`
+	Created time.Time `json:"created"`
+}
+
+// Call f with each file record, stopping at its first error.
+func eachBackupRecord(d *json.Decoder, f func(restoreWorkItem) error) error {
+	for {
+		ob := restoreWorkItem{}
+		err := d.Decode(&ob)
+		switch err {
+		case nil:
+			if ob.Index != nil {
+				continue
+			}
+			if err := f(ob); err != nil {
+				return err
+			}
+		case io.EOF:
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+// Send every file in a backup to ch in backup file order.
+//
+// Incremental backups only carry metadata for files that changed
+// since their parent, so the rest are looked up in the parent chain
+// fetched from the cluster at base.  Indexed parents are read a few
+// blocks at a time as files come up; if any parent has no index, the
+// whole chain is worked out in memory first.
+func readBackup(base string, d *json.Decoder, ch chan<- restoreWorkItem) error {
+	defer close(ch)
+
+	first := restoreWorkItem{}
+	switch err := d.Decode(&first); err {
+	case nil:
+	case io.EOF:
+		return nil
+	default:
+		return err
+	}
+
+	if first.Manifest == nil || first.Manifest.Parent == "" {
+		if first.Manifest == nil && first.Index == nil {
+			ch <- first
+		}
+		return eachBackupRecord(d, func(ob restoreWorkItem) error {
+			ch <- ob
+			return nil
+		})
+	}
+
+	chain, err := openParentChain(base, first.Manifest.Parent)
+	if err != nil {
+		return err
+	}
+	if chain == nil {
+		return readBufferedChain(base, first.Manifest.Parent, d, ch)
+	}
+	defer closeParentChain(chain)
+	return eachBackupRecord(d, func(ob restoreWorkItem) error {
+		if ob.Meta == nil {
+			m, err := resolveFromChain(chain, ob.Path)
+			if err != nil {
+				return err
+			}
+			ob.Meta = m
+		}
+		ch <- ob
+		return nil
+	})
+}
+
+// Resolve an incremental backup against parents that can only be
+// read from start to end, holding every file's metadata until the
+// whole chain has been read.
+func readBufferedChain(base, parent string, d *json.Decoder,
+	ch chan<- restoreWorkItem) error {
+
+	order := []string{}
+	metas := map[string]*json.RawMessage{}
+	missing := map[string]bool{}
+	err := eachBackupRecord(d, func(ob restoreWorkItem) error {
+		order = append(order, ob.Path)
+		if ob.Meta != nil {
+			metas[ob.Path] = ob.Meta
+		} else {
+			missing[ob.Path] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for parent != "" && len(missing) > 0 {
+		log.Printf("Resolving %v files from parent backup %v",
+			len(missing), parent)
+		parent, err = resolveFromParent(base, parent, metas, missing)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, p := range order {
+		if _, ok := metas[p]; !ok {
+			return fmt.Errorf("no metadata for %v in any parent backup", p)
+		}
+	}
+	for _, p := range order {
+		ch <- restoreWorkItem{Path: p, Meta: metas[p]}
+	}
+	return nil
+}
+
+// Fill in metadata for missing files from the named backup, returning
+// the name of its own parent (if any).
+func resolveFromParent(base, fn string,
+	metas map[string]*json.RawMessage, missing map[string]bool) (string, error) {
+
+	src := "cbfs://" + strings.TrimLeft(fn, "/")
+	ix, ranges, err := openBackupIndex(base, src)
+	if err != nil {
+		return "", err
+	}
+	if ix != nil {
+		defer ranges.Close()
+		return resolveFromIndex(ix, ranges, metas, missing)
+	}
+
+	r, err := openPlainBackup(base, src)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return "", err
+	}
+	defer gz.Close()
+
+	next := ""
+	err = eachBackupRecord(json.NewDecoder(gz), func(ob restoreWorkItem) error {
+		switch {
+		case ob.Manifest != nil:
+			next = ob.Manifest.Parent
+		case ob.Meta != nil && missing[ob.Path]:
+			metas[ob.Path] = ob.Meta
+			delete(missing, ob.Path)
+		}
+		return nil
+	})
+	return next, err
+}
+
+// How many decoded blocks of each parent to keep while resolving an
+// incremental backup.  Backups list files in much the same order, so
+// the next file left out is usually in a block that's just been read.
+const parentBlockCache = 4
+
+// An indexed parent backup, read a block at a time for the files an
+// incremental backup left out.
+type parentBackup struct {
+	ix     *backupIndex
+	ranges backupRanges
+	// Which block each path is in
+	blocks map[string]int
+	// Most recently read last
+	cached []parentBlock
+}
+
+type parentBlock struct {
+	n     int
+	metas map[string]*json.RawMessage
+}
+
+// The metadata the parent has for path, or nil if it doesn't have
+// the file or left it out too.
+func (p *parentBackup) meta(path string) (*json.RawMessage, error) {
+	n, ok := p.blocks[path]
+	if !ok {
+		return nil, nil
+	}
+	for _, b := range p.cached {
+		if b.n == n {
+			return b.metas[path], nil
+		}
+	}
+
+	items, err := readBackupBlock(p.ranges, p.ix.Blocks[n])
+	if err != nil {
+		return nil, err
+	}
+	b := parentBlock{n, map[string]*json.RawMessage{}}
+	for _, ob := range items {
+		b.metas[ob.Path] = ob.Meta
+	}
+	if len(p.cached) == parentBlockCache {
+		p.cached = p.cached[1:]
+	}
+	p.cached = append(p.cached, b)
+	return b.metas[path], nil
+}
+
+// Open the named backup and its parents by their indexes.  Returns
+// nil if any of them doesn't have one.
+func openParentChain(base, fn string) ([]*parentBackup, error) {
+	chain := []*parentBackup{}
+	for fn != "" {
+		src := "cbfs://" + strings.TrimLeft(fn, "/")
+		ix, ranges, err := openBackupIndex(base, src)
+		if err != nil || ix == nil {
+			closeParentChain(chain)
+			return nil, err
+		}
+		p := &parentBackup{ix: ix, ranges: ranges, blocks: map[string]int{}}
+		for n, b := range ix.Blocks {
+			for _, path := range b.Paths {
+				p.blocks[path] = n
+			}
+		}
+		chain = append(chain, p)
+
+		fn = ""
+		if ix.Manifest != nil {
+			fn = ix.Manifest.Parent
+		}
+	}
+	return chain, nil
+}
+
+func closeParentChain(chain []*parentBackup) {
+	for _, p := range chain {
+		p.ranges.Close()
+	}
+}
+
+// Find path's metadata in the nearest parent that has it.
+func resolveFromChain(chain []*parentBackup, path string) (*json.RawMessage, error) {
+	for _, p := range chain {
+		m, err := p.meta(path)
+		if err != nil || m != nil {
+			return m, err
+		}
+	}
+	return nil, fmt.Errorf("no metadata for %v in any parent backup", path)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Write a plain (version 1) backup of the given files.
+func writePlainBackup(manifest *backupManifest, items []restoreWorkItem) []byte {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	e := json.NewEncoder(gz)
+	if manifest != nil {
+		e.Encode(map[string]interface{}{"manifest": manifest})
+	}
+	for _, ob := range items {
+		e.Encode(map[string]interface{}{"path": ob.Path, "meta": ob.Meta})
+	}
+	gz.Close()
+	return buf.Bytes()
+}
+
+func readTestBackup(t *testing.T, base string, data []byte) (string, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error uncompressing backup: %v", err)
+	}
+	ch := make(chan restoreWorkItem)
+	errch := make(chan error, 1)
+	go func() { errch <- readBackup(base, json.NewDecoder(gz), ch) }()
+
+	got := []string{}
+	for ob := range ch {
+		m := struct{ OID string }{}
+		if ob.Meta != nil {
+			json.Unmarshal(*ob.Meta, &m)
+		}
+		got = append(got, ob.Path+"="+m.OID)
+	}
+	return strings.Join(got, " "), <-errch
+}
+
+func TestReadIncrementalBackup(t *testing.T) {
+	f := func(p, oid string) restoreWorkItem {
+		ob := restoreWorkItem{Path: p}
+		if oid != "" {
+			ob.Meta = oidMeta(oid)
+		}
+		return ob
+	}
+
+	backups := map[string][]byte{
+		"/full": writeBackupV2(t, nil, [][]restoreWorkItem{
+			{f("a/1", "g1"), f("a/2", "g2")},
+			{f("b/1", "g3"), f("b/2", "g4")},
+		}),
+		"/inc1": writeBackupV2(t, &backupManifest{Parent: "full"},
+			[][]restoreWorkItem{
+				{f("a/1", ""), f("a/2", "p2")},
+				{f("b/1", ""), f("b/2", "p4")},
+			}),
+		"/old": writePlainBackup(nil,
+			[]restoreWorkItem{f("a/1", "v1"), f("a/2", "v2")}),
+	}
+	reads := map[string]int{}
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			data, ok := backups[req.URL.Path]
+			if !ok {
+				http.NotFound(w, req)
+				return
+			}
+			reads[req.URL.Path]++
+			http.ServeContent(w, req, req.URL.Path, time.Time{},
+				bytes.NewReader(data))
+		}))
+	defer ts.Close()
+
+	// Files left out are found in the nearest indexed parent that has
+	// them, reading only the blocks they're in.
+	got, err := readTestBackup(t, ts.URL, writePlainBackup(
+		&backupManifest{Parent: "inc1"}, []restoreWorkItem{
+			f("a/1", ""), f("a/2", ""), f("b/1", "c3"),
+		}))
+	if exp := "a/1=g1 a/2=p2 b/1=c3"; err != nil || got != exp {
+		t.Errorf("Expected %v, got %v, %v", exp, got, err)
+	}
+	// Each reads its tail and index, then just the first block.
+	if reads["/full"] != 3 || reads["/inc1"] != 3 {
+		t.Errorf("Expected only the blocks needed read, got %v", reads)
+	}
+
+	_, err = readTestBackup(t, ts.URL, writePlainBackup(
+		&backupManifest{Parent: "inc1"}, []restoreWorkItem{f("c/1", "")}))
+	if err == nil || !strings.Contains(err.Error(), "c/1") {
+		t.Errorf("Expected an error for a file no parent has, got %v", err)
+	}
+
+	// Parents without an index are still read the old way.
+	got, err = readTestBackup(t, ts.URL, writePlainBackup(
+		&backupManifest{Parent: "old"}, []restoreWorkItem{
+			f("a/2", "c2"), f("a/1", ""),
+		}))
+	if exp := "a/2=c2 a/1=v1"; err != nil || got != exp {
+		t.Errorf("Expected %v, got %v, %v", exp, got, err)
+	}
+}
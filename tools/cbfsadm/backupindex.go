@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+// Version 2 backups are gzip members of up to a thousand records
+// each, then a member holding an index of the paths in each, then a
+// trailer member whose gzip header says where the index starts.  The
+// trailer is the last few dozen bytes; this is plenty to find it in.
+const backupTailLen = 64
+
+// Marks the gzip header subfield holding the index offset.
+const backupTrailerID = "CB"
+
+type backupIndexBlock struct {
+	Offset int64    `json:"offset"`
+	Length int64    `json:"length"`
+	Paths  []string `json:"paths"`
+}
+
+type backupIndex struct {
+	Version  int                `json:"version"`
+	Manifest *backupManifest    `json:"manifest"`
+	Blocks   []backupIndexBlock `json:"blocks"`
+}
+
+// A backup that can be read a range at a time.
+type backupRanges interface {
+	readRange(off, n int64) (io.ReadCloser, error)
+	Close() error
+}
+
+type fileRanges struct {
+	f *os.File
+}
+
+func (r fileRanges) readRange(off, n int64) (io.ReadCloser, error) {
+	return ioutil.NopCloser(io.NewSectionReader(r.f, off, n)), nil
+}
+
+func (r fileRanges) Close() error {
+	return r.f.Close()
+}
+
+// Reads ranges of a backup over HTTP.
+type httpRanges struct {
+	base, src string
+}
+
+var errNoRanges = errors.New("source can't send ranges")
+
+// Fetch the given Range, returning the response.
+func (r httpRanges) get(rng string) (*http.Response, error) {
+	req, err := backupRequest(r.base, r.src)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", rng)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 206 {
+		res.Body.Close()
+		if res.StatusCode == 200 {
+			return nil, errNoRanges
+		}
+		return nil, fmt.Errorf("error fetching %v of %v: %v",
+			rng, r.src, res.Status)
+	}
+	return res, nil
+}
+
+func (r httpRanges) readRange(off, n int64) (io.ReadCloser, error) {
+	res, err := r.get(fmt.Sprintf("bytes=%d-%d", off, off+n-1))
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (r httpRanges) Close() error {
+	return nil
+}
+
+// Find where the index starts from the end of a backup, reporting
+// whether there is one.
+func parseBackupTrailer(tail []byte) (int64, bool) {
+	for i := len(tail) - 18; i >= 0; i-- {
+		// A gzip member header with just FEXTRA set, and a 12 byte
+		// extra field holding our subfield.
+		if tail[i] != 0x1f || tail[i+1] != 0x8b || tail[i+2] != 8 ||
+			tail[i+3] != 4 || tail[i+10] != 12 || tail[i+11] != 0 ||
+			string(tail[i+12:i+14]) != backupTrailerID {
+			continue
+		}
+		gz, err := gzip.NewReader(bytes.NewReader(tail[i:]))
+		if err != nil {
+			continue
+		}
+		x := gz.Header.Extra
+		if len(x) == 12 {
+			return int64(binary.LittleEndian.Uint64(x[4:])), true
+		}
+	}
+	return 0, false
+}
+
+// Open a backup for reading a range at a time, returning its index.
+// The index is nil for backups without one and for sources that can't
+// send ranges; those can only be read from start to end.
+func openBackupIndex(base, src string) (*backupIndex, backupRanges, error) {
+	var r backupRanges
+	var tail []byte
+	var size int64
+	if isLocalSource(src) {
+		f, err := os.Open(src)
+		if err != nil {
+			return nil, nil, err
+		}
+		st, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		size = st.Size()
+		n := int64(backupTailLen)
+		if size < n {
+			n = size
+		}
+		tail = make([]byte, n)
+		if _, err := f.ReadAt(tail, size-n); err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		r = fileRanges{f}
+	} else {
+		hr := httpRanges{base, src}
+		res, err := hr.get(fmt.Sprintf("bytes=-%d", backupTailLen))
+		if err == errNoRanges {
+			return nil, nil, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		defer res.Body.Close()
+		tail, err = ioutil.ReadAll(res.Body)
+		if err != nil {
+			return nil, nil, err
+		}
+		size, err = contentRangeSize(res.Header.Get("Content-Range"))
+		if err != nil {
+			return nil, nil, err
+		}
+		r = hr
+	}
+
+	at, ok := parseBackupTrailer(tail)
+	if !ok || at >= size {
+		r.Close()
+		return nil, nil, nil
+	}
+	rc, err := r.readRange(at, size-at)
+	if err != nil {
+		r.Close()
+		return nil, nil, err
+	}
+	defer rc.Close()
+	gz, err := gzip.NewReader(rc)
+	if err != nil {
+		r.Close()
+		return nil, nil, err
+	}
+	gz.Multistream(false)
+	ix := struct{ Index *backupIndex }{}
+	if err := json.NewDecoder(gz).Decode(&ix); err != nil || ix.Index == nil {
+		r.Close()
+		return nil, nil, fmt.Errorf("error reading index of %v: %v", src, err)
+	}
+	return ix.Index, r, nil
+}
+
+var contentRangeRE = regexp.MustCompile(`^bytes \d+-\d+/(\d+)$`)
+
+// The total size from a Content-Range header.
+func contentRangeSize(h string) (int64, error) {
+	m := contentRangeRE.FindStringSubmatch(h)
+	if m == nil {
+		return 0, fmt.Errorf("unexpected Content-Range: %q", h)
+	}
+	return strconv.ParseInt(m[1], 10, 64)
+}
+
+// How many of the files after the first skip have paths want
+// accepts.  Files turn out to have no metadata only once they're
+// read, so this can be more than there are to restore.
+func (ix *backupIndex) countPaths(skip int, want func(string) bool) int {
+	n, seq := 0, 0
+	for _, b := range ix.Blocks {
+		for _, p := range b.Paths {
+			if seq >= skip && want(p) {
+				n++
+			}
+			seq++
+		}
+	}
+	return n
+}
+
+// Decode the file records in one block of a backup.
+func readBackupBlock(r backupRanges, b backupIndexBlock) ([]restoreWorkItem, error) {
+	rc, err := r.readRange(b.Offset, b.Length)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	gz, err := gzip.NewReader(rc)
+	if err != nil {
+		return nil, err
+	}
+	gz.Multistream(false)
+
+	rv := []restoreWorkItem{}
+	err = eachBackupRecord(json.NewDecoder(gz), func(ob restoreWorkItem) error {
+		if ob.Manifest == nil {
+			rv = append(rv, ob)
+		}
+		return nil
+	})
+	return rv, err
+}
+
+// Send every file in an indexed backup to ch in backup file order,
+// reading only the blocks holding a path want accepts, workers at a
+// time.  Files in the blocks left unread are sent without metadata so
+// they keep their places, as are those of an incremental backup no
+// parent has metadata for.
+func readIndexedBackup(base string, ix *backupIndex, r backupRanges,
+	want func(string) bool, workers int, ch chan<- restoreWorkItem) error {
+
+	defer close(ch)
+
+	todo := make(chan int)
+	read := make([][]restoreWorkItem, len(ix.Blocks))
+	var mu sync.Mutex
+	var readErr error
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range todo {
+				items, err := readBackupBlock(r, ix.Blocks[i])
+				mu.Lock()
+				read[i] = items
+				if err != nil && readErr == nil {
+					readErr = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i, b := range ix.Blocks {
+		for _, p := range b.Paths {
+			if want(p) {
+				todo <- i
+				break
+			}
+		}
+	}
+	close(todo)
+	wg.Wait()
+	if readErr != nil {
+		return readErr
+	}
+
+	if ix.Manifest != nil && ix.Manifest.Parent != "" {
+		metas := map[string]*json.RawMessage{}
+		missing := map[string]bool{}
+		for _, items := range read {
+			for _, ob := range items {
+				if ob.Meta == nil {
+					missing[ob.Path] = true
+				}
+			}
+		}
+		var err error
+		for parent := ix.Manifest.Parent; parent != "" && len(missing) > 0; {
+			log.Printf("Resolving %v files from parent backup %v",
+				len(missing), parent)
+			parent, err = resolveFromParent(base, parent, metas, missing)
+			if err != nil {
+				return err
+			}
+		}
+		for _, items := range read {
+			for i := range items {
+				if items[i].Meta != nil {
+					continue
+				}
+				m, ok := metas[items[i].Path]
+				if !ok {
+					return fmt.Errorf("no metadata for %v in any parent backup",
+						items[i].Path)
+				}
+				items[i].Meta = m
+			}
+		}
+	}
+
+	for i, b := range ix.Blocks {
+		if read[i] == nil {
+			for _, p := range b.Paths {
+				ch <- restoreWorkItem{Path: p}
+			}
+			continue
+		}
+		for _, ob := range read[i] {
+			ch <- ob
+		}
+	}
+	return nil
+}
+
+// Fill in metadata for missing files from an indexed backup, reading
+// only the blocks that have them, and return its parent's name.
+func resolveFromIndex(ix *backupIndex, r backupRanges,
+	metas map[string]*json.RawMessage, missing map[string]bool) (string, error) {
+
+	for _, b := range ix.Blocks {
+		needed := false
+		for _, p := range b.Paths {
+			if missing[p] {
+				needed = true
+				break
+			}
+		}
+		if !needed {
+			continue
+		}
+		items, err := readBackupBlock(r, b)
+		if err != nil {
+			return "", err
+		}
+		for _, ob := range items {
+			if ob.Meta != nil && missing[ob.Path] {
+				metas[ob.Path] = ob.Meta
+				delete(missing, ob.Path)
+			}
+		}
+	}
+	if ix.Manifest == nil {
+		return "", nil
+	}
+	return ix.Manifest.Parent, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Write a version 2 backup of the given blocks of paths, the way the
+// server does.
+func writeIndexedBackup(t *testing.T, blocks [][]string) []byte {
+	items := [][]restoreWorkItem{}
+	for _, paths := range blocks {
+		b := []restoreWorkItem{}
+		for _, p := range paths {
+			b = append(b, restoreWorkItem{Path: p, Meta: oidMeta("o-" + p)})
+		}
+		items = append(items, b)
+	}
+	return writeBackupV2(t, nil, items)
+}
+
+func oidMeta(oid string) *json.RawMessage {
+	m := json.RawMessage(`{"oid":"` + oid + `"}`)
+	return &m
+}
+
+// Write a version 2 backup of the given blocks of files, with the
+// manifest first if there is one.
+func writeBackupV2(t *testing.T, manifest *backupManifest,
+	blocks [][]restoreWorkItem) []byte {
+
+	buf := &bytes.Buffer{}
+	ix := backupIndex{Version: 2, Manifest: manifest}
+	for i, items := range blocks {
+		b := backupIndexBlock{Offset: int64(buf.Len())}
+		gz := gzip.NewWriter(buf)
+		e := json.NewEncoder(gz)
+		if i == 0 && manifest != nil {
+			e.Encode(map[string]interface{}{"manifest": manifest})
+		}
+		for _, ob := range items {
+			b.Paths = append(b.Paths, ob.Path)
+			e.Encode(map[string]interface{}{"path": ob.Path, "meta": ob.Meta})
+		}
+		gz.Close()
+		b.Length = int64(buf.Len()) - b.Offset
+		ix.Blocks = append(ix.Blocks, b)
+	}
+
+	at := buf.Len()
+	gz := gzip.NewWriter(buf)
+	json.NewEncoder(gz).Encode(map[string]interface{}{"index": ix})
+	gz.Close()
+
+	extra := make([]byte, 12)
+	copy(extra, backupTrailerID)
+	binary.LittleEndian.PutUint16(extra[2:], 8)
+	binary.LittleEndian.PutUint64(extra[4:], uint64(at))
+	gz = gzip.NewWriter(buf)
+	gz.Extra = extra
+	gz.Close()
+	return buf.Bytes()
+}
+
+func TestIndexedBackup(t *testing.T) {
+	d, err := ioutil.TempDir("", "cbfsbackupindex")
+	if err != nil {
+		t.Fatalf("Error making tmp dir: %v", err)
+	}
+	defer os.RemoveAll(d)
+	fn := filepath.Join(d, "backup.gz")
+	err = ioutil.WriteFile(fn, writeIndexedBackup(t, [][]string{
+		{"a/1", "a/2"}, {"b/1", "b/2"}, {"c/1", "a/3"},
+	}), 0644)
+	if err != nil {
+		t.Fatalf("Error writing backup: %v", err)
+	}
+
+	ix, r, err := openBackupIndex("", fn)
+	if err != nil || ix == nil {
+		t.Fatalf("Expected an index, got %v, %v", ix, err)
+	}
+	defer r.Close()
+	if len(ix.Blocks) != 3 {
+		t.Fatalf("Expected 3 blocks, got %+v", ix)
+	}
+
+	ch := make(chan restoreWorkItem)
+	errch := make(chan error, 1)
+	want := func(p string) bool { return strings.HasPrefix(p, "a/") }
+	go func() { errch <- readIndexedBackup("", ix, r, want, 2, ch) }()
+
+	got := []string{}
+	for ob := range ch {
+		s := ob.Path
+		if ob.Meta != nil {
+			s += "*"
+		}
+		got = append(got, s)
+	}
+	if err := <-errch; err != nil {
+		t.Fatalf("Error reading backup: %v", err)
+	}
+	// Only the blocks with a match are read, but every file keeps
+	// its place.
+	exp := "[a/1* a/2* b/1 b/2 c/1* a/3*]"
+	if s := fmt.Sprint(got); s != exp {
+		t.Errorf("Expected %v, got %v", exp, s)
+	}
+
+	// The whole thing is still one gzip stream of records.
+	f, err := os.Open(fn)
+	if err != nil {
+		t.Fatalf("Error opening backup: %v", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Error uncompressing backup: %v", err)
+	}
+	n := 0
+	err = eachBackupRecord(json.NewDecoder(gz), func(restoreWorkItem) error {
+		n++
+		return nil
+	})
+	if err != nil || n != 6 {
+		t.Errorf("Expected 6 records reading it all, got %v, %v", n, err)
+	}
+}
+
+func TestUnindexedBackup(t *testing.T) {
+	d, err := ioutil.TempDir("", "cbfsbackupindex")
+	if err != nil {
+		t.Fatalf("Error making tmp dir: %v", err)
+	}
+	defer os.RemoveAll(d)
+	fn := filepath.Join(d, "backup.gz")
+
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	json.NewEncoder(gz).Encode(map[string]string{"path": "x"})
+	gz.Close()
+	if err := ioutil.WriteFile(fn, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Error writing backup: %v", err)
+	}
+
+	ix, r, err := openBackupIndex("", fn)
+	if ix != nil || r != nil || err != nil {
+		t.Errorf("Expected no index, got %v, %v, %v", ix, r, err)
+	}
+}
+
+func TestContentRangeSize(t *testing.T) {
+	if n, err := contentRangeSize("bytes 10-73/74"); n != 74 || err != nil {
+		t.Errorf("Expected 74, got %v, %v", n, err)
+	}
+	if _, err := contentRangeSize("bytes */74"); err == nil {
+		t.Errorf("Expected an error for an unsatisfied range")
+	}
+}
+
+func TestCountPaths(t *testing.T) {
+	ix := backupIndex{Blocks: []backupIndexBlock{
+		{Paths: []string{"a/1", "b/2"}},
+		{Paths: []string{"a/3", "a/4", "b/5"}},
+	}}
+	want := func(p string) bool { return strings.HasPrefix(p, "a/") }
+
+	tests := []struct{ skip, exp int }{
+		{0, 3},
+		{1, 2},
+		{3, 1},
+		{5, 0},
+	}
+	for _, test := range tests {
+		if got := ix.countPaths(test.skip, want); got != test.exp {
+			t.Errorf("Expected %v after %v, got %v", test.exp, test.skip, got)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/couchbaselabs/cbfs/config"
+	"github.com/couchbaselabs/cbfs/tools"
+	"github.com/dustin/go-humanize"
+	"github.com/dustin/httputil"
+)
+
+// Names of the entries in a bundle made by backup -with-data.
+const (
+	bundleBlobDir = "blobs/"
+	bundleMetaDir = "meta/"
+)
+
+// Write a bundle of every file and the blobs they're made of to the
+// local file fn, encrypted with secret if there is one.
+func backupBundle(ustr, fn string, secret []byte) {
+	u := cbfstool.ParseURL(ustr)
+	u.Path = "/.cbfs/backup/bundle/"
+	req, err := http.NewRequest("GET", u.String(), nil)
+	cbfstool.MaybeFatal(err, "Error building request: %v", err)
+
+	start := time.Now()
+	res, err := http.DefaultClient.Do(req.WithContext(cbfstool.Context()))
+	cbfstool.MaybeFatal(err, "Error fetching bundle: %v", err)
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		log.Fatalf("%v", httputil.HTTPErrorf(res,
+			"error fetching bundle - %S\n%B"))
+	}
+
+	// Written aside and renamed when done, so an interrupted bundle
+	// doesn't pass for a whole one.
+	tmp := fn + ".tmp"
+	f, err := os.Create(tmp)
+	cbfstool.MaybeFatal(err, "Error creating %v: %v", tmp, err)
+	defer os.Remove(tmp)
+
+	w := io.Writer(f)
+	var enc io.WriteCloser
+	if secret != nil {
+		enc, err = cbfsconfig.NewBackupEncrypter(f, secret)
+		cbfstool.MaybeFatal(err, "Error starting encryption: %v", err)
+		w = enc
+	}
+	n, err := io.Copy(w, res.Body)
+	if err == nil && enc != nil {
+		err = enc.Close()
+	}
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil && cbfstool.Interrupted() {
+		log.Printf("Interrupted after %v; no bundle was written",
+			time.Since(start))
+		os.Exit(cbfstool.ExitInterrupted)
+	}
+	cbfstool.MaybeFatal(err, "Error writing bundle: %v", err)
+
+	err = os.Rename(tmp, fn)
+	cbfstool.MaybeFatal(err, "Error renaming %v: %v", tmp, err)
+	log.Printf("Wrote %v bundle to %v in %v", humanize.Bytes(uint64(n)),
+		fn, time.Since(start))
+}
+
+// Open a bundle for reading.  Local bundles that aren't encrypted are
+// seekable, so entries not needed can be skipped without reading them.
+func openBundle(base, src string) (io.ReadCloser, error) {
+	if isLocalSource(src) {
+		f, err := os.Open(src)
+		if err != nil {
+			return nil, err
+		}
+		hdr := make([]byte, len(cbfsconfig.BackupEncMagic))
+		f.ReadAt(hdr, 0)
+		if !cbfsconfig.IsEncryptedBackup(hdr) {
+			return f, nil
+		}
+		f.Close()
+	}
+	return openPlainBackup(base, src)
+}
+
+// Call f with each entry in a bundle.
+func eachBundleEntry(base, src string,
+	f func(h *tar.Header, r io.Reader) error) error {
+
+	rc, err := openBundle(base, src)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	tr := tar.NewReader(rc)
+	for {
+		h, err := tr.Next()
+		switch err {
+		case nil:
+		case io.EOF:
+			return nil
+		default:
+			return err
+		}
+		if err := f(h, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// Upload a blob from a bundle to the node at base.
+func uploadBlob(base, oid string, r io.Reader, length int64) error {
+	u := cbfstool.ParseURL(base)
+	u.Path = "/.cbfs/blob/" + oid
+	req, err := http.NewRequest("PUT", u.String(), r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = length
+	res, err := http.DefaultClient.Do(req.WithContext(cbfstool.Context()))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 201 {
+		return &cbfsclient.StatusError{
+			Code:      res.StatusCode,
+			Msg:       fmt.Sprintf("error uploading blob %v - %v", oid, res.Status),
+			RequestID: res.Header.Get("X-CBFS-Request-ID"),
+		}
+	}
+	return nil
+}
+
+// Restore the files in a bundle whose paths (after remapping) want
+// accepts, uploading the blobs they need first.  The bundle is read
+// twice: once to find the blobs needed, then to restore.
+func restoreBundle(base, src string, want func(string) bool) {
+	start := time.Now()
+	needed := map[string]bool{}
+	err := eachBundleEntry(base, src, func(h *tar.Header, r io.Reader) error {
+		p := strings.TrimPrefix(h.Name, bundleMetaDir)
+		if p == h.Name || !want(remapPath(p, *restoreStrip, *restoreAdd)) {
+			return nil
+		}
+		m := json.RawMessage{}
+		if err := json.NewDecoder(r).Decode(&m); err != nil {
+			return fmt.Errorf("error reading metadata of %v: %v", p, err)
+		}
+		oids, err := backupBlobs(&m)
+		for _, oid := range oids {
+			needed[oid] = true
+		}
+		return err
+	})
+	cbfstool.MaybeFatal(err, "Error reading bundle: %v", err)
+	log.Printf("Restoring files made of %v blobs from %v", len(needed), src)
+
+	files, blobs, failed := 0, 0, 0
+	badBlobs := map[string]bool{}
+	err = eachBundleEntry(base, src, func(h *tar.Header, r io.Reader) error {
+		if cbfstool.Interrupted() {
+			return cbfstool.Context().Err()
+		}
+		switch {
+		case strings.HasPrefix(h.Name, bundleBlobDir):
+			oid := h.Name[len(bundleBlobDir):]
+			if !needed[oid] {
+				return nil
+			}
+			if *restoreNoop {
+				log.Printf("NOOP would upload blob %v", oid)
+				return nil
+			}
+			if err := uploadBlob(base, oid, r, h.Size); err != nil {
+				log.Printf("Error uploading blob %v: %v", oid, err)
+				badBlobs[oid] = true
+				return nil
+			}
+			blobs++
+
+		case strings.HasPrefix(h.Name, bundleMetaDir):
+			orig := h.Name[len(bundleMetaDir):]
+			p := remapPath(orig, *restoreStrip, *restoreAdd)
+			if !want(p) {
+				return nil
+			}
+			m := json.RawMessage{}
+			if err := json.NewDecoder(r).Decode(&m); err != nil {
+				return fmt.Errorf("error reading metadata of %v: %v",
+					orig, err)
+			}
+			oids, _ := backupBlobs(&m)
+			for _, oid := range oids {
+				if badBlobs[oid] {
+					log.Printf("Not restoring %v, blob %v failed to upload",
+						p, oid)
+					failed++
+					return nil
+				}
+			}
+			if err := restoreFile(base, p, &m); err != nil {
+				log.Printf("Error restoring %v: %v", p, err)
+				failed++
+				return nil
+			}
+			files++
+		}
+		return nil
+	})
+	if err != nil && cbfstool.Interrupted() {
+		log.Printf("Interrupted after %v: restored %v files and %v blobs",
+			time.Since(start), files, blobs)
+		os.Exit(cbfstool.ExitInterrupted)
+	}
+	cbfstool.MaybeFatal(err, "Error reading bundle: %v", err)
+
+	log.Printf("Restored %v files and %v blobs in %v, %v failed",
+		files, blobs, time.Since(start), failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/couchbaselabs/cbfs/config"
+)
+
+func TestEachBundleEntry(t *testing.T) {
+	d, err := ioutil.TempDir("", "cbfsbundle")
+	if err != nil {
+		t.Fatalf("Error making tmp dir: %v", err)
+	}
+	defer os.RemoveAll(d)
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range []struct{ name, body string }{
+		{"cbfs-bundle.json", `{"version": 1}`},
+		{bundleBlobDir + "abc", "hello"},
+		{bundleMetaDir + "a/b", `{"oid": "abc", "length": 5}`},
+	} {
+		tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0644,
+			Size: int64(len(e.body))})
+		tw.Write([]byte(e.body))
+	}
+	tw.Close()
+
+	plain := filepath.Join(d, "plain.tar")
+	if err := ioutil.WriteFile(plain, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Error writing bundle: %v", err)
+	}
+
+	enc := &bytes.Buffer{}
+	w, err := cbfsconfig.NewBackupEncrypter(enc, []byte("sekrit"))
+	if err != nil {
+		t.Fatalf("Error encrypting: %v", err)
+	}
+	w.Write(buf.Bytes())
+	w.Close()
+	encrypted := filepath.Join(d, "encrypted.tar")
+	if err := ioutil.WriteFile(encrypted, enc.Bytes(), 0644); err != nil {
+		t.Fatalf("Error writing bundle: %v", err)
+	}
+
+	defer func(s []byte) { backupSecret = s }(backupSecret)
+	backupSecret = []byte("sekrit")
+
+	exp := "[cbfs-bundle.json blobs/abc=hello meta/a/b]"
+	for _, fn := range []string{plain, encrypted} {
+		got := []string{}
+		err := eachBundleEntry("", fn, func(h *tar.Header, r io.Reader) error {
+			if h.Name == bundleBlobDir+"abc" {
+				data, err := ioutil.ReadAll(r)
+				got = append(got, h.Name+"="+string(data))
+				return err
+			}
+			got = append(got, h.Name)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("Error reading %v: %v", fn, err)
+		}
+		if s := fmt.Sprint(got); s != exp {
+			t.Errorf("Expected %v from %v, got %v", exp, fn, s)
+		}
+	}
+}
@@ -10,10 +10,23 @@ func main() {
 			"getconf": {0, getConfCommand, "", nil},
 			"setconf": {2, setConfCommand, "prop value", nil},
 			"fsck":    {0, fsckCommand, "", fsckFlags},
-			"backup":  {1, backupCommand, "filename", backupFlags},
+			"backup":  {1, backupCommand, "filename|url", backupFlags},
 			"rmbak":   {0, rmBakCommand, "", rmbakFlags},
-			"restore": {1, restoreCommand, "filename", restoreFlags},
+			"restore": {1, restoreCommand, "filename|url", restoreFlags},
 			"induce":  {0, induceCommand, "taskname", induceFlags},
+			"gc":      {0, gcCommand, "", gcFlags},
 			"lsbak":   {0, lsBakCommand, "", nil},
+			"verifybackup": {1, verifyBackupCommand, "filename|url",
+				verifyFlags},
+			"sign":    {1, signCommand, "path", signFlags},
+			"adduser": {-2, addUserCommand, "name prefix:perms...", adduserFlags},
+			"rmuser":  {1, rmUserCommand, "name", nil},
+			"lsusers": {0, lsUsersCommand, "", nil},
+			"decommission": {1, decommissionCommand, "node",
+				decommissionFlags},
+			"maintenance": {1, maintenanceCommand, "node",
+				maintenanceFlags},
+			"rebalance": {0, rebalanceCommand, "", rebalanceFlags},
+			"migrate":   {1, migrateCommand, "dest_url", migrateFlags},
 		})
 }
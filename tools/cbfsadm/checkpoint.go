@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const restoreCheckpointFreq = 5 * time.Second
+
+// Persistent record of how far through a backup file a restore got.
+//
+// Done is the number of records (in backup file order) that have
+// been completely processed with no gaps, so a resumed restore can
+// skip exactly that many records.
+type restoreProgress struct {
+	Filename string    `json:"filename"`
+	Done     int       `json:"done"`
+	LastPath string    `json:"lastPath"`
+	Updated  time.Time `json:"updated"`
+}
+
+type restoreCheckpointer struct {
+	fn       string
+	mu       sync.Mutex
+	progress restoreProgress
+	pending  map[int]string
+	dirty    bool
+	quit     chan bool
+	wg       sync.WaitGroup
+}
+
+// Load (or initialize) the checkpoint stored in fn for the given
+// backup file.
+func loadRestoreCheckpoint(fn, backupFn string) (*restoreCheckpointer, error) {
+	rv := &restoreCheckpointer{
+		fn:       fn,
+		progress: restoreProgress{Filename: backupFn},
+		pending:  map[int]string{},
+		quit:     make(chan bool),
+	}
+
+	f, err := os.Open(fn)
+	switch {
+	case os.IsNotExist(err):
+		return rv, nil
+	case err != nil:
+		return nil, err
+	}
+	defer f.Close()
+
+	err = json.NewDecoder(f).Decode(&rv.progress)
+	if err != nil {
+		return nil, fmt.Errorf("error reading checkpoint %v: %v", fn, err)
+	}
+	if rv.progress.Filename != backupFn {
+		return nil, fmt.Errorf("checkpoint %v is for %v, not %v",
+			fn, rv.progress.Filename, backupFn)
+	}
+	return rv, nil
+}
+
+// Number of records that may be skipped.
+func (c *restoreCheckpointer) skip() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.progress.Done
+}
+
+// Mark the record at the given position in the backup as processed.
+func (c *restoreCheckpointer) complete(seq int, path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pending[seq] = path
+	for {
+		p, ok := c.pending[c.progress.Done]
+		if !ok {
+			break
+		}
+		delete(c.pending, c.progress.Done)
+		c.progress.Done++
+		c.progress.LastPath = p
+		c.dirty = true
+	}
+}
+
+func (c *restoreCheckpointer) save() error {
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	c.progress.Updated = time.Now().UTC()
+	data, err := json.Marshal(&c.progress)
+	c.dirty = false
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.fn, data)
+}
+
+// Replace fn with data, so it's never seen half written.
+func writeFileAtomic(fn string, data []byte) error {
+	tmpfn := fn + ".tmp"
+	f, err := os.Create(tmpfn)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmpfn)
+		return err
+	}
+	return os.Rename(tmpfn, fn)
+}
+
+// Periodically save progress until stopped.
+func (c *restoreCheckpointer) start() {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		t := time.NewTicker(restoreCheckpointFreq)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if err := c.save(); err != nil {
+					log.Printf("Error saving checkpoint: %v", err)
+				}
+			case <-c.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop periodic saving and write the final state.
+func (c *restoreCheckpointer) stop() error {
+	close(c.quit)
+	c.wg.Wait()
+	return c.save()
+}
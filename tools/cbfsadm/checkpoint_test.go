@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCheckpointContiguous(t *testing.T) {
+	d, err := ioutil.TempDir("", "cbfscheckpoint")
+	if err != nil {
+		t.Fatalf("Error making tmp dir: %v", err)
+	}
+	defer os.RemoveAll(d)
+	fn := filepath.Join(d, "checkpoint")
+
+	cp, err := loadRestoreCheckpoint(fn, "backup.gz")
+	if err != nil {
+		t.Fatalf("Error loading new checkpoint: %v", err)
+	}
+
+	cp.complete(1, "b")
+	cp.complete(2, "c")
+	if cp.skip() != 0 {
+		t.Fatalf("Expected no progress with a gap, got %v", cp.skip())
+	}
+	cp.complete(0, "a")
+	cp.complete(4, "e")
+	if cp.skip() != 3 {
+		t.Fatalf("Expected to skip 3, got %v", cp.skip())
+	}
+
+	if err := cp.save(); err != nil {
+		t.Fatalf("Error saving checkpoint: %v", err)
+	}
+
+	cp, err = loadRestoreCheckpoint(fn, "backup.gz")
+	if err != nil {
+		t.Fatalf("Error reloading checkpoint: %v", err)
+	}
+	if cp.skip() != 3 || cp.progress.LastPath != "c" {
+		t.Fatalf("Expected 3/c after reload, got %v/%v",
+			cp.skip(), cp.progress.LastPath)
+	}
+
+	_, err = loadRestoreCheckpoint(fn, "other.gz")
+	if err == nil {
+		t.Fatalf("Expected error loading checkpoint for another file")
+	}
+}
+
+func TestCheckpointResumesFailures(t *testing.T) {
+	d, err := ioutil.TempDir("", "cbfscheckpoint")
+	if err != nil {
+		t.Fatalf("Error making tmp dir: %v", err)
+	}
+	defer os.RemoveAll(d)
+	fn := filepath.Join(d, "checkpoint")
+
+	defer func(n int) { *restoreRetries = n }(*restoreRetries)
+	*restoreRetries = 0
+
+	// b fails the first time it's restored.
+	mu := sync.Mutex{}
+	restored := map[string]int{}
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			p := strings.TrimPrefix(req.URL.Path, "/.cbfs/backup/restore/")
+			mu.Lock()
+			defer mu.Unlock()
+			restored[p]++
+			if p == "b" && restored[p] == 1 {
+				http.Error(w, "injected failure", 400)
+				return
+			}
+			w.WriteHeader(201)
+		}))
+	defer ts.Close()
+
+	restore := func(paths ...string) *restoreTracker {
+		cp, err := loadRestoreCheckpoint(fn, "backup.gz")
+		if err != nil {
+			t.Fatalf("Error loading checkpoint: %v", err)
+		}
+		cp.start()
+		tracker := newRestoreTracker()
+		ch := make(chan restoreWorkItem, len(paths))
+		for i, p := range paths[cp.skip():] {
+			ch <- restoreWorkItem{Path: p, seq: cp.skip() + i}
+		}
+		close(ch)
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		restoreWorker(wg, ts.URL, ch, cp, tracker)
+		if err := cp.stop(); err != nil {
+			t.Fatalf("Error saving checkpoint: %v", err)
+		}
+		return tracker
+	}
+
+	tracker := restore("a", "b", "c")
+	if len(tracker.failed) != 1 || tracker.failed[0] != "b" {
+		t.Fatalf("Expected b to fail, got %v", tracker.failed)
+	}
+	cp, err := loadRestoreCheckpoint(fn, "backup.gz")
+	if err != nil {
+		t.Fatalf("Error loading checkpoint: %v", err)
+	}
+	if cp.skip() != 1 {
+		t.Fatalf("Expected the checkpoint to stop before b, got %v", cp.skip())
+	}
+
+	tracker = restore("a", "b", "c")
+	if len(tracker.failed) != 0 {
+		t.Fatalf("Expected the resumed restore to succeed, got %v",
+			tracker.failed)
+	}
+	if restored["a"] != 1 || restored["b"] != 2 {
+		t.Errorf("Expected a once and b twice, got %v", restored)
+	}
+	cp, err = loadRestoreCheckpoint(fn, "backup.gz")
+	if err != nil {
+		t.Fatalf("Error loading checkpoint: %v", err)
+	}
+	if cp.skip() != 3 {
+		t.Errorf("Expected everything done, got %v", cp.skip())
+	}
+}
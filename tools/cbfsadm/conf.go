@@ -16,6 +16,10 @@ func getClient(u string) *cbfsclient.Client {
 func getConfCommand(u string, args []string) {
 	conf, err := getClient(u).GetConfig()
 	cbfstool.MaybeFatal(err, "Error getting config: %v", err)
+	if cbfstool.JSON {
+		cbfstool.PrintJSON(conf)
+		return
+	}
 	conf.Dump(os.Stdout)
 }
 
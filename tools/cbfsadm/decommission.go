@@ -0,0 +1,25 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/couchbaselabs/cbfs/tools"
+)
+
+var decommissionFlags = flag.NewFlagSet("decommission", flag.ExitOnError)
+var decommissionCancel = decommissionFlags.Bool("cancel", false,
+	"stop decommissioning the node")
+
+func decommissionCommand(u string, args []string) {
+	node := args[0]
+	c := getClient(u)
+	if *decommissionCancel {
+		err := c.CancelDecommission(node)
+		cbfstool.MaybeFatal(err, "Error canceling decommission: %v", err)
+		return
+	}
+	err := c.Decommission(node)
+	cbfstool.MaybeFatal(err, "Error decommissioning %v: %v", node, err)
+	log.Printf("Draining %v; watch the drainNodes task for progress", node)
+}
@@ -15,16 +15,54 @@ import (
 
 var fsckFlags = flag.NewFlagSet("fsck", flag.ExitOnError)
 var fsckVerbose = fsckFlags.Bool("v", false, "Use more bandwidth, say more stuff")
+var fsckOrphansFlag = fsckFlags.Bool("orphans", false,
+	"Look for blobs on disk no file refers to")
+var fsckRemove = fsckFlags.Bool("remove", false,
+	"Remove orphaned blobs (with -orphans)")
+var fsckMinAge = fsckFlags.Duration("minage", 24*time.Hour,
+	"Only remove orphans older than this (with -orphans)")
+var fsckJSON = fsckFlags.Bool("json", false,
+	"Write a JSON report")
+var fsckRepair = fsckFlags.Bool("repair", false,
+	"Fix what can be fixed")
+
+type fsckStatus struct {
+	Path     string `json:"path"`
+	OID      string `json:"oid,omitempty"`
+	Reps     int    `json:"reps,omitempty"`
+	EType    string `json:"etype,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Repaired bool   `json:"repaired,omitempty"`
+}
+
+// What fsck found, with the problems left for someone to look at.
+type fsckReport struct {
+	Files      int          `json:"files"`
+	Problems   int          `json:"problems"`
+	Repaired   int          `json:"repaired"`
+	Unrepaired []fsckStatus `json:"unrepaired"`
+}
 
 func fsckCommand(ustr string, args []string) {
+	if *fsckOrphansFlag {
+		fsckOrphans(ustr)
+		return
+	}
+
 	u := cbfstool.ParseURL(ustr)
 	u.Path = "/.cbfs/fsck/"
 	if !*fsckVerbose {
 		u.RawQuery = "errsonly=true"
 	}
 
-	res, err := http.Get(u.String())
-	cbfstool.MaybeFatal(err, "Error executing GET of %v - %v", u, err)
+	method := "GET"
+	if *fsckRepair {
+		method = "POST"
+	}
+	req, err := http.NewRequest(method, u.String(), nil)
+	cbfstool.MaybeFatal(err, "Error making request: %v", err)
+	res, err := http.DefaultClient.Do(req)
+	cbfstool.MaybeFatal(err, "Error executing %v of %v - %v", method, u, err)
 
 	defer res.Body.Close()
 	if res.StatusCode != 200 {
@@ -34,7 +72,8 @@ func fsckCommand(ustr string, args []string) {
 	}
 
 	found := 0
-	errors := 0
+	report := fsckReport{Unrepaired: []fsckStatus{}}
+	lastPath := ""
 
 	if *fsckVerbose {
 		done := make(chan bool)
@@ -57,13 +96,7 @@ func fsckCommand(ustr string, args []string) {
 
 	d := json.NewDecoder(res.Body)
 	for {
-		status := struct {
-			Path  string `json:"path"`
-			OID   string `json:"oid,omitempty"`
-			Reps  int    `json:"reps,omitempty"`
-			EType string `json:"etype,omitempty"`
-			Error string `json:"error,omitempty"`
-		}{}
+		status := fsckStatus{}
 
 		err = d.Decode(&status)
 		if err != nil {
@@ -73,14 +106,41 @@ func fsckCommand(ustr string, args []string) {
 			log.Fatalf("Error executing fsck: %v", err)
 		}
 
-		found++
-		if status.Error != "" {
+		// A file with several problems gets a line for each.
+		if status.Path != lastPath {
+			found++
+			lastPath = status.Path
+		}
+		if cbfstool.JSON && !*fsckJSON {
+			cbfstool.PrintJSONLine(status)
+		}
+		if status.Error == "" {
+			continue
+		}
+		report.Problems++
+		if status.Repaired {
+			report.Repaired++
+			log.Printf("Repaired %#v - %v - %v: %v",
+				status.Path, status.OID,
+				status.EType, status.Error)
+		} else {
+			report.Unrepaired = append(report.Unrepaired, status)
 			log.Printf("Error on %#v - %v - %v: %v",
 				status.Path, status.OID,
 				status.EType, status.Error)
-			errors++
 		}
 	}
 
-	log.Printf("Found %v files and %v errors", found, errors)
+	report.Files = found
+	if *fsckJSON {
+		cbfstool.PrintJSON(&report)
+	}
+	log.Printf("Found %v files and %v errors, repaired %v",
+		found, report.Problems, report.Repaired)
+	if len(report.Unrepaired) > 0 {
+		if !*fsckRepair {
+			log.Printf("Nothing was repaired; use -repair to do so")
+		}
+		os.Exit(1)
+	}
 }
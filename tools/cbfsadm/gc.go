@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/tools"
+)
+
+var gcFlags = flag.NewFlagSet("gc", flag.ExitOnError)
+var gcNow = gcFlags.Bool("now", false, "start a garbage collection now")
+
+type gcRun struct {
+	Node         string    `json:"node"`
+	Started      time.Time `json:"started"`
+	Finished     time.Time `json:"finished"`
+	Scanned      int       `json:"scanned"`
+	Removed      int       `json:"removed"`
+	RemovedBytes int64     `json:"removedBytes"`
+	Skipped      int       `json:"skipped"`
+	InBackup     int       `json:"inBackup"`
+	Error        string    `json:"error"`
+}
+
+func gcCommand(ustr string, args []string) {
+	if *gcNow {
+		err := induceTask(ustr, "garbageCollectBlobs")
+		cbfstool.MaybeFatal(err, "Error starting garbage collection: %v", err)
+		if !cbfstool.JSON {
+			fmt.Println("Garbage collection started.")
+		}
+		return
+	}
+
+	u := cbfstool.ParseURL(ustr)
+	u.Path = "/.cbfs/tasks/gc/"
+
+	gc := struct {
+		Enabled   bool    `json:"enabled"`
+		Freq      string  `json:"freq"`
+		Limit     int     `json:"limit"`
+		Rate      int     `json:"rate"`
+		BytesRate int64   `json:"bytesRate"`
+		Runs      []gcRun `json:"runs"`
+	}{}
+	err := cbfstool.GetJsonData(u.String(), &gc)
+	cbfstool.MaybeFatal(err, "Error getting gc info: %v", err)
+	if cbfstool.JSON {
+		cbfstool.PrintJSON(gc)
+		return
+	}
+
+	fmt.Printf("enabled: %v, every %v, %v per batch, %v blobs/s, %v bytes/s\n\n",
+		gc.Enabled, gc.Freq, gc.Limit, gc.Rate, gc.BytesRate)
+
+	tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "started\tnode\ttook\tscanned\tremoved\tbytes\tskipped\tin backup\terror\n")
+	for _, r := range gc.Runs {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+			r.Started.Format(time.RFC3339), r.Node,
+			r.Finished.Sub(r.Started).Round(time.Second), r.Scanned,
+			r.Removed, r.RemovedBytes, r.Skipped, r.InBackup, r.Error)
+	}
+	tw.Flush()
+}
@@ -18,9 +18,22 @@ func lsBakCommand(ustr string, args []string) {
 	err := cbfstool.GetJsonData(u.String(), &backups)
 	cbfstool.MaybeFatal(err, "Error getting backup info: %v", err)
 
+	if cbfstool.JSON {
+		for _, b := range backups.Previous {
+			cbfstool.PrintJSONLine(map[string]interface{}{
+				"filename":  b.Filename,
+				"oid":       b.OID,
+				"when":      b.When,
+				"parent":    b.Parent,
+				"encrypted": b.Encrypted,
+			})
+		}
+		return
+	}
+
 	tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
 	for _, b := range backups.Previous {
-		fmt.Fprintf(tw, "%s\t%v\n", b.Filename, b.When)
+		fmt.Fprintf(tw, "%s\t%v\t%s\n", b.Filename, b.When, b.Parent)
 	}
 	tw.Flush()
 }
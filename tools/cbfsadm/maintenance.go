@@ -0,0 +1,26 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/couchbaselabs/cbfs/tools"
+)
+
+var maintenanceFlags = flag.NewFlagSet("maintenance", flag.ExitOnError)
+var maintenanceOff = maintenanceFlags.Bool("off", false,
+	"take the node out of maintenance")
+
+func maintenanceCommand(u string, args []string) {
+	node := args[0]
+	c := getClient(u)
+	if *maintenanceOff {
+		err := c.EndMaintenance(node)
+		cbfstool.MaybeFatal(err, "Error ending maintenance: %v", err)
+		log.Printf("%v is back in service", node)
+		return
+	}
+	err := c.StartMaintenance(node)
+	cbfstool.MaybeFatal(err, "Error starting maintenance of %v: %v", node, err)
+	log.Printf("%v is in maintenance; it gets no new blobs until -off", node)
+}
@@ -0,0 +1,655 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/couchbaselabs/cbfs/tools"
+	"github.com/dustin/go-humanize"
+	"github.com/dustin/httputil"
+)
+
+const migrateBatchSize = 100
+
+var migrateFlags = flag.NewFlagSet("migrate", flag.ExitOnError)
+var migratePrefix = migrateFlags.String("prefix", "",
+	"Only migrate files whose paths begin with this")
+var migrateWorkers = migrateFlags.Int("workers", 4,
+	"Number of files to migrate at once")
+var migrateStateFn = migrateFlags.String("state", "",
+	"File in which to record progress for resuming an interrupted migration")
+var migrateReportFn = migrateFlags.String("report", "",
+	"File to write the cutover report to (default stdout)")
+var migrateVerbose = migrateFlags.Bool("v", false, "Verbose")
+
+// Persistent record of how far a migration has got.  Once every file
+// has been copied (Copied), running the migration again only catches
+// up on the source's changes since Seq.
+type migrationState struct {
+	Source  string    `json:"source"`
+	Dest    string    `json:"dest"`
+	Prefix  string    `json:"prefix"`
+	Started time.Time `json:"started"`
+	// The latest change on the source when copying began, and the
+	// last one the destination has caught up with
+	StartSeq uint64 `json:"startSeq"`
+	Seq      uint64 `json:"seq"`
+	Copied   bool   `json:"copied"`
+	Files    int64  `json:"files"`
+	Same     int64  `json:"same"`
+	Removed  int64  `json:"removed"`
+	Blobs    int64  `json:"blobs"`
+	Bytes    int64  `json:"bytes"`
+	// Paths that couldn't be migrated, tried again each run
+	Failed []string `json:"failed"`
+}
+
+// What a migration has done, and whether the destination is ready
+// to take over from the source.
+type migrationReport struct {
+	migrationState
+	Finished time.Time `json:"finished"`
+	// The latest change on the source, and how many the destination
+	// has still to catch up with
+	Head   uint64 `json:"head"`
+	Behind uint64 `json:"behind"`
+	// Each cluster's usage under the prefix, to compare
+	SourceUsage *cbfsclient.DuStats `json:"sourceUsage,omitempty"`
+	DestUsage   *cbfsclient.DuStats `json:"destUsage,omitempty"`
+	// Every file's been copied, nothing failed and there are no
+	// changes left to catch up with
+	Ready bool `json:"readyForCutover"`
+}
+
+type migrateResult int
+
+const (
+	migrateCopied = migrateResult(iota)
+	migrateSame
+	migrateRemoved
+)
+
+// A file to migrate.  Without metadata, whatever the source has at
+// the path now is migrated, and if it has nothing the destination's
+// copy is removed.
+type migrateItem struct {
+	Path string           `json:"path"`
+	Meta *json.RawMessage `json:"meta"`
+}
+
+type migrator struct {
+	src, dst         *cbfsclient.Client
+	srcBase, dstBase string
+	srcNodes         map[string]cbfsclient.StorageNode
+	stateFn          string
+
+	mu sync.Mutex
+	st migrationState
+}
+
+// Load (or initialize) the state of migrating prefix from src to dst
+// recorded in fn.
+func loadMigrationState(fn, src, dst, prefix string) (migrationState, error) {
+	rv := migrationState{Source: src, Dest: dst, Prefix: prefix}
+	if fn == "" {
+		return rv, nil
+	}
+	f, err := os.Open(fn)
+	switch {
+	case os.IsNotExist(err):
+		return rv, nil
+	case err != nil:
+		return rv, err
+	}
+	defer f.Close()
+
+	st := migrationState{}
+	if err := json.NewDecoder(f).Decode(&st); err != nil {
+		return rv, fmt.Errorf("error reading state %v: %v", fn, err)
+	}
+	if st.Source != src || st.Dest != dst || st.Prefix != prefix {
+		return rv, fmt.Errorf("state %v is for migrating %q from %v to %v",
+			fn, st.Prefix, st.Source, st.Dest)
+	}
+	return st, nil
+}
+
+func newMigrator(srcBase, dstBase, prefix, stateFn string) (*migrator, error) {
+	st, err := loadMigrationState(stateFn, srcBase, dstBase, prefix)
+	if err != nil {
+		return nil, err
+	}
+	rv := &migrator{srcBase: srcBase, dstBase: dstBase, stateFn: stateFn,
+		st: st}
+	if rv.src, err = cbfsclient.New(srcBase); err != nil {
+		return nil, err
+	}
+	if rv.dst, err = cbfsclient.New(dstBase); err != nil {
+		return nil, err
+	}
+	// Looked up once here, as the clients cache them unguarded.
+	if rv.srcNodes, err = rv.src.Nodes(); err != nil {
+		return nil, fmt.Errorf("error listing source nodes: %v", err)
+	}
+	if _, err = rv.dst.Nodes(); err != nil {
+		return nil, fmt.Errorf("error listing destination nodes: %v", err)
+	}
+	return rv, nil
+}
+
+func (m *migrator) save() error {
+	if m.stateFn == "" {
+		return nil
+	}
+	m.mu.Lock()
+	data, err := json.Marshal(&m.st)
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(m.stateFn, data)
+}
+
+// Whether dst already has what migrating src would give it.
+func migratedAlready(src, dst cbfsclient.FileMeta) bool {
+	return src.OID == dst.OID && src.Length == dst.Length &&
+		src.Revno == dst.Revno && src.Modified.Equal(dst.Modified) &&
+		reflect.DeepEqual(src.Parts, dst.Parts) &&
+		reflect.DeepEqual(src.Headers, dst.Headers) &&
+		reflect.DeepEqual(src.Userdata, dst.Userdata)
+}
+
+// The blobs holding a file's content, and those holding its older
+// revisions.
+func migrateBlobs(fm cbfsclient.FileMeta) (cur, old []string) {
+	add := func(l []string, oid string, parts []cbfsclient.BlobPart) []string {
+		if len(parts) == 0 {
+			if oid == "" {
+				return l
+			}
+			return append(l, oid)
+		}
+		for _, p := range parts {
+			l = append(l, p.OID)
+		}
+		return l
+	}
+	cur = add(cur, fm.OID, fm.Parts)
+	for _, p := range fm.Previous {
+		old = add(old, p.OID, p.Parts)
+	}
+	return cur, old
+}
+
+// The paths under prefix touched by a batch of changes, each once, in
+// the order they were last changed.
+func changedPaths(changes []cbfsclient.Change, prefix string) []string {
+	last := map[string]int{}
+	for i, c := range changes {
+		if strings.HasPrefix(c.Path, prefix) {
+			last[c.Path] = i
+		}
+	}
+	rv := []string{}
+	for i, c := range changes {
+		if j, ok := last[c.Path]; ok && j == i {
+			rv = append(rv, c.Path)
+		}
+	}
+	return rv
+}
+
+// Send a blob from a source node straight to a destination node,
+// checking it against its hash on the way.
+func (m *migrator) sendBlob(from, oid string) (int64, error) {
+	req, err := http.NewRequest("GET", from, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set(cbfsclient.WantHashHeader, "true")
+	res, err := http.DefaultClient.Do(req.WithContext(cbfstool.Context()))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return 0, httputil.HTTPErrorf(res, "error fetching blob - %S\n%B")
+	}
+
+	_, n, err := m.dst.RandomNode()
+	if err != nil {
+		return 0, err
+	}
+	put, err := http.NewRequest("PUT", n.BlobURL(oid),
+		cbfsclient.VerifyBody(res))
+	if err != nil {
+		return 0, err
+	}
+	put.ContentLength = res.ContentLength
+	pres, err := http.DefaultClient.Do(put.WithContext(cbfstool.Context()))
+	if err != nil {
+		return 0, err
+	}
+	defer pres.Body.Close()
+	if pres.StatusCode != 201 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(pres.Body, 512))
+		return 0, &cbfsclient.StatusError{
+			Code:      pres.StatusCode,
+			Msg:       fmt.Sprintf("error storing blob %v - %s", oid, msg),
+			RequestID: pres.Header.Get("X-CBFS-Request-ID"),
+		}
+	}
+	return res.ContentLength, nil
+}
+
+// Copy the blobs the destination doesn't have yet.  Those the source
+// has lost are an error if required, and otherwise left behind.
+func (m *migrator) copyBlobs(oids []string, required bool) error {
+	if len(oids) == 0 {
+		return nil
+	}
+	have, err := m.dst.GetBlobInfos(oids...)
+	if err != nil {
+		return err
+	}
+	missing := []string{}
+	for _, oid := range oids {
+		if len(have[oid].Nodes) == 0 {
+			missing = append(missing, oid)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	infos, err := m.src.GetBlobInfos(missing...)
+	if err != nil {
+		return err
+	}
+
+	for _, oid := range missing {
+		err := fmt.Errorf("no source node has blob %v", oid)
+		for name := range infos[oid].Nodes {
+			node, ok := m.srcNodes[name]
+			if !ok {
+				continue
+			}
+			var n int64
+			if n, err = m.sendBlob(node.BlobURL(oid), oid); err == nil {
+				m.mu.Lock()
+				m.st.Blobs++
+				m.st.Bytes += n
+				m.mu.Unlock()
+				break
+			}
+			if cbfstool.Interrupted() {
+				return err
+			}
+		}
+		switch {
+		case err == nil:
+		case required:
+			return fmt.Errorf("error copying blob %v: %v", oid, err)
+		default:
+			log.Printf("Leaving behind blob %v of an old revision: %v",
+				oid, err)
+		}
+	}
+	return nil
+}
+
+// Record a file's metadata on the destination, replacing whatever's
+// there.
+func (m *migrator) storeMeta(path string, meta json.RawMessage) error {
+	u := cbfstool.ParseURL(m.dstBase)
+	u.Path = "/.cbfs/backup/restore/" + path
+	u.RawQuery = "force=true"
+	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(meta))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-CBFS-Expiration", "-1")
+
+	res, err := http.DefaultClient.Do(req.WithContext(cbfstool.Context()))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 201 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return &cbfsclient.StatusError{
+			Code:      res.StatusCode,
+			Msg:       fmt.Sprintf("error storing %v - %s", path, msg),
+			RequestID: res.Header.Get("X-CBFS-Request-ID"),
+		}
+	}
+	return nil
+}
+
+// The source's current metadata for path, or cbfsclient.Missing.
+func (m *migrator) sourceMeta(path string) (json.RawMessage, error) {
+	u := cbfstool.ParseURL(m.srcBase)
+	u.Path = "/.cbfs/info/file/" + path
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req.WithContext(cbfstool.Context()))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case 200:
+	case 404:
+		return nil, cbfsclient.Missing
+	default:
+		return nil, httputil.HTTPErrorf(res, "error getting info - %S\n%B")
+	}
+	j := struct {
+		Meta json.RawMessage `json:"meta"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&j)
+	return j.Meta, err
+}
+
+// Copy a file's blobs and then its metadata, unless the destination
+// already has it.
+func (m *migrator) migrateFile(path string,
+	meta json.RawMessage) (migrateResult, error) {
+
+	fm := cbfsclient.FileMeta{}
+	if err := json.Unmarshal(meta, &fm); err != nil {
+		return migrateCopied, fmt.Errorf("error reading metadata: %v", err)
+	}
+	existing, err := m.dst.StatContext(cbfstool.Context(), path)
+	switch {
+	case err == nil && migratedAlready(fm, existing):
+		return migrateSame, nil
+	case err != nil && err != cbfsclient.Missing:
+		return migrateCopied, err
+	}
+
+	cur, old := migrateBlobs(fm)
+	if err := m.copyBlobs(cur, true); err != nil {
+		return migrateCopied, err
+	}
+	if err := m.copyBlobs(old, false); err != nil {
+		return migrateCopied, err
+	}
+	return migrateCopied, m.storeMeta(path, meta)
+}
+
+func (m *migrator) migrate(it migrateItem) {
+	var r migrateResult
+	err := cbfsclient.DefaultBackoff.DoContext(cbfstool.Context(), func() error {
+		var err error
+		if it.Meta != nil {
+			r, err = m.migrateFile(it.Path, *it.Meta)
+			return err
+		}
+		meta, err := m.sourceMeta(it.Path)
+		switch err {
+		case nil:
+			r, err = m.migrateFile(it.Path, meta)
+		case cbfsclient.Missing:
+			r = migrateRemoved
+			err = m.dst.DeleteContext(cbfstool.Context(), it.Path)
+			if err == cbfsclient.Missing {
+				r, err = migrateSame, nil
+			}
+		}
+		if cbfsclient.IsTransient(err) {
+			log.Printf("Error migrating %v (may retry): %v", it.Path, err)
+		}
+		return err
+	})
+	if err != nil && cbfstool.Interrupted() {
+		// Left for a resumed migration to try again.
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	failed := m.st.Failed[:0]
+	for _, p := range m.st.Failed {
+		if p != it.Path {
+			failed = append(failed, p)
+		}
+	}
+	m.st.Failed = failed
+	if err != nil {
+		log.Printf("Error migrating %v: %v", it.Path, err)
+		m.st.Failed = append(m.st.Failed, it.Path)
+		return
+	}
+	switch r {
+	case migrateCopied:
+		cbfstool.Verbose(*migrateVerbose, "Migrated %v", it.Path)
+		m.st.Files++
+	case migrateSame:
+		m.st.Same++
+	case migrateRemoved:
+		cbfstool.Verbose(*migrateVerbose, "Removed %v", it.Path)
+		m.st.Removed++
+	}
+}
+
+// Migrate what feed sends, -workers at a time.
+func (m *migrator) each(feed func(ch chan<- migrateItem) error) error {
+	ch := make(chan migrateItem)
+	wg := sync.WaitGroup{}
+	for i := 0; i < *migrateWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for it := range ch {
+				if !cbfstool.Interrupted() {
+					m.migrate(it)
+				}
+			}
+		}()
+	}
+	err := feed(ch)
+	close(ch)
+	wg.Wait()
+	return err
+}
+
+// Copy every file under the prefix, as the source lists them.
+func (m *migrator) copyAll() error {
+	u := cbfstool.ParseURL(m.srcBase)
+	u.Path = "/.cbfs/backup/stream/" + m.st.Prefix
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req.WithContext(cbfstool.Context()))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return httputil.HTTPErrorf(res, "error listing files - %S\n%B")
+	}
+
+	return m.each(func(ch chan<- migrateItem) error {
+		d := json.NewDecoder(res.Body)
+		for !cbfstool.Interrupted() {
+			it := migrateItem{}
+			switch err := d.Decode(&it); err {
+			case nil:
+			case io.EOF:
+				return nil
+			default:
+				return err
+			}
+			if it.Meta != nil {
+				ch <- it
+			}
+		}
+		return cbfstool.Context().Err()
+	})
+}
+
+// Migrate whatever failed before, then whatever's changed on the
+// source since the last catch up, until there's nothing left.  The
+// sequence only moves past a batch of changes once it's been
+// migrated, so an interrupted catch up starts on the same batch.
+func (m *migrator) catchUp() error {
+	m.mu.Lock()
+	retry := append([]string{}, m.st.Failed...)
+	m.mu.Unlock()
+	err := m.each(func(ch chan<- migrateItem) error {
+		for _, p := range retry {
+			ch <- migrateItem{Path: p}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	head, err := m.src.ChangesHead()
+	if err != nil {
+		return err
+	}
+	for m.st.Seq < head {
+		res, err := m.src.Changes(m.st.Seq, migrateBatchSize, 0)
+		if err != nil {
+			return err
+		}
+		err = m.each(func(ch chan<- migrateItem) error {
+			for _, p := range changedPaths(res.Results, m.st.Prefix) {
+				ch <- migrateItem{Path: p}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if cbfstool.Interrupted() {
+			return cbfstool.Context().Err()
+		}
+		if res.LastSeq == m.st.Seq {
+			// Waiting on a change that's still being written.
+			break
+		}
+		m.mu.Lock()
+		m.st.Seq = res.LastSeq
+		m.mu.Unlock()
+		if err := m.save(); err != nil {
+			log.Printf("Error saving state: %v", err)
+		}
+	}
+	return nil
+}
+
+func (m *migrator) report() migrationReport {
+	rv := migrationReport{migrationState: m.st, Finished: time.Now().UTC()}
+	head, err := m.src.ChangesHead()
+	if err != nil {
+		log.Printf("Error getting the source's latest change: %v", err)
+	}
+	rv.Head = head
+	if head > rv.Seq {
+		rv.Behind = head - rv.Seq
+	}
+	dir := strings.Trim(m.st.Prefix, "/")
+	if st, err := m.src.Du(dir, false, false); err == nil {
+		rv.SourceUsage = &st
+	}
+	if st, err := m.dst.Du(dir, false, false); err == nil {
+		rv.DestUsage = &st
+	}
+	rv.Ready = err == nil && rv.Copied && rv.Behind == 0 &&
+		len(rv.Failed) == 0
+	return rv
+}
+
+func (m *migrator) interrupted(start time.Time) {
+	if err := m.save(); err != nil {
+		log.Printf("Error saving state: %v", err)
+	}
+	log.Printf("Interrupted after %v: %v files migrated, %v failed",
+		time.Since(start), m.st.Files, len(m.st.Failed))
+	os.Exit(cbfstool.ExitInterrupted)
+}
+
+// Copy the files under -prefix to another cluster, blobs and all,
+// then catch up on what changed on the source meanwhile.  Running it
+// again with the same -state picks up where it left off, and once
+// everything's been copied only catches up; so the usual cutover is
+// to migrate, stop writes to the source, then migrate again until
+// the report says the destination is ready.
+func migrateCommand(ustr string, args []string) {
+	if *migrateWorkers < 1 {
+		log.Fatalf("Need at least one worker")
+	}
+	dest := migrateFlags.Arg(0)
+	m, err := newMigrator(ustr, dest, strings.TrimLeft(*migratePrefix, "/"),
+		*migrateStateFn)
+	cbfstool.MaybeFatal(err, "Error starting migration: %v", err)
+
+	start := time.Now()
+	if !m.st.Copied {
+		if m.st.Started.IsZero() {
+			m.st.StartSeq, err = m.src.ChangesHead()
+			cbfstool.MaybeFatal(err, "Error getting changes: %v", err)
+			m.st.Seq = m.st.StartSeq
+			m.st.Started = start.UTC()
+			err = m.save()
+			cbfstool.MaybeFatal(err, "Error saving state: %v", err)
+		}
+		log.Printf("Copying files under %q from %v to %v",
+			m.st.Prefix, ustr, dest)
+		err = m.copyAll()
+		if cbfstool.Interrupted() {
+			m.interrupted(start)
+		}
+		cbfstool.MaybeFatal(err, "Error copying files: %v", err)
+		m.st.Copied = true
+		err = m.save()
+		cbfstool.MaybeFatal(err, "Error saving state: %v", err)
+	}
+
+	log.Printf("Catching up on changes since %v", m.st.Seq)
+	err = m.catchUp()
+	if cbfstool.Interrupted() {
+		m.interrupted(start)
+	}
+	cbfstool.MaybeFatal(err, "Error catching up: %v", err)
+	err = m.save()
+	cbfstool.MaybeFatal(err, "Error saving state: %v", err)
+
+	rep := m.report()
+	log.Printf("Migrated %v files (%v of blobs) in %v; %v already there, "+
+		"%v removed, %v failed, %v changes behind",
+		rep.Files, humanize.Bytes(uint64(rep.Bytes)), time.Since(start),
+		rep.Same, rep.Removed, len(rep.Failed), rep.Behind)
+
+	if *migrateReportFn == "" {
+		cbfstool.PrintJSON(rep)
+	} else {
+		data, err := json.MarshalIndent(rep, "", "  ")
+		if err == nil {
+			err = ioutil.WriteFile(*migrateReportFn, data, 0644)
+		}
+		cbfstool.MaybeFatal(err, "Error writing report: %v", err)
+	}
+	if len(rep.Failed) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/client"
+)
+
+func TestChangedPaths(t *testing.T) {
+	changes := []cbfsclient.Change{
+		{Path: "a/x"},
+		{Path: "b/y"},
+		{Path: "a/z"},
+		{Path: "a/x"},
+		{Path: "ab"},
+	}
+	tests := []struct {
+		prefix string
+		exp    []string
+	}{
+		{"", []string{"b/y", "a/z", "a/x", "ab"}},
+		{"a/", []string{"a/z", "a/x"}},
+		{"a", []string{"a/z", "a/x", "ab"}},
+		{"c/", []string{}},
+	}
+	for _, test := range tests {
+		got := changedPaths(changes, test.prefix)
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("Expected %v under %q, got %v", test.exp, test.prefix, got)
+		}
+	}
+}
+
+func TestMigrateBlobs(t *testing.T) {
+	fm := cbfsclient.FileMeta{
+		OID: "c",
+		Previous: []cbfsclient.PrevMeta{
+			{OID: "b"},
+			{Parts: []cbfsclient.BlobPart{
+				{OID: "p1", Length: 1},
+				{OID: "p2", Length: 2},
+			}},
+		},
+	}
+	cur, old := migrateBlobs(fm)
+	if !reflect.DeepEqual(cur, []string{"c"}) {
+		t.Errorf("Expected current blob c, got %v", cur)
+	}
+	if !reflect.DeepEqual(old, []string{"b", "p1", "p2"}) {
+		t.Errorf("Expected old blobs b, p1, p2, got %v", old)
+	}
+
+	cur, old = migrateBlobs(cbfsclient.FileMeta{
+		OID:   "ignored",
+		Parts: []cbfsclient.BlobPart{{OID: "p1", Length: 1}},
+	})
+	if !reflect.DeepEqual(cur, []string{"p1"}) || old != nil {
+		t.Errorf("Expected just part p1, got %v, %v", cur, old)
+	}
+}
+
+func TestMigratedAlready(t *testing.T) {
+	ud := json.RawMessage(`{"a": 1}`)
+	src := cbfsclient.FileMeta{
+		OID:      "abc",
+		Length:   3,
+		Revno:    2,
+		Modified: time.Date(2014, 3, 1, 0, 0, 0, 0, time.UTC),
+		Userdata: &ud,
+	}
+	dst := src
+	if !migratedAlready(src, dst) {
+		t.Errorf("Expected a copy to be migrated already")
+	}
+	dst.Modified = src.Modified.Local()
+	if !migratedAlready(src, dst) {
+		t.Errorf("Expected the same time elsewhere to be migrated already")
+	}
+
+	other := json.RawMessage(`{"a": 2}`)
+	for _, f := range []func(*cbfsclient.FileMeta){
+		func(fm *cbfsclient.FileMeta) { fm.OID = "def" },
+		func(fm *cbfsclient.FileMeta) { fm.Revno = 3 },
+		func(fm *cbfsclient.FileMeta) { fm.Modified = time.Now() },
+		func(fm *cbfsclient.FileMeta) { fm.Userdata = &other },
+		func(fm *cbfsclient.FileMeta) { fm.Userdata = nil },
+	} {
+		dst := src
+		f(&dst)
+		if migratedAlready(src, dst) {
+			t.Errorf("Expected %+v not to be migrated already", dst)
+		}
+	}
+}
+
+func TestLoadMigrationState(t *testing.T) {
+	d, err := ioutil.TempDir("", "cbfsmigrate")
+	if err != nil {
+		t.Fatalf("Error making tmp dir: %v", err)
+	}
+	defer os.RemoveAll(d)
+	fn := filepath.Join(d, "state")
+
+	st, err := loadMigrationState(fn, "http://a/", "http://b/", "x/")
+	if err != nil || st.Copied || st.Prefix != "x/" {
+		t.Fatalf("Expected a new state, got %+v, %v", st, err)
+	}
+
+	m := &migrator{stateFn: fn, st: st}
+	m.st.Copied = true
+	m.st.Seq = 42
+	m.st.Failed = []string{"x/y"}
+	if err := m.save(); err != nil {
+		t.Fatalf("Error saving state: %v", err)
+	}
+
+	st, err = loadMigrationState(fn, "http://a/", "http://b/", "x/")
+	if err != nil || !st.Copied || st.Seq != 42 ||
+		!reflect.DeepEqual(st.Failed, []string{"x/y"}) {
+		t.Errorf("Expected the saved state back, got %+v, %v", st, err)
+	}
+
+	_, err = loadMigrationState(fn, "http://a/", "http://c/", "x/")
+	if err == nil {
+		t.Errorf("Expected an error loading state for another migration")
+	}
+}
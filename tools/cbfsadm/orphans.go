@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/couchbaselabs/cbfs/tools"
+	"github.com/dustin/go-humanize"
+	"github.com/dustin/httputil"
+)
+
+type orphanBlob struct {
+	OID      string    `json:"oid"`
+	Node     string    `json:"node"`
+	Length   int64     `json:"length"`
+	Modified time.Time `json:"modified"`
+	InBackup bool      `json:"inBackup,omitempty"`
+	Removed  bool      `json:"removed,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type orphanReport struct {
+	Orphans      []orphanBlob `json:"orphans"`
+	Bytes        int64        `json:"bytes"`
+	Removed      int          `json:"removed"`
+	RemovedBytes int64        `json:"removedBytes"`
+	Errors       int          `json:"errors"`
+}
+
+// Get (and maybe remove) the orphaned blobs on one node.
+func nodeOrphans(n cbfsclient.StorageNode, remove bool,
+	minAge time.Duration) ([]orphanBlob, error) {
+
+	method := "GET"
+	if remove {
+		method = "POST"
+	}
+	u := n.URLFor("/.cbfs/orphans/") + "?" +
+		url.Values{"minage": {minAge.String()}}.Encode()
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, httputil.HTTPErrorf(res, "error finding orphans: %S\n%B")
+	}
+
+	rv := []orphanBlob{}
+	d := json.NewDecoder(res.Body)
+	for {
+		o := orphanBlob{}
+		err := d.Decode(&o)
+		if err == io.EOF {
+			return rv, nil
+		}
+		if err != nil {
+			return rv, err
+		}
+		rv = append(rv, o)
+	}
+}
+
+func fsckOrphans(ustr string) {
+	c, err := cbfsclient.New(ustr)
+	cbfstool.MaybeFatal(err, "Error getting client: %v", err)
+	nodes, err := c.Nodes()
+	cbfstool.MaybeFatal(err, "Error getting nodes: %v", err)
+
+	names := []string{}
+	for name := range nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	report := orphanReport{Orphans: []orphanBlob{}}
+	failed := false
+	for _, name := range names {
+		found, err := nodeOrphans(nodes[name], *fsckRemove, *fsckMinAge)
+		if err != nil {
+			log.Printf("Error on node %v: %v", name, err)
+			failed = true
+		}
+		for _, o := range found {
+			report.Bytes += o.Length
+			if o.Removed {
+				report.Removed++
+				report.RemovedBytes += o.Length
+			}
+			if o.Error != "" {
+				report.Errors++
+			}
+		}
+		report.Orphans = append(report.Orphans, found...)
+	}
+
+	if *fsckJSON || cbfstool.JSON {
+		cbfstool.PrintJSON(&report)
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+		for _, o := range report.Orphans {
+			status := ""
+			switch {
+			case o.Error != "":
+				status = "error: " + o.Error
+			case o.Removed:
+				status = "removed"
+			case o.InBackup:
+				status = "in backup"
+			}
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", o.Node, o.OID,
+				humanize.Bytes(uint64(o.Length)),
+				humanize.Time(o.Modified), status)
+		}
+		tw.Flush()
+
+		log.Printf("Found %v orphaned blobs using %v, removed %v (%v)",
+			len(report.Orphans), humanize.Bytes(uint64(report.Bytes)),
+			report.Removed, humanize.Bytes(uint64(report.RemovedBytes)))
+		if !*fsckRemove && len(report.Orphans) > 0 {
+			log.Printf("Nothing was removed; use -remove to do so")
+		}
+	}
+
+	if failed || report.Errors > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/tools"
+)
+
+var rebalanceFlags = flag.NewFlagSet("rebalance", flag.ExitOnError)
+var rebalanceWatch = rebalanceFlags.Bool("watch", false,
+	"report progress until the rebalance is done")
+
+// Give up watching for a rebalance that hasn't shown up in this long;
+// it either found nothing to do or was over before we looked.
+const rebalanceStartWait = 2 * time.Minute
+
+type taskState struct {
+	State  string `json:"state"`
+	Detail string `json:"detail"`
+}
+
+// Find the running rebalance, if any.
+func findRebalance(ustr string) (taskState, bool) {
+	u := cbfstool.ParseURL(ustr)
+	u.Path = "/.cbfs/tasks/"
+
+	tasks := map[string]map[string]taskState{}
+	err := cbfstool.GetJsonData(u.String(), &tasks)
+	cbfstool.MaybeFatal(err, "Error getting tasks: %v", err)
+	for _, tl := range tasks {
+		if st, ok := tl["rebalance"]; ok {
+			return st, true
+		}
+	}
+	return taskState{}, false
+}
+
+func watchRebalance(u string) {
+	start := time.Now()
+	seen := false
+	last := ""
+	for {
+		st, running := findRebalance(u)
+		switch {
+		case running:
+			seen = true
+			if st.Detail != last {
+				log.Printf("Rebalance %v", st.Detail)
+				last = st.Detail
+			}
+		case seen:
+			log.Printf("Rebalance finished")
+			return
+		case time.Since(start) > rebalanceStartWait:
+			log.Printf("No rebalance running; nodes are even or it's done")
+			return
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func rebalanceCommand(u string, args []string) {
+	err := induceTask(u, "rebalance")
+	cbfstool.MaybeFatal(err, "Error starting rebalance: %v", err)
+	if !*rebalanceWatch {
+		log.Printf("Rebalancing; watch the rebalance task for progress")
+		return
+	}
+	watchRebalance(u)
+}
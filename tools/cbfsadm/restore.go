@@ -7,31 +7,117 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"regexp"
+	"strings"
 	"sync"
 	"time"
 
 	"strconv"
 
+	"github.com/couchbaselabs/cbfs/client"
 	"github.com/couchbaselabs/cbfs/tools"
-	"github.com/dustin/httputil"
 )
 
 var restoreFlags = flag.NewFlagSet("restore", flag.ExitOnError)
 var restoreForce = restoreFlags.Bool("f", false, "Overwrite existing")
+var restoreSkipSame = restoreFlags.Bool("skip-existing-same", false,
+	"Skip files already there with the same content")
 var restoreNoop = restoreFlags.Bool("n", false, "Noop")
 var restoreVerbose = restoreFlags.Bool("v", false, "Verbose restore")
 var restorePat = restoreFlags.String("match", ".*", "Regex for paths to match")
 var restoreWorkers = restoreFlags.Int("workers", 4, "Number of restore workers")
+var restoreRetries = restoreFlags.Int("retries", 5,
+	"Times to retry a file after a network or server error")
 var restoreExpire = restoreFlags.Int("expire", -1,
 	"Override expiration time (in seconds, or abs unix time)")
+var restoreCheckpoint = restoreFlags.String("checkpoint", "",
+	"File in which to record progress for resuming an interrupted restore")
+var restoreStrip = restoreFlags.String("strip-prefix", "",
+	"Remove this directory prefix from restored paths")
+var restoreAdd = restoreFlags.String("add-prefix", "",
+	"Add this directory prefix to restored paths")
+var restoreFailedLog = restoreFlags.String("failed-log", "",
+	"File in which to list paths that failed to restore")
+var restoreAsOf = restoreFlags.String("as-of", "",
+	"Restore files as they were at this time (RFC3339)")
+var restoreOrder = restoreFlags.String("order", "backup",
+	"Order to restore files in: backup (streamed), largest, smallest or name")
+var restoreSecret = newSecretFlags(restoreFlags)
+var restoreWithData = restoreFlags.Bool("with-data", false,
+	"Restore a bundle made with backup -with-data, blobs and all")
+var restoreServer = restoreFlags.Bool("server", false,
+	"Have the server read the backup itself (s3:// and gs:// only)")
+var restoreRate cbfstool.Rate
+var restoreBurst = restoreFlags.Int("burst", 0,
+	"Bytes or requests allowed at once under -rate (default one second's worth)")
+
+func init() {
+	restoreFlags.Var(&restoreRate, "rate",
+		"Limit to this many bytes/sec (e.g. 10MB) or requests/sec (e.g. 50r)")
+}
 
 type restoreWorkItem struct {
-	Path string
-	Meta *json.RawMessage
+	Path     string
+	Meta     *json.RawMessage
+	Manifest *backupManifest
+	// Set on the index record at the end of a version 2 backup
+	Index *json.RawMessage
+
+	seq int
+}
+
+// Move a backed up path from under strip to under add.  Paths that
+// aren't under strip only get the new prefix.
+func remapPath(p, strip, add string) string {
+	strip = strings.Trim(strip, "/")
+	if strip != "" && strings.HasPrefix(p, strip+"/") {
+		p = p[len(strip)+1:]
+	}
+	if add = strings.Trim(add, "/"); add != "" {
+		p = add + "/" + p
+	}
+	return p
+}
+
+// Whether the file at path already has the backed up content, going
+// by its blobs.  Files stored in parts are the same if their parts
+// are, even if the lists of parts are named differently.
+func sameAsExisting(base, path string, m *json.RawMessage) (bool, error) {
+	fm := cbfsclient.FileMeta{}
+	if err := json.Unmarshal(*m, &fm); err != nil {
+		return false, err
+	}
+
+	u := cbfstool.ParseURL(base)
+	u.Path = "/.cbfs/info/file/" + path
+	res, err := http.Get(u.String())
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case 200:
+	case 404:
+		return false, nil
+	default:
+		return false, &cbfsclient.StatusError{
+			Code:      res.StatusCode,
+			Msg:       fmt.Sprintf("error checking %v - %v", path, res.Status),
+			RequestID: res.Header.Get("X-CBFS-Request-ID"),
+		}
+	}
+
+	existing := struct {
+		Meta cbfsclient.FileMeta
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&existing); err != nil {
+		return false, err
+	}
+	return existing.Meta.SameBlobs(fm), nil
 }
 
 func restoreFile(base, path string, data interface{}) error {
@@ -58,7 +144,9 @@ func restoreFile(base, path string, data interface{}) error {
 	req.Header.Set("X-CBFS-Expiration", strconv.Itoa(*restoreExpire))
 
 	res, err := http.DefaultClient.Do(req)
-	cbfstool.MaybeFatal(err, "Error executing POST to %v - %v", u, err)
+	if err != nil {
+		return err
+	}
 
 	defer res.Body.Close()
 	switch {
@@ -68,68 +156,314 @@ func restoreFile(base, path string, data interface{}) error {
 	case res.StatusCode == 409 && !*restoreForce:
 		// OK
 	default:
-		return httputil.HTTPErrorf(res, "restore error on %v - %Sv\n%B", path)
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return &cbfsclient.StatusError{
+			Code:      res.StatusCode,
+			Msg:       fmt.Sprintf("restore error on %v - %s", path, msg),
+			RequestID: res.Header.Get("X-CBFS-Request-ID"),
+		}
 	}
 
 	return nil
 }
 
-func restoreWorker(wg *sync.WaitGroup, base string, ch <-chan restoreWorkItem) {
+func restoreWorker(wg *sync.WaitGroup, base string,
+	ch <-chan restoreWorkItem, cp *restoreCheckpointer, t *restoreTracker) {
+
 	defer wg.Done()
+	backoff := cbfsclient.Backoff{
+		Attempts: *restoreRetries + 1,
+		Initial:  time.Second,
+		Max:      time.Minute,
+	}
 	for ob := range ch {
-		err := restoreFile(base, ob.Path, ob.Meta)
+		if cbfstool.Interrupted() {
+			continue
+		}
+		same := false
+		err := backoff.DoContext(cbfstool.Context(), func() error {
+			var err error
+			if *restoreSkipSame {
+				same, err = sameAsExisting(base, ob.Path, ob.Meta)
+			}
+			if err == nil && !same {
+				err = restoreFile(base, ob.Path, ob.Meta)
+			}
+			if cbfsclient.IsTransient(err) {
+				log.Printf("Error restoring %v (may retry): %v",
+					ob.Path, err)
+			}
+			return err
+		})
+		if err != nil && cbfstool.Interrupted() {
+			// Left for a resumed restore to try again.
+			continue
+		}
 		if err != nil {
 			log.Printf("Error restoring %v: %v",
 				ob.Path, err)
 		}
+		if same {
+			t.unchanged(ob)
+		} else {
+			t.finished(ob, err)
+		}
+		// Failures hold the checkpoint back so a resumed restore
+		// tries them again.
+		if cp != nil && err == nil {
+			cp.complete(ob.seq, ob.Path)
+		}
 	}
 }
 
+// Have the server restore a backup in S3 or GCS, so it never passes
+// through here.
+func restoreOnServer(ustr, fn string) {
+	if *restoreNoop || *restoreCheckpoint != "" || *restoreStrip != "" ||
+		*restoreAdd != "" || *restoreAsOf != "" {
+		log.Fatalf("-server can't be used with -n, -checkpoint, " +
+			"-strip-prefix, -add-prefix or -as-of")
+	}
+
+	start := time.Now()
+	res, err := getClient(ustr).RestoreBackupContext(cbfstool.Context(), fn,
+		cbfsclient.RestoreBackupOptions{
+			Match:  *restorePat,
+			Force:  *restoreForce,
+			Secret: backupSecret,
+		})
+	if err != nil && cbfstool.Interrupted() {
+		log.Printf("Stopped waiting after %v; the restore of %v may still finish",
+			time.Since(start), fn)
+		os.Exit(cbfstool.ExitInterrupted)
+	}
+	cbfstool.MaybeFatal(err, "Error restoring %v: %v", fn, err)
+
+	if cbfstool.JSON {
+		cbfstool.PrintJSON(res)
+	} else {
+		log.Printf("Restored %v files in %v, %v already existed, "+
+			"%v expired, %v failed", res.Restored, time.Since(start),
+			res.Existing, res.Expired, res.Failed)
+		if res.MissingBlobs > 0 {
+			log.Printf("%v restored files have content missing from "+
+				"the cluster", res.MissingBlobs)
+		}
+	}
+	if res.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// Read the backup fn, calling f in backup order with each file after
+// the first skip that match wants restored.  Files passed over are
+// marked done in cp, if given.  Returns f's first error, if any.
+func eachRestoreItem(base, fn string, ix *backupIndex, ranges backupRanges,
+	want func(string) bool, skip int, match func(*restoreWorkItem) bool,
+	cp *restoreCheckpointer, f func(restoreWorkItem) error) error {
+
+	items := make(chan restoreWorkItem)
+	readErr := make(chan error, 1)
+	if ix != nil {
+		// Only the blocks with files to restore need reading.
+		wantBlock := func(p string) bool {
+			return want(remapPath(p, *restoreStrip, *restoreAdd))
+		}
+		go func() {
+			readErr <- readIndexedBackup(base, ix, ranges, wantBlock,
+				*restoreWorkers, items)
+		}()
+	} else {
+		r, err := openPlainBackup(base, fn)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		go func() { readErr <- readBackup(base, json.NewDecoder(gz), items) }()
+	}
+
+	seq := 0
+	for ob := range items {
+		ob.seq = seq
+		seq++
+		ob.Path = remapPath(ob.Path, *restoreStrip, *restoreAdd)
+		switch {
+		case ob.seq < skip:
+			// Already restored in a previous run.
+		case match(&ob):
+			if err := f(ob); err != nil {
+				// Don't leave the reader stuck sending the rest.
+				go func() {
+					for range items {
+					}
+				}()
+				return err
+			}
+		case cp != nil:
+			cp.complete(ob.seq, ob.Path)
+		}
+	}
+	return <-readErr
+}
+
 func restoreCommand(ustr string, args []string) {
 	regex, err := regexp.Compile(*restorePat)
 	cbfstool.MaybeFatal(err, "Error parsing match pattern: %v", err)
 
 	fn := restoreFlags.Arg(0)
 
+	asOf := time.Time{}
+	if *restoreAsOf != "" {
+		asOf, err = time.Parse(time.RFC3339, *restoreAsOf)
+		cbfstool.MaybeFatal(err, "Error parsing -as-of time: %v", err)
+	}
+
+	if _, ok := restoreOrders[*restoreOrder]; !ok {
+		log.Fatalf("Unknown -order %q", *restoreOrder)
+	}
+
+	backupSecret, err = restoreSecret.secret()
+	cbfstool.MaybeFatal(err, "Error getting backup secret: %v", err)
+
+	if *restoreServer {
+		restoreOnServer(ustr, fn)
+		return
+	}
+	if *restoreWithData {
+		if *restoreCheckpoint != "" || *restoreAsOf != "" {
+			log.Fatalf("-with-data can't be used with -checkpoint or -as-of")
+		}
+		restoreBundle(ustr, fn, regex.MatchString)
+		return
+	}
+
+	cbfstool.LimitRate(restoreRate, *restoreBurst)
+
 	start := time.Now()
 
-	f, err := os.Open(fn)
+	ix, ranges, err := openBackupIndex(ustr, fn)
 	cbfstool.MaybeFatal(err, "Error opening restore file: %v", err)
 
-	defer f.Close()
-	gz, err := gzip.NewReader(f)
-	cbfstool.MaybeFatal(err, "Error uncompressing restore file: %v", err)
+	var cp *restoreCheckpointer
+	skip := 0
+	if *restoreCheckpoint != "" {
+		cp, err = loadRestoreCheckpoint(*restoreCheckpoint, fn)
+		cbfstool.MaybeFatal(err, "Error loading checkpoint: %v", err)
+		skip = cp.skip()
+		if skip > 0 {
+			log.Printf("Resuming restore after %v records", skip)
+		}
+		cp.start()
+	}
 
-	wg := &sync.WaitGroup{}
+	if ix != nil {
+		defer ranges.Close()
+	}
+	match := func(ob *restoreWorkItem) bool {
+		return ob.Meta != nil && regex.MatchString(ob.Path) &&
+			existedAt(ob, asOf)
+	}
+	read := func(cp *restoreCheckpointer, f func(restoreWorkItem) error) error {
+		return eachRestoreItem(ustr, fn, ix, ranges, regex.MatchString,
+			skip, match, cp, f)
+	}
+
+	// Restoring in another order than the backup's reads the list of
+	// files into memory first, which gives progress a total to go by.
+	// Otherwise the backup is only read once, as it's restored, so
+	// the total comes from the index if there is one and isn't known
+	// if there isn't.
+	tracker := newRestoreTracker()
+	var todo []restoreWorkItem
+	ordered := *restoreOrder != "backup"
+	switch {
+	case ordered:
+		err = read(cp, func(ob restoreWorkItem) error {
+			tracker.add(ob)
+			todo = append(todo, ob)
+			return nil
+		})
+		cbfstool.MaybeFatal(err, "Error reading backup file: %v", err)
+	case ix != nil:
+		tracker.total = ix.countPaths(skip, func(p string) bool {
+			return regex.MatchString(remapPath(p, *restoreStrip, *restoreAdd))
+		})
+		tracker.totalBytes = -1
+	default:
+		tracker.total, tracker.totalBytes = -1, -1
+	}
 
+	// Checkpoints count from the start of the backup, so a resumed
+	// restore in another order may go over files again.
+	err = orderRestore(todo, *restoreOrder)
+	cbfstool.MaybeFatal(err, "Error ordering restore: %v", err)
+
+	tracker.run()
+
+	wg := &sync.WaitGroup{}
 	ch := make(chan restoreWorkItem)
 	for i := 0; i < *restoreWorkers; i++ {
 		wg.Add(1)
-		go restoreWorker(wg, ustr, ch)
+		go restoreWorker(wg, ustr, ch, cp, tracker)
 	}
-
-	d := json.NewDecoder(gz)
-	nfiles := 0
-	done := false
-	for !done {
-		ob := restoreWorkItem{}
-
-		err := d.Decode(&ob)
-		switch err {
-		case nil:
-			if regex.MatchString(ob.Path) {
-				nfiles++
-				ch <- ob
+	feed := func(ob restoreWorkItem) error {
+		select {
+		case ch <- ob:
+			return nil
+		case <-cbfstool.Context().Done():
+			return cbfstool.Context().Err()
+		}
+	}
+	if ordered {
+		for _, ob := range todo {
+			if err = feed(ob); err != nil {
+				break
 			}
-		case io.EOF:
-			done = true
-			break
-		default:
-			log.Fatalf("Error reading backup file: %v", err)
 		}
+	} else {
+		err = read(cp, feed)
+	}
+	if err != nil && !cbfstool.Interrupted() {
+		log.Fatalf("Error reading backup file: %v", err)
 	}
 	close(ch)
 	wg.Wait()
+	tracker.stop()
+
+	if cp != nil {
+		err = cp.stop()
+		cbfstool.MaybeFatal(err, "Error saving checkpoint: %v", err)
+	}
+
+	if *restoreFailedLog != "" {
+		err = tracker.writeFailed(*restoreFailedLog)
+		cbfstool.MaybeFatal(err, "Error writing failed log: %v", err)
+	}
 
-	log.Printf("Restored %v files in %v", nfiles, time.Since(start))
+	if cbfstool.Interrupted() {
+		log.Printf("Interrupted after %v: restored %v of %v files, %v failed, "+
+			"%v unchanged", time.Since(start),
+			tracker.done-len(tracker.failed)-tracker.same, tracker.totalFiles(),
+			len(tracker.failed), tracker.same)
+		if cp != nil {
+			log.Printf("Run again with -checkpoint %v to resume",
+				*restoreCheckpoint)
+		}
+		os.Exit(cbfstool.ExitInterrupted)
+	}
+
+	log.Printf("Restored %v files in %v, %v failed, %v unchanged",
+		tracker.done-len(tracker.failed)-tracker.same, time.Since(start),
+		len(tracker.failed), tracker.same)
+	if len(tracker.failed) > 0 {
+		if cp != nil {
+			log.Printf("Run again with -checkpoint %v to retry them",
+				*restoreCheckpoint)
+		}
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemapPath(t *testing.T) {
+	tests := []struct {
+		in, strip, add, exp string
+	}{
+		{"a/b", "", "", "a/b"},
+		{"old/x/y", "/old", "", "x/y"},
+		{"old/x/y", "old/", "/new", "new/x/y"},
+		{"older/x", "/old", "/new", "new/older/x"},
+		{"other/x", "/old", "", "other/x"},
+		{"a/b", "", "new/", "new/a/b"},
+		{"old/x", "/old/x", "/new", "new/old/x"},
+	}
+
+	for _, test := range tests {
+		got := remapPath(test.in, test.strip, test.add)
+		if got != test.exp {
+			t.Errorf("Expected %q for %q (-%q +%q), got %q",
+				test.exp, test.in, test.strip, test.add, got)
+		}
+	}
+}
+
+func TestRestoreETA(t *testing.T) {
+	tests := []struct {
+		done, total         int
+		doneBytes, allBytes int64
+		elapsed, exp        time.Duration
+	}{
+		{0, 10, 0, 0, time.Minute, 0},
+		{5, 10, 0, 0, time.Minute, time.Minute},
+		{1, 4, 0, 0, time.Minute, 3 * time.Minute},
+		// Bytes win over counts when there are any.
+		{9, 10, 100, 1000, time.Minute, 9 * time.Minute},
+		{2, 3, 0, 0, 10 * time.Second, 5 * time.Second},
+	}
+
+	for _, test := range tests {
+		tr := restoreTracker{done: test.done, total: test.total,
+			doneBytes: test.doneBytes, totalBytes: test.allBytes}
+		if got := tr.eta(test.elapsed); got != test.exp {
+			t.Errorf("Expected %v for %+v, got %v", test.exp, test, got)
+		}
+	}
+}
+
+func TestSameAsExisting(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			switch req.URL.Path {
+			case "/.cbfs/info/file/a/b":
+				w.Write([]byte(`{"path": "a/b",
+					"meta": {"oid": "abc", "length": 5}}`))
+			case "/.cbfs/info/file/a/parts":
+				w.Write([]byte(`{"path": "a/parts",
+					"meta": {"oid": "m1", "length": 5,
+					"parts": [{"oid": "p1", "length": 2},
+						{"oid": "p2", "length": 3}]}}`))
+			default:
+				http.NotFound(w, req)
+			}
+		}))
+	defer ts.Close()
+
+	tests := []struct {
+		path, meta string
+		exp        bool
+	}{
+		{"a/b", `{"oid": "abc", "length": 5}`, true},
+		{"a/b", `{"oid": "abd", "length": 5}`, false},
+		{"a/b", `{"oid": "abc", "length": 6}`, false},
+		{"a/c", `{"oid": "abc", "length": 5}`, false},
+		{"a/parts", `{"oid": "m1", "length": 5}`, true},
+		{"a/parts", `{"oid": "m2", "length": 5,
+			"parts": [{"oid": "p1", "length": 2}, {"oid": "p2", "length": 3}]}`,
+			true},
+		{"a/parts", `{"oid": "m2", "length": 5,
+			"parts": [{"oid": "p1", "length": 2}, {"oid": "p3", "length": 3}]}`,
+			false},
+	}
+	for _, test := range tests {
+		m := json.RawMessage(test.meta)
+		got, err := sameAsExisting(ts.URL, test.path, &m)
+		if err != nil || got != test.exp {
+			t.Errorf("Expected %v for %v %v, got %v, %v",
+				test.exp, test.path, test.meta, got, err)
+		}
+	}
+}
+
+func TestEachRestoreItem(t *testing.T) {
+	d, err := ioutil.TempDir("", "cbfsrestore")
+	if err != nil {
+		t.Fatalf("Error making tmp dir: %v", err)
+	}
+	defer os.RemoveAll(d)
+	fn := filepath.Join(d, "backup.gz")
+
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	e := json.NewEncoder(gz)
+	for _, p := range []string{"a/1", "b/2", "a/3", "a/4"} {
+		e.Encode(map[string]interface{}{"path": p,
+			"meta": map[string]interface{}{"oid": "x", "length": 1}})
+	}
+	gz.Close()
+	if err := ioutil.WriteFile(fn, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Error writing backup: %v", err)
+	}
+
+	match := func(ob *restoreWorkItem) bool {
+		return strings.HasPrefix(ob.Path, "a/")
+	}
+	got := []string{}
+	err = eachRestoreItem("", fn, nil, nil, nil, 1, match, nil,
+		func(ob restoreWorkItem) error {
+			got = append(got, ob.Path)
+			return nil
+		})
+	if exp := []string{"a/3", "a/4"}; err != nil || !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v, %v", exp, got, err)
+	}
+
+	stop := errors.New("stop")
+	err = eachRestoreItem("", fn, nil, nil, nil, 0, match, nil,
+		func(ob restoreWorkItem) error { return stop })
+	if err != stop {
+		t.Errorf("Expected the callback's error, got %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The orders a restore can go in.  Directories in cbfs are only
+// implied by the files in them, so there's nothing to restore for
+// them; by name, a directory's files are restored before those of its
+// subdirectories, so an interrupted restore leaves whole directories
+// rather than files scattered throughout.
+var restoreOrders = map[string]func(s *restoreSorter, i, j int) bool{
+	"backup": nil,
+	"largest": func(s *restoreSorter, i, j int) bool {
+		return s.sizes[i] > s.sizes[j]
+	},
+	"smallest": func(s *restoreSorter, i, j int) bool {
+		return s.sizes[i] < s.sizes[j]
+	},
+	"name": func(s *restoreSorter, i, j int) bool {
+		return pathLess(s.items[i].Path, s.items[j].Path)
+	},
+}
+
+type restoreSorter struct {
+	items []restoreWorkItem
+	sizes []int64
+	less  func(s *restoreSorter, i, j int) bool
+}
+
+func (s *restoreSorter) Len() int {
+	return len(s.items)
+}
+
+func (s *restoreSorter) Less(i, j int) bool {
+	return s.less(s, i, j)
+}
+
+func (s *restoreSorter) Swap(i, j int) {
+	s.items[i], s.items[j] = s.items[j], s.items[i]
+	s.sizes[i], s.sizes[j] = s.sizes[j], s.sizes[i]
+}
+
+// Whether file a comes before file b by name: a directory's own files
+// first, then each subdirectory's in turn.
+func pathLess(a, b string) bool {
+	as, bs := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		aFile, bFile := i == len(as)-1, i == len(bs)-1
+		switch {
+		case aFile != bFile:
+			return aFile
+		case as[i] != bs[i]:
+			return as[i] < bs[i]
+		}
+	}
+	return len(as) < len(bs)
+}
+
+// Put files in the given restore order.  Ties keep their backup
+// order.
+func orderRestore(items []restoreWorkItem, order string) error {
+	less, ok := restoreOrders[order]
+	if !ok {
+		return fmt.Errorf("unknown restore order %q", order)
+	}
+	if less == nil {
+		return nil
+	}
+	s := &restoreSorter{items, make([]int64, len(items)), less}
+	for i, ob := range items {
+		s.sizes[i] = metaLength(ob.Meta)
+	}
+	sort.Stable(s)
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestOrderRestore(t *testing.T) {
+	item := func(p string, l int) restoreWorkItem {
+		m := json.RawMessage(fmt.Sprintf(`{"length": %d}`, l))
+		return restoreWorkItem{Path: p, Meta: &m}
+	}
+	tests := []struct {
+		order, exp string
+	}{
+		{"backup", "[a/b/c a/z b a/b/d a.x/y a/y]"},
+		{"largest", "[a/b/d a/b/c a.x/y a/y a/z b]"},
+		{"smallest", "[a/z b a/y a/b/c a.x/y a/b/d]"},
+		{"name", "[b a/y a/z a/b/c a/b/d a.x/y]"},
+	}
+	for _, test := range tests {
+		items := []restoreWorkItem{
+			item("a/b/c", 10), item("a/z", 1), item("b", 1),
+			item("a/b/d", 20), item("a.x/y", 10), item("a/y", 5),
+		}
+		if err := orderRestore(items, test.order); err != nil {
+			t.Fatalf("Error ordering by %v: %v", test.order, err)
+		}
+		got := []string{}
+		for _, ob := range items {
+			got = append(got, ob.Path)
+		}
+		if s := fmt.Sprint(got); s != test.exp {
+			t.Errorf("Expected %v by %v, got %v", test.exp, test.order, s)
+		}
+	}
+
+	if err := orderRestore(nil, "random"); err == nil {
+		t.Errorf("Expected an error for an unknown order")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+const restoreProgressFreq = 10 * time.Second
+
+// How far along a restore is, and what went wrong.  A total that
+// isn't known until the backup has been read is negative.
+type restoreTracker struct {
+	mu         sync.Mutex
+	start      time.Time
+	total      int
+	done       int
+	totalBytes int64
+	doneBytes  int64
+	same       int
+	failed     []string
+	quit       chan bool
+	wg         sync.WaitGroup
+}
+
+// The content length recorded in a backed up file's metadata.
+func metaLength(m *json.RawMessage) int64 {
+	fm := struct {
+		Length int64 `json:"length"`
+	}{}
+	if m != nil {
+		json.Unmarshal(*m, &fm)
+	}
+	return fm.Length
+}
+
+func newRestoreTracker() *restoreTracker {
+	return &restoreTracker{
+		start: time.Now(),
+		quit:  make(chan bool),
+	}
+}
+
+// Count a file to be restored in the total.
+func (t *restoreTracker) add(ob restoreWorkItem) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.total++
+	t.totalBytes += metaLength(ob.Meta)
+}
+
+func (t *restoreTracker) finished(ob restoreWorkItem, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done++
+	t.doneBytes += metaLength(ob.Meta)
+	if err != nil {
+		t.failed = append(t.failed, ob.Path)
+	}
+}
+
+func (t *restoreTracker) unchanged(ob restoreWorkItem) {
+	t.finished(ob, nil)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.same++
+}
+
+// Estimate the time remaining from the rate so far, by bytes if the
+// files have any, otherwise by count.
+func (t *restoreTracker) eta(elapsed time.Duration) time.Duration {
+	done, total := float64(t.done), float64(t.total)
+	if t.totalBytes > 0 {
+		done, total = float64(t.doneBytes), float64(t.totalBytes)
+	}
+	if done == 0 {
+		return 0
+	}
+	d := time.Duration(float64(elapsed) * (total - done) / done)
+	return d - d%time.Second
+}
+
+// The number of files to restore, or ? if it isn't known.
+func (t *restoreTracker) totalFiles() string {
+	if t.total < 0 {
+		return "?"
+	}
+	return strconv.Itoa(t.total)
+}
+
+func (t *restoreTracker) report() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	totalBytes, eta := "?", "?"
+	if t.totalBytes >= 0 {
+		totalBytes = humanize.Bytes(uint64(t.totalBytes))
+	}
+	if t.total >= 0 {
+		eta = t.eta(time.Since(t.start)).String()
+	}
+	log.Printf("Restored %v/%v files (%v failed), %v/%v, ETA %v",
+		t.done, t.totalFiles(), len(t.failed),
+		humanize.Bytes(uint64(t.doneBytes)), totalBytes, eta)
+}
+
+// Periodically report progress until stopped.
+func (t *restoreTracker) run() {
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		tick := time.NewTicker(restoreProgressFreq)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				t.report()
+			case <-t.quit:
+				return
+			}
+		}
+	}()
+}
+
+func (t *restoreTracker) stop() {
+	close(t.quit)
+	t.wg.Wait()
+}
+
+// Write the paths that failed to restore, one per line.
+func (t *restoreTracker) writeFailed(fn string) error {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	for _, p := range t.failed {
+		if _, err = f.WriteString(p + "\n"); err != nil {
+			break
+		}
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
@@ -34,6 +34,33 @@ func (b backups) Swap(i, j int) {
 	b[i], b[j] = b[j], b[i]
 }
 
+// Filter out of torm any backup an incremental backup in keep (or
+// its ancestors) depends on.
+func keepParents(torm, keep backups) backups {
+	byName := map[string]Backup{}
+	for _, b := range torm {
+		byName[b.Filename] = b
+	}
+
+	needed := map[string]bool{}
+	for _, b := range keep {
+		for p := b.Parent; p != "" && !needed[p]; p = byName[p].Parent {
+			needed[p] = true
+		}
+	}
+
+	rv := backups{}
+	for _, b := range torm {
+		if needed[b.Filename] {
+			cbfstool.Verbose(*rmbakVerbose,
+				"Keeping %v, it's the parent of a kept backup", b.Filename)
+			continue
+		}
+		rv = append(rv, b)
+	}
+	return rv
+}
+
 func relativeUrl(u, path string) string {
 	du := cbfstool.ParseURL(u)
 	du.Path = path
@@ -90,7 +117,8 @@ func rmBakCommand(ustr string, args []string) {
 		return
 	}
 
-	torm := data.Backups[:len(data.Backups)-*rmbakKeep]
+	torm := keepParents(data.Backups[:len(data.Backups)-*rmbakKeep],
+		data.Backups[len(data.Backups)-*rmbakKeep:])
 	cbfstool.Verbose(*rmbakVerbose, "Removing %v backups, keeping %v",
 		len(torm), len(data.Backups)-len(torm))
 
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeepParents(t *testing.T) {
+	torm := backups{
+		{Filename: "full1"},
+		{Filename: "inc1", Parent: "full1"},
+		{Filename: "full2"},
+		{Filename: "inc2", Parent: "full2"},
+	}
+	keep := backups{
+		{Filename: "inc3", Parent: "inc2"},
+	}
+
+	got := []string{}
+	for _, b := range keepParents(torm, keep) {
+		got = append(got, b.Filename)
+	}
+	exp := []string{"full1", "inc1"}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("Expected %v, got %v", exp, got)
+	}
+}
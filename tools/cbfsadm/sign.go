@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/config"
+	"github.com/couchbaselabs/cbfs/tools"
+	"github.com/dustin/go-humanize"
+)
+
+var signFlags = flag.NewFlagSet("sign", flag.ExitOnError)
+var signMethod = signFlags.String("method", "GET",
+	"Method to allow: GET (read), PUT (write) or POST (form upload)")
+var signTTL = signFlags.Duration("ttl", time.Hour, "How long the URL is valid")
+var signPrefix = signFlags.Bool("prefix", false,
+	"Allow any path under the given one")
+var signMaxSize = signFlags.String("maxsize", "",
+	"Largest upload allowed (e.g. 10MB)")
+var signType = signFlags.String("type", "",
+	"Content type uploads must have (e.g. image/*)")
+
+func signCommand(u string, args []string) {
+	method := strings.ToUpper(*signMethod)
+	switch method {
+	case "GET", "PUT", "POST":
+	default:
+		log.Fatalf("Invalid method: %q (expected GET, PUT or POST)", *signMethod)
+	}
+
+	path := strings.TrimLeft(args[0], "/")
+	policy := cbfsconfig.UploadPolicy{ContentType: *signType}
+	if *signPrefix {
+		policy.Prefix = path
+	}
+	if *signMaxSize != "" {
+		n, err := humanize.ParseBytes(*signMaxSize)
+		cbfstool.MaybeFatal(err, "Error parsing max size: %v", err)
+		policy.MaxSize = int64(n)
+	}
+	if method == "GET" && (policy.MaxSize > 0 || policy.ContentType != "") {
+		log.Fatalf("Size and type restrictions only apply to uploads")
+	}
+
+	conf, err := getClient(u).GetConfigSecrets()
+	cbfstool.MaybeFatal(err, "Error getting signing key: %v", err)
+
+	q, err := conf.SignUpload(method, path, policy, time.Now().Add(*signTTL))
+	cbfstool.MaybeFatal(err, "Error signing %v: %v", path, err)
+
+	su := cbfstool.ParseURL(u)
+	su.Path = "/" + path
+	if method == "POST" {
+		su.Path = "/.cbfs/upload/" + path
+	}
+	su.RawQuery = q.Encode()
+	if cbfstool.JSON {
+		cbfstool.PrintJSON(map[string]string{"method": method, "url": su.String()})
+	} else {
+		fmt.Println(su.String())
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/config"
+	"github.com/couchbaselabs/cbfs/sigv4"
+	"github.com/couchbaselabs/cbfs/tools"
+	"github.com/dustin/httputil"
+)
+
+// The secret encrypted backups are read with, if one was given.
+var backupSecret []byte
+
+// Where a command gets the secret for encrypting or reading backups.
+type secretFlags struct {
+	pass, keyfile *string
+}
+
+func newSecretFlags(fs *flag.FlagSet) secretFlags {
+	return secretFlags{
+		pass: fs.String("passphrase", "",
+			"Passphrase for encrypted backups"),
+		keyfile: fs.String("keyfile", "",
+			"File holding the secret for encrypted backups"),
+	}
+}
+
+// The secret given, or nil for none.
+func (s secretFlags) secret() ([]byte, error) {
+	switch {
+	case *s.pass != "" && *s.keyfile != "":
+		return nil, errors.New("give a passphrase or a key file, not both")
+	case *s.keyfile != "":
+		data, err := ioutil.ReadFile(*s.keyfile)
+		if err != nil {
+			return nil, err
+		}
+		data = bytes.TrimRight(data, "\r\n")
+		if len(data) == 0 {
+			return nil, fmt.Errorf("%v is empty", *s.keyfile)
+		}
+		return data, nil
+	case *s.pass != "":
+		return []byte(*s.pass), nil
+	}
+	return nil, nil
+}
+
+type backupReader struct {
+	io.Reader
+	io.Closer
+}
+
+// Open a backup for streaming its gzipped records, decrypting it with
+// backupSecret if it's encrypted.  Encrypted backups fail to read to
+// the end if they've been tampered with or cut short.
+func openPlainBackup(base, src string) (io.ReadCloser, error) {
+	f, err := openBackupSource(base, src)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(f)
+	hdr, _ := br.Peek(len(cbfsconfig.BackupEncMagic))
+	if !cbfsconfig.IsEncryptedBackup(hdr) {
+		return backupReader{br, f}, nil
+	}
+	if backupSecret == nil {
+		f.Close()
+		return nil, fmt.Errorf("%v is encrypted; give -passphrase or -keyfile",
+			src)
+	}
+	r, err := cbfsconfig.NewBackupDecrypter(br, backupSecret)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return backupReader{r, f}, nil
+}
+
+// Open a backup for streaming.  src may be a local filename, an
+// http(s) URL, an s3://bucket/key URL, or a cbfs://path URL naming a
+// file in the cluster at base.
+func openBackupSource(base, src string) (io.ReadCloser, error) {
+	if isLocalSource(src) {
+		return os.Open(src)
+	}
+	req, err := backupRequest(base, src)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		defer res.Body.Close()
+		return nil, httputil.HTTPErrorf(res, "error fetching %v - %S\n%B",
+			src)
+	}
+	return res.Body, nil
+}
+
+// Whether a backup source is a plain filename (or starts with a
+// windows drive letter).
+func isLocalSource(src string) bool {
+	u, err := url.Parse(src)
+	return err != nil || u.Scheme == "" || len(u.Scheme) == 1
+}
+
+// Build a GET for a backup that isn't on the local disk.
+func backupRequest(base, src string) (*http.Request, error) {
+	u, err := url.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return http.NewRequest("GET", src, nil)
+	case "cbfs":
+		bu := cbfstool.ParseURL(base)
+		bu.Path = "/" + strings.TrimLeft(u.Host+u.Path, "/")
+		return http.NewRequest("GET", bu.String(), nil)
+	case "s3":
+		return newS3Request(u.Host, strings.TrimLeft(u.Path, "/"))
+	}
+	return nil, fmt.Errorf("unsupported backup source: %v", src)
+}
+
+// Build a GET for an S3 object.  Credentials come from the usual
+// AWS_* environment variables; without them the request is anonymous.
+func newS3Request(bucket, key string) (*http.Request, error) {
+	region := sigv4.EnvRegion()
+	u := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucket, region,
+		sigv4.URIEscape(key, true))
+	req, err := http.NewRequest("GET", u, nil)
+	creds := sigv4.EnvCredentials()
+	if err != nil || !creds.Valid() {
+		return req, err
+	}
+	req.Header.Set("X-Amz-Content-Sha256", sigv4.EmptySHA256)
+	sigv4.Sign(req, creds, region, "s3", sigv4.EmptySHA256, time.Now())
+	return req, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/couchbaselabs/cbfs/config"
+	"github.com/couchbaselabs/cbfs/tools"
+)
+
+var adduserFlags = flag.NewFlagSet("adduser", flag.ExitOnError)
+var adduserS3 = adduserFlags.Bool("s3", false,
+	"also issue a secret key for signing S3 requests")
+
+func newToken() string {
+	b := make([]byte, 24)
+	_, err := rand.Read(b)
+	cbfstool.MaybeFatal(err, "Error generating token: %v", err)
+	return hex.EncodeToString(b)
+}
+
+func addUserCommand(u string, args []string) {
+	name := args[0]
+	var grants []cbfsconfig.Grant
+	for _, s := range args[1:] {
+		g, err := cbfsconfig.ParseGrant(s)
+		cbfstool.MaybeFatal(err, "%v", err)
+		grants = append(grants, g)
+	}
+
+	token := newToken()
+	s3Secret := ""
+	if *adduserS3 {
+		s3Secret = newToken()
+	}
+	err := getClient(u).UpdateConfig(func(conf *cbfsconfig.CBFSConfig) error {
+		if conf.Users == nil {
+			conf.Users = map[string]cbfsconfig.AuthUser{}
+		}
+		conf.Users[name] = cbfsconfig.AuthUser{
+			TokenHash: cbfsconfig.HashToken(token),
+			Grants:    grants,
+			S3Secret:  s3Secret,
+		}
+		return nil
+	})
+	cbfstool.MaybeFatal(err, "Error adding user: %v", err)
+
+	// Only the hash is stored, so this is the only chance to see it.
+	// The S3 secret goes with the name as its access key.
+	if cbfstool.JSON {
+		out := map[string]string{"name": name, "token": token}
+		if s3Secret != "" {
+			out["s3Secret"] = s3Secret
+		}
+		cbfstool.PrintJSON(out)
+	} else {
+		fmt.Println(token)
+		if s3Secret != "" {
+			fmt.Println(s3Secret)
+		}
+	}
+}
+
+func rmUserCommand(u string, args []string) {
+	name := args[0]
+	err := getClient(u).UpdateConfig(func(conf *cbfsconfig.CBFSConfig) error {
+		if _, ok := conf.Users[name]; !ok {
+			return fmt.Errorf("no such user: %v", name)
+		}
+		delete(conf.Users, name)
+		return nil
+	})
+	cbfstool.MaybeFatal(err, "Error removing user: %v", err)
+}
+
+func lsUsersCommand(u string, args []string) {
+	conf, err := getClient(u).GetConfig()
+	cbfstool.MaybeFatal(err, "Error getting config: %v", err)
+
+	names := make([]string, 0, len(conf.Users))
+	for n := range conf.Users {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+	for _, n := range names {
+		grants := []string{}
+		for _, g := range conf.Users[n].Grants {
+			grants = append(grants, g.String())
+		}
+		if cbfstool.JSON {
+			cbfstool.PrintJSONLine(map[string]interface{}{
+				"name": n, "grants": grants})
+			continue
+		}
+		fmt.Fprintf(tw, "%v\t%v\n", n, strings.Join(grants, " "))
+	}
+	tw.Flush()
+}
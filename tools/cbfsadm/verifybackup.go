@@ -0,0 +1,229 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/couchbaselabs/cbfs/tools"
+)
+
+var verifyFlags = flag.NewFlagSet("verifybackup", flag.ExitOnError)
+var verifyMin = verifyFlags.Int("min", 0,
+	"Copies each blob should have (default is the cluster's minrepl)")
+var verifyWorkers = verifyFlags.Int("workers", 8, "Number of blob checkers")
+var verifySecret = newSecretFlags(verifyFlags)
+var verifyVerbose = verifyFlags.Bool("v", false,
+	"List every file referencing a bad blob")
+
+const verifyBatchSize = 256
+
+// The blobs holding a backed up file's content.
+func backupBlobs(m *json.RawMessage) ([]string, error) {
+	fm := cbfsclient.FileMeta{}
+	if m == nil {
+		return nil, nil
+	}
+	if err := json.Unmarshal(*m, &fm); err != nil {
+		return nil, err
+	}
+	if len(fm.Parts) > 0 {
+		rv := make([]string, 0, len(fm.Parts))
+		for _, p := range fm.Parts {
+			rv = append(rv, p.OID)
+		}
+		return rv, nil
+	}
+	if fm.OID == "" {
+		return nil, nil
+	}
+	return []string{fm.OID}, nil
+}
+
+// Count the nodes that answer for a blob the registry says they hold.
+func countLiveCopies(nodes map[string]cbfsclient.StorageNode,
+	oid string, bi cbfsclient.BlobInfo) int {
+
+	rv := 0
+	for name := range bi.Nodes {
+		n, ok := nodes[name]
+		if !ok {
+			continue
+		}
+		res, err := http.Head(n.BlobURL(oid))
+		if err != nil {
+			log.Printf("Error checking %v on %v: %v", oid, name, err)
+			continue
+		}
+		res.Body.Close()
+		if res.StatusCode == 200 {
+			rv++
+		}
+	}
+	return rv
+}
+
+// Find the number of live copies of each of the given blobs.
+func checkBlobCopies(c *cbfsclient.Client, oids []string) (map[string]int, error) {
+	nodes, err := c.Nodes()
+	if err != nil {
+		return nil, err
+	}
+
+	type verifyWork struct {
+		oid string
+		bi  cbfsclient.BlobInfo
+	}
+
+	rv := map[string]int{}
+	var mu sync.Mutex
+	ch := make(chan verifyWork)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < *verifyWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for w := range ch {
+				n := countLiveCopies(nodes, w.oid, w.bi)
+				mu.Lock()
+				rv[w.oid] = n
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for len(oids) > 0 {
+		batch := oids
+		if len(batch) > verifyBatchSize {
+			batch = batch[:verifyBatchSize]
+		}
+		oids = oids[len(batch):]
+
+		infos, err := c.GetBlobInfos(batch...)
+		if err != nil {
+			close(ch)
+			wg.Wait()
+			return nil, err
+		}
+		for _, oid := range batch {
+			ch <- verifyWork{oid, infos[oid]}
+		}
+	}
+	close(ch)
+	wg.Wait()
+
+	return rv, nil
+}
+
+func verifyBackupCommand(ustr string, args []string) {
+	fn := verifyFlags.Arg(0)
+
+	var err error
+	backupSecret, err = verifySecret.secret()
+	cbfstool.MaybeFatal(err, "Error getting backup secret: %v", err)
+
+	c := getClient(ustr)
+	want := *verifyMin
+	if want == 0 {
+		conf, err := c.GetConfig()
+		cbfstool.MaybeFatal(err, "Error getting config: %v", err)
+		want = conf.MinReplicas
+	}
+
+	f, err := openPlainBackup(ustr, fn)
+	cbfstool.MaybeFatal(err, "Error opening backup: %v", err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	cbfstool.MaybeFatal(err, "Error uncompressing backup: %v", err)
+
+	items := make(chan restoreWorkItem)
+	readErr := make(chan error, 1)
+	go func() { readErr <- readBackup(ustr, json.NewDecoder(gz), items) }()
+
+	// Blob -> files referencing it
+	refs := map[string][]string{}
+	files, badMeta := 0, 0
+	for ob := range items {
+		files++
+		oids, err := backupBlobs(ob.Meta)
+		if err != nil {
+			log.Printf("Bad metadata for %v: %v", ob.Path, err)
+			badMeta++
+			continue
+		}
+		for _, oid := range oids {
+			refs[oid] = append(refs[oid], ob.Path)
+		}
+	}
+	streamErr := <-readErr
+	if streamErr != nil {
+		log.Printf("Backup is damaged after %v files: %v", files, streamErr)
+	}
+
+	oids := make([]string, 0, len(refs))
+	for oid := range refs {
+		oids = append(oids, oid)
+	}
+	sort.Strings(oids)
+
+	log.Printf("Checking %v blobs referenced by %v files", len(oids), files)
+	copies, err := checkBlobCopies(c, oids)
+	cbfstool.MaybeFatal(err, "Error checking blobs: %v", err)
+
+	missing, under := 0, 0
+	for _, oid := range oids {
+		n := copies[oid]
+		if cbfstool.JSON {
+			if n < want {
+				cbfstool.PrintJSONLine(map[string]interface{}{
+					"oid": oid, "copies": n, "want": want, "files": refs[oid]})
+			}
+			if n == 0 {
+				missing++
+			} else if n < want {
+				under++
+			}
+			continue
+		}
+		switch {
+		case n == 0:
+			missing++
+			fmt.Printf("missing\t%v\t%v\n", oid, refs[oid][0])
+		case n < want:
+			under++
+			fmt.Printf("under\t%v\t%v/%v copies\t%v\n",
+				oid, n, want, refs[oid][0])
+		default:
+			continue
+		}
+		if *verifyVerbose {
+			for _, p := range refs[oid][1:] {
+				fmt.Printf("\t\t%v\n", p)
+			}
+		}
+	}
+
+	if cbfstool.JSON {
+		cbfstool.PrintJSONLine(map[string]int{
+			"files": files, "blobs": len(oids), "missing": missing,
+			"under": under, "badMeta": badMeta})
+	} else {
+		fmt.Printf("%v files, %v blobs: %v missing, %v under-replicated",
+			files, len(oids), missing, under)
+		if badMeta > 0 {
+			fmt.Printf(", %v with bad metadata", badMeta)
+		}
+		fmt.Printf("\n")
+	}
+
+	if streamErr != nil || badMeta > 0 || missing > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestBackupBlobs(t *testing.T) {
+	tests := []struct {
+		in  string
+		exp []string
+	}{
+		{`{"oid": "abc", "length": 3}`, []string{"abc"}},
+		{`{"oid": "whole", "parts": [{"oid": "p1"}, {"oid": "p2"}]}`,
+			[]string{"p1", "p2"}},
+		{`{"length": 0}`, nil},
+	}
+
+	for _, test := range tests {
+		m := json.RawMessage(test.in)
+		got, err := backupBlobs(&m)
+		if err != nil {
+			t.Errorf("Error on %v: %v", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("Expected %v for %v, got %v", test.exp, test.in, got)
+		}
+	}
+
+	if got, err := backupBlobs(nil); got != nil || err != nil {
+		t.Errorf("Expected nothing for nil meta, got %v, %v", got, err)
+	}
+	bad := json.RawMessage(`{"oid": 7}`)
+	if _, err := backupBlobs(&bad); err == nil {
+		t.Errorf("Expected error on bad meta")
+	}
+}
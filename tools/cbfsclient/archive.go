@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/couchbaselabs/cbfs/tools"
+)
+
+var archiveFlags = flag.NewFlagSet("archive", flag.ExitOnError)
+var archiveFormat = archiveFlags.String("format", "tar.gz",
+	"Archive format: tar, tar.gz or zip")
+
+func archiveCommand(base string, args []string) {
+	client, err := cbfsclient.New(base)
+	cbfstool.MaybeFatal(err, "Error setting up client: %v", err)
+
+	src := archiveFlags.Arg(0)
+	dest := archiveFlags.Arg(1)
+	if dest == "" {
+		name := path.Base(strings.Trim(src, "/"))
+		if name == "." || name == "" {
+			name = "cbfs-archive"
+		}
+		dest = name + "." + *archiveFormat
+	}
+
+	r, err := client.Archive(src, *archiveFormat)
+	cbfstool.MaybeFatal(err, "Error getting archive: %v", err)
+	defer r.Close()
+
+	var w io.Writer = os.Stdout
+	if dest != "-" {
+		f, err := os.Create(dest)
+		cbfstool.MaybeFatal(err, "Error creating %v: %v", dest, err)
+		defer f.Close()
+		w = f
+	}
+
+	_, err = io.Copy(w, r)
+	cbfstool.MaybeFatal(err, "Error writing archive: %v", err)
+}
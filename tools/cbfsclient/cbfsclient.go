@@ -5,14 +5,53 @@ import (
 )
 
 func main() {
+	cbfstool.RemoteArgs = map[string][]int{
+		"upload":    {1},
+		"sync":      {1},
+		"download":  {0},
+		"find":      {0},
+		"ls":        {0},
+		"rm":        {-1},
+		"cp":        {0, 1},
+		"mv":        {0, 1},
+		"revisions": {0},
+		"revert":    {0},
+		"fileinfo":  {0},
+		"quota":     {0},
+		"du":        {0},
+		"archive":   {0},
+		"extract":   {1},
+		"trash":     {1},
+		"retain":    {0},
+		"pin":       {0},
+		"shell":     {0},
+		"export":    {0},
+	}
 	cbfstool.ToolMain(
 		map[string]cbfstool.Command{
-			"upload":   {2, uploadCommand, "/src/dir /dest/dir", uploadFlags},
-			"download": {-1, downloadCommand, "/src/dir /dest/dir", dlFlags},
-			"find":     {1, findCommand, "/src/dir", findFlags},
-			"ls":       {0, lsCommand, "[path]", lsFlags},
-			"rm":       {-1, rmCommand, "path", rmFlags},
-			"info":     {0, infoCommand, "", infoFlags},
-			"fileinfo": {1, fileInfoCommand, "path", fileInfoFlags},
+			"upload":    {2, uploadCommand, "/src/dir /dest/dir", uploadFlags},
+			"sync":      {2, syncCommand, "/src/dir /dest/dir", syncFlags},
+			"download":  {-1, downloadCommand, "/src/dir /dest/dir", dlFlags},
+			"find":      {1, findCommand, "/src/dir", findFlags},
+			"ls":        {0, lsCommand, "[path]", lsFlags},
+			"rm":        {-1, rmCommand, "path", rmFlags},
+			"cp":        {2, cpCommand, "/src/file /dest/file", cpFlags},
+			"mv":        {2, mvCommand, "/src/file /dest/file", mvFlags},
+			"revisions": {1, revisionsCommand, "path", revisionsFlags},
+			"revert":    {2, revertCommand, "path revno", revertFlags},
+			"info":      {0, infoCommand, "", infoFlags},
+			"fileinfo":  {1, fileInfoCommand, "path", fileInfoFlags},
+			"dedup":     {0, dedupCommand, "", dedupFlags},
+			"quota":     {0, quotaCommand, "[prefix]", quotaFlags},
+			"du":        {0, duCommand, "[path]", duFlags},
+			"archive":   {-1, archiveCommand, "/src/dir [dest.tar.gz|-]", archiveFlags},
+			"extract":   {2, extractCommand, "archive|- /dest/dir", extractFlags},
+			"trash":     {-1, trashCommand, "ls|restore|purge [path]", trashFlags},
+			"retain":    {1, retainCommand, "path", retainFlags},
+			"pin":       {1, pinCommand, "path", pinFlags},
+			"lock":      {-1, lockCommand, "acquire|renew|release|info name", lockFlags},
+			"shell":     {0, shellCommand, "[dir]", shellFlags},
+			"export":    {0, exportCommand, "[prefix]", exportFlags},
+			"import":    {1, importCommand, "manifest|-", importFlags},
 		})
 }
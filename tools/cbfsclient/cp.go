@@ -0,0 +1,32 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/couchbaselabs/cbfs/tools"
+)
+
+var cpFlags = flag.NewFlagSet("cp", flag.ExitOnError)
+var cpNoClobber = cpFlags.Bool("n", false, "Don't overwrite existing files")
+
+var mvFlags = flag.NewFlagSet("mv", flag.ExitOnError)
+var mvNoClobber = mvFlags.Bool("n", false, "Don't overwrite existing files")
+
+func cpCommand(u string, args []string) {
+	client, err := cbfsclient.New(u)
+	cbfstool.MaybeFatal(err, "Error creating cbfs client: %v", err)
+
+	src, dest := cpFlags.Arg(0), cpFlags.Arg(1)
+	err = client.Copy(quotingReplacer.Replace(src), dest, !*cpNoClobber)
+	cbfstool.MaybeFatal(err, "Error copying %v to %v: %v", src, dest, err)
+}
+
+func mvCommand(u string, args []string) {
+	client, err := cbfsclient.New(u)
+	cbfstool.MaybeFatal(err, "Error creating cbfs client: %v", err)
+
+	src, dest := mvFlags.Arg(0), mvFlags.Arg(1)
+	err = client.Move(quotingReplacer.Replace(src), dest, !*mvNoClobber)
+	cbfstool.MaybeFatal(err, "Error moving %v to %v: %v", src, dest, err)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/couchbaselabs/cbfs/tools"
+)
+
+var dedupFlags = flag.NewFlagSet("dedup", flag.ExitOnError)
+var dedupTop = dedupFlags.Int("n", 10, "Number of most referenced blobs to show")
+var dedupTemplate = dedupFlags.String("t", "", "Display template")
+var dedupTemplateFile = dedupFlags.String("T", "", "Display template filename")
+var dedupJSON = dedupFlags.Bool("json", false, "Dump as json")
+
+const defaultDedupTemplate = `files reference {{.References}} blobs, {{.Blobs}} distinct
+logical size: {{bytes .LogicalBytes}}
+stored size:  {{bytes .StoredBytes}} (one copy of each)
+saved:        {{bytes .SavedBytes}} ({{printf "%.2f" .Ratio}}x)
+{{if .Top}}
+most referenced:
+{{range .Top}}  {{.OID}} {{.Refs}} refs x {{bytes .Length}}, saving {{bytes .Saved}}
+{{end}}{{end}}`
+
+func dedupCommand(base string, args []string) {
+	tmpl := cbfstool.GetTemplate(*dedupTemplate, *dedupTemplateFile,
+		defaultDedupTemplate)
+
+	client, err := cbfsclient.New(base)
+	cbfstool.MaybeFatal(err, "Error setting up client: %v", err)
+
+	rep, err := client.Dedup(*dedupTop)
+	cbfstool.MaybeFatal(err, "Error getting dedup report: %v", err)
+
+	if *dedupJSON || cbfstool.JSON {
+		cbfstool.PrintJSON(rep)
+	} else {
+		err := tmpl.Execute(os.Stdout, rep)
+		cbfstool.MaybeFatal(err, "Error executing template: %v", err)
+	}
+}
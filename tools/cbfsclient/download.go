@@ -25,6 +25,14 @@ var totalConcurrency = dlFlags.Int("ct", 4, "Total number of concurrent download
 var nodeConcurrency = dlFlags.Int("cn", 2, "Max concurrent downloads per node")
 var dlNoop = dlFlags.Bool("n", false, "Noop")
 var dlLink = dlFlags.Bool("L", false, "hard link identical content")
+var dlVerify = dlFlags.Bool("verify", false,
+	"check downloads against the hashes nodes send")
+var dlWorkers = dlFlags.Int("workers", 1,
+	"Number of byte ranges of each large file to fetch at once")
+var dlSegment = dlFlags.Int64("segment", 16*1024*1024,
+	"Size of each byte range fetched with -workers")
+var dlZone = dlFlags.String("zone", "",
+	"Prefer nodes in this zone when reading files")
 
 var totalBytes int64
 
@@ -91,11 +99,57 @@ func saveDownload(filenames []string, oid string, r io.Reader) (err error) {
 	} else {
 		log.Printf("Error downloading %v (for %v): %v",
 			oid, filenames, err)
+		if _, ok := err.(*cbfsclient.HashMismatch); ok && !*dlNoop {
+			// Don't leave damaged files behind.
+			for _, fn := range filenames {
+				os.Remove(fn)
+			}
+		}
 	}
 
 	return err
 }
 
+// Fetch a large blob as concurrent byte ranges into the first
+// filename, then copy it to the rest.
+func saveSegmented(client *cbfsclient.Client, filenames []string,
+	oid string, length int64) (err error) {
+
+	basefn := filenames[0]
+	f, err := os.Create(basefn)
+	if err != nil {
+		err = os.MkdirAll(filepath.Dir(basefn), 0777)
+		if err != nil {
+			return err
+		}
+		f, err = os.Create(basefn)
+	}
+	if err != nil {
+		return err
+	}
+	defer errutil.AppendCall(&err, f.Close)
+
+	err = client.SegmentedBlob(oid, length, *dlSegment, *dlWorkers, f)
+	if err == nil && *dlVerify {
+		err = cbfsclient.VerifyContent(io.NewSectionReader(f, 0, length), oid)
+	}
+	if err != nil {
+		log.Printf("Error downloading %v (for %v): %v", oid, basefn, err)
+		os.Remove(basefn)
+		return err
+	}
+
+	atomic.AddInt64(&totalBytes, length)
+	cbfstool.Verbose(*dlverbose, "Downloaded %s into %v in %v workers",
+		humanize.Bytes(uint64(length)), basefn, *dlWorkers)
+
+	if len(filenames) > 1 {
+		return saveDownload(filenames[1:], oid,
+			io.NewSectionReader(f, 0, length))
+	}
+	return nil
+}
+
 func downloadCommand(u string, args []string) {
 	src := dlFlags.Arg(0)
 	destbase := dlFlags.Arg(1)
@@ -112,6 +166,8 @@ func downloadCommand(u string, args []string) {
 
 	client, err := cbfsclient.New(u)
 	cbfstool.MaybeFatal(err, "Can't build a client: %v", err)
+	client.VerifyHashes = *dlVerify
+	client.Zone = *dlZone
 
 	things, err := client.ListDepth(src, 4096)
 	cbfstool.MaybeFatal(err, "Can't list things: %v", err)
@@ -119,11 +175,42 @@ func downloadCommand(u string, args []string) {
 	start := time.Now()
 	oids := []string{}
 	dests := map[string][]string{}
+	lengths := map[string]int64{}
+	// Files stored in parts can't be fetched as a single blob.
+	parted := map[string]string{}
 	for fn, inf := range things.Files {
-		fn = fn[len(src):]
-		dests[inf.OID] = append(dests[inf.OID],
-			filepath.Join(destbase, fn))
-		oids = append(oids, inf.OID)
+		dest := filepath.Join(destbase, fn[len(src):])
+		if len(inf.Parts) > 0 {
+			parted[fn] = dest
+			continue
+		}
+		if _, seen := lengths[inf.OID]; !seen {
+			oids = append(oids, inf.OID)
+		}
+		dests[inf.OID] = append(dests[inf.OID], dest)
+		lengths[inf.OID] = inf.Length
+	}
+
+	// Large blobs are fetched a range at a time from all their nodes.
+	if *dlWorkers > 1 && !*dlNoop {
+		small := []string{}
+		for _, oid := range oids {
+			if lengths[oid] <= *dlSegment {
+				small = append(small, oid)
+				continue
+			}
+			err := saveSegmented(client, dests[oid], oid, lengths[oid])
+			cbfstool.MaybeFatal(err, "Error getting %v: %v", oid, err)
+		}
+		oids = small
+	}
+
+	for fn, dest := range parted {
+		r, err := client.Get(quotingReplacer.Replace(fn))
+		cbfstool.MaybeFatal(err, "Error getting %v: %v", fn, err)
+		err = saveDownload([]string{dest}, fn, r)
+		r.Close()
+		cbfstool.MaybeFatal(err, "Error saving %v: %v", fn, err)
 	}
 
 	err = client.Blobs(*totalConcurrency, *nodeConcurrency,
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/couchbaselabs/cbfs/tools"
+)
+
+var duFlags = flag.NewFlagSet("du", flag.ExitOnError)
+var duSummary = duFlags.Bool("s", false, "Only show the total, not subdirectories")
+var duPhysical = duFlags.Bool("p", false,
+	"Show the space taken by every stored copy (reads every blob)")
+var duTemplate = duFlags.String("t", "", "Display template")
+var duTemplateFile = duFlags.String("T", "", "Display template filename")
+var duJSON = duFlags.Bool("json", false, "Dump as json")
+
+const defaultDuTemplate = `{{range .Children}}{{template "line" .}}{{end}}{{template "line" .}}
+{{- define "line"}}{{bytes .LogicalBytes}}	{{bytes .DedupedBytes}} deduped	{{if .PhysicalBytes}}{{bytes .PhysicalBytes}} stored	{{end}}{{.Objects}} files	/{{.Path}}
+{{end}}`
+
+func duCommand(base string, args []string) {
+	tmpl := cbfstool.GetTemplate(*duTemplate, *duTemplateFile,
+		defaultDuTemplate)
+
+	client, err := cbfsclient.New(base)
+	cbfstool.MaybeFatal(err, "Error setting up client: %v", err)
+
+	st, err := client.Du(duFlags.Arg(0), !*duSummary, *duPhysical)
+	cbfstool.MaybeFatal(err, "Error getting usage: %v", err)
+
+	if *duJSON || cbfstool.JSON {
+		cbfstool.PrintJSON(st)
+	} else {
+		err := tmpl.Execute(os.Stdout, st)
+		cbfstool.MaybeFatal(err, "Error executing template: %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/couchbaselabs/cbfs/tools"
+)
+
+func TestDuTemplate(t *testing.T) {
+	st := cbfsclient.DuStats{Path: "a", Objects: 3,
+		Children: []cbfsclient.DuStats{
+			{Path: "a/b", Objects: 1},
+			{Path: "a/c", Objects: 2},
+		}}
+
+	buf := &bytes.Buffer{}
+	tmpl := cbfstool.GetTemplate("", "", defaultDuTemplate)
+	if err := tmpl.Execute(buf, st); err != nil {
+		t.Fatalf("Error executing template: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	exp := []string{"1 files\t/a/b", "2 files\t/a/c", "3 files\t/a"}
+	if len(lines) != len(exp) {
+		t.Fatalf("Expected %v lines, got %q", len(exp), lines)
+	}
+	for i, l := range lines {
+		if !strings.HasSuffix(l, exp[i]) {
+			t.Errorf("Expected line %v to end with %q, got %q", i, exp[i], l)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/couchbaselabs/cbfs/tools"
+)
+
+var extractFlags = flag.NewFlagSet("extract", flag.ExitOnError)
+var extractFormat = extractFlags.String("format", "",
+	"Archive format: tar, tar.gz or zip (guessed if empty)")
+var extractWorkers = extractFlags.Int("workers", 0,
+	"Number of files the server stores at once")
+var extractVerbose = extractFlags.Bool("v", false, "Verbose")
+var extractNoWait = extractFlags.Bool("nowait", false,
+	"Don't wait for the server to finish")
+
+func extractCommand(base string, args []string) {
+	client, err := cbfsclient.New(base)
+	cbfstool.MaybeFatal(err, "Error setting up client: %v", err)
+
+	src := extractFlags.Arg(0)
+	dest := extractFlags.Arg(1)
+
+	var r io.Reader = os.Stdin
+	if src != "-" {
+		f, err := os.Open(src)
+		cbfstool.MaybeFatal(err, "Error opening %v: %v", src, err)
+		defer f.Close()
+		r = f
+		if fi, err := f.Stat(); err == nil && fi.Size() > 0 && *extractVerbose {
+			pr := newProgressReader(f, fi.Size())
+			defer pr.Close()
+			r = pr
+		}
+	}
+
+	id, err := client.Extract(dest, *extractFormat, *extractWorkers, r)
+	cbfstool.MaybeFatal(err, "Error sending %v: %v", src, err)
+	cbfstool.Verbose(*extractVerbose, "Extracting %v into %v (task %v)",
+		src, dest, id)
+	if *extractNoWait {
+		return
+	}
+
+	for {
+		time.Sleep(time.Second)
+		t, err := client.ExtractTask(id)
+		cbfstool.MaybeFatal(err, "Error checking on %v: %v", id, err)
+		cbfstool.Verbose(*extractVerbose, "%v: %v files extracted, %v errors",
+			dest, t.Files, t.Errors)
+		if !t.Done() {
+			continue
+		}
+		if t.Errors > 0 {
+			log.Fatalf("%v errors extracting %v, the last: %v",
+				t.Errors, src, t.LastError)
+		}
+		return
+	}
+}
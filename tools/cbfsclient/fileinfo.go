@@ -42,6 +42,14 @@ func fileInfoCommand(base string, args []string) {
 	fh, err := client.OpenFile(args[0])
 	cbfstool.MaybeFatal(err, "Error getting file info: %v", err)
 
+	if cbfstool.JSON {
+		cbfstool.PrintJSON(map[string]interface{}{
+			"filename": u.Path[1:],
+			"meta":     fh.Meta(),
+			"nodes":    fh.Nodes(),
+		})
+		return
+	}
 	err = tmpl.Execute(os.Stdout, map[string]interface{}{
 		"Filename": u.Path[1:],
 		"Meta":     fh.Meta(),
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/couchbaselabs/cbfs/client"
 	"github.com/couchbaselabs/cbfs/tools"
+	"github.com/dustin/go-humanize"
 	"github.com/dustin/httputil"
 )
 
@@ -30,8 +32,12 @@ var findDashIName = findFlags.String("iname", "",
 	"Case insensitive glob name to match")
 var findDashMTime = findFlags.Duration("mtime", 0, "Find by mod time")
 var findDashDepth = findFlags.Int("depth", 4096, "Maximum search depth")
+var findDashSize = findFlags.String("size", "",
+	"Find by size (+n for more than n, -n for less, n for exactly n)")
+var findDashCType = findFlags.String("ctype", "", "Content type prefix to match")
 
 var findDashType findType
+var findDashMeta = findMeta{}
 
 const defaultFindTemplate = `{{.Name}}
 `
@@ -62,8 +68,54 @@ func (t *findType) Set(s string) error {
 	return nil
 }
 
+// Repeated name=value (or just name) metadata to match.
+type findMeta map[string]string
+
+func (m findMeta) String() string {
+	return fmt.Sprint(map[string]string(m))
+}
+
+func (m findMeta) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if parts[0] == "" {
+		return fmt.Errorf("expected name=value or name")
+	}
+	m[parts[0]] = ""
+	if len(parts) == 2 {
+		m[parts[0]] = parts[1]
+	}
+	return nil
+}
+
 func init() {
 	findFlags.Var(&findDashType, "type", "Type to match (f or d)")
+	findFlags.Var(findDashMeta, "meta", "Metadata to match (name=value or name)")
+}
+
+// Parse a find(1) style size into an inclusive range.  max is -1
+// when there's no upper bound.
+func findSizeRange(s string) (min, max int64, err error) {
+	if s == "" {
+		return 0, -1, nil
+	}
+	sign := s[0]
+	if sign == '+' || sign == '-' {
+		s = s[1:]
+	}
+	n, err := humanize.ParseBytes(s)
+	if err != nil {
+		return 0, -1, err
+	}
+	switch sign {
+	case '+':
+		return int64(n) + 1, -1, nil
+	case '-':
+		if n == 0 {
+			return 0, -1, fmt.Errorf("nothing is smaller than 0")
+		}
+		return 0, int64(n) - 1, nil
+	}
+	return int64(n), int64(n), nil
 }
 
 type dirAndFileMatcher struct {
@@ -87,6 +139,13 @@ type findMatch struct {
 	isDir bool
 }
 
+// A line of find -json output.
+type findJSONMatch struct {
+	Name  string              `json:"name"`
+	IsDir bool                `json:"isDir"`
+	Meta  cbfsclient.FileMeta `json:"meta"`
+}
+
 func (d dirAndFileMatcher) match(name string, isdir bool) bool {
 	switch findDashType {
 	case findTypeAny:
@@ -169,26 +228,57 @@ func findCommand(u string, args []string) {
 	client, err := cbfsclient.New(u)
 	cbfstool.MaybeFatal(err, "Can't build a client: %v", err)
 
-	things, err := client.ListDepth(src, *findDashDepth)
-	cbfstool.MaybeFatal(err, "Can't list things: %v", err)
+	minSize, maxSize, err := findSizeRange(*findDashSize)
+	cbfstool.MaybeFatal(err, "Invalid -size %q: %v", *findDashSize, err)
+
+	now := time.Now()
+	q := cbfsclient.FindQuery{
+		MinSize:     minSize,
+		MaxSize:     maxSize,
+		ContentType: *findDashCType,
+		Meta:        findDashMeta,
+	}
+	switch {
+	case *findDashMTime > 0:
+		q.Newer = now.Add(-*findDashMTime)
+	case *findDashMTime < 0:
+		q.Older = now.Add(*findDashMTime)
+	}
+	// Only files can match, so the server can check names too.
+	if findDashType == findTypeFile {
+		q.Name, q.IName = *findDashName, *findDashIName
+	}
 
-	metaMatcher := findGetRefTimeMatch(time.Now())
+	metaMatcher := findGetRefTimeMatch(now)
 	matcher := newDirAndFileMatcher()
-	for fn, inf := range things.Files {
-		if !metaMatcher(inf.Modified) {
-			continue
-		}
-		if len(fn) > len(src)+1 {
-			fn = fn[len(src)+1:]
-		}
-		for _, match := range matcher.matches(fn) {
-			if err := tmpl.Execute(os.Stdout, struct {
-				Name  string
-				IsDir bool
-				Meta  cbfsclient.FileMeta
-			}{match.path, match.isDir, inf}); err != nil {
-				log.Fatalf("Error executing template: %v", err)
+	err = client.Find(context.Background(), src, q,
+		func(r cbfsclient.FindResult) error {
+			inf := r.Meta
+			if !metaMatcher(inf.Modified) || inf.Length < minSize ||
+				(maxSize >= 0 && inf.Length > maxSize) {
+				return nil
 			}
-		}
-	}
+			fn := r.Path
+			if len(fn) > len(src)+1 {
+				fn = fn[len(src)+1:]
+			}
+			if strings.Count(fn, "/") >= *findDashDepth {
+				return nil
+			}
+			for _, match := range matcher.matches(fn) {
+				if cbfstool.JSON {
+					cbfstool.PrintJSONLine(findJSONMatch{match.path, match.isDir, inf})
+					continue
+				}
+				if err := tmpl.Execute(os.Stdout, struct {
+					Name  string
+					IsDir bool
+					Meta  cbfsclient.FileMeta
+				}{match.path, match.isDir, inf}); err != nil {
+					log.Fatalf("Error executing template: %v", err)
+				}
+			}
+			return nil
+		})
+	cbfstool.MaybeFatal(err, "Can't find things: %v", err)
 }
@@ -143,3 +143,19 @@ func TestRefTimeMatcher(t *testing.T) {
 		}
 	}
 }
+
+func TestFindMetaFlag(t *testing.T) {
+	m := findMeta{}
+	for _, s := range []string{"owner=bob", "source", "note=a=b"} {
+		if err := m.Set(s); err != nil {
+			t.Errorf("Error setting %q: %v", s, err)
+		}
+	}
+	exp := findMeta{"owner": "bob", "source": "", "note": "a=b"}
+	if !reflect.DeepEqual(m, exp) {
+		t.Errorf("Expected %v, got %v", exp, m)
+	}
+	if err := m.Set("=x"); err == nil {
+		t.Errorf("Expected an error setting a nameless meta")
+	}
+}
@@ -10,7 +10,29 @@ import (
 	"github.com/couchbaselabs/cbfs/tools"
 )
 
+const dirIgnoreFile = ".cbfsignore"
+
 var ignorePatterns = []string{}
+var includePatterns = []string{}
+
+// Patterns from .cbfsignore files, keyed by the directory they were
+// found in.  They apply to everything below that directory.
+var dirIgnorePatterns = map[string][]string{}
+
+// A repeatable flag collecting glob patterns.
+type patternList []string
+
+func (p *patternList) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *patternList) Set(s string) error {
+	if _, err := filepath.Match(s, ""); err != nil {
+		return err
+	}
+	*p = append(*p, s)
+	return nil
+}
 
 func loadIgnorePatternsFromFile(fn string) error {
 	f, err := os.Open(fn)
@@ -23,15 +45,44 @@ func loadIgnorePatternsFromFile(fn string) error {
 }
 
 func loadIgnorePatterns(r io.Reader) error {
+	pats, err := parseIgnorePatterns(r)
+	ignorePatterns = append(ignorePatterns, pats...)
+	return err
+}
+
+// Load the .cbfsignore file in dir, if there is one.
+func loadDirIgnores(dir string) error {
+	f, err := os.Open(filepath.Join(dir, dirIgnoreFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	pats, err := parseIgnorePatterns(f)
+	if err != nil {
+		return err
+	}
+	if dir = filepath.Clean(dir); dir == "." {
+		dir = ""
+	}
+	dirIgnorePatterns[dir] = append(dirIgnorePatterns[dir], pats...)
+	return nil
+}
+
+func parseIgnorePatterns(r io.Reader) ([]string, error) {
 	b := bufio.NewReader(r)
 
+	rv := []string{}
 	for {
 		line, err := b.ReadString('\n')
 		if err != nil {
 			if err == io.EOF {
 				err = nil
 			}
-			return err
+			return rv, err
 		}
 
 		line = strings.TrimSpace(line)
@@ -41,19 +92,21 @@ func loadIgnorePatterns(r io.Reader) error {
 		default:
 			_, err = filepath.Match(line, "")
 			if err != nil {
-				return err
+				return rv, err
 			}
-			ignorePatterns = append(ignorePatterns, line)
+			rv = append(rv, line)
 		}
 	}
 }
 
-func isIgnored(input string) bool {
+// Patterns starting with / match the whole path, others match only
+// the last path element.
+func matchesAny(pats []string, input string) bool {
 	if input[0] == '/' {
 		input = input[1:]
 	}
 	b := filepath.Base(input)
-	for _, pat := range ignorePatterns {
+	for _, pat := range pats {
 		in := b
 		if pat[0] == '/' {
 			in = input
@@ -68,3 +121,27 @@ func isIgnored(input string) bool {
 	}
 	return false
 }
+
+func isIgnored(input string) bool {
+	if matchesAny(ignorePatterns, input) {
+		return true
+	}
+	for dir, pats := range dirIgnorePatterns {
+		switch {
+		case dir == "":
+			if matchesAny(pats, input) {
+				return true
+			}
+		case strings.HasPrefix(input, dir+"/"):
+			if matchesAny(pats, input[len(dir)+1:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// With no include patterns, everything's included.
+func isIncluded(input string) bool {
+	return len(includePatterns) == 0 || matchesAny(includePatterns, input)
+}
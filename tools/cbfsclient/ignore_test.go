@@ -41,3 +41,57 @@ func TestPatterns(t *testing.T) {
 		}
 	}
 }
+
+func TestDirPatterns(t *testing.T) {
+	defer func() { dirIgnorePatterns = map[string][]string{} }()
+
+	pats, err := parseIgnorePatterns(strings.NewReader("*.tmp\n/build\n"))
+	if err != nil {
+		t.Fatalf("Error loading patterns: %v", err)
+	}
+	dirIgnorePatterns["src/a"] = pats
+
+	tests := []struct {
+		path string
+		exp  bool
+	}{
+		{"src/a/x.tmp", true},
+		{"src/a/b/x.tmp", true},
+		{"src/x.tmp", false},
+		{"src/a/build", true},
+		{"src/a/b/build", false},
+		{"src/ab/x.tmp", false},
+	}
+
+	for _, test := range tests {
+		if isIgnored(test.path) != test.exp {
+			t.Errorf("Expected %v for %v", test.exp, test.path)
+		}
+	}
+}
+
+func TestIncludes(t *testing.T) {
+	defer func() { includePatterns = nil }()
+
+	if !isIncluded("anything.c") {
+		t.Errorf("Expected everything included without patterns")
+	}
+
+	includePatterns = []string{"*.jpg", "/photos/*/*.png"}
+	tests := []struct {
+		path string
+		exp  bool
+	}{
+		{"a/b.jpg", true},
+		{"a/b.png", false},
+		{"photos/x/y.png", true},
+		{"/photos/x/y.png", true},
+		{"photos/y.png", false},
+	}
+
+	for _, test := range tests {
+		if isIncluded(test.path) != test.exp {
+			t.Errorf("Expected %v for %v", test.exp, test.path)
+		}
+	}
+}
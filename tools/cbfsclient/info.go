@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"os"
 	"sync"
@@ -13,8 +12,9 @@ import (
 )
 
 type Tasks map[string]map[string]struct {
-	State string
-	TS    time.Time
+	State  string
+	TS     time.Time
+	Detail string
 }
 
 type Backup struct {
@@ -32,11 +32,11 @@ var infoTemplateFile = infoFlags.String("T", "", "Display template filename")
 var infoJSON = infoFlags.Bool("json", false, "Dump as json")
 
 const defaultInfoTemplate = `nodes:
-{{ range $name, $info := .Nodes }}  {{$name}} {{$info.Version}} up {{$info.UptimeStr}} (age: {{$info.HBAgeStr}})
+{{ range $name, $info := .Nodes }}  {{$name}} {{$info.Version}} up {{$info.UptimeStr}} (age: {{$info.HBAgeStr}}){{if $info.Draining}} decommissioning{{end}}
 {{ end }}
 {{if .Tasks}}tasks:{{end}}{{ range $node, $tasks := .Tasks }}
   {{$node}}
-  {{ range $task, $info := $tasks }}    {{$task}} - {{$info.State}} - {{$info.TS}}
+  {{ range $task, $info := $tasks }}    {{$task}} - {{$info.State}} - {{$info.TS}}{{if $info.Detail}} - {{$info.Detail}}{{end}}
   {{end}}{{end}}
 backups:
   Found {{len .Backups.Previous }} backups.
@@ -84,10 +84,8 @@ func infoCommand(base string, args []string) {
 
 	wg.Wait()
 
-	if *infoJSON {
-		data, err := json.MarshalIndent(result, "", "  ")
-		cbfstool.MaybeFatal(err, "Error marshaling rseult: %v", err)
-		os.Stdout.Write(data)
+	if *infoJSON || cbfstool.JSON {
+		cbfstool.PrintJSON(result)
 	} else {
 		err := tmpl.Execute(os.Stdout, result)
 		cbfstool.MaybeFatal(err, "Error executing template: %v", err)
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/couchbaselabs/cbfs/tools"
+)
+
+var lockFlags = flag.NewFlagSet("lock", flag.ExitOnError)
+var lockTTL = lockFlags.Duration("ttl", time.Minute,
+	"How long to hold the lock for")
+var lockOwner = lockFlags.String("owner", "",
+	"Who's taking the lock, shown to others who want it")
+var lockToken = lockFlags.String("token", "",
+	"Token of the held lock to renew or release")
+
+func lockCommand(u string, args []string) {
+	client, err := cbfsclient.New(u)
+	cbfstool.MaybeFatal(err, "Error creating client: %v", err)
+
+	name := lockFlags.Arg(1)
+	if name == "" {
+		log.Fatalf("Which lock?")
+	}
+	l := cbfsclient.Lock{Name: name, Token: *lockToken}
+	switch lockFlags.Arg(0) {
+	case "acquire":
+		l, err = client.Lock(name, *lockOwner, *lockTTL)
+	case "renew":
+		l, err = client.RenewLock(l, *lockTTL)
+	case "release":
+		err = client.Unlock(l)
+	case "info":
+		l, err = client.LockInfo(name)
+	default:
+		log.Fatalf("Unknown lock command %q (expected acquire, renew, release or info)",
+			lockFlags.Arg(0))
+	}
+
+	switch err {
+	case nil:
+	case cbfsclient.LockHeld:
+		log.Fatalf("%v is held by %q until %v", name, l.Owner,
+			l.Expires.Local().Format(time.RFC3339))
+	case cbfsclient.Missing:
+		log.Fatalf("%v isn't held", name)
+	default:
+		log.Fatalf("Error with lock %v: %v", name, err)
+	}
+
+	if cbfstool.JSON && lockFlags.Arg(0) != "release" {
+		cbfstool.PrintJSON(l)
+		return
+	}
+	switch lockFlags.Arg(0) {
+	case "acquire":
+		// Just the token, so scripts can capture it.
+		fmt.Println(l.Token)
+	case "renew":
+		fmt.Printf("%v is held until %v\n", name,
+			l.Expires.Local().Format(time.RFC3339))
+	case "info":
+		fmt.Printf("%v is held by %q since %v until %v\n", name, l.Owner,
+			l.Acquired.Local().Format(time.RFC3339),
+			l.Expires.Local().Format(time.RFC3339))
+	}
+}
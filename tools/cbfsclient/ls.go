@@ -1,10 +1,10 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
-	"sort"
 	"text/tabwriter"
 
 	"github.com/couchbaselabs/cbfs/client"
@@ -14,64 +14,67 @@ import (
 
 var lsFlags = flag.NewFlagSet("ls", flag.ExitOnError)
 var lsDashL = lsFlags.Bool("l", false, "Display detailed listing")
+var lsSort = lsFlags.String("sort", "name", "Order by name, mtime or size")
+var lsPage = lsFlags.Int("page", 1000, "Entries to fetch at a time")
+
+// A line of ls -json output.
+type lsEntry struct {
+	Name string               `json:"name"`
+	Dir  *cbfsclient.Dir      `json:"dir,omitempty"`
+	File *cbfsclient.FileMeta `json:"file,omitempty"`
+}
 
 func lsCommand(u string, args []string) {
 	client, err := cbfsclient.New(u)
 	cbfstool.MaybeFatal(err, "Error creating client: %v", err)
 
-	result, err := client.List(lsFlags.Arg(0))
-	cbfstool.MaybeFatal(err, "Error listing directory: %v", err)
+	totalFiles := 0
+	totalSize := uint64(0)
+	tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
 
-	dirnames := sort.StringSlice{}
-	filenames := sort.StringSlice{}
-	for k := range result.Dirs {
-		dirnames = append(dirnames, k)
-	}
-	for k := range result.Files {
-		filenames = append(filenames, k)
-	}
-	dirnames.Sort()
-	filenames.Sort()
-
-	if *lsDashL {
-		totalFiles := 0
-		totalSize := uint64(0)
-		tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
-		for i := range dirnames {
-			dn := dirnames[i]
-			di := result.Dirs[dn]
-			fmt.Fprintf(tw, "d %8s\t%s\t(%s descendants)\n",
-				humanize.Bytes(uint64(di.Size)), dn,
-				humanize.Comma(int64(di.Descendants)))
-			totalSize += uint64(di.Size)
-			totalFiles += di.Descendants
-		}
-		for i := range filenames {
-			fn := filenames[i]
-			fi := result.Files[fn]
-			fmt.Fprintf(tw, "f %8s\t%s\t%s\n",
-				humanize.Bytes(uint64(fi.Length)), fn,
-				fi.Headers.Get("Content-Type"))
+	opts := cbfsclient.ListOptions{Limit: *lsPage, Sort: *lsSort}
+	err = client.ListPages(context.Background(), lsFlags.Arg(0), opts,
+		func(result cbfsclient.ListResult) error {
+			for _, name := range result.Order {
+				if cbfstool.JSON {
+					e := lsEntry{Name: name}
+					if di, ok := result.Dirs[name]; ok {
+						e.Dir = &di
+					} else {
+						fi := result.Files[name]
+						e.File = &fi
+					}
+					cbfstool.PrintJSONLine(e)
+					continue
+				}
+				if !*lsDashL {
+					fmt.Println(name)
+					continue
+				}
+				if di, ok := result.Dirs[name]; ok {
+					fmt.Fprintf(tw, "d %8s\t%s\t(%s descendants)\n",
+						humanize.Bytes(uint64(di.Size)), name,
+						humanize.Comma(int64(di.Descendants)))
+					totalSize += uint64(di.Size)
+					totalFiles += di.Descendants
+					continue
+				}
+				fi := result.Files[name]
+				fmt.Fprintf(tw, "f %8s\t%s\t%s\n",
+					humanize.Bytes(uint64(fi.Length)), name,
+					fi.Headers.Get("Content-Type"))
+				totalSize += uint64(fi.Length)
+				totalFiles++
+			}
+			return tw.Flush()
+		})
+	cbfstool.MaybeFatal(err, "Error listing directory: %v", err)
 
-			totalSize += uint64(fi.Length)
-			totalFiles++
-		}
+	if *lsDashL && !cbfstool.JSON {
 		fmt.Fprintf(tw, "----------------------------------------\n")
 		fmt.Fprintf(tw, "Tot: %s\t\t%s files\n",
 			humanize.Bytes(totalSize),
 			humanize.Comma(int64(totalFiles)))
 		tw.Flush()
-	} else {
-		allnames := sort.StringSlice{}
-		for i := range dirnames {
-			allnames = append(allnames, dirnames[i])
-		}
-		for i := range filenames {
-			allnames = append(allnames, filenames[i])
-		}
-		allnames.Sort()
-		for _, a := range allnames {
-			fmt.Println(a)
-		}
 	}
 }
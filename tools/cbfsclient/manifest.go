@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/couchbaselabs/cbfs/tools"
+)
+
+var exportFlags = flag.NewFlagSet("export", flag.ExitOnError)
+var exportFormat = exportFlags.String("format", "ndjson",
+	"Manifest format: csv or ndjson")
+
+var importFlags = flag.NewFlagSet("import", flag.ExitOnError)
+var importFormat = importFlags.String("format", "",
+	"Manifest format: csv or ndjson (guessed if empty)")
+var importFrom = importFlags.String("from", "",
+	"Upload files from this local directory instead of making placeholders")
+var importNoop = importFlags.Bool("n", false, "Dry run")
+var importVerbose = importFlags.Bool("v", false, "Verbose")
+
+// One file in an exported manifest.  CSV manifests have a header row
+// of these names, and the columns may come in any order.
+type manifestEntry struct {
+	Path        string    `json:"path"`
+	Size        int64     `json:"size"`
+	Hash        string    `json:"hash"`
+	Modified    time.Time `json:"mtime"`
+	ContentType string    `json:"contentType"`
+}
+
+var manifestColumns = []string{"path", "size", "hash", "mtime", "contentType"}
+
+func newManifestEntry(r cbfsclient.FindResult) manifestEntry {
+	return manifestEntry{
+		Path:        r.Path,
+		Size:        r.Meta.Length,
+		Hash:        r.Meta.OID,
+		Modified:    r.Meta.Modified.UTC(),
+		ContentType: r.Meta.Headers.Get("Content-Type"),
+	}
+}
+
+// The format of the manifest fn, guessed from its name if not given.
+func manifestFormat(fn, format string) (string, error) {
+	if format == "" {
+		format = "ndjson"
+		if strings.HasSuffix(strings.ToLower(fn), ".csv") {
+			format = "csv"
+		}
+	}
+	switch format {
+	case "csv", "ndjson":
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown manifest format %q", format)
+}
+
+type manifestWriter struct {
+	csv  *csv.Writer
+	json *json.Encoder
+}
+
+func newManifestWriter(w io.Writer, format string) (*manifestWriter, error) {
+	if format == "ndjson" {
+		return &manifestWriter{json: json.NewEncoder(w)}, nil
+	}
+	cw := csv.NewWriter(w)
+	return &manifestWriter{csv: cw}, cw.Write(manifestColumns)
+}
+
+func (m *manifestWriter) write(e manifestEntry) error {
+	if m.json != nil {
+		return m.json.Encode(e)
+	}
+	return m.csv.Write([]string{e.Path, strconv.FormatInt(e.Size, 10),
+		e.Hash, e.Modified.Format(time.RFC3339Nano), e.ContentType})
+}
+
+func (m *manifestWriter) flush() error {
+	if m.csv == nil {
+		return nil
+	}
+	m.csv.Flush()
+	return m.csv.Error()
+}
+
+// Call f with each entry in a manifest.
+func readManifest(r io.Reader, format string,
+	f func(manifestEntry) error) error {
+
+	if format == "ndjson" {
+		d := json.NewDecoder(r)
+		for {
+			e := manifestEntry{}
+			switch err := d.Decode(&e); err {
+			case nil:
+			case io.EOF:
+				return nil
+			default:
+				return err
+			}
+			if err := f(e); err != nil {
+				return err
+			}
+		}
+	}
+
+	cr := csv.NewReader(r)
+	hdr, err := cr.Read()
+	if err != nil {
+		return fmt.Errorf("error reading header: %v", err)
+	}
+	cols := map[string]int{}
+	for i, h := range hdr {
+		cols[strings.TrimSpace(h)] = i
+	}
+	if _, ok := cols["path"]; !ok {
+		return fmt.Errorf("no path column in %q", hdr)
+	}
+	for {
+		rec, err := cr.Read()
+		switch err {
+		case nil:
+		case io.EOF:
+			return nil
+		default:
+			return err
+		}
+		col := func(name string) string {
+			if i, ok := cols[name]; ok {
+				return rec[i]
+			}
+			return ""
+		}
+		e := manifestEntry{
+			Path:        col("path"),
+			Hash:        col("hash"),
+			ContentType: col("contentType"),
+		}
+		if s := col("size"); s != "" {
+			if e.Size, err = strconv.ParseInt(s, 10, 64); err != nil {
+				return fmt.Errorf("invalid size of %v: %v", e.Path, err)
+			}
+		}
+		if s := col("mtime"); s != "" {
+			if e.Modified, err = time.Parse(time.RFC3339Nano, s); err != nil {
+				return fmt.Errorf("invalid mtime of %v: %v", e.Path, err)
+			}
+		}
+		if err := f(e); err != nil {
+			return err
+		}
+	}
+}
+
+func exportCommand(base string, args []string) {
+	client, err := cbfsclient.New(base)
+	cbfstool.MaybeFatal(err, "Error setting up client: %v", err)
+
+	format, err := manifestFormat("", *exportFormat)
+	cbfstool.MaybeFatal(err, "%v", err)
+	mw, err := newManifestWriter(os.Stdout, format)
+	cbfstool.MaybeFatal(err, "Error writing manifest: %v", err)
+
+	err = client.Find(cbfstool.Context(), exportFlags.Arg(0),
+		cbfsclient.FindQuery{}, func(r cbfsclient.FindResult) error {
+			return mw.write(newManifestEntry(r))
+		})
+	if err == nil {
+		err = mw.flush()
+	}
+	cbfstool.MaybeFatal(err, "Error exporting: %v", err)
+}
+
+// Make a file that refers to the manifest entry's blob without
+// uploading it, for content that's already there or will be copied
+// in by other means.
+func importPlaceholder(client *cbfsclient.Client, e manifestEntry) error {
+	if e.Hash == "" {
+		return fmt.Errorf("no hash to make a placeholder with")
+	}
+	fm := cbfsclient.FileMeta{
+		Headers:  http.Header{},
+		OID:      e.Hash,
+		Length:   e.Size,
+		Modified: e.Modified,
+	}
+	if e.ContentType != "" {
+		fm.Headers.Set("Content-Type", e.ContentType)
+	}
+	return client.RestoreContext(cbfstool.Context(), e.Path, fm, -1)
+}
+
+// Upload the local copy of the manifest entry's file, which must
+// have the hash listed.
+func importUpload(client *cbfsclient.Client, e manifestEntry) error {
+	src := filepath.Join(*importFrom, filepath.FromSlash(e.Path))
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return client.PutContext(cbfstool.Context(), src, e.Path, f,
+		cbfsclient.PutOptions{
+			Hash:        e.Hash,
+			ContentType: e.ContentType,
+			IfNoneMatch: "*",
+		})
+}
+
+func importCommand(base string, args []string) {
+	client, err := cbfsclient.New(base)
+	cbfstool.MaybeFatal(err, "Error setting up client: %v", err)
+
+	src := importFlags.Arg(0)
+	format, err := manifestFormat(src, *importFormat)
+	cbfstool.MaybeFatal(err, "%v", err)
+
+	var r io.Reader = os.Stdin
+	if src != "-" {
+		f, err := os.Open(src)
+		cbfstool.MaybeFatal(err, "Error opening %v: %v", src, err)
+		defer f.Close()
+		r = f
+	}
+
+	start := time.Now()
+	imported, existing, failed := 0, 0, 0
+	err = readManifest(r, format, func(e manifestEntry) error {
+		if cbfstool.Interrupted() {
+			return cbfstool.Context().Err()
+		}
+		e.Path = strings.Trim(e.Path, "/")
+		if e.Path == "" {
+			log.Printf("Skipping a manifest entry with no path")
+			failed++
+			return nil
+		}
+		cbfstool.Verbose(*importVerbose || *importNoop, "Importing %v (%v)",
+			e.Path, e.Hash)
+		if *importNoop {
+			return nil
+		}
+
+		var err error
+		if *importFrom != "" {
+			err = importUpload(client, e)
+		} else {
+			err = importPlaceholder(client, e)
+		}
+		switch err {
+		case nil:
+			imported++
+		case cbfsclient.Exists, cbfsclient.PreconditionFailed:
+			cbfstool.Verbose(*importVerbose, "%v already exists", e.Path)
+			existing++
+		default:
+			log.Printf("Error importing %v: %v", e.Path, err)
+			failed++
+		}
+		return nil
+	})
+	if err != nil && cbfstool.Interrupted() {
+		log.Printf("Interrupted after %v: %v imported, %v existing, %v failed",
+			time.Since(start), imported, existing, failed)
+		os.Exit(cbfstool.ExitInterrupted)
+	}
+	cbfstool.MaybeFatal(err, "Error reading %v: %v", src, err)
+
+	log.Printf("Imported %v files in %v, %v already existed, %v failed",
+		imported, time.Since(start), existing, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestManifestRoundTrip(t *testing.T) {
+	entries := []manifestEntry{
+		{"a/b.txt", 5, "abc", time.Date(2014, 3, 1, 2, 3, 4, 5, time.UTC),
+			"text/plain"},
+		{"a/c, with a comma", 0, "def", time.Date(2014, 3, 2, 0, 0, 0, 0,
+			time.UTC), ""},
+	}
+	for _, format := range []string{"csv", "ndjson"} {
+		buf := &bytes.Buffer{}
+		mw, err := newManifestWriter(buf, format)
+		if err != nil {
+			t.Fatalf("Error starting %v manifest: %v", format, err)
+		}
+		for _, e := range entries {
+			if err := mw.write(e); err != nil {
+				t.Fatalf("Error writing %v manifest: %v", format, err)
+			}
+		}
+		if err := mw.flush(); err != nil {
+			t.Fatalf("Error flushing %v manifest: %v", format, err)
+		}
+
+		got := []manifestEntry{}
+		err = readManifest(buf, format, func(e manifestEntry) error {
+			got = append(got, e)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("Error reading %v manifest: %v", format, err)
+		}
+		if !reflect.DeepEqual(got, entries) {
+			t.Errorf("Expected %v back from %v, got %v", entries, format, got)
+		}
+	}
+}
+
+func TestReadManifestCSVColumns(t *testing.T) {
+	in := "hash,path\nabc,x/y\n"
+	got := []manifestEntry{}
+	err := readManifest(strings.NewReader(in), "csv", func(e manifestEntry) error {
+		got = append(got, e)
+		return nil
+	})
+	exp := []manifestEntry{{Path: "x/y", Hash: "abc"}}
+	if err != nil || !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v, %v", exp, got, err)
+	}
+
+	err = readManifest(strings.NewReader("hash\nabc\n"), "csv",
+		func(manifestEntry) error { return nil })
+	if err == nil {
+		t.Errorf("Expected an error reading a manifest with no paths")
+	}
+}
+
+func TestManifestFormat(t *testing.T) {
+	tests := []struct {
+		fn, format, exp string
+	}{
+		{"x.csv", "", "csv"},
+		{"X.CSV", "", "csv"},
+		{"x.ndjson", "", "ndjson"},
+		{"-", "", "ndjson"},
+		{"x.csv", "ndjson", "ndjson"},
+		{"x", "xml", ""},
+	}
+	for _, test := range tests {
+		got, err := manifestFormat(test.fn, test.format)
+		if got != test.exp || (err != nil) != (test.exp == "") {
+			t.Errorf("Expected %q for %v/%v, got %q, %v",
+				test.exp, test.fn, test.format, got, err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/couchbaselabs/cbfs/tools"
+)
+
+var pinFlags = flag.NewFlagSet("pin", flag.ExitOnError)
+var pinNodes = pinFlags.String("nodes", "",
+	"Keep a copy on each of these nodes (comma separated)")
+var pinAll = pinFlags.Bool("all", false, "Keep a copy on every node")
+var pinOff = pinFlags.Bool("off", false, "Remove the file's pins")
+
+func pinCommand(u string, args []string) {
+	client, err := cbfsclient.New(u)
+	cbfstool.MaybeFatal(err, "Error creating client: %v", err)
+
+	path := quotingReplacer.Replace(args[0])
+	var p cbfsclient.Pins
+	switch {
+	case btoi(*pinNodes != "")+btoi(*pinAll)+btoi(*pinOff) > 1:
+		log.Fatalf("Give one of -nodes, -all or -off")
+	case *pinNodes != "":
+		p, err = client.Pin(path, strings.Split(*pinNodes, ",")...)
+	case *pinAll:
+		p, err = client.Pin(path, cbfsclient.PinAll)
+	case *pinOff:
+		p, err = client.Unpin(path)
+	default:
+		p, err = client.Pins(path)
+	}
+	if err == cbfsclient.Missing {
+		log.Fatalf("No such file: %v", args[0])
+	}
+	cbfstool.MaybeFatal(err, "Error with pins of %v: %v", args[0], err)
+
+	if cbfstool.JSON {
+		cbfstool.PrintJSON(p)
+		return
+	}
+	switch {
+	case len(p.Pinned) == 0:
+		fmt.Printf("%v is not pinned\n", args[0])
+	case p.Pinned[0] == cbfsclient.PinAll:
+		fmt.Printf("%v is pinned to every node\n", args[0])
+	default:
+		fmt.Printf("%v is pinned to %v\n", args[0],
+			strings.Join(p.Pinned, ", "))
+	}
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/couchbaselabs/cbfs/config"
+	"github.com/couchbaselabs/cbfs/tools"
+	"github.com/dustin/go-humanize"
+)
+
+var quotaFlags = flag.NewFlagSet("quota", flag.ExitOnError)
+var quotaBytes = quotaFlags.String("bytes", "", "Set the size limit (e.g. 10GB, 0 for none)")
+var quotaObjects = quotaFlags.Int64("objects", -1, "Set the file count limit (0 for none)")
+var quotaRemove = quotaFlags.Bool("rm", false, "Remove the quota")
+var quotaTemplate = quotaFlags.String("t", "", "Display template")
+var quotaTemplateFile = quotaFlags.String("T", "", "Display template filename")
+var quotaJSON = quotaFlags.Bool("json", false, "Dump as json")
+
+const defaultQuotaTemplate = `{{range .}}{{.Prefix}}
+  size:  {{bytes .UsedBytes}} of {{if .Bytes}}{{bytes .Bytes}}{{else}}unlimited{{end}}
+  files: {{.UsedObjects}} of {{if .Objects}}{{.Objects}}{{else}}unlimited{{end}}
+{{end}}`
+
+func quotaCommand(base string, args []string) {
+	client, err := cbfsclient.New(base)
+	cbfstool.MaybeFatal(err, "Error setting up client: %v", err)
+
+	prefix := quotaFlags.Arg(0)
+	if *quotaRemove || *quotaBytes != "" || *quotaObjects >= 0 {
+		if prefix == "" {
+			log.Fatalf("Setting a quota requires a path prefix")
+		}
+		setQuota(client, prefix)
+		return
+	}
+
+	quotas, err := client.Quotas()
+	cbfstool.MaybeFatal(err, "Error getting quotas: %v", err)
+
+	if prefix != "" {
+		matched := quotas[:0]
+		for _, q := range quotas {
+			if q.Prefix == prefix {
+				matched = append(matched, q)
+			}
+		}
+		quotas = matched
+	}
+
+	if *quotaJSON || cbfstool.JSON {
+		cbfstool.PrintJSON(quotas)
+	} else {
+		tmpl := cbfstool.GetTemplate(*quotaTemplate, *quotaTemplateFile,
+			defaultQuotaTemplate)
+		err := tmpl.Execute(os.Stdout, quotas)
+		cbfstool.MaybeFatal(err, "Error executing template: %v", err)
+	}
+}
+
+func setQuota(client *cbfsclient.Client, prefix string) {
+	q := cbfsconfig.Quota{}
+	if !*quotaRemove {
+		conf, err := client.GetConfig()
+		cbfstool.MaybeFatal(err, "Error getting config: %v", err)
+		q = conf.Quotas[prefix]
+
+		if *quotaBytes != "" {
+			n, err := humanize.ParseBytes(*quotaBytes)
+			cbfstool.MaybeFatal(err, "Error parsing size %q: %v",
+				*quotaBytes, err)
+			q.Bytes = int64(n)
+		}
+		if *quotaObjects >= 0 {
+			q.Objects = *quotaObjects
+		}
+	}
+
+	err := client.SetQuota(prefix, q)
+	cbfstool.MaybeFatal(err, "Error setting quota on %v: %v", prefix, err)
+}
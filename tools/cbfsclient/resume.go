@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Directory holding the IDs of multipart uploads in progress, so an
+// interrupted upload of the same file can pick up where it left off.
+func uploadStateDir() string {
+	if d := os.Getenv("CBFS_UPLOAD_STATE"); d != "" {
+		return d
+	}
+	return filepath.Join(os.Getenv("HOME"), ".cbfsuploads")
+}
+
+func uploadStatePath(src, dest string) string {
+	if abs, err := filepath.Abs(src); err == nil {
+		src = abs
+	}
+	h := sha1.New()
+	h.Write([]byte(src + "\x00" + dest))
+	return filepath.Join(uploadStateDir(), hex.EncodeToString(h.Sum(nil)))
+}
+
+// The ID of an earlier, unfinished upload of src to dest, if any.
+func loadUploadState(src, dest string) string {
+	data, err := ioutil.ReadFile(uploadStatePath(src, dest))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func saveUploadState(src, dest, id string) error {
+	if err := os.MkdirAll(uploadStateDir(), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(uploadStatePath(src, dest), []byte(id+"\n"), 0600)
+}
+
+func clearUploadState(src, dest string) {
+	os.Remove(uploadStatePath(src, dest))
+}
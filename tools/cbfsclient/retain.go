@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/couchbaselabs/cbfs/tools"
+)
+
+var retainFlags = flag.NewFlagSet("retain", flag.ExitOnError)
+var retainFor = retainFlags.Duration("for", 0,
+	"Lock the file for this long from now")
+var retainUntil = retainFlags.String("until", "",
+	"Lock the file until this time (RFC 3339)")
+
+func retainCommand(u string, args []string) {
+	client, err := cbfsclient.New(u)
+	cbfstool.MaybeFatal(err, "Error creating client: %v", err)
+
+	path := quotingReplacer.Replace(args[0])
+	var until time.Time
+	switch {
+	case *retainFor > 0 && *retainUntil != "":
+		log.Fatalf("Give -for or -until, not both")
+	case *retainFor > 0:
+		until = time.Now().Add(*retainFor)
+	case *retainUntil != "":
+		until, err = time.Parse(time.RFC3339, *retainUntil)
+		cbfstool.MaybeFatal(err, "Invalid -until: %v", err)
+	}
+
+	var r cbfsclient.Retention
+	if until.IsZero() {
+		r, err = client.Retention(path)
+	} else {
+		r, err = client.Retain(path, until)
+	}
+	if err == cbfsclient.Missing {
+		log.Fatalf("No such file: %v", args[0])
+	}
+	cbfstool.MaybeFatal(err, "Error with retention of %v: %v", args[0], err)
+
+	if cbfstool.JSON {
+		cbfstool.PrintJSON(r)
+		return
+	}
+	if r.Locked {
+		fmt.Printf("%v is locked until %v\n", args[0],
+			r.RetainUntil.Local().Format(time.RFC3339))
+	} else {
+		fmt.Printf("%v is not locked\n", args[0])
+	}
+	if r.Policy != "0s" && r.Policy != "" {
+		fmt.Printf("Files stored there are locked for %v\n", r.Policy)
+	}
+}
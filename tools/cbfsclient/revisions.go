@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/couchbaselabs/cbfs/tools"
+	"github.com/dustin/go-humanize"
+)
+
+var revisionsFlags = flag.NewFlagSet("revisions", flag.ExitOnError)
+
+var revertFlags = flag.NewFlagSet("revert", flag.ExitOnError)
+
+func revisionsCommand(u string, args []string) {
+	client, err := cbfsclient.New(u)
+	cbfstool.MaybeFatal(err, "Error creating client: %v", err)
+
+	fn := revisionsFlags.Arg(0)
+	revs, err := client.Revisions(quotingReplacer.Replace(fn))
+	cbfstool.MaybeFatal(err, "Error listing revisions of %v: %v", fn, err)
+
+	if cbfstool.JSON {
+		for _, r := range revs {
+			cbfstool.PrintJSONLine(r)
+		}
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+	for _, r := range revs {
+		cur := " "
+		if r.Current {
+			cur = "*"
+		}
+		fmt.Fprintf(tw, "%s %d\t%8s\t%s\t%s\n", cur, r.Revno,
+			humanize.Bytes(uint64(r.Length)),
+			r.Modified.Local().Format(time.RFC3339), r.OID)
+	}
+	tw.Flush()
+}
+
+func revertCommand(u string, args []string) {
+	client, err := cbfsclient.New(u)
+	cbfstool.MaybeFatal(err, "Error creating client: %v", err)
+
+	fn := revertFlags.Arg(0)
+	revno, err := strconv.Atoi(revertFlags.Arg(1))
+	cbfstool.MaybeFatal(err, "Invalid revision %q: %v", revertFlags.Arg(1), err)
+
+	err = client.Revert(quotingReplacer.Replace(fn), revno)
+	cbfstool.MaybeFatal(err, "Error reverting %v to %v: %v", fn, revno, err)
+}
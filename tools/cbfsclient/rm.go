@@ -2,7 +2,9 @@ package main
 
 import (
 	"flag"
+	"log"
 	"sync"
+	"time"
 
 	"github.com/couchbaselabs/cbfs/client"
 	"github.com/couchbaselabs/cbfs/tools"
@@ -15,6 +17,30 @@ var rmNoop = rmFlags.Bool("n", false, "Dry run")
 var rmWg = sync.WaitGroup{}
 var rmCh = make(chan string, 100)
 
+// Have the server delete everything under a path, waiting for it to
+// finish.
+func rmTree(client *cbfsclient.Client, under string) {
+	id, err := client.RmRecursive(under)
+	cbfstool.MaybeFatal(err, "Error starting delete of %q: %v", under, err)
+	cbfstool.Verbose(*rmVerbose, "Deleting %v (task %v)", under, id)
+
+	for {
+		time.Sleep(time.Second)
+		t, err := client.RmTask(id)
+		cbfstool.MaybeFatal(err, "Error checking on %v: %v", id, err)
+		cbfstool.Verbose(*rmVerbose, "%v: %v deleted, %v errors",
+			under, t.Deleted, t.Errors)
+		if !t.Done() {
+			continue
+		}
+		if t.Errors > 0 {
+			log.Fatalf("%v errors deleting %v, the last: %v",
+				t.Errors, under, t.LastError)
+		}
+		return
+	}
+}
+
 func rmDashR(client *cbfsclient.Client, under string) {
 	listing, err := client.ListDepth(under, 8192)
 	cbfstool.MaybeFatal(err, "Error listing files at %q: %v", under, err)
@@ -56,9 +82,12 @@ func rmCommand(u string, args []string) {
 	}
 
 	for _, path := range rmFlags.Args() {
-		if *rmRecurse {
+		switch {
+		case *rmRecurse && !*rmNoop:
+			rmTree(client, path)
+		case *rmRecurse:
 			rmDashR(client, path)
-		} else {
+		default:
 			rmCh <- path
 		}
 	}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/couchbaselabs/cbfs/tools"
+	"github.com/dustin/go-humanize"
+	"github.com/peterh/liner"
+)
+
+var shellFlags = flag.NewFlagSet("shell", flag.ExitOnError)
+var shellHistory = shellFlags.String("history",
+	filepath.Join(os.Getenv("HOME"), ".cbfsclient_history"),
+	"File to keep command history in (empty for none)")
+
+var errShellExit = errors.New("exit")
+
+type shellCmd struct {
+	run   func(sh *shell, args []string) error
+	usage string
+}
+
+var shellCmds map[string]shellCmd
+
+func init() {
+	shellCmds = map[string]shellCmd{
+		"cd":   {(*shell).cd, "cd [dir]"},
+		"pwd":  {(*shell).pwd, "pwd"},
+		"ls":   {(*shell).ls, "ls [-l] [dir]"},
+		"get":  {(*shell).get, "get file [local]"},
+		"put":  {(*shell).put, "put local [file]"},
+		"rm":   {(*shell).rm, "rm file..."},
+		"stat": {(*shell).stat, "stat file"},
+		"help": {(*shell).help, "help"},
+		"exit": {(*shell).exit, "exit"},
+		"quit": {(*shell).exit, "quit"},
+	}
+}
+
+// An interactive session against a cbfs cluster.
+type shell struct {
+	client *cbfsclient.Client
+	// Lists a directory, empty if it doesn't exist.
+	list func(dir string) (cbfsclient.ListResult, error)
+	cwd  string // without leading or trailing slashes
+	out  io.Writer
+}
+
+func shellCommand(u string, args []string) {
+	client, err := cbfsclient.New(u)
+	cbfstool.MaybeFatal(err, "Error creating client: %v", err)
+
+	sh := &shell{client: client, list: client.ListOrEmpty, out: os.Stdout}
+	if shellFlags.NArg() > 0 {
+		sh.cwd = sh.resolve(shellFlags.Arg(0))
+	}
+
+	line := liner.NewLiner()
+	defer line.Close()
+	line.SetCtrlCAborts(true)
+	line.SetCompleter(sh.complete)
+
+	if *shellHistory != "" {
+		if f, err := os.Open(*shellHistory); err == nil {
+			line.ReadHistory(f)
+			f.Close()
+		}
+		defer func() {
+			if f, err := os.Create(*shellHistory); err == nil {
+				line.WriteHistory(f)
+				f.Close()
+			}
+		}()
+	}
+
+	for {
+		input, err := line.Prompt("cbfs:/" + sh.cwd + "> ")
+		switch err {
+		case nil:
+		case liner.ErrPromptAborted:
+			continue
+		case io.EOF:
+			fmt.Println()
+			return
+		default:
+			cbfstool.MaybeFatal(err, "Error reading command: %v", err)
+		}
+		if strings.TrimSpace(input) == "" {
+			continue
+		}
+		line.AppendHistory(input)
+		if err := sh.run(input); err == errShellExit {
+			return
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+	}
+}
+
+func (sh *shell) run(input string) error {
+	args := strings.Fields(input)
+	cmd, ok := shellCmds[args[0]]
+	if !ok {
+		return fmt.Errorf("Unknown command %q (try help)", args[0])
+	}
+	return cmd.run(sh, args[1:])
+}
+
+// The full path (without a leading slash) of p relative to the
+// current directory.
+func (sh *shell) resolve(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + sh.cwd + "/" + p
+	}
+	return strings.TrimPrefix(path.Clean(p), "/")
+}
+
+func (sh *shell) cd(args []string) error {
+	if len(args) == 0 {
+		sh.cwd = ""
+		return nil
+	}
+	dir := sh.resolve(args[0])
+	if dir != "" {
+		l, err := sh.list(sh.resolve("/" + dir + "/.."))
+		if err != nil {
+			return err
+		}
+		if _, ok := l.Dirs[path.Base(dir)]; !ok {
+			return fmt.Errorf("No such directory: /%v", dir)
+		}
+	}
+	sh.cwd = dir
+	return nil
+}
+
+func (sh *shell) pwd(args []string) error {
+	fmt.Fprintf(sh.out, "/%v\n", sh.cwd)
+	return nil
+}
+
+func (sh *shell) ls(args []string) error {
+	long := false
+	if len(args) > 0 && args[0] == "-l" {
+		long, args = true, args[1:]
+	}
+	dir := sh.cwd
+	if len(args) > 0 {
+		dir = sh.resolve(args[0])
+	}
+	l, err := sh.list(dir)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(sh.out, 2, 4, 2, ' ', 0)
+	for _, name := range sortedNames(l) {
+		di, isDir := l.Dirs[name]
+		switch {
+		case !long && isDir:
+			fmt.Fprintf(tw, "%s/\n", name)
+		case !long:
+			fmt.Fprintf(tw, "%s\n", name)
+		case isDir:
+			fmt.Fprintf(tw, "d %8s\t%s/\t(%s descendants)\n",
+				humanize.Bytes(uint64(di.Size)), name,
+				humanize.Comma(int64(di.Descendants)))
+		default:
+			fi := l.Files[name]
+			fmt.Fprintf(tw, "f %8s\t%s\t%s\t%s\n",
+				humanize.Bytes(uint64(fi.Length)), name,
+				fi.Modified.Format("2006-01-02 15:04"),
+				fi.Headers.Get("Content-Type"))
+		}
+	}
+	return tw.Flush()
+}
+
+func sortedNames(l cbfsclient.ListResult) []string {
+	rv := make([]string, 0, len(l.Dirs)+len(l.Files))
+	for name := range l.Dirs {
+		rv = append(rv, name)
+	}
+	for name := range l.Files {
+		rv = append(rv, name)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+func (sh *shell) get(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("Usage: " + shellCmds["get"].usage)
+	}
+	src := sh.resolve(args[0])
+	dest := path.Base(src)
+	if len(args) > 1 {
+		dest = args[1]
+	}
+	if st, err := os.Stat(dest); err == nil && st.IsDir() {
+		dest = filepath.Join(dest, path.Base(src))
+	}
+
+	r, err := sh.client.Get(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(dest)
+		return err
+	}
+	fmt.Fprintf(sh.out, "%v -> %v (%v)\n", src, dest, humanize.Bytes(uint64(n)))
+	return nil
+}
+
+func (sh *shell) put(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("Usage: " + shellCmds["put"].usage)
+	}
+	dest := sh.resolve(filepath.Base(args[0]))
+	if len(args) > 1 {
+		dest = sh.resolve(args[1])
+		if strings.HasSuffix(args[1], "/") {
+			dest = path.Join(dest, filepath.Base(args[0]))
+		}
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := sh.client.Put(args[0], dest, f, cbfsclient.PutOptions{}); err != nil {
+		return err
+	}
+	fmt.Fprintf(sh.out, "%v -> /%v\n", args[0], dest)
+	return nil
+}
+
+func (sh *shell) rm(args []string) error {
+	if len(args) == 0 {
+		return errors.New("Usage: " + shellCmds["rm"].usage)
+	}
+	for _, a := range args {
+		p := sh.resolve(a)
+		if err := sh.client.Rm(p); err != nil {
+			return fmt.Errorf("Error removing /%v: %v", p, err)
+		}
+	}
+	return nil
+}
+
+func (sh *shell) stat(args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: " + shellCmds["stat"].usage)
+	}
+	p := sh.resolve(args[0])
+	m, err := sh.client.Stat(p)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(sh.out, "File: /%v\n  OID: %v\n  Length: %v (%v)\n"+
+		"  Modified: %v\n  Rev: %v\n  Type: %v\n",
+		p, m.OID, m.Length, humanize.Bytes(uint64(m.Length)),
+		m.Modified, m.Revno, m.Headers.Get("Content-Type"))
+	return nil
+}
+
+func (sh *shell) help(args []string) error {
+	names := make([]string, 0, len(shellCmds))
+	for name := range shellCmds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(sh.out, "  %v\n", shellCmds[name].usage)
+	}
+	return nil
+}
+
+func (sh *shell) exit(args []string) error {
+	return errShellExit
+}
+
+// Complete a command name, a local file for put, or else a path in
+// the cluster.
+func (sh *shell) complete(line string) []string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || (len(fields) == 1 && !strings.HasSuffix(line, " ")) {
+		prefix := strings.TrimSpace(line)
+		var rv []string
+		for name := range shellCmds {
+			if strings.HasPrefix(name, prefix) {
+				rv = append(rv, name+" ")
+			}
+		}
+		sort.Strings(rv)
+		return rv
+	}
+
+	word := ""
+	if !strings.HasSuffix(line, " ") {
+		word = fields[len(fields)-1]
+	}
+	head := line[:len(line)-len(word)]
+	if fields[0] == "put" && (len(fields) == 1 || (len(fields) == 2 && word != "")) {
+		return completeLocal(head, word)
+	}
+
+	dir, base := "", word
+	if i := strings.LastIndex(word, "/"); i >= 0 {
+		dir, base = word[:i+1], word[i+1:]
+	}
+	l, err := sh.list(sh.resolve(dir))
+	if err != nil {
+		return nil
+	}
+	var rv []string
+	for _, name := range sortedNames(l) {
+		if !strings.HasPrefix(name, base) {
+			continue
+		}
+		if _, ok := l.Dirs[name]; ok {
+			rv = append(rv, head+dir+name+"/")
+		} else {
+			rv = append(rv, head+dir+name)
+		}
+	}
+	return rv
+}
+
+func completeLocal(head, word string) []string {
+	matches, _ := filepath.Glob(word + "*")
+	var rv []string
+	for _, m := range matches {
+		if st, err := os.Stat(m); err == nil && st.IsDir() {
+			m += string(filepath.Separator)
+		}
+		rv = append(rv, head+m)
+	}
+	return rv
+}
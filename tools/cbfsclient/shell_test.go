@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/couchbaselabs/cbfs/client"
+)
+
+func fakeShell() (*shell, *bytes.Buffer) {
+	tree := map[string]cbfsclient.ListResult{
+		"": {
+			Dirs:  map[string]cbfsclient.Dir{"docs": {}, "data": {}},
+			Files: map[string]cbfsclient.FileMeta{"readme": {}},
+		},
+		"docs": {
+			Dirs:  map[string]cbfsclient.Dir{},
+			Files: map[string]cbfsclient.FileMeta{"a.txt": {}, "b.txt": {}},
+		},
+	}
+	buf := &bytes.Buffer{}
+	return &shell{
+		list: func(dir string) (cbfsclient.ListResult, error) {
+			return tree[dir], nil
+		},
+		out: buf,
+	}, buf
+}
+
+func TestShellResolve(t *testing.T) {
+	sh, _ := fakeShell()
+	sh.cwd = "docs/old"
+
+	tests := map[string]string{
+		"":         "docs/old",
+		"a.txt":    "docs/old/a.txt",
+		"../b.txt": "docs/b.txt",
+		"/x/./y":   "x/y",
+		"../../..": "",
+		"/":        "",
+	}
+	for in, exp := range tests {
+		if got := sh.resolve(in); got != exp {
+			t.Errorf("Expected %q to resolve to %q, got %q", in, exp, got)
+		}
+	}
+}
+
+func TestShellCd(t *testing.T) {
+	sh, buf := fakeShell()
+	if err := sh.run("cd docs"); err != nil || sh.cwd != "docs" {
+		t.Fatalf("Expected to be in docs, got %q, %v", sh.cwd, err)
+	}
+	if err := sh.run("cd ../nope"); err == nil || sh.cwd != "docs" {
+		t.Errorf("Expected not to cd to a missing dir, got %q, %v", sh.cwd, err)
+	}
+	if err := sh.run("ls"); err != nil || buf.String() != "a.txt\nb.txt\n" {
+		t.Errorf("Expected to list docs, got %q, %v", buf, err)
+	}
+	if err := sh.run("cd"); err != nil || sh.cwd != "" {
+		t.Errorf("Expected to be back at the top, got %q, %v", sh.cwd, err)
+	}
+	if err := sh.run("frob"); err == nil {
+		t.Errorf("Expected an error for an unknown command")
+	}
+}
+
+func TestShellComplete(t *testing.T) {
+	sh, _ := fakeShell()
+
+	tests := []struct {
+		line string
+		exp  []string
+	}{
+		{"s", []string{"stat "}},
+		{"cd d", []string{"cd data/", "cd docs/"}},
+		{"get ", []string{"get data/", "get docs/", "get readme"}},
+		{"get docs/b", []string{"get docs/b.txt"}},
+		{"rm docs/a.txt docs/", []string{
+			"rm docs/a.txt docs/a.txt", "rm docs/a.txt docs/b.txt"}},
+		{"ls nope/", nil},
+	}
+	for _, test := range tests {
+		if got := sh.complete(test.line); !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("Expected %q to complete to %q, got %q",
+				test.line, test.exp, got)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/couchbaselabs/cbfs/tools"
+	"github.com/dustin/httputil"
+)
+
+var syncFlags = flag.NewFlagSet("sync", flag.ExitOnError)
+var syncVerbose = syncFlags.Bool("v", false, "Verbose")
+var syncDelete = syncFlags.Bool("delete", false,
+	"Delete remote files that are missing locally")
+var syncPull = syncFlags.Bool("pull", false,
+	"Download remote files that are missing or newer locally")
+var syncNoop = syncFlags.Bool("n", false,
+	"Dry run; report the differences without changing anything")
+var syncWorkers = syncFlags.Int("workers", 4, "Number of sync workers")
+var syncZone = syncFlags.String("zone", "",
+	"Prefer nodes in this zone when pulling files")
+
+// Actions completed, for the summary of an interrupted sync.
+var syncDone int64
+
+type syncOp uint8
+
+const (
+	syncUpload = syncOp(iota)
+	syncDownload
+	syncRemove
+)
+
+func (o syncOp) String() string {
+	switch o {
+	case syncUpload:
+		return ">"
+	case syncDownload:
+		return "<"
+	case syncRemove:
+		return "-"
+	}
+	panic("unhandled sync op")
+}
+
+type syncAction struct {
+	op   syncOp
+	path string
+	why  string
+}
+
+type syncPlan []syncAction
+
+func (s syncPlan) Len() int {
+	return len(s)
+}
+
+func (s syncPlan) Less(i, j int) bool {
+	return s[i].path < s[j].path
+}
+
+func (s syncPlan) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// Work out what needs to move to bring local and remote in line.
+//
+// Paths are relative to the roots being synced.  same reports whether
+// a local file has a remote file's content and is only consulted for
+// same-sized files.
+func planSync(local map[string]os.FileInfo,
+	remote map[string]cbfsclient.FileMeta,
+	same func(string, cbfsclient.FileMeta) bool, del, pull bool) syncPlan {
+
+	rv := syncPlan{}
+	for p, fi := range local {
+		rm, ok := remote[p]
+		switch {
+		case !ok:
+			rv = append(rv, syncAction{syncUpload, p, "missing remotely"})
+		case fi.Size() == rm.Length && same(p, rm):
+			// Same content.
+		case pull && rm.Modified.After(fi.ModTime()):
+			rv = append(rv, syncAction{syncDownload, p, "newer remotely"})
+		default:
+			rv = append(rv, syncAction{syncUpload, p, "changed locally"})
+		}
+	}
+
+	for p := range remote {
+		if _, ok := local[p]; ok {
+			continue
+		}
+		switch {
+		case pull:
+			rv = append(rv, syncAction{syncDownload, p, "missing locally"})
+		case del:
+			rv = append(rv, syncAction{syncRemove, p, "missing locally"})
+		}
+	}
+
+	sort.Sort(rv)
+	return rv
+}
+
+func syncLocalFiles(src string) (map[string]os.FileInfo, error) {
+	rv := map[string]os.FileInfo{}
+	err := filepath.Walk(src,
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if isIgnored(path) {
+				cbfstool.Verbose(*syncVerbose, "Ignoring %v", path)
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			switch {
+			case info.IsDir():
+				return loadDirIgnores(path)
+			case info.Mode()&os.ModeType != 0:
+				cbfstool.Verbose(*syncVerbose,
+					"Ignoring special file: %v - %v", path, info.Mode())
+			default:
+				rel, err := filepath.Rel(src, path)
+				if err != nil {
+					return err
+				}
+				rv[filepath.ToSlash(rel)] = info
+			}
+			return nil
+		})
+	return rv, err
+}
+
+func syncDownloadFile(client *cbfsclient.Client, remote, local string,
+	modified time.Time) error {
+
+	r, err := client.Get(quotingReplacer.Replace(remote))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	err = os.MkdirAll(filepath.Dir(local), 0777)
+	if err != nil {
+		return err
+	}
+
+	tmp := local + ".cbfstmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Chtimes(tmp, modified, modified)
+	}
+	if err == nil {
+		err = os.Rename(tmp, local)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func syncWorker(wg *sync.WaitGroup, client *cbfsclient.Client,
+	src, dest string, remote map[string]cbfsclient.FileMeta,
+	ch <-chan syncAction, ech chan<- error) {
+
+	defer wg.Done()
+	for a := range ch {
+		cbfstool.Verbose(*syncVerbose, "%v %v (%v)", a.op, a.path, a.why)
+
+		local := filepath.Join(src, filepath.FromSlash(a.path))
+		rpath := dest + "/" + a.path
+		var err error
+		switch a.op {
+		case syncUpload:
+			var f *os.File
+			f, err = os.Open(local)
+			if err == nil {
+				err = client.Put(local, quotingReplacer.Replace(rpath), f,
+					cbfsclient.PutOptions{Hash: localHash(local)})
+				f.Close()
+			}
+		case syncDownload:
+			err = syncDownloadFile(client, rpath, local,
+				remote[a.path].Modified)
+		case syncRemove:
+			err = client.Rm(quotingReplacer.Replace(rpath))
+			if err == cbfsclient.Missing {
+				err = nil
+			}
+		}
+		switch {
+		case err == nil:
+			atomic.AddInt64(&syncDone, 1)
+		case !cbfstool.Interrupted():
+			ech <- fmt.Errorf("%v %v: %v", a.op, a.path, err)
+		}
+	}
+}
+
+func syncCommand(u string, args []string) {
+	httputil.InitHTTPTracker(false)
+
+	if *syncDelete && *syncPull {
+		log.Fatalf("-delete and -pull are mutually exclusive")
+	}
+
+	client, err := cbfsclient.New(u)
+	cbfstool.MaybeFatal(err, "Error setting up client: %v", err)
+	client.Zone = *syncZone
+	useClusterHash(client)
+	if *syncPull {
+		// Learn the nodes up front so the workers share one list.
+		_, err = client.Nodes()
+		cbfstool.MaybeFatal(err, "Error listing nodes: %v", err)
+	}
+
+	src := filepath.Clean(syncFlags.Arg(0))
+	dest := strings.Trim(syncFlags.Arg(1), "/")
+
+	fi, err := os.Stat(src)
+	cbfstool.MaybeFatal(err, "Error statting %v: %v", src, err)
+	if !fi.IsDir() {
+		log.Fatalf("%v is not a directory", src)
+	}
+
+	start := time.Now()
+	local, err := syncLocalFiles(src)
+	cbfstool.MaybeFatal(err, "Traversal error: %v", err)
+
+	listing, err := client.ListDepthOrEmpty(dest, 8192)
+	cbfstool.MaybeFatal(err, "Error listing %v: %v", dest, err)
+	remote := map[string]cbfsclient.FileMeta{}
+	for fn, fm := range listing.Files {
+		remote[strings.TrimPrefix(fn[len(dest):], "/")] = fm
+	}
+
+	plan := planSync(local, remote, func(p string, rm cbfsclient.FileMeta) bool {
+		return sameLocal(filepath.Join(src, filepath.FromSlash(p)), &rm)
+	}, *syncDelete, *syncPull)
+
+	cbfstool.Verbose(*syncVerbose, "Planned %v actions in %v",
+		len(plan), time.Since(start))
+
+	if *syncNoop {
+		for _, a := range plan {
+			if cbfstool.JSON {
+				cbfstool.PrintJSONLine(map[string]string{
+					"op": a.op.String(), "path": a.path, "why": a.why})
+			} else {
+				fmt.Printf("%v %v (%v)\n", a.op, a.path, a.why)
+			}
+		}
+		return
+	}
+
+	wg := &sync.WaitGroup{}
+	ch := make(chan syncAction)
+	ech := make(chan error)
+	for i := 0; i < *syncWorkers; i++ {
+		wg.Add(1)
+		go syncWorker(wg, client, src, dest, remote, ch, ech)
+	}
+	go func() {
+		defer close(ch)
+		for _, a := range plan {
+			select {
+			case ch <- a:
+			case <-cbfstool.Context().Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(ech)
+	}()
+
+	rc, failed := 0, 0
+	for err := range ech {
+		log.Printf("Sync error: %v", err)
+		rc = 1
+		failed++
+	}
+
+	if cbfstool.Interrupted() {
+		log.Printf("Interrupted after %v: %v of %v actions done, %v failed",
+			time.Since(start), syncDone, len(plan), failed)
+		os.Exit(cbfstool.ExitInterrupted)
+	}
+	cbfstool.Verbose(*syncVerbose, "Finished sync in %v", time.Since(start))
+	os.Exit(rc)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/client"
+)
+
+type fakeFileInfo struct {
+	size  int64
+	mtime time.Time
+}
+
+func (f fakeFileInfo) Name() string       { return "" }
+func (f fakeFileInfo) Size() int64        { return f.size }
+func (f fakeFileInfo) Mode() os.FileMode  { return 0644 }
+func (f fakeFileInfo) ModTime() time.Time { return f.mtime }
+func (f fakeFileInfo) IsDir() bool        { return false }
+func (f fakeFileInfo) Sys() interface{}   { return nil }
+
+func TestPlanSync(t *testing.T) {
+	t0 := time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC)
+	t1 := t0.Add(time.Hour)
+
+	local := map[string]os.FileInfo{
+		"same":        fakeFileInfo{3, t0},
+		"localonly":   fakeFileInfo{3, t0},
+		"localnewer":  fakeFileInfo{4, t1},
+		"remotenewer": fakeFileInfo{3, t0},
+	}
+	remote := map[string]cbfsclient.FileMeta{
+		"same":        {OID: "h-same", Length: 3, Modified: t1},
+		"remoteonly":  {OID: "x", Length: 3, Modified: t0},
+		"localnewer":  {OID: "old", Length: 3, Modified: t0},
+		"remotenewer": {OID: "new", Length: 3, Modified: t1},
+	}
+	same := func(p string, rm cbfsclient.FileMeta) bool {
+		return rm.OID == "h-"+p
+	}
+
+	tests := []struct {
+		del, pull bool
+		exp       []string
+	}{
+		{false, false, []string{
+			"> localnewer", "> localonly", "> remotenewer"}},
+		{true, false, []string{
+			"> localnewer", "> localonly", "> remotenewer", "- remoteonly"}},
+		{false, true, []string{
+			"> localnewer", "> localonly", "< remotenewer", "< remoteonly"}},
+	}
+
+	for _, test := range tests {
+		got := []string{}
+		for _, a := range planSync(local, remote, same, test.del, test.pull) {
+			got = append(got, a.op.String()+" "+a.path)
+		}
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("Expected %v with del=%v pull=%v, got %v",
+				test.exp, test.del, test.pull, got)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/couchbaselabs/cbfs/tools"
+	"github.com/dustin/go-humanize"
+)
+
+var trashFlags = flag.NewFlagSet("trash", flag.ExitOnError)
+var trashID = trashFlags.String("id", "",
+	"Restore or purge this entry rather than the latest deletion")
+var trashTo = trashFlags.String("to", "", "Restore to this path instead")
+var trashOverwrite = trashFlags.Bool("overwrite", false,
+	"Replace a file that's in the way of a restore")
+
+func trashCommand(u string, args []string) {
+	client, err := cbfsclient.New(u)
+	cbfstool.MaybeFatal(err, "Error creating client: %v", err)
+
+	path := quotingReplacer.Replace(trashFlags.Arg(1))
+	switch trashFlags.Arg(0) {
+	case "ls":
+		entries, err := client.ListTrash(path)
+		cbfstool.MaybeFatal(err, "Error listing trash: %v", err)
+
+		if cbfstool.JSON {
+			for _, e := range entries {
+				cbfstool.PrintJSONLine(e)
+			}
+			return
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+		for _, e := range entries {
+			fmt.Fprintf(tw, "%s\t%8s\t%s\t%s\n", e.ID,
+				humanize.Bytes(uint64(e.Meta.Length)),
+				e.Deleted.Local().Format(time.RFC3339), e.Path)
+		}
+		tw.Flush()
+	case "restore":
+		if path == "" {
+			log.Fatalf("Which file should be restored?")
+		}
+		err := client.RestoreTrash(path, *trashID, *trashTo, *trashOverwrite)
+		if err == cbfsclient.PreconditionFailed {
+			log.Fatalf("A file is in the way of restoring %v (see -overwrite)",
+				trashFlags.Arg(1))
+		}
+		cbfstool.MaybeFatal(err, "Error restoring %v: %v", trashFlags.Arg(1), err)
+	case "purge":
+		n, err := client.PurgeTrash(path, *trashID)
+		cbfstool.MaybeFatal(err, "Error purging trash: %v", err)
+		if cbfstool.JSON {
+			cbfstool.PrintJSON(map[string]int{"purged": n})
+		} else {
+			log.Printf("Purged %v files", n)
+		}
+	default:
+		log.Fatalf("Unknown trash command %q (expected ls, restore or purge)",
+			trashFlags.Arg(0))
+	}
+}
@@ -2,13 +2,13 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha1"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
@@ -16,10 +16,12 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/couchbaselabs/cbfs/client"
 	"github.com/couchbaselabs/cbfs/tools"
+	"github.com/dustin/go-humanize"
 	"github.com/dustin/go-id3"
 	"github.com/dustin/httputil"
 	"github.com/rwcarlsen/goexif/exif"
@@ -27,6 +29,9 @@ import (
 
 var uploadWg = sync.WaitGroup{}
 
+// What became of a directory upload's requests, for its summary.
+var uploadDone, uploadFailed, uploadStopped int64
+
 var uploadFlags = flag.NewFlagSet("upload", flag.ExitOnError)
 var uploadVerbose = uploadFlags.Bool("v", false, "Verbose")
 var uploadDelete = uploadFlags.Bool("delete", false,
@@ -43,10 +48,37 @@ var uploadUnsafe = uploadFlags.Bool("unsafe", false,
 	"Unsafe (not synchronously replicated) uploads.")
 var uploadNoHash = uploadFlags.Bool("nohash", false,
 	"Don't include the hash in the upload request")
+var uploadNoCompress = uploadFlags.Bool("nocompress", false,
+	"Don't compress text-like content in transit")
 var uploadExpiration = uploadFlags.Int("expire", 0,
 	"Expiration time (in seconds, or abs unix time)")
+var uploadTTL = uploadFlags.Duration("ttl", 0,
+	"Have the server remove uploaded files after this long")
+var uploadRetain = uploadFlags.Duration("retain", 0,
+	"Lock uploaded files against overwrites and deletes for this long")
+var uploadCheck = uploadFlags.String("check", "hash",
+	"How to detect changed files: hash, or mtime (size and mtime)")
+var uploadPartSize = uploadFlags.String("partsize", "",
+	"Upload files larger than this in parallel parts (e.g. 512MB)")
+var uploadDelta = uploadFlags.Bool("delta", false,
+	"Send only the chunks of existing files that changed")
+var uploadBurst = uploadFlags.Int("burst", 0,
+	"Bytes or requests allowed at once under -rate (default one second's worth)")
+var uploadPartBytes int64
+var uploadRate cbfstool.Rate
+var uploadExcludes patternList
+var uploadIncludes patternList
 var uploadRevsSet = false
 
+func init() {
+	uploadFlags.Var(&uploadExcludes, "exclude",
+		"Glob of paths to skip (may be repeated)")
+	uploadFlags.Var(&uploadIncludes, "include",
+		"Glob of files to upload, skipping all others (may be repeated)")
+	uploadFlags.Var(&uploadRate, "rate",
+		"Limit to this many bytes/sec (e.g. 10MB) or requests/sec (e.g. 50r)")
+}
+
 var quotingReplacer = strings.NewReplacer("%", "%25",
 	"?", "%3f",
 	" ", "%20",
@@ -73,10 +105,10 @@ func (u uploadOpType) String() string {
 }
 
 type uploadReq struct {
-	src        string
-	dest       string
-	op         uploadOpType
-	remoteHash string
+	src    string
+	dest   string
+	op     uploadOpType
+	remote *cbfsclient.FileMeta
 }
 
 func processMP3Meta(src, dest string) (interface{}, error) {
@@ -150,6 +182,22 @@ func processMeta(client *cbfsclient.Client, src, dest string) error {
 	return nil
 }
 
+// When files uploaded now should expire per -ttl.
+func uploadExpires() time.Time {
+	if *uploadTTL <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(*uploadTTL)
+}
+
+// When files uploaded now should be locked until per -retain.
+func uploadRetainUntil() time.Time {
+	if *uploadRetain <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(*uploadRetain)
+}
+
 func uploadFile(client *cbfsclient.Client, src, dest, localHash string) error {
 	cbfstool.Verbose(*uploadVerbose, "Uploading %v -> %v (%v)",
 		src, dest, localHash)
@@ -163,7 +211,25 @@ func uploadFile(client *cbfsclient.Client, src, dest, localHash string) error {
 	}
 	defer f.Close()
 
-	err = uploadStream(client, f, src, dest, localHash)
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	delta := *uploadDelta && !encrypting()
+	if delta {
+		err = uploadChanges(client, f, fi.Size(), dest)
+		if err == cbfsclient.Missing || err == cbfsclient.NotChunked {
+			delta = false
+		}
+	}
+	switch {
+	case delta:
+	case uploadPartBytes > 0 && fi.Size() > uploadPartBytes && !encrypting():
+		err = uploadParts(client, f, fi.Size(), dest)
+	default:
+		err = uploadStream(client, f, src, dest, localHash)
+	}
 	if err != nil {
 		return err
 	}
@@ -183,8 +249,11 @@ func uploadStream(client *cbfsclient.Client, r io.Reader,
 	opts := cbfsclient.PutOptions{
 		Unsafe:           *uploadUnsafe,
 		Expiration:       *uploadExpiration,
+		Expires:          uploadExpires(),
+		RetainUntil:      uploadRetainUntil(),
 		Hash:             localHash,
 		ContentTransform: maybeCrypt,
+		Compress:         !*uploadNoCompress,
 	}
 
 	if uploadRevsSet {
@@ -198,6 +267,80 @@ func uploadStream(client *cbfsclient.Client, r io.Reader,
 	return client.Put(srcName, dest, r, opts)
 }
 
+func uploadParts(client *cbfsclient.Client, f *os.File, size int64,
+	dest string) error {
+
+	opts := cbfsclient.PutOptions{
+		Expiration:  *uploadExpiration,
+		Expires:     uploadExpires(),
+		RetainUntil: uploadRetainUntil(),
+		ContentType: mime.TypeByExtension(filepath.Ext(f.Name())),
+	}
+	if uploadRevsSet {
+		opts.SetKeepRevs(*uploadRevs)
+	}
+
+	var m *cbfsclient.MultipartUpload
+	var err error
+	if id := loadUploadState(f.Name(), dest); id != "" {
+		m, err = client.ResumeMultipart(id)
+		switch {
+		case err == nil:
+			cbfstool.Verbose(*uploadVerbose, "Resuming upload %v of %v (%v parts done)",
+				id, f.Name(), len(m.Parts))
+		case err == cbfsclient.Missing:
+			m = nil
+		default:
+			return err
+		}
+	}
+	if m == nil {
+		m, err = client.InitMultipart(dest, opts)
+		if err != nil {
+			return err
+		}
+		if err := saveUploadState(f.Name(), dest, m.ID); err != nil {
+			log.Printf("Can't record upload state, won't be resumable: %v", err)
+		}
+	}
+
+	cbfstool.Verbose(*uploadVerbose, "Uploading %v in %v byte parts",
+		f.Name(), uploadPartBytes)
+	err = m.Upload(f, size, uploadPartBytes, *uploadWorkers)
+	switch {
+	case err == nil:
+		clearUploadState(f.Name(), dest)
+	case !cbfsclient.IsTransient(err) && !cbfstool.Interrupted():
+		// Nothing to come back to.
+		m.Abort()
+		clearUploadState(f.Name(), dest)
+	}
+	return err
+}
+
+// Send only the chunks of f that dest doesn't already have.
+func uploadChanges(client *cbfsclient.Client, f *os.File, size int64,
+	dest string) error {
+
+	opts := cbfsclient.PutOptions{
+		Expiration:  *uploadExpiration,
+		Expires:     uploadExpires(),
+		RetainUntil: uploadRetainUntil(),
+		ContentType: mime.TypeByExtension(filepath.Ext(f.Name())),
+	}
+	if uploadRevsSet {
+		opts.SetKeepRevs(*uploadRevs)
+	}
+
+	stats, err := client.PutDelta(dest, f, size, *uploadWorkers, opts)
+	if err == nil {
+		cbfstool.Verbose(*uploadVerbose, "Sent %v of %v chunks (%v of %v) of %v",
+			stats.Sent, stats.Chunks, humanize.Bytes(uint64(stats.SentBytes)),
+			humanize.Bytes(uint64(stats.Bytes)), f.Name())
+	}
+	return err
+}
+
 // This is very similar to rm's version, but uses different channel
 // signaling.
 func uploadRmDir(client *cbfsclient.Client, under string) error {
@@ -227,14 +370,50 @@ func uploadRmDashR(client *cbfsclient.Client, d string) error {
 	return uploadRmDir(client, d)
 }
 
+// The hash the cluster names blobs by, so local files can be
+// compared with what's stored.
+var blobHashName = "sha1"
+
+func useClusterHash(client *cbfsclient.Client) {
+	name, err := client.BlobHash()
+	cbfstool.MaybeFatal(err, "Error getting the cluster's hash: %v", err)
+	if cbfsclient.NewHash(name) == nil {
+		log.Printf("Can't hash with %v, comparing files by size and time",
+			name)
+	}
+	blobHashName = name
+}
+
+// Whether the local file has the remote file's content.  Files this
+// client can't hash are compared by size and time instead.
+func sameLocal(fn string, remote *cbfsclient.FileMeta) bool {
+	f, err := os.Open(fn)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	same, err := remote.SameContent(f, blobHashName)
+	if err == cbfsclient.UnknownHash {
+		return unchangedByStat(fn, remote)
+	}
+	return err == nil && same
+}
+
+// The local file's hash, or "" if this client can't make the one the
+// cluster uses.
 func localHash(fn string) string {
+	h := cbfsclient.NewHash(blobHashName)
+	if h == nil {
+		return ""
+	}
+
 	f, err := os.Open(fn)
 	if err != nil {
 		return "unknown"
 	}
 	defer f.Close()
 
-	h := sha1.New()
 	_, err = io.Copy(h, f)
 	if err != nil {
 		return "unknown"
@@ -243,49 +422,68 @@ func localHash(fn string) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
+// True if the local file is the same size as the remote one and
+// hasn't been modified since it was stored.
+func unchangedByStat(fn string, remote *cbfsclient.FileMeta) bool {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return false
+	}
+	return fi.Size() == remote.Length && !fi.ModTime().After(remote.Modified)
+}
+
+func uploadOne(client *cbfsclient.Client, req uploadReq) error {
+	switch req.op {
+	case uploadFileOp:
+		if req.remote != nil && *uploadCheck == "mtime" &&
+			unchangedByStat(req.src, req.remote) {
+			return nil
+		}
+		if req.remote != nil {
+			if sameLocal(req.src, req.remote) {
+				return nil
+			}
+			cbfstool.Verbose(*uploadVerbose, "%v has changed, reupping",
+				req.src)
+		}
+		return uploadFile(client, req.src, req.dest, localHash(req.src))
+	case removeFileOp:
+		cbfstool.Verbose(*uploadVerbose, "Removing file %v", req.dest)
+		if !*uploadNoop {
+			return rmFile(client, req.dest)
+		}
+	case removeRecurseOp:
+		return uploadRmDashR(client, req.dest)
+	default:
+		log.Fatalf("Unhandled case")
+	}
+	return nil
+}
+
 func uploadWorker(client *cbfsclient.Client, ch chan uploadReq, ech chan error) {
 	defer uploadWg.Done()
 	for req := range ch {
-		retries := 0
-		done := false
-		for !done {
-			var err error
-			switch req.op {
-			case uploadFileOp:
-				lh := localHash(req.src)
-				if req.remoteHash == "" {
-					err = uploadFile(client, req.src, req.dest, lh)
-				} else {
-					if lh != req.remoteHash {
-						cbfstool.Verbose(*uploadVerbose, "%v has changed, reupping",
-							req.src)
-						err = uploadFile(client, req.src, req.dest, lh)
-					}
-				}
-			case removeFileOp:
-				cbfstool.Verbose(*uploadVerbose, "Removing file %v", req.dest)
-				if !*uploadNoop {
-					err = rmFile(client, req.dest)
-				}
-			case removeRecurseOp:
-				err = uploadRmDashR(client, req.dest)
-			default:
-				log.Fatalf("Unhandled case")
-			}
-			if err != nil {
-				if retries < 3 {
-					retries++
-					log.Printf("Error in %v: %v... retrying",
-						req.op, err)
-					time.Sleep(time.Duration(retries) * time.Second)
-				} else {
-					ech <- fmt.Errorf("Failed to %v %q: %v",
-						req.op, req.src, err)
-					done = true
-				}
-			} else {
-				done = true
+		// Drain what's queued once interrupted.
+		if cbfstool.Interrupted() {
+			atomic.AddInt64(&uploadStopped, 1)
+			continue
+		}
+		err := cbfsclient.DefaultBackoff.DoContext(cbfstool.Context(), func() error {
+			err := uploadOne(client, req)
+			if cbfsclient.IsTransient(err) {
+				log.Printf("Error in %v: %v... retrying", req.op, err)
 			}
+			return err
+		})
+		switch {
+		case err == nil:
+			atomic.AddInt64(&uploadDone, 1)
+		case cbfstool.Interrupted():
+			atomic.AddInt64(&uploadStopped, 1)
+		default:
+			atomic.AddInt64(&uploadFailed, 1)
+			ech <- fmt.Errorf("Failed to %v %q: %v",
+				req.op, req.src, err)
 		}
 	}
 }
@@ -315,18 +513,25 @@ func syncPath(client *cbfsclient.Client, path, dest string,
 	}
 
 	localNames := map[string]os.FileInfo{}
+	// Names we chose not to sync; these are never deleted remotely.
+	skipped := map[string]bool{}
 	for _, c := range children {
+		fullPath := filepath.Join(path, c.Name())
 		switch c.Mode() & os.ModeType {
 		case os.ModeCharDevice, os.ModeDevice,
 			os.ModeNamedPipe, os.ModeSocket, os.ModeSymlink:
 			cbfstool.Verbose(*uploadVerbose, "Ignoring special file: %v - %v",
-				filepath.Join(path, c.Name()), c.Mode())
+				fullPath, c.Mode())
 		default:
-			fullPath := filepath.Join(path, c.Name())
-			if !isIgnored(fullPath) {
-				localNames[c.Name()] = c
-			} else {
+			switch {
+			case isIgnored(fullPath):
 				cbfstool.Verbose(*uploadVerbose, "Ignoring %v", fullPath)
+				skipped[c.Name()] = true
+			case !c.IsDir() && !isIncluded(fullPath):
+				cbfstool.Verbose(*uploadVerbose, "Not including %v", fullPath)
+				skipped[c.Name()] = true
+			default:
+				localNames[c.Name()] = c
 			}
 		}
 	}
@@ -354,14 +559,14 @@ func syncPath(client *cbfsclient.Client, path, dest string,
 			if ri, ok := serverListing.Files[n]; ok {
 				ch <- uploadReq{filepath.Join(path, n),
 					r.Replace(dest) + "/" + r.Replace(n),
-					uploadFileOp, ri.OID}
+					uploadFileOp, &ri}
 			}
 		}
 	}
 
 	toRm := []string{}
 	for n := range remoteNames {
-		if _, ok := localNames[n]; !ok {
+		if _, ok := localNames[n]; !ok && !skipped[n] {
 			toRm = append(toRm, n)
 		}
 	}
@@ -369,14 +574,14 @@ func syncPath(client *cbfsclient.Client, path, dest string,
 	if len(missingUpstream) > 0 {
 		for _, m := range missingUpstream {
 			ch <- uploadReq{filepath.Join(path, m),
-				r.Replace(dest) + "/" + r.Replace(m), uploadFileOp, ""}
+				r.Replace(dest) + "/" + r.Replace(m), uploadFileOp, nil}
 		}
 	}
 
 	if *uploadDelete && len(toRm) > 0 {
 		for _, m := range toRm {
-			ch <- uploadReq{"", dest + "/" + r.Replace(m), removeFileOp, ""}
-			ch <- uploadReq{"", dest + "/" + r.Replace(m), removeRecurseOp, ""}
+			ch <- uploadReq{"", dest + "/" + r.Replace(m), removeFileOp, nil}
+			ch <- uploadReq{"", dest + "/" + r.Replace(m), removeRecurseOp, nil}
 		}
 	}
 
@@ -393,12 +598,19 @@ func syncUp(client *cbfsclient.Client, src, u string, ch chan<- uploadReq) {
 
 	err := filepath.Walk(src,
 		func(path string, info os.FileInfo, err error) error {
+			if cbfstool.Interrupted() {
+				return filepath.SkipDir
+			}
 			if err == nil && info.IsDir() {
 				if isIgnored(path) {
 					cbfstool.Verbose(*uploadVerbose, "Skipping dir %v",
 						path)
 					return filepath.SkipDir
 				}
+				err = loadDirIgnores(path)
+				if err != nil {
+					return err
+				}
 				shortPath := path[len(src):]
 				err = syncPath(client, path, u+shortPath, info, ch)
 			}
@@ -417,13 +629,31 @@ func uploadCommand(u string, args []string) {
 		}
 	})
 
+	switch *uploadCheck {
+	case "hash", "mtime":
+	default:
+		log.Fatalf("Invalid -check: %q (expected hash or mtime)", *uploadCheck)
+	}
+
+	if *uploadPartSize != "" {
+		ps, err := humanize.ParseBytes(*uploadPartSize)
+		cbfstool.MaybeFatal(err, "Error parsing part size: %v", err)
+		uploadPartBytes = int64(ps)
+	}
+
+	ignorePatterns = append(ignorePatterns, uploadExcludes...)
+	includePatterns = append(includePatterns, uploadIncludes...)
+
 	if *uploadIgnore != "" {
 		err := loadIgnorePatternsFromFile(*uploadIgnore)
 		cbfstool.MaybeFatal(err, "Error loading ignores: %v", err)
 	}
 
+	cbfstool.LimitRate(uploadRate, *uploadBurst)
+
 	client, err := cbfsclient.New(u)
 	cbfstool.MaybeFatal(err, "Error setting up client: %v", err)
+	useClusterHash(client)
 
 	srcFn := uploadFlags.Arg(0)
 	dest := uploadFlags.Arg(1)
@@ -501,11 +731,23 @@ func uploadCommand(u string, args []string) {
 			}
 		}
 
+		if cbfstool.Interrupted() {
+			log.Printf("Interrupted after %v: %v done, %v failed, %v not finished",
+				time.Since(start), uploadDone, uploadFailed, uploadStopped)
+			os.Exit(cbfstool.ExitInterrupted)
+		}
 		cbfstool.Verbose(*uploadVerbose, "Finished sync in %v",
 			time.Since(start))
 		os.Exit(rc)
 	} else {
-		err = uploadFile(client, srcFn, dest, localHash(srcFn))
+		lh := localHash(srcFn)
+		err = cbfsclient.DefaultBackoff.DoContext(cbfstool.Context(), func() error {
+			err := uploadFile(client, srcFn, dest, lh)
+			if cbfsclient.IsTransient(err) {
+				log.Printf("Error uploading %v: %v... retrying", srcFn, err)
+			}
+			return err
+		})
 		cbfstool.MaybeFatal(err, "Error uploading file: %v", err)
 	}
 }
@@ -114,6 +114,10 @@ func initCrypto() {
 	}
 }
 
+func encrypting() bool {
+	return len(encryptKeys) > 0
+}
+
 func maybeCrypt(r io.Reader) io.Reader {
 	if len(encryptKeys) == 0 {
 		return r
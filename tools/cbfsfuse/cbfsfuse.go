@@ -0,0 +1,72 @@
+// +build fuse
+
+// cbfsfuse mounts a cbfs prefix as a read-write filesystem.
+//
+// It needs bazil.org/fuse, so build it with:
+//
+//	go get -tags fuse github.com/couchbaselabs/cbfs/tools/cbfsfuse
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/couchbaselabs/cbfs/tools"
+)
+
+var cacheTime = flag.Duration("cache", 5*time.Second,
+	"How long to cache attributes and directory listings")
+var readOnly = flag.Bool("ro", false, "Mount read-only")
+
+func main() {
+	log.SetFlags(log.Lmicroseconds)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr,
+			"Usage:\n  %s [flags] http://cbfs:8484/[prefix] /mount/point\n",
+			os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(64)
+	}
+
+	u := cbfstool.ParseURL(flag.Arg(0))
+	prefix := strings.Trim(u.Path, "/")
+	u.Path = "/"
+	client, err := cbfsclient.New(u.String())
+	cbfstool.MaybeFatal(err, "Error setting up client: %v", err)
+
+	mountpoint := flag.Arg(1)
+	opts := []fuse.MountOption{fuse.FSName("cbfs"), fuse.Subtype("cbfs")}
+	if *readOnly {
+		opts = append(opts, fuse.ReadOnly())
+	}
+	conn, err := fuse.Mount(mountpoint, opts...)
+	cbfstool.MaybeFatal(err, "Error mounting %v: %v", mountpoint, err)
+	defer conn.Close()
+
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigch
+		if err := fuse.Unmount(mountpoint); err != nil {
+			log.Printf("Error unmounting %v: %v", mountpoint, err)
+		}
+	}()
+
+	log.Printf("Serving %v%v on %v", u, prefix, mountpoint)
+	err = fs.Serve(conn, newCBFSFS(client, prefix))
+	cbfstool.MaybeFatal(err, "Error serving filesystem: %v", err)
+}
@@ -0,0 +1,459 @@
+// +build fuse
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/dustin/httputil"
+)
+
+type cachedListing struct {
+	when time.Time
+	res  cbfsclient.ListResult
+}
+
+type cbfsFS struct {
+	client *cbfsclient.Client
+	prefix string
+
+	mu       sync.Mutex
+	listings map[string]cachedListing
+	// Directories made here that have no files yet, and so don't
+	// exist as far as cbfs is concerned.
+	made map[string]bool
+}
+
+func newCBFSFS(c *cbfsclient.Client, prefix string) *cbfsFS {
+	return &cbfsFS{
+		client:   c,
+		prefix:   prefix,
+		listings: map[string]cachedListing{},
+		made:     map[string]bool{},
+	}
+}
+
+func (f *cbfsFS) Root() (fs.Node, error) {
+	return &dir{f, f.prefix}, nil
+}
+
+func (f *cbfsFS) list(p string) (cbfsclient.ListResult, error) {
+	f.mu.Lock()
+	cl, ok := f.listings[p]
+	f.mu.Unlock()
+	if ok && time.Since(cl.when) < *cacheTime {
+		return cl.res, nil
+	}
+
+	res, err := f.client.ListOrEmpty(p)
+	if err != nil {
+		log.Printf("Error listing %v: %v", p, err)
+		return res, fuse.Errno(syscall.EIO)
+	}
+	f.mu.Lock()
+	f.listings[p] = cachedListing{time.Now(), res}
+	f.mu.Unlock()
+	return res, nil
+}
+
+func (f *cbfsFS) invalidate(p string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.listings, path.Dir(p))
+	delete(f.listings, p)
+}
+
+func (f *cbfsFS) setMade(p string, made bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if made {
+		f.made[p] = true
+	} else {
+		delete(f.made, p)
+	}
+}
+
+func (f *cbfsFS) wasMade(p string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.made[p]
+}
+
+func join(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+type dir struct {
+	fs   *cbfsFS
+	path string
+}
+
+func (d *dir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0755
+	a.Valid = *cacheTime
+	return nil
+}
+
+func (d *dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	p := join(d.path, name)
+	l, err := d.fs.list(d.path)
+	if err != nil {
+		return nil, err
+	}
+	if fm, ok := l.Files[name]; ok {
+		return &file{fs: d.fs, path: p, meta: fm}, nil
+	}
+	if _, ok := l.Dirs[name]; ok || d.fs.wasMade(p) {
+		return &dir{d.fs, p}, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+func (d *dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	l, err := d.fs.list(d.path)
+	if err != nil {
+		return nil, err
+	}
+	rv := []fuse.Dirent{}
+	for name := range l.Dirs {
+		rv = append(rv, fuse.Dirent{Name: name, Type: fuse.DT_Dir})
+	}
+	for name := range l.Files {
+		rv = append(rv, fuse.Dirent{Name: name, Type: fuse.DT_File})
+	}
+	d.fs.mu.Lock()
+	for p := range d.fs.made {
+		if path.Dir(p) == d.path || (d.path == "" && path.Dir(p) == ".") {
+			if _, ok := l.Dirs[path.Base(p)]; !ok {
+				rv = append(rv, fuse.Dirent{Name: path.Base(p),
+					Type: fuse.DT_Dir})
+			}
+		}
+	}
+	d.fs.mu.Unlock()
+	return rv, nil
+}
+
+func (d *dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	p := join(d.path, req.Name)
+	d.fs.setMade(p, true)
+	return &dir{d.fs, p}, nil
+}
+
+func (d *dir) Create(ctx context.Context, req *fuse.CreateRequest,
+	resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+
+	f := &file{fs: d.fs, path: join(d.path, req.Name),
+		meta: cbfsclient.FileMeta{Modified: time.Now()}}
+	h, err := f.openWriter(false)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Make sure it shows up even if nothing's ever written.
+	h.dirty = true
+	return f, h, nil
+}
+
+func (d *dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	p := join(d.path, req.Name)
+	if req.Dir {
+		l, err := d.fs.list(p)
+		if err != nil {
+			return err
+		}
+		if len(l.Files) > 0 || len(l.Dirs) > 0 {
+			return fuse.Errno(syscall.ENOTEMPTY)
+		}
+		d.fs.setMade(p, false)
+		return nil
+	}
+
+	defer d.fs.invalidate(p)
+	switch err := d.fs.client.Rm(p); err {
+	case nil:
+		return nil
+	case cbfsclient.Missing:
+		return fuse.ENOENT
+	default:
+		log.Printf("Error removing %v: %v", p, err)
+		return fuse.Errno(syscall.EIO)
+	}
+}
+
+func (d *dir) Rename(ctx context.Context, req *fuse.RenameRequest,
+	newDir fs.Node) error {
+
+	nd, ok := newDir.(*dir)
+	if !ok {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	src, dest := join(d.path, req.OldName), join(nd.path, req.NewName)
+	defer d.fs.invalidate(src)
+	defer d.fs.invalidate(dest)
+
+	switch err := d.fs.client.Move(src, dest, true); err {
+	case nil:
+		return nil
+	case cbfsclient.Missing:
+		// Directories can't be moved in one request.
+		return fuse.Errno(syscall.ENOSYS)
+	default:
+		log.Printf("Error moving %v to %v: %v", src, dest, err)
+		return fuse.Errno(syscall.EIO)
+	}
+}
+
+type file struct {
+	fs   *cbfsFS
+	path string
+
+	mu     sync.Mutex
+	meta   cbfsclient.FileMeta
+	writer *writeHandle
+}
+
+func (f *file) Attr(ctx context.Context, a *fuse.Attr) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	a.Mode = 0644
+	a.Size = uint64(f.meta.Length)
+	a.Mtime = f.meta.Modified
+	a.Valid = *cacheTime
+	if f.writer != nil {
+		if fi, err := f.writer.tmp.Stat(); err == nil {
+			a.Size = uint64(fi.Size())
+		}
+		a.Valid = 0
+	}
+	return nil
+}
+
+func (f *file) Open(ctx context.Context, req *fuse.OpenRequest,
+	resp *fuse.OpenResponse) (fs.Handle, error) {
+
+	if req.Flags.IsReadOnly() {
+		return &readHandle{f}, nil
+	}
+	return f.openWriter(req.Flags&fuse.OpenTruncate == 0)
+}
+
+// Writes go to a local copy that's uploaded when the file is closed.
+func (f *file) openWriter(fetch bool) (*writeHandle, error) {
+	tmp, err := ioutil.TempFile("", "cbfsfuse")
+	if err != nil {
+		return nil, fuse.Errno(syscall.EIO)
+	}
+	os.Remove(tmp.Name())
+	h := &writeHandle{f: f, tmp: tmp}
+
+	if fetch {
+		r, err := f.fs.client.Get(f.path)
+		if err != nil {
+			tmp.Close()
+			log.Printf("Error fetching %v for writing: %v", f.path, err)
+			return nil, fuse.Errno(syscall.EIO)
+		}
+		_, err = io.Copy(tmp, r)
+		r.Close()
+		if err != nil {
+			tmp.Close()
+			log.Printf("Error fetching %v for writing: %v", f.path, err)
+			return nil, fuse.Errno(syscall.EIO)
+		}
+	}
+
+	f.mu.Lock()
+	f.writer = h
+	f.mu.Unlock()
+	return h, nil
+}
+
+func (f *file) Setattr(ctx context.Context, req *fuse.SetattrRequest,
+	resp *fuse.SetattrResponse) error {
+
+	if !req.Valid.Size() {
+		return nil
+	}
+	f.mu.Lock()
+	h := f.writer
+	f.mu.Unlock()
+
+	switch {
+	case h != nil:
+		if err := h.tmp.Truncate(int64(req.Size)); err != nil {
+			return fuse.Errno(syscall.EIO)
+		}
+		h.dirty = true
+	case req.Size == 0:
+		h, err := f.openWriter(false)
+		if err != nil {
+			return err
+		}
+		h.dirty = true
+		defer h.close()
+		if err := h.upload(); err != nil {
+			return err
+		}
+	default:
+		return fuse.Errno(syscall.ENOTSUP)
+	}
+	return f.Attr(ctx, &resp.Attr)
+}
+
+// Reads straight from cbfs, a range at a time.
+type readHandle struct {
+	f *file
+}
+
+func (h *readHandle) Read(ctx context.Context, req *fuse.ReadRequest,
+	resp *fuse.ReadResponse) error {
+
+	h.f.mu.Lock()
+	length := h.f.meta.Length
+	h.f.mu.Unlock()
+
+	end := req.Offset + int64(req.Size)
+	if end > length {
+		end = length
+	}
+	if req.Offset >= end {
+		resp.Data = nil
+		return nil
+	}
+
+	hreq, err := http.NewRequest("GET", h.f.fs.client.URLFor(h.f.path), nil)
+	if err != nil {
+		return fuse.Errno(syscall.EIO)
+	}
+	hreq.Header.Set("Range", fmt.Sprintf("bytes=%v-%v", req.Offset, end-1))
+	res, err := http.DefaultClient.Do(hreq)
+	if err != nil {
+		log.Printf("Error reading %v: %v", h.f.path, err)
+		return fuse.Errno(syscall.EIO)
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case 206:
+	case 200:
+		// The whole thing; skip to what was asked for.
+		if _, err := io.CopyN(ioutil.Discard, res.Body, req.Offset); err != nil {
+			return fuse.Errno(syscall.EIO)
+		}
+	case 404:
+		return fuse.ENOENT
+	default:
+		log.Print(httputil.HTTPErrorf(res, "Error reading %v: %S\n%B",
+			h.f.path))
+		return fuse.Errno(syscall.EIO)
+	}
+
+	resp.Data = make([]byte, end-req.Offset)
+	n, err := io.ReadFull(res.Body, resp.Data)
+	resp.Data = resp.Data[:n]
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return fuse.Errno(syscall.EIO)
+	}
+	return nil
+}
+
+type writeHandle struct {
+	f     *file
+	mu    sync.Mutex
+	tmp   *os.File
+	dirty bool
+}
+
+func (h *writeHandle) Read(ctx context.Context, req *fuse.ReadRequest,
+	resp *fuse.ReadResponse) error {
+
+	resp.Data = make([]byte, req.Size)
+	n, err := h.tmp.ReadAt(resp.Data, req.Offset)
+	resp.Data = resp.Data[:n]
+	if err != nil && err != io.EOF {
+		return fuse.Errno(syscall.EIO)
+	}
+	return nil
+}
+
+func (h *writeHandle) Write(ctx context.Context, req *fuse.WriteRequest,
+	resp *fuse.WriteResponse) error {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n, err := h.tmp.WriteAt(req.Data, req.Offset)
+	resp.Size = n
+	h.dirty = true
+	if err != nil {
+		return fuse.Errno(syscall.EIO)
+	}
+	return nil
+}
+
+// Store the local copy if it changed.
+func (h *writeHandle) upload() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.dirty {
+		return nil
+	}
+
+	fi, err := h.tmp.Stat()
+	if err == nil {
+		_, err = h.tmp.Seek(0, 0)
+	}
+	if err == nil {
+		err = h.f.fs.client.Put(h.f.path, h.f.path, h.tmp,
+			cbfsclient.PutOptions{})
+	}
+	h.f.fs.invalidate(h.f.path)
+	if err != nil {
+		log.Printf("Error storing %v: %v", h.f.path, err)
+		return fuse.Errno(syscall.EIO)
+	}
+	h.dirty = false
+
+	h.f.mu.Lock()
+	h.f.meta.Length = fi.Size()
+	h.f.meta.Modified = time.Now()
+	h.f.mu.Unlock()
+	return nil
+}
+
+func (h *writeHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	return h.upload()
+}
+
+func (h *writeHandle) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	return h.upload()
+}
+
+func (h *writeHandle) close() {
+	h.f.mu.Lock()
+	if h.f.writer == h {
+		h.f.writer = nil
+	}
+	h.f.mu.Unlock()
+	h.tmp.Close()
+}
+
+func (h *writeHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	defer h.close()
+	return h.upload()
+}
@@ -0,0 +1,242 @@
+package cbfstool
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/couchbaselabs/cbfs/client"
+)
+
+// Which arguments of each command name paths in the cluster, by
+// position (-1 for all of them), so completion scripts made with
+// -remote can look them up as they're typed.
+var RemoteArgs = map[string][]int{}
+
+var completionFlags = flag.NewFlagSet("completion", flag.ExitOnError)
+var completionRemote = completionFlags.Bool("remote", false,
+	"Complete paths in the cluster too (queries it as you type)")
+
+// The command completion scripts run to get candidates for the word
+// being typed.
+const completeCmd = "__complete"
+
+var completeFlags = flag.NewFlagSet(completeCmd, flag.ExitOnError)
+var completeRemote = completeFlags.Bool("remote", false,
+	"Complete paths in the cluster")
+
+var completionScripts = map[string]string{
+	"bash": `# bash completion for {{.Prog}}
+_{{.Func}}_complete() {
+	local line=${COMP_LINE:0:COMP_POINT} words
+	read -ra words <<< "$line"
+	[[ $line == *' ' ]] && words+=('')
+	local IFS=$'\n'
+	COMPREPLY=($({{.Prog}} {{.Complete}} -- "${words[@]:1}" 2>/dev/null))
+	if [[ ${#COMPREPLY[@]} -eq 1 && ${COMPREPLY[0]} == */ ]]; then
+		compopt -o nospace
+	fi
+}
+complete -o default -F _{{.Func}}_complete {{.Prog}}
+`,
+	"zsh": `#compdef {{.Prog}}
+_{{.Func}}() {
+	local -a found dirs others
+	local c
+	found=("${(@f)$({{.Prog}} {{.Complete}} -- "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+	for c in $found; do
+		if [[ -z $c ]]; then continue; fi
+		if [[ $c == */ ]]; then dirs+=$c; else others+=$c; fi
+	done
+	if (( ${#dirs} + ${#others} == 0 )); then
+		_files
+		return
+	fi
+	compadd -S '' -- $dirs
+	compadd -- $others
+}
+compdef _{{.Func}} {{.Prog}}
+`,
+	"fish": `# fish completion for {{.Prog}}
+function __{{.Func}}_complete
+	set -l args (commandline -opc)
+	set -e args[1]
+	{{.Prog}} {{.Complete}} -- $args (commandline -ct) 2>/dev/null
+end
+complete -c {{.Prog}} -a '(__{{.Func}}_complete)'
+`,
+}
+
+func completionCommand(u string, args []string) {
+	shell := completionFlags.Arg(0)
+	err := writeCompletion(os.Stdout, filepath.Base(os.Args[0]), shell,
+		*completionRemote)
+	MaybeFatal(err, "Error writing completion: %v", err)
+}
+
+// Write the completion script for a shell.
+func writeCompletion(w io.Writer, prog, shell string, remote bool) error {
+	text, ok := completionScripts[shell]
+	if !ok {
+		return fmt.Errorf("unknown shell %q (expected bash, zsh or fish)", shell)
+	}
+	complete := completeCmd
+	if remote {
+		complete += " -remote"
+	}
+	return template.Must(template.New("").Parse(text)).Execute(w,
+		map[string]string{
+			"Prog":     prog,
+			"Func":     strings.NewReplacer("-", "_", ".", "_").Replace(prog),
+			"Complete": complete,
+		})
+}
+
+// Print candidates for the last of the words after the program name.
+func completeWords(u string, commands map[string]Command, args []string) {
+	completeFlags.Parse(args)
+	words := completeFlags.Args()
+	if len(words) == 0 {
+		words = []string{""}
+	}
+
+	var remote func(string, string) []string
+	if *completeRemote {
+		remote = func(u, cur string) []string {
+			client, err := cbfsclient.New(u)
+			if err != nil {
+				log.Fatalf("Error creating client: %v", err)
+			}
+			return remotePaths(client.ListOrEmpty, cur)
+		}
+	}
+	for _, c := range complete(u, commands, remote, words) {
+		fmt.Println(c)
+	}
+}
+
+// Does flag -name (from an argument like -name or --name=x) need the
+// next argument as its value?
+func takesValue(fs *flag.FlagSet, arg string) bool {
+	name := strings.TrimLeft(arg, "-")
+	if strings.Contains(name, "=") {
+		return false
+	}
+	f := fs.Lookup(name)
+	if f == nil {
+		return false
+	}
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return !ok || !b.IsBoolFlag()
+}
+
+func flagNames(fs *flag.FlagSet, cur string) []string {
+	var rv []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if strings.HasPrefix("-"+f.Name, cur) {
+			rv = append(rv, "-"+f.Name)
+		}
+	})
+	return rv
+}
+
+// Candidates for the last word, given the ones before it.  Paths in
+// the cluster are found with remote, if it's given.
+func complete(u string, commands map[string]Command,
+	remote func(u, cur string) []string, words []string) []string {
+
+	cur := words[len(words)-1]
+	words = words[:len(words)-1]
+
+	i := 0
+	for i < len(words) && strings.HasPrefix(words[i], "-") {
+		if takesValue(flag.CommandLine, words[i]) {
+			i++
+		}
+		i++
+	}
+	if i < len(words) && (strings.HasPrefix(words[i], "http://") ||
+		strings.HasPrefix(words[i], "https://")) {
+		u = words[i]
+		i++
+	}
+
+	if i >= len(words) {
+		if strings.HasPrefix(cur, "-") {
+			return flagNames(flag.CommandLine, cur)
+		}
+		var rv []string
+		for name := range commands {
+			if strings.HasPrefix(name, cur) {
+				rv = append(rv, name)
+			}
+		}
+		sort.Strings(rv)
+		return rv
+	}
+
+	name := words[i]
+	cmd, ok := commands[name]
+	if !ok {
+		return nil
+	}
+	// Flags are only parsed until the first other argument.
+	pos, flagsDone := 0, false
+	args := words[i+1:]
+	for j := 0; j < len(args); j++ {
+		if !flagsDone && cmd.Flags != nil && strings.HasPrefix(args[j], "-") {
+			if takesValue(cmd.Flags, args[j]) {
+				j++
+			}
+			continue
+		}
+		flagsDone = true
+		pos++
+	}
+
+	if !flagsDone && cmd.Flags != nil && strings.HasPrefix(cur, "-") {
+		return flagNames(cmd.Flags, cur)
+	}
+	if remote == nil {
+		return nil
+	}
+	for _, p := range RemoteArgs[name] {
+		if p == pos || p == -1 {
+			return remote(u, cur)
+		}
+	}
+	return nil
+}
+
+// Files and directories in the cluster starting with cur.
+func remotePaths(list func(string) (cbfsclient.ListResult, error),
+	cur string) []string {
+
+	dir, base := "", cur
+	if i := strings.LastIndex(cur, "/"); i >= 0 {
+		dir, base = cur[:i+1], cur[i+1:]
+	}
+	l, err := list(dir)
+	if err != nil {
+		return nil
+	}
+	var rv []string
+	for name := range l.Dirs {
+		if strings.HasPrefix(name, base) {
+			rv = append(rv, dir+name+"/")
+		}
+	}
+	for name := range l.Files {
+		if strings.HasPrefix(name, base) {
+			rv = append(rv, dir+name)
+		}
+	}
+	sort.Strings(rv)
+	return rv
+}
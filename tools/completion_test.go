@@ -0,0 +1,96 @@
+package cbfstool
+
+import (
+	"bytes"
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/cbfs/client"
+)
+
+func TestComplete(t *testing.T) {
+	getFlags := flag.NewFlagSet("get", flag.ContinueOnError)
+	getFlags.Bool("v", false, "")
+	getFlags.Int("workers", 4, "")
+	commands := map[string]Command{
+		"get":  {1, nil, "path", getFlags},
+		"gc":   {0, nil, "", nil},
+		"info": {0, nil, "", nil},
+	}
+	defer func(m map[string][]int) { RemoteArgs = m }(RemoteArgs)
+	RemoteArgs = map[string][]int{"get": {0}}
+
+	var asked []string
+	remote := func(u, cur string) []string {
+		asked = append(asked, u+" "+cur)
+		return []string{cur + "x"}
+	}
+
+	tests := []struct {
+		words []string
+		exp   []string
+	}{
+		{[]string{"g"}, []string{"gc", "get"}},
+		{[]string{"http://other:8484/", "i"}, []string{"info"}},
+		{[]string{"get", "-w"}, []string{"-workers"}},
+		{[]string{"get", "a"}, []string{"ax"}},
+		{[]string{"get", "-workers", "3", "-v", "b"}, []string{"bx"}},
+		{[]string{"http://other:8484/", "get", "c"}, []string{"cx"}},
+		{[]string{"get", "a", ""}, nil},
+		{[]string{"get", "a", "-v"}, nil},
+		{[]string{"gc", "d"}, nil},
+		{[]string{"nope", "e"}, nil},
+	}
+	for _, test := range tests {
+		got := complete("http://cbfs:8484/", commands, remote, test.words)
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("Expected %q to complete to %q, got %q",
+				test.words, test.exp, got)
+		}
+	}
+
+	exp := []string{"http://cbfs:8484/ a", "http://cbfs:8484/ b",
+		"http://other:8484/ c"}
+	if !reflect.DeepEqual(asked, exp) {
+		t.Errorf("Expected lookups %q, got %q", exp, asked)
+	}
+
+	if got := complete("", commands, nil, []string{"get", "a"}); got != nil {
+		t.Errorf("Expected no remote completion without remote, got %q", got)
+	}
+}
+
+func TestRemotePaths(t *testing.T) {
+	list := func(dir string) (cbfsclient.ListResult, error) {
+		if dir != "/docs/" {
+			return cbfsclient.ListResult{}, nil
+		}
+		return cbfsclient.ListResult{
+			Dirs:  map[string]cbfsclient.Dir{"old": {}},
+			Files: map[string]cbfsclient.FileMeta{"a.txt": {}, "other": {}},
+		}, nil
+	}
+	got := remotePaths(list, "/docs/o")
+	exp := []string{"/docs/old/", "/docs/other"}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %q, got %q", exp, got)
+	}
+}
+
+func TestWriteCompletion(t *testing.T) {
+	for _, shell := range []string{"bash", "zsh", "fish"} {
+		buf := &bytes.Buffer{}
+		if err := writeCompletion(buf, "cbfs-client", shell, true); err != nil {
+			t.Fatalf("Error writing %v completion: %v", shell, err)
+		}
+		if !strings.Contains(buf.String(), "cbfs-client __complete -remote --") ||
+			!strings.Contains(buf.String(), "cbfs_client") {
+			t.Errorf("Unexpected %v completion:\n%s", shell, buf)
+		}
+	}
+	if err := writeCompletion(&bytes.Buffer{}, "cbfsclient", "csh", false); err == nil {
+		t.Errorf("Expected an error for an unknown shell")
+	}
+}
@@ -0,0 +1,62 @@
+package cbfstool
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Exit status of a command stopped by Ctrl-C, as a shell reports it.
+const ExitInterrupted = 130
+
+var toolCtx = context.Background()
+
+// Done once the user interrupts the command.  Long-running commands
+// stop starting new work when it is, and requests in flight through
+// http.DefaultClient are cancelled.
+func Context() context.Context {
+	return toolCtx
+}
+
+// Has the user interrupted the command?
+func Interrupted() bool {
+	return toolCtx.Err() != nil
+}
+
+// Cancel Context on the first SIGINT or SIGTERM, letting commands
+// wind down and summarize.  A second one exits right away.
+func handleInterrupts() {
+	ctx, cancel := context.WithCancel(context.Background())
+	toolCtx = ctx
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		log.Printf("Interrupted, stopping (interrupt again to quit now)")
+		cancel()
+		<-sigs
+		os.Exit(ExitInterrupted)
+	}()
+
+	base := http.DefaultClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	http.DefaultClient.Transport = &cancelTransport{base}
+}
+
+// Ties requests that can't otherwise be cancelled to Context.
+type cancelTransport struct {
+	base http.RoundTripper
+}
+
+func (t *cancelTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Context().Done() == nil {
+		req = req.WithContext(toolCtx)
+	}
+	return t.base.RoundTrip(req)
+}
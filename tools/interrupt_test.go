@@ -0,0 +1,46 @@
+package cbfstool
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestCancelTransport(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func(old context.Context) { toolCtx = old }(toolCtx)
+	toolCtx = ctx
+
+	var got context.Context
+	ct := &cancelTransport{roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		got = req.Context()
+		return nil, nil
+	})}
+
+	req, _ := http.NewRequest("GET", "http://cbfs:8484/x", nil)
+	ct.RoundTrip(req)
+	if got != ctx {
+		t.Errorf("Expected the tool context on a plain request")
+	}
+
+	own, stop := context.WithCancel(context.Background())
+	defer stop()
+	ct.RoundTrip(req.WithContext(own))
+	if got != own {
+		t.Errorf("Expected a request's own context to be kept")
+	}
+
+	if Interrupted() {
+		t.Errorf("Interrupted before cancel")
+	}
+	cancel()
+	if !Interrupted() {
+		t.Errorf("Not interrupted after cancel")
+	}
+}
@@ -0,0 +1,133 @@
+package cbfstool
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// A rate limit given on the command line, either in bytes per second
+// ("10MB", "512k") or requests per second ("20r").
+type Rate struct {
+	N        float64
+	Requests bool
+}
+
+func (r *Rate) Set(s string) error {
+	if strings.HasSuffix(s, "r") {
+		n, err := strconv.ParseFloat(s[:len(s)-1], 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid request rate: %q", s)
+		}
+		*r = Rate{n, true}
+		return nil
+	}
+	n, err := humanize.ParseBytes(s)
+	if err != nil || n == 0 {
+		return fmt.Errorf("invalid byte rate: %q", s)
+	}
+	*r = Rate{float64(n), false}
+	return nil
+}
+
+func (r Rate) String() string {
+	switch {
+	case r.N == 0:
+		return ""
+	case r.Requests:
+		return strconv.FormatFloat(r.N, 'g', -1, 64) + "r"
+	}
+	return humanize.Bytes(uint64(r.N))
+}
+
+// A token bucket.  Takes may overdraw it, in which case the taker
+// waits until it's paid back, so a single take larger than the bucket
+// still goes through.
+type Limiter struct {
+	rate   float64
+	burst  float64
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// Make a limiter allowing rate per second, with room for burst at
+// once.  A burst of zero allows one second's worth.
+func NewLimiter(rate float64, burst int) *Limiter {
+	b := float64(burst)
+	if b <= 0 {
+		b = rate
+	}
+	return &Limiter{rate: rate, burst: b, tokens: b, last: time.Now()}
+}
+
+// Take n tokens, waiting as long as it takes for them to be
+// available.
+func (l *Limiter) Wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	debt := -l.tokens
+	l.mu.Unlock()
+
+	if debt > 0 {
+		time.Sleep(time.Duration(debt / l.rate * float64(time.Second)))
+	}
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	l *Limiter
+}
+
+func (b limitedBody) Read(p []byte) (int, error) {
+	if len(p) > 32*1024 {
+		p = p[:32*1024]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.l.Wait(n)
+	return n, err
+}
+
+type limitTransport struct {
+	l        *Limiter
+	requests bool
+	base     http.RoundTripper
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.requests {
+		t.l.Wait(1)
+	} else if req.Body != nil {
+		r := *req
+		r.Body = limitedBody{req.Body, t.l}
+		req = &r
+	}
+	return t.base.RoundTrip(req)
+}
+
+// Hold all requests made through http.DefaultClient to the given
+// rate, shared among every goroutine making them.  Byte rates count
+// request bodies sent.  A zero rate leaves things unlimited.
+func LimitRate(rate Rate, burst int) {
+	if rate.N <= 0 {
+		return
+	}
+	base := http.DefaultClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	http.DefaultClient.Transport = &limitTransport{
+		NewLimiter(rate.N, burst), rate.Requests, base}
+}
@@ -0,0 +1,42 @@
+package cbfstool
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateSet(t *testing.T) {
+	tests := []struct {
+		in  string
+		exp Rate
+		ok  bool
+	}{
+		{"20r", Rate{20, true}, true},
+		{"2.5r", Rate{2.5, true}, true},
+		{"0r", Rate{}, false},
+		{"r", Rate{}, false},
+		{"lots", Rate{}, false},
+	}
+
+	for _, test := range tests {
+		var r Rate
+		err := r.Set(test.in)
+		if (err == nil) != test.ok || (test.ok && r != test.exp) {
+			t.Errorf("Expected %v (ok=%v) for %q, got %v (%v)",
+				test.exp, test.ok, test.in, r, err)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(100, 10)
+
+	start := time.Now()
+	// The first ten are in the bucket, the next ten take 100ms.
+	for i := 0; i < 20; i++ {
+		l.Wait(1)
+	}
+	if d := time.Since(start); d < 80*time.Millisecond {
+		t.Errorf("Expected at least 80ms, took %v", d)
+	}
+}
@@ -0,0 +1,125 @@
+package cbfstool
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+// A named cluster in the client config file, so its URL and
+// secrets needn't be given on every command line.
+type Profile struct {
+	URL   string `yaml:"url"`
+	Token string `yaml:"token"`
+	// PEM file of CAs to trust for https URLs
+	CACert string `yaml:"cacert"`
+	// PEM files of a client certificate and its key
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// Don't check the nodes' certificates
+	Insecure bool `yaml:"insecure"`
+	// Flags to use by default, by command name
+	Flags map[string][]string `yaml:"flags"`
+}
+
+// The client config file, e.g.:
+//
+//	default: prod
+//	profiles:
+//	  prod:
+//	    url: https://cbfs.example.com:8484/
+//	    token: 5e1b...
+//	    cacert: /etc/cbfs/ca.pem
+//	    flags:
+//	      upload: [-workers, "8"]
+type profileFile struct {
+	Default  string             `yaml:"default"`
+	Profiles map[string]Profile `yaml:"profiles"`
+}
+
+// Where the client config file is: $CBFS_CONFIG or
+// ~/.cbfsclient.yaml.
+func profilePath() string {
+	if p := os.Getenv("CBFS_CONFIG"); p != "" {
+		return p
+	}
+	return filepath.Join(os.Getenv("HOME"), ".cbfsclient.yaml")
+}
+
+// Load the named profile from the config file at path, or its
+// default profile if name is empty.  With neither, or no file, the
+// profile is empty.
+func LoadProfile(path, name string) (Profile, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && name == "" {
+		return Profile{}, nil
+	}
+	if err != nil {
+		return Profile{}, err
+	}
+	pf := profileFile{}
+	if err := yaml.Unmarshal(data, &pf); err != nil {
+		return Profile{}, fmt.Errorf("%v: %v", path, err)
+	}
+	if name == "" {
+		name = pf.Default
+	}
+	if name == "" {
+		return Profile{}, nil
+	}
+	p, ok := pf.Profiles[name]
+	if !ok {
+		return Profile{}, fmt.Errorf("no profile %q in %v", name, path)
+	}
+	return p, nil
+}
+
+// TLS settings for talking to the profile's cluster, or nil if it
+// has none.
+func (p Profile) TLSConfig() (*tls.Config, error) {
+	if p.CACert == "" && p.Cert == "" && !p.Insecure {
+		return nil, nil
+	}
+	conf := &tls.Config{InsecureSkipVerify: p.Insecure}
+	if p.CACert != "" {
+		pem, err := ioutil.ReadFile(p.CACert)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v", p.CACert)
+		}
+	}
+	if p.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(p.Cert, p.Key)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+// Use the profile's TLS settings for requests made through
+// http.DefaultTransport.
+func (p Profile) useTLS() error {
+	conf, err := p.TLSConfig()
+	if err != nil || conf == nil {
+		return err
+	}
+	t, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("can't set TLS options on %T", http.DefaultTransport)
+	}
+	t = t.Clone()
+	t.TLSClientConfig = conf
+	http.DefaultTransport = t
+	return nil
+}
@@ -0,0 +1,67 @@
+package cbfstool
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testProfiles = `
+default: prod
+profiles:
+  prod:
+    url: https://cbfs.example.com:8484/
+    token: sekrit
+    flags:
+      upload: [-workers, "8"]
+  dev:
+    url: http://localhost:8484/
+    insecure: true
+`
+
+func TestLoadProfile(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "profiletest")
+	if err != nil {
+		t.Fatalf("Error making tmp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	fn := filepath.Join(tmpdir, "cbfsclient.yaml")
+	if err := ioutil.WriteFile(fn, []byte(testProfiles), 0600); err != nil {
+		t.Fatalf("Error writing profiles: %v", err)
+	}
+
+	p, err := LoadProfile(fn, "")
+	exp := Profile{
+		URL:   "https://cbfs.example.com:8484/",
+		Token: "sekrit",
+		Flags: map[string][]string{"upload": {"-workers", "8"}},
+	}
+	if err != nil || !reflect.DeepEqual(p, exp) {
+		t.Errorf("Expected the default profile %+v, got %+v, %v", exp, p, err)
+	}
+	if conf, err := p.TLSConfig(); conf != nil || err != nil {
+		t.Errorf("Expected no TLS settings, got %v, %v", conf, err)
+	}
+
+	p, err = LoadProfile(fn, "dev")
+	if err != nil || p.URL != "http://localhost:8484/" || !p.Insecure {
+		t.Errorf("Expected the dev profile, got %+v, %v", p, err)
+	}
+	if conf, err := p.TLSConfig(); err != nil || !conf.InsecureSkipVerify {
+		t.Errorf("Expected to skip verification, got %v, %v", conf, err)
+	}
+
+	if _, err := LoadProfile(fn, "nope"); err == nil {
+		t.Errorf("Expected an error for a missing profile")
+	}
+
+	missing := filepath.Join(tmpdir, "missing.yaml")
+	if p, err := LoadProfile(missing, ""); err != nil || p.URL != "" {
+		t.Errorf("Expected an empty profile without a file, got %+v, %v", p, err)
+	}
+	if _, err := LoadProfile(missing, "prod"); err == nil {
+		t.Errorf("Expected an error asking for a profile without a file")
+	}
+}
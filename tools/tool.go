@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
@@ -16,6 +17,8 @@ import (
 	"text/template"
 	"time"
 
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/dustin/go-humanize"
 	"github.com/dustin/httputil"
 )
 
@@ -23,6 +26,10 @@ func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
+// Set by the global -json flag: commands print JSON for scripts
+// rather than text for people.
+var JSON bool
+
 type Command struct {
 	Nargs  int
 	F      func(url string, args []string)
@@ -42,7 +49,7 @@ func (c Command) Usage(name string) {
 func setUsage(commands map[string]Command) {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr,
-			"Usage:\n  %s [http://cbfs:8484/] cmd [-opts] cmdargs\n",
+			"Usage:\n  %s [-json] [-profile name] [http://cbfs:8484/] cmd [-opts] cmdargs\n",
 			os.Args[0])
 
 		fmt.Fprintf(os.Stderr, "\nCommands:\n")
@@ -91,6 +98,9 @@ func GetTemplate(ttext, filename, tdefault string) *template.Template {
 		"join": func(o string, s []string) string {
 			return strings.Join(s, o)
 		},
+		"bytes": func(n int64) string {
+			return humanize.Bytes(uint64(n))
+		},
 	}).Parse(tmplstr)
 	MaybeFatal(err, "Error parsing template: %v", err)
 	return tmpl
@@ -110,8 +120,30 @@ func GetJsonData(u string, into interface{}) error {
 	return d.Decode(into)
 }
 
+// Where PrintJSON and PrintJSONLine write.
+var jsonOut io.Writer = os.Stdout
+
+// Print a command's result as one JSON document.
+func PrintJSON(v interface{}) {
+	e := json.NewEncoder(jsonOut)
+	e.SetIndent("", "  ")
+	err := e.Encode(v)
+	MaybeFatal(err, "Error writing JSON: %v", err)
+}
+
+// Print one of a stream of results as a line of JSON, so a command
+// listing things writes NDJSON.
+func PrintJSONLine(v interface{}) {
+	err := json.NewEncoder(jsonOut).Encode(v)
+	MaybeFatal(err, "Error writing JSON: %v", err)
+}
+
 func MaybeFatal(err error, msg string, args ...interface{}) {
 	if err != nil {
+		if Interrupted() {
+			log.Printf(msg, args...)
+			os.Exit(ExitInterrupted)
+		}
 		log.Fatalf(msg, args...)
 	}
 }
@@ -131,7 +163,13 @@ func ParseURL(ustr string) *url.URL {
 func ToolMain(commands map[string]Command) {
 	log.SetFlags(log.Lmicroseconds)
 
+	commands["completion"] = Command{1, completionCommand,
+		"bash|zsh|fish", completionFlags}
 	setUsage(commands)
+	flag.BoolVar(&JSON, "json", false,
+		"Print JSON rather than text (one object per line for lists)")
+	profileName := flag.String("profile", os.Getenv("CBFS_PROFILE"),
+		"Cluster profile from "+profilePath()+" to use")
 
 	flag.Parse()
 
@@ -139,15 +177,36 @@ func ToolMain(commands map[string]Command) {
 		flag.Usage()
 	}
 
+	profile, err := LoadProfile(profilePath(), *profileName)
+	MaybeFatal(err, "Error loading profile: %v", err)
+	err = profile.useTLS()
+	MaybeFatal(err, "Error setting up TLS: %v", err)
+	handleInterrupts()
+
 	off := 0
 	u := "http://cbfs:8484/"
-
-	if strings.HasPrefix(flag.Arg(0), "http://") {
+	switch {
+	case strings.HasPrefix(flag.Arg(0), "http://") ||
+		strings.HasPrefix(flag.Arg(0), "https://"):
 		u = flag.Arg(0)
 		off++
+	case os.Getenv("CBFS_URL") != "":
+		u = os.Getenv("CBFS_URL")
+	case profile.URL != "":
+		u = profile.URL
 	}
 
+	token := cbfsclient.TokenFromEnv()
+	if profile.Token != "" && os.Getenv("CBFS_TOKEN") == "" {
+		token = profile.Token
+	}
+	cbfsclient.UseToken(token, u)
+
 	cmdName := flag.Arg(off)
+	if cmdName == completeCmd {
+		completeWords(u, commands, flag.Args()[off+1:])
+		return
+	}
 	cmd, ok := commands[cmdName]
 	if !ok {
 		fmt.Fprintf(os.Stderr, "Unknown command: %v\n", cmdName)
@@ -157,7 +216,10 @@ func ToolMain(commands map[string]Command) {
 	args := flag.Args()[off+1:]
 	nargs := len(args)
 	if cmd.Flags != nil {
-		cmd.Flags.Parse(args)
+		// The profile's defaults come first so the command line
+		// overrides them.
+		cmd.Flags.Parse(append(append([]string{}, profile.Flags[cmdName]...),
+			args...))
 		nargs = cmd.Flags.NArg()
 	}
 
@@ -0,0 +1,25 @@
+package cbfstool
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestPrintJSON(t *testing.T) {
+	defer func(w io.Writer) { jsonOut = w }(jsonOut)
+	buf := &bytes.Buffer{}
+	jsonOut = buf
+
+	PrintJSONLine(map[string]int{"a": 1})
+	PrintJSONLine(map[string]int{"b": 2})
+	if exp := "{\"a\":1}\n{\"b\":2}\n"; buf.String() != exp {
+		t.Errorf("Expected %q, got %q", exp, buf)
+	}
+
+	buf.Reset()
+	PrintJSON(map[string]int{"a": 1})
+	if exp := "{\n  \"a\": 1\n}\n"; buf.String() != exp {
+		t.Errorf("Expected %q, got %q", exp, buf)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+)
+
+var otlpEndpoint = flag.String("otlpEndpoint", "",
+	"OpenTelemetry collector (host:port) to send traces to over OTLP/HTTP "+
+		"(needs -tags otel)")
+
+// What the server needs from a distributed tracing implementation.
+// Spans are carried between nodes in W3C traceparent headers.
+type tracer interface {
+	// Begin a span for a request being served, continuing the
+	// caller's trace if it sent one.
+	serverSpan(req *http.Request, name string) (context.Context, func(status int))
+	// Begin a span for a request to another node, adding the headers
+	// the node continues the trace from.
+	clientSpan(ctx context.Context, req *http.Request) func(status int, err error)
+	// Begin a span for a metadata operation.
+	dbSpan(ctx context.Context, op, key string) func(err error)
+}
+
+// Set by initTracing when built with -tags otel and given
+// -otlpEndpoint.
+var tracing tracer
+
+// Begin a span for a metadata operation made serving req.  The
+// returned function ends it.
+func traceDB(req *http.Request, op, key string) func(error) {
+	if tracing == nil {
+		return func(error) {}
+	}
+	return tracing.dbSpan(req.Context(), op, key)
+}
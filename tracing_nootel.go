@@ -0,0 +1,11 @@
+// +build !otel
+
+package main
+
+import "log"
+
+func initTracing() {
+	if *otlpEndpoint != "" {
+		log.Fatalf("-otlpEndpoint needs cbfs built with -tags otel")
+	}
+}
@@ -0,0 +1,106 @@
+// +build otel
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type otelTracer struct {
+	t trace.Tracer
+	p propagation.TextMapPropagator
+}
+
+func initTracing() {
+	if *otlpEndpoint == "" {
+		return
+	}
+	exp, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpoint(*otlpEndpoint),
+		otlptracehttp.WithInsecure())
+	if err != nil {
+		log.Fatalf("Error setting up trace exporter: %v", err)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "cbfs"),
+			attribute.String("cbfs.node", serverId))))
+	p := propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{})
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(p)
+
+	tracing = otelTracer{tp.Tracer("github.com/couchbaselabs/cbfs"), p}
+	log.Printf("Sending traces to %v", *otlpEndpoint)
+}
+
+func (o otelTracer) serverSpan(req *http.Request,
+	name string) (context.Context, func(int)) {
+
+	ctx := o.p.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	ctx, span := o.t.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.method", req.Method),
+			attribute.String("http.target", req.URL.Path),
+			attribute.String("cbfs.request_id", req.Header.Get(requestIDHeader))))
+	return ctx, func(status int) {
+		span.SetAttributes(attribute.Int("http.status_code", status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		span.End()
+	}
+}
+
+func (o otelTracer) clientSpan(ctx context.Context,
+	req *http.Request) func(int, error) {
+
+	ctx, span := o.t.Start(ctx, endpointName(req),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("net.peer.name", req.URL.Host),
+			attribute.String("http.method", req.Method),
+			attribute.String("http.target", req.URL.Path)))
+	o.p.Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return func(status int, err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		} else {
+			span.SetAttributes(attribute.Int("http.status_code", status))
+			if status >= 500 {
+				span.SetStatus(codes.Error, http.StatusText(status))
+			}
+		}
+		span.End()
+	}
+}
+
+func (o otelTracer) dbSpan(ctx context.Context, op, key string) func(error) {
+	_, span := o.t.Start(ctx, "couchbase "+op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "couchbase"),
+			attribute.String("db.operation", op),
+			attribute.String("cbfs.key", key)))
+	return func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
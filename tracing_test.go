@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+type spanKey struct{}
+
+// Records spans as "kind name status", with each span's context
+// naming it so children can be checked.
+type fakeTracer struct {
+	spans []string
+}
+
+func (f *fakeTracer) serverSpan(req *http.Request,
+	name string) (context.Context, func(int)) {
+
+	ctx := context.WithValue(req.Context(), spanKey{}, name)
+	return ctx, func(status int) {
+		f.spans = append(f.spans, "server "+name+" "+http.StatusText(status))
+	}
+}
+
+func (f *fakeTracer) clientSpan(ctx context.Context,
+	req *http.Request) func(int, error) {
+
+	req.Header.Set("traceparent", ctx.Value(spanKey{}).(string))
+	return func(status int, err error) {
+		f.spans = append(f.spans, "client "+req.URL.Host+" "+http.StatusText(status))
+	}
+}
+
+func (f *fakeTracer) dbSpan(ctx context.Context, op, key string) func(error) {
+	parent, _ := ctx.Value(spanKey{}).(string)
+	return func(err error) {
+		f.spans = append(f.spans, "db "+op+" "+key+" under "+parent+": "+err.Error())
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestTracing(t *testing.T) {
+	if done := traceDB(httptest.NewRequest("GET", "/x", nil), "get", "x"); done == nil {
+		t.Fatalf("Expected traceDB to work without a tracer")
+	}
+
+	ft := &fakeTracer{}
+	defer func(tr tracer) { tracing = tr }(tracing)
+	tracing = ft
+
+	var sent http.Header
+	rt := hopTransport{roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		sent = req.Header
+		return &http.Response{StatusCode: 206}, nil
+	})}
+	var preq *http.Request
+	h := instrumentHandler(func(w http.ResponseWriter, req *http.Request) {
+		traceDB(req, "get", "/some/file")(errors.New("not found"))
+		preq, _ = http.NewRequest("GET", "http://other:8484/.cbfs/blob/abc", nil)
+		preq.Header.Set(requestIDHeader, req.Header.Get(requestIDHeader))
+		rt.RoundTrip(preq)
+		w.WriteHeader(404)
+	})
+	h(httptest.NewRecorder(), httptest.NewRequest("GET", "/some/file", nil))
+
+	exp := []string{
+		"db get /some/file under GET file: not found",
+		"client other:8484 Partial Content",
+		"server GET file Not Found",
+	}
+	if !reflect.DeepEqual(ft.spans, exp) {
+		t.Errorf("Expected spans %q, got %q", exp, ft.spans)
+	}
+	if sent.Get("traceparent") != "GET file" {
+		t.Errorf("Expected the trace to be sent to the other node, got %v", sent)
+	}
+	if preq.Header.Get("traceparent") != "" {
+		t.Errorf("Expected the original request to be left alone, got %v",
+			preq.Header)
+	}
+}
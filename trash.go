@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+	cb "github.com/couchbaselabs/go-couchbase"
+)
+
+const trashKeyPrefix = "/@trash/"
+
+var errNoSuchTrash = errors.New("not in the trash")
+
+// A deleted file, kept until the trash retention runs out.  Its blobs
+// are referenced from here (via the file_blobs view) so they aren't
+// collected in the meantime.
+type trashEntry struct {
+	ID      string    `json:"id"`
+	Type    string    `json:"type"`
+	Path    string    `json:"path"`
+	Deleted time.Time `json:"deleted"`
+	Meta    fileMeta  `json:"meta"`
+}
+
+// A file couldn't be kept in the trash, so it wasn't deleted.
+type trashError struct {
+	err error
+}
+
+func (t trashError) Error() string {
+	return "error moving to trash: " + t.err.Error()
+}
+
+func trashExpiration() int {
+	d := globalConfig.TrashRetention
+	if d > time.Hour*24*30 {
+		return int(time.Now().Add(d).Unix())
+	}
+	return int(d.Seconds())
+}
+
+// The same deletion of the same file always gets the same ID, so a
+// retried delete doesn't leave copies in the trash.
+func trashID(path string, fm fileMeta) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%d", path, fm.OID, fm.Modified.UnixNano())
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Keep a file that's being deleted in the trash, if there is one.
+func moveToTrash(path string, fm fileMeta) error {
+	if globalConfig.TrashRetention <= 0 || fm.Type != "file" {
+		return nil
+	}
+	te := trashEntry{
+		ID:      trashID(path, fm),
+		Type:    "trash",
+		Path:    path,
+		Deleted: time.Now().UTC(),
+		Meta:    fm,
+	}
+	err := couchbase.Set(trashKeyPrefix+te.ID, trashExpiration(), &te)
+	if err != nil {
+		return trashError{err}
+	}
+	return nil
+}
+
+// Delete the file at k, keeping it in the trash if that's enabled.
+// Locked files are left alone.
+func deleteFile(k string) (fileMeta, error) {
+	fm := fileMeta{}
+	err := couchbase.Update(k, 0, func(in []byte) ([]byte, error) {
+		fm = fileMeta{}
+		if json.Unmarshal(in, &fm) == nil {
+			path := eventPath(k, fm)
+			if err := checkRetention(path, fm, time.Now()); err != nil {
+				return in, err
+			}
+			if err := moveToTrash(path, fm); err != nil {
+				return in, err
+			}
+		}
+		return nil, nil
+	})
+	return fm, err
+}
+
+func getTrashEntry(id string) (trashEntry, error) {
+	te := trashEntry{}
+	err := couchbase.Get(trashKeyPrefix+id, &te)
+	if gomemcached.IsNotFound(err) || (err == nil && te.Type != "trash") {
+		err = errNoSuchTrash
+	}
+	return te, err
+}
+
+// Is path prefix itself or under it?  abc isn't under a.
+func underTrashPrefix(path, prefix string) bool {
+	p := strings.Trim(prefix, "/")
+	return p == "" || path == p || strings.HasPrefix(path, p+"/")
+}
+
+// Everything in the trash that was deleted from under prefix, most
+// recently deleted first.
+func listTrash(prefix string) ([]trashEntry, error) {
+	viewRes := struct {
+		Rows []struct {
+			ID  string
+			Key string
+		}
+		Errors []cb.ViewError
+	}{}
+	err := couchbase.ViewCustom("cbfs", "trash",
+		map[string]interface{}{
+			"stale":    false,
+			"startkey": prefix,
+			"endkey":   prefix + "\ufff0",
+		}, &viewRes)
+	if err != nil {
+		return nil, err
+	}
+	if len(viewRes.Errors) > 0 {
+		return nil, fmt.Errorf("View errors: %v", viewRes.Errors)
+	}
+
+	keys := []string{}
+	for _, r := range viewRes.Rows {
+		// The view range also takes in siblings like abc for a.
+		if underTrashPrefix(r.Key, prefix) {
+			keys = append(keys, r.ID)
+		}
+	}
+	res, err := couchbase.GetBulk(keys)
+	if err != nil {
+		return nil, err
+	}
+	rv := []trashEntry{}
+	for _, k := range keys {
+		v, ok := res[k]
+		if !ok || v.Status != gomemcached.SUCCESS {
+			// Expired since the view saw it.
+			continue
+		}
+		te := trashEntry{}
+		if err := json.Unmarshal(v.Body, &te); err != nil {
+			return nil, err
+		}
+		rv = append(rv, te)
+	}
+	sort.Sort(trashByDeleted(rv))
+	return rv, nil
+}
+
+// Most recently deleted first.
+type trashByDeleted []trashEntry
+
+func (t trashByDeleted) Len() int           { return len(t) }
+func (t trashByDeleted) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t trashByDeleted) Less(i, j int) bool { return t[i].Deleted.After(t[j].Deleted) }
+
+// Find the entry a restore or purge of one file means: the one with
+// the given ID, or the most recent deletion of the path.
+func findTrashEntry(path, id string) (trashEntry, error) {
+	if id != "" {
+		te, err := getTrashEntry(id)
+		if err == nil && te.Path != path {
+			err = errNoSuchTrash
+		}
+		return te, err
+	}
+	entries, err := listTrash(path)
+	if err != nil {
+		return trashEntry{}, err
+	}
+	for _, te := range entries {
+		if te.Path == path {
+			return te, nil
+		}
+	}
+	return trashEntry{}, errNoSuchTrash
+}
+
+func sendTrashError(w http.ResponseWriter, err error) {
+	if err == errNoSuchTrash {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	http.Error(w, err.Error(), 500)
+}
+
+// GET /.cbfs/trash/<prefix> lists what was deleted from under prefix.
+func doListTrash(w http.ResponseWriter, req *http.Request, prefix string) {
+	entries, err := listTrash(strings.TrimLeft(prefix, "/"))
+	if err != nil {
+		sendTrashError(w, err)
+		return
+	}
+	sendJson(w, req, map[string]interface{}{
+		"retention": globalConfig.TrashRetention.String(),
+		"entries":   entries,
+	})
+}
+
+// POST /.cbfs/trash/<path>?id=...&to=... puts a deleted file back,
+// at its old path unless to is given.  Without an id, the most
+// recent deletion of path is restored.  An existing file isn't
+// replaced unless overwrite=true.
+func doRestoreTrash(w http.ResponseWriter, req *http.Request, path string) {
+	path = strings.TrimLeft(path, "/")
+	te, err := findTrashEntry(path, req.FormValue("id"))
+	if err != nil {
+		sendTrashError(w, err)
+		return
+	}
+
+	dest := te.Path
+	if to := strings.TrimLeft(req.FormValue("to"), "/"); to != "" {
+		dest = to
+	}
+	hdr := http.Header{}
+	if req.FormValue("overwrite") != "true" {
+		hdr.Set("If-None-Match", "*")
+	}
+
+	fm := te.Meta
+	fm.Name = ""
+	err = storeMeta(dest, 0, fm, globalConfig.DefaultVersionCount, hdr)
+	if httpQuotaError(w, dest, err) || httpRetentionError(w, dest, err) {
+		return
+	}
+	switch err {
+	case nil:
+	case errUploadPrecondition:
+		http.Error(w, "a file exists at "+dest, 409)
+		return
+	default:
+		http.Error(w, fmt.Sprintf("Error restoring %v: %v", dest, err), 500)
+		return
+	}
+
+	if err := couchbase.Delete(trashKeyPrefix + te.ID); err != nil {
+		log.Printf("Error removing restored %v from the trash: %v", te.ID, err)
+	}
+	log.Printf("Restored %v from the trash to %v", te.Path, dest)
+	w.Header().Set("Etag", fileETag(fm.OID))
+	w.WriteHeader(201)
+}
+
+// DELETE /.cbfs/trash/<prefix> empties the trash of everything
+// deleted from under prefix, or with an id, just that entry.
+func doPurgeTrash(w http.ResponseWriter, req *http.Request, prefix string) {
+	prefix = strings.TrimLeft(prefix, "/")
+	var entries []trashEntry
+	if id := req.FormValue("id"); id != "" {
+		te, err := findTrashEntry(prefix, id)
+		if err != nil {
+			sendTrashError(w, err)
+			return
+		}
+		entries = []trashEntry{te}
+	} else {
+		var err error
+		if entries, err = listTrash(prefix); err != nil {
+			sendTrashError(w, err)
+			return
+		}
+	}
+
+	purged := 0
+	for _, te := range entries {
+		err := couchbase.Delete(trashKeyPrefix + te.ID)
+		switch {
+		case err == nil:
+			purged++
+		case !gomemcached.IsNotFound(err):
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+	log.Printf("Purged %v files from the trash under %q", purged, prefix)
+	sendJson(w, req, map[string]interface{}{"purged": purged})
+}
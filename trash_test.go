@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestTrashID(t *testing.T) {
+	now := time.Now()
+	fm := fileMeta{OID: "abc", Modified: now}
+
+	if trashID("a/b", fm) != trashID("a/b", fm) {
+		t.Errorf("Expected the same ID for the same deletion")
+	}
+	later := fileMeta{OID: "abc", Modified: now.Add(time.Second)}
+	for _, id := range []string{trashID("a/c", fm), trashID("a/b", later),
+		trashID("a/b", fileMeta{OID: "def", Modified: now})} {
+		if id == trashID("a/b", fm) {
+			t.Errorf("Expected a different ID for a different deletion")
+		}
+	}
+}
+
+func TestTrashByDeleted(t *testing.T) {
+	now := time.Now()
+	entries := []trashEntry{
+		{ID: "b", Deleted: now.Add(-time.Hour)},
+		{ID: "a", Deleted: now},
+		{ID: "c", Deleted: now.Add(-2 * time.Hour)},
+	}
+	sort.Sort(trashByDeleted(entries))
+	for i, exp := range []string{"a", "b", "c"} {
+		if entries[i].ID != exp {
+			t.Errorf("Expected %v at %v, got %v", exp, i, entries[i].ID)
+		}
+	}
+}
+
+func TestMoveToTrashDisabled(t *testing.T) {
+	defer func(d time.Duration) { globalConfig.TrashRetention = d }(
+		globalConfig.TrashRetention)
+	globalConfig.TrashRetention = 0
+
+	// Nothing is stored, so this doesn't need a database.
+	if err := moveToTrash("a", fileMeta{Type: "file"}); err != nil {
+		t.Errorf("Expected nothing to happen, got %v", err)
+	}
+}
+
+func TestUnderTrashPrefix(t *testing.T) {
+	tests := []struct {
+		path, prefix string
+		exp          bool
+	}{
+		{"a/b", "", true},
+		{"a", "a", true},
+		{"a/b", "a", true},
+		{"a/b", "/a/", true},
+		{"abc/d", "a", false},
+		{"ab", "a", false},
+	}
+
+	for _, test := range tests {
+		if got := underTrashPrefix(test.path, test.prefix); got != test.exp {
+			t.Errorf("Expected %v for %q under %q, got %v",
+				test.exp, test.path, test.prefix, got)
+		}
+	}
+}
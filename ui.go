@@ -0,0 +1,299 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How many recent error log lines a node keeps for the dashboard.
+const recentErrorCount = 50
+
+type loggedError struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"msg"`
+}
+
+// Remembers the last few log lines that mention an error.
+type errorRing struct {
+	mu     sync.Mutex
+	errors []loggedError
+	next   int
+}
+
+var recentErrors = &errorRing{}
+
+func (r *errorRing) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	if !strings.Contains(strings.ToLower(msg), "error") {
+		return len(p), nil
+	}
+	e := loggedError{time.Now(), msg}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.errors) < recentErrorCount {
+		r.errors = append(r.errors, e)
+	} else {
+		r.errors[r.next] = e
+	}
+	r.next = (r.next + 1) % recentErrorCount
+	return len(p), nil
+}
+
+// The remembered errors, newest first.
+func (r *errorRing) recent() []loggedError {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rv := make([]loggedError, 0, len(r.errors))
+	for i := 0; i < len(r.errors); i++ {
+		j := (r.next - 1 - i + 2*recentErrorCount) % recentErrorCount
+		if j < len(r.errors) {
+			rv = append(rv, r.errors[j])
+		}
+	}
+	return rv
+}
+
+// Keep recent errors for the dashboard in addition to logging them
+// wherever they were going.
+func initRecentErrors() {
+	log.SetOutput(io.MultiWriter(log.Writer(), recentErrors))
+}
+
+func doUI(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case strings.TrimSuffix(uiPrefix, "/"):
+		http.Redirect(w, req, uiPrefix, http.StatusMovedPermanently)
+	case uiPrefix:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, uiPage)
+	case uiStatusPath:
+		doUIStatus(w, req)
+	default:
+		http.Error(w, "Not found", 404)
+	}
+}
+
+// What the dashboard shows about the node serving it, beyond what the
+// node and task lists say.
+func doUIStatus(w http.ResponseWriter, req *http.Request) {
+	res := map[string]interface{}{
+		"node":          serverId,
+		"queueDepth":    len(internodeTaskQueue),
+		"queueCapacity": cap(internodeTaskQueue),
+		"errors":        recentErrors.recent(),
+	}
+	if under, err := underReplicatedCount(); err == nil {
+		res["underReplicated"] = under
+	} else {
+		res["underReplicatedError"] = err.Error()
+	}
+	sendJson(w, req, res)
+}
+
+const uiPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>cbfs</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; color: #222; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.1em; margin-top: 1.5em; border-bottom: 1px solid #ccc; }
+table { border-collapse: collapse; }
+th, td { text-align: left; padding: 2px 10px 2px 0; }
+td.num { text-align: right; }
+.bad { color: #b00; }
+.bar { background: #ddd; width: 120px; height: 10px; display: inline-block; }
+.bar span { background: #48c; height: 10px; display: block; }
+#errors td { font-family: monospace; font-size: 0.9em; }
+#browser a { cursor: pointer; }
+</style>
+</head>
+<body>
+<h1>cbfs <span id="node"></span></h1>
+
+<h2>Nodes</h2>
+<table id="nodes"></table>
+
+<h2>Replication</h2>
+<div id="replication"></div>
+
+<h2>Tasks</h2>
+<table id="tasks"></table>
+
+<h2>Recent errors</h2>
+<table id="errors"></table>
+
+<h2>Files</h2>
+<div id="path"></div>
+<table id="browser"></table>
+<p>
+<input type="file" id="upload" multiple>
+<button onclick="upload()">Upload here</button>
+</p>
+
+<script>
+var cwd = "";
+
+function el(tag, text, cls) {
+	var e = document.createElement(tag);
+	if (text !== undefined) e.textContent = text;
+	if (cls) e.className = cls;
+	return e;
+}
+
+function row(table, cells, header) {
+	var tr = el("tr");
+	cells.forEach(function(c) {
+		var td = el(header ? "th" : "td");
+		if (c instanceof Node) td.appendChild(c); else td.textContent = c;
+		tr.appendChild(td);
+	});
+	table.appendChild(tr);
+	return tr;
+}
+
+function clear(id) {
+	var e = document.getElementById(id);
+	while (e.firstChild) e.removeChild(e.firstChild);
+	return e;
+}
+
+function bytes(n) {
+	var units = ["B", "KB", "MB", "GB", "TB", "PB"], i = 0;
+	while (n >= 1000 && i < units.length - 1) { n /= 1000; i++; }
+	return (i ? n.toFixed(1) : n) + " " + units[i];
+}
+
+function get(path) {
+	return fetch(path, {credentials: "same-origin"}).then(function(res) {
+		if (res.status == 404) return null;
+		if (!res.ok) throw new Error(path + ": " + res.status + " " + res.statusText);
+		return res.json();
+	});
+}
+
+function showError(id, err) {
+	clear(id).appendChild(el("tr", String(err), "bad"));
+}
+
+function loadNodes() {
+	get("/.cbfs/nodes/").then(function(nodes) {
+		var t = clear("nodes");
+		row(t, ["node", "address", "zone", "heartbeat", "uptime", "used", "free", ""], true);
+		Object.keys(nodes).sort().forEach(function(name) {
+			var n = nodes[name], total = n.used + n.free;
+			var bar = el("span", undefined, "bar"), fill = el("span");
+			fill.style.width = (total ? 100 * n.used / total : 0) + "%";
+			bar.appendChild(fill);
+			var tr = row(t, [name, n.addr, n.zone || "", n.hbage_str + " ago",
+				n.uptime_str || "", bytes(n.used), bytes(n.free), bar]);
+			if (n.hbage_ms > 60000 || n.draining || n.stopping || n.maintenance) tr.className = "bad";
+		});
+	}).catch(function(err) { showError("nodes", err); });
+}
+
+function loadTasks() {
+	get("/.cbfs/tasks/").then(function(tasks) {
+		var t = clear("tasks");
+		row(t, ["node", "task", "state", "since", "detail"], true);
+		Object.keys(tasks || {}).sort().forEach(function(node) {
+			Object.keys(tasks[node]).sort().forEach(function(name) {
+				var s = tasks[node][name];
+				row(t, [node, name, s.state, s.ts, s.detail || ""]);
+			});
+		});
+	}).catch(function(err) { showError("tasks", err); });
+}
+
+function loadStatus() {
+	get("/.cbfs/ui/status").then(function(st) {
+		document.getElementById("node").textContent = "on " + st.node;
+		var r = clear("replication");
+		if (st.underReplicatedError) {
+			r.appendChild(el("div", st.underReplicatedError, "bad"));
+		} else {
+			r.appendChild(el("div", st.underReplicated + " under-replicated blobs",
+				st.underReplicated ? "bad" : ""));
+		}
+		r.appendChild(el("div", st.queueDepth + " of " + st.queueCapacity +
+			" internode tasks queued on this node"));
+		var t = clear("errors");
+		if (!st.errors.length) row(t, ["None"]);
+		st.errors.forEach(function(e) {
+			row(t, [new Date(e.time).toLocaleString(), e.msg]);
+		});
+	}).catch(function(err) { showError("errors", err); });
+}
+
+function fileURL(name) {
+	return "/" + (cwd ? cwd + "/" : "") + name.split("/").map(encodeURIComponent).join("/");
+}
+
+function browse(path) {
+	cwd = path;
+	var p = clear("path"), parts = path ? path.split("/") : [];
+	var root = el("a", "/");
+	root.href = "#";
+	root.onclick = function() { browse(""); return false; };
+	p.appendChild(root);
+	parts.forEach(function(part, i) {
+		var a = el("a", part + "/");
+		a.href = "#";
+		a.onclick = function() { browse(parts.slice(0, i + 1).join("/")); return false; };
+		p.appendChild(a);
+	});
+
+	get("/.cbfs/list/" + path + "?includeMeta=true").then(function(l) {
+		var t = clear("browser");
+		row(t, ["name", "size", "modified", ""], true);
+		l = l || {dirs: {}, files: {}};
+		Object.keys(l.dirs || {}).sort().forEach(function(d) {
+			var a = el("a", d + "/");
+			a.onclick = function() { browse((cwd ? cwd + "/" : "") + d); };
+			row(t, [a, "", "", ""]);
+		});
+		Object.keys(l.files || {}).sort().forEach(function(f) {
+			var m = l.files[f] || {};
+			var a = el("a", f);
+			a.href = fileURL(f);
+			var del = el("button", "delete");
+			del.onclick = function() { remove(f); };
+			row(t, [a, m.length === undefined ? "" : bytes(m.length),
+				m.modified || "", del]);
+		});
+	}).catch(function(err) { showError("browser", err); });
+}
+
+function upload() {
+	var files = document.getElementById("upload").files;
+	Promise.all(Array.prototype.map.call(files, function(f) {
+		return fetch(fileURL(f.name), {method: "PUT", body: f,
+			credentials: "same-origin",
+			headers: {"Content-Type": f.type || "application/octet-stream"}});
+	})).then(function() { browse(cwd); }).catch(alert);
+}
+
+function remove(name) {
+	if (!confirm("Delete " + name + "?")) return;
+	fetch(fileURL(name), {method: "DELETE", credentials: "same-origin"})
+		.then(function() { browse(cwd); }).catch(alert);
+}
+
+function refresh() {
+	loadNodes();
+	loadTasks();
+	loadStatus();
+}
+
+refresh();
+browse("");
+setInterval(refresh, 30000);
+</script>
+</body>
+</html>
+`
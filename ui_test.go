@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestErrorRing(t *testing.T) {
+	r := &errorRing{}
+	fmt.Fprintf(r, "Doing fine\n")
+	if got := r.recent(); len(got) != 0 {
+		t.Errorf("Expected nothing but errors to be kept, got %v", got)
+	}
+
+	for i := 0; i < recentErrorCount+5; i++ {
+		fmt.Fprintf(r, "Error number %v\n", i)
+	}
+	got := r.recent()
+	if len(got) != recentErrorCount {
+		t.Fatalf("Expected %v errors, got %v", recentErrorCount, len(got))
+	}
+	first := fmt.Sprintf("Error number %v", recentErrorCount+4)
+	last := fmt.Sprintf("Error number %v", 5)
+	if got[0].Message != first || got[len(got)-1].Message != last {
+		t.Errorf("Expected errors %q to %q, got %q to %q",
+			first, last, got[0].Message, got[len(got)-1].Message)
+	}
+}
+
+func TestUIPage(t *testing.T) {
+	w := httptest.NewRecorder()
+	doUI(w, httptest.NewRequest("GET", "/.cbfs/ui", nil))
+	if w.Code != 301 || w.Header().Get("Location") != uiPrefix {
+		t.Errorf("Expected a redirect to %v, got %v %v",
+			uiPrefix, w.Code, w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	doUI(w, httptest.NewRequest("GET", uiPrefix, nil))
+	if w.Code != 200 || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") ||
+		!strings.Contains(w.Body.String(), uiStatusPath) {
+		t.Errorf("Expected the dashboard, got %v %v", w.Code, w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	doUI(w, httptest.NewRequest("GET", uiPrefix+"nope", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown page, got %v", w.Code)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Headers stored with a file, returned with it and searchable by
+// the part of their name after this.
+const userMetaPrefix = "x-cbfs-meta-"
+
+const metaSearchLimit = 1000
+
+func isUserMetaHeader(k string) bool {
+	return strings.HasPrefix(strings.ToLower(k), userMetaPrefix)
+}
+
+// Make sure the user metadata in some headers isn't too big.
+func checkUserMeta(h http.Header) error {
+	size := 0
+	for k, vs := range h {
+		if !isUserMetaHeader(k) {
+			continue
+		}
+		size += len(k) - len(userMetaPrefix)
+		for _, v := range vs {
+			size += len(v)
+		}
+	}
+	if max := globalConfig.MaxUserMeta; max > 0 && size > max {
+		return fmt.Errorf("user metadata is %v bytes, more than the %v allowed",
+			size, max)
+	}
+	return nil
+}
+
+// Find the files with a user metadata header, optionally limited to
+// those with a particular value.
+func searchUserMeta(name, value string, hasValue bool,
+	limit int) ([]string, error) {
+
+	name = strings.ToLower(name)
+	params := map[string]interface{}{
+		"limit": limit,
+	}
+	if hasValue {
+		params["key"] = []string{name, value}
+	} else {
+		params["start_key"] = []interface{}{name}
+		params["end_key"] = []interface{}{name, &(json.RawMessage{'{', '}'})}
+	}
+
+	viewRes := struct {
+		Rows []struct {
+			Value string
+		}
+	}{}
+	err := couchbase.ViewCustom("cbfs", "file_meta", params, &viewRes)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := make([]string, 0, len(viewRes.Rows))
+	for _, r := range viewRes.Rows {
+		rv = append(rv, r.Value)
+	}
+	return rv, nil
+}
+
+func doSearchUserMeta(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	name := req.FormValue("name")
+	if name == "" {
+		http.Error(w, "Missing name parameter", 400)
+		return
+	}
+	_, hasValue := req.Form["value"]
+
+	limit := metaSearchLimit
+	if s := req.FormValue("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, fmt.Sprintf("Invalid limit: %q", s), 400)
+			return
+		}
+		limit = n
+	}
+
+	files, err := searchUserMeta(name, req.FormValue("value"), hasValue, limit)
+	if err != nil {
+		log.Printf("Error searching for %v metadata: %v", name, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	sendJson(w, req, map[string]interface{}{"files": files})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCheckUserMeta(t *testing.T) {
+	defer func(m int) { globalConfig.MaxUserMeta = m }(globalConfig.MaxUserMeta)
+	globalConfig.MaxUserMeta = 9
+
+	tests := []struct {
+		hdr http.Header
+		ok  bool
+	}{
+		{http.Header{}, true},
+		{http.Header{"X-Cbfs-Meta-Owner": {"bob"}}, true},
+		{http.Header{"X-Cbfs-Meta-Owner": {"bob", "al"}}, false},
+		{http.Header{"X-Cbfs-Meta-A": {"1"}, "X-Cbfs-Meta-B": {"1234567"}}, false},
+		{http.Header{"Content-Type": {strings.Repeat("x", 100)}}, true},
+	}
+
+	for _, test := range tests {
+		err := checkUserMeta(test.hdr)
+		if (err == nil) != test.ok {
+			t.Errorf("Expected ok=%v for %v, got %v", test.ok, test.hdr, err)
+		}
+	}
+
+	globalConfig.MaxUserMeta = 0
+	if err := checkUserMeta(tests[2].hdr); err != nil {
+		t.Errorf("Expected no limit, got %v", err)
+	}
+}
+
+func TestIsResponseHeader(t *testing.T) {
+	tests := map[string]bool{
+		"Content-Type":       true,
+		"X-Cbfs-Meta-Owner":  true,
+		"x-cbfs-meta-source": true,
+		"X-Cbfs-Hash":        false,
+		"Authorization":      false,
+	}
+	for h, exp := range tests {
+		if got := isResponseHeader(h); got != exp {
+			t.Errorf("Expected %v for %v, got %v", exp, h, got)
+		}
+	}
+}
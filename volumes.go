@@ -0,0 +1,141 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var extraVolumes = flag.String("volumes", "",
+	"Comma separated storage locations to use as well as -root "+
+		"(e.g. one per disk)")
+
+// Space on one of this node's storage locations.
+type volumeInfo struct {
+	Path string `json:"path"`
+	Free int64  `json:"free"`
+	// As of the last reconcile
+	Used  int64 `json:"used"`
+	Blobs int64 `json:"blobs"`
+}
+
+var volumeUsageLock sync.Mutex
+var volumeUsage = map[string]volumeInfo{}
+
+// Every directory blobs are stored in, -root first.
+func volumes() []string {
+	rv := []string{*root}
+	for _, v := range strings.Split(*extraVolumes, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" && v != *root {
+			rv = append(rv, v)
+		}
+	}
+	return rv
+}
+
+// The volume a blob's on, if any.
+func blobVolume(oid string) (string, bool) {
+	vols := volumes()
+	for _, v := range vols {
+		if _, err := os.Stat(hashFilename(v, oid)); err == nil {
+			return v, true
+		}
+	}
+	return vols[0], false
+}
+
+// The local file holding a blob.  If no volume has it, this is where
+// it'd be on -root.
+func blobFilename(oid string) string {
+	v, _ := blobVolume(oid)
+	return hashFilename(v, oid)
+}
+
+// The volume new blobs should go on: the one with the most free
+// space.
+func pickVolume() string {
+	vols := volumes()
+	if len(vols) == 1 {
+		return vols[0]
+	}
+	rv, most := vols[0], int64(-1)
+	for _, v := range vols {
+		free, err := filesystemFree(v)
+		if err != nil {
+			if err != noFSFree {
+				log.Printf("Error getting free space of %v: %v", v, err)
+			}
+			continue
+		}
+		if free > most {
+			rv, most = v, free
+		}
+	}
+	return rv
+}
+
+// Free space across all volumes.
+func volumesFree() (int64, error) {
+	total := int64(0)
+	for _, v := range volumes() {
+		free, err := filesystemFree(v)
+		if err != nil {
+			return free, err
+		}
+		total += free
+	}
+	return total, nil
+}
+
+// Remember what a walk over a volume found.
+func recordVolumeUsage(path string, blobs, used int64) {
+	volumeUsageLock.Lock()
+	defer volumeUsageLock.Unlock()
+	volumeUsage[path] = volumeInfo{Path: path, Used: used, Blobs: blobs}
+}
+
+func volumeInfos() []volumeInfo {
+	volumeUsageLock.Lock()
+	defer volumeUsageLock.Unlock()
+
+	rv := []volumeInfo{}
+	for _, v := range volumes() {
+		vi := volumeUsage[v]
+		vi.Path = v
+		vi.Free, _ = filesystemFree(v)
+		rv = append(rv, vi)
+	}
+	return rv
+}
+
+// Walk the blobs on every volume, calling f with each one's info, and
+// note how much space each volume's blobs use.  Quarantined blobs are
+// skipped.
+func walkLocalBlobs(f func(info os.FileInfo) error) error {
+	for _, v := range volumes() {
+		qdir := filepath.Join(v, quarantineDir)
+		blobs, used := int64(0), int64(0)
+		err := filepath.Walk(v, func(path string, info os.FileInfo, err error) error {
+			switch {
+			case err != nil:
+				return err
+			case info.IsDir() && path == qdir:
+				return filepath.SkipDir
+			case info.IsDir(), !isBlobName(info.Name()):
+				return nil
+			}
+			blobs++
+			used += info.Size()
+			return f(info)
+		})
+		if err != nil {
+			return err
+		}
+		recordVolumeUsage(v, blobs, used)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBlobVolume(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "voltest")
+	if err != nil {
+		t.Fatalf("Error making tmp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer func(r, v string) { *root, *extraVolumes = r, v }(*root,
+		*extraVolumes)
+
+	v1, v2 := filepath.Join(tmpdir, "v1"), filepath.Join(tmpdir, "v2")
+	*root = v1
+	*extraVolumes = v2 + ", " + v1 + ","
+	if got := volumes(); !reflect.DeepEqual(got, []string{v1, v2}) {
+		t.Fatalf("Expected volumes %v, got %v", []string{v1, v2}, got)
+	}
+
+	oid := "bb02"
+	fn := hashFilename(v2, oid)
+	os.MkdirAll(filepath.Dir(fn), 0777)
+	if err := ioutil.WriteFile(fn, []byte("x"), 0666); err != nil {
+		t.Fatalf("Error writing blob: %v", err)
+	}
+
+	if v, ok := blobVolume(oid); v != v2 || !ok {
+		t.Errorf("Expected %v on %v, got %v, %v", oid, v2, v, ok)
+	}
+	if got := blobFilename("cc03"); got != hashFilename(v1, "cc03") {
+		t.Errorf("Expected missing blob on %v, got %v", v1, got)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/config"
+)
+
+var webhookWorkers = flag.Int("webhookWorkers", 4,
+	"Number of concurrent webhook deliveries")
+var webhookDeadLetters = flag.String("webhookDeadLetters", "",
+	"File undeliverable webhook events are appended to "+
+		"(default .webhooks-dead.json under -root)")
+
+const (
+	webhookAttempts  = 5
+	webhookQueueSize = 1024
+
+	webhookSignatureHeader = "X-CBFS-Signature"
+)
+
+// Delay before the first retry; it doubles after each failure.
+var webhookBackoff = time.Second
+
+var webhookClient = &http.Client{Timeout: 30 * time.Second}
+
+var webhookQueue = make(chan webhookDelivery, webhookQueueSize)
+
+// Something that happened to a file, as sent to webhooks.
+type objectEvent struct {
+	Seq      uint64    `json:"seq,omitempty"`
+	Event    string    `json:"event"`
+	Path     string    `json:"path"`
+	OID      string    `json:"oid,omitempty"`
+	Length   int64     `json:"length"`
+	Revno    int       `json:"revno"`
+	Modified time.Time `json:"modified"`
+	Time     time.Time `json:"time"`
+	Node     string    `json:"node"`
+}
+
+type webhookDelivery struct {
+	Hook  cbfsconfig.Webhook `json:"hook"`
+	Event objectEvent        `json:"event"`
+}
+
+// What's written to the dead letter log when a delivery gives up.
+type deadLetter struct {
+	webhookDelivery
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	Failed   time.Time `json:"failed"`
+}
+
+// Record something that happened to the file at path in the changes
+// feed and tell interested webhooks.  Webhook delivery is
+// asynchronous; if the queue's full the event goes straight to the
+// dead letter log rather than holding up the caller.
+func notifyObject(event, path string, fm fileMeta) {
+	ev := objectEvent{
+		Event:    event,
+		Path:     path,
+		OID:      fm.OID,
+		Length:   fm.Length,
+		Revno:    fm.Revno,
+		Modified: fm.Modified,
+		Time:     time.Now().UTC(),
+		Node:     serverId,
+	}
+	if err := recordChange(&ev); err != nil {
+		log.Printf("Error recording %v of %v in changes feed: %v",
+			event, path, err)
+	}
+	for _, h := range globalConfig.WebhooksFor(event, path) {
+		d := webhookDelivery{h, ev}
+		select {
+		case webhookQueue <- d:
+		default:
+			recordDeadLetter(d, 0, fmt.Errorf("webhook queue full"))
+		}
+	}
+}
+
+// The path a file's events are reported under.
+func eventPath(k string, fm fileMeta) string {
+	if fm.Name != "" {
+		return fm.Name
+	}
+	return k
+}
+
+func startWebhooks() {
+	for i := 0; i < *webhookWorkers; i++ {
+		go webhookWorker()
+	}
+}
+
+func webhookWorker() {
+	for d := range webhookQueue {
+		deliverWebhook(d)
+	}
+}
+
+// Send an event, backing off between attempts, and record it as a
+// dead letter if it never gets through.
+func deliverWebhook(d webhookDelivery) {
+	body, err := json.Marshal(d.Event)
+	if err != nil {
+		recordDeadLetter(d, 0, err)
+		return
+	}
+	delay := webhookBackoff
+	for i := 1; ; i++ {
+		err = postWebhook(d.Hook, body)
+		if err == nil {
+			return
+		}
+		if i == webhookAttempts {
+			log.Printf("Giving up on %v event for %v to %v: %v",
+				d.Event.Event, d.Event.Path, d.Hook.URL, err)
+			recordDeadLetter(d, i, err)
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func postWebhook(h cbfsconfig.Webhook, body []byte) error {
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.Secret != "" {
+		req.Header.Set(webhookSignatureHeader, signWebhook(h.Secret, body))
+	}
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("HTTP error: %v", res.Status)
+	}
+	return nil
+}
+
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+var deadLetterLock sync.Mutex
+
+func deadLetterPath() string {
+	if *webhookDeadLetters != "" {
+		return *webhookDeadLetters
+	}
+	return filepath.Join(*root, ".webhooks-dead.json")
+}
+
+// Append an undeliverable event to the dead letter log, one JSON
+// object per line.
+func recordDeadLetter(d webhookDelivery, attempts int, err error) {
+	d.Hook.Secret = ""
+	data, jerr := json.Marshal(deadLetter{d, attempts, err.Error(),
+		time.Now().UTC()})
+	if jerr != nil {
+		log.Printf("Error encoding dead letter: %v", jerr)
+		return
+	}
+
+	deadLetterLock.Lock()
+	defer deadLetterLock.Unlock()
+
+	f, ferr := os.OpenFile(deadLetterPath(),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if ferr != nil {
+		log.Printf("Error opening dead letter log: %v", ferr)
+		return
+	}
+	defer f.Close()
+	if _, ferr := f.Write(append(data, '\n')); ferr != nil {
+		log.Printf("Error writing dead letter: %v", ferr)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/config"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+	got := make(chan *http.Request, 1)
+	var body []byte
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			body, _ = ioutil.ReadAll(req.Body)
+			got <- req
+		}))
+	defer s.Close()
+
+	ev := objectEvent{Event: "created", Path: "a/b", OID: "x", Length: 3}
+	deliverWebhook(webhookDelivery{
+		cbfsconfig.Webhook{URL: s.URL, Secret: "sekrit"}, ev})
+
+	req := <-got
+	sig := req.Header.Get(webhookSignatureHeader)
+	if exp := signWebhook("sekrit", body); sig != exp {
+		t.Errorf("Expected signature %v, got %v", exp, sig)
+	}
+	sent := objectEvent{}
+	if err := json.Unmarshal(body, &sent); err != nil {
+		t.Fatalf("Error decoding %s: %v", body, err)
+	}
+	if sent != ev {
+		t.Errorf("Expected %+v, got %+v", ev, sent)
+	}
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	defer func(d time.Duration) { webhookBackoff = d }(webhookBackoff)
+	webhookBackoff = time.Millisecond
+
+	dir, err := ioutil.TempDir("", "webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(s string) { *webhookDeadLetters = s }(*webhookDeadLetters)
+	*webhookDeadLetters = filepath.Join(dir, "dead.json")
+
+	tries := 0
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			tries++
+			http.Error(w, "nope", 503)
+		}))
+	defer s.Close()
+
+	deliverWebhook(webhookDelivery{
+		cbfsconfig.Webhook{URL: s.URL, Secret: "sekrit"},
+		objectEvent{Event: "deleted", Path: "a/b"}})
+
+	if tries != webhookAttempts {
+		t.Errorf("Expected %v attempts, got %v", webhookAttempts, tries)
+	}
+
+	f, err := os.Open(*webhookDeadLetters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	if !sc.Scan() {
+		t.Fatalf("Expected a dead letter")
+	}
+	dl := deadLetter{}
+	if err := json.Unmarshal(sc.Bytes(), &dl); err != nil {
+		t.Fatalf("Error decoding %s: %v", sc.Bytes(), err)
+	}
+	if dl.Event.Path != "a/b" || dl.Attempts != webhookAttempts ||
+		dl.Hook.URL != s.URL || dl.Hook.Secret != "" {
+		t.Errorf("Unexpected dead letter: %+v", dl)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"archive/zip"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"strings"
@@ -24,6 +25,15 @@ func archiveFilename(path, ext string) string {
 func doZipDocs(w http.ResponseWriter, req *http.Request,
 	path string) {
 
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=%q", archiveFilename(path, "zip")))
+	w.Header().Set("Content-Type", "application/zip")
+	w.WriteHeader(200)
+	writeZip(w, path)
+}
+
+// Write a zip of everything under path.
+func writeZip(w io.Writer, path string) {
 	quit := make(chan bool)
 	defer close(quit)
 	ch := make(chan *namedFile)
@@ -32,11 +42,6 @@ func doZipDocs(w http.ResponseWriter, req *http.Request,
 	go pathGenerator(path, ch, cherr, quit)
 	go logErrors("zip", cherr)
 
-	w.Header().Set("Content-Disposition",
-		fmt.Sprintf("attachment; filename=%q", archiveFilename(path, "zip")))
-	w.Header().Set("Content-Type", "application/zip")
-	w.WriteHeader(200)
-
 	zw := zip.NewWriter(w)
 	for nf := range ch {
 		if nf.err != nil {
@@ -59,7 +64,7 @@ func doZipDocs(w http.ResponseWriter, req *http.Request,
 			return
 		}
 
-		err = copyBlob(zf, nf.meta.OID)
+		err = copyFileContent(zf, nf.meta)
 		if err != nil {
 			log.Printf("Error copying blob for %v: %v",
 				nf.name, err)
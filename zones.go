@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	cb "github.com/couchbaselabs/go-couchbase"
+)
+
+var zone = flag.String("zone", "",
+	"Zone or rack this node is in; replicas are spread across zones")
+
+const zoneReportKey = "/@zoneReport"
+
+// Sent by clients to say which zone they're in, so their reads can be
+// served from a node in it.
+const zoneHeader = "X-CBFS-Zone"
+
+// Results of the last zone check.
+type zoneReport struct {
+	Checked    int       `json:"checked"`
+	Violations int       `json:"violations"`
+	Moved      int       `json:"moved"`
+	Time       time.Time `json:"time"`
+}
+
+// Order nodes so those in zones not in used come first, taking one
+// node per new zone before any second.  Nodes with no zone never
+// count as sharing one.
+func (nl NodeList) spreadAcrossZones(used map[string]bool) NodeList {
+	seen := map[string]bool{}
+	for z := range used {
+		seen[z] = true
+	}
+	first, rest := NodeList{}, NodeList{}
+	for _, n := range nl {
+		if n.Zone == "" || !seen[n.Zone] {
+			first = append(first, n)
+			if n.Zone != "" {
+				seen[n.Zone] = true
+			}
+		} else {
+			rest = append(rest, n)
+		}
+	}
+	return append(first, rest...)
+}
+
+// Order copies for removal: second and later copies in a zone first.
+func (nl NodeList) pruneOrder() NodeList {
+	seen := map[string]bool{}
+	extra, rest := NodeList{}, NodeList{}
+	for _, n := range nl {
+		if n.Zone != "" && seen[n.Zone] {
+			extra = append(extra, n)
+		} else {
+			rest = append(rest, n)
+		}
+		seen[n.Zone] = true
+	}
+	return append(extra, rest...)
+}
+
+// Order nodes so those in zone z come first, otherwise keeping their
+// order.
+func (nl NodeList) preferZone(z string) NodeList {
+	if z == "" {
+		return nl
+	}
+	near, far := NodeList{}, NodeList{}
+	for _, n := range nl {
+		if n.Zone == z {
+			near = append(near, n)
+		} else {
+			far = append(far, n)
+		}
+	}
+	return append(near, far...)
+}
+
+// The zone a request comes from: the one the client names, or else
+// this node's.
+func requestZone(req *http.Request) string {
+	if z := req.Header.Get(zoneHeader); z != "" {
+		return z
+	}
+	return *zone
+}
+
+// Send a client in another zone to a live node in its own that holds
+// the whole file, if there is one, rather than serve it across zones.
+// Returns whether it did.
+func redirectToZone(w http.ResponseWriter, req *http.Request,
+	fm fileMeta) bool {
+
+	z := req.Header.Get(zoneHeader)
+	if z == "" || z == *zone || req.Method != "GET" {
+		return false
+	}
+	nl, err := fileNodes(fm)
+	if err != nil {
+		log.Printf("Error finding the nodes holding %v: %v", fm.OID, err)
+		return false
+	}
+	for _, n := range nl {
+		fresh := time.Since(n.Time) < globalConfig.StaleNodeLimit
+		if n.Zone == z && fresh && !n.Stopping {
+			http.Redirect(w, req, n.URLFor(req.URL.RequestURI()),
+				http.StatusTemporaryRedirect)
+			return true
+		}
+	}
+	return false
+}
+
+func (nl NodeList) zones() map[string]bool {
+	rv := map[string]bool{}
+	for _, n := range nl {
+		if n.Zone != "" {
+			rv[n.Zone] = true
+		}
+	}
+	return rv
+}
+
+// Find a copy of a blob that shares its zone with another copy while
+// some live node in another zone has none, and a node to move it to.
+func zoneViolation(holders, nl NodeList, length int64) (from, to StorageNode, ok bool) {
+	byZone := map[string]NodeList{}
+	for _, n := range holders {
+		if n.Zone != "" {
+			byZone[n.Zone] = append(byZone[n.Zone], n)
+		}
+	}
+
+	var crowded NodeList
+	for _, ns := range byZone {
+		if len(ns) > 1 {
+			crowded = ns
+			break
+		}
+	}
+	if crowded == nil {
+		return
+	}
+
+	used := holders.zones()
+	for _, n := range nl.minus(holders).accepting().withAtLeast(length) {
+		fresh := time.Since(n.Time) < globalConfig.StaleNodeLimit
+		if n.Zone != "" && !used[n.Zone] && fresh {
+			return crowded[len(crowded)-1], n, true
+		}
+	}
+	return
+}
+
+// Move copies so no zone has more than one while another has none.
+func checkZones() error {
+	nl, err := findAllNodes()
+	if err != nil {
+		return err
+	}
+	if len(nl.zones()) < 2 {
+		return nil
+	}
+	nm := map[string]StorageNode{}
+	for _, n := range nl {
+		nm[n.name] = n
+	}
+
+	report := zoneReport{Time: time.Now().UTC()}
+	err = checkZonesIn("repcounts", map[string]interface{}{"startkey": 2},
+		nl, nm, &report)
+	if err == nil {
+		err = checkZonesIn("replica_policy", map[string]interface{}{},
+			nl, nm, &report)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Checked zones of %v blobs: %v violations, %v moving",
+		report.Checked, report.Violations, report.Moved)
+	return couchbase.Set(zoneReportKey, 0, report)
+}
+
+// Check the zones of the blobs a view emits, a page at a time.
+func checkZonesIn(view string, params map[string]interface{},
+	nl NodeList, nm map[string]StorageNode, report *zoneReport) error {
+
+	params["reduce"] = false
+	params["include_docs"] = true
+	params["limit"] = globalConfig.ReplicationCheckLimit
+	params["stale"] = false
+
+	for {
+		viewRes := struct {
+			Rows []struct {
+				Id  string
+				Key int
+				Doc struct {
+					Json struct {
+						Nodes  map[string]string
+						Length int64
+					}
+				}
+			}
+			Errors []cb.ViewError
+		}{}
+
+		err := couchbase.ViewCustom("cbfs", view, params, &viewRes)
+		if err != nil {
+			return err
+		}
+		if len(viewRes.Errors) > 0 {
+			return fmt.Errorf("View errors: %v", viewRes.Errors)
+		}
+
+		for _, r := range viewRes.Rows {
+			report.Checked++
+			holders := NodeList{}
+			for n := range r.Doc.Json.Nodes {
+				if sn, ok := nm[n]; ok {
+					holders = append(holders, sn)
+				}
+			}
+			from, to, bad := zoneViolation(holders, nl, r.Doc.Json.Length)
+			if !bad {
+				continue
+			}
+			report.Violations++
+			oid := r.Id[1:]
+			if maybeQueueBlobAcquire(to, oid, from.name) {
+				log.Printf("Moving %v from %v to %v to spread zones",
+					oid, from, to)
+				report.Moved++
+			}
+		}
+
+		if !relockTask("checkZones") {
+			return errors.New("Lost lock")
+		}
+		if len(viewRes.Rows) < globalConfig.ReplicationCheckLimit {
+			break
+		}
+		last := viewRes.Rows[len(viewRes.Rows)-1]
+		params["startkey"] = last.Key
+		params["startkey_docid"] = last.Id
+		params["skip"] = 1
+	}
+	return nil
+}
+
+func doListZones(w http.ResponseWriter, req *http.Request) {
+	nl, err := findAllNodes()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	zones := map[string][]string{}
+	for _, n := range nl {
+		zones[n.Zone] = append(zones[n.Zone], n.name)
+	}
+	for _, names := range zones {
+		sort.Strings(names)
+	}
+
+	report := zoneReport{}
+	if err := couchbase.Get(zoneReportKey, &report); err != nil {
+		log.Printf("Error getting zone report: %v", err)
+	}
+
+	sendJson(w, req, map[string]interface{}{
+		"zones":  zones,
+		"report": report,
+	})
+}
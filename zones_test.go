@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func testZoneNodes() NodeList {
+	now := time.Now()
+	mk := func(name, zone string) StorageNode {
+		return StorageNode{name: name, Zone: zone, Time: now, Free: 1 << 30}
+	}
+	return NodeList{
+		mk("a1", "a"), mk("a2", "a"), mk("b1", "b"),
+		mk("b2", "b"), mk("c1", "c"), mk("none", ""),
+	}
+}
+
+func nodeNames(nl NodeList) []string {
+	rv := []string{}
+	for _, n := range nl {
+		rv = append(rv, n.name)
+	}
+	return rv
+}
+
+func TestSpreadAcrossZones(t *testing.T) {
+	nl := testZoneNodes()
+
+	tests := []struct {
+		used map[string]bool
+		exp  string
+	}{
+		{nil, "[a1 b1 c1 none a2 b2]"},
+		{map[string]bool{"a": true}, "[b1 c1 none a1 a2 b2]"},
+		{map[string]bool{"a": true, "b": true, "c": true},
+			"[none a1 a2 b1 b2 c1]"},
+	}
+
+	for _, test := range tests {
+		got := nodeNames(nl.spreadAcrossZones(test.used))
+		if s := fmt.Sprint(got); s != test.exp {
+			t.Errorf("Expected %v with %v used, got %v", test.exp, test.used, s)
+		}
+	}
+}
+
+func TestPruneOrder(t *testing.T) {
+	nl := testZoneNodes()
+	got := fmt.Sprint(nodeNames(nl.pruneOrder()))
+	if exp := "[a2 b2 a1 b1 c1 none]"; got != exp {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+}
+
+func TestPreferZone(t *testing.T) {
+	nl := testZoneNodes()
+	tests := []struct {
+		zone, exp string
+	}{
+		{"", "[a1 a2 b1 b2 c1 none]"},
+		{"b", "[b1 b2 a1 a2 c1 none]"},
+		{"d", "[a1 a2 b1 b2 c1 none]"},
+	}
+	for _, test := range tests {
+		got := fmt.Sprint(nodeNames(nl.preferZone(test.zone)))
+		if got != test.exp {
+			t.Errorf("Expected %v preferring %q, got %v",
+				test.exp, test.zone, got)
+		}
+	}
+}
+
+func TestNotLocalURLs(t *testing.T) {
+	e := errNotLocal{"abc", NodeList{
+		{name: "a", Zone: "a", BindAddr: "a:8484"},
+		{name: "b", Zone: "b", BindAddr: "b:8484"},
+	}}
+	got := e.urls("b")
+	if len(got) != 2 || got[0] != "http://b:8484/.cbfs/blob/abc" {
+		t.Errorf("Expected the node in b first, got %v", got)
+	}
+}
+
+func TestZoneViolation(t *testing.T) {
+	nl := testZoneNodes()
+	byName := map[string]StorageNode{}
+	for _, n := range nl {
+		byName[n.name] = n
+	}
+	holders := func(names ...string) NodeList {
+		rv := NodeList{}
+		for _, n := range names {
+			rv = append(rv, byName[n])
+		}
+		return rv
+	}
+
+	tests := []struct {
+		holders  NodeList
+		from, to string
+	}{
+		{holders("a1", "b1"), "", ""},
+		{holders("a1", "a2"), "a2", "b1"},
+		{holders("a1", "a2", "b1"), "a2", "c1"},
+		{holders("a1", "a2", "b1", "c1"), "", ""},
+		{holders("none", "a1"), "", ""},
+	}
+
+	for _, test := range tests {
+		from, to, ok := zoneViolation(test.holders, nl, 100)
+		if ok != (test.from != "") || from.name != test.from || to.name != test.to {
+			t.Errorf("Expected %q -> %q for %v, got %q -> %q (%v)",
+				test.from, test.to, nodeNames(test.holders),
+				from.name, to.name, ok)
+		}
+	}
+}